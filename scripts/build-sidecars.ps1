@@ -34,8 +34,9 @@ if (Test-Path $GoDir) {
     try {
         $GoOut = Join-Path $BinDir "lumina-net-$TargetTriple$Ext"
         
-        # Build command
-        go build -o $GoOut
+        # Build command; LUMINA_UPDATE_PUBLIC_KEY is the base64 Ed25519 key
+        # release manifests are signed with, needed for self-update
+        go build -ldflags "-X main.updatePublicKey=$env:LUMINA_UPDATE_PUBLIC_KEY" -o $GoOut
         
         if ($LASTEXITCODE -eq 0) {
             Write-Host "Go Sidecar built successfully: $GoOut" -ForegroundColor Green
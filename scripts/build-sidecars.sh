@@ -33,8 +33,9 @@ if [ -d "$GO_DIR" ]; then
     pushd "$GO_DIR" > /dev/null
     GO_OUT="$BIN_DIR/lumina-net-$TARGET_TRIPLE$EXT"
     
-    # Build command
-    go build -o "$GO_OUT"
+    # Build command; LUMINA_UPDATE_PUBLIC_KEY is the base64 Ed25519 key
+    # release manifests are signed with, needed for self-update
+    go build -ldflags "-X main.updatePublicKey=${LUMINA_UPDATE_PUBLIC_KEY:-}" -o "$GO_OUT"
     
     if [ $? -eq 0 ]; then
         echo "Go Sidecar built successfully: $GO_OUT"
@@ -0,0 +1,746 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"compress/flate"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// send_archive packs a selection of files and folders into one zip or
+// tar.zst archive while it is being sent, so nothing is staged on disk
+// first. Zip archives can be password-protected with AES. The archive's
+// length is not known up front, so its header announces Size -1, which
+// older receivers refuse, and the body travels in length-prefixed chunks
+// ending with an empty one, followed by the usual SHA-256 trailer. With
+// extract set the receiver unpacks the archive into a folder named after
+// it; encrypted archives are kept as they are for extract_archive. The
+// receiver holds the sender to the announced size: the body may not
+// outgrow the files plus what each entry costs in the archive, and
+// unpacking stops once it writes more than the files add up to.
+const (
+	archiveZip     = "zip"
+	archiveTarZstd = "tar.zst"
+
+	// archiveEntryOverhead bounds the headers and padding of one entry,
+	// archiveSlack the rest of the archive's own structure
+	archiveEntryOverhead = 2 << 10
+	archiveSlack         = 1 << 20
+)
+
+var errArchiveTooLarge = errors.New("archive is larger than announced")
+
+// archiveBodyLimit is the most an archive announced by h may take on
+// the wire
+func archiveBodyLimit(h TransferHeader) int64 {
+	return h.Unpacked + h.Unpacked/64 + int64(h.Entries+1)*archiveEntryOverhead + archiveSlack
+}
+
+// archiveExt is the file extension of each format
+func archiveExt(format string) string {
+	return "." + format
+}
+
+func validArchiveFormat(format string) bool {
+	return format == archiveZip || format == archiveTarZstd
+}
+
+// archiveEntry is one file or directory going into an archive
+type archiveEntry struct {
+	name     string // slash-separated path inside the archive
+	path     string
+	dir      bool
+	size     int64
+	mode     fs.FileMode
+	modified time.Time
+}
+
+// collectArchive lists paths and everything under the directories among
+// them, each under its base name. Symlinks and special files are left
+// out, as in directory transfers.
+func collectArchive(paths []string) ([]archiveEntry, int64, error) {
+	var entries []archiveEntry
+	var total int64
+	seen := make(map[string]bool)
+	for _, root := range paths {
+		root = filepath.Clean(root)
+		base := filepath.Base(root)
+		if seen[base] {
+			return nil, 0, catalogError(ErrFailed, "archive.two_paths_named", "base", base)
+		}
+		seen[base] = true
+		if _, err := os.Stat(root); err != nil {
+			return nil, 0, err
+		}
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.IsDir() && !d.Type().IsRegular() {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			e := archiveEntry{
+				name:     filepath.ToSlash(filepath.Join(base, rel)),
+				path:     path,
+				dir:      d.IsDir(),
+				mode:     info.Mode(),
+				modified: info.ModTime(),
+			}
+			if !e.dir {
+				e.size = info.Size()
+				total += e.size
+			}
+			entries = append(entries, e)
+			return nil
+		})
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	if len(entries) == 0 {
+		return nil, 0, catalogError(ErrFailed, "archive.nothing_archive")
+	}
+	return entries, total, nil
+}
+
+// ArchiveOptions says how send_archive packs its files
+type ArchiveOptions struct {
+	Format   string `json:"format"`   // "zip" (default) or "tar.zst"
+	Level    int    `json:"level"`    // deflate 1-9 for zip, zstd 1-22 for tar.zst, 0 for the default
+	Password string `json:"password"` // zip only: encrypt entries with AES-256
+}
+
+func (o *ArchiveOptions) Validate() error {
+	if o.Format == "" {
+		o.Format = archiveZip
+	}
+	switch o.Format {
+	case archiveZip:
+		if o.Level < 0 || o.Level > flate.BestCompression {
+			return catalogError(ErrInvalidArgument, "archive.zip_level_must_between")
+		}
+	case archiveTarZstd:
+		if o.Level < 0 || o.Level > 22 {
+			return catalogError(ErrInvalidArgument, "archive.tar_zst_level_must")
+		}
+		if o.Password != "" {
+			return catalogError(ErrInvalidArgument, "archive.password_requires_format_zip")
+		}
+	default:
+		return catalogError(ErrUnsupported, "archive.unsupported_archive_format", "format", o.Format)
+	}
+	return nil
+}
+
+// writeArchive packs entries into w, counting the bytes read from disk
+// into t
+func writeArchive(w io.Writer, opts ArchiveOptions, entries []archiveEntry, t *Transfer) error {
+	if opts.Format == archiveTarZstd {
+		return writeTarZstd(w, opts, entries, t)
+	}
+	zw := zip.NewWriter(w)
+	if opts.Level > 0 {
+		zw.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
+			return flate.NewWriter(out, opts.Level)
+		})
+	}
+	zw.RegisterCompressor(zipMethodAES, func(out io.Writer) (io.WriteCloser, error) {
+		return newZipAESWriter(out, opts.Password, opts.Level)
+	})
+	for _, e := range entries {
+		fh := &zip.FileHeader{Name: e.name, Method: zip.Deflate, Modified: e.modified}
+		fh.SetMode(e.mode)
+		switch {
+		case e.dir:
+			fh.Name += "/"
+			fh.Method = zip.Store
+		case opts.Password != "":
+			fh.Method = zipMethodAES
+			fh.Extra = zipAESExtra(zip.Deflate)
+		}
+		ew, err := zw.CreateHeader(fh)
+		if err != nil {
+			return err
+		}
+		if !e.dir {
+			if err := copyArchiveFile(ew, e, t); err != nil {
+				return err
+			}
+		}
+	}
+	return zw.Close()
+}
+
+func writeTarZstd(w io.Writer, opts ArchiveOptions, entries []archiveEntry, t *Transfer) error {
+	var zopts []zstd.EOption
+	if opts.Level > 0 {
+		zopts = append(zopts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(opts.Level)))
+	}
+	zw, err := zstd.NewWriter(w, zopts...)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(zw)
+	for _, e := range entries {
+		hdr := &tar.Header{
+			Name:     e.name,
+			Mode:     int64(e.mode.Perm()),
+			ModTime:  e.modified,
+			Size:     e.size,
+			Typeflag: tar.TypeReg,
+			Format:   tar.FormatPAX,
+		}
+		if e.dir {
+			hdr.Name += "/"
+			hdr.Typeflag = tar.TypeDir
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			zw.Close()
+			return err
+		}
+		if !e.dir {
+			if err := copyArchiveFile(tw, e, t); err != nil {
+				zw.Close()
+				return err
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		zw.Close()
+		return err
+	}
+	return zw.Close()
+}
+
+// copyArchiveFile writes the file behind e, which must still have the
+// size it was listed with
+func copyArchiveFile(w io.Writer, e archiveEntry, t *Transfer) error {
+	f, err := os.Open(e.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	n, err := io.CopyBuffer(progressWriter{w: w, t: t}, io.LimitReader(f, e.size), make([]byte, transferBufferSize))
+	if err == nil && n != e.size {
+		err = fmt.Errorf("%s changed while it was archived", e.path)
+	}
+	return err
+}
+
+// rawCodec frames archive bytes without compressing them again
+type rawCodec struct{}
+
+func (rawCodec) Encode(dst, src []byte) ([]byte, error) { return append(dst[:0], src...), nil }
+func (rawCodec) Decode(dst, src []byte) ([]byte, error) { return append(dst[:0], src...), nil }
+func (rawCodec) Close()                                 {}
+
+type SendArchivePayload struct {
+	Host      string   `json:"host"`
+	Port      int      `json:"port"`
+	Paths     []string `json:"paths"` // files and folders to pack
+	Name      string   `json:"name"`  // archive name on the receiver, defaults from the paths
+	Extract   bool     `json:"extract"`
+	TimeoutMs int      `json:"timeout_ms"`
+	Encrypted bool     `json:"encrypted"`
+	PeerKey   string   `json:"peer_key"`
+
+	Archive ArchiveOptions `json:"archive"`
+	Auth    ClientAuth     `json:"auth"`
+
+	Offer          bool `json:"offer"`            // wait for a drop receiver to accept first
+	OfferTimeoutMs int  `json:"offer_timeout_ms"` // how long to wait for that answer
+
+	AddressFamily string `json:"address_family"` // "ipv4", "ipv6" or "dual" (default)
+	Transport     string `json:"transport"`      // "tcp" (default) or "quic"
+	Proxy         string `json:"proxy"`          // proxy URL, or "direct" to skip the configured proxy
+}
+
+func handleSendArchive(payload json.RawMessage, writer *Output) {
+	var p SendArchivePayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		sendInvalidPayload(writer, "send_archive")
+		return
+	}
+	if p.Host == "" || p.Port <= 0 || len(p.Paths) == 0 {
+		sendErrorCode(writer, ErrInvalidArgument, message("archive.send_archive_requires_host"), nil)
+		return
+	}
+	if err := p.Archive.Validate(); err != nil {
+		sendFailure(writer, err)
+		return
+	}
+	if err := p.Auth.Validate(); err != nil {
+		sendFailure(writer, err)
+		return
+	}
+	entries, size, err := collectArchive(p.Paths)
+	if err != nil {
+		sendError(writer, message("common.failed_read", "path", strings.Join(p.Paths, ", "), "error", err))
+		return
+	}
+
+	name := p.Name
+	if name == "" {
+		name = "Archive"
+		if len(p.Paths) == 1 {
+			name = filepath.Base(filepath.Clean(p.Paths[0]))
+		}
+	}
+	if !strings.HasSuffix(name, archiveExt(p.Archive.Format)) {
+		name += archiveExt(p.Archive.Format)
+	}
+	timeout := defaultDialTimeout
+	if p.TimeoutMs > 0 {
+		timeout = time.Duration(p.TimeoutMs) * time.Millisecond
+	}
+	network, isQUIC, err := transportNetwork(p.Transport, p.AddressFamily)
+	if err == nil && isQUIC {
+		err = validProxy(p.Proxy, "quic")
+	} else if err == nil {
+		err = validProxy(p.Proxy, "tcp")
+	}
+	if err != nil {
+		sendFailure(writer, err)
+		return
+	}
+
+	spec := dialSpec{
+		Network:   network,
+		Addr:      net.JoinHostPort(normalizeHost(p.Host), strconv.Itoa(p.Port)),
+		QUIC:      isQUIC,
+		Timeout:   timeout,
+		Encrypted: p.Encrypted,
+		PeerKey:   p.PeerKey,
+		Auth:      p.Auth,
+		Proxy:     p.Proxy,
+	}
+	if p.Offer {
+		spec.OfferWait = defaultOfferSenderWait
+		if p.OfferTimeoutMs > 0 {
+			spec.OfferWait = time.Duration(p.OfferTimeoutMs) * time.Millisecond
+		}
+	}
+	files := 0
+	for _, e := range entries {
+		if !e.dir {
+			files++
+		}
+	}
+	t := newTransfer("send", name, filepath.Clean(p.Paths[0]), spec.Addr, size)
+	setScope(t.ID, writer.Namespace())
+	t.setFiles(files)
+	t.setCompression(p.Archive.Format)
+	ctx, done := trackJob(t.ID, "transfer", spec.Addr)
+
+	writer.Encode(okResponse(message("common.transfer_started"), t.Info()))
+
+	header := TransferHeader{Name: name, Size: -1, Archive: p.Archive.Format, Extract: p.Extract, Unpacked: size, Entries: len(entries)}
+	go func() {
+		defer recoverTransfer(t)
+		defer done()
+		t.finish(canceled(ctx, sendArchive(ctx, t, spec, header, p.Archive, entries)))
+	}()
+}
+
+// sendArchive streams the archive of entries to the receiver
+func sendArchive(ctx context.Context, t *Transfer, spec dialSpec, header TransferHeader, opts ArchiveOptions, entries []archiveEntry) error {
+	conn, secure, err := spec.dial()
+	if err != nil {
+		return err
+	}
+	c := trackConn(conn, "outbound", spec.transport(), nil)
+	if c == nil {
+		conn.Close()
+		return errors.New("service is shutting down")
+	}
+	defer untrackConn(c)
+	defer t.cancelOn(ctx, c)()
+	c.setSecure(secure)
+
+	if spec.OfferWait > 0 {
+		header.Offer, header.From = true, senderName()
+	}
+	line, _ := json.Marshal(header)
+	if _, err := c.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	reader := bufio.NewReader(c)
+	if header.Offer {
+		if _, err := readAck(reader, c, spec.OfferWait); err != nil {
+			return err
+		}
+	}
+
+	h := sha256.New()
+	cw := newChunkWriter(c, rawCodec{}, &t.wire)
+	done := make(chan struct{})
+	go t.reportProgress(done)
+	err = writeArchive(io.MultiWriter(cw, h), opts, entries, t)
+	if err == nil {
+		err = cw.Close()
+	}
+	close(done)
+	if err != nil {
+		return err
+	}
+
+	sum := hex.EncodeToString(h.Sum(nil))
+	line, _ = json.Marshal(transferTrailer{SHA256: sum})
+	if _, err := c.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	// Unpacking happens before the ack, so allow for it
+	ack, err := readAck(reader, c, spec.Timeout+archiveAckWait)
+	if ack.Result == resultChecksumMismatch {
+		emitVerifyFailed(t, t.Path, hashSHA256, sum, ack.SHA256)
+		return &checksumError{name: t.Name, expected: sum, actual: ack.SHA256}
+	}
+	if err == nil {
+		t.mu.Lock()
+		t.SHA256 = sum
+		t.mu.Unlock()
+	}
+	return err
+}
+
+// archiveAckWait is how long a sender waits on top of its timeout for a
+// receiver that unpacks the archive
+const archiveAckWait = 10 * time.Minute
+
+// receiveArchive stores an archive sent by send_archive and unpacks it
+// when the sender asked for that
+func receiveArchive(c *Connection, reader *bufio.Reader, dir string, header TransferHeader) error {
+	name, err := incomingName(header.Name)
+	if err == nil && !validArchiveFormat(header.Archive) {
+		err = errors.New("unsupported archive format " + header.Archive)
+	}
+	if err != nil {
+		return err
+	}
+	t := newTransfer("receive", name, "", c.Info().RemoteAddr, 0)
+	setScope(t.ID, scopeOf(c.ID))
+	ctx, done := trackJob(t.ID, "transfer", t.Peer)
+	defer done()
+	stop := t.cancelOn(ctx, c)
+	emitEvent("transfer_started", t.Info())
+
+	err = func() error {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+		path, err := safeJoin(dir, name)
+		if err == nil {
+			path, err = uniquePath(path)
+		}
+		if err != nil {
+			return err
+		}
+		t.mu.Lock()
+		t.Path = path
+		t.mu.Unlock()
+
+		partial := path + ".part"
+		f, err := os.Create(partial)
+		if err != nil {
+			return err
+		}
+		h := sha256.New()
+		progress := make(chan struct{})
+		go t.reportProgress(progress)
+		body := newChunkReader(reader, rawCodec{}, &t.wire)
+		limit := archiveBodyLimit(header)
+		n, err := io.CopyBuffer(progressWriter{w: io.MultiWriter(f, h), t: t}, io.LimitReader(body, limit+1), make([]byte, transferBufferSize))
+		if err == nil && n > limit {
+			err = errArchiveTooLarge
+		}
+		close(progress)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = verifyTrailer(t, reader, path, hex.EncodeToString(h.Sum(nil)))
+		}
+		if err != nil {
+			os.Remove(partial)
+			return err
+		}
+		return finalizeReceived(t, partial, path)
+	}()
+	stop()
+	err = canceled(ctx, err)
+	if err == nil && header.Extract {
+		autoExtract(t, header.Unpacked)
+	}
+	writeAck(c, err)
+	t.finish(err)
+	return err
+}
+
+// autoExtract unpacks a received archive beside it and removes the
+// archive once everything is out, writing at most the unpacked bytes the
+// sender announced. Failures only leave the archive in place.
+func autoExtract(t *Transfer, unpacked int64) {
+	archive := t.Info().Path
+	dest, err := uniquePath(strings.TrimSuffix(archive, archiveExt(archiveFormatOf(archive))))
+	var files int
+	if err == nil {
+		files, err = extractArchive(archive, dest, "", unpacked)
+	}
+	if err != nil {
+		logger.Warn("failed to extract archive", "id", t.ID, "path", archive, "error", err)
+		emitEvent("archive_extract_failed", map[string]interface{}{
+			"id":        t.ID,
+			"path":      archive,
+			"error":     err.Error(),
+			"encrypted": errors.Is(err, errArchivePassword),
+		})
+		return
+	}
+	os.Remove(archive)
+	logger.Info("archive extracted", "id", t.ID, "path", dest, "files", files)
+	emitEvent("archive_extracted", map[string]interface{}{"id": t.ID, "archive": archive, "path": dest, "files": files})
+}
+
+// archiveFormatOf guesses the format from the file name
+func archiveFormatOf(path string) string {
+	lower := strings.ToLower(path)
+	switch {
+	case strings.HasSuffix(lower, ".tar.zst"):
+		return archiveTarZstd
+	case strings.HasSuffix(lower, ".zip"):
+		return archiveZip
+	}
+	return ""
+}
+
+// extractBudget is how many more bytes an extraction may write; nil
+// leaves it unbounded
+type extractBudget struct {
+	left int64
+}
+
+// extractArchive unpacks archive into dest and returns the number of files
+// written. Entries may not leave dest; links and special files are skipped.
+// With limit zero or more, it fails once the files add up to more.
+func extractArchive(archive, dest, password string, limit int64) (int, error) {
+	var budget *extractBudget
+	if limit >= 0 {
+		budget = &extractBudget{left: limit}
+	}
+	switch archiveFormatOf(archive) {
+	case archiveZip:
+		return extractZip(archive, dest, password, budget)
+	case archiveTarZstd:
+		return extractTarZstd(archive, dest, budget)
+	}
+	return 0, catalogError(ErrUnsupported, "archive.unsupported_archive", "archive", filepath.Base(archive))
+}
+
+func extractZip(archive, dest, password string, budget *extractBudget) (int, error) {
+	zr, err := zip.OpenReader(archive)
+	if err != nil {
+		return 0, err
+	}
+	defer zr.Close()
+	// Check the password before anything is written
+	for _, f := range zr.File {
+		if f.Method == zipMethodAES {
+			rc, err := openZipAES(f, password)
+			if err != nil {
+				return 0, err
+			}
+			rc.Close()
+			break
+		}
+	}
+	files := 0
+	for _, f := range zr.File {
+		mode := f.Mode()
+		if mode.IsDir() {
+			if err := extractDir(dest, f.Name); err != nil {
+				return files, err
+			}
+			continue
+		}
+		if !mode.IsRegular() {
+			continue
+		}
+		var rc io.ReadCloser
+		if f.Method == zipMethodAES {
+			rc, err = openZipAES(f, password)
+		} else {
+			rc, err = f.Open()
+		}
+		if err != nil {
+			return files, err
+		}
+		err = extractFile(dest, f.Name, rc, mode, f.Modified, budget)
+		rc.Close()
+		if err != nil {
+			return files, err
+		}
+		files++
+	}
+	return files, nil
+}
+
+func extractTarZstd(archive, dest string, budget *extractBudget) (int, error) {
+	f, err := os.Open(archive)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	zr, err := zstd.NewReader(f)
+	if err != nil {
+		return 0, err
+	}
+	defer zr.Close()
+	tr := tar.NewReader(zr)
+	files := 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return files, err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = extractDir(dest, hdr.Name)
+		case tar.TypeReg:
+			err = extractFile(dest, hdr.Name, tr, fs.FileMode(hdr.Mode).Perm(), hdr.ModTime, budget)
+			files++
+		}
+		if err != nil {
+			return files, err
+		}
+	}
+}
+
+func extractDir(dest, name string) error {
+	path, err := safeJoin(dest, strings.TrimSuffix(name, "/"))
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(path, 0o755)
+}
+
+// extractFile writes one entry through a temporary name and the receive
+// policy, like received files, and charges it to budget
+func extractFile(dest, name string, r io.Reader, mode fs.FileMode, modified time.Time, budget *extractBudget) error {
+	if err := os.MkdirAll(dest, 0o755); err != nil {
+		return err
+	}
+	path, err := safeJoin(dest, name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	partial := path + ".part"
+	f, err := os.OpenFile(partial, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode.Perm()|0o600)
+	if err != nil {
+		return err
+	}
+	if budget != nil {
+		r = io.LimitReader(r, budget.left+1)
+	}
+	n, err := io.CopyBuffer(f, r, make([]byte, transferBufferSize))
+	if budget != nil {
+		if budget.left -= n; budget.left < 0 && err == nil {
+			err = errArchiveTooLarge
+		}
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(partial)
+		return err
+	}
+	// An entry the receive policy rejects is quarantined; the rest unpack
+	var pe *PolicyError
+	if err := finalizeReceived(nil, partial, path); errors.As(err, &pe) {
+		return nil
+	} else if err != nil {
+		os.Remove(partial)
+		return err
+	}
+	if !modified.IsZero() {
+		os.Chtimes(path, modified, modified)
+	}
+	return nil
+}
+
+type ExtractArchivePayload struct {
+	Path     string `json:"path"`
+	Dest     string `json:"dest"` // default a folder beside the archive, named after it
+	Password string `json:"password"`
+}
+
+// handleExtractArchive unpacks a zip or tar.zst archive, such as an
+// encrypted one a receiver kept
+func handleExtractArchive(payload json.RawMessage, writer *Output) {
+	var p ExtractArchivePayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		sendInvalidPayload(writer, "extract_archive")
+		return
+	}
+	if p.Path == "" {
+		sendErrorCode(writer, ErrInvalidArgument, message("archive.extract_archive_requires_path"), nil)
+		return
+	}
+	format := archiveFormatOf(p.Path)
+	if format == "" {
+		sendErrorCode(writer, ErrUnsupported, message("archive.unsupported_archive", "archive", filepath.Base(p.Path)), nil)
+		return
+	}
+	dest := p.Dest
+	if dest == "" {
+		var err error
+		if dest, err = uniquePath(p.Path[:len(p.Path)-len(archiveExt(format))]); err != nil {
+			sendFailure(writer, err)
+			return
+		}
+	}
+	files, err := extractArchive(p.Path, dest, p.Password, -1)
+	switch {
+	case errors.Is(err, errArchivePassword):
+		sendErrorCode(writer, ErrInvalidArgument, message("archive.extract_archive_requires_password"), nil)
+		return
+	case errors.Is(err, errWrongPassword):
+		sendErrorCode(writer, ErrPermissionDenied, message("archive.wrong_archive_password"), nil)
+		return
+	case err != nil:
+		sendError(writer, message("archive.failed_extract", "path", p.Path, "error", err))
+		return
+	}
+	logger.Info("archive extracted", "path", dest, "files", files)
+	writer.Encode(okResponse(message("archive.extracted"), map[string]interface{}{"path": dest, "files": files}))
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestArchiveRoundTrip(t *testing.T) {
+	src := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(src, "docs", "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]byte{
+		"docs/a.txt":     bytes.Repeat([]byte("alpha"), 1000),
+		"docs/sub/b.bin": bytes.Repeat([]byte{0, 1, 2, 3, 250}, 20000),
+		"docs/empty":     {},
+	}
+	for name, data := range want {
+		if err := os.WriteFile(filepath.Join(src, filepath.FromSlash(name)), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, _, err := collectArchive([]string{filepath.Join(src, "docs")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, opts := range []ArchiveOptions{
+		{Format: archiveZip},
+		{Format: archiveZip, Password: "s3cret", Level: 9},
+		{Format: archiveTarZstd, Level: 3},
+	} {
+		dir := t.TempDir()
+		archive := filepath.Join(dir, "out"+archiveExt(opts.Format))
+		var buf bytes.Buffer
+		if err := writeArchive(&buf, opts, entries, &Transfer{}); err != nil {
+			t.Fatalf("%+v: write: %v", opts, err)
+		}
+		if err := os.WriteFile(archive, buf.Bytes(), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if opts.Password != "" {
+			if _, err := extractArchive(archive, filepath.Join(dir, "x"), "", -1); !errors.Is(err, errArchivePassword) {
+				t.Errorf("no password: got %v", err)
+			}
+			if _, err := extractArchive(archive, filepath.Join(dir, "x"), "wrong", -1); !errors.Is(err, errWrongPassword) {
+				t.Errorf("wrong password: got %v", err)
+			}
+			if _, err := os.Stat(filepath.Join(dir, "x")); !os.IsNotExist(err) {
+				t.Errorf("failed extraction left files behind")
+			}
+		}
+		files, err := extractArchive(archive, filepath.Join(dir, "x"), opts.Password, -1)
+		if err != nil {
+			t.Fatalf("%+v: extract: %v", opts, err)
+		}
+		if files != len(want) {
+			t.Errorf("%+v: extracted %d files, want %d", opts, files, len(want))
+		}
+		for name, data := range want {
+			got, err := os.ReadFile(filepath.Join(dir, "x", filepath.FromSlash(name)))
+			if err != nil || !bytes.Equal(got, data) {
+				t.Errorf("%+v: %s differs (%v)", opts, name, err)
+			}
+		}
+	}
+}
+
+func TestArchiveTamperedAES(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "f.txt")
+	if err := os.WriteFile(path, bytes.Repeat([]byte("secret "), 100), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	entries, _, err := collectArchive([]string{path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := writeArchive(&buf, ArchiveOptions{Format: archiveZip, Password: "pw"}, entries, &Transfer{}); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	// Flip a ciphertext byte just past the local header, salt and check value
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	offset, err := zr.File[0].DataOffset()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[offset+16+zipAESVerify+3] ^= 0xff
+	archive := filepath.Join(dir, "t.zip")
+	if err := os.WriteFile(archive, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := extractArchive(archive, filepath.Join(dir, "x"), "pw", -1); err == nil {
+		t.Error("tampered entry extracted")
+	}
+}
+
+func TestExtractRejectsEscapes(t *testing.T) {
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "evil.zip")
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.Create("../escape.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("x"))
+	zw.Close()
+	if err := os.WriteFile(archive, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := extractArchive(archive, filepath.Join(dir, "out"), "", -1); err == nil {
+		t.Error("entry outside the destination accepted")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "escape.txt")); !os.IsNotExist(err) {
+		t.Error("escape.txt was written")
+	}
+}
+
+func TestExtractStopsAtAnnouncedSize(t *testing.T) {
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "bomb.zip")
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, name := range []string{"a", "b"} {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(bytes.Repeat([]byte{0}, 10000))
+	}
+	zw.Close()
+	if err := os.WriteFile(archive, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := extractArchive(archive, filepath.Join(dir, "short"), "", 15000); !errors.Is(err, errArchiveTooLarge) {
+		t.Errorf("extracting past the announced size: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "short", "b")); !os.IsNotExist(err) {
+		t.Error("the entry that went over was kept")
+	}
+	if files, err := extractArchive(archive, filepath.Join(dir, "exact"), "", 20000); err != nil || files != 2 {
+		t.Errorf("extracting the announced size: %d files, %v", files, err)
+	}
+}
+
+func TestReceiveArchiveCapsBody(t *testing.T) {
+	savedOutput := output
+	output = NewOutput(io.Discard)
+	t.Cleanup(func() { output = savedOutput })
+
+	header := TransferHeader{Name: "big.zip", Size: -1, Archive: archiveZip}
+	var body bytes.Buffer
+	cw := newChunkWriter(&body, rawCodec{}, nil)
+	cw.Write(make([]byte, archiveBodyLimit(header)+1))
+	cw.Close()
+
+	ours, theirs := net.Pipe()
+	defer theirs.Close()
+	go io.Copy(io.Discard, theirs)
+	c := &Connection{ID: "archive-in", Direction: "inbound", Network: "tcp", Created: time.Now(), Limiter: newRateLimiter(0)}
+	c.setConn(ours)
+	dir := t.TempDir()
+	if err := receiveArchive(c, bufio.NewReader(&body), dir, header); !errors.Is(err, errArchiveTooLarge) {
+		t.Errorf("oversized archive: %v", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("%d files left behind", len(entries))
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The audit log records every control command: what was asked, with
+// anything secret redacted, how it was answered and how long that took.
+// It is a JSON lines file next to the config that is only ever appended to
+// and rotates like the log file, so when a user reports that something
+// just stopped working the commands leading up to it are still there.
+// get_audit_log reads it back.
+const (
+	defaultAuditMaxSize    = 5 << 20 // 5 MiB
+	defaultAuditMaxBackups = 3
+	defaultAuditLimit      = 100
+	maxAuditLimit          = 5000
+	auditMaxString         = 256 // longer parameter strings are cut to this
+)
+
+// auditSecrets are parts of parameter names whose values are never written
+var auditSecrets = []string{
+	"password", "passphrase", "secret", "token", "private", "credential",
+	"authorization", "cookie", "psk", "api_key", "apikey",
+}
+
+// AuditConfig is the config section of the audit log. Zero values keep
+// the defaults.
+type AuditConfig struct {
+	Disabled   bool  `json:"disabled,omitempty"`
+	MaxSize    int64 `json:"max_size,omitempty"`    // bytes before rotating, default 5 MiB
+	MaxBackups int   `json:"max_backups,omitempty"` // rotated files kept, default 3
+}
+
+func (a AuditConfig) Validate() error {
+	if a.MaxSize < 0 || a.MaxBackups < 0 {
+		return catalogError(ErrInvalidArgument, "audit.max_size_max_backups_must")
+	}
+	return nil
+}
+
+// AuditEntry is one command in the audit log
+type AuditEntry struct {
+	Time       time.Time       `json:"time"`
+	Command    string          `json:"command"`
+	ID         json.RawMessage `json:"id,omitempty"`
+	Namespace  string          `json:"namespace,omitempty"`
+	Params     json.RawMessage `json:"params,omitempty"` // the payload, redacted
+	Status     string          `json:"status"`           // the response's, or "none" when there was none
+	Code       string          `json:"code,omitempty"`
+	Message    string          `json:"message,omitempty"`
+	DurationMs float64         `json:"duration_ms"` // until the first response
+}
+
+// AuditLog is the open audit file
+type AuditLog struct {
+	mu   sync.Mutex
+	path string
+	file *RotatingFile
+}
+
+var audit AuditLog
+
+// auditPath puts the audit log beside the config file
+func auditPath(configPath string) string {
+	return filepath.Join(filepath.Dir(configPath), "lumina-audit.jsonl")
+}
+
+// Open starts auditing to path
+func (a *AuditLog) Open(path string, cfg AuditConfig) error {
+	a.mu.Lock()
+	a.path = path
+	a.mu.Unlock()
+	return a.configure(cfg)
+}
+
+// configure reopens the file with cfg's limits, or closes it when auditing
+// is disabled
+func (a *AuditLog) configure(cfg AuditConfig) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file != nil {
+		a.file.Close()
+		a.file = nil
+	}
+	if a.path == "" || cfg.Disabled {
+		return nil
+	}
+	maxSize, maxBackups := cfg.MaxSize, cfg.MaxBackups
+	if maxSize == 0 {
+		maxSize = defaultAuditMaxSize
+	}
+	if maxBackups == 0 {
+		maxBackups = defaultAuditMaxBackups
+	}
+	if err := os.MkdirAll(filepath.Dir(a.path), 0o755); err != nil {
+		return err
+	}
+	f, err := OpenRotatingFile(a.path, maxSize, maxBackups)
+	if err != nil {
+		return err
+	}
+	a.file = f
+	return nil
+}
+
+func (a *AuditLog) Close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file != nil {
+		a.file.Close()
+		a.file = nil
+	}
+}
+
+func (a *AuditLog) write(e AuditEntry) {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file == nil {
+		return
+	}
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		logger.Warn("failed to write audit log", "path", a.path, "error", err)
+	}
+}
+
+// auditRecord is a command being audited; the first response, or the
+// handler returning without one, writes its entry
+type auditRecord struct {
+	entry AuditEntry
+	start time.Time
+	once  sync.Once
+}
+
+// begin starts auditing req, or returns nil when auditing is off
+func (a *AuditLog) begin(req ProtocolRequest) *auditRecord {
+	a.mu.Lock()
+	on := a.file != nil
+	a.mu.Unlock()
+	if !on {
+		return nil
+	}
+	now := time.Now()
+	return &auditRecord{
+		entry: AuditEntry{Time: now, Command: req.Command, ID: req.ID, Namespace: req.Namespace, Params: redactParams(req.Payload)},
+		start: now,
+	}
+}
+
+// answered records resp as the command's outcome
+func (r *auditRecord) answered(resp ProtocolResponse) {
+	r.once.Do(func() {
+		r.entry.Status, r.entry.Code, r.entry.Message = resp.Status, resp.Code, resp.Message
+		r.finish()
+	})
+}
+
+// done records a command whose handler returned without answering
+func (r *auditRecord) done() {
+	r.once.Do(func() {
+		r.entry.Status = "none"
+		r.finish()
+	})
+}
+
+func (r *auditRecord) finish() {
+	r.entry.DurationMs = millis(time.Since(r.start))
+	audit.write(r.entry)
+}
+
+// redactParams copies a payload with secret values replaced and long
+// strings, such as file contents, cut short
+func redactParams(payload json.RawMessage) json.RawMessage {
+	var v interface{}
+	if len(payload) == 0 || json.Unmarshal(payload, &v) != nil {
+		return nil
+	}
+	out, err := json.Marshal(redactValue(v))
+	if err != nil {
+		return nil
+	}
+	return out
+}
+
+func redactValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, field := range v {
+			if secretField(k) {
+				if field != nil && field != "" {
+					v[k] = "[redacted]"
+				}
+				continue
+			}
+			v[k] = redactValue(field)
+		}
+		return v
+	case []interface{}:
+		for i := range v {
+			v[i] = redactValue(v[i])
+		}
+		return v
+	case string:
+		// Credentials in a URL, as in a proxy or download address, go too
+		if u, err := url.Parse(v); err == nil && u.User != nil {
+			u.User = url.User("redacted")
+			v = u.String()
+		}
+		if len(v) > auditMaxString {
+			return fmt.Sprintf("%s... (%d bytes)", v[:auditMaxString], len(v))
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+func secretField(name string) bool {
+	name = strings.ToLower(name)
+	for _, s := range auditSecrets {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+type GetAuditLogPayload struct {
+	Limit      int       `json:"limit"`       // newest entries returned, default 100
+	Command    string    `json:"command"`     // only this command
+	Since      time.Time `json:"since"`       // only entries at or after this time
+	ErrorsOnly bool      `json:"errors_only"` // only commands answered with an error
+}
+
+// handleGetAuditLog returns matching entries from the audit file and its
+// rotated copies, newest first
+func handleGetAuditLog(payload json.RawMessage, writer *Output) {
+	var p GetAuditLogPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		sendInvalidPayload(writer, "get_audit_log")
+		return
+	}
+	if p.Limit < 0 || p.Limit > maxAuditLimit {
+		sendErrorCode(writer, ErrInvalidArgument, message("audit.limit_must_between", "max", maxAuditLimit), nil)
+		return
+	}
+	if p.Limit == 0 {
+		p.Limit = defaultAuditLimit
+	}
+
+	audit.mu.Lock()
+	path, enabled := audit.path, audit.file != nil
+	audit.mu.Unlock()
+	if path == "" {
+		sendError(writer, message("audit.audit_log_not_open"))
+		return
+	}
+	entries, err := readAudit(path, p)
+	if err != nil {
+		sendError(writer, message("audit.failed_read_audit_log", "error", err))
+		return
+	}
+	writer.Encode(ProtocolResponse{
+		Status: "ok",
+		Data:   map[string]interface{}{"entries": entries, "path": path, "enabled": enabled},
+	})
+}
+
+// readAudit reads path and its rotated copies from newest to oldest until
+// p.Limit entries match
+func readAudit(path string, p GetAuditLogPayload) ([]AuditEntry, error) {
+	entries := []AuditEntry{}
+	for i := 0; len(entries) < p.Limit; i++ {
+		file := path
+		if i > 0 {
+			file = fmt.Sprintf("%s.%d", path, i)
+		}
+		lines, err := readLines(file)
+		if errors.Is(err, os.ErrNotExist) {
+			if i == 0 {
+				continue // nothing logged since the last rotation
+			}
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		for j := len(lines) - 1; j >= 0 && len(entries) < p.Limit; j-- {
+			var e AuditEntry
+			if json.Unmarshal(lines[j], &e) != nil {
+				continue // cut short by a crash
+			}
+			switch {
+			case p.Command != "" && e.Command != p.Command:
+			case !p.Since.IsZero() && e.Time.Before(p.Since):
+			case p.ErrorsOnly && e.Status != "error":
+			default:
+				entries = append(entries, e)
+			}
+		}
+	}
+	return entries, nil
+}
+
+func readLines(path string) ([][]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var lines [][]byte
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64<<10), defaultMaxMessageSize)
+	for scanner.Scan() {
+		lines = append(lines, append([]byte(nil), scanner.Bytes()...))
+	}
+	return lines, scanner.Err()
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Authenticated stream listeners open every connection with a challenge:
+// the listener sends a random nonce, the peer answers with either an
+// HMAC-SHA256 of the nonce keyed by the shared secret or a session token
+// issued through issue_auth_token, and the listener replies ok or drops
+// it. The secret never crosses the wire; tokens do, so pair them with
+// encryption on untrusted networks. HTTP and WebSocket listeners take the
+// secret or a token as a bearer credential instead.
+const (
+	authNonceSize      = 32
+	defaultAuthTimeout = 10 * time.Second
+	defaultTokenTTL    = 10 * time.Minute
+)
+
+// Reasons reported in auth_failed events
+const (
+	authReasonTimeout  = "timeout"
+	authReasonMissing  = "missing credentials"
+	authReasonSecret   = "bad secret"
+	authReasonToken    = "unknown or expired token"
+	authReasonProtocol = "malformed handshake"
+)
+
+var errAuthFailed = errors.New("authentication failed")
+
+// AuthOptions configures authentication for a listener
+type AuthOptions struct {
+	Secret    string `json:"secret"`     // shared secret peers must prove they know
+	Tokens    bool   `json:"tokens"`     // accept tokens from issue_auth_token
+	TimeoutMs int    `json:"timeout_ms"` // time a peer gets to authenticate
+}
+
+func (o AuthOptions) Enabled() bool {
+	return o.Secret != "" || o.Tokens
+}
+
+// ClientAuth holds the credentials presented when dialing a listener
+type ClientAuth struct {
+	Secret string `json:"secret"`
+	Token  string `json:"token"`
+}
+
+func (a ClientAuth) Enabled() bool {
+	return a.Secret != "" || a.Token != ""
+}
+
+func (a ClientAuth) Validate() error {
+	if a.Secret != "" && a.Token != "" {
+		return catalogError(ErrInvalidArgument, "auth.takes_secret_or_token")
+	}
+	return nil
+}
+
+// authToken is a session token issued for one listener
+type authToken struct {
+	Expires time.Time
+	Uses    int // remaining uses, 0 for unlimited until expiry
+}
+
+// ListenerAuth checks credentials for one listener
+type ListenerAuth struct {
+	secret  []byte
+	tokens  bool
+	timeout time.Duration
+
+	Failures atomic.Uint64
+
+	mu     sync.Mutex
+	issued map[string]*authToken
+}
+
+func newListenerAuth(o AuthOptions) *ListenerAuth {
+	if !o.Enabled() {
+		return nil
+	}
+	timeout := defaultAuthTimeout
+	if o.TimeoutMs > 0 {
+		timeout = time.Duration(o.TimeoutMs) * time.Millisecond
+	}
+	return &ListenerAuth{
+		secret:  []byte(o.Secret),
+		tokens:  o.Tokens,
+		timeout: timeout,
+		issued:  make(map[string]*authToken),
+	}
+}
+
+// Issue creates a token valid for ttl and, when uses is positive, that many
+// sessions
+func (a *ListenerAuth) Issue(ttl time.Duration, uses int) (string, time.Time, error) {
+	raw := make([]byte, 24)
+	if _, err := rand.Read(raw); err != nil {
+		return "", time.Time{}, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+	expires := time.Now().Add(ttl)
+
+	a.mu.Lock()
+	a.issued[token] = &authToken{Expires: expires, Uses: uses}
+	a.mu.Unlock()
+	return token, expires, nil
+}
+
+func (a *ListenerAuth) Revoke(token string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, ok := a.issued[token]
+	delete(a.issued, token)
+	return ok
+}
+
+// redeem consumes one use of token, dropping it once spent or expired
+func (a *ListenerAuth) redeem(token string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	for t, info := range a.issued {
+		if now.After(info.Expires) {
+			delete(a.issued, t)
+		}
+	}
+	info, ok := a.issued[token]
+	if !ok || !a.tokens {
+		return false
+	}
+	if info.Uses > 0 {
+		info.Uses--
+		if info.Uses == 0 {
+			delete(a.issued, token)
+		}
+	}
+	return true
+}
+
+// checkMAC verifies a challenge response against the shared secret
+func (a *ListenerAuth) checkMAC(nonce []byte, mac string) bool {
+	if len(a.secret) == 0 {
+		return false
+	}
+	got, err := hex.DecodeString(mac)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(got, authMAC(a.secret, nonce))
+}
+
+// checkBearer accepts the shared secret itself or an issued token
+func (a *ListenerAuth) checkBearer(credential string) (method, reason string) {
+	switch {
+	case credential == "":
+		return "", authReasonMissing
+	case len(a.secret) > 0 && hmac.Equal([]byte(credential), a.secret):
+		return "secret", ""
+	case a.redeem(credential):
+		return "token", ""
+	case len(a.secret) > 0 && !a.tokens:
+		return "", authReasonSecret
+	default:
+		return "", authReasonToken
+	}
+}
+
+func authMAC(secret, nonce []byte) []byte {
+	m := hmac.New(sha256.New, secret)
+	m.Write(nonce)
+	return m.Sum(nil)
+}
+
+// authMessage is every line of the stream handshake
+type authMessage struct {
+	Nonce   string `json:"nonce,omitempty"` // listener challenge
+	MAC     string `json:"mac,omitempty"`   // peer response with the secret
+	Token   string `json:"token,omitempty"` // peer response with a token
+	Status  string `json:"status,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// authClient answers the listener's challenge on conn with creds
+func authClient(conn net.Conn, creds ClientAuth, timeout time.Duration) error {
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+
+	var challenge authMessage
+	if err := readJSONLine(conn, &challenge); err != nil {
+		return fmt.Errorf("auth handshake failed: %w", err)
+	}
+	nonce, err := base64.StdEncoding.DecodeString(challenge.Nonce)
+	if err != nil || len(nonce) != authNonceSize {
+		return errors.New("auth handshake failed: listener did not send a challenge")
+	}
+
+	answer := authMessage{Token: creds.Token}
+	if creds.Secret != "" {
+		answer = authMessage{MAC: hex.EncodeToString(authMAC([]byte(creds.Secret), nonce))}
+	}
+	line, _ := json.Marshal(answer)
+	if _, err := conn.Write(append(line, '\n')); err != nil {
+		return err
+	}
+
+	var result authMessage
+	if err := readJSONLine(conn, &result); err != nil {
+		return fmt.Errorf("auth handshake failed: %w", err)
+	}
+	if result.Status != "ok" {
+		return errAuthFailed
+	}
+	return nil
+}
+
+// authInbound challenges a peer on an authenticated listener and drops it
+// unless it proves the secret or presents a valid token in time
+func authInbound(c *Connection, l *Listener) error {
+	a := l.Auth
+	conn := c.Conn()
+	c.SetDeadline(time.Now().Add(a.timeout))
+	defer c.SetDeadline(time.Time{})
+
+	nonce := make([]byte, authNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	line, _ := json.Marshal(authMessage{Nonce: base64.StdEncoding.EncodeToString(nonce)})
+	if _, err := conn.Write(append(line, '\n')); err != nil {
+		return err
+	}
+
+	var answer authMessage
+	method, reason := "", ""
+	if err := readJSONLine(conn, &answer); err != nil {
+		reason = authReasonProtocol
+		if isTimeout(err) {
+			reason = authReasonTimeout
+		}
+	} else {
+		switch {
+		case answer.MAC != "":
+			if method, reason = "secret", ""; !a.checkMAC(nonce, answer.MAC) {
+				reason = authReasonSecret
+			}
+		case answer.Token != "":
+			if method, reason = "token", ""; !a.redeem(answer.Token) {
+				reason = authReasonToken
+			}
+		default:
+			reason = authReasonMissing
+		}
+	}
+
+	if reason != "" {
+		rejectAuth(l, c.ID, conn.RemoteAddr().String(), reason)
+		line, _ = json.Marshal(authMessage{Status: "error", Message: errAuthFailed.Error()})
+		conn.Write(append(line, '\n'))
+		return fmt.Errorf("%w: %s", errAuthFailed, reason)
+	}
+
+	line, _ = json.Marshal(authMessage{Status: "ok"})
+	if _, err := conn.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	c.setAuth(method)
+	return nil
+}
+
+// rejectAuth counts and reports a peer that failed to authenticate
+func rejectAuth(l *Listener, id, remote, reason string) {
+	l.Auth.Failures.Add(1)
+	logger.Warn("authentication failed", "listener", l.Addr, "remote", remote, "reason", reason)
+	event := map[string]interface{}{
+		"listener":    l.Addr,
+		"listener_id": l.ID,
+		"remote":      remote,
+		"reason":      reason,
+	}
+	if id != "" {
+		event["id"] = id
+	}
+	emitEvent("auth_failed", event)
+}
+
+// requireAuth guards an HTTP handler with the listener's credentials,
+// taken from an Authorization bearer header or, for browsers opening a
+// WebSocket, a token query parameter
+func requireAuth(l *Listener, next http.Handler) http.Handler {
+	if l.Auth == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		credential := r.URL.Query().Get("token")
+		if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+			credential = strings.TrimPrefix(h, "Bearer ")
+		}
+		if _, reason := l.Auth.checkBearer(credential); reason != "" {
+			rejectAuth(l, "", r.RemoteAddr, reason)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSON(w, http.StatusUnauthorized, ProtocolResponse{Status: "error", Message: "Authentication required"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type IssueAuthTokenPayload struct {
+	ListenerRef
+	TTLMs int `json:"ttl_ms"` // default 10 minutes
+	Uses  int `json:"uses"`   // sessions the token admits, 0 for unlimited
+}
+
+func handleIssueAuthToken(payload json.RawMessage, writer *Output) {
+	var p IssueAuthTokenPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		sendInvalidPayload(writer, "issue_auth_token")
+		return
+	}
+	if p.Uses < 0 {
+		sendErrorCode(writer, ErrInvalidArgument, message("auth.uses_must_not_negative"), nil)
+		return
+	}
+	a, addr, ok := listenerAuth(p.ListenerRef, writer)
+	if !ok {
+		return
+	}
+	if !a.tokens {
+		sendErrorCode(writer, ErrInvalidState, message("auth.server_does_not_accept"), nil)
+		return
+	}
+	ttl := defaultTokenTTL
+	if p.TTLMs > 0 {
+		ttl = time.Duration(p.TTLMs) * time.Millisecond
+	}
+
+	token, expires, err := a.Issue(ttl, p.Uses)
+	if err != nil {
+		sendError(writer, message("auth.failed_issue_token", "error", err))
+		return
+	}
+	writer.Encode(ProtocolResponse{
+		Status: "ok",
+		Data: map[string]interface{}{
+			"listener": addr,
+			"token":    token,
+			"expires":  expires,
+			"uses":     p.Uses,
+		},
+	})
+}
+
+type RevokeAuthTokenPayload struct {
+	ListenerRef
+	Token string `json:"token"`
+}
+
+func handleRevokeAuthToken(payload json.RawMessage, writer *Output) {
+	var p RevokeAuthTokenPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		sendInvalidPayload(writer, "revoke_auth_token")
+		return
+	}
+	a, _, ok := listenerAuth(p.ListenerRef, writer)
+	if !ok {
+		return
+	}
+	if !a.Revoke(p.Token) {
+		sendErrorCode(writer, ErrNotFound, message("auth.token_not_found"), nil)
+		return
+	}
+	writer.Encode(okResponse(message("auth.token_revoked"), nil))
+}
+
+// listenerAuth looks up the auth state of a listener, answering with an
+// error when there is none
+func listenerAuth(ref ListenerRef, writer *Output) (*ListenerAuth, string, bool) {
+	state.Mutex.Lock()
+	l, ok := findListenerLocked(ref, writer)
+	state.Mutex.Unlock()
+	if !ok {
+		return nil, "", false
+	}
+	if l.Auth == nil {
+		sendErrorCode(writer, ErrInvalidState, message("auth.server_does_not_require"), nil)
+		return nil, l.Addr, false
+	}
+	return l.Auth, l.Addr, true
+}
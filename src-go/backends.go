@@ -0,0 +1,513 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Storage backends: a transfer listener keeps what it receives in its
+// directory unless it, or the accept_offer that let a transfer in, names
+// one of the config's storage_backends. A "local" backend is just a named
+// directory. An "s3" backend (any S3-compatible service) or a "webdav"
+// share takes each file as an HTTP PUT that streams the body on as it
+// arrives, so nothing is staged on this machine. Those take single files
+// only: directories, archives and parallel sends need a local disk to
+// land on. A remote upload cannot be resumed, so a resume starts over, and
+// content checks are limited to the sniffed MIME type, since a scanner
+// needs the file on disk.
+const (
+	backendLocal  = "local"
+	backendS3     = "s3"
+	backendWebDAV = "webdav"
+
+	defaultS3Region = "us-east-1"
+	// maxS3PutBytes is the most a single S3 PUT takes
+	maxS3PutBytes = 5 << 30
+	// maxBackendNameTries bounds the "name (n).ext" variants tried when a
+	// name is taken
+	maxBackendNameTries = 100
+)
+
+// StorageBackendConfig is one entry of the config's storage_backends
+type StorageBackendConfig struct {
+	Type string `json:"type"` // "local", "s3" or "webdav"
+
+	Dir string `json:"dir,omitempty"` // local
+
+	Endpoint    string `json:"endpoint,omitempty"` // s3: e.g. "https://s3.eu-west-1.amazonaws.com"
+	Region      string `json:"region,omitempty"`   // s3: default "us-east-1"
+	Bucket      string `json:"bucket,omitempty"`
+	Prefix      string `json:"prefix,omitempty"` // s3: prepended to every key, e.g. "incoming/"
+	AccessKey   string `json:"access_key,omitempty"`
+	SecretKey   string `json:"secret_key,omitempty"`
+	VirtualHost bool   `json:"virtual_host,omitempty"` // s3: bucket.endpoint instead of endpoint/bucket
+
+	URL      string `json:"url,omitempty"` // webdav: the collection files go into
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+func (b StorageBackendConfig) Validate() error {
+	switch b.Type {
+	case backendLocal:
+		if b.Dir == "" {
+			return catalogError(ErrInvalidArgument, "backends.local_requires_dir")
+		}
+	case backendS3:
+		if b.Bucket == "" || b.AccessKey == "" || b.SecretKey == "" {
+			return catalogError(ErrInvalidArgument, "backends.s3_requires")
+		}
+		if _, err := httpURL(b.Endpoint); err != nil {
+			return catalogError(ErrInvalidArgument, "backends.url_must_http", "field", "s3 endpoint")
+		}
+	case backendWebDAV:
+		if _, err := httpURL(b.URL); err != nil {
+			return catalogError(ErrInvalidArgument, "backends.url_must_http", "field", "webdav url")
+		}
+	default:
+		return catalogError(ErrUnsupported, "backends.unsupported_type", "type", b.Type)
+	}
+	return nil
+}
+
+func httpURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, errors.New("must be an http or https URL")
+	}
+	return u, nil
+}
+
+// validateBackends checks the config's storage_backends
+func validateBackends(backends map[string]*StorageBackendConfig) error {
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if name == "" {
+			return catalogError(ErrInvalidArgument, "backends.names_not_empty")
+		}
+		if b := backends[name]; b == nil {
+			return fmt.Errorf("storage_backends.%s is empty", name)
+		} else if err := b.Validate(); err != nil {
+			return fmt.Errorf("storage_backends.%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// resolveStorage turns a storage backend name into where received files
+// go: a local backend becomes its directory, a remote one stays a name
+func resolveStorage(name string) (receiveDest, error) {
+	if name == "" {
+		return receiveDest{}, nil
+	}
+	b := config.Get().StorageBackends[name]
+	if b == nil {
+		return receiveDest{}, catalogError(ErrNotFound, "backends.backend_not_found", "name", name)
+	}
+	if b.Type == backendLocal {
+		return receiveDest{dir: b.Dir}, nil
+	}
+	return receiveDest{storage: name}, nil
+}
+
+// receiveDest is where a transfer listener puts an accepted body: dir on
+// this machine, or the remote storage backend of that name when set
+type receiveDest struct {
+	dir     string
+	storage string
+}
+
+// StorageBackend stores received files somewhere other than a local disk
+type StorageBackend interface {
+	// Create starts storing a file of size bytes under name, or a variant
+	// of it when name is taken; ctx ends the upload early
+	Create(ctx context.Context, name string, size int64) (Upload, error)
+}
+
+// Upload is a file being written to a storage backend
+type Upload interface {
+	io.Writer
+	Location() string // where the file ends up, without credentials
+	Commit() error    // finishes the upload; the file exists only after it
+	Abort()
+}
+
+// openBackend builds the backend the config names
+func openBackend(name string) (StorageBackend, error) {
+	b := config.Get().StorageBackends[name]
+	if b == nil {
+		return nil, catalogError(ErrNotFound, "backends.backend_not_found", "name", name)
+	}
+	switch b.Type {
+	case backendS3:
+		return newS3Backend(*b), nil
+	case backendWebDAV:
+		return newWebDAVBackend(*b), nil
+	}
+	return nil, fmt.Errorf("storage backend %s keeps files on this machine", name)
+}
+
+// localOnly reports why a header cannot go to a remote backend, nil when
+// it can. What does go to one has no local path for hooks: move hooks skip
+// it, and the others see its {location} and {storage} with {path} and
+// {dir} empty.
+func localOnly(header TransferHeader, storage string) error {
+	if header.Manifest != nil || header.Archive != "" || header.Streams > 1 || header.Batch != "" || header.Parallel != "" {
+		return catalogError(ErrFailed, "backends.single_files_only", "name", storage)
+	}
+	if len(config.Get().ReceivePolicy.Scanner) > 0 {
+		return fmt.Errorf("storage backend %s cannot be used with receive_policy.scanner, which needs files on this machine", storage)
+	}
+	return nil
+}
+
+// receiveToBackend streams a single file to a storage backend. The upload
+// is committed only once the whole body arrived and checked out, so a
+// broken transfer leaves nothing behind.
+func receiveToBackend(ctx context.Context, c *Connection, t *Transfer, r *bufio.Reader, storage string, header TransferHeader) error {
+	backend, err := openBackend(storage)
+	if err != nil {
+		return err
+	}
+	// Nothing is kept to resume from, so a resume starts at the beginning
+	h := sha256.New()
+	body, finish, pr, err := openBody(c, t, r, header, 0, hex.EncodeToString(h.Sum(nil)))
+	if header.Pausable {
+		defer t.disablePause(nil)
+	}
+	if err != nil {
+		return err
+	}
+	up, err := backend.Create(ctx, t.Name, header.Size)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	t.Path, t.Storage = up.Location(), storage
+	t.mu.Unlock()
+	emitEvent("transfer_started", t.Info())
+
+	done := make(chan struct{})
+	go t.reportProgress(done)
+	head := &headWriter{}
+	n, err := io.CopyBuffer(progressWriter{w: io.MultiWriter(up, h, head), t: t}, io.LimitReader(body, header.Size), make([]byte, transferBufferSize))
+	close(done)
+	if err == nil && n == header.Size {
+		err = finish()
+	}
+	if err == nil && pr != nil && n == header.Size {
+		err = pr.finish()
+	}
+	t.disablePause(nil)
+	sum := hex.EncodeToString(h.Sum(nil))
+	if err == nil && header.Verify && n == header.Size {
+		err = verifyTrailer(t, r, up.Location(), sum)
+	}
+	if err == nil && n != header.Size {
+		err = fmt.Errorf("connection closed after %d of %d bytes", n, header.Size)
+	}
+	if err == nil {
+		if err = config.Get().ReceivePolicy.checkMIME(t.Name, head.buf); err != nil {
+			reportRefusedHeader(err, t.Peer)
+		}
+	}
+	if err != nil {
+		up.Abort()
+		return err
+	}
+	if err := up.Commit(); err != nil {
+		return err
+	}
+	if header.Verify {
+		t.mu.Lock()
+		t.SHA256 = sum
+		t.mu.Unlock()
+	}
+	logger.Info("file stored", "id", t.ID, "storage", storage, "location", up.Location())
+	return nil
+}
+
+// headWriter keeps the first sniffLen bytes written to it
+type headWriter struct {
+	buf []byte
+}
+
+func (w *headWriter) Write(b []byte) (int, error) {
+	if room := sniffLen - len(w.buf); room > 0 {
+		w.buf = append(w.buf, b[:min(room, len(b))]...)
+	}
+	return len(b), nil
+}
+
+// httpBackend is a backend that takes each file as one HTTP PUT
+type httpBackend struct {
+	client  *http.Client
+	url     func(name string) *url.URL
+	sign    func(req *http.Request) // adds credentials to a request
+	maxSize int64                   // largest file it takes, 0 for no limit
+	cleanup bool                    // delete what an aborted PUT may have left
+}
+
+func newHTTPBackend() *httpBackend {
+	// Uploads run as long as the transfer does; the transfer's own timeouts
+	// and cancel end them
+	return &httpBackend{client: &http.Client{Transport: http.DefaultTransport.(*http.Transport).Clone()}}
+}
+
+// request builds a signed request; headers must be in place before the
+// signature covers them
+func (b *httpBackend) request(ctx context.Context, method string, u *url.URL, body io.Reader, header http.Header) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	b.sign(req)
+	return req, nil
+}
+
+// freeName finds a variant of name nothing is stored under. A server that
+// will not say leaves it to the PUT, which refuses to overwrite.
+func (b *httpBackend) freeName(ctx context.Context, name string) (string, error) {
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	candidate := name
+	for i := 1; i <= maxBackendNameTries; i++ {
+		req, err := b.request(ctx, http.MethodHead, b.url(candidate), nil, nil)
+		if err != nil {
+			return "", err
+		}
+		resp, err := b.client.Do(req)
+		if err != nil {
+			return "", err
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return candidate, nil
+		}
+		candidate = fmt.Sprintf("%s (%d)%s", base, i, ext)
+	}
+	return "", errors.New("too many files named " + name)
+}
+
+func (b *httpBackend) Create(ctx context.Context, name string, size int64) (Upload, error) {
+	if b.maxSize > 0 && size > b.maxSize {
+		return nil, fmt.Errorf("file too large for the storage backend: %d bytes, at most %d", size, b.maxSize)
+	}
+	name, err := b.freeName(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	u := b.url(name)
+	pr, pw := io.Pipe()
+	// Never overwrite a file that appeared since freeName looked
+	req, err := b.request(ctx, http.MethodPut, u, pr, http.Header{"If-None-Match": {"*"}})
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	if size == 0 {
+		req.Body = http.NoBody
+	}
+
+	up := &putUpload{backend: b, ctx: ctx, url: u, pw: pw, done: make(chan error, 1)}
+	go func() {
+		resp, err := b.client.Do(req)
+		if err == nil {
+			err = responseError(resp)
+		}
+		// A failed PUT stops reading; let the next Write say why
+		pr.CloseWithError(err)
+		up.done <- err
+	}()
+	return up, nil
+}
+
+// responseError turns a refused request into an error and closes it
+func responseError(resp *http.Response) error {
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode/100 == 2:
+		return nil
+	case resp.StatusCode == http.StatusPreconditionFailed:
+		return errors.New("the storage backend already has a file by that name")
+	}
+	detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	if msg := strings.TrimSpace(string(detail)); msg != "" {
+		return fmt.Errorf("storage backend answered %s: %s", resp.Status, msg)
+	}
+	return fmt.Errorf("storage backend answered %s", resp.Status)
+}
+
+type putUpload struct {
+	backend *httpBackend
+	ctx     context.Context
+	url     *url.URL
+	pw      *io.PipeWriter
+	done    chan error
+}
+
+var errUploadAborted = errors.New("upload aborted")
+
+func (u *putUpload) Write(b []byte) (int, error) { return u.pw.Write(b) }
+
+func (u *putUpload) Location() string {
+	loc := *u.url
+	loc.User = nil
+	return loc.String()
+}
+
+func (u *putUpload) Commit() error {
+	u.pw.Close()
+	return <-u.done
+}
+
+func (u *putUpload) Abort() {
+	u.pw.CloseWithError(errUploadAborted)
+	<-u.done
+	if !u.backend.cleanup {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if req, err := u.backend.request(ctx, http.MethodDelete, u.url, nil, nil); err == nil {
+		if resp, err := u.backend.client.Do(req); err == nil {
+			resp.Body.Close()
+		}
+	}
+}
+
+// newWebDAVBackend puts files into a WebDAV collection. A server may keep
+// what an aborted PUT wrote, so an abort deletes it again.
+func newWebDAVBackend(cfg StorageBackendConfig) StorageBackend {
+	base, _ := httpURL(cfg.URL)
+	b := newHTTPBackend()
+	b.cleanup = true
+	b.url = func(name string) *url.URL {
+		u := *base
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + name
+		u.RawPath = ""
+		return &u
+	}
+	b.sign = func(req *http.Request) {
+		if cfg.Username != "" || cfg.Password != "" {
+			req.SetBasicAuth(cfg.Username, cfg.Password)
+		}
+	}
+	return b
+}
+
+// newS3Backend puts files into a bucket, signing each request with AWS
+// Signature Version 4. The body is sent unsigned, as it streams.
+func newS3Backend(cfg StorageBackendConfig) StorageBackend {
+	endpoint, _ := httpURL(cfg.Endpoint)
+	region := cfg.Region
+	if region == "" {
+		region = defaultS3Region
+	}
+	b := newHTTPBackend()
+	b.maxSize = maxS3PutBytes
+	b.url = func(name string) *url.URL {
+		u := *endpoint
+		key := strings.TrimPrefix(cfg.Prefix, "/") + name
+		if cfg.VirtualHost {
+			u.Host = cfg.Bucket + "." + u.Host
+			u.Path = "/" + key
+		} else {
+			u.Path = "/" + cfg.Bucket + "/" + key
+		}
+		u.RawPath = s3Escape(u.Path)
+		return &u
+	}
+	b.sign = func(req *http.Request) {
+		signS3(req, cfg.AccessKey, cfg.SecretKey, region, s3UnsignedPayload, time.Now())
+	}
+	return b
+}
+
+// s3Escape encodes a path the way Signature Version 4 expects: everything
+// but unreserved characters and the slashes
+func s3Escape(p string) string {
+	var sb strings.Builder
+	for _, c := range []byte(p) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/':
+			sb.WriteByte(c)
+		default:
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+	return sb.String()
+}
+
+const s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+
+// signS3 adds the Signature Version 4 headers to req; payload is the
+// body's hex SHA-256 or s3UnsignedPayload
+func signS3(req *http.Request, accessKey, secretKey, region, payload string, now time.Time) {
+	now = now.UTC()
+	stamp := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", stamp)
+	req.Header.Set("X-Amz-Content-Sha256", payload)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.Join(values, ",")
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonical strings.Builder
+	for _, name := range names {
+		canonical.WriteString(name + ":" + strings.TrimSpace(headers[name]) + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	request := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonical.String(),
+		signed,
+		payload,
+	}, "\n")
+	scope := day + "/" + region + "/s3/aws4_request"
+	digest := sha256.Sum256([]byte(request))
+	toSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + hex.EncodeToString(digest[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), day)
+	for _, part := range []string{region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signed, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
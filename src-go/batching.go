@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"time"
+)
+
+// Batching: with many transfers running, progress, stats and log events
+// arrive by the thousand per second, and flushing each on its own costs
+// more than producing it. A channel that batches leaves events in its
+// buffer until max_bytes wait or the oldest has waited max_delay_ms, then
+// writes them in one go. Responses still flush at once, taking the events
+// before them along, so nothing is reordered and no response waits. The
+// stdout channel batches as the config's stdout_batching says; any
+// channel can change its own with set_output_batching, and flush_output
+// writes out what is waiting.
+const (
+	defaultBatchBytes = 64 << 10
+	maxBatchBytes     = 4 << 20
+	maxBatchDelay     = time.Second
+)
+
+// OutputBatching is how a channel batches events. A zero max_delay_ms
+// writes every event at once, as before batching existed.
+type OutputBatching struct {
+	MaxBytes   int `json:"max_bytes,omitempty"`    // flush once this much waits, default 65536
+	MaxDelayMs int `json:"max_delay_ms,omitempty"` // longest an event waits, 0 for no batching
+}
+
+func (b OutputBatching) Validate() error {
+	return b.validate("")
+}
+
+// validate names the fields in its errors after prefix, where b sits in
+// the config
+func (b OutputBatching) validate(prefix string) error {
+	if b.MaxBytes < 0 || b.MaxBytes > maxBatchBytes {
+		return catalogError(ErrInvalidArgument, "batching.field_must_between", "field", prefix+"max_bytes", "max", maxBatchBytes)
+	}
+	if b.MaxDelayMs < 0 || b.MaxDelayMs > int(maxBatchDelay/time.Millisecond) {
+		return catalogError(ErrInvalidArgument, "batching.field_must_between", "field", prefix+"max_delay_ms", "max", maxBatchDelay.Milliseconds())
+	}
+	return nil
+}
+
+func (b OutputBatching) enabled() bool { return b.MaxDelayMs > 0 }
+
+// effective fills in the default size
+func (b OutputBatching) effective() OutputBatching {
+	if b.enabled() && b.MaxBytes == 0 {
+		b.MaxBytes = defaultBatchBytes
+	}
+	return b
+}
+
+// SetBatching changes how the channel batches events, writing out what
+// waits first
+func (o *Output) SetBatching(b OutputBatching) {
+	if o.parent != nil {
+		o.parent.SetBatching(b)
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.flushLocked()
+	o.batch = b.effective()
+	// A buffer smaller than a batch would write it out in pieces
+	size := max(o.batch.MaxBytes, 4096)
+	if o.buf.Size() != size {
+		o.buf = bufio.NewWriterSize(o.w, size)
+		o.enc = json.NewEncoder(o.buf)
+	}
+}
+
+// Batching is how the channel batches events
+func (o *Output) Batching() OutputBatching {
+	if o.parent != nil {
+		return o.parent.Batching()
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.batch
+}
+
+// Flush writes out the events waiting in the channel's buffer and returns
+// how many bytes that was
+func (o *Output) Flush() (int, error) {
+	if o.parent != nil {
+		return o.parent.Flush()
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed {
+		return 0, nil
+	}
+	n := o.buf.Buffered()
+	return n, o.flushLocked()
+}
+
+// flushLocked writes the buffer out and disarms the timer
+func (o *Output) flushLocked() error {
+	if o.flushTimer != nil {
+		o.flushTimer.Stop()
+		o.flushTimer = nil
+	}
+	return o.buf.Flush()
+}
+
+// deferFlushLocked leaves an event in the buffer unless a batch is full,
+// making sure a timer will write it out
+func (o *Output) deferFlushLocked() error {
+	if o.buf.Buffered() >= o.batch.MaxBytes {
+		return o.flushLocked()
+	}
+	if o.flushTimer == nil {
+		o.flushTimer = time.AfterFunc(time.Duration(o.batch.MaxDelayMs)*time.Millisecond, o.timedFlush)
+	}
+	return nil
+}
+
+func (o *Output) timedFlush() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.flushTimer = nil
+	if !o.closed {
+		o.buf.Flush()
+	}
+}
+
+// handleSetOutputBatching changes batching on the channel the request
+// came in on
+func handleSetOutputBatching(payload json.RawMessage, writer *Output) {
+	var p OutputBatching
+	if err := json.Unmarshal(payload, &p); err != nil {
+		sendInvalidPayload(writer, "set_output_batching")
+		return
+	}
+	if err := p.Validate(); err != nil {
+		sendFailure(writer, err)
+		return
+	}
+	writer.SetBatching(p)
+	writer.Encode(ProtocolResponse{Status: "ok", Data: writer.Batching()})
+}
+
+// handleFlushOutput writes out the channel's waiting events. The response
+// would do so anyway; this says how much there was.
+func handleFlushOutput(writer *Output) {
+	n, err := writer.Flush()
+	if err != nil {
+		sendError(writer, message("batching.failed_flush_output", "error", err))
+		return
+	}
+	writer.Encode(ProtocolResponse{Status: "ok", Data: map[string]interface{}{"flushed_bytes": n}})
+}
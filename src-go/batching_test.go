@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lockedBuffer is written by flush timers while the test reads it
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestBatchingHoldsEventsUntilAResponse(t *testing.T) {
+	var out lockedBuffer
+	w := NewOutput(&out)
+	w.SetBatching(OutputBatching{MaxDelayMs: 1000})
+
+	w.Encode(ProtocolEvent{Status: "event", Event: "first"})
+	w.Encode(ProtocolEvent{Status: "event", Event: "second"})
+	if out.String() != "" {
+		t.Fatalf("events written before the batch was due: %s", out.String())
+	}
+	w.Encode(ProtocolResponse{Status: "ok", Message: "answer"})
+	got := out.String()
+	first, second, answer := strings.Index(got, "first"), strings.Index(got, "second"), strings.Index(got, "answer")
+	if first < 0 || !(first < second && second < answer) {
+		t.Errorf("response did not take the events along in order: %s", got)
+	}
+}
+
+func TestBatchingFlushesOnTimeAndSize(t *testing.T) {
+	var out lockedBuffer
+	w := NewOutput(&out)
+	w.SetBatching(OutputBatching{MaxDelayMs: 20})
+	w.Encode(ProtocolEvent{Status: "event", Event: "late"})
+	deadline := time.Now().Add(2 * time.Second)
+	for !strings.Contains(out.String(), "late") {
+		if time.Now().After(deadline) {
+			t.Fatal("event never written")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	w.SetBatching(OutputBatching{MaxBytes: 100, MaxDelayMs: 1000})
+	w.Encode(ProtocolEvent{Status: "event", Event: "small"})
+	if strings.Contains(out.String(), "small") {
+		t.Fatal("a batch under max_bytes was written")
+	}
+	w.Encode(ProtocolEvent{Status: "event", Event: "big", Data: strings.Repeat("x", 100)})
+	if !strings.Contains(out.String(), "big") {
+		t.Error("a full batch was held back")
+	}
+
+	w.Encode(ProtocolEvent{Status: "event", Event: "pending"})
+	if n, err := w.Flush(); err != nil || n == 0 || !strings.Contains(out.String(), "pending") {
+		t.Errorf("flush wrote %d bytes, %v", n, err)
+	}
+}
+
+func TestOutputBatchingValidate(t *testing.T) {
+	for _, b := range []OutputBatching{{MaxBytes: -1}, {MaxBytes: maxBatchBytes + 1}, {MaxDelayMs: 5000}} {
+		if b.Validate() == nil {
+			t.Errorf("%+v accepted", b)
+		}
+	}
+	// The config names the field in full and keeps the code
+	err := (&Config{StdoutBatching: OutputBatching{MaxBytes: -1}}).Validate()
+	var e *messageError
+	if !errors.As(err, &e) || e.code != ErrInvalidArgument || e.Args["field"] != "stdout_batching.max_bytes" {
+		t.Errorf("config error %v", err)
+	}
+	if b := (OutputBatching{MaxDelayMs: 10}).effective(); b.MaxBytes != defaultBatchBytes {
+		t.Errorf("default batch size %d", b.MaxBytes)
+	}
+}
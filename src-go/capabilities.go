@@ -0,0 +1,135 @@
+package main
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Discovery advertises what this node's transfer listener can do next to
+// its key, so a sender picks encryption, resume, QUIC or compression
+// before it connects instead of finding out from a refused header. The
+// TXT record carries the highest transfer protocol the node speaks and a
+// list of capability flags; a peer advertising neither is an older build
+// that speaks protocol 1 and says nothing about the rest.
+const (
+	protocolTXTKey     = "lumina_proto="
+	capabilitiesTXTKey = "lumina_caps="
+)
+
+// Capability flags in discovery records. Like features, flags are only
+// ever added.
+const (
+	capEncryption     = "encryption"
+	capResume         = "resume"
+	capQUIC           = "quic"
+	capChunkChecksums = "chunk_checksums"
+	capDedup          = "dedup"
+	capParallel       = "parallel"
+	capOffer          = "offer"
+)
+
+// localCapabilities is what this build's transfer listener offers, plus
+// its compression algorithms as "compression:<name>"
+var localCapabilities = []string{
+	capChunkChecksums,
+	"compression:" + compressGzip,
+	"compression:" + compressZstd,
+	capDedup,
+	capEncryption,
+	capOffer,
+	capParallel,
+	capQUIC,
+	capResume,
+}
+
+// capabilityText is the TXT entries discovery advertises with
+func capabilityText() []string {
+	return []string{
+		protocolTXTKey + strconv.Itoa(transferProtocolVersion),
+		capabilitiesTXTKey + strings.Join(localCapabilities, ","),
+	}
+}
+
+// PeerCapabilities is what a discovered peer advertised
+type PeerCapabilities struct {
+	MaxProtocol int      `json:"max_protocol"`
+	Flags       []string `json:"flags"`
+	Encryption  bool     `json:"encryption"`
+	Resume      bool     `json:"resume"`
+}
+
+// TransferModes are the send_file options both ends support, best first
+type TransferModes struct {
+	Protocol    int    `json:"protocol"` // highest both speak
+	Encrypted   bool   `json:"encrypted"`
+	Resume      bool   `json:"resume"`
+	Transport   string `json:"transport"`             // "quic" when both have it, else "tcp"
+	Compression string `json:"compression,omitempty"` // zstd over gzip
+	Streams     bool   `json:"streams,omitempty"`     // parallel streams
+	Dedup       bool   `json:"dedup,omitempty"`
+	Offer       bool   `json:"offer,omitempty"`
+}
+
+// textCapabilities reads the capability entries of a discovery TXT record;
+// nil when the peer advertises none
+func textCapabilities(text []string) *PeerCapabilities {
+	var caps *PeerCapabilities
+	for _, t := range text {
+		switch {
+		case strings.HasPrefix(t, protocolTXTKey):
+			if caps == nil {
+				caps = &PeerCapabilities{Flags: []string{}}
+			}
+			caps.MaxProtocol, _ = strconv.Atoi(t[len(protocolTXTKey):])
+		case strings.HasPrefix(t, capabilitiesTXTKey):
+			if caps == nil {
+				caps = &PeerCapabilities{Flags: []string{}}
+			}
+			for _, f := range strings.Split(t[len(capabilitiesTXTKey):], ",") {
+				if f = strings.TrimSpace(f); f != "" && !slices.Contains(caps.Flags, f) {
+					caps.Flags = append(caps.Flags, f)
+				}
+			}
+		}
+	}
+	if caps == nil {
+		return nil
+	}
+	if caps.MaxProtocol <= 0 {
+		caps.MaxProtocol = 1
+	}
+	caps.Encryption = slices.Contains(caps.Flags, capEncryption)
+	caps.Resume = slices.Contains(caps.Flags, capResume)
+	return caps
+}
+
+// suggestModes picks the transfer options to use with a peer that
+// advertised caps
+func suggestModes(caps *PeerCapabilities) *TransferModes {
+	if caps == nil {
+		return nil
+	}
+	both := func(flag string) bool {
+		return slices.Contains(caps.Flags, flag) && slices.Contains(localCapabilities, flag)
+	}
+	m := &TransferModes{
+		Protocol:  min(caps.MaxProtocol, transferProtocolVersion),
+		Encrypted: both(capEncryption),
+		Resume:    both(capResume),
+		Transport: "tcp",
+		Streams:   both(capParallel),
+		Dedup:     both(capDedup),
+		Offer:     both(capOffer),
+	}
+	if both(capQUIC) {
+		m.Transport = "quic"
+	}
+	for _, algorithm := range []string{compressZstd, compressGzip} {
+		if both("compression:" + algorithm) {
+			m.Compression = algorithm
+			break
+		}
+	}
+	return m
+}
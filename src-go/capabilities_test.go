@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestTextCapabilities(t *testing.T) {
+	if textCapabilities([]string{identityTXTKey + "abc"}) != nil {
+		t.Error("older peer reported capabilities")
+	}
+
+	caps := textCapabilities(capabilityText())
+	if caps == nil || caps.MaxProtocol != transferProtocolVersion || !caps.Encryption || !caps.Resume {
+		t.Fatalf("own capabilities %+v", caps)
+	}
+	m := suggestModes(caps)
+	if !m.Encrypted || !m.Resume || m.Transport != "quic" || m.Compression != compressZstd {
+		t.Errorf("modes with self %+v", m)
+	}
+
+	caps = textCapabilities([]string{"lumina_proto=7", "lumina_caps=resume,compression:gzip,teleport"})
+	m = suggestModes(caps)
+	if caps.MaxProtocol != 7 || caps.Encryption || m.Protocol != transferProtocolVersion {
+		t.Errorf("newer peer %+v, modes %+v", caps, m)
+	}
+	if m.Encrypted || !m.Resume || m.Transport != "tcp" || m.Compression != compressGzip {
+		t.Errorf("modes with newer peer %+v", m)
+	}
+}
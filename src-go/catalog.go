@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Localized responses: error and success responses are sent as a
+// Message, a key of messageCatalog and its placeholder values, and carry
+// both as message_key and message_args so a frontend can translate them
+// on its own. Errors a handler passes on are built with catalogError to
+// keep theirs, and success responses with okResponse. A channel that
+// picked a locale with set_locale gets message in that language when a
+// translation exists, from the built-in ones or those the frontend
+// supplied; other channels use the config's locale, English by default.
+const maxLocaleMessages = 4096
+
+var localeTag = regexp.MustCompile(`^[A-Za-z]{2,3}([-_][A-Za-z0-9]{2,8})*$`)
+
+// Message is a catalog entry with the values of its placeholders
+type Message struct {
+	Key  string
+	Args map[string]string
+}
+
+// message fills in catalog entry key with args, given as placeholder name
+// and value pairs; values print as fmt.Sprint prints them
+func message(key string, args ...interface{}) Message {
+	m := Message{Key: key}
+	if len(args) > 0 {
+		m.Args = make(map[string]string, len(args)/2)
+		for i := 0; i+1 < len(args); i += 2 {
+			m.Args[args[i].(string)] = fmt.Sprint(args[i+1])
+		}
+	}
+	return m
+}
+
+func (m Message) String() string {
+	return renderTemplate(messageCatalog[m.Key], m.Args)
+}
+
+// okResponse is a success response carrying m and data
+func okResponse(m Message, data interface{}) ProtocolResponse {
+	return ProtocolResponse{Status: "ok", Message: m.String(), MessageKey: m.Key, MessageArgs: m.Args, Data: data}
+}
+
+// messageError is an error whose text is a catalog message
+type messageError struct {
+	Message
+	code    string // sent as the response's code, see errors.go
+	wrapped []error
+}
+
+func (e *messageError) Error() string   { return e.String() }
+func (e *messageError) Unwrap() []error { return e.wrapped }
+
+// catalogError is message as an error with an error code, which wraps the
+// errors among args
+func catalogError(code, key string, args ...interface{}) error {
+	e := &messageError{Message: message(key, args...), code: code}
+	for i := 1; i < len(args); i += 2 {
+		if err, ok := args[i].(error); ok {
+			e.wrapped = append(e.wrapped, err)
+		}
+	}
+	return e
+}
+
+// messageOf is the message err, or an error it wraps, was built with by
+// catalogError, or its text as common.error
+func messageOf(err error) Message {
+	var e *messageError
+	if errors.As(err, &e) {
+		return e.Message
+	}
+	return message("common.error", "error", err)
+}
+
+// templatePart is literal text or, with hole set, a placeholder name
+type templatePart struct {
+	text string
+	hole bool
+}
+
+// parseTemplate splits a catalog message into literal text and placeholders
+func parseTemplate(t string) []templatePart {
+	var parts []templatePart
+	var lit strings.Builder
+	for i := 0; i < len(t); i++ {
+		switch {
+		case strings.HasPrefix(t[i:], "{{"):
+			lit.WriteByte('{')
+			i++
+		case strings.HasPrefix(t[i:], "}}"):
+			lit.WriteByte('}')
+			i++
+		case t[i] == '{':
+			end := strings.IndexByte(t[i:], '}')
+			if end < 0 {
+				lit.WriteString(t[i:])
+				i = len(t)
+				continue
+			}
+			if lit.Len() > 0 {
+				parts = append(parts, templatePart{text: lit.String()})
+				lit.Reset()
+			}
+			parts = append(parts, templatePart{text: t[i+1 : i+end], hole: true})
+			i += end
+		default:
+			lit.WriteByte(t[i])
+		}
+	}
+	if lit.Len() > 0 {
+		parts = append(parts, templatePart{text: lit.String()})
+	}
+	return parts
+}
+
+// renderTemplate fills in a message; a placeholder without a value stays
+func renderTemplate(t string, args map[string]string) string {
+	var b strings.Builder
+	for _, p := range parseTemplate(t) {
+		if v, ok := args[p.text]; p.hole && ok {
+			b.WriteString(v)
+		} else if p.hole {
+			b.WriteString("{" + p.text + "}")
+		} else {
+			b.WriteString(p.text)
+		}
+	}
+	return b.String()
+}
+
+var (
+	localesMu     sync.Mutex
+	customLocales = make(map[string]map[string]string) // translations set_locale was given
+	defaultLocale atomic.Pointer[string]               // the config's locale
+)
+
+// normalizeLocale lowercases a tag and writes it with dashes, as in "pt-br"
+func normalizeLocale(tag string) string {
+	return strings.ToLower(strings.ReplaceAll(tag, "_", "-"))
+}
+
+func validLocale(tag string) bool {
+	return tag == "" || localeTag.MatchString(tag)
+}
+
+func setDefaultLocale(tag string) {
+	tag = normalizeLocale(tag)
+	defaultLocale.Store(&tag)
+}
+
+// translation is the text of key in locale, falling back from a regional
+// tag such as "uk-ua" to its language; false means English
+func translation(locale, key string) (string, bool) {
+	if locale == "" {
+		if l := defaultLocale.Load(); l != nil {
+			locale = *l
+		}
+	}
+	localesMu.Lock()
+	defer localesMu.Unlock()
+	for tag := locale; tag != "" && tag != "en"; {
+		if text, ok := customLocales[tag][key]; ok {
+			return text, true
+		}
+		if text, ok := builtinTranslations[tag][key]; ok {
+			return text, true
+		}
+		i := strings.LastIndexByte(tag, '-')
+		if i < 0 {
+			break
+		}
+		tag = tag[:i]
+	}
+	return "", false
+}
+
+// localize translates a response's message when it was sent with a
+// catalog key
+func localize(resp ProtocolResponse, locale string) ProtocolResponse {
+	if resp.Message == "" || resp.MessageKey == "" {
+		return resp
+	}
+	if text, ok := translation(locale, resp.MessageKey); ok {
+		resp.Message = renderTemplate(text, resp.MessageArgs)
+	}
+	return resp
+}
+
+type SetLocalePayload struct {
+	Locale   string            `json:"locale"`   // BCP 47 tag such as "uk" or "ja-JP"; "en" for no translation
+	Messages map[string]string `json:"messages"` // translations by catalog key, merged over the built-in ones
+}
+
+// handleSetLocale picks the language of this channel's messages
+func handleSetLocale(payload json.RawMessage, writer *Output) {
+	var p SetLocalePayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		sendInvalidPayload(writer, "set_locale")
+		return
+	}
+	if p.Locale == "" || !validLocale(p.Locale) {
+		sendErrorCode(writer, ErrInvalidArgument, message("catalog.set_locale_requires_locale"), nil)
+		return
+	}
+	if len(p.Messages) > maxLocaleMessages {
+		sendErrorCode(writer, ErrInvalidArgument, message("catalog.messages_must_hold_most", "max_locale_messages", maxLocaleMessages), nil)
+		return
+	}
+	for key := range p.Messages {
+		if _, ok := messageCatalog[key]; !ok {
+			sendErrorCode(writer, ErrNotFound, message("catalog.message_key_not_found", "key", key), map[string]interface{}{"key": key})
+			return
+		}
+	}
+	locale := normalizeLocale(p.Locale)
+	if len(p.Messages) > 0 {
+		localesMu.Lock()
+		if customLocales[locale] == nil {
+			customLocales[locale] = make(map[string]string, len(p.Messages))
+		}
+		for key, text := range p.Messages {
+			customLocales[locale][key] = text
+		}
+		localesMu.Unlock()
+	}
+	writer.SetLocale(locale)
+
+	translated := 0
+	for key := range messageCatalog {
+		if _, ok := translation(locale, key); ok {
+			translated++
+		}
+	}
+	writer.Encode(okResponse(message("catalog.locale_set", "locale", locale),
+		map[string]interface{}{"locale": locale, "translated": translated, "messages": len(messageCatalog)}))
+}
+
+type GetMessageCatalogPayload struct {
+	Locale string `json:"locale"` // also return this locale's translations
+}
+
+// handleGetMessageCatalog returns the English catalog, for a frontend to
+// build its own translations from, and those this build has for locale
+func handleGetMessageCatalog(payload json.RawMessage, writer *Output) {
+	var p GetMessageCatalogPayload
+	if len(payload) > 0 && string(payload) != "null" {
+		if err := json.Unmarshal(payload, &p); err != nil {
+			sendInvalidPayload(writer, "get_message_catalog")
+			return
+		}
+	}
+	data := map[string]interface{}{"messages": messageCatalog}
+	if p.Locale != "" {
+		locale := normalizeLocale(p.Locale)
+		translations := make(map[string]string)
+		for key := range messageCatalog {
+			if text, ok := translation(locale, key); ok {
+				translations[key] = text
+			}
+		}
+		data["locale"] = locale
+		data["translations"] = translations
+	}
+	writer.Encode(ProtocolResponse{Status: "ok", Data: data})
+}
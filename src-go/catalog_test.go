@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestTranslationsMatchCatalog(t *testing.T) {
+	for locale, messages := range builtinTranslations {
+		for key, text := range messages {
+			english, ok := messageCatalog[key]
+			if !ok {
+				t.Errorf("%s: %s is not in the catalog", locale, key)
+				continue
+			}
+			want := map[string]bool{}
+			for _, p := range parseTemplate(english) {
+				want[p.text] = want[p.text] || p.hole
+			}
+			for _, p := range parseTemplate(text) {
+				if p.hole && !want[p.text] {
+					t.Errorf("%s: %s uses {%s}, which %q lacks", locale, key, p.text, english)
+				}
+			}
+		}
+	}
+}
+
+func TestLocalize(t *testing.T) {
+	m := message("main.unknown_command", "command", "frob")
+	failed := ProtocolResponse{Status: "error", Message: m.String(), MessageKey: m.Key, MessageArgs: m.Args}
+	if resp := localize(failed, "ja-JP"); resp.Message != "不明なコマンド: frob" || resp.MessageArgs["command"] != "frob" {
+		t.Errorf("localized %+v", resp)
+	}
+	if resp := localize(failed, "en"); resp.Message != "Unknown command: frob" || resp.MessageKey != "main.unknown_command" {
+		t.Errorf("english %+v", resp)
+	}
+	if resp := localize(okResponse(message("discovery.started", "service", "_lumina._tcp"),
+		nil), "ja"); resp.Message != "_lumina._tcp の検出を開始しました" {
+		t.Errorf("success %+v", resp)
+	}
+	// Text sent without a key stays as it is, even when it reads like a
+	// catalog message
+	if resp := localize(ProtocolResponse{Status: "error", Message: "Unknown command: frob"}, "ja"); resp.MessageKey != "" || resp.Message != "Unknown command: frob" {
+		t.Errorf("uncatalogued %+v", resp)
+	}
+}
+
+// Every message and catalogError call names a catalog key and fills in
+// exactly its placeholders
+func TestMessageCallsMatchCatalog(t *testing.T) {
+	files, err := filepath.Glob("*.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fset := token.NewFileSet()
+	for _, name := range files {
+		f, err := parser.ParseFile(fset, name, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ast.Inspect(f, func(n ast.Node) bool {
+			call, ok := n.(*ast.CallExpr)
+			if !ok {
+				return true
+			}
+			fn, ok := call.Fun.(*ast.Ident)
+			if !ok || (fn.Name != "message" && fn.Name != "catalogError") {
+				return true
+			}
+			// catalogError takes the error code first
+			args := call.Args
+			if fn.Name == "catalogError" && len(args) > 0 {
+				args = args[1:]
+			}
+			if len(args) == 0 {
+				return true
+			}
+			lit, ok := args[0].(*ast.BasicLit)
+			if !ok {
+				return true
+			}
+			key, _ := strconv.Unquote(lit.Value)
+			text, ok := messageCatalog[key]
+			if !ok {
+				t.Errorf("%s: %s is not in the catalog", fset.Position(call.Pos()), key)
+				return true
+			}
+			want := map[string]bool{}
+			for _, p := range parseTemplate(text) {
+				if p.hole {
+					want[p.text] = true
+				}
+			}
+			got := map[string]bool{}
+			for i := 1; i < len(args); i += 2 {
+				if name, ok := args[i].(*ast.BasicLit); ok {
+					arg, _ := strconv.Unquote(name.Value)
+					got[arg] = true
+				}
+			}
+			if len(got) != len(want) {
+				t.Errorf("%s: %s fills in %v, wants %v", fset.Position(call.Pos()), key, got, want)
+			}
+			for name := range got {
+				if !want[name] {
+					t.Errorf("%s: %s has no {%s}", fset.Position(call.Pos()), key, name)
+				}
+			}
+			return true
+		})
+	}
+}
+
+func TestCatalogError(t *testing.T) {
+	cause := errors.New("no route to host")
+	err := catalogError(ErrFailed, "ping.failed_resolve", "host", "example.com", "error", cause)
+	if err.Error() != "Failed to resolve example.com: no route to host" || !errors.Is(err, cause) {
+		t.Errorf("error %q", err)
+	}
+	if m := messageOf(err); m.Key != "ping.failed_resolve" || m.Args["host"] != "example.com" {
+		t.Errorf("message %+v", m)
+	}
+	if m := messageOf(cause); m.Key != "common.error" || m.String() != "no route to host" {
+		t.Errorf("uncatalogued %+v", m)
+	}
+}
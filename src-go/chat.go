@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The chat protocol runs on connections accepted by "chat" listeners and
+// on outbound connections made with protocol "chat". Each frame is one
+// JSON line; every message is answered with an ack carrying its ID.
+const (
+	chatProtocol   = "chat"
+	maxChatMessage = 64 << 10
+)
+
+var errNotChat = catalogError(ErrFailed, "chat.connection_does_not_speak")
+
+// chatFrame is one line of the chat protocol
+type chatFrame struct {
+	Type   string `json:"type"` // "message", "ack", "closing"
+	ID     string `json:"id"`
+	From   string `json:"from,omitempty"`
+	Text   string `json:"text,omitempty"`
+	Sent   int64  `json:"sent,omitempty"`   // unix milliseconds
+	Within int64  `json:"within,omitempty"` // closing: milliseconds until the server closes
+}
+
+// ChatMessage is a message kept in a peer's history
+type ChatMessage struct {
+	ID         string     `json:"id"`
+	Direction  string     `json:"direction"` // "in", "out"
+	Connection string     `json:"connection"`
+	From       string     `json:"from,omitempty"`
+	Text       string     `json:"text"`
+	Sent       time.Time  `json:"sent"`
+	Received   *time.Time `json:"received,omitempty"` // incoming messages only
+	Delivered  bool       `json:"delivered"`
+}
+
+// ChatState tracks unacknowledged messages and the optional per-peer history
+type ChatState struct {
+	mu      sync.Mutex
+	pending map[string]pendingMessage // message ID -> sent message awaiting its ack
+	limit   int                       // messages kept per peer, 0 keeps none
+	history map[string][]*ChatMessage
+}
+
+type pendingMessage struct {
+	conn string
+	sent time.Time
+	msg  *ChatMessage // nil when history is off
+}
+
+var (
+	chat    = ChatState{pending: make(map[string]pendingMessage), history: make(map[string][]*ChatMessage)}
+	chatSeq atomic.Uint64
+)
+
+// speaksChat reports whether c carries chat frames
+func (c *Connection) speaksChat() bool {
+	return c.Protocol() == chatProtocol
+}
+
+// chatPeer is the history key for c: the discovered instance behind it if
+// known, otherwise the remote IP
+func chatPeer(c *Connection) string {
+	remote := c.Info().RemoteAddr
+	if peer, known := discoveredPeer(remote); known {
+		return peer
+	}
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		return host
+	}
+	return remote
+}
+
+// recordLocked appends msg to peer's history; the caller holds chat.mu
+func (s *ChatState) recordLocked(peer string, msg *ChatMessage) {
+	if s.limit <= 0 {
+		return
+	}
+	h := append(s.history[peer], msg)
+	if len(h) > s.limit {
+		h = h[len(h)-s.limit:]
+	}
+	s.history[peer] = h
+}
+
+// handleChatConnection serves the chat protocol on an inbound connection
+func handleChatConnection(conn *Connection, _ *Listener, _ string) {
+	defer untrackConn(conn)
+	emitEvent("connection_opened", conn.Info())
+
+	reader := bufio.NewReader(conn)
+	for {
+		// The same bound as an outbound chat stream's
+		line, err := readLineLimit(reader, maxChatMessage*2)
+		if len(line) > 0 {
+			handleChatFrame(conn, line)
+		}
+		if err != nil {
+			emitClosed(conn, err)
+			return
+		}
+	}
+}
+
+// chatStream splits the chunks an outbound reader gets into chat frames
+type chatStream struct {
+	buf []byte
+}
+
+func (s *chatStream) feed(c *Connection, data []byte) {
+	s.buf = append(s.buf, data...)
+	for {
+		i := bytes.IndexByte(s.buf, '\n')
+		if i < 0 {
+			break
+		}
+		handleChatFrame(c, s.buf[:i+1])
+		s.buf = s.buf[i+1:]
+	}
+	if len(s.buf) > maxChatMessage*2 {
+		logger.Warn("dropping oversized chat frame", "id", c.ID, "bytes", len(s.buf))
+		s.buf = nil
+	}
+}
+
+func handleChatFrame(c *Connection, line []byte) {
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 {
+		return
+	}
+	var f chatFrame
+	if err := json.Unmarshal(line, &f); err != nil || f.ID == "" {
+		logger.Warn("invalid chat frame", "id", c.ID)
+		return
+	}
+
+	switch f.Type {
+	case "message":
+		ack, _ := json.Marshal(chatFrame{Type: "ack", ID: f.ID})
+		c.Write(append(ack, '\n'))
+
+		received := time.Now()
+		sent := time.UnixMilli(f.Sent)
+		peer := chatPeer(c)
+		chat.mu.Lock()
+		chat.recordLocked(peer, &ChatMessage{
+			ID: f.ID, Direction: "in", Connection: c.ID, From: f.From, Text: f.Text,
+			Sent: sent, Received: &received, Delivered: true,
+		})
+		chat.mu.Unlock()
+
+		emitEvent("message_received", map[string]interface{}{
+			"id":         f.ID,
+			"connection": c.ID,
+			"from":       f.From,
+			"peer":       peer,
+			"text":       f.Text,
+			"sent":       sent,
+			"received":   received,
+		})
+	case "ack":
+		chat.mu.Lock()
+		pm, exists := chat.pending[f.ID]
+		if exists && pm.conn == c.ID {
+			delete(chat.pending, f.ID)
+			if pm.msg != nil {
+				pm.msg.Delivered = true
+			}
+		}
+		chat.mu.Unlock()
+		if exists && pm.conn == c.ID {
+			emitEvent("message_delivered", map[string]interface{}{
+				"id":         f.ID,
+				"connection": c.ID,
+				"rtt_ms":     time.Since(pm.sent).Milliseconds(),
+			})
+		}
+	case "closing":
+		emitEvent("peer_closing", map[string]interface{}{
+			"connection": c.ID,
+			"from":       f.From,
+			"reason":     f.Text,
+			"within_ms":  f.Within,
+		})
+	}
+}
+
+// sendChat writes a message frame on c; its ack later arrives as a
+// message_delivered event
+func sendChat(c *Connection, text string) (string, error) {
+	if !c.speaksChat() {
+		return "", errNotChat
+	}
+	id := fmt.Sprintf("msg-%d", chatSeq.Add(1))
+	now := time.Now()
+	frame, _ := json.Marshal(chatFrame{Type: "message", ID: id, From: senderName(), Text: text, Sent: now.UnixMilli()})
+
+	peer := chatPeer(c)
+	chat.mu.Lock()
+	pm := pendingMessage{conn: c.ID, sent: now}
+	if chat.limit > 0 {
+		pm.msg = &ChatMessage{ID: id, Direction: "out", Connection: c.ID, Text: text, Sent: now}
+		chat.recordLocked(peer, pm.msg)
+	}
+	chat.pending[id] = pm
+	chat.mu.Unlock()
+
+	if _, err := c.Write(append(frame, '\n')); err != nil {
+		chat.mu.Lock()
+		delete(chat.pending, id)
+		chat.mu.Unlock()
+		return "", err
+	}
+	return id, nil
+}
+
+// forgetPending drops acks that can no longer arrive once c has closed
+func forgetPending(c *Connection) {
+	chat.mu.Lock()
+	defer chat.mu.Unlock()
+	for id, pm := range chat.pending {
+		if pm.conn == c.ID {
+			delete(chat.pending, id)
+		}
+	}
+}
+
+type SendMessagePayload struct {
+	ID   string `json:"id"` // connection
+	Text string `json:"text"`
+}
+
+func handleSendMessage(payload json.RawMessage, writer *Output) {
+	var p SendMessagePayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		sendInvalidPayload(writer, "send_message")
+		return
+	}
+	if len(p.Text) > maxChatMessage {
+		sendErrorCode(writer, ErrInvalidArgument, message("chat.message_exceeds_bytes", "max_chat_message", maxChatMessage), nil)
+		return
+	}
+	c, exists := lookupConn(p.ID, writer)
+	if !exists {
+		sendErrorCode(writer, ErrNotFound, message("common.connection_not_found"), nil)
+		return
+	}
+	id, err := sendChat(c, p.Text)
+	if err != nil {
+		sendError(writer, message("chat.failed_send_message", "id", p.ID, "error", err))
+		return
+	}
+	writer.Encode(ProtocolResponse{
+		Status: "ok",
+		Data:   map[string]interface{}{"id": id, "connection": p.ID},
+	})
+}
+
+type BroadcastMessagePayload struct {
+	Text     string `json:"text"`
+	Listener string `json:"listener"` // only connections accepted by this listener
+}
+
+// handleBroadcastMessage sends the same text on every chat connection
+func handleBroadcastMessage(payload json.RawMessage, writer *Output) {
+	var p BroadcastMessagePayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		sendInvalidPayload(writer, "broadcast_message")
+		return
+	}
+	if len(p.Text) > maxChatMessage {
+		sendErrorCode(writer, ErrInvalidArgument, message("chat.message_exceeds_bytes", "max_chat_message", maxChatMessage), nil)
+		return
+	}
+
+	state.Mutex.Lock()
+	var targets []*Connection
+	for _, c := range state.Conns {
+		if c.speaksChat() && (p.Listener == "" || c.Listener == p.Listener) {
+			targets = append(targets, c)
+		}
+	}
+	state.Mutex.Unlock()
+	sort.Slice(targets, func(i, j int) bool { return targets[i].Created.Before(targets[j].Created) })
+
+	messages := map[string]string{}
+	failed := map[string]string{}
+	for _, c := range targets {
+		id, err := sendChat(c, p.Text)
+		if err != nil {
+			failed[c.ID] = err.Error()
+			continue
+		}
+		messages[c.ID] = id
+	}
+	writer.Encode(okResponse(message("chat.message_sent_connections", "messages", len(messages)),
+		map[string]interface{}{"messages": messages, "failed": failed}))
+}
+
+type ChatHistoryPayload struct {
+	Peer  string `json:"peer"`  // empty for every peer
+	Limit *int   `json:"limit"` // set_chat_history: messages kept per peer, 0 turns history off
+}
+
+func handleSetChatHistory(payload json.RawMessage, writer *Output) {
+	var p ChatHistoryPayload
+	if err := json.Unmarshal(payload, &p); err != nil || p.Limit == nil || *p.Limit < 0 {
+		sendErrorCode(writer, ErrInvalidArgument, message("chat.set_chat_history_requires"), nil)
+		return
+	}
+	chat.mu.Lock()
+	chat.limit = *p.Limit
+	for peer, h := range chat.history {
+		if len(h) > chat.limit {
+			h = h[len(h)-chat.limit:]
+		}
+		if len(h) == 0 {
+			delete(chat.history, peer)
+		} else {
+			chat.history[peer] = h
+		}
+	}
+	chat.mu.Unlock()
+	writer.Encode(okResponse(message("chat.keeping_messages_per_peer", "limit", *p.Limit),
+		map[string]interface{}{"limit": *p.Limit}))
+}
+
+func handleGetChatHistory(payload json.RawMessage, writer *Output) {
+	var p ChatHistoryPayload
+	if len(payload) > 0 && string(payload) != "null" {
+		if err := json.Unmarshal(payload, &p); err != nil {
+			sendInvalidPayload(writer, "get_chat_history")
+			return
+		}
+	}
+	chat.mu.Lock()
+	history := make(map[string][]ChatMessage)
+	for peer, h := range chat.history {
+		if p.Peer != "" && peer != p.Peer {
+			continue
+		}
+		msgs := make([]ChatMessage, len(h))
+		for i, m := range h {
+			msgs[i] = *m
+		}
+		history[peer] = msgs
+	}
+	limit := chat.limit
+	chat.mu.Unlock()
+	writer.Encode(ProtocolResponse{
+		Status: "ok",
+		Data:   map[string]interface{}{"limit": limit, "history": history},
+	})
+}
+
+func handleClearChatHistory(payload json.RawMessage, writer *Output) {
+	var p ChatHistoryPayload
+	if len(payload) > 0 && string(payload) != "null" {
+		if err := json.Unmarshal(payload, &p); err != nil {
+			sendInvalidPayload(writer, "clear_chat_history")
+			return
+		}
+	}
+	chat.mu.Lock()
+	if p.Peer == "" {
+		chat.history = make(map[string][]*ChatMessage)
+	} else {
+		delete(chat.history, p.Peer)
+	}
+	chat.mu.Unlock()
+	writer.Encode(okResponse(message("chat.history_cleared"), nil))
+}
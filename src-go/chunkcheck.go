@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sync"
+)
+
+// Checked bodies catch corruption one frame at a time instead of at the
+// final SHA-256. When send_file asks for chunk_checksums and the receiver
+// agrees, every data frame of the pausable body carries a sequence number
+// and a CRC-32C of itself. The receiver acknowledges each good frame on
+// the back channel and asks again for the first one that fails; the
+// sender keeps unacknowledged frames, at most checkedWindow of them, and
+// goes back to the frame asked for. A frame that fails more than
+// chunk_retries times ends the transfer. Sequence numbers start at 1.
+const (
+	frameChecked byte = frameEnd + 1 // sequence, CRC-32C, data
+
+	checkedPrefix       = 8  // sequence and checksum before the data
+	checkedWindow       = 64 // frames in flight before the sender waits for acks
+	defaultChunkRetries = 3
+	maxChunkRetries     = 20
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// checkedSum covers the sequence number as well, so a damaged one is
+// caught too
+func checkedSum(seq uint32, data []byte) uint32 {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], seq)
+	return crc32.Update(crc32.Checksum(b[:], castagnoli), castagnoli, data)
+}
+
+// sentChunk is a frame kept until the receiver acknowledges it
+type sentChunk struct {
+	seq   uint32
+	frame []byte
+}
+
+// chunkLog is the sender's record of checked frames in flight
+type chunkLog struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	t       *Transfer
+	retries int
+	next    uint32
+	unacked []sentChunk // oldest first
+	rewind  uint32      // frame the receiver asked for again, 0 for none
+	tries   map[uint32]int
+	err     error
+}
+
+func newChunkLog(t *Transfer, retries int) *chunkLog {
+	l := &chunkLog{t: t, retries: retries, next: 1, tries: make(map[uint32]int)}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// add builds the next frame for data and keeps it
+func (l *chunkLog) add(data []byte) []byte {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	seq := l.next
+	l.next++
+	frame := make([]byte, frameHeaderSize+checkedPrefix+len(data))
+	frame[0] = frameChecked
+	binary.BigEndian.PutUint32(frame[1:], uint32(checkedPrefix+len(data)))
+	binary.BigEndian.PutUint32(frame[5:], seq)
+	binary.BigEndian.PutUint32(frame[9:], checkedSum(seq, data))
+	copy(frame[frameHeaderSize+checkedPrefix:], data)
+	l.unacked = append(l.unacked, sentChunk{seq, frame})
+	return frame
+}
+
+// ack forgets every frame up to seq
+func (l *chunkLog) ack(seq uint32) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	i := 0
+	for i < len(l.unacked) && l.unacked[i].seq <= seq {
+		delete(l.tries, l.unacked[i].seq)
+		i++
+	}
+	l.unacked = l.unacked[i:]
+	l.cond.Broadcast()
+}
+
+// retransmit marks seq for sending again. The receiver asks once per bad
+// frame, so requests arriving before the resend went out are one attempt.
+func (l *chunkLog) retransmit(seq uint32) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rewind != 0 || l.err != nil {
+		return
+	}
+	if len(l.unacked) == 0 || seq < l.unacked[0].seq || seq >= l.next {
+		l.failLocked(fmt.Errorf("receiver asked for chunk %d, which is not in flight", seq))
+		return
+	}
+	l.tries[seq]++
+	attempt := l.tries[seq]
+	if attempt > l.retries {
+		l.failLocked(fmt.Errorf("chunk %d failed its checksum %d times", seq, attempt))
+		return
+	}
+	l.rewind = seq
+	l.cond.Broadcast()
+
+	l.t.mu.Lock()
+	l.t.Retransmits++
+	l.t.mu.Unlock()
+	logger.Warn("chunk checksum failed, resending", "id", l.t.ID, "seq", seq, "attempt", attempt)
+	emitEvent("transfer_chunk_retransmitted", map[string]interface{}{
+		"id":      l.t.ID,
+		"seq":     seq,
+		"attempt": attempt,
+		"retries": l.retries,
+	})
+}
+
+func (l *chunkLog) fail(err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.failLocked(err)
+}
+
+func (l *chunkLog) failLocked(err error) {
+	if l.err == nil {
+		l.err = err
+	}
+	l.cond.Broadcast()
+}
+
+// wait blocks until settled reports true, a resend is due or the body
+// broke, and returns the frames to send again
+func (l *chunkLog) wait(settled func() bool) ([][]byte, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for l.err == nil && l.rewind == 0 && !settled() {
+		l.cond.Wait()
+	}
+	if l.err != nil {
+		return nil, l.err
+	}
+	if l.rewind == 0 {
+		return nil, nil
+	}
+	var frames [][]byte
+	for _, c := range l.unacked {
+		if c.seq >= l.rewind {
+			frames = append(frames, c.frame)
+		}
+	}
+	l.rewind = 0
+	return frames, nil
+}
+
+// writeChecked sends data as the next checked frame once the window has
+// room, first resending anything the receiver asked for
+func (pw *pausableWriter) writeChecked(data []byte) error {
+	l := pw.chunks
+	for {
+		resend, err := l.wait(func() bool { return len(l.unacked) < checkedWindow })
+		if err != nil {
+			return err
+		}
+		if err := pw.resend(resend); err != nil {
+			return err
+		}
+		if resend == nil {
+			break
+		}
+	}
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	_, err := pw.w.Write(l.add(data))
+	return err
+}
+
+// settleChecked waits until the receiver has every frame
+func (pw *pausableWriter) settleChecked() error {
+	l := pw.chunks
+	for {
+		resend, err := l.wait(func() bool { return len(l.unacked) == 0 })
+		if err != nil || resend == nil {
+			return err
+		}
+		if err := pw.resend(resend); err != nil {
+			return err
+		}
+	}
+}
+
+func (pw *pausableWriter) resend(frames [][]byte) error {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	for _, frame := range frames {
+		if _, err := pw.w.Write(frame); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readChecked reads a checked frame of n bytes, keeping its data when it
+// is the one expected and intact, and answers it on the back channel
+func (pr *pausableReader) readChecked(n uint32) error {
+	if n < checkedPrefix || n > checkedPrefix+transferBufferSize {
+		return fmt.Errorf("invalid checked frame of %d bytes", n)
+	}
+	if cap(pr.buf) < int(n) {
+		pr.buf = make([]byte, n)
+	}
+	buf := pr.buf[:n]
+	if _, err := io.ReadFull(pr.r, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	seq, sum, data := binary.BigEndian.Uint32(buf), binary.BigEndian.Uint32(buf[4:]), buf[checkedPrefix:]
+	if checkedSum(seq, data) != sum {
+		// Whatever frame this was, the expected one is what we need
+		pr.bad++
+		if pr.bad > maxChunkRetries {
+			return fmt.Errorf("chunk %d failed its checksum %d times", pr.expect, pr.bad)
+		}
+		logger.Warn("chunk checksum failed", "id", pr.t.ID, "seq", pr.expect)
+		pr.t.mu.Lock()
+		pr.t.Retransmits++
+		pr.t.mu.Unlock()
+		return pr.back(transferControl{Control: "retransmit", Seq: pr.expect})
+	}
+	if seq != pr.expect {
+		return nil // sent before our request, or a copy of one we have
+	}
+	pr.expect++
+	pr.bad = 0
+	pr.ready = data
+	return pr.back(transferControl{Control: "chunk_ack", Seq: seq})
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// corruptingProxy forwards connections to target, flipping a bit at each
+// of offsets in what the sender writes
+func corruptingProxy(t *testing.T, target string, offsets ...int64) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			client, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			server, err := net.Dial("tcp", target)
+			if err != nil {
+				client.Close()
+				continue
+			}
+			go func() {
+				defer client.Close()
+				defer server.Close()
+				go io.Copy(client, server)
+				buf := make([]byte, 32<<10)
+				var pos int64
+				for {
+					n, err := client.Read(buf)
+					for _, off := range offsets {
+						if off >= pos && off < pos+int64(n) {
+							buf[off-pos] ^= 0x10
+						}
+					}
+					pos += int64(n)
+					if _, werr := server.Write(buf[:n]); werr != nil || err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestChunkChecksumsResendDamagedFrames(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "checked.bin")
+	want := writeSource(t, src, 4*transferBufferSize+777)
+	dir := t.TempDir()
+	// Both land inside frame data, well past the header line and clear of
+	// the frame headers
+	addr := corruptingProxy(t, startReceiver(t, dir), 50_000, 2*transferBufferSize+70_000)
+
+	f, err := os.Open(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	info, _ := f.Stat()
+	tr := newTransfer("send", "checked.bin", src, addr, info.Size())
+	tr.spec = dialSpec{Network: "tcp", Addr: addr, Timeout: 5 * time.Second, ChunkRetries: defaultChunkRetries}
+	tr.Key = transferKey(src, info)
+	err = sendFile(context.Background(), tr, f, tr.spec, false)
+	tr.finish(err)
+	waitReceivers(t)
+	if err != nil {
+		t.Fatalf("send failed: %v", err)
+	}
+	// The second hit may land on a frame already in flight behind the
+	// first, which the first resend covers
+	if n := tr.Info().Retransmits; n < 1 || n > 2 {
+		t.Errorf("sender resent %d times, want 1 or 2", n)
+	}
+	transfersMu.Lock()
+	for _, r := range transfers {
+		if info := r.Info(); info.Direction == "receive" && info.Name == "checked.bin" && info.Retransmits != 2 {
+			t.Errorf("receiver saw %d damaged frames, want 2", info.Retransmits)
+		}
+	}
+	transfersMu.Unlock()
+	checkReceived(t, dir, "checked.bin", want)
+}
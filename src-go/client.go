@@ -0,0 +1,541 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math"
+	"math/rand/v2"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultDialTimeout       = 10 * time.Second
+	defaultReconnectDelay    = 2 * time.Second
+	defaultReconnectMaxDelay = time.Minute
+	defaultReconnectBackoff  = 2.0
+	defaultReconnectJitter   = 0.2
+	reconnectPoll            = 250 * time.Millisecond // how soon a wait notices disconnect
+)
+
+type ConnectPayload struct {
+	Host      string           `json:"host"`
+	Port      int              `json:"port"`
+	Type      string           `json:"type"` // "tcp", "udp", "quic"
+	TimeoutMs int              `json:"timeout_ms"`
+	Reconnect ReconnectOptions `json:"reconnect"`
+	Encrypted bool             `json:"encrypted"`
+	PeerKey   string           `json:"peer_key"` // pinned name or base64 key the remote must present
+	Timeouts  TimeoutOptions   `json:"timeouts"`
+
+	// Compression is proposed to the listener, which may decline it
+	Compression CompressionOptions `json:"compression"`
+
+	Auth ClientAuth `json:"auth"` // credentials for an authenticated listener
+
+	Protocol string `json:"protocol"` // "" for raw connection_data, "chat" for chat frames
+
+	AddressFamily string `json:"address_family"` // "ipv4", "ipv6" or "dual" (default)
+
+	Proxy string `json:"proxy"` // proxy URL, or "direct" to skip the configured proxy
+
+	// Mux opens the connection as a stream of an open_mux link instead of
+	// dialing host and port. Service names what the stream asks the mux
+	// listener for, default "echo", or "chat" for the chat protocol.
+	Mux     string `json:"mux"`
+	Service string `json:"service"`
+
+	// HalfClose lets the peer's FIN end only what it sends: the connection
+	// emits connection_read_closed and stays open for send until
+	// shutdown_write or disconnect, see halfclose.go
+	HalfClose bool `json:"half_close"`
+}
+
+// dialSpec describes how to (re)establish an outbound connection
+type dialSpec struct {
+	Network   string
+	Addr      string
+	QUIC      bool // dial a stream over QUIC; Network is then a udp one
+	Timeout   time.Duration
+	Encrypted bool
+	Plaintext bool // announce to an encrypted listener that we skip encryption, see plaintext.go
+	PeerKey   string
+
+	Compression CompressionOptions
+	Auth        ClientAuth
+
+	OfferWait    time.Duration // transfers only: wait this long for a receiver to accept
+	Streams      int           // file sends only: parallel connections for the body
+	ChunkRetries int           // file sends only: check each frame, resending a bad one this often
+	Dedup        bool          // file sends only: send just the chunks the receiver lacks
+	Session      string        // file sends only: transfer session token, see transfersession.go
+	Proxy        string        // proxy URL, "direct", or "" for the configured proxy
+	Alternates   []string      // other host:port of the same peer, raced against Addr
+
+	Mux     *Mux   // open a stream on this link instead of dialing
+	Service string // the listener service that stream asks for
+}
+
+// dial connects and runs whichever of the encryption, auth and compression
+// handshakes the spec asks for
+func (d dialSpec) dial() (net.Conn, *SecureInfo, error) {
+	conn, secure, _, err := d.dialRoute()
+	return conn, secure, err
+}
+
+// dialRoute is dial that also says which address a direct TCP dial took,
+// see eyeballs.go; the route is nil for every other kind of dial
+func (d dialSpec) dialRoute() (net.Conn, *SecureInfo, *DialRoute, error) {
+	if d.Mux != nil {
+		// The link ran the handshakes once for all its streams
+		conn, err := d.Mux.openStream(d.Service, d.Timeout)
+		return conn, d.Mux.secure, nil, err
+	}
+	var conn net.Conn
+	var route *DialRoute
+	var err error
+	var via *url.URL
+	harnessed := isHarnessAddr(d.Addr)
+	if !harnessed && !d.QUIC && strings.HasPrefix(d.Network, "tcp") {
+		if via, err = proxyFor(d.Proxy, d.Addr); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	if d.Plaintext && via != nil {
+		// Behind a proxy neither side sees the other's address
+		return nil, nil, nil, errors.New("plaintext transfers cannot go through a proxy")
+	}
+	switch {
+	case harnessed:
+		conn, err = dialHarness(d.Addr, d.Timeout)
+	case d.QUIC:
+		conn, err = dialQUIC(d.Network, d.Addr, d.Timeout)
+	case via != nil:
+		conn, err = dialProxy(via, d.Addr, d.Timeout)
+	case strings.HasPrefix(d.Network, "tcp"):
+		conn, route, err = dialEyeballs(d.Network, d.Addr, d.Alternates, d.Timeout)
+	default:
+		conn, err = net.DialTimeout(d.Network, d.Addr, d.Timeout)
+		if err == nil {
+			path := newUDPPathConn(conn)
+			path.framed = d.Encrypted || d.Compression.Enabled()
+			conn = path
+		}
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var secure *SecureInfo
+	if d.Encrypted {
+		s, err := secureClient(conn, d.PeerKey)
+		if err != nil {
+			conn.Close()
+			return nil, nil, nil, err
+		}
+		conn, secure = s, secureInfo(s.peer)
+	} else if d.Plaintext {
+		if err := plaintextClient(conn); err != nil {
+			conn.Close()
+			return nil, nil, nil, err
+		}
+	}
+
+	if d.Auth.Enabled() {
+		if err := authClient(conn, d.Auth, d.Timeout); err != nil {
+			conn.Close()
+			return nil, nil, nil, err
+		}
+	}
+
+	// Compress inside the encryption layer; ciphertext does not compress
+	if d.Compression.Enabled() {
+		cc, err := compressClient(conn, d.Compression, d.Timeout)
+		if err != nil {
+			conn.Close()
+			return nil, nil, nil, err
+		}
+		conn = cc
+	}
+	return conn, secure, route, nil
+}
+
+// transport names what the connection runs over, as shown in its info
+func (d dialSpec) transport() string {
+	if d.QUIC {
+		return "quic"
+	}
+	return "tcp"
+}
+
+// ReconnectOptions controls what happens when an outbound connection
+// drops. Waits between attempts start at delay_ms and grow by backoff
+// each time up to max_delay_ms, and jitter spreads them so peers that
+// lost the same link do not all come back at once.
+type ReconnectOptions struct {
+	Enabled    bool    `json:"enabled"`
+	MaxRetries int     `json:"max_retries"`  // 0 retries until disconnect is called
+	DelayMs    int     `json:"delay_ms"`     // first wait, default 2s
+	MaxDelayMs int     `json:"max_delay_ms"` // longest wait, default 60s
+	Backoff    float64 `json:"backoff"`      // growth per attempt, default 2; 1 keeps the wait fixed
+	Jitter     float64 `json:"jitter"`       // fraction of each wait picked at random, default 0.2; -1 for none
+}
+
+func (o ReconnectOptions) Validate() error {
+	switch {
+	case o.MaxRetries < 0 || o.DelayMs < 0 || o.MaxDelayMs < 0:
+		return catalogError(ErrInvalidArgument, "client.reconnect_max_retries_delay")
+	case o.Backoff != 0 && o.Backoff < 1:
+		return catalogError(ErrInvalidArgument, "client.reconnect_backoff_must_least")
+	case o.Jitter != -1 && (o.Jitter < 0 || o.Jitter > 1):
+		return catalogError(ErrInvalidArgument, "client.reconnect_jitter_must_between")
+	}
+	return nil
+}
+
+// delay is the wait before the given attempt, counting from 1
+func (o ReconnectOptions) delay(attempt int) time.Duration {
+	base, limit := defaultReconnectDelay, defaultReconnectMaxDelay
+	if o.DelayMs > 0 {
+		base = time.Duration(o.DelayMs) * time.Millisecond
+	}
+	if o.MaxDelayMs > 0 {
+		limit = time.Duration(o.MaxDelayMs) * time.Millisecond
+	}
+	limit = max(limit, base)
+	backoff, jitter := defaultReconnectBackoff, defaultReconnectJitter
+	if o.Backoff != 0 {
+		backoff = o.Backoff
+	}
+	if o.Jitter != 0 {
+		jitter = max(o.Jitter, 0)
+	}
+
+	d := float64(base) * math.Pow(backoff, float64(attempt-1))
+	d = min(d, float64(limit))
+	// Jitter takes away from the wait rather than adding, so max_delay_ms holds
+	d -= d * jitter * rand.Float64()
+	return time.Duration(d)
+}
+
+type SendPayload struct {
+	ID       string `json:"id"`
+	Data     string `json:"data"`
+	Encoding string `json:"encoding"` // "utf8" (default), "base64" or "hex"
+}
+
+type DisconnectPayload struct {
+	ID string `json:"id"`
+}
+
+func handleConnect(payload json.RawMessage, writer *Output) {
+	var p ConnectPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		sendInvalidPayload(writer, "connect")
+		return
+	}
+	if p.Mux == "" && (p.Host == "" || p.Port <= 0) {
+		sendErrorCode(writer, ErrInvalidArgument, message("client.connect_requires_host_port"), nil)
+		return
+	}
+	if p.Service != "" && p.Mux == "" {
+		sendErrorCode(writer, ErrInvalidArgument, message("client.service_requires_mux"), nil)
+		return
+	}
+	if p.Mux != "" {
+		if err := checkMuxOptions(p.Type, p.Encrypted, p.Auth, p.Compression, p.Proxy); err != nil {
+			sendFailure(writer, err)
+			return
+		}
+	}
+
+	network := p.Type
+	if network == "" {
+		network = "tcp"
+	}
+	if network != "tcp" && network != "udp" && network != "quic" {
+		sendErrorCode(writer, ErrUnsupported, message("client.unsupported_connection_type", "network", network), nil)
+		return
+	}
+	// QUIC streams carry bytes like TCP does, so everything layered on
+	// TCP works over them too
+	stream := network != "udp"
+
+	if p.Encrypted && !stream {
+		sendErrorCode(writer, ErrInvalidArgument, message("client.encryption_requires_tcp_connection"), nil)
+		return
+	}
+	if err := p.Auth.Validate(); err != nil {
+		sendFailure(writer, err)
+		return
+	}
+	if p.Auth.Enabled() && !stream {
+		sendErrorCode(writer, ErrInvalidArgument, message("client.authentication_requires_tcp_connection"), nil)
+		return
+	}
+	if p.Protocol != "" && p.Protocol != chatProtocol {
+		sendErrorCode(writer, ErrUnsupported, message("common.unsupported_protocol", "protocol", p.Protocol), nil)
+		return
+	}
+	if err := p.Compression.Validate(); err != nil {
+		sendFailure(writer, err)
+		return
+	}
+	if p.Compression.Enabled() && !stream {
+		sendErrorCode(writer, ErrInvalidArgument, message("client.compression_requires_tcp_connection"), nil)
+		return
+	}
+	if err := validProxy(p.Proxy, network); err != nil {
+		sendFailure(writer, err)
+		return
+	}
+	if err := p.Reconnect.Validate(); err != nil {
+		sendFailure(writer, err)
+		return
+	}
+
+	timeout := defaultDialTimeout
+	if p.TimeoutMs > 0 {
+		timeout = time.Duration(p.TimeoutMs) * time.Millisecond
+	}
+
+	dialNetwork, err := familyNetwork(network, p.AddressFamily)
+	if network == "quic" {
+		dialNetwork, err = familyNetwork("udp", p.AddressFamily)
+	}
+	if err != nil {
+		sendFailure(writer, err)
+		return
+	}
+
+	spec := dialSpec{
+		Network:   dialNetwork,
+		Addr:      net.JoinHostPort(normalizeHost(p.Host), strconv.Itoa(p.Port)),
+		QUIC:      network == "quic",
+		Timeout:   timeout,
+		Encrypted: p.Encrypted,
+		PeerKey:   p.PeerKey,
+
+		Compression: p.Compression,
+		Auth:        p.Auth,
+		Proxy:       p.Proxy,
+	}
+	if p.Mux != "" {
+		service := p.Service
+		if service == "" && p.Protocol == chatProtocol {
+			service = chatProtocol
+		} else if service == "" {
+			service = "echo"
+		}
+		if err := spec.useMux(p.Mux, service); err != nil {
+			sendFailure(writer, err)
+			return
+		}
+	}
+	conn, secure, route, err := spec.dialRoute()
+	if err != nil {
+		sendErrorCode(writer, ErrConnectFailed, message("common.failed_connect", "addr", spec.Addr, "error", err), map[string]interface{}{"addr": spec.Addr, "error": err.Error()})
+		return
+	}
+
+	c := trackStream(conn, "outbound", network, nil, p.Mux)
+	if c == nil {
+		conn.Close()
+		sendErrorCode(writer, ErrShuttingDown, message("common.service_shutting_down"), nil)
+		return
+	}
+	setScope(c.ID, writer.Namespace())
+	c.setSecure(secure)
+	c.setRoute(route)
+	c.setProtocol(p.Protocol)
+	c.SetTimeouts(p.Timeouts.Apply(defaultOutboundTimeouts))
+	c.halfOpen.Store(p.HalfClose)
+
+	go readOutbound(c, spec, p.Reconnect)
+
+	writer.Encode(okResponse(message("client.connected_addr", "addr", spec.Addr), c.Info()))
+}
+
+// readOutbound pushes everything received on an outbound connection as
+// connection_data events, or chat events for chat connections, and redials
+// according to opts when it drops
+func readOutbound(c *Connection, spec dialSpec, opts ReconnectOptions) {
+	defer recoverConn(c)
+	defer untrackConn(c)
+
+	var chat *chatStream
+	if c.speaksChat() {
+		chat = &chatStream{}
+	}
+	buffer := make([]byte, streamBufferSize)
+	for {
+		n, err := c.Read(buffer)
+		if n > 0 && chat != nil {
+			chat.feed(c, buffer[:n])
+		} else if n > 0 {
+			emitData(c, buffer[:n])
+		}
+		if err == nil {
+			continue
+		}
+
+		if holdHalfOpen(c, err) || c.closing.Load() {
+			emitEvent("connection_closed", map[string]interface{}{"id": c.ID, "reason": "closed"})
+			return
+		}
+		// A configured timeout ending the connection is deliberate, not a drop
+		if isTimeout(err) {
+			emitEvent("connection_closed", map[string]interface{}{"id": c.ID, "reason": "timeout"})
+			return
+		}
+		if !opts.Enabled || !redial(c, spec, opts, err) {
+			emitEvent("connection_closed", map[string]interface{}{"id": c.ID, "reason": err.Error()})
+			return
+		}
+	}
+}
+
+// redial replaces the socket behind c, returning false when retries run
+// out or the connection is closed while it waits
+func redial(c *Connection, spec dialSpec, opts ReconnectOptions, cause error) bool {
+	down := clock.Now()
+	lastErr := cause
+	attempt := 1
+	for ; opts.MaxRetries == 0 || attempt <= opts.MaxRetries; attempt++ {
+		delay := opts.delay(attempt)
+		emitEvent("connection_reconnecting", map[string]interface{}{
+			"id":       c.ID,
+			"attempt":  attempt,
+			"delay_ms": delay.Milliseconds(),
+			"error":    lastErr.Error(),
+		})
+		logger.Info("reconnecting", "id", c.ID, "addr", spec.Addr, "attempt", attempt, "delay", delay.String())
+		if !waitUnlessClosing(c, delay) {
+			return false
+		}
+
+		conn, secure, route, err := spec.dialRoute()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		c.setConn(conn)
+		c.setSecure(secure)
+		c.setRoute(route)
+		// disconnect may have raced with the dial; don't leak the new socket
+		if c.closing.Load() {
+			conn.Close()
+			return false
+		}
+		emitEvent("connection_reconnected", map[string]interface{}{
+			"id":          c.ID,
+			"attempt":     attempt,
+			"downtime_ms": clock.Now().Sub(down).Milliseconds(),
+		})
+		return true
+	}
+	logger.Warn("reconnect gave up", "id", c.ID, "addr", spec.Addr, "attempts", attempt-1, "error", lastErr)
+	emitEvent("connection_gave_up", map[string]interface{}{
+		"id":          c.ID,
+		"attempts":    attempt - 1,
+		"error":       lastErr.Error(),
+		"downtime_ms": clock.Now().Sub(down).Milliseconds(),
+	})
+	return false
+}
+
+// waitUnlessClosing waits d on the clock, returning false early once c is
+// being closed or the service stops
+func waitUnlessClosing(c *Connection, d time.Duration) bool {
+	done := clock.After(d)
+	poll := time.NewTicker(reconnectPoll)
+	defer poll.Stop()
+	for {
+		if c.closing.Load() || isStopping() {
+			return false
+		}
+		select {
+		case <-done:
+			return true
+		case <-poll.C:
+		}
+	}
+}
+
+func handleSend(payload json.RawMessage, writer *Output) {
+	var p SendPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		sendInvalidPayload(writer, "send")
+		return
+	}
+
+	c, exists := lookupConn(p.ID, writer)
+	if !exists {
+		sendErrorCode(writer, ErrNotFound, message("common.connection_not_found"), nil)
+		return
+	}
+
+	data, err := decodeData(p.Data, p.Encoding)
+	if err != nil {
+		sendFailure(writer, err)
+		return
+	}
+	if c.writeShut.Load() {
+		sendErrorCode(writer, ErrInvalidState, message("client.sending_side_shut"), map[string]interface{}{"id": p.ID})
+		return
+	}
+
+	n, err := c.Write(data)
+	if err != nil {
+		sendError(writer, message("client.failed_send", "id", p.ID, "error", err))
+		return
+	}
+
+	writer.Encode(ProtocolResponse{
+		Status: "ok",
+		Data:   map[string]interface{}{"id": p.ID, "bytes": n},
+	})
+}
+
+func handleDisconnect(payload json.RawMessage, writer *Output) {
+	var p DisconnectPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		sendInvalidPayload(writer, "disconnect")
+		return
+	}
+
+	c, exists := lookupConn(p.ID, writer)
+	if !exists {
+		sendErrorCode(writer, ErrNotFound, message("common.connection_not_found"), nil)
+		return
+	}
+
+	c.Abort()
+	writer.Encode(okResponse(message("client.connection_closed"), nil))
+}
+
+func decodeData(data, encoding string) ([]byte, error) {
+	switch encoding {
+	case "", "utf8":
+		return []byte(data), nil
+	case "base64":
+		decoded, err := base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			return nil, catalogError(ErrInvalidArgument, "common.invalid_base64_data")
+		}
+		return decoded, nil
+	case "hex":
+		decoded, err := hex.DecodeString(data)
+		if err != nil {
+			return nil, catalogError(ErrInvalidArgument, "common.invalid_hex_data")
+		}
+		return decoded, nil
+	default:
+		return nil, catalogError(ErrUnsupported, "common.unsupported_encoding", "encoding", encoding)
+	}
+}
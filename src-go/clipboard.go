@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// Clipboard sync pushes one clipboard item per connection to a "clipboard"
+// listener: a JSON header line, the raw content, then the receiver's ack.
+// The sidecar never touches the system clipboard itself; the receiver
+// hands the item to the app in a clipboard_received event and the app
+// applies it once the user confirms.
+const (
+	clipboardText  = "text"
+	clipboardImage = "image"
+
+	// clipboardSnippet is a push_text item: shown to the user rather than
+	// put on the clipboard, and reported as text_received
+	clipboardSnippet = "snippet"
+
+	maxClipboardSize = 16 << 20
+	maxSnippetSize   = 64 << 10
+)
+
+var clipSeq atomic.Uint64
+
+// clipboardHeader announces a clipboard item
+type clipboardHeader struct {
+	Kind string `json:"kind"` // "text", "image", "snippet"
+	MIME string `json:"mime"`
+	Size int64  `json:"size"`
+	From string `json:"from,omitempty"`
+}
+
+// handleClipboardConnection receives clipboard pushes until the sender
+// closes the connection
+func handleClipboardConnection(c *Connection, l *Listener, _ string) {
+	defer untrackConn(c)
+
+	reader := bufio.NewReader(c)
+	for {
+		c.SetReadDeadline(time.Now().Add(30 * time.Second))
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+		var header clipboardHeader
+		if err := json.Unmarshal(line, &header); err != nil {
+			writeAck(c, errors.New("invalid clipboard header"))
+			return
+		}
+		limit := int64(maxClipboardSize)
+		switch header.Kind {
+		case clipboardText, clipboardImage:
+		case clipboardSnippet:
+			limit = maxSnippetSize
+		default:
+			writeAck(c, errors.New("unsupported clipboard kind: "+header.Kind))
+			return
+		}
+		if header.Size < 0 || header.Size > limit {
+			writeAck(c, fmt.Errorf("clipboard item exceeds %d bytes", limit))
+			return
+		}
+
+		content := make([]byte, header.Size)
+		if _, err := io.ReadFull(reader, content); err != nil {
+			return
+		}
+		c.SetReadDeadline(time.Time{})
+		if header.Kind != clipboardImage && !utf8.Valid(content) {
+			writeAck(c, errors.New("clipboard text is not valid UTF-8"))
+			continue
+		}
+		if header.Kind == clipboardSnippet {
+			receiveSnippet(c, l, header, string(content))
+			writeAck(c, nil)
+			continue
+		}
+
+		item := map[string]interface{}{
+			"id":          fmt.Sprintf("clip-%d", clipSeq.Add(1)),
+			"listener":    l.Addr,
+			"listener_id": l.ID,
+			"remote":      c.Info().RemoteAddr,
+			"kind":        header.Kind,
+			"mime":        header.MIME,
+			"size":        header.Size,
+			"from":        header.From,
+		}
+		if peer, known := discoveredPeer(c.Info().RemoteAddr); known {
+			item["peer"] = peer
+		}
+		if header.Kind == clipboardText {
+			item["text"] = string(content)
+		} else {
+			item["data"] = base64.StdEncoding.EncodeToString(content)
+		}
+		logger.Info("clipboard received", "id", item["id"], "kind", header.Kind, "size", header.Size)
+		emitEvent("clipboard_received", item)
+		writeAck(c, nil)
+	}
+}
+
+// clipboardTarget is where push_clipboard and push_text send to, and the
+// peer start_log_tail reads from
+type clipboardTarget struct {
+	Host string `json:"host"`
+	Port int    `json:"port"`
+	Peer string `json:"peer"` // discovered instance to send to instead of host
+
+	TimeoutMs int        `json:"timeout_ms"`
+	Encrypted bool       `json:"encrypted"`
+	PeerKey   string     `json:"peer_key"`
+	Auth      ClientAuth `json:"auth"`
+
+	AddressFamily string `json:"address_family"` // "ipv4", "ipv6" or "dual" (default)
+}
+
+// spec resolves the target to a dial spec; errors are ready to send to the
+// app, command names the command for the missing-target message
+func (p *clipboardTarget) spec(command string) (dialSpec, error) {
+	if !validFamily(p.AddressFamily) {
+		return dialSpec{}, catalogError(ErrUnsupported, "common.unsupported_address_family", "address_family", p.AddressFamily)
+	}
+	var others []string
+	if p.Peer != "" && p.Host == "" {
+		hosts := peerHosts(p.Peer, p.AddressFamily)
+		if len(hosts) == 0 {
+			return dialSpec{}, catalogError(ErrNotFound, "clipboard.peer_not_found", "peer", p.Peer)
+		}
+		p.Host, others = hosts[0], hosts[1:]
+	}
+	if p.Host == "" || p.Port <= 0 {
+		return dialSpec{}, catalogError(ErrInvalidArgument, "clipboard.requires_host_peer_port", "command", command)
+	}
+	if err := p.Auth.Validate(); err != nil {
+		return dialSpec{}, err
+	}
+	timeout := defaultDialTimeout
+	if p.TimeoutMs > 0 {
+		timeout = time.Duration(p.TimeoutMs) * time.Millisecond
+	}
+	network, _ := familyNetwork("tcp", p.AddressFamily)
+	return dialSpec{
+		Network:    network,
+		Addr:       net.JoinHostPort(normalizeHost(p.Host), strconv.Itoa(p.Port)),
+		Alternates: joinHosts(others, p.Port),
+		Timeout:    timeout,
+		Encrypted:  p.Encrypted,
+		PeerKey:    p.PeerKey,
+		Auth:       p.Auth,
+	}, nil
+}
+
+type PushClipboardPayload struct {
+	clipboardTarget
+
+	Kind     string `json:"kind"` // "text" (default), "image"
+	MIME     string `json:"mime"`
+	Text     string `json:"text"`     // text items
+	Data     string `json:"data"`     // image items, base64
+	Encoding string `json:"encoding"` // text items only: "utf8" (default), "base64"
+}
+
+// peerHosts lists every address of a discovered instance in the given
+// family, IPv4 first, falling back to its host name when it announced none.
+// A dial races them all, see eyeballs.go.
+func peerHosts(instance, family string) []string {
+	discovery.Mutex.Lock()
+	defer discovery.Mutex.Unlock()
+	peer, exists := discovery.Peers[instance]
+	if !exists {
+		return nil
+	}
+	var hosts []string
+	if family != familyIPv6 {
+		hosts = append(hosts, peer.IPv4...)
+	}
+	if family != familyIPv4 {
+		hosts = append(hosts, peer.IPv6...)
+	}
+	if len(hosts) == 0 && (family == "" || family == familyDual) && peer.Host != "" {
+		hosts = append(hosts, strings.TrimSuffix(peer.Host, "."))
+	}
+	return hosts
+}
+
+// joinHosts pairs each host with port, for dialSpec.Alternates
+func joinHosts(hosts []string, port int) []string {
+	addrs := make([]string, len(hosts))
+	for i, host := range hosts {
+		addrs[i] = net.JoinHostPort(normalizeHost(host), strconv.Itoa(port))
+	}
+	return addrs
+}
+
+// handlePushClipboard sends a clipboard item in the background and reports
+// the outcome as clipboard_sent or clipboard_failed
+func handlePushClipboard(payload json.RawMessage, writer *Output) {
+	var p PushClipboardPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		sendInvalidPayload(writer, "push_clipboard")
+		return
+	}
+	spec, err := p.spec("push_clipboard")
+	if err != nil {
+		sendFailure(writer, err)
+		return
+	}
+
+	var content []byte
+	switch p.Kind {
+	case "", clipboardText:
+		p.Kind = clipboardText
+		if p.MIME == "" {
+			p.MIME = "text/plain;charset=utf-8"
+		}
+		content, err = decodeData(p.Text, p.Encoding)
+	case clipboardImage:
+		if p.MIME == "" {
+			p.MIME = "image/png"
+		}
+		content, err = base64.StdEncoding.DecodeString(p.Data)
+		if err != nil {
+			err = catalogError(ErrInvalidArgument, "common.invalid_base64_data")
+		}
+	default:
+		err = catalogError(ErrUnsupported, "clipboard.unsupported_clipboard_kind", "kind", p.Kind)
+	}
+	if err != nil {
+		sendFailure(writer, err)
+		return
+	}
+	if len(content) > maxClipboardSize {
+		sendErrorCode(writer, ErrInvalidArgument, message("clipboard.item_exceeds_bytes", "max_clipboard_size", maxClipboardSize), nil)
+		return
+	}
+
+	header := clipboardHeader{Kind: p.Kind, MIME: p.MIME, Size: int64(len(content)), From: senderName()}
+
+	id := fmt.Sprintf("clip-%d", clipSeq.Add(1))
+	writer.Encode(okResponse(message("clipboard.push_started"),
+		map[string]interface{}{"id": id, "addr": spec.Addr, "kind": p.Kind, "size": header.Size}))
+
+	go func() {
+		if err := pushClipboard(spec, header, content); err != nil {
+			logger.Warn("clipboard push failed", "id", id, "addr", spec.Addr, "error", err)
+			emitEvent("clipboard_failed", map[string]interface{}{"id": id, "addr": spec.Addr, "error": err.Error()})
+			return
+		}
+		emitEvent("clipboard_sent", map[string]interface{}{"id": id, "addr": spec.Addr, "kind": p.Kind, "size": header.Size})
+	}()
+}
+
+func pushClipboard(spec dialSpec, header clipboardHeader, content []byte) error {
+	conn, secure, err := spec.dial()
+	if err != nil {
+		return err
+	}
+	c := trackConn(conn, "outbound", "tcp", nil)
+	if c == nil {
+		conn.Close()
+		return errors.New("service is shutting down")
+	}
+	defer untrackConn(c)
+	c.setSecure(secure)
+
+	line, _ := json.Marshal(header)
+	if _, err := c.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if _, err := c.Write(content); err != nil {
+		return err
+	}
+	_, err = readAck(bufio.NewReader(c), c, spec.Timeout)
+	return err
+}
+
+// linkSchemes are the schemes a snippet may carry as a link for the app to
+// offer opening; anything else is shown as plain text
+var linkSchemes = []string{"http", "https", "mailto"}
+
+// snippetURL returns text as a link when it is nothing but one
+func snippetURL(text string) (string, bool) {
+	text = strings.TrimSpace(text)
+	if text == "" || strings.ContainsAny(text, " \t\r\n") {
+		return "", false
+	}
+	u, err := url.Parse(text)
+	if err != nil || !slices.Contains(linkSchemes, strings.ToLower(u.Scheme)) {
+		return "", false
+	}
+	if u.Scheme != "mailto" && u.Host == "" {
+		return "", false
+	}
+	return u.String(), true
+}
+
+// receiveSnippet reports a pushed text. Like clipboard items it is only
+// handed to the app, which asks the user before opening a link.
+func receiveSnippet(c *Connection, l *Listener, header clipboardHeader, text string) {
+	item := map[string]interface{}{
+		"id":          fmt.Sprintf("text-%d", clipSeq.Add(1)),
+		"listener":    l.Addr,
+		"listener_id": l.ID,
+		"remote":      c.Info().RemoteAddr,
+		"text":        text,
+		"size":        header.Size,
+		"from":        header.From,
+	}
+	if peer, known := discoveredPeer(c.Info().RemoteAddr); known {
+		item["peer"] = peer
+	}
+	if link, ok := snippetURL(text); ok {
+		item["url"] = link
+	}
+	logger.Info("text received", "id", item["id"], "size", header.Size, "url", item["url"] != nil)
+	emitEvent("text_received", item)
+}
+
+type PushTextPayload struct {
+	clipboardTarget
+
+	Text string `json:"text"` // a short note or a URL
+}
+
+// handlePushText sends a short text to a peer's clipboard listener in the
+// background and reports the outcome as text_sent or text_failed
+func handlePushText(payload json.RawMessage, writer *Output) {
+	var p PushTextPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		sendInvalidPayload(writer, "push_text")
+		return
+	}
+	spec, err := p.spec("push_text")
+	if err != nil {
+		sendFailure(writer, err)
+		return
+	}
+	if strings.TrimSpace(p.Text) == "" {
+		sendErrorCode(writer, ErrInvalidArgument, message("clipboard.push_text_requires_text"), nil)
+		return
+	}
+	if len(p.Text) > maxSnippetSize {
+		sendErrorCode(writer, ErrInvalidArgument, message("clipboard.text_exceeds_bytes", "max_snippet_size", maxSnippetSize), nil)
+		return
+	}
+
+	header := clipboardHeader{Kind: clipboardSnippet, MIME: "text/plain;charset=utf-8", Size: int64(len(p.Text)), From: senderName()}
+	_, isURL := snippetURL(p.Text)
+	id := fmt.Sprintf("text-%d", clipSeq.Add(1))
+	writer.Encode(okResponse(message("clipboard.text_push_started"),
+		map[string]interface{}{"id": id, "addr": spec.Addr, "size": header.Size, "url": isURL}))
+
+	go func() {
+		if err := pushClipboard(spec, header, []byte(p.Text)); err != nil {
+			logger.Warn("text push failed", "id", id, "addr", spec.Addr, "error", err)
+			emitEvent("text_failed", map[string]interface{}{"id": id, "addr": spec.Addr, "error": err.Error()})
+			return
+		}
+		emitEvent("text_sent", map[string]interface{}{"id": id, "addr": spec.Addr, "size": header.Size})
+	}()
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+)
+
+// The encrypted handshake also measures how far the peer's clock is from
+// ours, the way NTP does. Each side's key confirmation carries the time it
+// was sent (t1); the other side notes when it arrived (t2) and answers
+// with both and its own send time (t3), which arrives at t4. The peer's
+// clock is then ((t2-t1)+(t3-t4))/2 ahead of ours, give or take half the
+// asymmetry of the round trip. A skew past clock_skew.warn_seconds is
+// reported, since history timestamps and schedules handed between the
+// machines are off by as much. A peer whose hello is older than the
+// exchange skips it, see crypto.go.
+const (
+	defaultClockSkewWarn = time.Minute
+	clockReplySize       = 24
+	// clockSkewRewarn keeps parallel connections to one peer from
+	// repeating the same warning
+	clockSkewRewarn = 10 * time.Minute
+)
+
+var errClockExchange = errors.New("clock exchange mismatch")
+
+// ClockSkewConfig is the config section of clock offset warnings. Zero
+// keeps the default of 60 seconds; -1 turns warnings off.
+type ClockSkewConfig struct {
+	WarnSeconds int `json:"warn_seconds,omitempty"`
+}
+
+func (c ClockSkewConfig) Validate() error {
+	if c.WarnSeconds < -1 {
+		return catalogError(ErrInvalidArgument, "clock.warn_seconds_must_not")
+	}
+	return nil
+}
+
+// threshold is the skew worth a warning, 0 for none
+func (c ClockSkewConfig) threshold() time.Duration {
+	switch {
+	case c.WarnSeconds < 0:
+		return 0
+	case c.WarnSeconds == 0:
+		return defaultClockSkewWarn
+	}
+	return time.Duration(c.WarnSeconds) * time.Second
+}
+
+// clockSample is one measurement of a peer's clock
+type clockSample struct {
+	Offset    time.Duration // the peer's clock minus ours
+	RoundTrip time.Duration // network time of the exchange
+	At        time.Time
+}
+
+// clockOffset works out the sample from the four timestamps, t2 and t3
+// being on the peer's clock
+func clockOffset(t1, t2, t3, t4 int64) (offset, roundTrip time.Duration) {
+	offset = time.Duration(((t2 - t1) + (t3 - t4)) / 2)
+	roundTrip = max(0, time.Duration((t4-t1)-(t3-t2)))
+	return offset, roundTrip
+}
+
+// appendClock adds a timestamp to a handshake record
+func appendClock(b []byte, t time.Time) []byte {
+	return binary.BigEndian.AppendUint64(b, uint64(t.UnixNano()))
+}
+
+func readClock(b []byte) int64 {
+	return int64(binary.BigEndian.Uint64(b))
+}
+
+// exchangeClock answers the peer's confirmation, stamped peerSent and
+// received at received, and reads its answer to ours, sent at sent
+func (s *secureConn) exchangeClock(sent time.Time, peerSent []byte, received time.Time) error {
+	reply := make([]byte, 0, clockReplySize)
+	reply = append(reply, peerSent...)
+	reply = appendClock(reply, received)
+	reply = appendClock(reply, time.Now())
+
+	writeErr := make(chan error, 1)
+	go func() { writeErr <- s.writeRecord(reply) }()
+	answer, err := s.readRecord()
+	back := time.Now()
+	if err != nil {
+		return err
+	}
+	if err := <-writeErr; err != nil {
+		return err
+	}
+	if len(answer) != clockReplySize || readClock(answer) != sent.UnixNano() {
+		return errClockExchange
+	}
+	offset, rtt := clockOffset(sent.UnixNano(), readClock(answer[8:]), readClock(answer[16:]), back.UnixNano())
+	s.clock = clockSample{Offset: offset, RoundTrip: rtt, At: back}
+	return nil
+}
+
+// skewWarned remembers when each peer fingerprint was last warned about
+var skewWarned sync.Map
+
+// warnClockSkew reports a session whose peer's clock is too far off
+func warnClockSkew(s *secureConn) {
+	limit := config.Get().ClockSkew.threshold()
+	if limit == 0 || s.clock.Offset.Abs() < limit {
+		return
+	}
+	info := secureInfo(s.peer)
+	if last, ok := skewWarned.Load(info.Fingerprint); ok && time.Since(last.(time.Time)) < clockSkewRewarn {
+		return
+	}
+	skewWarned.Store(info.Fingerprint, time.Now())
+
+	remote := s.Conn.RemoteAddr().String()
+	logger.Warn("peer clock is off", "peer", info.Fingerprint, "remote", remote, "offset", s.clock.Offset)
+	emitEvent("clock_skew", map[string]interface{}{
+		"peer_key":      info.PeerKey,
+		"fingerprint":   info.Fingerprint,
+		"pinned_as":     info.PinnedAs,
+		"remote_addr":   remote,
+		"offset_ms":     s.clock.Offset.Milliseconds(),
+		"round_trip_ms": s.clock.RoundTrip.Milliseconds(),
+		"threshold_ms":  limit.Milliseconds(),
+	})
+}
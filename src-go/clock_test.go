@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestClockOffsetMath(t *testing.T) {
+	// The peer runs 90s ahead; the request takes 10ms, the answer 30ms and
+	// the peer holds it for 5ms
+	const ms = int64(time.Millisecond)
+	skew := 90 * int64(time.Second)
+	t1 := int64(1_000_000) * ms
+	t2 := t1 + 10*ms + skew
+	t3 := t2 + 5*ms
+	t4 := t3 - skew + 30*ms
+	offset, rtt := clockOffset(t1, t2, t3, t4)
+	if rtt != 40*time.Millisecond {
+		t.Errorf("round trip %v, want 40ms", rtt)
+	}
+	// Asymmetric paths shift the estimate by half the difference
+	if want := time.Duration(skew) - 10*time.Millisecond; offset != want {
+		t.Errorf("offset %v, want %v", offset, want)
+	}
+}
+
+func TestHandshakeMeasuresClock(t *testing.T) {
+	client, server := securePair(t)
+	for _, s := range []*secureConn{client, server} {
+		if s.clock.At.IsZero() || s.clock.Offset.Abs() > time.Second || s.clock.RoundTrip < 0 {
+			t.Errorf("clock sample %+v on one machine", s.clock)
+		}
+		if info := s.Session(); !info.ClockMeasured || info.ClockOffsetMs != s.clock.Offset.Milliseconds() {
+			t.Errorf("session reports offset %dms, sample %v", info.ClockOffsetMs, s.clock.Offset)
+		}
+	}
+}
+
+func TestHandshakeWithoutClockExchange(t *testing.T) {
+	a, b := net.Pipe()
+	t.Cleanup(func() { a.Close(); b.Close() })
+	older := make(chan *secureConn, 1)
+	go func() {
+		s, err := secureHandshakeWith(b, false, secureMagicNoClock)
+		if err != nil {
+			t.Errorf("LUMSEC02 responder: %v", err)
+		}
+		older <- s
+	}()
+	client, err := secureHandshake(a, true)
+	if err != nil {
+		t.Fatalf("initiator with a LUMSEC02 peer: %v", err)
+	}
+	server := <-older
+	if server == nil {
+		t.FailNow()
+	}
+	for _, s := range []*secureConn{client, server} {
+		if info := s.Session(); info.ClockMeasured || !s.clock.At.IsZero() {
+			t.Errorf("clock measured with a LUMSEC02 peer: %+v", s.clock)
+		}
+	}
+
+	go client.Write([]byte("hi"))
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(server, buf); err != nil || string(buf) != "hi" {
+		t.Errorf("read %q, %v", buf, err)
+	}
+}
+
+func TestClockSkewThreshold(t *testing.T) {
+	for _, c := range []struct {
+		warn int
+		want time.Duration
+	}{{0, time.Minute}, {-1, 0}, {5, 5 * time.Second}} {
+		if got := (ClockSkewConfig{WarnSeconds: c.warn}).threshold(); got != c.want {
+			t.Errorf("warn_seconds %d gives %v, want %v", c.warn, got, c.want)
+		}
+	}
+	if (ClockSkewConfig{WarnSeconds: -2}).Validate() == nil {
+		t.Error("warn_seconds -2 accepted")
+	}
+}
@@ -0,0 +1,486 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression algorithms a transfer or stream can negotiate
+const (
+	compressNone = "none"
+	compressGzip = "gzip"
+	compressZstd = "zstd"
+)
+
+// compressChunkSize is the most uncompressed data packed into one chunk.
+// Every chunk is compressed on its own and sent as a 4-byte big-endian
+// length followed by the compressed bytes; a zero length ends a body.
+const compressChunkSize = 256 << 10
+
+// maxCompressedChunk bounds what a peer may announce for a single chunk
+const maxCompressedChunk = compressChunkSize + compressChunkSize/2 + 1024
+
+// CompressionOptions selects an algorithm and level for one transfer or stream
+type CompressionOptions struct {
+	Algorithm string `json:"algorithm"` // "zstd", "gzip", "none" (default)
+	Level     int    `json:"level"`     // algorithm specific, 0 for its default
+}
+
+func (o CompressionOptions) Enabled() bool {
+	return o.Algorithm != "" && o.Algorithm != compressNone
+}
+
+func (o CompressionOptions) Validate() error {
+	switch o.Algorithm {
+	case "", compressNone:
+		return nil
+	case compressZstd:
+		if o.Level < 0 || o.Level > 22 {
+			return catalogError(ErrInvalidArgument, "compress.zstd_level_must_between")
+		}
+	case compressGzip:
+		if o.Level < 0 || o.Level > gzip.BestCompression {
+			return catalogError(ErrInvalidArgument, "compress.gzip_level_must_between")
+		}
+	default:
+		return fmt.Errorf("unsupported compression algorithm: %s", o.Algorithm)
+	}
+	return nil
+}
+
+// supportedCompression answers a peer's proposal with what we will use
+func supportedCompression(algorithm string) string {
+	switch algorithm {
+	case compressZstd, compressGzip:
+		return algorithm
+	}
+	return compressNone
+}
+
+// codec compresses and decompresses whole chunks
+type codec interface {
+	Encode(dst, src []byte) ([]byte, error)
+	Decode(dst, src []byte) ([]byte, error)
+	Close()
+}
+
+func newCodec(algorithm string, level int) (codec, error) {
+	switch algorithm {
+	case compressZstd:
+		encLevel := zstd.SpeedDefault
+		if level > 0 {
+			encLevel = zstd.EncoderLevelFromZstd(level)
+		}
+		enc, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(encLevel), zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		dec, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(compressChunkSize))
+		if err != nil {
+			enc.Close()
+			return nil, err
+		}
+		return &zstdCodec{enc: enc, dec: dec}, nil
+	case compressGzip:
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		return &gzipCodec{level: level}, nil
+	}
+	return nil, fmt.Errorf("unsupported compression algorithm: %s", algorithm)
+}
+
+type zstdCodec struct {
+	enc *zstd.Encoder
+	dec *zstd.Decoder
+}
+
+func (z *zstdCodec) Encode(dst, src []byte) ([]byte, error) {
+	return z.enc.EncodeAll(src, dst[:0]), nil
+}
+
+func (z *zstdCodec) Decode(dst, src []byte) ([]byte, error) {
+	return z.dec.DecodeAll(src, dst[:0])
+}
+
+func (z *zstdCodec) Close() {
+	z.enc.Close()
+	z.dec.Close()
+}
+
+type gzipCodec struct {
+	level int
+	w     *gzip.Writer
+	buf   bytes.Buffer
+}
+
+func (g *gzipCodec) Encode(dst, src []byte) ([]byte, error) {
+	g.buf.Reset()
+	if g.w == nil {
+		w, err := gzip.NewWriterLevel(&g.buf, g.level)
+		if err != nil {
+			return nil, err
+		}
+		g.w = w
+	} else {
+		g.w.Reset(&g.buf)
+	}
+	if _, err := g.w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := g.w.Close(); err != nil {
+		return nil, err
+	}
+	return append(dst[:0], g.buf.Bytes()...), nil
+}
+
+func (g *gzipCodec) Decode(dst, src []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	out := bytes.NewBuffer(dst[:0])
+	// Refuse chunks that inflate past the agreed size
+	n, err := io.Copy(out, io.LimitReader(r, compressChunkSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if n > compressChunkSize {
+		return nil, errors.New("compressed chunk too large")
+	}
+	return out.Bytes(), nil
+}
+
+func (g *gzipCodec) Close() {}
+
+// chunkWriter compresses everything written to it into chunks on w.
+// wire, when set, counts the bytes that actually went out.
+type chunkWriter struct {
+	w     io.Writer
+	codec codec
+	wire  *atomic.Int64
+	buf   []byte
+	out   []byte
+}
+
+func newChunkWriter(w io.Writer, c codec, wire *atomic.Int64) *chunkWriter {
+	return &chunkWriter{w: w, codec: c, wire: wire, buf: make([]byte, 0, compressChunkSize)}
+}
+
+func (cw *chunkWriter) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		n := min(len(b), compressChunkSize-len(cw.buf))
+		cw.buf = append(cw.buf, b[:n]...)
+		b = b[n:]
+		written += n
+		if len(cw.buf) == compressChunkSize {
+			if err := cw.Flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// Flush sends whatever is buffered as one chunk
+func (cw *chunkWriter) Flush() error {
+	if len(cw.buf) == 0 {
+		return nil
+	}
+	out, err := cw.codec.Encode(cw.out, cw.buf)
+	if err != nil {
+		return err
+	}
+	cw.out = out
+	cw.buf = cw.buf[:0]
+	return cw.writeFrame(out)
+}
+
+// Close flushes and writes the terminating empty chunk
+func (cw *chunkWriter) Close() error {
+	if err := cw.Flush(); err != nil {
+		return err
+	}
+	return cw.writeFrame(nil)
+}
+
+func (cw *chunkWriter) writeFrame(payload []byte) error {
+	frame := make([]byte, 4, 4+len(payload))
+	binary.BigEndian.PutUint32(frame, uint32(len(payload)))
+	frame = append(frame, payload...)
+	if _, err := cw.w.Write(frame); err != nil {
+		return err
+	}
+	if cw.wire != nil {
+		cw.wire.Add(int64(len(frame)))
+	}
+	return nil
+}
+
+// chunkReader decompresses chunks from r. It never reads past the
+// terminating chunk, so the connection can carry more data afterwards.
+type chunkReader struct {
+	r       io.Reader
+	codec   codec
+	wire    *atomic.Int64
+	pending []byte
+	in, out []byte
+	done    bool
+}
+
+func newChunkReader(r io.Reader, c codec, wire *atomic.Int64) *chunkReader {
+	return &chunkReader{r: r, codec: c, wire: wire}
+}
+
+func (cr *chunkReader) Read(b []byte) (int, error) {
+	for len(cr.pending) == 0 {
+		if cr.done {
+			return 0, io.EOF
+		}
+		if err := cr.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, cr.pending)
+	cr.pending = cr.pending[n:]
+	return n, nil
+}
+
+func (cr *chunkReader) next() error {
+	var size [4]byte
+	if _, err := io.ReadFull(cr.r, size[:]); err != nil {
+		return err
+	}
+	length := binary.BigEndian.Uint32(size[:])
+	if cr.wire != nil {
+		cr.wire.Add(int64(4 + length))
+	}
+	if length == 0 {
+		cr.done = true
+		return nil
+	}
+	if length > maxCompressedChunk {
+		return fmt.Errorf("compressed chunk of %d bytes exceeds limit", length)
+	}
+
+	if cap(cr.in) < int(length) {
+		cr.in = make([]byte, length)
+	}
+	cr.in = cr.in[:length]
+	if _, err := io.ReadFull(cr.r, cr.in); err != nil {
+		return err
+	}
+	out, err := cr.codec.Decode(cr.out, cr.in)
+	if err != nil {
+		return fmt.Errorf("corrupt compressed chunk: %w", err)
+	}
+	cr.out, cr.pending = out, out
+	return nil
+}
+
+// Finish consumes the terminating chunk once the caller has read the
+// whole body, failing if the sender sent more than expected
+func (cr *chunkReader) Finish() error {
+	var extra [1]byte
+	if _, err := cr.Read(extra[:]); err != io.EOF {
+		if err == nil {
+			err = errors.New("compressed body longer than announced")
+		}
+		return err
+	}
+	return nil
+}
+
+// bodyReader wraps r for a transfer body sent with algorithm. finish must
+// run once the whole body has been read.
+func bodyReader(r io.Reader, algorithm string, wire *atomic.Int64) (body io.Reader, finish func() error, err error) {
+	if supportedCompression(algorithm) == compressNone {
+		return r, func() error { return nil }, nil
+	}
+	cd, err := newCodec(algorithm, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	cr := newChunkReader(r, cd, wire)
+	return cr, func() error {
+		defer cd.Close()
+		return cr.Finish()
+	}, nil
+}
+
+// bodyWriter is the sending side of bodyReader. finish flushes the last
+// chunk and the terminator.
+func bodyWriter(w io.Writer, opts CompressionOptions, wire *atomic.Int64) (body io.Writer, finish func() error, err error) {
+	if !opts.Enabled() {
+		return w, func() error { return nil }, nil
+	}
+	cd, err := newCodec(opts.Algorithm, opts.Level)
+	if err != nil {
+		return nil, nil, err
+	}
+	cw := newChunkWriter(w, cd, wire)
+	return cw, func() error {
+		defer cd.Close()
+		return cw.Close()
+	}, nil
+}
+
+// CompressionStats is the JSON view of a compressed stream's byte counts
+type CompressionStats struct {
+	Algorithm string `json:"algorithm"`
+	RawIn     int64  `json:"raw_in"`
+	RawOut    int64  `json:"raw_out"`
+	WireIn    int64  `json:"wire_in"`
+	WireOut   int64  `json:"wire_out"`
+}
+
+// compressedConn compresses a stream connection. Every Write becomes one
+// or more chunks flushed immediately, so interactive traffic is not delayed.
+type compressedConn struct {
+	net.Conn
+	algorithm string
+
+	readMu  sync.Mutex
+	reader  *chunkReader
+	writeMu sync.Mutex
+	writer  *chunkWriter
+
+	rawIn, rawOut, wireIn, wireOut atomic.Int64
+}
+
+func newCompressedConn(conn net.Conn, opts CompressionOptions) (*compressedConn, error) {
+	enc, err := newCodec(opts.Algorithm, opts.Level)
+	if err != nil {
+		return nil, err
+	}
+	dec, err := newCodec(opts.Algorithm, opts.Level)
+	if err != nil {
+		enc.Close()
+		return nil, err
+	}
+	cc := &compressedConn{Conn: conn, algorithm: opts.Algorithm}
+	cc.reader = newChunkReader(conn, dec, &cc.wireIn)
+	cc.writer = newChunkWriter(conn, enc, &cc.wireOut)
+	return cc, nil
+}
+
+func (cc *compressedConn) Read(b []byte) (int, error) {
+	cc.readMu.Lock()
+	defer cc.readMu.Unlock()
+	for {
+		n, err := cc.reader.Read(b)
+		if err == io.EOF && cc.reader.done {
+			// An empty chunk has no meaning on a stream; keep reading
+			cc.reader.done = false
+			continue
+		}
+		cc.rawIn.Add(int64(n))
+		return n, err
+	}
+}
+
+func (cc *compressedConn) Write(b []byte) (int, error) {
+	cc.writeMu.Lock()
+	defer cc.writeMu.Unlock()
+	n, err := cc.writer.Write(b)
+	if err == nil {
+		err = cc.writer.Flush()
+	}
+	cc.rawOut.Add(int64(n))
+	return n, err
+}
+
+func (cc *compressedConn) Stats() *CompressionStats {
+	return &CompressionStats{
+		Algorithm: cc.algorithm,
+		RawIn:     cc.rawIn.Load(),
+		RawOut:    cc.rawOut.Load(),
+		WireIn:    cc.wireIn.Load(),
+		WireOut:   cc.wireOut.Load(),
+	}
+}
+
+// compressionHello is exchanged as a JSON line when a stream negotiates
+// compression: the client proposes, the listener answers with its choice
+type compressionHello struct {
+	Compression string `json:"compression"`
+}
+
+// compressClient proposes opts to the listener and wraps conn with
+// whatever it accepts
+func compressClient(conn net.Conn, opts CompressionOptions, timeout time.Duration) (net.Conn, error) {
+	line, _ := json.Marshal(compressionHello{Compression: opts.Algorithm})
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+
+	if _, err := conn.Write(append(line, '\n')); err != nil {
+		return nil, err
+	}
+	var reply compressionHello
+	if err := readJSONLine(conn, &reply); err != nil {
+		return nil, fmt.Errorf("compression negotiation failed: %w", err)
+	}
+	if reply.Compression == compressNone {
+		return conn, nil
+	}
+	if reply.Compression != opts.Algorithm {
+		return nil, fmt.Errorf("listener chose unexpected compression %q", reply.Compression)
+	}
+	return newCompressedConn(conn, opts)
+}
+
+// compressInbound answers a client's compression proposal on c
+func compressInbound(c *Connection) error {
+	c.SetReadDeadline(time.Now().Add(secureHandshakeTTL))
+	var hello compressionHello
+	err := readJSONLine(c.Conn(), &hello)
+	c.SetReadDeadline(time.Time{})
+	if err != nil {
+		return fmt.Errorf("compression negotiation failed: %w", err)
+	}
+
+	chosen := supportedCompression(hello.Compression)
+	line, _ := json.Marshal(compressionHello{Compression: chosen})
+	if _, err := c.Conn().Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if chosen == compressNone {
+		return nil
+	}
+	// The level only matters to the compressing side, so use the default
+	cc, err := newCompressedConn(c.Conn(), CompressionOptions{Algorithm: chosen})
+	if err != nil {
+		return err
+	}
+	c.setConn(cc)
+	return nil
+}
+
+// readJSONLine reads one short JSON line into v a byte at a time so
+// nothing past it is consumed from the connection
+func readJSONLine(conn net.Conn, v interface{}) error {
+	var line []byte
+	var b [1]byte
+	for len(line) < 512 {
+		if _, err := io.ReadFull(conn, b[:]); err != nil {
+			return err
+		}
+		if b[0] == '\n' {
+			return json.Unmarshal(line, v)
+		}
+		line = append(line, b[0])
+	}
+	return errors.New("handshake line too long")
+}
@@ -0,0 +1,468 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Config holds settings that survive a restart. Everything is optional;
+// zero values leave the built-in defaults in place.
+type Config struct {
+	DownloadDir    string         `json:"download_dir,omitempty"`
+	LogLevel       string         `json:"log_level,omitempty"`
+	LogFile        string         `json:"log_file,omitempty"`
+	Locale         string         `json:"locale,omitempty"` // language of messages on channels that did not set_locale
+	MaxConnections int            `json:"max_connections,omitempty"`
+	DefaultPorts   map[string]int `json:"default_ports,omitempty"` // listener type -> port used when start_server omits one
+	RateLimits     RateLimits     `json:"rate_limits"`
+	Proxy          *ProxyConfig   `json:"proxy,omitempty"`     // outbound dials go through this proxy
+	Storage        StorageConfig  `json:"storage"`             // free space and quotas for received files
+	ReceivePolicy  ReceivePolicy  `json:"receive_policy"`      // which incoming files are kept
+	P2P            P2PConfig      `json:"p2p"`                 // STUN and TURN servers for peer sessions
+	ControlLimits  ControlLimits  `json:"control_limits"`      // guardrails on stdin and control socket requests
+	Rekey          RekeyConfig    `json:"rekey"`               // how often encrypted sessions replace their keys
+	Developer      bool           `json:"developer,omitempty"` // testing aids such as set_netem
+
+	// Encryption says where transfers may skip encryption, see plaintext.go
+	Encryption EncryptionConfig `json:"encryption"`
+
+	// Update is where check_update and apply_update find releases
+	Update UpdateConfig `json:"update"`
+
+	// GeoIP names the databases remote addresses are looked up in
+	GeoIP GeoIPConfig `json:"geoip"`
+
+	// Audit limits the command audit log, see audit.go
+	Audit AuditConfig `json:"audit"`
+
+	// Heartbeat decides how fast peer links notice a peer gone silent
+	Heartbeat HeartbeatConfig `json:"heartbeat"`
+
+	// StdoutBatching batches events written to stdout, see batching.go
+	StdoutBatching OutputBatching `json:"stdout_batching"`
+
+	// ClockSkew decides when a peer's clock is far enough off to warn
+	// about, see clock.go
+	ClockSkew ClockSkewConfig `json:"clock_skew"`
+
+	// TransferPriority shares bandwidth between priorities, see priority.go
+	TransferPriority PriorityConfig `json:"transfer_priority"`
+
+	// Hooks run in order once a received transfer completes, see hooks.go
+	Hooks []TransferHook `json:"hooks,omitempty"`
+
+	// Webhooks receive chosen events as they happen, see webhooks.go
+	Webhooks []EventWebhook `json:"webhooks,omitempty"`
+
+	// Servers are start_server payloads, plus an optional bytes_per_sec,
+	// started right after launch in order. They are kept verbatim so saving
+	// the config does not rewrite them.
+	Servers []json.RawMessage `json:"servers,omitempty"`
+
+	// Profiles are named servers in the same form that start_profile
+	// launches on demand. set_config merges them by name; a null profile
+	// removes one.
+	Profiles map[string]json.RawMessage `json:"profiles,omitempty"`
+
+	// Groups are named lists of peers broadcast_file sends to, merged by
+	// name like profiles
+	Groups map[string][]string `json:"groups,omitempty"`
+
+	// StorageBackends are where transfer listeners can put received files
+	// instead of a local directory, see backends.go. Merged by name like
+	// profiles.
+	StorageBackends map[string]*StorageBackendConfig `json:"storage_backends,omitempty"`
+}
+
+// RateLimits are the starting caps, in bytes per second, for new
+// listeners and connections
+type RateLimits struct {
+	Listener   int64 `json:"listener,omitempty"`
+	Connection int64 `json:"connection,omitempty"`
+}
+
+// serverConfig is the part of a configured server that start_server
+// does not read itself
+type serverConfig struct {
+	Type        string `json:"type"`
+	Host        string `json:"host"`
+	Port        int    `json:"port"`
+	BytesPerSec int64  `json:"bytes_per_sec"`
+}
+
+func (c *Config) Validate() error {
+	if c.LogLevel != "" {
+		if _, ok := parseLogLevel(c.LogLevel); !ok {
+			return catalogError(ErrUnsupported, "common.unknown_log_level", "level", c.LogLevel)
+		}
+	}
+	if !validLocale(c.Locale) {
+		return catalogError(ErrInvalidArgument, "config.invalid_locale", "locale", c.Locale)
+	}
+	if c.MaxConnections < 0 {
+		return catalogError(ErrInvalidArgument, "common.max_connections_must_not")
+	}
+	if c.RateLimits.Listener < 0 || c.RateLimits.Connection < 0 {
+		return catalogError(ErrInvalidArgument, "config.rate_limits_must_not")
+	}
+	if err := c.Proxy.Validate(); err != nil {
+		return err
+	}
+	if err := c.Storage.Validate(); err != nil {
+		return err
+	}
+	if err := c.ReceivePolicy.Validate(); err != nil {
+		return err
+	}
+	if err := c.P2P.Validate(); err != nil {
+		return err
+	}
+	if err := c.ControlLimits.Validate(); err != nil {
+		return err
+	}
+	if err := c.Rekey.Validate(); err != nil {
+		return err
+	}
+	if err := c.Encryption.Validate(); err != nil {
+		return err
+	}
+	if err := c.Update.Validate(); err != nil {
+		return err
+	}
+	if err := c.Heartbeat.Validate(); err != nil {
+		return err
+	}
+	if err := c.ClockSkew.Validate(); err != nil {
+		return err
+	}
+	if err := c.StdoutBatching.validate("stdout_batching."); err != nil {
+		return err
+	}
+	if err := c.Audit.Validate(); err != nil {
+		return err
+	}
+	if err := c.GeoIP.Validate(); err != nil {
+		return err
+	}
+	if err := c.TransferPriority.Validate(); err != nil {
+		return err
+	}
+	if err := validateHooks(c.Hooks); err != nil {
+		return err
+	}
+	if err := validateWebhooks(c.Webhooks); err != nil {
+		return err
+	}
+	for typ, port := range c.DefaultPorts {
+		if port < 0 || port > 65535 {
+			return fmt.Errorf("default port for %s is out of range", typ)
+		}
+	}
+	for i, raw := range c.Servers {
+		if err := validateServerEntry(raw); err != nil {
+			return fmt.Errorf("server %d: %v", i, err)
+		}
+	}
+	for name, raw := range c.Profiles {
+		if err := validateProfileName(name); err != nil {
+			return err
+		}
+		if err := validateServerEntry(raw); err != nil {
+			return fmt.Errorf("profile %s: %v", name, err)
+		}
+	}
+	for name, members := range c.Groups {
+		if err := validateGroup(name, members); err != nil {
+			return err
+		}
+	}
+	return validateBackends(c.StorageBackends)
+}
+
+// validateServerEntry checks what can be checked of a configured server
+// before start_server sees it
+func validateServerEntry(raw json.RawMessage) error {
+	var s serverConfig
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return err
+	}
+	if s.BytesPerSec < 0 {
+		return catalogError(ErrInvalidArgument, "common.bytes_per_sec_must")
+	}
+	return nil
+}
+
+// ConfigStore is the loaded configuration and the file it came from
+type ConfigStore struct {
+	mu   sync.Mutex
+	path string
+	cfg  Config
+}
+
+var config ConfigStore
+
+func (s *ConfigStore) Get() Config {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cfg
+}
+
+func (s *ConfigStore) Path() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.path
+}
+
+// Load reads path into the store. A missing file is not an error so a
+// first launch starts from defaults.
+func (s *ConfigStore) Load(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.path = path
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return fmt.Errorf("parse %s: %w", path, err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	s.cfg = cfg
+	return nil
+}
+
+// Update merges the fields present in patch into the configuration and
+// writes the result back to disk
+func (s *ConfigStore) Update(patch json.RawMessage) (Config, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cfg := s.cfg
+	// Decode into a copy of the map so a rejected patch leaves s.cfg alone
+	cfg.DefaultPorts = make(map[string]int, len(s.cfg.DefaultPorts))
+	for k, v := range s.cfg.DefaultPorts {
+		cfg.DefaultPorts[k] = v
+	}
+	cfg.Profiles = make(map[string]json.RawMessage, len(s.cfg.Profiles))
+	for k, v := range s.cfg.Profiles {
+		cfg.Profiles[k] = v
+	}
+	cfg.Groups = make(map[string][]string, len(s.cfg.Groups))
+	for k, v := range s.cfg.Groups {
+		cfg.Groups[k] = v
+	}
+	cfg.StorageBackends = make(map[string]*StorageBackendConfig, len(s.cfg.StorageBackends))
+	for k, v := range s.cfg.StorageBackends {
+		cfg.StorageBackends[k] = v
+	}
+	// Hooks are replaced as a list, not decoded over the old entries
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(patch, &fields) == nil && fields["hooks"] != nil {
+		cfg.Hooks = nil
+	}
+	if err := json.Unmarshal(patch, &cfg); err != nil {
+		return s.cfg, catalogError(ErrInvalidArgument, "config.invalid_config", "error", err)
+	}
+	for name, raw := range cfg.Profiles {
+		if string(raw) == "null" {
+			delete(cfg.Profiles, name)
+		}
+	}
+	for name, members := range cfg.Groups {
+		if members == nil {
+			delete(cfg.Groups, name)
+		}
+	}
+	for name, b := range cfg.StorageBackends {
+		if b == nil {
+			delete(cfg.StorageBackends, name)
+		}
+	}
+	if err := cfg.Validate(); err != nil {
+		return s.cfg, err
+	}
+	if err := saveConfig(s.path, cfg); err != nil {
+		return s.cfg, catalogError(ErrFailed, "config.failed_save_config", "error", err)
+	}
+	s.cfg = cfg
+	return cfg, nil
+}
+
+// saveConfig writes cfg atomically so a crash never leaves it half written
+func saveConfig(path string, cfg Config) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(cfg); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path+".tmp", buf.Bytes(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// defaultConfigPath is where the config lives unless -config says otherwise
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "Lumina", "lumina-net.json")
+}
+
+// applyConfig puts the settings that take effect immediately into force.
+// With a non-nil only, just the named fields are applied, so changing one
+// setting does not undo runtime changes to the others.
+func applyConfig(cfg Config, only map[string]json.RawMessage) error {
+	has := func(field string) bool {
+		_, ok := only[field]
+		return only == nil || ok
+	}
+	if has("log_level") {
+		if level, ok := parseLogLevel(cfg.LogLevel); ok {
+			logLevel.Set(level)
+		}
+	}
+	if has("log_file") {
+		if cfg.LogFile == "" {
+			logSink.SetFile(nil)
+		} else {
+			f, err := OpenRotatingFile(cfg.LogFile, defaultLogMaxSize, defaultLogMaxBackups)
+			if err != nil {
+				return fmt.Errorf("open log file: %w", err)
+			}
+			logSink.SetFile(f)
+		}
+	}
+	if has("locale") {
+		setDefaultLocale(cfg.Locale)
+	}
+	if has("geoip") {
+		if err := geoip.load(cfg.GeoIP); err != nil {
+			return fmt.Errorf("open geoip database: %w", err)
+		}
+	}
+	if has("audit") {
+		if err := audit.configure(cfg.Audit); err != nil {
+			return fmt.Errorf("open audit log: %w", err)
+		}
+	}
+	if has("stdout_batching") {
+		output.SetBatching(cfg.StdoutBatching)
+	}
+	if has("transfer_priority") {
+		priorities.rebalance()
+	}
+	if has("max_connections") {
+		globalGate.SetMax(cfg.MaxConnections)
+	}
+	if has("control_limits") {
+		setControlLimits(cfg.ControlLimits)
+		if cfg.ControlLimits.MaxMessageSize > 0 && input != nil && !maxMessageSizeFlag {
+			mode, _ := input.settings()
+			input.Configure(mode, cfg.ControlLimits.MaxMessageSize)
+		}
+	}
+	return nil
+}
+
+// startConfiguredServers starts the servers listed in the config and
+// reports each outcome as an event, since no request asked for them
+func startConfiguredServers(cfg Config) {
+	for _, raw := range cfg.Servers {
+		var s serverConfig
+		json.Unmarshal(raw, &s)
+		resp := startServerEntry(raw)
+		if resp.Status != "ok" {
+			logger.Warn("configured server failed to start", "type", s.Type, "port", s.Port, "error", resp.Message)
+			emitEvent("config_server_failed", map[string]interface{}{
+				"type": s.Type, "host": s.Host, "port": s.Port, "error": resp.Message,
+			})
+			continue
+		}
+		emitEvent("config_server_started", resp.Data)
+	}
+}
+
+// startServerEntry runs start_server on a configured server, applies its
+// bytes_per_sec and returns the answer; the listener's address is in
+// Data["addr"] when it started
+func startServerEntry(raw json.RawMessage) ProtocolResponse {
+	var s serverConfig
+	json.Unmarshal(raw, &s)
+	var buf bytes.Buffer
+	handleStartServer(raw, NewOutput(&buf))
+
+	var resp ProtocolResponse
+	json.Unmarshal(buf.Bytes(), &resp)
+	if resp.Status != "ok" || s.BytesPerSec <= 0 {
+		return resp
+	}
+	bound, _ := resp.Data.(map[string]interface{})
+	if id, ok := bound["listener_id"].(string); ok {
+		state.Mutex.Lock()
+		if l, exists := state.Listeners[id]; exists {
+			l.Limiter.SetRate(s.BytesPerSec)
+		}
+		state.Mutex.Unlock()
+	}
+	return resp
+}
+
+// defaultPort fills in the configured port for a listener type when the
+// payload leaves the port out entirely; an explicit 0 still picks a free one
+func defaultPort(payload json.RawMessage, typ string) (int, bool) {
+	var fields map[string]json.RawMessage
+	json.Unmarshal(payload, &fields)
+	if _, given := fields["port"]; given {
+		return 0, false
+	}
+	port, ok := config.Get().DefaultPorts[typ]
+	return port, ok
+}
+
+func handleGetConfig(writer *Output) {
+	writer.Encode(ProtocolResponse{
+		Status: "ok",
+		Data:   map[string]interface{}{"path": config.Path(), "config": config.Get()},
+	})
+}
+
+// handleSetConfig takes a partial config, merges it, saves it and applies
+// what can change at runtime. Servers only start on the next launch.
+func handleSetConfig(payload json.RawMessage, writer *Output) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &fields); err != nil || fields == nil {
+		sendInvalidPayload(writer, "set_config")
+		return
+	}
+	cfg, err := config.Update(payload)
+	if err != nil {
+		sendFailure(writer, err)
+		return
+	}
+	if err := applyConfig(cfg, fields); err != nil {
+		sendError(writer, message("config.saved_but_not_applied", "error", err))
+		return
+	}
+	logger.Info("config updated", "path", config.Path())
+
+	writer.Encode(okResponse(message("config.saved", "path", config.Path()),
+		map[string]interface{}{"path": config.Path(), "config": cfg}))
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Connection is a socket tracked in state so it can be drained on shutdown
+// and addressed by ID from the Tauri process
+type Connection struct {
+	ID         string
+	Direction  string // "inbound", "outbound"
+	Network    string // "tcp", "udp"
+	Listener   string // listener address for inbound connections
+	ListenerID string // and its ID
+	Mux        string // mux link carrying this stream, if any
+	Created    time.Time
+	Limiter    *RateLimiter
+
+	BytesIn  atomic.Uint64
+	BytesOut atomic.Uint64
+	In       Meter
+	Out      Meter
+
+	server *Listener
+
+	tap atomic.Pointer[Tap]   // set while tap_connection captures the traffic
+	sim atomic.Pointer[Netem] // conditions set_netem simulates, nil for none
+
+	// closing is set when we close the socket on purpose, so readers do not
+	// mistake it for a network failure
+	closing atomic.Bool
+
+	// readShut and writeShut record shutdown_read and shutdown_write;
+	// halfOpen keeps the sending side after the peer's FIN, see halfclose.go
+	readShut, writeShut, halfOpen atomic.Bool
+
+	raw atomic.Pointer[RawChannel] // set_raw_channel's terms, see rawchannel.go
+
+	mu       sync.Mutex
+	conn     net.Conn
+	secure   *SecureInfo
+	route    *DialRoute // the address an outbound dial raced to, see eyeballs.go
+	trusted  string     // subnet an encrypted listener waived the handshake for, see plaintext.go
+	auth     string     // how an inbound peer authenticated, "secret" or "token"
+	protocol string     // framing spoken on top of the stream, "" for raw bytes or "chat"
+	linger   *int       // seconds from set_linger, nil until set
+	timeouts Timeouts
+	// readDeadline is an explicit deadline set by a handler; while set it
+	// takes precedence over the configured read and idle timeouts
+	readDeadline time.Time
+}
+
+// ConnectionInfo is the JSON view of a Connection
+type ConnectionInfo struct {
+	ID         string      `json:"id"`
+	Direction  string      `json:"direction"`
+	Network    string      `json:"network"`
+	LocalAddr  string      `json:"local_addr"`
+	RemoteAddr string      `json:"remote_addr"`
+	Listener   string      `json:"listener,omitempty"`
+	ListenerID string      `json:"listener_id,omitempty"`
+	Mux        string      `json:"mux,omitempty"`
+	Created    time.Time   `json:"created"`
+	BytesIn    uint64      `json:"bytes_in"`
+	BytesOut   uint64      `json:"bytes_out"`
+	InBps      float64     `json:"in_bps"`
+	OutBps     float64     `json:"out_bps"`
+	RateLimit  int64       `json:"bytes_per_sec"`
+	Encrypted  bool        `json:"encrypted"`
+	Secure     *SecureInfo `json:"secure,omitempty"`
+	Auth       string      `json:"auth,omitempty"`
+	Protocol   string      `json:"protocol,omitempty"`
+	Timeouts   Timeouts    `json:"timeouts"`
+
+	Compression *CompressionStats `json:"compression,omitempty"`
+	Session     *SessionInfo      `json:"session,omitempty"` // keys and rekeying of an encrypted session
+	Path        *PathInfo         `json:"path,omitempty"`    // MTU of a QUIC or UDP connection's path
+	Route       *DialRoute        `json:"route,omitempty"`   // address and family an outbound dial chose
+
+	Plaintext string `json:"plaintext,omitempty"` // trusted subnet that let it skip encryption, see plaintext.go
+
+	Shutdown string `json:"shutdown,omitempty"` // directions shut so far: "read", "write" or "both"
+	Linger   *int   `json:"linger,omitempty"`   // seconds from set_linger
+
+	Raw *RawChannel `json:"raw,omitempty"` // recv and send_raw terms, see rawchannel.go
+
+	Tapped bool `json:"tapped,omitempty"` // tap_connection is capturing it
+
+	Namespace string     `json:"namespace,omitempty"`
+	Netem     *NetemInfo `json:"netem,omitempty"` // conditions set_netem simulates on it
+
+	Geo *GeoInfo `json:"geo,omitempty"` // where the remote address is, see geoip.go
+}
+
+var connSeq atomic.Uint64
+
+// Conn returns the current underlying socket, which changes on reconnect
+func (c *Connection) Conn() net.Conn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn
+}
+
+func (c *Connection) setConn(conn net.Conn) {
+	c.mu.Lock()
+	c.conn = conn
+	keepalive := c.timeouts.Keepalive
+	c.mu.Unlock()
+	applyKeepalive(conn, keepalive)
+}
+
+func (c *Connection) Timeouts() Timeouts {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.timeouts
+}
+
+func (c *Connection) SetTimeouts(t Timeouts) {
+	c.mu.Lock()
+	c.timeouts = t
+	conn := c.conn
+	c.mu.Unlock()
+	applyKeepalive(conn, t.Keepalive)
+	c.armReadDeadline()
+}
+
+// armReadDeadline pushes the read deadline out by the configured window.
+// It runs before every read and after every write, so the idle timeout
+// measures time since the last traffic in either direction.
+func (c *Connection) armReadDeadline() {
+	c.mu.Lock()
+	conn, explicit, window := c.conn, c.readDeadline, c.timeouts.readWindow()
+	c.mu.Unlock()
+
+	switch {
+	case !explicit.IsZero():
+		conn.SetReadDeadline(explicit)
+	case window > 0:
+		conn.SetReadDeadline(time.Now().Add(window))
+	default:
+		conn.SetReadDeadline(time.Time{})
+	}
+}
+
+// setSecure records the peer identity once the socket is encrypted
+func (c *Connection) setSecure(info *SecureInfo) {
+	c.mu.Lock()
+	c.secure = info
+	c.mu.Unlock()
+}
+
+func (c *Connection) setRoute(route *DialRoute) {
+	c.mu.Lock()
+	c.route = route
+	c.mu.Unlock()
+}
+
+func (c *Connection) setAuth(method string) {
+	c.mu.Lock()
+	c.auth = method
+	c.mu.Unlock()
+}
+
+func (c *Connection) setProtocol(protocol string) {
+	c.mu.Lock()
+	c.protocol = protocol
+	c.mu.Unlock()
+}
+
+func (c *Connection) Protocol() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.protocol
+}
+
+func (c *Connection) Read(b []byte) (int, error) {
+	c.armReadDeadline()
+	n, err := c.Conn().Read(b)
+	if sim, _ := c.netem(); sim.applies("in") && n > 0 {
+		for n > 0 && err == nil && !sim.pass(n, c.Network == "udp") {
+			n, err = c.Conn().Read(b)
+		}
+	}
+	c.countIn(n)
+	if t := c.tap.Load(); t != nil && n > 0 {
+		t.capture(c, "in", b[:n])
+	}
+	return n, err
+}
+
+func (c *Connection) Write(b []byte) (int, error) {
+	c.throttle(len(b))
+	if sim, _ := c.netem(); sim.applies("out") && !sim.pass(len(b), c.Network == "udp") {
+		// Lost on the way, as far as the peer can tell
+		c.countOut(len(b))
+		return len(b), nil
+	}
+
+	conn := c.Conn()
+	if write := c.Timeouts().Write; write > 0 {
+		conn.SetWriteDeadline(time.Now().Add(write))
+	}
+	n, err := conn.Write(b)
+	c.countOut(n)
+	if t := c.tap.Load(); t != nil && n > 0 {
+		t.capture(c, "out", b[:n])
+	}
+	if n > 0 && c.Timeouts().Idle > 0 {
+		c.armReadDeadline()
+	}
+	return n, err
+}
+
+// countIn records n received bytes for handlers that read around Read
+func (c *Connection) countIn(n int) {
+	if n <= 0 {
+		return
+	}
+	c.BytesIn.Add(uint64(n))
+	c.In.Add(n)
+	metrics.BytesIn.Add(uint64(n))
+	if c.server != nil {
+		c.server.BytesIn.Add(uint64(n))
+		c.server.In.Add(n)
+	}
+	// Throttle reads after the fact so the sender is slowed by TCP backpressure
+	c.throttle(n)
+}
+
+func (c *Connection) countOut(n int) {
+	if n <= 0 {
+		return
+	}
+	c.BytesOut.Add(uint64(n))
+	c.Out.Add(n)
+	metrics.BytesOut.Add(uint64(n))
+	if c.server != nil {
+		c.server.BytesOut.Add(uint64(n))
+		c.server.Out.Add(n)
+	}
+}
+
+// throttle waits on both the connection's own bucket and its listener's
+func (c *Connection) throttle(n int) {
+	c.Limiter.WaitN(n)
+	if c.server != nil {
+		c.server.Limiter.WaitN(n)
+	}
+}
+
+func (c *Connection) Close() error {
+	return c.Conn().Close()
+}
+
+// SetReadDeadline sets an explicit deadline that overrides the configured
+// timeouts; the zero time hands control back to them
+func (c *Connection) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	return c.Conn().SetReadDeadline(t)
+}
+
+func (c *Connection) SetWriteDeadline(t time.Time) error {
+	return c.Conn().SetWriteDeadline(t)
+}
+
+func (c *Connection) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	return c.Conn().SetDeadline(t)
+}
+
+func (c *Connection) LocalAddr() net.Addr  { return c.Conn().LocalAddr() }
+func (c *Connection) RemoteAddr() net.Addr { return c.Conn().RemoteAddr() }
+
+// Abort closes the connection deliberately, suppressing reconnect attempts
+func (c *Connection) Abort() error {
+	c.closing.Store(true)
+	return c.Close()
+}
+
+func (c *Connection) Info() ConnectionInfo {
+	c.mu.Lock()
+	conn, secure, route, plaintext, auth, protocol, linger, timeouts := c.conn, c.secure, c.route, c.trusted, c.auth, c.protocol, c.linger, c.timeouts
+	c.mu.Unlock()
+
+	info := ConnectionInfo{
+		ID:         c.ID,
+		Direction:  c.Direction,
+		Network:    c.Network,
+		LocalAddr:  conn.LocalAddr().String(),
+		RemoteAddr: conn.RemoteAddr().String(),
+		Listener:   c.Listener,
+		ListenerID: c.ListenerID,
+		Mux:        c.Mux,
+		Created:    c.Created,
+		BytesIn:    c.BytesIn.Load(),
+		BytesOut:   c.BytesOut.Load(),
+		InBps:      c.In.Rate(),
+		OutBps:     c.Out.Rate(),
+		RateLimit:  c.Limiter.Rate(),
+		Encrypted:  secure != nil,
+		Secure:     secure,
+		Route:      route,
+		Plaintext:  plaintext,
+		Shutdown:   c.shutdownDirections(),
+		Linger:     linger,
+		Raw:        c.raw.Load(),
+		Auth:       auth,
+		Protocol:   protocol,
+		Tapped:     c.tap.Load() != nil,
+		Timeouts:   timeouts,
+		Namespace:  scopeOf(c.ID),
+	}
+	if cc, ok := conn.(*compressedConn); ok {
+		info.Compression = cc.Stats()
+	}
+	if s := secureOf(conn); s != nil {
+		info.Session = s.Session()
+	}
+	info.Path = pathOf(conn)
+	info.Geo = geoForAddr(info.RemoteAddr)
+	if sim, scope := c.netem(); sim != nil {
+		info.Netem = sim.Info(scope)
+	}
+	return info
+}
+
+// trackConn registers a connection so shutdown can drain it.
+// It returns nil once shutdown has started.
+func trackConn(conn net.Conn, direction, network string, server *Listener) *Connection {
+	return trackStream(conn, direction, network, server, "")
+}
+
+// trackStream registers one stream of the mux link mux
+func trackStream(conn net.Conn, direction, network string, server *Listener, mux string) *Connection {
+	state.Mutex.Lock()
+	defer state.Mutex.Unlock()
+
+	if state.stopping {
+		return nil
+	}
+
+	c := &Connection{
+		ID:        fmt.Sprintf("conn-%d", connSeq.Add(1)),
+		Direction: direction,
+		Network:   network,
+		Mux:       mux,
+		Created:   time.Now(),
+		Limiter:   newRateLimiter(config.Get().RateLimits.Connection),
+		server:    server,
+		conn:      conn,
+		timeouts:  defaultOutboundTimeouts,
+	}
+	if server != nil {
+		c.Listener, c.ListenerID = server.Addr, server.ID
+		setScope(c.ID, scopeOf(server.ID))
+		c.timeouts = server.Timeouts
+		if server.Type == chatProtocol {
+			c.protocol = chatProtocol
+		}
+	}
+	applyKeepalive(conn, c.timeouts.Keepalive)
+	state.Conns[c.ID] = c
+	state.active.Add(1)
+	metrics.Connections.Add(1)
+	if server != nil {
+		server.Accepted.Add(1)
+	}
+	logger.Debug("connection opened", "id", c.ID, "direction", direction, "network", network,
+		"remote", conn.RemoteAddr().String())
+	return c
+}
+
+func untrackConn(c *Connection) {
+	c.Close()
+
+	state.Mutex.Lock()
+	_, exists := state.Conns[c.ID]
+	delete(state.Conns, c.ID)
+	state.Mutex.Unlock()
+	dropScope(c.ID)
+
+	if exists {
+		// Streams of a mux link share the slot the link itself took
+		if c.server != nil && c.Mux == "" {
+			releaseServerSlots(c.server)
+		}
+		state.active.Done()
+		forgetPending(c)
+		usage.account(c, true)
+		if t := c.tap.Swap(nil); t != nil {
+			t.stop("closed")
+		}
+		logger.Debug("connection closed", "id", c.ID,
+			"bytes_in", c.BytesIn.Load(), "bytes_out", c.BytesOut.Load())
+	}
+}
+
+// lookupConn finds connection id if requests answered through writer can
+// see it
+func lookupConn(id string, writer *Output) (*Connection, bool) {
+	state.Mutex.Lock()
+	c, exists := state.Conns[id]
+	state.Mutex.Unlock()
+	if !exists || !inScope(c.ID, writer) {
+		return nil, false
+	}
+	return c, true
+}
+
+func handleListConnections(writer *Output) {
+	state.Mutex.Lock()
+	conns := make([]ConnectionInfo, 0, len(state.Conns))
+	for _, c := range state.Conns {
+		if inScope(c.ID, writer) {
+			conns = append(conns, c.Info())
+		}
+	}
+	state.Mutex.Unlock()
+
+	sort.Slice(conns, func(i, j int) bool { return conns[i].Created.Before(conns[j].Created) })
+
+	writer.Encode(ProtocolResponse{
+		Status: "ok",
+		Data:   map[string]interface{}{"connections": conns},
+	})
+}
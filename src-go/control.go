@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// The control socket is a second way in besides stdin/stdout: a Unix
+// domain socket, or a named pipe on Windows, where local tools can issue
+// the same protocol requests as the Tauri parent. Every client speaks the
+// protocol independently and receives all events. Events wait in a queue
+// per client for a goroutine of its own to write them, so a client that
+// stops reading cannot hold up the others or whoever emitted the event;
+// one that lets its queue fill is disconnected.
+const controlEventQueue = 256
+
+// ControlClient is one local process connected to the control socket
+type ControlClient struct {
+	ID     string
+	in     *FrameReader
+	out    *Output
+	closer io.Closer
+	events chan interface{}
+}
+
+// ControlState is the control socket listener and its clients
+type ControlState struct {
+	mu      sync.Mutex
+	path    string
+	ln      net.Listener
+	clients map[*Output]*ControlClient
+}
+
+var (
+	control    = ControlState{clients: make(map[*Output]*ControlClient)}
+	controlSeq atomic.Uint64
+)
+
+// readRequests serves protocol requests read from in until it fails,
+// answering each on writer, within the control channel guardrails
+func readRequests(in *FrameReader, writer *Output) error {
+	var bucket commandBucket
+	for {
+		frame, err := in.ReadFrame()
+		if err == errMessageTooLarge {
+			_, maxSize := in.settings()
+			sendMessageTooLarge(writer, maxSize)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		frame = bytes.TrimSpace(frame)
+		if len(frame) == 0 {
+			continue
+		}
+
+		limits := currentControlLimits()
+		if jsonDepth(frame) > limits.MaxDepth {
+			sendTooDeep(writer, limits)
+			continue
+		}
+		var req ProtocolRequest
+		if err := json.Unmarshal(frame, &req); err != nil {
+			sendErrorCode(writer, ErrInvalidPayload, message("control.invalid_json_format"), nil)
+			continue
+		}
+		if !bucket.allow(limits) {
+			sendRateLimited(writer.forRequest(req.ID), limits)
+			continue
+		}
+
+		dispatchRequest(req, writer)
+	}
+}
+
+// Requests that carry an id are handed to a bounded pool of workers, so a
+// slow handler does not hold up the ones behind it, and their responses
+// repeat the id. Requests without one run in order on the reading
+// goroutine as they always have, and so do commands that change channel
+// state (framing, locale, namespace, output batching) or end the process,
+// so later requests see the change, and the pieces of chunked
+// payloads, which have to land in the order they were sent.
+const defaultRequestWorkers = 8
+
+var inlineCommands = map[string]bool{
+	"set_framing":         true,
+	"set_locale":          true,
+	"set_namespace":       true,
+	"set_output_batching": true,
+	"shutdown":            true,
+	"begin_payload":       true,
+	"payload_chunk":       true,
+}
+
+// WorkerPool runs queued requests on a fixed number of goroutines
+type WorkerPool struct {
+	work chan func()
+}
+
+// requestPool is nil until main starts it; requests then run inline
+var requestPool *WorkerPool
+
+func newWorkerPool(size int) *WorkerPool {
+	p := &WorkerPool{work: make(chan func(), size*4)}
+	for i := 0; i < size; i++ {
+		go func() {
+			for fn := range p.work {
+				fn()
+			}
+		}()
+	}
+	return p
+}
+
+// dispatchRequest answers req on writer, on the pool when req has an id.
+// A full queue blocks the reader, which pushes back on the sender.
+func dispatchRequest(req ProtocolRequest, writer *Output) {
+	if len(req.ID) == 0 || requestPool == nil || inlineCommands[req.Command] {
+		handleRequest(req, writer.forRequest(req.ID))
+		return
+	}
+	w := writer.forRequest(req.ID)
+	requestPool.work <- func() { handleRequest(req, w) }
+}
+
+// readerFor is the reader whose requests writer answers, so set_framing
+// only changes the channel it arrived on
+func readerFor(writer *Output) *FrameReader {
+	control.mu.Lock()
+	defer control.mu.Unlock()
+	if c, exists := control.clients[writer.channel()]; exists {
+		return c.in
+	}
+	return input
+}
+
+// broadcastControl queues an event for every control client
+func broadcastControl(v interface{}) {
+	control.mu.Lock()
+	defer control.mu.Unlock()
+	for out, c := range control.clients {
+		select {
+		case c.events <- v:
+		default:
+			logger.Warn("control client is not reading events, disconnecting", "id", c.ID)
+			delete(control.clients, out)
+			c.closer.Close()
+		}
+	}
+}
+
+// writeControlEvents writes c's queued events until serveControl closes
+// the queue
+func writeControlEvents(c *ControlClient) {
+	defer recoverPanic("control client " + c.ID)
+	for v := range c.events {
+		c.out.Encode(v)
+	}
+}
+
+// startControlLocked listens on path; the caller holds control.mu
+func startControlLocked(path string) error {
+	if control.ln != nil {
+		return fmt.Errorf("control socket already listening on %s", control.path)
+	}
+	ln, err := listenControl(path)
+	if err != nil {
+		return err
+	}
+	control.path, control.ln = path, ln
+	go acceptControl(ln)
+	logger.Info("control socket listening", "path", path)
+	return nil
+}
+
+// stopControlLocked closes the listener and every client; the caller
+// holds control.mu
+func stopControlLocked() {
+	if control.ln == nil {
+		return
+	}
+	control.ln.Close()
+	for out, c := range control.clients {
+		c.closer.Close()
+		delete(control.clients, out)
+	}
+	logger.Info("control socket closed", "path", control.path)
+	control.path, control.ln = "", nil
+}
+
+func acceptControl(ln net.Listener) {
+	defer recoverPanic("control socket")
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go serveControl(conn)
+	}
+}
+
+func serveControl(conn net.Conn) {
+	defer recoverPanic("control client")
+	_, maxSize := input.settings()
+	c := &ControlClient{
+		ID:     fmt.Sprintf("control-%d", controlSeq.Add(1)),
+		in:     NewFrameReader(conn, framingLine, maxSize),
+		out:    NewOutput(conn),
+		closer: conn,
+		events: make(chan interface{}, controlEventQueue),
+	}
+
+	control.mu.Lock()
+	if control.ln == nil {
+		control.mu.Unlock()
+		conn.Close()
+		return
+	}
+	control.clients[c.out] = c
+	control.mu.Unlock()
+	go writeControlEvents(c)
+	logger.Info("control client connected", "id", c.ID)
+
+	err := readRequests(c.in, c.out)
+
+	// Out of the map nothing queues more, so the queue can close
+	control.mu.Lock()
+	delete(control.clients, c.out)
+	control.mu.Unlock()
+	close(c.events)
+	c.out.Close()
+	conn.Close()
+	if err == io.EOF {
+		logger.Info("control client disconnected", "id", c.ID)
+	} else {
+		logger.Info("control client disconnected", "id", c.ID, "error", err)
+	}
+}
+
+type ControlSocketPayload struct {
+	Path string `json:"path"` // socket file, or \\.\pipe\name on Windows
+}
+
+func handleStartControlSocket(payload json.RawMessage, writer *Output) {
+	var p ControlSocketPayload
+	if len(payload) > 0 && string(payload) != "null" {
+		if err := json.Unmarshal(payload, &p); err != nil {
+			sendInvalidPayload(writer, "start_control_socket")
+			return
+		}
+	}
+	if p.Path == "" {
+		p.Path = defaultControlPath()
+	}
+
+	control.mu.Lock()
+	err := startControlLocked(p.Path)
+	control.mu.Unlock()
+	if err != nil {
+		sendError(writer, message("control.failed_start_control_socket", "error", err))
+		return
+	}
+	writer.Encode(okResponse(message("control.socket_listening", "path", p.Path), map[string]interface{}{"path": p.Path}))
+}
+
+func handleStopControlSocket(writer *Output) {
+	control.mu.Lock()
+	defer control.mu.Unlock()
+	if control.ln == nil {
+		sendErrorCode(writer, ErrNotRunning, message("control.socket_not_running"), nil)
+		return
+	}
+	// A client stopping the socket it is connected to still gets its answer
+	writer.Encode(okResponse(message("control.socket_stopped"), nil))
+	stopControlLocked()
+}
+
+func handleControlStatus(writer *Output) {
+	control.mu.Lock()
+	defer control.mu.Unlock()
+	clients := make([]string, 0, len(control.clients))
+	for _, c := range control.clients {
+		clients = append(clients, c.ID)
+	}
+	writer.Encode(ProtocolResponse{
+		Status: "ok",
+		Data: map[string]interface{}{
+			"running": control.ln != nil,
+			"path":    control.path,
+			"clients": clients,
+		},
+	})
+}
@@ -0,0 +1,48 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// listenControl listens on a Unix domain socket only the current user can
+// connect to. A socket file left behind by a crashed run is replaced, but
+// one another process still answers on is not.
+func listenControl(path string) (net.Listener, error) {
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return nil, errors.New("another process is listening on " + path)
+	}
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+func defaultControlPath() string {
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "lumina-net.sock")
+}
+
+func defaultGRPCPath() string {
+	return filepath.Join(filepath.Dir(defaultControlPath()), "lumina-net-grpc.sock")
+}
@@ -0,0 +1,62 @@
+//go:build !windows
+
+package main
+
+import (
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestControlDisconnectsClientThatStopsReading(t *testing.T) {
+	savedOutput := output
+	output = NewOutput(io.Discard)
+	savedInput := input
+	input = NewFrameReader(strings.NewReader(""), framingLine, defaultMaxMessageSize)
+	t.Cleanup(func() { output, input = savedOutput, savedInput })
+
+	path := filepath.Join(t.TempDir(), "control.sock")
+	harnessCall(t, handleStartControlSocket, `{"path":"`+path+`"}`)
+	t.Cleanup(func() {
+		control.mu.Lock()
+		stopControlLocked()
+		control.mu.Unlock()
+	})
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	clients := func() int {
+		control.mu.Lock()
+		defer control.mu.Unlock()
+		return len(control.clients)
+	}
+	for deadline := time.Now().Add(5 * time.Second); clients() == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("client never registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Far more than the socket buffers and the queue hold together
+	ev := ProtocolEvent{Status: "event", Event: "test", Data: strings.Repeat("x", 8<<10)}
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 4*controlEventQueue; i++ {
+			broadcastControl(ev)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("broadcast blocked on a client that does not read")
+	}
+	if n := clients(); n != 0 {
+		t.Errorf("%d clients still connected", n)
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"net"
+	"os"
+
+	"github.com/Microsoft/go-winio"
+)
+
+// controlPipeSDDL grants the pipe's owner full access and nobody else
+const controlPipeSDDL = "D:P(A;;GA;;;OW)"
+
+// listenControl listens on a named pipe only the current user can open
+func listenControl(path string) (net.Listener, error) {
+	return winio.ListenPipe(path, &winio.PipeConfig{SecurityDescriptor: controlPipeSDDL})
+}
+
+func defaultControlPath() string {
+	return `\\.\pipe\lumina-net-` + os.Getenv("USERNAME")
+}
+
+func defaultGRPCPath() string {
+	return `\\.\pipe\lumina-net-grpc-` + os.Getenv("USERNAME")
+}
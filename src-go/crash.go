@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Panics: a bug in one connection handler or job used to take the whole
+// sidecar down, and every other connection and transfer with it. The
+// goroutines that accept on listeners, serve connections, run jobs and
+// answer requests defer one of the recover functions below, which stops
+// the panic in that goroutine, writes a dump of the stack and the state
+// beside the config file, and reports both as a fatal_error event; the
+// rest of the service keeps running. Deferred cleanup in the panicking
+// goroutine still runs as its stack unwinds.
+const (
+	maxCrashDumps = 20
+	// crashStateTimeout bounds gathering the state for a dump, as the
+	// panic may have left a lock held
+	crashStateTimeout = 2 * time.Second
+)
+
+// crashDir is where dumps go; empty writes none
+var crashDir string
+
+var panicsRecovered atomic.Uint64
+
+// crashDirPath puts the dumps beside the config file
+func crashDirPath(configPath string) string {
+	return filepath.Join(filepath.Dir(configPath), "crashes")
+}
+
+// CrashDump is what a dump file holds
+type CrashDump struct {
+	Time        time.Time              `json:"time"`
+	Version     string                 `json:"version"`
+	Goroutine   string                 `json:"goroutine"` // what panicked, e.g. "connection conn-3"
+	Panic       string                 `json:"panic"`
+	Stack       string                 `json:"stack"`
+	Goroutines  int                    `json:"goroutines"`
+	Status      map[string]interface{} `json:"status,omitempty"`
+	Connections []ConnectionInfo       `json:"connections,omitempty"`
+	Transfers   []TransferInfo         `json:"transfers,omitempty"`
+	Jobs        []Job                  `json:"jobs,omitempty"`
+	StateError  string                 `json:"state_error,omitempty"` // why the state is missing
+}
+
+// recoverPanic, deferred, stops a panic in the goroutine that deferred it
+// and reports it as what
+func recoverPanic(what string) {
+	if r := recover(); r != nil {
+		reportPanic(what, r)
+	}
+}
+
+// goSafe runs f on a goroutine of its own that recovers from a panic in
+// it, reported as what
+func goSafe(what string, f func()) {
+	go func() {
+		defer recoverPanic(what)
+		f()
+	}()
+}
+
+// callSafe runs f and turns a panic in it, reported as what, into an
+// error, for goroutines someone waits on for a result
+func callSafe(what string, f func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			reportPanic(what, r)
+			err = fmt.Errorf("internal error: %v", r)
+		}
+	}()
+	return f()
+}
+
+// recoverConn is recoverPanic for a goroutine serving c, which it closes:
+// whatever spoke on it stopped in the middle of its protocol
+func recoverConn(c *Connection) {
+	if r := recover(); r != nil {
+		reportPanic("connection "+c.ID, r)
+		untrackConn(c)
+		emitEvent("connection_closed", map[string]interface{}{"id": c.ID, "reason": "panic"})
+	}
+}
+
+// recoverTransfer is recoverPanic for a goroutine running t, which it
+// fails unless it already finished
+func recoverTransfer(t *Transfer) {
+	if r := recover(); r != nil {
+		reportPanic("transfer "+t.ID, r)
+		t.mu.Lock()
+		active := t.State == "active"
+		t.mu.Unlock()
+		if active {
+			t.finish(fmt.Errorf("internal error: %v", r))
+		}
+	}
+}
+
+// recoverRequest is recoverPanic for a request handler, which also answers
+// the request so the frontend is not left waiting
+func recoverRequest(command string, writer *Output) {
+	if r := recover(); r != nil {
+		dump := reportPanic("request "+command, r)
+		sendErrorCode(writer, ErrInternal, message("crash.internal_error", "command", command),
+			map[string]interface{}{"command": command, "dump": dump})
+	}
+}
+
+// reportPanic logs a recovered panic, writes its dump and emits
+// fatal_error. It returns the dump's path, empty when none was written.
+func reportPanic(what string, r interface{}) string {
+	n := panicsRecovered.Add(1)
+	d := CrashDump{
+		Time:       time.Now().UTC(),
+		Version:    version,
+		Goroutine:  what,
+		Panic:      fmt.Sprint(r),
+		Stack:      string(debug.Stack()),
+		Goroutines: runtime.NumGoroutine(),
+	}
+	logger.Error("recovered from panic", "goroutine", what, "panic", d.Panic)
+
+	path := ""
+	if crashDir != "" {
+		gatherCrashState(&d)
+		var err error
+		if path, err = writeCrashDump(crashDir, &d, n); err != nil {
+			logger.Warn("cannot write crash dump", "dir", crashDir, "error", err)
+		}
+	}
+	emitEvent("fatal_error", map[string]interface{}{
+		"goroutine": what,
+		"panic":     d.Panic,
+		"stack":     d.Stack,
+		"dump":      path,
+		"recovered": true,
+		"count":     n,
+	})
+	return path
+}
+
+// gatherCrashState adds what is running to d, giving up after
+// crashStateTimeout rather than waiting on a lock the panic left held
+func gatherCrashState(d *CrashDump) {
+	gathered := make(chan CrashDump, 1)
+	go func() {
+		// A second panic here only costs the dump its state
+		defer func() { recover() }()
+		var s CrashDump
+		s.Status = statusData("")
+		state.Mutex.Lock()
+		for _, c := range state.Conns {
+			s.Connections = append(s.Connections, c.Info())
+		}
+		state.Mutex.Unlock()
+		sort.Slice(s.Connections, func(i, j int) bool { return s.Connections[i].Created.Before(s.Connections[j].Created) })
+		transfersMu.Lock()
+		for _, t := range transfers {
+			s.Transfers = append(s.Transfers, t.Info())
+		}
+		transfersMu.Unlock()
+		sort.Slice(s.Transfers, func(i, j int) bool { return s.Transfers[i].StartedAt.Before(s.Transfers[j].StartedAt) })
+		s.Jobs = listJobs(func(*Job) bool { return true })
+		gathered <- s
+	}()
+	// Real time: the test harness clock may never get there
+	select {
+	case s := <-gathered:
+		d.Status, d.Connections, d.Transfers, d.Jobs = s.Status, s.Connections, s.Transfers, s.Jobs
+	case <-time.After(crashStateTimeout):
+		d.StateError = "state was locked"
+	}
+}
+
+// writeCrashDump saves d as the nth dump in dir and removes the oldest
+// beyond maxCrashDumps
+func writeCrashDump(dir string, d *CrashDump, n uint64) (string, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+	data, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	name := fmt.Sprintf("crash-%s-%d.json", d.Time.Format("20060102-150405.000"), n)
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		return "", err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return path, nil
+	}
+	var dumps []string
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), "crash-") && strings.HasSuffix(e.Name(), ".json") {
+			dumps = append(dumps, e.Name())
+		}
+	}
+	// Names start with the time, so they sort oldest first
+	sort.Strings(dumps)
+	for len(dumps) > maxCrashDumps {
+		os.Remove(filepath.Join(dir, dumps[0]))
+		dumps = dumps[1:]
+	}
+	return path, nil
+}
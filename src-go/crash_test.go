@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useCrashDir sends dumps to a directory of the test's own
+func useCrashDir(t *testing.T) string {
+	dir := t.TempDir()
+	saved := crashDir
+	crashDir = dir
+	t.Cleanup(func() { crashDir = saved })
+	return dir
+}
+
+func TestRecoverConnKeepsListenerServing(t *testing.T) {
+	dir := useCrashDir(t)
+	events := &eventRecorder{}
+	savedOutput := output
+	output = NewOutput(events)
+	t.Cleanup(func() { output = savedOutput })
+	connHandlers["panic"] = connHandler{serve: func(c *Connection, _ *Listener, _ string) {
+		defer untrackConn(c)
+		panic("handler bug on " + c.ID)
+	}}
+	t.Cleanup(func() { delete(connHandlers, "panic") })
+
+	resp := harnessCall(t, handleStartServer, `{"host":"127.0.0.1","port":0,"type":"panic"}`)
+	data := resp.Data.(map[string]interface{})
+	t.Cleanup(func() { harnessCall(t, handleStopServer, `{"listener_id":"`+data["listener_id"].(string)+`"}`) })
+	addr := data["addr"].(string)
+
+	// The second connection finds the listener still accepting
+	for nth := 1; nth <= 2; nth++ {
+		conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+		if err != nil {
+			t.Fatalf("connection %d: %v", nth, err)
+		}
+		defer conn.Close()
+		fatal := events.wait(t, "fatal_error", nth)
+		if !strings.HasPrefix(fatal["panic"].(string), "handler bug on ") || !strings.Contains(fatal["stack"].(string), "crash_test.go") {
+			t.Errorf("fatal_error %v", fatal)
+		}
+		if closed := events.wait(t, "connection_closed", nth); closed["reason"] != "panic" {
+			t.Errorf("closed %v", closed)
+		}
+
+		raw, err := os.ReadFile(fatal["dump"].(string))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var dump CrashDump
+		if err := json.Unmarshal(raw, &dump); err != nil {
+			t.Fatal(err)
+		}
+		if dump.Panic != fatal["panic"] || dump.Status == nil || dump.StateError != "" || filepath.Dir(fatal["dump"].(string)) != dir {
+			t.Errorf("dump %+v", dump)
+		}
+	}
+}
+
+func TestRecoverRequestAnswers(t *testing.T) {
+	useCrashDir(t)
+	savedOutput := output
+	output = NewOutput(&bytes.Buffer{})
+	t.Cleanup(func() { output = savedOutput })
+
+	var buf bytes.Buffer
+	func() {
+		defer recoverRequest("get_status", NewOutput(&buf))
+		var m map[string]int
+		m["boom"]++
+	}()
+	var resp ProtocolResponse
+	if err := json.Unmarshal(buf.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != "error" || resp.Code != ErrInternal || resp.Message != "Internal error in get_status" {
+		t.Errorf("answered %s", buf.String())
+	}
+}
+
+func TestWriteCrashDumpKeepsNewest(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var last string
+	for i := 0; i < maxCrashDumps+3; i++ {
+		d := &CrashDump{Time: start.Add(time.Duration(i) * time.Second), Panic: "boom"}
+		path, err := writeCrashDump(dir, d, uint64(i+1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		last = path
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != maxCrashDumps || entries[0].Name() != "crash-20240101-000003.000-4.json" {
+		t.Errorf("%d dumps left, oldest %s", len(entries), entries[0].Name())
+	}
+	if _, err := os.Stat(last); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGoSafeRecovers(t *testing.T) {
+	useCrashDir(t)
+	events := &eventRecorder{}
+	savedOutput := output
+	output = NewOutput(events)
+	t.Cleanup(func() { output = savedOutput })
+
+	goSafe("webhook test", func() { panic("queue bug") })
+	if fatal := events.wait(t, "fatal_error", 1); fatal["goroutine"] != "webhook test" || fatal["panic"] != "queue bug" {
+		t.Errorf("fatal_error %v", fatal)
+	}
+}
+
+func TestCallSafeReturnsPanicAsError(t *testing.T) {
+	useCrashDir(t)
+	events := &eventRecorder{}
+	savedOutput := output
+	output = NewOutput(events)
+	t.Cleanup(func() { output = savedOutput })
+
+	err := callSafe("stream test", func() error { panic("chunk bug") })
+	if err == nil || !strings.Contains(err.Error(), "chunk bug") {
+		t.Errorf("got %v", err)
+	}
+	if fatal := events.wait(t, "fatal_error", 1); fatal["goroutine"] != "stream test" {
+		t.Errorf("fatal_error %v", fatal)
+	}
+	if err := callSafe("stream test", func() error { return io.EOF }); err != io.EOF {
+		t.Errorf("plain error became %v", err)
+	}
+}
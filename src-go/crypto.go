@@ -0,0 +1,684 @@
+package main
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Encrypted sessions run a handshake directly after connecting: both sides
+// send a hello carrying their static and an ephemeral X25519 key, derive
+// directional ChaCha20-Poly1305 keys from three DH results (ee, es, se) and
+// then exchange an encrypted confirmation record. Only the holder of a
+// static private key can complete it, so a pinned public key authenticates
+// the peer. Afterwards every write becomes a length-prefixed sealed record,
+// and the keys are replaced now and then as described in rekey.go. Version
+// 02 of the hello added rekeying and 03 offers the clock exchange of
+// clock.go, which runs only when both hellos are 03; a peer still on 02
+// gets a session without it. Older peers cannot complete the handshake.
+const (
+	secureMagic        = "LUMSEC03"
+	secureMagicNoClock = "LUMSEC02"
+	secureConfirm      = "LUMSEC-OK"
+	secureMaxRecord    = 16 << 10
+	secureHandshakeTTL = 10 * time.Second
+)
+
+var errPeerKeyMismatch = errors.New("peer key does not match the pinned key")
+
+// KeyStore holds the local identity and pinned peer public keys
+type KeyStore struct {
+	mu     sync.Mutex
+	local  *ecdh.PrivateKey
+	path   string            // where the identity is kept across restarts
+	pinned map[string][]byte // name -> X25519 public key
+}
+
+var keys = KeyStore{pinned: make(map[string][]byte)}
+
+// LoadIdentity reads the identity saved at path. Without one, a new key
+// is generated and saved there, so the node keeps its ID from then on.
+func (ks *KeyStore) LoadIdentity(path string) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.path = path
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		key, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return err
+		}
+		ks.local = key
+		return ks.saveLocked()
+	}
+	if err != nil {
+		return err
+	}
+	key, err := parsePrivateKey(string(bytes.TrimSpace(data)))
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	ks.local = key
+	return nil
+}
+
+func (ks *KeyStore) saveLocked() error {
+	if ks.path == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(ks.path), 0o755); err != nil {
+		return err
+	}
+	encoded := base64.StdEncoding.EncodeToString(ks.local.Bytes())
+	if err := os.WriteFile(ks.path+".tmp", []byte(encoded+"\n"), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(ks.path+".tmp", ks.path)
+}
+
+// Identity returns the local static key, generating one on first use
+func (ks *KeyStore) Identity() (*ecdh.PrivateKey, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if ks.local == nil {
+		key, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		ks.local = key
+	}
+	return ks.local, nil
+}
+
+// SetIdentity replaces the local key and saves it as the node's identity
+func (ks *KeyStore) SetIdentity(key *ecdh.PrivateKey) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.local = key
+	return ks.saveLocked()
+}
+
+func parsePrivateKey(encoded string) (*ecdh.PrivateKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, catalogError(ErrInvalidArgument, "crypto.private_key_must_base64")
+	}
+	key, err := ecdh.X25519().NewPrivateKey(raw)
+	if err != nil {
+		return nil, catalogError(ErrInvalidArgument, "crypto.invalid_private_key", "error", err)
+	}
+	return key, nil
+}
+
+// PinnedName returns the name a public key was pinned under, if any.
+// Peers trusted in the trust store count as pinned.
+func (ks *KeyStore) PinnedName(pub []byte) (string, bool) {
+	ks.mu.Lock()
+	for name, key := range ks.pinned {
+		if bytes.Equal(key, pub) {
+			ks.mu.Unlock()
+			return name, true
+		}
+	}
+	ks.mu.Unlock()
+	return trust.trustedName(pub)
+}
+
+// resolvePeerKey turns a pinned name, a known peer or a base64 public key
+// into key bytes
+func (ks *KeyStore) resolvePeerKey(ref string) ([]byte, error) {
+	ks.mu.Lock()
+	key, ok := ks.pinned[ref]
+	ks.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+	trust.mu.Lock()
+	known := trust.lookupLocked(ref)
+	trust.mu.Unlock()
+	if known != nil {
+		return decodePublicKey(known.PublicKey)
+	}
+	return decodePublicKey(ref)
+}
+
+func decodePublicKey(s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(key) != 32 {
+		return nil, catalogError(ErrInvalidArgument, "crypto.public_key_must_32")
+	}
+	return key, nil
+}
+
+// Fingerprint is a short, human-comparable digest of a public key
+func Fingerprint(pub []byte) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:16])
+}
+
+// SecureInfo describes the peer of an encrypted session
+type SecureInfo struct {
+	PeerKey     string `json:"peer_key"`
+	Fingerprint string `json:"fingerprint"`
+	PinnedAs    string `json:"pinned_as,omitempty"`
+}
+
+// secureConn encrypts everything written to and decrypts everything read
+// from the wrapped connection
+type secureConn struct {
+	net.Conn
+
+	readMu   sync.Mutex
+	open     cipher.AEAD
+	readSeq  uint64
+	pending  []byte
+	writeMu  sync.Mutex
+	seal     cipher.AEAD
+	writeSeq uint64
+
+	peer      []byte
+	initiator bool // dialed the connection; wins rekeys started at once
+	rekey     rekeyState
+	clock     clockSample // the peer's clock, measured in the handshake
+}
+
+func secureNonce(seq uint64) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint64(nonce[4:], seq)
+	return nonce
+}
+
+func (s *secureConn) Read(b []byte) (int, error) {
+	s.readMu.Lock()
+	defer s.readMu.Unlock()
+
+	for len(s.pending) == 0 {
+		record, err := s.readRecord()
+		if err != nil {
+			return 0, err
+		}
+		s.pending = record
+	}
+	n := copy(b, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+// readRecord returns the next data record, handling any control records
+// in front of it
+func (s *secureConn) readRecord() ([]byte, error) {
+	for {
+		var header [4]byte
+		if _, err := io.ReadFull(s.Conn, header[:]); err != nil {
+			return nil, err
+		}
+		size := binary.BigEndian.Uint32(header[:])
+		control := size&secureControl != 0
+		size &^= secureControl
+		if size > secureMaxRecord+chacha20poly1305.Overhead {
+			return nil, errors.New("encrypted record too large")
+		}
+
+		sealed := make([]byte, size)
+		if _, err := io.ReadFull(s.Conn, sealed); err != nil {
+			return nil, err
+		}
+		plain, err := s.open.Open(sealed[:0], secureNonce(s.readSeq), sealed, nil)
+		if err != nil {
+			return nil, errors.New("encrypted record failed authentication")
+		}
+		s.readSeq++
+		if !control {
+			return plain, nil
+		}
+		if err := s.handleControl(plain); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (s *secureConn) Write(b []byte) (int, error) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	written := 0
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > secureMaxRecord {
+			chunk = chunk[:secureMaxRecord]
+		}
+		if err := s.applySwitchLocked(); err != nil {
+			return written, err
+		}
+		if s.rekeyDueLocked() {
+			if err := s.startRekeyLocked(); err != nil {
+				return written, err
+			}
+		}
+		if err := s.writeRecord(chunk); err != nil {
+			return written, err
+		}
+		s.rekey.sent.Add(uint64(len(chunk)))
+		written += len(chunk)
+		b = b[len(chunk):]
+	}
+	return written, nil
+}
+
+func (s *secureConn) writeRecord(plain []byte) error {
+	return s.writeFrame(plain, false)
+}
+
+// writeFrame seals one record; control records carry rekey messages
+func (s *secureConn) writeFrame(plain []byte, control bool) error {
+	record := make([]byte, 4, 4+len(plain)+chacha20poly1305.Overhead)
+	record = s.seal.Seal(record, secureNonce(s.writeSeq), plain, nil)
+	size := uint32(len(record) - 4)
+	if control {
+		size |= secureControl
+	}
+	binary.BigEndian.PutUint32(record[:4], size)
+	s.writeSeq++
+	_, err := s.Conn.Write(record)
+	return err
+}
+
+// secureHandshake upgrades conn to an encrypted session. The dialing side
+// must pass initiator=true so both ends agree on key directions.
+func secureHandshake(conn net.Conn, initiator bool) (*secureConn, error) {
+	return secureHandshakeWith(conn, initiator, secureMagic)
+}
+
+// secureHandshakeWith is secureHandshake offering the hello version magic
+func secureHandshakeWith(conn net.Conn, initiator bool, magic string) (*secureConn, error) {
+	static, err := keys.Identity()
+	if err != nil {
+		return nil, err
+	}
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(secureHandshakeTTL))
+	defer conn.SetDeadline(time.Time{})
+
+	hello := make([]byte, 0, len(magic)+64)
+	hello = append(hello, magic...)
+	hello = append(hello, static.PublicKey().Bytes()...)
+	hello = append(hello, ephemeral.PublicKey().Bytes()...)
+
+	// Both sides speak first; the hello is small enough not to deadlock
+	writeErr := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(hello)
+		writeErr <- err
+	}()
+
+	remote := make([]byte, len(hello))
+	if _, err := io.ReadFull(conn, remote); err != nil {
+		return nil, fmt.Errorf("handshake failed: %w", err)
+	}
+	if err := <-writeErr; err != nil {
+		return nil, fmt.Errorf("handshake failed: %w", err)
+	}
+	// Both hellos are in the transcript, so a version changed on the way
+	// fails the key confirmation
+	var clock bool
+	switch string(remote[:len(secureMagic)]) {
+	case secureMagic:
+		clock = magic == secureMagic
+	case secureMagicNoClock:
+	default:
+		return nil, errors.New("handshake failed: peer does not speak the encrypted protocol")
+	}
+
+	remoteStatic, err := ecdh.X25519().NewPublicKey(remote[len(secureMagic) : len(secureMagic)+32])
+	if err != nil {
+		return nil, err
+	}
+	remoteEphemeral, err := ecdh.X25519().NewPublicKey(remote[len(secureMagic)+32:])
+	if err != nil {
+		return nil, err
+	}
+
+	ee, err := ephemeral.ECDH(remoteEphemeral)
+	if err != nil {
+		return nil, err
+	}
+	// "es" is the initiator's ephemeral with the responder's static key and
+	// "se" the other way round; each side computes them from its own half
+	var es, se []byte
+	if initiator {
+		es, err = ephemeral.ECDH(remoteStatic)
+		if err == nil {
+			se, err = static.ECDH(remoteEphemeral)
+		}
+	} else {
+		es, err = static.ECDH(remoteEphemeral)
+		if err == nil {
+			se, err = ephemeral.ECDH(remoteStatic)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	first, second := hello, remote
+	if !initiator {
+		first, second = remote, hello
+	}
+	transcript := sha256.Sum256(append(append([]byte{}, first...), second...))
+
+	ikm := append(append(append([]byte{}, ee...), es...), se...)
+	// The third key is the root later rekeys start from
+	material, err := hkdf.Key(sha256.New, ikm, transcript[:], "lumina-net session keys", 3*chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, err
+	}
+	i2r, err := chacha20poly1305.New(material[:chacha20poly1305.KeySize])
+	if err != nil {
+		return nil, err
+	}
+	r2i, err := chacha20poly1305.New(material[chacha20poly1305.KeySize : 2*chacha20poly1305.KeySize])
+	if err != nil {
+		return nil, err
+	}
+
+	s := &secureConn{Conn: conn, peer: remoteStatic.Bytes(), initiator: initiator}
+	s.rekey.init(material[2*chacha20poly1305.KeySize:])
+	if initiator {
+		s.seal, s.open = i2r, r2i
+	} else {
+		s.seal, s.open = r2i, i2r
+	}
+
+	// Key confirmation proves the peer owns the static key it presented,
+	// and its timestamp starts the clock exchange
+	sent := time.Now()
+	mine, size := []byte(secureConfirm), len(secureConfirm)
+	if clock {
+		mine, size = appendClock(mine, sent), size+8
+	}
+	go func() { writeErr <- s.writeRecord(mine) }()
+	confirm, err := s.readRecord()
+	received := time.Now()
+	if err != nil || len(confirm) != size || string(confirm[:len(secureConfirm)]) != secureConfirm {
+		return nil, errors.New("handshake failed: key confirmation mismatch")
+	}
+	if err := <-writeErr; err != nil {
+		return nil, fmt.Errorf("handshake failed: %w", err)
+	}
+	if clock {
+		if err := s.exchangeClock(sent, confirm[len(secureConfirm):], received); err != nil {
+			return nil, fmt.Errorf("handshake failed: %w", err)
+		}
+		warnClockSkew(s)
+	}
+	return s, nil
+}
+
+// secureClient runs the initiator handshake and, when peerKey is set,
+// insists that the remote presents that key
+func secureClient(conn net.Conn, peerKey string) (*secureConn, error) {
+	var expected []byte
+	if peerKey != "" {
+		key, err := keys.resolvePeerKey(peerKey)
+		if err != nil {
+			return nil, err
+		}
+		expected = key
+	}
+
+	s, err := secureHandshake(conn, true)
+	if err != nil {
+		return nil, err
+	}
+	if expected != nil && !bytes.Equal(expected, s.peer) {
+		return nil, errPeerKeyMismatch
+	}
+	return s, nil
+}
+
+// secureInbound upgrades an accepted connection on an encrypted listener.
+// Unless the listener allows it, peers must present a pinned key. A
+// transfer peer on a trusted subnet may skip encryption where unpinned
+// peers are allowed, see plaintext.go.
+func secureInbound(c *Connection, l *Listener) error {
+	conn := c.Conn()
+	if l.Type == "transfer" {
+		if subnet := config.Get().Encryption.trustedSubnet(conn.LocalAddr(), conn.RemoteAddr()); subnet != "" {
+			replay, plaintext, err := acceptPlaintext(c, l, subnet)
+			if err != nil || plaintext {
+				return err
+			}
+			conn = replay
+		}
+	}
+	s, err := secureHandshake(conn, false)
+	if err != nil {
+		return err
+	}
+	// The hello used up whatever was read ahead
+	s.Conn = c.Conn()
+
+	host, _, _ := net.SplitHostPort(c.Info().RemoteAddr)
+	if known := trust.observe(s.peer, "", host); known.Trust == trustBlocked {
+		rejectBlocked(l, c.Info().RemoteAddr, known, "handshake")
+		return errors.New("peer is blocked")
+	}
+	info := secureInfo(s.peer)
+	if info.PinnedAs == "" && !l.AllowUnpinned {
+		emitEvent("encryption_rejected", map[string]interface{}{
+			"id":          c.ID,
+			"listener":    l.Addr,
+			"listener_id": l.ID,
+			"peer_key":    info.PeerKey,
+			"fingerprint": info.Fingerprint,
+			"reason":      "peer key is not pinned",
+		})
+		return errors.New("peer key is not pinned")
+	}
+
+	c.setConn(s)
+	c.setSecure(info)
+	return nil
+}
+
+func secureInfo(peer []byte) *SecureInfo {
+	info := &SecureInfo{
+		PeerKey:     base64.StdEncoding.EncodeToString(peer),
+		Fingerprint: Fingerprint(peer),
+	}
+	if name, ok := keys.PinnedName(peer); ok {
+		info.PinnedAs = name
+	}
+	return info
+}
+
+func keypairData(key *ecdh.PrivateKey, includePrivate bool) map[string]interface{} {
+	pub := key.PublicKey().Bytes()
+	data := map[string]interface{}{
+		"id":          Fingerprint(pub), // the node ID peers store us under
+		"public_key":  base64.StdEncoding.EncodeToString(pub),
+		"fingerprint": Fingerprint(pub),
+	}
+	if includePrivate {
+		data["private_key"] = base64.StdEncoding.EncodeToString(key.Bytes())
+	}
+	return data
+}
+
+type GenerateKeypairPayload struct {
+	Path string `json:"path"` // optional file to store the private key in
+}
+
+func handleGenerateKeypair(payload json.RawMessage, writer *Output) {
+	var p GenerateKeypairPayload
+	if len(payload) > 0 && string(payload) != "null" {
+		if err := json.Unmarshal(payload, &p); err != nil {
+			sendInvalidPayload(writer, "generate_keypair")
+			return
+		}
+	}
+
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		sendError(writer, message("crypto.failed_generate_keypair", "error", err))
+		return
+	}
+	if p.Path != "" {
+		encoded := base64.StdEncoding.EncodeToString(key.Bytes())
+		if err := os.WriteFile(p.Path, []byte(encoded+"\n"), 0o600); err != nil {
+			sendError(writer, message("crypto.failed_save_keypair", "error", err))
+			return
+		}
+	}
+	if err := keys.SetIdentity(key); err != nil {
+		sendError(writer, message("crypto.failed_save_identity", "error", err))
+		return
+	}
+	logger.Info("generated new identity keypair", "fingerprint", Fingerprint(key.PublicKey().Bytes()))
+
+	writer.Encode(okResponse(message("crypto.keypair_generated"), keypairData(key, false)))
+}
+
+type ExportKeypairPayload struct {
+	IncludePrivate bool `json:"include_private"`
+}
+
+func handleExportKeypair(payload json.RawMessage, writer *Output) {
+	var p ExportKeypairPayload
+	if len(payload) > 0 && string(payload) != "null" {
+		if err := json.Unmarshal(payload, &p); err != nil {
+			sendInvalidPayload(writer, "export_keypair")
+			return
+		}
+	}
+
+	key, err := keys.Identity()
+	if err != nil {
+		sendError(writer, message("crypto.failed_load_keypair", "error", err))
+		return
+	}
+	writer.Encode(ProtocolResponse{Status: "ok", Data: keypairData(key, p.IncludePrivate)})
+}
+
+type ImportKeypairPayload struct {
+	PrivateKey string `json:"private_key"` // base64
+	Path       string `json:"path"`        // or a file written by generate_keypair
+}
+
+func handleImportKeypair(payload json.RawMessage, writer *Output) {
+	var p ImportKeypairPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		sendInvalidPayload(writer, "import_keypair")
+		return
+	}
+
+	encoded := p.PrivateKey
+	if encoded == "" && p.Path != "" {
+		data, err := os.ReadFile(p.Path)
+		if err != nil {
+			sendError(writer, message("crypto.failed_read_keypair", "error", err))
+			return
+		}
+		encoded = string(bytes.TrimSpace(data))
+	}
+
+	key, err := parsePrivateKey(encoded)
+	if err != nil {
+		sendFailure(writer, err)
+		return
+	}
+	if err := keys.SetIdentity(key); err != nil {
+		sendError(writer, message("crypto.failed_save_identity", "error", err))
+		return
+	}
+
+	writer.Encode(okResponse(message("crypto.keypair_imported"), keypairData(key, false)))
+}
+
+type PinPeerKeyPayload struct {
+	Name      string `json:"name"`
+	PublicKey string `json:"public_key"`
+}
+
+func handlePinPeerKey(payload json.RawMessage, writer *Output) {
+	var p PinPeerKeyPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		sendInvalidPayload(writer, "pin_peer_key")
+		return
+	}
+	if p.Name == "" {
+		sendErrorCode(writer, ErrInvalidArgument, message("crypto.pin_peer_key_requires"), nil)
+		return
+	}
+	key, err := decodePublicKey(p.PublicKey)
+	if err != nil {
+		sendFailure(writer, err)
+		return
+	}
+
+	keys.mu.Lock()
+	keys.pinned[p.Name] = key
+	keys.mu.Unlock()
+
+	writer.Encode(okResponse(message("crypto.pinned_key", "name", p.Name),
+		map[string]interface{}{"name": p.Name, "fingerprint": Fingerprint(key)}))
+}
+
+func handleUnpinPeerKey(payload json.RawMessage, writer *Output) {
+	var p PinPeerKeyPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		sendInvalidPayload(writer, "unpin_peer_key")
+		return
+	}
+
+	keys.mu.Lock()
+	_, exists := keys.pinned[p.Name]
+	delete(keys.pinned, p.Name)
+	keys.mu.Unlock()
+
+	if !exists {
+		sendErrorCode(writer, ErrNotFound, message("crypto.no_key_pinned", "name", p.Name), nil)
+		return
+	}
+	writer.Encode(okResponse(message("crypto.unpinned_key", "name", p.Name), nil))
+}
+
+func handleListPinnedKeys(writer *Output) {
+	keys.mu.Lock()
+	list := make([]map[string]interface{}, 0, len(keys.pinned))
+	for name, key := range keys.pinned {
+		list = append(list, map[string]interface{}{
+			"name":        name,
+			"public_key":  base64.StdEncoding.EncodeToString(key),
+			"fingerprint": Fingerprint(key),
+		})
+	}
+	keys.mu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i]["name"].(string) < list[j]["name"].(string) })
+	writer.Encode(ProtocolResponse{Status: "ok", Data: map[string]interface{}{"pinned": list}})
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+func TestMain(m *testing.M) {
+	output = NewOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// securePair runs both halves of the handshake over an in-memory pipe
+func securePair(t *testing.T) (client, server *secureConn) {
+	t.Helper()
+	a, b := net.Pipe()
+	t.Cleanup(func() { a.Close(); b.Close() })
+
+	type result struct {
+		s   *secureConn
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		s, err := secureHandshake(b, false)
+		done <- result{s, err}
+	}()
+	client, err := secureHandshake(a, true)
+	if err != nil {
+		t.Fatalf("initiator handshake: %v", err)
+	}
+	r := <-done
+	if r.err != nil {
+		t.Fatalf("responder handshake: %v", r.err)
+	}
+	return client, r.s
+}
+
+// sealRecord builds the record s would write next, without sending it
+func sealRecord(s *secureConn, plain []byte) []byte {
+	record := make([]byte, 4, 4+len(plain)+chacha20poly1305.Overhead)
+	record = s.seal.Seal(record, secureNonce(s.writeSeq), plain, nil)
+	binary.BigEndian.PutUint32(record[:4], uint32(len(record)-4))
+	s.writeSeq++
+	return record
+}
+
+// readAsync reads one record on s in the background; net.Pipe writes
+// block until the other side reads
+func readAsync(s *secureConn) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.readRecord()
+		done <- err
+	}()
+	return done
+}
+
+func TestSecureRoundTrip(t *testing.T) {
+	client, server := securePair(t)
+
+	// Larger than one record, so it is split and reassembled
+	sent := make([]byte, 3*secureMaxRecord+123)
+	rand.Read(sent)
+	for _, dir := range []struct {
+		name     string
+		from, to *secureConn
+	}{{"client to server", client, server}, {"server to client", server, client}} {
+		go func() {
+			if _, err := dir.from.Write(sent); err != nil {
+				t.Errorf("%s: write: %v", dir.name, err)
+			}
+		}()
+		got := make([]byte, len(sent))
+		if _, err := io.ReadFull(dir.to, got); err != nil {
+			t.Fatalf("%s: read: %v", dir.name, err)
+		}
+		if !bytes.Equal(got, sent) {
+			t.Fatalf("%s: data corrupted in transit", dir.name)
+		}
+	}
+	if client.writeSeq != server.readSeq || server.writeSeq != client.readSeq {
+		t.Fatalf("sequence counters out of step: client %d/%d, server %d/%d",
+			client.writeSeq, client.readSeq, server.writeSeq, server.readSeq)
+	}
+}
+
+func TestSecureNonceIsPerRecord(t *testing.T) {
+	if bytes.Equal(secureNonce(1), secureNonce(2)) {
+		t.Fatal("different sequence numbers produced the same nonce")
+	}
+	if len(secureNonce(0)) != chacha20poly1305.NonceSize {
+		t.Fatalf("nonce is %d bytes, want %d", len(secureNonce(0)), chacha20poly1305.NonceSize)
+	}
+}
+
+func TestSecureRejectsTamperedRecord(t *testing.T) {
+	client, server := securePair(t)
+
+	record := sealRecord(client, []byte("hello"))
+	record[len(record)-1] ^= 0x01
+	done := readAsync(server)
+	client.Conn.Write(record)
+	if err := <-done; err == nil || !strings.Contains(err.Error(), "authentication") {
+		t.Fatalf("tampered record accepted: %v", err)
+	}
+}
+
+func TestSecureRejectsReplayedRecord(t *testing.T) {
+	client, server := securePair(t)
+
+	record := sealRecord(client, []byte("once"))
+	done := readAsync(server)
+	client.Conn.Write(record)
+	if err := <-done; err != nil {
+		t.Fatalf("first delivery: %v", err)
+	}
+	done = readAsync(server)
+	client.Conn.Write(record)
+	if err := <-done; err == nil {
+		t.Fatal("replayed record accepted")
+	}
+}
+
+func TestSecureKeysAreDirectional(t *testing.T) {
+	client, server := securePair(t)
+
+	// A record reflected back to its author must not open: each direction
+	// has its own key
+	seq := client.writeSeq
+	record := sealRecord(client, []byte("mirror"))
+	if _, err := client.open.Open(nil, secureNonce(seq), record[4:], nil); err == nil {
+		t.Fatal("record opened with the key for the opposite direction")
+	}
+	if _, err := server.open.Open(nil, secureNonce(seq), record[4:], nil); err != nil {
+		t.Fatalf("record did not open for its recipient: %v", err)
+	}
+}
+
+func TestSecureRejectsOversizedRecord(t *testing.T) {
+	client, server := securePair(t)
+
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], secureMaxRecord+chacha20poly1305.Overhead+1)
+	done := readAsync(server)
+	client.Conn.Write(header[:])
+	if err := <-done; err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Fatalf("oversized record accepted: %v", err)
+	}
+}
+
+func TestSecureRejectsPlaintextPeer(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	go func() {
+		b.Write(make([]byte, len(secureMagic)+64))
+		io.Copy(io.Discard, b)
+	}()
+	if _, err := secureHandshake(a, true); err == nil {
+		t.Fatal("handshake succeeded against a peer without the magic")
+	}
+	b.Close()
+}
+
+func TestSecureClientRejectsUnexpectedKey(t *testing.T) {
+	other, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	go secureHandshake(b, false)
+
+	expected := base64.StdEncoding.EncodeToString(other.PublicKey().Bytes())
+	if _, err := secureClient(a, expected); err != errPeerKeyMismatch {
+		t.Fatalf("got %v, want %v", err, errPeerKeyMismatch)
+	}
+}
+
+// inboundPair connects over loopback and runs secureInbound on the accepted
+// side, as an encrypted listener would
+func inboundPair(t *testing.T, l *Listener) (*Connection, error) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	dialed := make(chan net.Conn, 1)
+	go func() {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			dialed <- nil
+			return
+		}
+		secureClient(conn, "")
+		dialed <- conn
+	}()
+	accepted, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Connection{ID: "test", Direction: "inbound", Network: "tcp", Created: time.Now(), Limiter: newRateLimiter(0)}
+	c.setConn(accepted)
+	err = secureInbound(c, l)
+	if conn := <-dialed; conn != nil {
+		conn.Close()
+	}
+	accepted.Close()
+	return c, err
+}
+
+func TestSecureInboundRequiresPinnedKey(t *testing.T) {
+	l := &Listener{Addr: "127.0.0.1:0", Encrypted: true}
+	if _, err := inboundPair(t, l); err == nil || !strings.Contains(err.Error(), "not pinned") {
+		t.Fatalf("unpinned peer accepted: %v", err)
+	}
+
+	l.AllowUnpinned = true
+	c, err := inboundPair(t, l)
+	if err != nil {
+		t.Fatalf("unpinned peer refused with allow_unpinned: %v", err)
+	}
+	if info := c.Info(); !info.Encrypted || info.Secure.PinnedAs != "" {
+		t.Fatalf("unexpected session info: %+v", info.Secure)
+	}
+
+	// Both ends share this process's identity, so pinning it pins the peer
+	local, err := keys.Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys.mu.Lock()
+	keys.pinned["self"] = local.PublicKey().Bytes()
+	keys.mu.Unlock()
+	defer func() {
+		keys.mu.Lock()
+		delete(keys.pinned, "self")
+		keys.mu.Unlock()
+	}()
+
+	l.AllowUnpinned = false
+	c, err = inboundPair(t, l)
+	if err != nil {
+		t.Fatalf("pinned peer refused: %v", err)
+	}
+	if got := c.Info().Secure.PinnedAs; got != "self" {
+		t.Fatalf("pinned_as = %q, want %q", got, "self")
+	}
+}
+
+func TestSecureRekeysAfterBytes(t *testing.T) {
+	client, server := securePair(t)
+	client.rekey.policy.Bytes = 64 << 10
+
+	// The client must read to see the answers to its rekeys
+	go io.Copy(io.Discard, client)
+	sent := make([]byte, 1<<20)
+	rand.Read(sent)
+	go client.Write(sent)
+	got := make([]byte, len(sent))
+	if _, err := io.ReadFull(server, got); err != nil {
+		t.Fatalf("read across rekeys: %v", err)
+	}
+	if !bytes.Equal(got, sent) {
+		t.Fatal("data corrupted across rekeys")
+	}
+	if n := server.Session().Rekeys; n == 0 {
+		t.Fatal("1 MiB at a 64 KiB rekey interval did not rekey")
+	}
+}
+
+func TestSecureRekeyCollision(t *testing.T) {
+	client, server := securePair(t)
+
+	// Both start before either reads the other's start; the dialer's
+	// rekey must win and both must end up on the same keys
+	go client.Rekey()
+	go server.Rekey()
+	deadline := time.Now().Add(2 * time.Second)
+	for !client.Session().Rekeying || !server.Session().Rekeying {
+		if time.Now().After(deadline) {
+			t.Fatal("rekeys did not start")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	reads := make(chan string, 2)
+	for _, s := range []*secureConn{client, server} {
+		go func() {
+			buf := make([]byte, 4)
+			io.ReadFull(s, buf)
+			reads <- string(buf)
+		}()
+	}
+	for client.Session().Rekeying || server.Session().Rekeying {
+		if time.Now().After(deadline) {
+			t.Fatalf("rekey did not settle: client %+v, server %+v", client.Session(), server.Session())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	go client.Write([]byte("ping"))
+	go server.Write([]byte("pong"))
+	got := map[string]bool{<-reads: true, <-reads: true}
+	if !got["ping"] || !got["pong"] {
+		t.Fatalf("after the rekey read %v", got)
+	}
+	if client.Session().Rekeys != 1 || server.Session().Rekeys != 1 {
+		t.Errorf("rekeys: client %d, server %d, want 1 each", client.Session().Rekeys, server.Session().Rekeys)
+	}
+}
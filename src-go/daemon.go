@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Daemon mode keeps the service running once the frontend that started it
+// goes away, so listeners and transfers carry on while the app is closed.
+// Started with -daemon, or switched to with detach, the service stays up
+// when stdin closes and serves the control socket instead, where a new
+// frontend instance connects and sends attach. Every event carries a
+// sequence number and the last defaultEventBuffer of them are kept, so
+// attach can replay what the frontend missed while it was away. The
+// daemon writes its pid and socket to lumina-daemon.json next to the
+// config for a frontend to find it.
+const defaultEventBuffer = 1000
+
+// EventLog numbers events and keeps the most recent ones for attach
+type EventLog struct {
+	mu     sync.Mutex
+	events []ProtocolEvent // ring, oldest at next once full
+	next   int
+	seq    uint64
+}
+
+var eventLog = EventLog{events: make([]ProtocolEvent, 0, defaultEventBuffer)}
+
+// record numbers ev and keeps it
+func (l *EventLog) record(ev *ProtocolEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.seq++
+	ev.Seq = l.seq
+	if len(l.events) < cap(l.events) {
+		l.events = append(l.events, *ev)
+		return
+	}
+	l.events[l.next] = *ev
+	l.next = (l.next + 1) % len(l.events)
+}
+
+// since returns the kept events after seq, oldest first, and whether they
+// are all of them or some had already been dropped
+func (l *EventLog) since(seq uint64) (events []ProtocolEvent, complete bool, last uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ordered := append(append([]ProtocolEvent(nil), l.events[l.next:]...), l.events[:l.next]...)
+	complete = seq >= l.seq || len(ordered) == 0 || ordered[0].Seq <= seq+1
+	for _, ev := range ordered {
+		if ev.Seq > seq {
+			events = append(events, ev)
+		}
+	}
+	return events, complete, l.seq
+}
+
+func (l *EventLog) last() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.seq
+}
+
+// DaemonState is whether the service outlives stdin and where a frontend
+// finds it
+type DaemonState struct {
+	mu       sync.Mutex
+	enabled  bool
+	infoPath string
+	started  time.Time
+}
+
+var daemon DaemonState
+
+// DaemonInfo is what lumina-daemon.json holds
+type DaemonInfo struct {
+	PID           int       `json:"pid"`
+	ControlSocket string    `json:"control_socket"`
+	Version       string    `json:"version"`
+	StartedAt     time.Time `json:"started_at"`
+}
+
+func daemonInfoPath(configPath string) string {
+	return filepath.Join(filepath.Dir(configPath), "lumina-daemon.json")
+}
+
+// enableDaemon makes the service outlive stdin, starting the control
+// socket at its default path if it is not already listening
+func enableDaemon() (string, error) {
+	control.mu.Lock()
+	if control.ln == nil {
+		if err := startControlLocked(defaultControlPath()); err != nil {
+			control.mu.Unlock()
+			return "", err
+		}
+	}
+	path := control.path
+	control.mu.Unlock()
+
+	daemon.mu.Lock()
+	defer daemon.mu.Unlock()
+	if !daemon.enabled {
+		// A closed terminal or parent must not take the daemon down with it
+		signal.Ignore(syscall.SIGHUP, syscall.SIGPIPE)
+		daemon.enabled, daemon.started = true, time.Now()
+		daemon.infoPath = daemonInfoPath(config.Path())
+		logger.Info("daemon mode enabled", "control_socket", path)
+	}
+	info := DaemonInfo{PID: os.Getpid(), ControlSocket: path, Version: version, StartedAt: daemon.started}
+	data, _ := json.MarshalIndent(info, "", "  ")
+	if err := os.WriteFile(daemon.infoPath+".tmp", append(data, '\n'), 0o600); err != nil {
+		return path, err
+	}
+	return path, os.Rename(daemon.infoPath+".tmp", daemon.infoPath)
+}
+
+func daemonEnabled() bool {
+	daemon.mu.Lock()
+	defer daemon.mu.Unlock()
+	return daemon.enabled
+}
+
+// removeDaemonInfo runs on shutdown so nobody tries to attach to a
+// process that is gone
+func removeDaemonInfo() {
+	daemon.mu.Lock()
+	defer daemon.mu.Unlock()
+	if daemon.infoPath != "" {
+		os.Remove(daemon.infoPath)
+	}
+}
+
+type AttachPayload struct {
+	SinceSeq uint64 `json:"since_seq"` // last event seen; 0 replays everything kept
+}
+
+// handleAttach replays the kept events after since_seq on the channel
+// the request came in on; live events keep arriving there as usual, so
+// the frontend drops any seq it has already seen
+func handleAttach(payload json.RawMessage, writer *Output) {
+	var p AttachPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		sendInvalidPayload(writer, "attach")
+		return
+	}
+	events, complete, last := eventLog.since(p.SinceSeq)
+	for _, ev := range events {
+		writer.channel().Encode(ev)
+	}
+	daemon.mu.Lock()
+	started := daemon.started
+	daemon.mu.Unlock()
+	writer.Encode(okResponse(message("daemon.replayed_events", "events", len(events)), map[string]interface{}{
+		"replayed":     len(events),
+		"complete":     complete, // false when events after since_seq were already dropped
+		"last_seq":     last,
+		"pid":          os.Getpid(),
+		"daemon":       daemonEnabled(),
+		"daemon_since": started,
+	}))
+}
+
+// handleDetach lets the frontend go without stopping the service: it
+// switches to daemon mode and stops writing to the channel the request
+// came in on
+func handleDetach(writer *Output) {
+	path, err := enableDaemon()
+	if err != nil {
+		sendError(writer, message("daemon.failed_detach", "error", err))
+		return
+	}
+	last := eventLog.last()
+	writer.Encode(okResponse(message("daemon.detached_attach_through", "path", path),
+		map[string]interface{}{"control_socket": path, "last_seq": last, "pid": os.Getpid()}))
+	channel := writer.channel()
+	if channel == output {
+		output.Close()
+		return
+	}
+	control.mu.Lock()
+	c, ok := control.clients[channel]
+	control.mu.Unlock()
+	if ok {
+		channel.Close()
+		c.closer.Close()
+	}
+}
+
+// waitAsDaemon keeps the process up after stdin closed, until a shutdown
+// request or signal ends it
+func waitAsDaemon() {
+	output.Close()
+	logger.Info("stdin closed, daemon keeps running")
+	select {}
+}
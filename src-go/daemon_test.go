@@ -0,0 +1,21 @@
+package main
+
+import "testing"
+
+func TestEventLogReplay(t *testing.T) {
+	l := EventLog{events: make([]ProtocolEvent, 0, 4)}
+	for i := 0; i < 6; i++ {
+		l.record(&ProtocolEvent{Event: "tick"})
+	}
+	events, complete, last := l.since(3)
+	if len(events) != 3 || events[0].Seq != 4 || events[2].Seq != 6 || !complete || last != 6 {
+		t.Errorf("since 3: %d events from %d, complete %v, last %d", len(events), events[0].Seq, complete, last)
+	}
+	// Seq 2 fell out of the ring, so replaying after 1 has a gap
+	if events, complete, _ := l.since(1); len(events) != 4 || events[0].Seq != 3 || complete {
+		t.Errorf("since 1: %d events, complete %v", len(events), complete)
+	}
+	if events, complete, _ := l.since(6); len(events) != 0 || !complete {
+		t.Errorf("since 6: %d events, complete %v", len(events), complete)
+	}
+}
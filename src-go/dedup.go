@@ -0,0 +1,616 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Deduplicated sends split the file into content-defined chunks, so an
+// edit only changes the chunks around it, and send the list of chunk
+// hashes first. The receiver looks each one up in its chunk index, which
+// covers the files it received this way plus whatever already sits at the
+// incoming name, and asks only for the chunks it cannot find. It builds
+// the new file from its own copies and the chunks that came over the wire
+// and checks the whole-file hash as usual. Deduplicated bodies are not
+// pausable or resumable. The chunks a receiver asks for tell the sender
+// which ones it holds, in any file it indexed, so it only deduplicates for
+// peers it pinned; anyone else has the file sent whole.
+const (
+	cdcMinChunk = 16 << 10
+	cdcMaxChunk = 256 << 10
+	cdcAvgBits  = 16 // chunks average 64 KiB past the minimum
+
+	dedupMaxFiles    = 256             // indexed files kept, least recently used go first
+	dedupPlanTimeout = 5 * time.Minute // how long a sender waits while the receiver checks its copies
+)
+
+// cdcGear maps each byte to a pseudo-random value for the rolling hash.
+// Both ends must cut at the same places, so it derives from a fixed seed.
+var cdcGear = func() (gear [256]uint64) {
+	for i := range gear {
+		sum := sha256.Sum256([]byte{'c', 'd', 'c', byte(i)})
+		gear[i] = binary.BigEndian.Uint64(sum[:])
+	}
+	return gear
+}()
+
+// cdcCut returns the length of the chunk starting at b, which holds at
+// least cdcMaxChunk bytes unless it is the rest of the input
+func cdcCut(b []byte) int {
+	if len(b) <= cdcMinChunk {
+		return len(b)
+	}
+	n := min(len(b), cdcMaxChunk)
+	var h uint64
+	for i := cdcMinChunk; i < n; i++ {
+		// The top bits depend on the last 64 bytes only, so boundaries
+		// come back in step right after an edit
+		h = h<<1 + cdcGear[b[i]]
+		if h>>(64-cdcAvgBits) == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+type cdcChunk struct {
+	Offset int64
+	Size   int64
+	Hash   [32]byte
+}
+
+// chunkStream splits r into content-defined chunks, handing each and its
+// bytes to fn in order
+func chunkStream(r io.Reader, fn func(c cdcChunk, data []byte) error) error {
+	buf := make([]byte, 4*cdcMaxChunk)
+	start, end, eof := 0, 0, false
+	var off int64
+	for {
+		for !eof && end-start < cdcMaxChunk {
+			if start > 0 {
+				end = copy(buf, buf[start:end])
+				start = 0
+			}
+			n, err := r.Read(buf[end:])
+			end += n
+			if err == io.EOF {
+				eof = true
+			} else if err != nil {
+				return err
+			}
+		}
+		if start == end {
+			return nil
+		}
+		n := cdcCut(buf[start:end])
+		data := buf[start : start+n]
+		if err := fn(cdcChunk{Offset: off, Size: int64(n), Hash: sha256.Sum256(data)}, data); err != nil {
+			return err
+		}
+		start += n
+		off += int64(n)
+	}
+}
+
+// dedupRecipe is the line a deduplicating sender writes once the receiver
+// agreed: the file's chunks in order
+type dedupRecipe struct {
+	Hashes []string `json:"hashes"` // hex SHA-256 of each chunk
+	Sizes  []int64  `json:"sizes"`
+}
+
+// indexedFile is one file in the chunk index
+type indexedFile struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	Used    time.Time `json:"used"`
+	Hashes  []string  `json:"hashes"`
+	Sizes   []int64   `json:"sizes"`
+}
+
+type chunkLocation struct {
+	file   *indexedFile
+	offset int64
+	size   int64
+}
+
+// ChunkIndex finds local copies of chunks by hash. It is saved next to
+// the config so it outlives restarts.
+type ChunkIndex struct {
+	mu     sync.Mutex
+	path   string
+	files  map[string]*indexedFile
+	byHash map[[32]byte]chunkLocation
+
+	reused  atomic.Int64 // bytes received sends took from local copies
+	skipped atomic.Int64 // bytes our sends left out because the receiver had them
+}
+
+var chunkIndex = ChunkIndex{files: make(map[string]*indexedFile), byHash: make(map[[32]byte]chunkLocation)}
+
+func chunkIndexPath(configPath string) string {
+	return filepath.Join(filepath.Dir(configPath), "lumina-chunks.json")
+}
+
+// Load reads path into the index; a missing file is an empty index
+func (x *ChunkIndex) Load(path string) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.path = path
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var files []*indexedFile
+	if err := json.Unmarshal(data, &files); err != nil {
+		return fmt.Errorf("parse %s: %w", path, err)
+	}
+	for _, f := range files {
+		if len(f.Hashes) == len(f.Sizes) {
+			x.putLocked(f)
+		}
+	}
+	return nil
+}
+
+func (x *ChunkIndex) saveLocked() error {
+	if x.path == "" {
+		return nil
+	}
+	files := make([]*indexedFile, 0, len(x.files))
+	for _, f := range x.files {
+		files = append(files, f)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Used.Before(files[j].Used) })
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(files); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(x.path), 0o755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(x.path+".tmp", buf.Bytes(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(x.path+".tmp", x.path)
+}
+
+// putLocked indexes f in place of any earlier entry for its path
+func (x *ChunkIndex) putLocked(f *indexedFile) {
+	x.dropLocked(f.Path)
+	x.files[f.Path] = f
+	var off int64
+	for i, s := range f.Hashes {
+		var h [32]byte
+		if raw, err := hex.DecodeString(s); err == nil && len(raw) == len(h) {
+			copy(h[:], raw)
+			if _, exists := x.byHash[h]; !exists {
+				x.byHash[h] = chunkLocation{file: f, offset: off, size: f.Sizes[i]}
+			}
+		}
+		off += f.Sizes[i]
+	}
+	for len(x.files) > dedupMaxFiles {
+		oldest := f
+		for _, other := range x.files {
+			if other.Used.Before(oldest.Used) {
+				oldest = other
+			}
+		}
+		x.dropLocked(oldest.Path)
+	}
+}
+
+func (x *ChunkIndex) dropLocked(path string) {
+	f, ok := x.files[path]
+	if !ok {
+		return
+	}
+	delete(x.files, path)
+	for h, loc := range x.byHash {
+		if loc.file == f {
+			delete(x.byHash, h)
+		}
+	}
+}
+
+// add indexes the file at path from chunks already known to make it up
+func (x *ChunkIndex) add(path string, recipe dedupRecipe) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	f := &indexedFile{Path: path, Size: info.Size(), ModTime: info.ModTime(), Used: time.Now(), Hashes: recipe.Hashes, Sizes: recipe.Sizes}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.putLocked(f)
+	if err := x.saveLocked(); err != nil {
+		logger.Warn("failed to save chunk index", "path", x.path, "error", err)
+	}
+}
+
+// ensure indexes the regular file at path unless the index already
+// holds it as it is now
+func (x *ChunkIndex) ensure(path string) {
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() || info.Size() == 0 {
+		return
+	}
+	x.mu.Lock()
+	f, ok := x.files[path]
+	current := ok && f.Size == info.Size() && f.ModTime.Equal(info.ModTime())
+	x.mu.Unlock()
+	if current {
+		return
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	var recipe dedupRecipe
+	err = chunkStream(file, func(c cdcChunk, _ []byte) error {
+		recipe.Hashes = append(recipe.Hashes, hex.EncodeToString(c.Hash[:]))
+		recipe.Sizes = append(recipe.Sizes, c.Size)
+		return nil
+	})
+	if err != nil {
+		logger.Warn("failed to index file for dedup", "path", path, "error", err)
+		return
+	}
+	x.add(path, recipe)
+}
+
+// lookup finds a local copy of the chunk with hash h
+func (x *ChunkIndex) lookup(h [32]byte) (chunkLocation, bool) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	loc, ok := x.byHash[h]
+	if ok {
+		loc.file.Used = time.Now()
+	}
+	return loc, ok
+}
+
+// forget drops a file whose content no longer matches its entry
+func (x *ChunkIndex) forget(path string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.dropLocked(path)
+	if err := x.saveLocked(); err != nil {
+		logger.Warn("failed to save chunk index", "path", x.path, "error", err)
+	}
+}
+
+// read loads a located chunk into buf and checks it still has hash h
+func (loc chunkLocation) read(buf []byte, h [32]byte) bool {
+	f, err := os.Open(loc.file.Path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	if _, err := f.ReadAt(buf[:loc.size], loc.offset); err != nil {
+		return false
+	}
+	return sha256.Sum256(buf[:loc.size]) == h
+}
+
+// IndexedFileInfo is one file in dedup_cache_status
+type IndexedFileInfo struct {
+	Path   string    `json:"path"`
+	Size   int64     `json:"size"`
+	Chunks int       `json:"chunks"`
+	Used   time.Time `json:"used"`
+}
+
+func (x *ChunkIndex) status() map[string]interface{} {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	files := make([]IndexedFileInfo, 0, len(x.files))
+	var size int64
+	for _, f := range x.files {
+		files = append(files, IndexedFileInfo{Path: f.Path, Size: f.Size, Chunks: len(f.Hashes), Used: f.Used})
+		size += f.Size
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Used.After(files[j].Used) })
+	return map[string]interface{}{
+		"path":          x.path,
+		"files":         files,
+		"chunks":        len(x.byHash),
+		"bytes":         size,
+		"reused_bytes":  x.reused.Load(),
+		"skipped_bytes": x.skipped.Load(),
+	}
+}
+
+func (x *ChunkIndex) clear() error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.files = make(map[string]*indexedFile)
+	x.byHash = make(map[[32]byte]chunkLocation)
+	if x.path == "" {
+		return nil
+	}
+	if err := os.Remove(x.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// readLineLimit reads a line of at most max bytes
+func readLineLimit(r *bufio.Reader, max int) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > max {
+			return nil, errors.New("line too long")
+		}
+		if err != bufio.ErrBufferFull {
+			return line, err
+		}
+	}
+}
+
+// sendDeduped sends t's body as a recipe and the chunks the receiver
+// asks for, once the receiver agreed to deduplicate
+func sendDeduped(t *Transfer, f *os.File, c *Connection, reader *bufio.Reader, opts CompressionOptions, timeout time.Duration) error {
+	var recipe dedupRecipe
+	h := sha256.New()
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	err := chunkStream(f, func(ch cdcChunk, data []byte) error {
+		h.Write(data)
+		recipe.Hashes = append(recipe.Hashes, hex.EncodeToString(ch.Hash[:]))
+		recipe.Sizes = append(recipe.Sizes, ch.Size)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	line, _ := json.Marshal(recipe)
+	if _, err := c.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	ack, err := readAck(reader, c, max(timeout, dedupPlanTimeout))
+	if err != nil {
+		return err
+	}
+	need, err := base64.StdEncoding.DecodeString(ack.Need)
+	if err != nil || len(need) != (len(recipe.Sizes)+7)/8 {
+		return errors.New("invalid chunk request from receiver")
+	}
+
+	body, finish, err := bodyWriter(c, opts, &t.wire)
+	if err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	go t.reportProgress(done)
+	var off, skipped int64
+	for i, size := range recipe.Sizes {
+		if need[i/8]&(1<<(i%8)) != 0 {
+			if _, err = io.Copy(progressWriter{w: body, t: t}, io.NewSectionReader(f, off, size)); err != nil {
+				break
+			}
+		} else {
+			t.Add(int(size))
+			skipped += size
+		}
+		off += size
+	}
+	if err == nil {
+		err = finish()
+	}
+	close(done)
+	if err != nil {
+		return err
+	}
+	chunkIndex.skipped.Add(skipped)
+	t.mu.Lock()
+	t.Deduplicated = skipped
+	t.mu.Unlock()
+
+	line, _ = json.Marshal(transferTrailer{SHA256: sum})
+	if _, err := c.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	ack, err = readAck(reader, c, timeout)
+	if ack.Result == resultChecksumMismatch {
+		emitVerifyFailed(t, t.Path, hashSHA256, sum, ack.SHA256)
+		return &checksumError{name: t.Name, expected: sum, actual: ack.SHA256}
+	}
+	if err == nil {
+		t.mu.Lock()
+		t.SHA256 = sum
+		t.mu.Unlock()
+	}
+	return err
+}
+
+// dedupAllowed reports whether c's peer may learn which chunks we hold,
+// which only a pinned one may
+func dedupAllowed(c *Connection) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.secure != nil && c.secure.PinnedAs != ""
+}
+
+// receiveDeduped answers a deduplicating sender and builds the file from
+// local copies and the chunks it asks for
+func receiveDeduped(c *Connection, t *Transfer, r *bufio.Reader, dir string, header TransferHeader) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	path, err := safeJoin(dir, t.Name)
+	if err != nil {
+		return err
+	}
+	// A file resent is usually an older version of the one already here
+	chunkIndex.ensure(path)
+	if path, err = uniquePath(path); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	t.Path = path
+	t.mu.Unlock()
+
+	compression := supportedCompression(header.Compression)
+	ack := TransferAck{Status: "ok", Compression: compression, Dedup: true}
+	line, _ := json.Marshal(ack)
+	if _, err := c.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	t.setCompression(compression)
+
+	// Every chunk but the last is at least cdcMinChunk, and each takes
+	// under 80 bytes in the recipe
+	maxChunks := header.Size/cdcMinChunk + 1
+	c.SetReadDeadline(time.Now().Add(30 * time.Second))
+	line, err = readLineLimit(r, int(min(maxChunks, 1<<24))*80+64)
+	c.SetReadDeadline(time.Time{})
+	if err != nil {
+		return fmt.Errorf("no chunk list from sender: %w", err)
+	}
+	var recipe dedupRecipe
+	if err := json.Unmarshal(line, &recipe); err != nil || len(recipe.Hashes) != len(recipe.Sizes) || int64(len(recipe.Sizes)) > maxChunks {
+		return errors.New("invalid chunk list")
+	}
+	hashes := make([][32]byte, len(recipe.Hashes))
+	var total int64
+	for i, s := range recipe.Hashes {
+		raw, err := hex.DecodeString(s)
+		if err != nil || len(raw) != 32 || recipe.Sizes[i] <= 0 || recipe.Sizes[i] > cdcMaxChunk {
+			return errors.New("invalid chunk list")
+		}
+		copy(hashes[i][:], raw)
+		total += recipe.Sizes[i]
+	}
+	if total != header.Size {
+		return errors.New("chunk list does not add up to the file size")
+	}
+
+	// Ask for every chunk without a local copy that still checks out
+	buf := make([]byte, cdcMaxChunk)
+	local := make([]chunkLocation, len(hashes))
+	need := make([]byte, (len(hashes)+7)/8)
+	var reused int64
+	for i, h := range hashes {
+		loc, ok := chunkIndex.lookup(h)
+		if ok && (loc.size != recipe.Sizes[i] || !loc.read(buf, h)) {
+			chunkIndex.forget(loc.file.Path)
+			ok = false
+		}
+		if ok {
+			local[i] = loc
+			reused += loc.size
+		} else {
+			need[i/8] |= 1 << (i % 8)
+		}
+	}
+	line, _ = json.Marshal(TransferAck{Status: "ok", Need: base64.StdEncoding.EncodeToString(need)})
+	if _, err := c.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	logger.Info("dedup receive planned", "id", t.ID, "chunks", len(hashes), "requested", needCount(need), "reused_bytes", reused)
+
+	body, finish, err := bodyReader(r, compression, &t.wire)
+	if err != nil {
+		return err
+	}
+	emitEvent("transfer_started", t.Info())
+	partial := path + ".part"
+	out, err := os.Create(partial)
+	if err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	go t.reportProgress(done)
+	whole := sha256.New()
+	err = func() error {
+		for i, h := range hashes {
+			data := buf[:recipe.Sizes[i]]
+			if need[i/8]&(1<<(i%8)) != 0 {
+				if _, err := io.ReadFull(body, data); err != nil {
+					return fmt.Errorf("connection closed after %d of %d bytes", t.bytes.Load(), header.Size)
+				}
+				if sha256.Sum256(data) != h {
+					return fmt.Errorf("chunk %d does not match its hash", i)
+				}
+			} else if !local[i].read(data, h) {
+				chunkIndex.forget(local[i].file.Path)
+				return fmt.Errorf("local copy of chunk %d changed during the transfer", i)
+			}
+			if _, err := out.Write(data); err != nil {
+				return err
+			}
+			whole.Write(data)
+			t.Add(len(data))
+		}
+		return finish()
+	}()
+	close(done)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = verifyTrailer(t, r, path, hex.EncodeToString(whole.Sum(nil)))
+	}
+	if err == nil {
+		err = finalizeReceived(t, partial, path)
+	}
+	if err != nil {
+		os.Remove(partial)
+		return err
+	}
+	chunkIndex.reused.Add(reused)
+	chunkIndex.add(path, recipe)
+	t.mu.Lock()
+	t.SHA256 = hex.EncodeToString(whole.Sum(nil))
+	t.Deduplicated = reused
+	t.mu.Unlock()
+	return nil
+}
+
+func handleDedupCacheStatus(writer *Output) {
+	writer.Encode(ProtocolResponse{Status: "ok", Data: chunkIndex.status()})
+}
+
+func handleClearDedupCache(writer *Output) {
+	if err := chunkIndex.clear(); err != nil {
+		sendError(writer, message("dedup.failed_clear_dedup_cache", "error", err))
+		return
+	}
+	logger.Info("dedup cache cleared")
+	writer.Encode(okResponse(message("dedup.cache_cleared"), nil))
+}
+
+// needCount is how many chunks a need bitmap asks for
+func needCount(need []byte) (n int) {
+	for _, b := range need {
+		n += bits.OnesCount8(b)
+	}
+	return n
+}
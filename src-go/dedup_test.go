@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+	"time"
+)
+
+func chunkHashes(t *testing.T, data []byte) map[[32]byte]bool {
+	hashes := make(map[[32]byte]bool)
+	var joined []byte
+	err := chunkStream(bytes.NewReader(data), func(c cdcChunk, b []byte) error {
+		if c.Offset != int64(len(joined)) || c.Size > cdcMaxChunk || c.Size == 0 {
+			t.Fatalf("chunk at %d of %d bytes", c.Offset, c.Size)
+		}
+		joined = append(joined, b...)
+		hashes[c.Hash] = true
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(joined, data) {
+		t.Fatal("chunks do not add up to the input")
+	}
+	return hashes
+}
+
+func TestChunkBoundariesSurviveAnInsert(t *testing.T) {
+	data := make([]byte, 8<<20)
+	rand.Read(data)
+	before := chunkHashes(t, data)
+
+	edited := append(append(append([]byte(nil), data[:3<<20]...), "a few new bytes"...), data[3<<20:]...)
+	after := chunkHashes(t, edited)
+	var shared int
+	for h := range after {
+		if before[h] {
+			shared++
+		}
+	}
+	// Only the chunks around the edit should differ
+	if len(after)-shared > 3 {
+		t.Errorf("%d of %d chunks changed after a small insert", len(after)-shared, len(after))
+	}
+}
+
+func TestDedupOnlyForPinnedPeers(t *testing.T) {
+	for _, tc := range []struct {
+		secure *SecureInfo
+		want   bool
+	}{
+		{nil, false},
+		{&SecureInfo{Fingerprint: "unpinned"}, false},
+		{&SecureInfo{Fingerprint: "pinned", PinnedAs: "laptop"}, true},
+	} {
+		c := &Connection{ID: "dedup-peer", Direction: "inbound", Network: "tcp", Created: time.Now(), Limiter: newRateLimiter(0)}
+		c.setSecure(tc.secure)
+		if got := dedupAllowed(c); got != tc.want {
+			t.Errorf("%+v: dedup %v", tc.secure, got)
+		}
+	}
+}
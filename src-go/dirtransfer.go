@@ -0,0 +1,811 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxTransferStreams caps how many parallel connections one directory uses
+const maxTransferStreams = 8
+
+// Conflict policies for files that already exist on the receiver
+const (
+	conflictRename    = "rename" // store as "name (n).ext", the default
+	conflictOverwrite = "overwrite"
+	conflictSkip      = "skip"
+
+	// conflictSync overwrites only receiver files still at the version the
+	// sender last synced, keeps the others and reports them as conflicts
+	conflictSync = "sync"
+)
+
+// Manifest lists everything in a directory transfer. Paths are relative
+// to the directory and always use forward slashes.
+type Manifest struct {
+	Entries []ManifestEntry `json:"entries"`
+
+	// Deleted lists files removed on the sender since the last sync, each
+	// with the Base it was synced at
+	Deleted []ManifestEntry `json:"deleted,omitempty"`
+}
+
+type ManifestEntry struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256,omitempty"`
+	Dir    bool   `json:"dir,omitempty"` // kept so empty directories survive
+
+	Base string `json:"base,omitempty"` // sync only: SHA-256 last synced, empty if never
+}
+
+// Totals returns the number of files and their combined size
+func (m *Manifest) Totals() (files int, size int64) {
+	for _, e := range m.Entries {
+		if !e.Dir {
+			files++
+			size += e.Size
+		}
+	}
+	return files, size
+}
+
+// buildManifest walks root and records its regular files and directories.
+// Symlinks and other special files are left out.
+func buildManifest(root string) (*Manifest, error) {
+	m := &Manifest{}
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == root {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		entry := ManifestEntry{Path: filepath.ToSlash(rel)}
+		switch {
+		case d.IsDir():
+			entry.Dir = true
+		case d.Type().IsRegular():
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			entry.Size = info.Size()
+		default:
+			return nil
+		}
+		m.Entries = append(m.Entries, entry)
+		return nil
+	})
+	return m, err
+}
+
+// hashManifest fills in the SHA-256 of every file in m not hashed yet
+func hashManifest(root string, m *Manifest) error {
+	for i := range m.Entries {
+		e := &m.Entries[i]
+		if e.Dir || e.SHA256 != "" {
+			continue
+		}
+		sum, err := hashFile(filepath.Join(root, filepath.FromSlash(e.Path)))
+		if err != nil {
+			return err
+		}
+		e.SHA256 = sum
+	}
+	return nil
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.CopyBuffer(h, f, make([]byte, transferBufferSize)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func validConflictPolicy(policy string) bool {
+	switch policy {
+	case "", conflictRename, conflictOverwrite, conflictSkip, conflictSync:
+		return true
+	}
+	return false
+}
+
+type SendDirectoryPayload struct {
+	Host      string `json:"host"`
+	Port      int    `json:"port"`
+	Path      string `json:"path"`
+	Name      string `json:"name"`     // directory name on the receiver, defaults to the base name
+	Conflict  string `json:"conflict"` // "rename" (default), "overwrite", "skip", "sync"
+	Streams   int    `json:"streams"`  // parallel file connections, default 1
+	TimeoutMs int    `json:"timeout_ms"`
+	Encrypted bool   `json:"encrypted"`
+	PeerKey   string `json:"peer_key"`
+
+	Compression CompressionOptions `json:"compression"`
+	Auth        ClientAuth         `json:"auth"`
+
+	Offer          bool `json:"offer"`            // wait for a drop receiver to accept first
+	OfferTimeoutMs int  `json:"offer_timeout_ms"` // how long to wait for that answer
+
+	AddressFamily string `json:"address_family"` // "ipv4", "ipv6" or "dual" (default)
+	Transport     string `json:"transport"`      // "tcp" (default) or "quic"
+	Proxy         string `json:"proxy"`          // proxy URL, or "direct" to skip the configured proxy
+	Mux           string `json:"mux"`            // send over this open_mux link instead of dialing host and port
+
+	Schedule *ScheduleSpec `json:"schedule"` // run later or repeatedly instead of now
+	Priority string        `json:"priority"` // "low", "normal" (default) or "high", see priority.go
+}
+
+func handleSendDirectory(payload json.RawMessage, writer *Output) {
+	var p SendDirectoryPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		sendInvalidPayload(writer, "send_directory")
+		return
+	}
+	if (p.Mux == "" && (p.Host == "" || p.Port <= 0)) || p.Path == "" {
+		sendErrorCode(writer, ErrInvalidArgument, message("dirtransfer.send_directory_requires_path"), nil)
+		return
+	}
+	if !validPriority(p.Priority) {
+		sendErrorCode(writer, ErrInvalidArgument, message("priority.priority_must_low"), nil)
+		return
+	}
+	if p.Mux != "" {
+		if err := checkMuxOptions(p.Transport, p.Encrypted, p.Auth, p.Compression, p.Proxy); err != nil {
+			sendFailure(writer, err)
+			return
+		}
+	}
+	if p.Schedule != nil {
+		scheduleCommand(writer, "send_directory", payload, *p.Schedule)
+		return
+	}
+	if !validConflictPolicy(p.Conflict) {
+		sendErrorCode(writer, ErrUnsupported, message("dirtransfer.unsupported_conflict_policy", "conflict", p.Conflict), nil)
+		return
+	}
+	if err := p.Auth.Validate(); err != nil {
+		sendFailure(writer, err)
+		return
+	}
+	if err := p.Compression.Validate(); err != nil {
+		sendFailure(writer, err)
+		return
+	}
+	if p.Streams <= 0 {
+		p.Streams = 1
+	}
+	if p.Streams > maxTransferStreams {
+		p.Streams = maxTransferStreams
+	}
+
+	root := filepath.Clean(p.Path)
+	if info, err := os.Stat(root); err != nil || !info.IsDir() {
+		sendErrorCode(writer, ErrInvalidArgument, message("common.not_directory", "dir", p.Path), nil)
+		return
+	}
+	manifest, err := buildManifest(root)
+	if err != nil {
+		sendError(writer, message("common.failed_read", "path", p.Path, "error", err))
+		return
+	}
+
+	name := p.Name
+	if name == "" {
+		name = filepath.Base(root)
+	}
+	timeout := defaultDialTimeout
+	if p.TimeoutMs > 0 {
+		timeout = time.Duration(p.TimeoutMs) * time.Millisecond
+	}
+	network, isQUIC, err := transportNetwork(p.Transport, p.AddressFamily)
+	if err == nil && isQUIC {
+		err = validProxy(p.Proxy, "quic")
+	} else if err == nil {
+		err = validProxy(p.Proxy, "tcp")
+	}
+	if err != nil {
+		sendFailure(writer, err)
+		return
+	}
+
+	spec := dialSpec{
+		Network:   network,
+		Addr:      net.JoinHostPort(normalizeHost(p.Host), strconv.Itoa(p.Port)),
+		QUIC:      isQUIC,
+		Timeout:   timeout,
+		Encrypted: p.Encrypted,
+		PeerKey:   p.PeerKey,
+		Auth:      p.Auth,
+		Proxy:     p.Proxy,
+	}
+	if p.Offer {
+		spec.OfferWait = defaultOfferSenderWait
+		if p.OfferTimeoutMs > 0 {
+			spec.OfferWait = time.Duration(p.OfferTimeoutMs) * time.Millisecond
+		}
+	}
+	if p.Mux != "" {
+		if err := spec.useMux(p.Mux, "transfer"); err != nil {
+			sendFailure(writer, err)
+			return
+		}
+	}
+	files, size := manifest.Totals()
+	t := newTransferAt(p.Priority, "send", name, root, spec.Addr, size)
+	setScope(t.ID, writer.Namespace())
+	t.setFiles(files)
+	t.compression = p.Compression
+	ctx, done := trackJob(t.ID, "transfer", spec.Addr)
+
+	writer.Encode(okResponse(message("common.transfer_started"), t.Info()))
+
+	go func() {
+		defer recoverTransfer(t)
+		defer done()
+		t.finish(canceled(ctx, sendDirectory(ctx, t, root, manifest, spec, p.Conflict, p.Streams)))
+	}()
+}
+
+// sendDirectory offers the manifest on a control connection, then streams
+// the files the receiver wants over the given number of connections
+func sendDirectory(ctx context.Context, t *Transfer, root string, m *Manifest, spec dialSpec, conflict string, streams int) error {
+	if err := hashManifest(root, m); err != nil {
+		return err
+	}
+
+	conn, secure, err := spec.dial()
+	if err != nil {
+		return err
+	}
+	c := trackConn(conn, "outbound", spec.transport(), nil)
+	if c == nil {
+		conn.Close()
+		return errors.New("service is shutting down")
+	}
+	defer untrackConn(c)
+	defer t.cancelOn(ctx, c)()
+	c.setSecure(secure)
+
+	header := TransferHeader{Name: t.Name, Size: t.Size, Manifest: m, Conflict: conflict}
+	if t.compression.Enabled() {
+		header.Compression = t.compression.Algorithm
+	}
+	if spec.OfferWait > 0 {
+		header.Offer, header.From = true, senderName()
+	}
+	line, _ := json.Marshal(header)
+	if _, err := c.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	control := bufio.NewReader(c)
+	if header.Offer {
+		if _, err := readAck(control, c, spec.OfferWait); err != nil {
+			return err
+		}
+	}
+	ack, err := readAck(control, c, spec.Timeout)
+	if err != nil {
+		return err
+	}
+	if len(ack.Conflicts) > 0 {
+		t.mu.Lock()
+		t.Conflicts = ack.Conflicts
+		t.mu.Unlock()
+	}
+	// Every file uses what the receiver accepted for the whole directory
+	t.compression.Algorithm = supportedCompression(ack.Compression)
+	t.setCompression(t.compression.Algorithm)
+
+	skip := make(map[string]bool, len(ack.Skip))
+	for _, path := range ack.Skip {
+		skip[path] = true
+	}
+	queue := make(chan ManifestEntry, len(m.Entries))
+	for _, e := range m.Entries {
+		switch {
+		case e.Dir:
+		case skip[e.Path]:
+			// Skipped files count as done so progress still reaches 100%
+			t.Add(int(e.Size))
+			emitFileCompleted(t, e.Path, e.Size, conflictSkip)
+		default:
+			queue <- e
+		}
+	}
+	close(queue)
+
+	done := make(chan struct{})
+	go t.reportProgress(done)
+	err = sendDirectoryFiles(ctx, t, root, ack.Batch, queue, spec, streams)
+	close(done)
+
+	// Tell the receiver how it went so it can finish its side of the transfer
+	final := TransferAck{Status: "ok"}
+	if err != nil {
+		final = TransferAck{Status: "error", Message: err.Error()}
+	}
+	line, _ = json.Marshal(final)
+	if _, werr := c.Write(append(line, '\n')); err == nil {
+		err = werr
+	}
+	if err != nil {
+		return err
+	}
+	_, err = readAck(control, c, spec.Timeout)
+	return err
+}
+
+// sendDirectoryFiles drains queue over parallel connections, stopping
+// every stream at the first error
+func sendDirectoryFiles(ctx context.Context, t *Transfer, root, batch string, queue <-chan ManifestEntry, spec dialSpec, streams int) error {
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+		failed   = make(chan struct{})
+	)
+	fail := func(err error) {
+		errOnce.Do(func() {
+			firstErr = err
+			close(failed)
+		})
+	}
+
+	for i := 0; i < streams; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := callSafe("transfer "+t.ID, func() error {
+				return sendDirectoryStream(ctx, t, root, batch, queue, failed, spec)
+			})
+			if err != nil {
+				fail(err)
+			}
+		}()
+	}
+	wg.Wait()
+	return firstErr
+}
+
+func sendDirectoryStream(ctx context.Context, t *Transfer, root, batch string, queue <-chan ManifestEntry, failed <-chan struct{}, spec dialSpec) error {
+	var c *Connection
+	var reader *bufio.Reader
+	stop := func() bool { return false }
+	defer func() {
+		stop()
+		if c != nil {
+			untrackConn(c)
+		}
+	}()
+
+	for e := range queue {
+		select {
+		case <-failed:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		// Dial lazily so streams that find the queue empty never connect
+		if c == nil {
+			conn, secure, err := spec.dial()
+			if err != nil {
+				return err
+			}
+			if c = trackConn(conn, "outbound", spec.transport(), nil); c == nil {
+				conn.Close()
+				return errors.New("service is shutting down")
+			}
+			c.setSecure(secure)
+			stop = t.cancelOn(ctx, c)
+			reader = bufio.NewReader(c)
+		}
+
+		result, err := sendDirectoryFile(t, c, reader, root, batch, e, spec.Timeout)
+		if err != nil {
+			return fmt.Errorf("%s: %w", e.Path, err)
+		}
+		emitFileCompleted(t, e.Path, e.Size, result)
+	}
+	return nil
+}
+
+func sendDirectoryFile(t *Transfer, c *Connection, reader *bufio.Reader, root, batch string, e ManifestEntry, timeout time.Duration) (string, error) {
+	f, err := os.Open(filepath.Join(root, filepath.FromSlash(e.Path)))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err != nil || info.Size() != e.Size {
+		return "", errors.New("file changed during transfer")
+	}
+
+	header := TransferHeader{
+		Name:   filepath.Base(filepath.FromSlash(e.Path)),
+		Size:   e.Size,
+		Batch:  batch,
+		Path:   e.Path,
+		SHA256: e.SHA256,
+	}
+	if t.compression.Enabled() {
+		header.Compression = t.compression.Algorithm
+	}
+	line, _ := json.Marshal(header)
+	if _, err := c.Write(append(line, '\n')); err != nil {
+		return "", err
+	}
+	body, finish, err := bodyWriter(c, t.compression, &t.wire)
+	if err != nil {
+		return "", err
+	}
+	if err := copyFileBody(body, f, e.Size, t, nil); err != nil {
+		return "", err
+	}
+	if err := finish(); err != nil {
+		return "", err
+	}
+	ack, err := readAck(reader, c, timeout)
+	if ack.Result == resultChecksumMismatch {
+		emitVerifyFailed(t, e.Path, hashSHA256, e.SHA256, ack.SHA256)
+	}
+	return ack.Result, err
+}
+
+func (t *Transfer) setFiles(n int) {
+	t.mu.Lock()
+	t.Files = n
+	t.mu.Unlock()
+}
+
+func emitFileCompleted(t *Transfer, path string, size int64, result string) {
+	emitEvent("transfer_file_completed", map[string]interface{}{
+		"id":        t.ID,
+		"direction": t.Direction,
+		"path":      path,
+		"size":      size,
+		"result":    result,
+	})
+}
+
+// incomingDirectory is a directory transfer being received
+type incomingDirectory struct {
+	t        *Transfer
+	root     string
+	conflict string
+	entries  map[string]ManifestEntry
+	deleted  []ManifestEntry
+
+	mu       sync.Mutex
+	received map[string]bool
+}
+
+var (
+	incomingMu  sync.Mutex
+	incomingDir = make(map[string]*incomingDirectory)
+)
+
+func lookupIncomingDirectory(id string) (*incomingDirectory, bool) {
+	incomingMu.Lock()
+	defer incomingMu.Unlock()
+	d, ok := incomingDir[id]
+	return d, ok
+}
+
+// receiveDirectory handles the control connection of a directory transfer:
+// it validates the manifest, answers with the transfer ID and the files to
+// skip, then waits for the sender to report that every file went out
+func receiveDirectory(c *Connection, reader *bufio.Reader, dir string, header TransferHeader) {
+	conflict := header.Conflict
+	if conflict == "" {
+		conflict = conflictRename
+	}
+	if !validConflictPolicy(conflict) {
+		writeAck(c, errors.New("unsupported conflict policy: "+conflict))
+		return
+	}
+
+	name, err := incomingName(header.Name)
+	if err != nil {
+		writeAck(c, err)
+		return
+	}
+	root, err := safeJoin(dir, name)
+	if err == nil && checkWithin(dir, root) != nil {
+		// Entries are checked against root, so root itself must not lead out
+		err = &PathError{Path: header.Name, Reason: reasonSymlink}
+	}
+	if err != nil {
+		writeAck(c, err)
+		return
+	}
+	entries := make(map[string]ManifestEntry, len(header.Manifest.Entries))
+	for _, e := range header.Manifest.Entries {
+		if _, err := safeJoin(root, e.Path); err != nil {
+			writeAck(c, err)
+			return
+		}
+		if e.Size < 0 {
+			writeAck(c, fmt.Errorf("invalid manifest entry %q", e.Path))
+			return
+		}
+		entries[e.Path] = e
+	}
+	for _, e := range header.Manifest.Deleted {
+		if _, err := safeJoin(root, e.Path); err != nil {
+			writeAck(c, err)
+			return
+		}
+	}
+	if len(header.Manifest.Deleted) > 0 && conflict != conflictSync {
+		writeAck(c, errors.New("deletions need the sync conflict policy"))
+		return
+	}
+
+	files, size := header.Manifest.Totals()
+	t := newTransfer("receive", filepath.Base(root), root, c.Info().RemoteAddr, size)
+	setScope(t.ID, scopeOf(c.ID))
+	t.setFiles(files)
+	d := &incomingDirectory{t: t, root: root, conflict: conflict, entries: entries, deleted: header.Manifest.Deleted,
+		received: make(map[string]bool)}
+
+	ack, err := d.prepare()
+	ack.Compression = supportedCompression(header.Compression)
+	t.setCompression(ack.Compression)
+	if err != nil {
+		writeAck(c, err)
+		t.finish(err)
+		return
+	}
+
+	incomingMu.Lock()
+	incomingDir[t.ID] = d
+	incomingMu.Unlock()
+	defer func() {
+		incomingMu.Lock()
+		delete(incomingDir, t.ID)
+		incomingMu.Unlock()
+	}()
+
+	line, _ := json.Marshal(ack)
+	if _, err := c.Write(append(line, '\n')); err != nil {
+		t.finish(err)
+		return
+	}
+	emitEvent("transfer_started", t.Info())
+	ctx, endJob := trackJob(t.ID, "transfer", t.Peer)
+	defer endJob()
+	defer t.cancelOn(ctx, c)()
+
+	// Files arrive on other connections, so this one is quiet for as long
+	// as they take; rely on keepalive to notice a dead sender instead
+	timeouts := c.Timeouts()
+	timeouts.Idle, timeouts.Read = 0, 0
+	c.SetTimeouts(timeouts)
+
+	done := make(chan struct{})
+	go t.reportProgress(done)
+	err = canceled(ctx, d.wait(reader))
+	close(done)
+
+	writeAck(c, err)
+	t.finish(err)
+}
+
+// prepare creates the directory tree and works out which files to skip
+func (d *incomingDirectory) prepare() (TransferAck, error) {
+	ack := TransferAck{Status: "ok", Batch: d.t.ID}
+	if err := os.MkdirAll(d.root, 0o755); err != nil {
+		return ack, err
+	}
+	for path, e := range d.entries {
+		target, _ := safeJoin(d.root, path)
+		if e.Dir {
+			if err := os.MkdirAll(target, 0o755); err != nil {
+				return ack, err
+			}
+			continue
+		}
+		if d.conflict == conflictSync {
+			switch d.syncState(target, e.SHA256, e.Base) {
+			case syncCurrent:
+				ack.Skip = append(ack.Skip, path)
+				d.markReceived(path, e.Size)
+			case syncConflict:
+				ack.Skip = append(ack.Skip, path)
+				ack.Conflicts = append(ack.Conflicts, path)
+				d.markReceived(path, e.Size)
+				emitSyncConflict(d.t, path, "modified", "")
+			}
+			continue
+		}
+		if d.conflict != conflictSkip {
+			continue
+		}
+		if _, err := os.Lstat(target); err == nil {
+			ack.Skip = append(ack.Skip, path)
+			d.markReceived(path, e.Size)
+		}
+	}
+	for _, e := range d.deleted {
+		target, _ := safeJoin(d.root, e.Path)
+		switch d.syncState(target, "", e.Base) {
+		case syncConflict:
+			ack.Conflicts = append(ack.Conflicts, e.Path)
+			emitSyncConflict(d.t, e.Path, "deleted", "")
+		case syncStale:
+			if err := os.Remove(target); err != nil {
+				return ack, err
+			}
+			emitFileCompleted(d.t, e.Path, 0, resultDeleted)
+		}
+	}
+	return ack, nil
+}
+
+// What a sync finds at a target before replacing or deleting it
+const (
+	syncMissing  = iota // nothing there yet
+	syncCurrent         // already what the sender has
+	syncStale           // the version last synced, safe to replace
+	syncConflict        // changed on this side since the last sync
+)
+
+// resultDeleted is reported for files a sync removed
+const resultDeleted = "deleted"
+
+func (d *incomingDirectory) syncState(target, sum, base string) int {
+	info, err := os.Lstat(target)
+	if err != nil {
+		return syncMissing
+	}
+	if !info.Mode().IsRegular() {
+		return syncConflict
+	}
+	actual, err := hashFile(target)
+	switch {
+	case err != nil:
+		return syncConflict
+	case sum != "" && actual == sum:
+		return syncCurrent
+	case base != "" && actual == base:
+		return syncStale
+	}
+	return syncConflict
+}
+
+// markReceived records a finished file; skipped files count toward progress
+// the same way they do on the sender
+func (d *incomingDirectory) markReceived(path string, skipped int64) {
+	d.mu.Lock()
+	d.received[path] = true
+	d.mu.Unlock()
+	if skipped > 0 {
+		d.t.Add(int(skipped))
+	}
+}
+
+// wait blocks until the sender reports the outcome on the control connection
+func (d *incomingDirectory) wait(reader *bufio.Reader) error {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("sender went away: %w", err)
+	}
+	var final TransferAck
+	if err := json.Unmarshal([]byte(line), &final); err != nil {
+		return errors.New("invalid message from sender")
+	}
+	if final.Status != "ok" {
+		return fmt.Errorf("sender aborted: %s", final.Message)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for path, e := range d.entries {
+		if !e.Dir && !d.received[path] {
+			return fmt.Errorf("missing %s", path)
+		}
+	}
+	return nil
+}
+
+// receiveDirectoryFile stores one file of a directory transfer. A non-nil
+// error means the connection can no longer be used.
+func receiveDirectoryFile(c *Connection, reader *bufio.Reader, header TransferHeader) error {
+	d, ok := lookupIncomingDirectory(header.Batch)
+	if !ok {
+		err := errors.New("unknown transfer " + header.Batch)
+		writeAck(c, err)
+		return err
+	}
+	e, ok := d.entries[header.Path]
+	if !ok || e.Dir || e.Size != header.Size {
+		err := fmt.Errorf("%s is not in the manifest", header.Path)
+		writeAck(c, err)
+		return err
+	}
+	// Check again: the tree may have changed since the manifest was answered
+	target, err := safeJoin(d.root, header.Path)
+	if err != nil {
+		writeAck(c, err)
+		return err
+	}
+	body, finish, err := bodyReader(reader, header.Compression, &d.t.wire)
+	if err != nil {
+		writeAck(c, err)
+		return err
+	}
+
+	result := "written"
+	if _, err := os.Lstat(target); err == nil {
+		switch d.conflict {
+		case conflictSkip:
+			// Appeared after the manifest was answered; drain the body and keep ours
+			if _, err := io.CopyN(io.Discard, body, header.Size); err != nil {
+				return err
+			}
+			if err := finish(); err != nil {
+				return err
+			}
+			d.markReceived(header.Path, header.Size)
+			return writeDirectoryAck(c, d, header, conflictSkip, nil)
+		case conflictOverwrite, conflictSync:
+			result = "overwritten"
+		default:
+			if target, err = uniquePath(target); err != nil {
+				return writeDirectoryAck(c, d, header, "", err)
+			}
+			result = "renamed"
+		}
+	}
+
+	err = writeFile(d.t, body, target, header.Size, e.SHA256)
+	if err == nil {
+		err = finish()
+	}
+	if err == nil {
+		d.markReceived(header.Path, 0)
+	}
+	return writeDirectoryAck(c, d, header, result, err)
+}
+
+func writeDirectoryAck(c *Connection, d *incomingDirectory, header TransferHeader, result string, err error) error {
+	ack := TransferAck{Status: "ok", Batch: d.t.ID, Result: result}
+	if err != nil {
+		ack = TransferAck{Status: "error", Message: err.Error()}
+		mismatchAck(&ack, err)
+		pathAck(c, &ack, err)
+	} else {
+		emitFileCompleted(d.t, header.Path, header.Size, result)
+	}
+	line, _ := json.Marshal(ack)
+	if _, werr := c.Write(append(line, '\n')); werr != nil {
+		return werr
+	}
+	return err
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/grandcat/zeroconf"
+)
+
+const (
+	defaultDiscoveryService = "_lumina._tcp"
+	discoveryDomain         = "local."
+
+	// discoveryRound is how long each browse pass listens for answers
+	discoveryRound = 10 * time.Second
+	// peerLostRounds is how many consecutive passes a peer may miss before it is dropped
+	peerLostRounds = 3
+)
+
+// Peer is another Lumina instance seen on the local network
+type Peer struct {
+	Instance string    `json:"instance"`
+	Host     string    `json:"host"`
+	Port     int       `json:"port"`
+	IPv4     []string  `json:"ipv4"`
+	IPv6     []string  `json:"ipv6"`
+	Text     []string  `json:"text"`
+	LastSeen time.Time `json:"last_seen"`
+
+	Fingerprint string `json:"fingerprint,omitempty"` // node ID from the advertised key
+	Trust       string `json:"trust,omitempty"`       // what the trust store says about it
+
+	Capabilities *PeerCapabilities `json:"capabilities,omitempty"` // nil for builds that do not advertise them
+	Modes        *TransferModes    `json:"modes,omitempty"`        // best options both ends support
+
+	missed int
+}
+
+// DiscoveryState holds the mDNS advertisement and browser
+type DiscoveryState struct {
+	Mutex    sync.Mutex
+	Running  bool
+	Instance string
+	Service  string
+	Peers    map[string]*Peer
+
+	server *zeroconf.Server
+	cancel context.CancelFunc
+
+	// What was advertised and browsed for, to start over on a network change
+	port   int
+	text   []string
+	family string
+}
+
+var discovery = DiscoveryState{
+	Peers: make(map[string]*Peer),
+}
+
+type StartDiscoveryPayload struct {
+	Instance string   `json:"instance"`
+	Service  string   `json:"service"`
+	Port     int      `json:"port"` // advertised port; 0 browses without advertising
+	Text     []string `json:"text"`
+
+	AddressFamily string `json:"address_family"` // "ipv4", "ipv6" or "dual" (default)
+}
+
+func handleStartDiscovery(payload json.RawMessage, writer *Output) {
+	var p StartDiscoveryPayload
+	if len(payload) > 0 && string(payload) != "null" {
+		if err := json.Unmarshal(payload, &p); err != nil {
+			sendInvalidPayload(writer, "start_discovery")
+			return
+		}
+	}
+
+	if p.Service == "" {
+		p.Service = defaultDiscoveryService
+	}
+	if !validFamily(p.AddressFamily) {
+		sendErrorCode(writer, ErrUnsupported, message("common.unsupported_address_family", "address_family", p.AddressFamily), nil)
+		return
+	}
+	if p.Instance == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			host = "lumina"
+		}
+		p.Instance = host
+	}
+
+	discovery.Mutex.Lock()
+	defer discovery.Mutex.Unlock()
+
+	if discovery.Running {
+		sendErrorCode(writer, ErrAlreadyRunning, message("discovery.already_running"), nil)
+		return
+	}
+
+	if p.Port > 0 {
+		// Advertise the node's key so peers can remember and trust it, and
+		// what its listener supports so they can pick a transfer mode
+		if txt, err := identityText(); err == nil {
+			p.Text = append(p.Text, txt)
+		}
+		p.Text = append(p.Text, capabilityText()...)
+		server, err := zeroconf.Register(p.Instance, p.Service, discoveryDomain, p.Port, p.Text, nil)
+		if err != nil {
+			sendError(writer, message("common.failed_advertise", "service", p.Service, "error", err))
+			return
+		}
+		discovery.server = server
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	discovery.Running = true
+	discovery.Instance = p.Instance
+	discovery.Service = p.Service
+	discovery.cancel = cancel
+	discovery.port, discovery.text, discovery.family = p.Port, p.Text, p.AddressFamily
+
+	goSafe("discovery browser", func() { browseLoop(ctx, p.Service, p.Instance, p.AddressFamily) })
+
+	writer.Encode(okResponse(message("discovery.started", "service", p.Service), map[string]interface{}{
+		"instance":       p.Instance,
+		"advertised":     p.Port > 0,
+		"address_family": p.AddressFamily,
+	}))
+}
+
+func handleStopDiscovery(writer *Output) {
+	discovery.Mutex.Lock()
+	defer discovery.Mutex.Unlock()
+
+	if !discovery.Running {
+		sendErrorCode(writer, ErrNotRunning, message("discovery.not_running"), nil)
+		return
+	}
+	stopDiscoveryLocked()
+
+	writer.Encode(okResponse(message("discovery.stopped"), nil))
+}
+
+// stopDiscoveryLocked tears down advertisement and browsing; discovery.Mutex must be held
+func stopDiscoveryLocked() {
+	if discovery.cancel != nil {
+		discovery.cancel()
+		discovery.cancel = nil
+	}
+	if discovery.server != nil {
+		discovery.server.Shutdown()
+		discovery.server = nil
+	}
+	discovery.Running = false
+	discovery.Peers = make(map[string]*Peer)
+}
+
+func handleListPeers(writer *Output) {
+	discovery.Mutex.Lock()
+	defer discovery.Mutex.Unlock()
+
+	peers := make([]*Peer, 0, len(discovery.Peers))
+	for _, peer := range discovery.Peers {
+		peers = append(peers, peer)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Instance < peers[j].Instance })
+
+	writer.Encode(ProtocolResponse{
+		Status: "ok",
+		Data: map[string]interface{}{
+			"running": discovery.Running,
+			"peers":   peers,
+		},
+	})
+}
+
+// browseLoop repeatedly browses for the service. zeroconf only reports each
+// entry once per browse, so liveness is tracked per pass: peers that miss
+// peerLostRounds passes in a row are reported lost.
+func browseLoop(ctx context.Context, service, self, family string) {
+	for {
+		// Passes missed while paused do not count against peers
+		if !power.wait(ctx) {
+			return
+		}
+		seen, err := browseOnce(ctx, service, self, family)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			logger.Warn("discovery browse failed", "error", err)
+		}
+		expirePeers(seen)
+	}
+}
+
+// browsedEntry is an answer and the interface it arrived on
+type browsedEntry struct {
+	entry *zeroconf.ServiceEntry
+	iface string
+}
+
+// discoveryInterfaces lists the interfaces to browse on one by one. A
+// link-local IPv6 address is only usable with the zone of the interface it
+// was seen on, so each interface gets its own resolver.
+func discoveryInterfaces() []net.Interface {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	var list []net.Interface
+	for _, ifi := range ifaces {
+		if ifi.Flags&net.FlagUp != 0 && ifi.Flags&net.FlagMulticast != 0 {
+			list = append(list, ifi)
+		}
+	}
+	return list
+}
+
+func discoveryTraffic(family string) zeroconf.IPType {
+	switch family {
+	case familyIPv4:
+		return zeroconf.IPv4
+	case familyIPv6:
+		return zeroconf.IPv6
+	}
+	return zeroconf.IPv4AndIPv6
+}
+
+func browseOnce(ctx context.Context, service, self, family string) (map[string]bool, error) {
+	seen := make(map[string]bool)
+	round := time.Now()
+	roundCtx, cancel := context.WithTimeout(ctx, discoveryRound)
+	defer cancel()
+
+	found := make(chan browsedEntry)
+	browse := func(iface string, opts ...zeroconf.ClientOption) error {
+		resolver, err := zeroconf.NewResolver(append(opts, zeroconf.SelectIPTraffic(discoveryTraffic(family)))...)
+		if err != nil {
+			return err
+		}
+		entries := make(chan *zeroconf.ServiceEntry)
+		if err := resolver.Browse(roundCtx, service, discoveryDomain, entries); err != nil {
+			return err
+		}
+		go func() {
+			for entry := range entries {
+				select {
+				case found <- browsedEntry{entry, iface}:
+				case <-roundCtx.Done():
+					return
+				}
+			}
+		}()
+		return nil
+	}
+
+	var err error
+	browsing := 0
+	for _, ifi := range discoveryInterfaces() {
+		if e := browse(ifi.Name, zeroconf.SelectIfaces([]net.Interface{ifi})); e != nil {
+			err = e
+			continue
+		}
+		browsing++
+	}
+	if browsing == 0 {
+		// No interface could be joined on its own; fall back to letting
+		// zeroconf pick, which still finds peers but cannot zone their
+		// link-local addresses
+		if err = browse(""); err != nil {
+			// Still wait out the round so a missing network does not spin
+			<-roundCtx.Done()
+			return seen, err
+		}
+	}
+
+	for {
+		select {
+		case <-roundCtx.Done():
+			return seen, nil
+		case b := <-found:
+			if b.entry == nil || b.entry.Instance == self {
+				continue
+			}
+			seen[b.entry.Instance] = true
+			recordPeer(b.entry, b.iface, round)
+		}
+	}
+}
+
+// recordPeer stores an answer seen on iface. Answers for the same instance
+// on other interfaces in this round add their addresses to it.
+func recordPeer(entry *zeroconf.ServiceEntry, iface string, round time.Time) {
+	peer := &Peer{
+		Instance: entry.Instance,
+		Host:     entry.HostName,
+		Port:     entry.Port,
+		IPv4:     []string{},
+		IPv6:     []string{},
+		Text:     append([]string{}, entry.Text...),
+		LastSeen: time.Now(),
+	}
+	for _, ip := range entry.AddrIPv4 {
+		peer.IPv4 = append(peer.IPv4, ip.String())
+	}
+	for _, ip := range entry.AddrIPv6 {
+		addr := ip.String()
+		if ip.IsLinkLocalUnicast() && iface != "" {
+			addr += "%" + iface
+		}
+		peer.IPv6 = append(peer.IPv6, addr)
+	}
+	if pub, ok := textIdentity(entry.Text); ok {
+		known := trust.observe(pub, entry.Instance, append(append([]string{}, peer.IPv4...), peer.IPv6...)...)
+		peer.Fingerprint, peer.Trust = known.Fingerprint, known.Trust
+	}
+	peer.Capabilities = textCapabilities(entry.Text)
+	peer.Modes = suggestModes(peer.Capabilities)
+
+	discovery.Mutex.Lock()
+	existing, known := discovery.Peers[peer.Instance]
+	sameService := known && existing.Port == peer.Port && existing.Host == peer.Host
+	if sameService && !existing.LastSeen.Before(round) {
+		peer.IPv4 = mergeAddrs(existing.IPv4, peer.IPv4)
+		peer.IPv6 = mergeAddrs(existing.IPv6, peer.IPv6)
+	}
+	discovery.Peers[peer.Instance] = peer
+	discovery.Mutex.Unlock()
+
+	if !sameService {
+		emitEvent("peer_found", peer)
+	}
+}
+
+// mergeAddrs appends the addresses of b not already in a
+func mergeAddrs(a, b []string) []string {
+	merged := append([]string{}, a...)
+	for _, addr := range b {
+		dup := false
+		for _, have := range merged {
+			if have == addr {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			merged = append(merged, addr)
+		}
+	}
+	return merged
+}
+
+func expirePeers(seen map[string]bool) {
+	var lost []*Peer
+
+	discovery.Mutex.Lock()
+	for name, peer := range discovery.Peers {
+		if seen[name] {
+			peer.missed = 0
+			continue
+		}
+		peer.missed++
+		if peer.missed >= peerLostRounds {
+			delete(discovery.Peers, name)
+			lost = append(lost, peer)
+		}
+	}
+	discovery.Mutex.Unlock()
+
+	for _, peer := range lost {
+		emitEvent("peer_lost", peer)
+	}
+}
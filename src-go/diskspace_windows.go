@@ -0,0 +1,17 @@
+package main
+
+import "golang.org/x/sys/windows"
+
+// diskFree returns the bytes the current user may still write to the
+// volume holding path, after any disk quota
+func diskFree(path string) (uint64, error) {
+	p, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	var free uint64
+	if err := windows.GetDiskFreeSpaceEx(p, &free, nil, nil); err != nil {
+		return 0, err
+	}
+	return free, nil
+}
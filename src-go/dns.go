@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DNS diagnostics run through Go's own resolver so a query can be sent to
+// a chosen server instead of the system one. Names in the hosts file are
+// still answered from it, as they are for every program on the machine.
+const (
+	defaultDNSTimeout      = 5 * time.Second
+	defaultBenchmarkRounds = 5
+	maxBenchmarkRounds     = 50
+	maxBenchmarkServers    = 16
+)
+
+var dnsTypes = map[string]bool{"A": true, "AAAA": true, "TXT": true, "SRV": true, "CNAME": true, "MX": true}
+
+// dnsResolver returns a resolver that asks server ("host" or "host:port",
+// empty for the system resolver) over network ("udp" or "tcp")
+func dnsResolver(server, network string) (*net.Resolver, string, error) {
+	if server == "" {
+		return net.DefaultResolver, "system", nil
+	}
+	switch network {
+	case "":
+		network = "udp"
+	case "udp", "tcp":
+	default:
+		return nil, "", catalogError(ErrUnsupported, "common.unsupported_network", "network", network)
+	}
+	addr := server
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		addr = net.JoinHostPort(normalizeHost(server), "53")
+	}
+	r := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+	return r, addr, nil
+}
+
+// DNSRecord is one answer to a resolve query
+type DNSRecord struct {
+	Type     string `json:"type"`
+	Value    string `json:"value"`
+	Priority int    `json:"priority,omitempty"` // SRV and MX
+	Weight   int    `json:"weight,omitempty"`   // SRV
+	Port     int    `json:"port,omitempty"`     // SRV
+}
+
+// dnsLookup runs one query of the given type
+func dnsLookup(ctx context.Context, r *net.Resolver, name, typ string) ([]DNSRecord, error) {
+	records := []DNSRecord{}
+	switch typ {
+	case "A", "AAAA":
+		network := "ip4"
+		if typ == "AAAA" {
+			network = "ip6"
+		}
+		ips, err := r.LookupIP(ctx, network, name)
+		for _, ip := range ips {
+			records = append(records, DNSRecord{Type: typ, Value: ip.String()})
+		}
+		return records, err
+	case "TXT":
+		txts, err := r.LookupTXT(ctx, name)
+		for _, txt := range txts {
+			records = append(records, DNSRecord{Type: typ, Value: txt})
+		}
+		return records, err
+	case "SRV":
+		// name is the full "_service._proto.domain" name
+		_, srvs, err := r.LookupSRV(ctx, "", "", name)
+		for _, srv := range srvs {
+			records = append(records, DNSRecord{
+				Type: typ, Value: srv.Target, Priority: int(srv.Priority), Weight: int(srv.Weight), Port: int(srv.Port),
+			})
+		}
+		return records, err
+	case "CNAME":
+		cname, err := r.LookupCNAME(ctx, name)
+		if err == nil {
+			records = append(records, DNSRecord{Type: typ, Value: cname})
+		}
+		return records, err
+	case "MX":
+		mxs, err := r.LookupMX(ctx, name)
+		for _, mx := range mxs {
+			records = append(records, DNSRecord{Type: typ, Value: mx.Host, Priority: int(mx.Pref)})
+		}
+		return records, err
+	}
+	return records, catalogError(ErrUnsupported, "dns.unsupported_record_type", "type", typ)
+}
+
+// dnsErrorData describes a failed lookup; NXDOMAIN is an answer too, so
+// it is reported as not_found rather than as a resolver failure
+func dnsErrorData(err error, server string) map[string]interface{} {
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) {
+		return map[string]interface{}{"error": err.Error()}
+	}
+	if server != "system" {
+		// The resolver names the system server it was asked to dial, not ours
+		dnsErr.Server = server
+	}
+	return map[string]interface{}{
+		"error":     dnsErr.Error(),
+		"not_found": dnsErr.IsNotFound,
+		"timeout":   dnsErr.IsTimeout,
+	}
+}
+
+func dnsTimeout(ms int) time.Duration {
+	if ms > 0 {
+		return time.Duration(ms) * time.Millisecond
+	}
+	return defaultDNSTimeout
+}
+
+type ResolvePayload struct {
+	Name      string   `json:"name" required:"true"`
+	Types     []string `json:"types"`   // "A", "AAAA", "TXT", "SRV", "CNAME", "MX"; default A and AAAA
+	Server    string   `json:"server"`  // resolver address, empty for the system resolver
+	Network   string   `json:"network"` // "udp" (default), "tcp"
+	TimeoutMs int      `json:"timeout_ms"`
+}
+
+func handleResolve(payload json.RawMessage, writer *Output) {
+	var p ResolvePayload
+	if err := json.Unmarshal(payload, &p); err != nil || p.Name == "" {
+		sendErrorCode(writer, ErrInvalidArgument, message("dns.resolve_requires_name"), nil)
+		return
+	}
+	if len(p.Types) == 0 {
+		p.Types = []string{"A", "AAAA"}
+	}
+	for i, typ := range p.Types {
+		p.Types[i] = strings.ToUpper(typ)
+		if !dnsTypes[p.Types[i]] {
+			sendErrorCode(writer, ErrUnsupported, message("dns.unsupported_record_type", "type", typ), nil)
+			return
+		}
+	}
+	r, server, err := dnsResolver(p.Server, p.Network)
+	if err != nil {
+		sendFailure(writer, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dnsTimeout(p.TimeoutMs))
+	defer cancel()
+	results := make(map[string]interface{}, len(p.Types))
+	records := []DNSRecord{}
+	for _, typ := range p.Types {
+		start := time.Now()
+		found, err := dnsLookup(ctx, r, p.Name, typ)
+		result := map[string]interface{}{
+			"records":     found,
+			"duration_ms": float64(time.Since(start).Microseconds()) / 1000,
+		}
+		if err != nil {
+			for k, v := range dnsErrorData(err, server) {
+				result[k] = v
+			}
+		}
+		results[typ] = result
+		records = append(records, found...)
+	}
+
+	writer.Encode(ProtocolResponse{
+		Status: "ok",
+		Data: map[string]interface{}{
+			"name":    p.Name,
+			"server":  server,
+			"records": records,
+			"results": results,
+		},
+	})
+}
+
+type ReverseLookupPayload struct {
+	IP        string `json:"ip"`
+	Server    string `json:"server"`
+	Network   string `json:"network"`
+	TimeoutMs int    `json:"timeout_ms"`
+}
+
+func handleReverseLookup(payload json.RawMessage, writer *Output) {
+	var p ReverseLookupPayload
+	if err := json.Unmarshal(payload, &p); err != nil || net.ParseIP(normalizeHost(p.IP)) == nil {
+		sendErrorCode(writer, ErrInvalidArgument, message("dns.reverse_lookup_requires_ip"), nil)
+		return
+	}
+	r, server, err := dnsResolver(p.Server, p.Network)
+	if err != nil {
+		sendFailure(writer, err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), dnsTimeout(p.TimeoutMs))
+	defer cancel()
+
+	start := time.Now()
+	names, err := r.LookupAddr(ctx, normalizeHost(p.IP))
+	data := map[string]interface{}{
+		"ip":          normalizeHost(p.IP),
+		"server":      server,
+		"names":       append([]string{}, names...),
+		"duration_ms": float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if err != nil {
+		for k, v := range dnsErrorData(err, server) {
+			data[k] = v
+		}
+	}
+	writer.Encode(ProtocolResponse{Status: "ok", Data: data})
+}
+
+// DNSBenchmarkResult is how one resolver did in dns_benchmark
+type DNSBenchmarkResult struct {
+	Server   string  `json:"server"`
+	Queries  int     `json:"queries"`
+	Answered int     `json:"answered"`
+	Failed   int     `json:"failed"`
+	MinMs    float64 `json:"min_ms"`
+	AvgMs    float64 `json:"avg_ms"`
+	MedianMs float64 `json:"median_ms"`
+	MaxMs    float64 `json:"max_ms"`
+	Error    string  `json:"error,omitempty"` // last failure
+}
+
+type DNSBenchmarkPayload struct {
+	Name      string   `json:"name"`                    // default "example.com"
+	Type      string   `json:"type"`                    // default "A"
+	Servers   []string `json:"servers" required:"true"` // "" stands for the system resolver
+	Rounds    int      `json:"rounds"`                  // queries per server, default 5
+	Uncached  bool     `json:"uncached"`                // query a random subdomain each time to defeat caches
+	Network   string   `json:"network"`
+	TimeoutMs int      `json:"timeout_ms"` // per query
+}
+
+// handleDNSBenchmark times the same query against several resolvers. The
+// resolvers are measured side by side, each query after the previous one.
+func handleDNSBenchmark(payload json.RawMessage, writer *Output) {
+	var p DNSBenchmarkPayload
+	if err := json.Unmarshal(payload, &p); err != nil || len(p.Servers) == 0 {
+		sendErrorCode(writer, ErrInvalidArgument, message("dns.benchmark_requires_servers"), nil)
+		return
+	}
+	if len(p.Servers) > maxBenchmarkServers {
+		sendErrorCode(writer, ErrInvalidArgument, message("dns.benchmark_takes_most_servers", "max_benchmark_servers", maxBenchmarkServers), nil)
+		return
+	}
+	if p.Name == "" {
+		p.Name = "example.com"
+	}
+	p.Type = strings.ToUpper(p.Type)
+	if p.Type == "" {
+		p.Type = "A"
+	}
+	if p.Rounds <= 0 {
+		p.Rounds = defaultBenchmarkRounds
+	}
+	if p.Rounds > maxBenchmarkRounds {
+		sendErrorCode(writer, ErrInvalidArgument, message("dns.rounds_must_most", "max_benchmark_rounds", maxBenchmarkRounds), nil)
+		return
+	}
+	resolvers := make([]*net.Resolver, len(p.Servers))
+	results := make([]DNSBenchmarkResult, len(p.Servers))
+	for i, server := range p.Servers {
+		r, addr, err := dnsResolver(server, p.Network)
+		if err != nil {
+			sendFailure(writer, err)
+			return
+		}
+		resolvers[i], results[i].Server = r, addr
+	}
+	if !dnsTypes[p.Type] {
+		sendErrorCode(writer, ErrUnsupported, message("dns.unsupported_record_type", "type", p.Type), nil)
+		return
+	}
+
+	var wg sync.WaitGroup
+	for i := range resolvers {
+		wg.Add(1)
+		go func(r *net.Resolver, res *DNSBenchmarkResult) {
+			defer wg.Done()
+			benchmarkResolver(r, res, p)
+		}(resolvers[i], &results[i])
+	}
+	wg.Wait()
+
+	ranked := append([]DNSBenchmarkResult{}, results...)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		if (ranked[i].Answered == 0) != (ranked[j].Answered == 0) {
+			return ranked[i].Answered > 0
+		}
+		return ranked[i].AvgMs < ranked[j].AvgMs
+	})
+	writer.Encode(ProtocolResponse{
+		Status: "ok",
+		Data: map[string]interface{}{
+			"name":    p.Name,
+			"type":    p.Type,
+			"rounds":  p.Rounds,
+			"results": ranked, // fastest first; resolvers that never answered last
+		},
+	})
+}
+
+func benchmarkResolver(r *net.Resolver, res *DNSBenchmarkResult, p DNSBenchmarkPayload) {
+	var times []float64
+	for i := 0; i < p.Rounds; i++ {
+		name := p.Name
+		if p.Uncached {
+			label := make([]byte, 6)
+			rand.Read(label)
+			name = hex.EncodeToString(label) + "." + p.Name
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), dnsTimeout(p.TimeoutMs))
+		start := time.Now()
+		_, err := dnsLookup(ctx, r, name, p.Type)
+		elapsed := float64(time.Since(start).Microseconds()) / 1000
+		cancel()
+
+		res.Queries++
+		var dnsErr *net.DNSError
+		if err != nil && !(errors.As(err, &dnsErr) && dnsErr.IsNotFound) {
+			res.Failed++
+			res.Error = dnsErrorData(err, res.Server)["error"].(string)
+			continue
+		}
+		res.Answered++
+		times = append(times, elapsed)
+	}
+	if len(times) == 0 {
+		return
+	}
+	sort.Float64s(times)
+	var sum float64
+	for _, t := range times {
+		sum += t
+	}
+	res.MinMs, res.MaxMs = times[0], times[len(times)-1]
+	res.AvgMs = sum / float64(len(times))
+	res.MedianMs = times[len(times)/2]
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// doctor runs self-tests for the support UI: can this machine bind and
+// talk over loopback, reach itself on its LAN addresses, get UDP out to
+// the internet, write to the download directory, and does its clock
+// agree with NTP. Checks run concurrently; each one reports pass, warn,
+// fail or skip with a message a human can act on.
+const (
+	defaultNTPServer     = "pool.ntp.org:123"
+	defaultDoctorTimeout = 3 * time.Second
+
+	// Clock skew beyond these breaks token expiry and makes logs hard to
+	// line up across peers
+	clockSkewWarn = 2 * time.Second
+	clockSkewFail = time.Minute
+
+	// ntpEpochOffset is the seconds from 1900, the NTP epoch, to 1970
+	ntpEpochOffset = 2208988800
+)
+
+const (
+	checkPass = "pass"
+	checkWarn = "warn"
+	checkFail = "fail"
+	checkSkip = "skip"
+)
+
+// CheckResult is the outcome of one doctor check
+type CheckResult struct {
+	Name       string                 `json:"name"`
+	Status     string                 `json:"status"` // "pass", "warn", "fail", "skip"
+	Message    string                 `json:"message"`
+	DurationMs float64                `json:"duration_ms"`
+	Details    map[string]interface{} `json:"details,omitempty"`
+}
+
+type doctorCheck struct {
+	name string
+	run  func(p DoctorPayload) CheckResult
+}
+
+// doctorChecks in report order
+var doctorChecks = []doctorCheck{
+	{"loopback_tcp", checkLoopbackTCP},
+	{"loopback_udp", checkLoopbackUDP},
+	{"lan_reachability", checkLANReachability},
+	{"outbound_udp", checkOutboundUDP},
+	{"probe", checkProbe},
+	{"download_dir", checkDownloadDir},
+	{"clock_skew", checkClockSkew},
+}
+
+type DoctorPayload struct {
+	Checks     []string `json:"checks"`      // names to run, default all
+	TimeoutMs  int      `json:"timeout_ms"`  // per check, default 3000
+	NTPServer  string   `json:"ntp_server"`  // default pool.ntp.org:123
+	STUNServer string   `json:"stun_server"` // default stun.l.google.com:19302
+	Probe      string   `json:"probe"`       // host:port that should accept TCP, e.g. a peer's listener
+
+	timeout time.Duration
+}
+
+// handleDoctor runs the selected checks and returns the report; the
+// overall status is the worst of the checks that ran
+func handleDoctor(payload json.RawMessage, writer *Output) {
+	var p DoctorPayload
+	if len(payload) > 0 && string(payload) != "null" {
+		if err := json.Unmarshal(payload, &p); err != nil {
+			sendInvalidPayload(writer, "doctor")
+			return
+		}
+	}
+	for _, name := range p.Checks {
+		if !slices.ContainsFunc(doctorChecks, func(c doctorCheck) bool { return c.name == name }) {
+			sendErrorCode(writer, ErrUnsupported, message("doctor.unsupported_check", "name", name), nil)
+			return
+		}
+	}
+	p.timeout = defaultDoctorTimeout
+	if p.TimeoutMs > 0 {
+		p.timeout = time.Duration(p.TimeoutMs) * time.Millisecond
+	}
+	if p.NTPServer == "" {
+		p.NTPServer = defaultNTPServer
+	}
+	if p.STUNServer == "" {
+		p.STUNServer = defaultSTUNServer
+	}
+
+	var selected []doctorCheck
+	for _, c := range doctorChecks {
+		if len(p.Checks) == 0 || slices.Contains(p.Checks, c.name) {
+			selected = append(selected, c)
+		}
+	}
+	results := make([]CheckResult, len(selected))
+	var wg sync.WaitGroup
+	for i, c := range selected {
+		wg.Add(1)
+		go func() {
+			defer recoverPanic("doctor check " + c.name)
+			defer wg.Done()
+			start := time.Now()
+			r := c.run(p)
+			r.Name, r.DurationMs = c.name, millis(time.Since(start))
+			results[i] = r
+		}()
+	}
+	wg.Wait()
+
+	overall := checkPass
+	counts := map[string]int{}
+	for _, r := range results {
+		counts[r.Status]++
+		if r.Status == checkFail || (r.Status == checkWarn && overall == checkPass) {
+			overall = r.Status
+		}
+	}
+	logger.Info("doctor finished", "status", overall, "failed", counts[checkFail], "warnings", counts[checkWarn])
+	writer.Encode(ProtocolResponse{
+		Status: "ok",
+		Data: map[string]interface{}{
+			"status":     overall,
+			"checks":     results,
+			"counts":     counts,
+			"version":    version,
+			"checked_at": time.Now().UTC().Format(time.RFC3339),
+		},
+	})
+}
+
+func failed(msg string, err error) CheckResult {
+	return CheckResult{Status: checkFail, Message: fmt.Sprintf("%s: %v", msg, err)}
+}
+
+// echoOnce accepts one connection on ln and writes back what it reads
+func echoOnce(ln net.Listener, timeout time.Duration) {
+	conn, err := ln.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	io.Copy(conn, conn)
+}
+
+// roundTrip dials addr, sends a probe and expects it echoed back
+func roundTrip(network, addr string, timeout time.Duration) error {
+	conn, err := net.DialTimeout(network, addr, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	probe := []byte("lumina-doctor")
+	if _, err := conn.Write(probe); err != nil {
+		return err
+	}
+	reply := make([]byte, len(probe))
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if !bytes.Equal(reply, probe) {
+		return errors.New("echo did not match")
+	}
+	return nil
+}
+
+func checkLoopbackTCP(p DoctorPayload) CheckResult {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return failed("Cannot bind a loopback TCP port", err)
+	}
+	defer ln.Close()
+	goSafe("doctor echo", func() { echoOnce(ln, p.timeout) })
+	if err := roundTrip("tcp", ln.Addr().String(), p.timeout); err != nil {
+		return failed("Loopback TCP echo failed", err)
+	}
+	return CheckResult{Status: checkPass, Message: "Bound and echoed over loopback TCP", Details: map[string]interface{}{"addr": ln.Addr().String()}}
+}
+
+func checkLoopbackUDP(p DoctorPayload) CheckResult {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return failed("Cannot bind a loopback UDP port", err)
+	}
+	defer server.Close()
+	goSafe("doctor echo", func() {
+		buf := make([]byte, 64)
+		server.SetDeadline(time.Now().Add(p.timeout))
+		n, from, err := server.ReadFrom(buf)
+		if err == nil {
+			server.WriteTo(buf[:n], from)
+		}
+	})
+	if err := roundTrip("udp", server.LocalAddr().String(), p.timeout); err != nil {
+		return failed("Loopback UDP send/receive failed", err)
+	}
+	return CheckResult{Status: checkPass, Message: "Sent and received a loopback UDP datagram"}
+}
+
+// checkLANReachability listens on all interfaces and dials in through each
+// LAN address, which catches host firewalls that drop inbound connections
+// on some interfaces
+func checkLANReachability(p DoctorPayload) CheckResult {
+	ifaces, err := listInterfaces()
+	if err != nil {
+		return failed("Cannot list interfaces", err)
+	}
+	var addrs []string
+	for _, iface := range ifaces {
+		if !iface.Up || iface.Loopback {
+			continue
+		}
+		for _, a := range iface.Addresses {
+			if ip := net.ParseIP(a.IP); ip != nil && !ip.IsLinkLocalUnicast() {
+				addrs = append(addrs, a.IP)
+			}
+		}
+	}
+	if len(addrs) == 0 {
+		return CheckResult{Status: checkSkip, Message: "No LAN address is configured"}
+	}
+
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		return failed("Cannot bind a TCP port on all interfaces", err)
+	}
+	defer ln.Close()
+	port := listenerPort(ln)
+	goSafe("doctor echo", func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			goSafe("doctor echo", func() {
+				defer conn.Close()
+				conn.SetDeadline(time.Now().Add(p.timeout))
+				io.Copy(conn, conn)
+			})
+		}
+	})
+
+	reachable := map[string]interface{}{}
+	var unreachable []string
+	for _, ip := range addrs {
+		if err := roundTrip("tcp", net.JoinHostPort(ip, fmt.Sprint(port)), p.timeout); err != nil {
+			reachable[ip] = err.Error()
+			unreachable = append(unreachable, ip)
+		} else {
+			reachable[ip] = "ok"
+		}
+	}
+	details := map[string]interface{}{"port": port, "addresses": reachable}
+	switch {
+	case len(unreachable) == 0:
+		return CheckResult{Status: checkPass, Message: fmt.Sprintf("Reachable on %d LAN address(es)", len(addrs)), Details: details}
+	case len(unreachable) == len(addrs):
+		return CheckResult{Status: checkFail, Message: "Not reachable on any LAN address; a firewall may block inbound connections", Details: details}
+	}
+	return CheckResult{Status: checkWarn, Message: fmt.Sprintf("Not reachable on %v", unreachable), Details: details}
+}
+
+// checkOutboundUDP asks a STUN server for our public address, which needs
+// UDP out and back through any firewall and NAT
+func checkOutboundUDP(p DoctorPayload) CheckResult {
+	server, err := net.ResolveUDPAddr("udp4", p.STUNServer)
+	if err != nil {
+		return CheckResult{Status: checkWarn, Message: fmt.Sprintf("Cannot resolve %s: %v", p.STUNServer, err)}
+	}
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return failed("Cannot open a UDP socket", err)
+	}
+	defer conn.Close()
+	public, err := stunRequest(conn, server, p.timeout)
+	if err != nil {
+		return CheckResult{Status: checkWarn, Message: fmt.Sprintf("No STUN reply from %s: %v", p.STUNServer, err)}
+	}
+	return CheckResult{Status: checkPass, Message: "UDP reaches the internet", Details: map[string]interface{}{"public_addr": public.String(), "server": p.STUNServer}}
+}
+
+func checkProbe(p DoctorPayload) CheckResult {
+	if p.Probe == "" {
+		return CheckResult{Status: checkSkip, Message: "No probe address given"}
+	}
+	conn, err := net.DialTimeout("tcp", p.Probe, p.timeout)
+	if err != nil {
+		return failed("Cannot connect to "+p.Probe, err)
+	}
+	conn.Close()
+	return CheckResult{Status: checkPass, Message: "Connected to " + p.Probe}
+}
+
+func checkDownloadDir(DoctorPayload) CheckResult {
+	dir := defaultDownloadDir()
+	details := map[string]interface{}{"dir": dir}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		r := failed("Cannot create the download directory", err)
+		r.Details = details
+		return r
+	}
+	f, err := os.CreateTemp(dir, ".lumina-doctor-*")
+	if err == nil {
+		_, err = f.Write([]byte("lumina-doctor"))
+		if serr := f.Sync(); err == nil {
+			err = serr
+		}
+		f.Close()
+		os.Remove(f.Name())
+	}
+	if err != nil {
+		r := failed("Cannot write to the download directory", err)
+		r.Details = details
+		return r
+	}
+	return CheckResult{Status: checkPass, Message: "Download directory is writable", Details: details}
+}
+
+func checkClockSkew(p DoctorPayload) CheckResult {
+	offset, err := ntpOffset(p.NTPServer, p.timeout)
+	if err != nil {
+		return CheckResult{Status: checkWarn, Message: fmt.Sprintf("Cannot query %s: %v", p.NTPServer, err)}
+	}
+	details := map[string]interface{}{"offset_ms": millis(offset), "server": p.NTPServer}
+	skew := offset.Abs()
+	switch {
+	case skew >= clockSkewFail:
+		return CheckResult{Status: checkFail, Message: fmt.Sprintf("Clock is off by %s", skew.Round(time.Second)), Details: details}
+	case skew >= clockSkewWarn:
+		return CheckResult{Status: checkWarn, Message: fmt.Sprintf("Clock is off by %s", skew.Round(time.Millisecond)), Details: details}
+	}
+	return CheckResult{Status: checkPass, Message: "Clock agrees with NTP", Details: details}
+}
+
+// ntpOffset runs one SNTP exchange and returns how far the server's clock
+// is ahead of ours
+func ntpOffset(server string, timeout time.Duration) (time.Duration, error) {
+	conn, err := net.DialTimeout("udp", server, timeout)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	req := make([]byte, 48)
+	req[0] = 0x23 // leap 0, version 4, mode 3 (client)
+	sent := time.Now()
+	putNTPTime(req[40:], sent)
+	if _, err := conn.Write(req); err != nil {
+		return 0, err
+	}
+	resp := make([]byte, 48)
+	n, err := conn.Read(resp)
+	received := time.Now()
+	if err != nil {
+		return 0, err
+	}
+	if n < 48 || resp[0]&0x07 != 4 {
+		return 0, errors.New("not an NTP server reply")
+	}
+	if resp[1] == 0 {
+		return 0, errors.New("server is not synchronized")
+	}
+	t2, t3 := ntpTime(resp[32:]), ntpTime(resp[40:])
+	return (t2.Sub(sent) + t3.Sub(received)) / 2, nil
+}
+
+func ntpTime(b []byte) time.Time {
+	secs := int64(binary.BigEndian.Uint32(b)) - ntpEpochOffset
+	frac := int64(binary.BigEndian.Uint32(b[4:]))
+	return time.Unix(secs, frac*1e9>>32)
+}
+
+func putNTPTime(b []byte, t time.Time) {
+	binary.BigEndian.PutUint32(b, uint32(t.Unix()+ntpEpochOffset))
+	binary.BigEndian.PutUint32(b[4:], uint32((int64(t.Nanosecond())<<32)/1e9))
+}
@@ -0,0 +1,547 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// download_url fetches an HTTP(S) URL into the download directory as a
+// receive transfer, so it reports transfer_progress, stops with cancel and
+// lands in the history like one from a peer. When the server takes ranges
+// the body can come in several segments at once, and a failed or canceled
+// download continues with resume_transfer from what is on disk: the .part
+// file's sidecar records each segment's progress and the validators the
+// server sent, and a body that changed since starts over. The finished
+// file is checked against an expected digest when one is given and then
+// goes through the receive policy.
+const (
+	maxDownloadSegments = 16
+	minDownloadSegment  = 1 << 20
+	downloadCheckpoint  = time.Second
+)
+
+type DownloadURLPayload struct {
+	URL         string            `json:"url"`
+	Name        string            `json:"name"` // default the last element of the URL path
+	Dir         string            `json:"dir"`  // default the download directory
+	Headers     map[string]string `json:"headers"`
+	Segments    int               `json:"segments"` // ranges fetched at once, default 1
+	BytesPerSec int64             `json:"bytes_per_sec"`
+	Algorithm   string            `json:"algorithm"` // of expected, default sha256
+	Expected    string            `json:"expected"`  // digest the file must have
+	Proxy       string            `json:"proxy"`     // proxy URL, or "direct" to skip the configured proxy
+	TimeoutMs   int               `json:"timeout_ms"`
+
+	Schedule *ScheduleSpec `json:"schedule"` // run later or repeatedly instead of now
+	Priority string        `json:"priority"` // "low", "normal" (default) or "high", see priority.go
+}
+
+func handleDownloadURL(payload json.RawMessage, writer *Output) {
+	var p DownloadURLPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		sendInvalidPayload(writer, "download_url")
+		return
+	}
+	u, err := url.Parse(p.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		sendErrorCode(writer, ErrInvalidArgument, message("download.download_url_requires_http"), nil)
+		return
+	}
+	if p.Segments < 0 || p.Segments > maxDownloadSegments {
+		sendErrorCode(writer, ErrInvalidArgument, message("download.segments_must_between", "max_download_segments", maxDownloadSegments), nil)
+		return
+	}
+	if p.BytesPerSec < 0 {
+		sendErrorCode(writer, ErrInvalidArgument, message("common.bytes_per_sec_must"), nil)
+		return
+	}
+	if !validPriority(p.Priority) {
+		sendErrorCode(writer, ErrInvalidArgument, message("priority.priority_must_low"), nil)
+		return
+	}
+	if p.Algorithm == "" {
+		p.Algorithm = hashSHA256
+	}
+	if _, err := newHasher(p.Algorithm); err != nil {
+		sendFailure(writer, err)
+		return
+	}
+	if err := validProxy(p.Proxy, "tcp"); err != nil {
+		sendFailure(writer, err)
+		return
+	}
+	if p.Schedule != nil {
+		scheduleCommand(writer, "download_url", payload, *p.Schedule)
+		return
+	}
+
+	name := p.Name
+	if name == "" {
+		name = path.Base(u.Path)
+		if name == "/" || name == "." {
+			name = u.Hostname()
+		}
+	}
+	name, err = incomingName(name)
+	if err != nil {
+		sendFailure(writer, err)
+		return
+	}
+	dir := downloadDirFor(p.Dir)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		sendError(writer, message("common.failed_create", "dir", dir, "error", err))
+		return
+	}
+	dest, err := downloadPath(filepath.Join(dir, name), p.URL)
+	if err != nil {
+		sendFailure(writer, err)
+		return
+	}
+	startDownload(writer, p, name, dest, "")
+}
+
+// startDownload registers a download transfer and runs it in the background
+func startDownload(writer *Output, p DownloadURLPayload, name, dest, resumes string) {
+	u, _ := url.Parse(p.URL)
+	t := newTransferAt(p.Priority, "receive", name, dest, u.Host, 0)
+	setScope(t.ID, writer.Namespace())
+	t.download = &p
+	t.mu.Lock()
+	t.URL = p.URL
+	t.Resumes = resumes
+	t.mu.Unlock()
+
+	writer.Encode(okResponse(message("download.download_started"), t.Info()))
+
+	ctx, done := trackJob(t.ID, "transfer", p.URL)
+	go func() {
+		defer recoverTransfer(t)
+		defer done()
+		err := downloadURL(ctx, t, p)
+		if errors.Is(err, errResumeMismatch) {
+			// The server's copy changed or it stopped taking ranges
+			logger.Info("download changed, starting over", "id", t.ID, "url", p.URL)
+			os.Remove(dest + ".part")
+			os.Remove(dest + partialSuffix)
+			t.bytes.Store(0)
+			err = downloadURL(ctx, t, p)
+		}
+		t.finish(canceled(ctx, err))
+	}()
+}
+
+// downloadPath picks the file a download of rawURL goes to: one with an
+// unfinished download of the same URL, else the first free name like
+// uniquePath's
+func downloadPath(base, rawURL string) (string, error) {
+	ext := filepath.Ext(base)
+	stem := strings.TrimSuffix(base, ext)
+	for i := 0; i < 10000; i++ {
+		candidate := base
+		if i > 0 {
+			candidate = fmt.Sprintf("%s (%d)%s", stem, i, ext)
+		}
+		if st, err := loadDownloadState(candidate); err == nil {
+			if st.URL == rawURL {
+				return candidate, nil
+			}
+			continue
+		}
+		_, errFile := os.Lstat(candidate)
+		_, errPart := os.Lstat(candidate + ".part")
+		if os.IsNotExist(errFile) && os.IsNotExist(errPart) {
+			return candidate, nil
+		}
+	}
+	return "", errors.New("too many files named " + filepath.Base(base))
+}
+
+// downloadState is the sidecar of an unfinished download, saved beside
+// its .part file
+type downloadState struct {
+	URL          string            `json:"url"`
+	ETag         string            `json:"etag,omitempty"`
+	LastModified string            `json:"last_modified,omitempty"`
+	Size         int64             `json:"size"` // -1 when the server did not say
+	Segments     []downloadSegment `json:"segments"`
+	UpdatedAt    time.Time         `json:"updated_at"`
+
+	mu sync.Mutex
+}
+
+// downloadSegment is one range of the body
+type downloadSegment struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"` // exclusive; -1 runs to the end of the body
+	Done  int64 `json:"done"`
+}
+
+func loadDownloadState(dest string) (*downloadState, error) {
+	data, err := os.ReadFile(dest + partialSuffix)
+	if err != nil {
+		return nil, err
+	}
+	var st downloadState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return nil, err
+	}
+	if st.URL == "" || len(st.Segments) == 0 {
+		return nil, errors.New("not a download")
+	}
+	return &st, nil
+}
+
+// save writes the sidecar atomically, like partialState.save
+func (st *downloadState) save(dest string) error {
+	// Held throughout so the checkpoint ticker and the last save do not
+	// write the temporary file at once
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.UpdatedAt = time.Now()
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	sidecar := dest + partialSuffix
+	if err := os.WriteFile(sidecar+".tmp", data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(sidecar+".tmp", sidecar)
+}
+
+func (st *downloadState) done() int64 {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	var n int64
+	for _, s := range st.Segments {
+		n += s.Done
+	}
+	return n
+}
+
+func (st *downloadState) segment(i int) downloadSegment {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.Segments[i]
+}
+
+func (st *downloadState) advance(i int, n int64) {
+	st.mu.Lock()
+	st.Segments[i].Done += n
+	st.mu.Unlock()
+}
+
+// remoteFile is what a HEAD request tells about the body
+type remoteFile struct {
+	size         int64
+	ranges       bool
+	etag         string
+	lastModified string
+}
+
+// newDownloadState splits a body of the probed size into up to segments
+// ranges of at least minDownloadSegment
+func newDownloadState(rawURL string, rf remoteFile, segments int) *downloadState {
+	st := &downloadState{URL: rawURL, ETag: rf.etag, LastModified: rf.lastModified, Size: rf.size}
+	n := 1
+	if rf.ranges && rf.size > 0 {
+		n = int(min(int64(max(segments, 1)), max(rf.size/minDownloadSegment, 1)))
+	}
+	if n == 1 {
+		st.Segments = []downloadSegment{{End: rf.size}}
+		return st
+	}
+	per := rf.size / int64(n)
+	for i := range n {
+		end := int64(i+1) * per
+		if i == n-1 {
+			end = rf.size
+		}
+		st.Segments = append(st.Segments, downloadSegment{Start: int64(i) * per, End: end})
+	}
+	return st
+}
+
+// downloadClient dials through the configured or given proxy like every
+// other outbound TCP dial
+func downloadClient(proxy string, timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{Timeout: timeout}
+	return &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			u, err := proxyFor(proxy, addr)
+			if err != nil {
+				return nil, err
+			}
+			if u != nil {
+				return dialProxy(u, addr, timeout)
+			}
+			return dialer.DialContext(ctx, network, addr)
+		},
+		TLSHandshakeTimeout:   timeout,
+		ResponseHeaderTimeout: timeout,
+	}}
+}
+
+func newDownloadRequest(ctx context.Context, method string, p DownloadURLPayload) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, p.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "lumina-net/"+version)
+	for k, v := range p.Headers {
+		req.Header.Set(k, v)
+	}
+	return req, nil
+}
+
+// probe asks for the body's size and validators; a server that refuses
+// HEAD gets a single plain GET
+func probe(ctx context.Context, client *http.Client, p DownloadURLPayload) remoteFile {
+	rf := remoteFile{size: -1}
+	req, err := newDownloadRequest(ctx, http.MethodHead, p)
+	if err != nil {
+		return rf
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return rf
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return rf
+	}
+	rf.size = resp.ContentLength
+	rf.ranges = resp.Header.Get("Accept-Ranges") == "bytes" && resp.Header.Get("Content-Encoding") == ""
+	rf.etag = resp.Header.Get("ETag")
+	rf.lastModified = resp.Header.Get("Last-Modified")
+	return rf
+}
+
+// downloadURL fetches p.URL into t's .part file, continuing what an
+// earlier attempt left there, and gives the file its final name
+func downloadURL(ctx context.Context, t *Transfer, p DownloadURLPayload) error {
+	timeout := defaultDialTimeout
+	if p.TimeoutMs > 0 {
+		timeout = time.Duration(p.TimeoutMs) * time.Millisecond
+	}
+	client := downloadClient(p.Proxy, timeout)
+	dest := t.Info().Path
+	partial := dest + ".part"
+
+	rf := probe(ctx, client, p)
+	st, err := loadDownloadState(dest)
+	if err == nil && (st.URL != p.URL || st.Size != rf.size || st.ETag != rf.etag || st.LastModified != rf.lastModified ||
+		(len(st.Segments) > 1 && !rf.ranges)) {
+		logger.Info("download changed since the last attempt", "id", t.ID, "url", p.URL)
+		err = errResumeMismatch
+	}
+	if err != nil {
+		st = newDownloadState(p.URL, rf, p.Segments)
+		os.Remove(partial)
+	}
+	if err := checkStorage(filepath.Dir(dest), max(st.Size, 0)-st.done(), t.Peer); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	t.Size = max(st.Size, 0)
+	if n := st.done(); n > 0 {
+		t.ResumedFrom = n
+	}
+	t.mu.Unlock()
+	t.bytes.Store(st.done())
+
+	f, err := os.OpenFile(partial, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := st.save(dest); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	limiter := newRateLimiter(p.BytesPerSec)
+	done := make(chan struct{})
+	go t.reportProgress(done)
+	goSafe("download checkpoints "+t.ID, func() {
+		ticker := time.NewTicker(downloadCheckpoint)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				st.save(dest)
+			}
+		}
+	})
+
+	errs := make(chan error, len(st.Segments))
+	for i := range st.Segments {
+		go func() {
+			err := callSafe("download "+t.ID, func() error {
+				return fetchSegment(ctx, client, p, st, i, f, limiter, t)
+			})
+			if err != nil {
+				cancel() // one failed range fails the download
+			}
+			errs <- err
+		}()
+	}
+	for range st.Segments {
+		if e := <-errs; e != nil && (err == nil || errors.Is(err, context.Canceled)) {
+			err = e
+		}
+	}
+	close(done)
+	if serr := st.save(dest); err == nil {
+		err = serr
+	}
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+
+	size := st.done()
+	t.mu.Lock()
+	t.Size = size
+	t.mu.Unlock()
+	sum, actual, err := digestDownload(f, p.Algorithm)
+	if err != nil {
+		return err
+	}
+	expected := strings.ToLower(p.Expected)
+	if expected != "" && actual != expected {
+		os.Remove(partial)
+		os.Remove(dest + partialSuffix)
+		emitVerifyFailed(t, dest, p.Algorithm, expected, actual)
+		return &checksumError{name: t.Name, expected: expected, actual: actual}
+	}
+	t.mu.Lock()
+	t.SHA256 = sum
+	t.mu.Unlock()
+	f.Close()
+	os.Remove(dest + partialSuffix)
+	return finalizeReceived(t, partial, dest)
+}
+
+// fetchSegment fetches what is left of segment i and writes it in place
+func fetchSegment(ctx context.Context, client *http.Client, p DownloadURLPayload, st *downloadState, i int,
+	f *os.File, limiter *RateLimiter, t *Transfer) error {
+	seg := st.segment(i)
+	from := seg.Start + seg.Done
+	if seg.End >= 0 && from >= seg.End {
+		return nil
+	}
+	req, err := newDownloadRequest(ctx, http.MethodGet, p)
+	if err != nil {
+		return err
+	}
+	ranged := from > 0 || (seg.End >= 0 && seg.End != st.Size)
+	if ranged {
+		if seg.End >= 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", from, seg.End-1))
+		} else {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", from))
+		}
+		// A changed body comes back whole instead of the range
+		if st.ETag != "" {
+			req.Header.Set("If-Range", st.ETag)
+		} else if st.LastModified != "" {
+			req.Header.Set("If-Range", st.LastModified)
+		}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case ranged && resp.StatusCode == http.StatusPartialContent:
+	case !ranged && resp.StatusCode == http.StatusOK:
+	case ranged && resp.StatusCode == http.StatusOK:
+		return errResumeMismatch
+	default:
+		return fmt.Errorf("server answered %s", resp.Status)
+	}
+
+	buf := make([]byte, transferBufferSize)
+	off := from
+	for {
+		n, rerr := resp.Body.Read(buf)
+		if seg.End >= 0 {
+			n = int(min(int64(n), seg.End-off))
+		}
+		if n > 0 {
+			limiter.WaitN(n)
+			if _, err := f.WriteAt(buf[:n], off); err != nil {
+				return err
+			}
+			off += int64(n)
+			st.advance(i, int64(n))
+			t.Add(n)
+		}
+		if seg.End >= 0 && off >= seg.End {
+			return nil
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			return rerr
+		}
+	}
+	if seg.End >= 0 {
+		return fmt.Errorf("connection closed after %d of %d bytes", off-seg.Start, seg.End-seg.Start)
+	}
+	return nil
+}
+
+// digestDownload hashes the finished file with SHA-256, which transfers
+// record, and with algorithm for the expected digest
+func digestDownload(f *os.File, algorithm string) (sum, actual string, err error) {
+	h := sha256.New()
+	other, err := newHasher(algorithm)
+	if err != nil {
+		return "", "", err
+	}
+	w := io.Writer(h)
+	if algorithm != hashSHA256 {
+		w = io.MultiWriter(h, other)
+	}
+	if _, err := io.CopyBuffer(w, io.NewSectionReader(f, 0, 1<<62), make([]byte, transferBufferSize)); err != nil {
+		return "", "", err
+	}
+	sum = hex.EncodeToString(h.Sum(nil))
+	if algorithm == hashSHA256 {
+		return sum, sum, nil
+	}
+	return sum, hex.EncodeToString(other.Sum(nil)), nil
+}
+
+// resumeDownload retries a failed or canceled download from its .part file
+func resumeDownload(t *Transfer, writer *Output) {
+	info := t.Info()
+	if info.State != "failed" && info.State != "canceled" {
+		sendErrorCode(writer, ErrInvalidState, message("resume.transfer_not_failed_canceled", "state", info.State), nil)
+		return
+	}
+	startDownload(writer, *t.download, info.Name, info.Path, t.ID)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDownloadURLSegmentsAndResume(t *testing.T) {
+	body := make([]byte, 3<<20+123)
+	rand.Read(body)
+	sum := sha256.Sum256(body)
+	var mu sync.Mutex
+	var ranges []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			mu.Lock()
+			ranges = append(ranges, r.Header.Get("Range"))
+			mu.Unlock()
+		}
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "blob.bin", time.Time{}, bytes.NewReader(body))
+	}))
+	defer srv.Close()
+	dir := t.TempDir()
+
+	p := DownloadURLPayload{URL: srv.URL + "/blob.bin", Segments: 3, Algorithm: hashSHA256, Expected: hex.EncodeToString(sum[:])}
+	dest := filepath.Join(dir, "blob.bin")
+	tr := newTransfer("receive", "blob.bin", dest, "", 0)
+	err := downloadURL(context.Background(), tr, p)
+	tr.finish(err)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(dest); !bytes.Equal(got, body) {
+		t.Fatal("downloaded file differs")
+	}
+	if len(ranges) != 3 || tr.Info().SHA256 != p.Expected {
+		t.Errorf("ranges %q, sha256 %s", ranges, tr.Info().SHA256)
+	}
+	if _, err := os.Stat(dest + partialSuffix); !os.IsNotExist(err) {
+		t.Error("sidecar left behind")
+	}
+
+	// An earlier attempt got the first megabyte of a single segment
+	dest = filepath.Join(dir, "again.bin")
+	if err := os.WriteFile(dest+".part", body[:1<<20], 0o644); err != nil {
+		t.Fatal(err)
+	}
+	st := &downloadState{URL: p.URL, ETag: `"v1"`, Size: int64(len(body)), Segments: []downloadSegment{{End: int64(len(body)), Done: 1 << 20}}}
+	if err := st.save(dest); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := downloadPath(dest, p.URL); err != nil || got != dest {
+		t.Fatalf("download path %s, %v", got, err)
+	}
+	ranges = nil
+	tr = newTransfer("receive", "again.bin", dest, "", 0)
+	err = downloadURL(context.Background(), tr, p)
+	tr.finish(err)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(dest); !bytes.Equal(got, body) {
+		t.Fatal("resumed file differs")
+	}
+	if len(ranges) != 1 || ranges[0] != "bytes=1048576-3145850" {
+		t.Errorf("resume ranges %q", ranges)
+	}
+	if tr.Info().ResumedFrom != 1<<20 {
+		t.Errorf("resumed from %d", tr.Info().ResumedFrom)
+	}
+
+	p.Expected = "00"
+	tr = newTransfer("receive", "bad.bin", filepath.Join(dir, "bad.bin"), "", 0)
+	err = downloadURL(context.Background(), tr, p)
+	tr.finish(err)
+	if !errors.Is(err, errChecksumMismatch) {
+		t.Errorf("bad digest gave %v", err)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Draining: a plain stop_server closes the listening socket and leaves
+// the connections it accepted to run on. With drain it also winds them
+// down: chat peers are told the server is closing, and every connection
+// gets timeout_ms to end on its own. Whatever is still open then has its
+// pausable transfers paused, which tells the sender where to pick up with
+// resume_transfer, its mux links sent a go-away, and is closed. The
+// server_drained event says how it went.
+const drainPollInterval = 100 * time.Millisecond
+
+type StopServerPayload struct {
+	ListenerRef
+	Drain     bool `json:"drain"`      // wind the listener's connections down too
+	TimeoutMs int  `json:"timeout_ms"` // how long drain waits for them, default 5000
+}
+
+// DrainReport is the payload of server_drained
+type DrainReport struct {
+	ListenerID   string `json:"listener_id"`
+	Addr         string `json:"addr"`
+	Connections  int    `json:"connections"`
+	Closed       int    `json:"closed"`       // ended on their own
+	Checkpointed int    `json:"checkpointed"` // transfers paused before the close
+	ForceClosed  int    `json:"force_closed"`
+	WaitedMs     int64  `json:"waited_ms"`
+}
+
+// listenerConnsLocked lists the connections a listener accepted, streams
+// of its mux links included; the caller holds state.Mutex
+func listenerConnsLocked(l *Listener) []*Connection {
+	var conns []*Connection
+	for _, c := range state.Conns {
+		if c.ListenerID == l.ID {
+			conns = append(conns, c)
+		}
+	}
+	return conns
+}
+
+// openConns keeps the connections still tracked
+func openConns(conns []*Connection) []*Connection {
+	state.Mutex.Lock()
+	defer state.Mutex.Unlock()
+	var open []*Connection
+	for _, c := range conns {
+		if _, ok := state.Conns[c.ID]; ok {
+			open = append(open, c)
+		}
+	}
+	return open
+}
+
+// notifyClosing tells a peer that can understand it that the connection
+// ends within timeout
+func notifyClosing(c *Connection, timeout time.Duration) {
+	if !c.speaksChat() {
+		return
+	}
+	frame, _ := json.Marshal(chatFrame{
+		Type: "closing", ID: fmt.Sprintf("closing-%d", chatSeq.Add(1)), From: senderName(),
+		Text: "Server is shutting down", Within: timeout.Milliseconds(),
+	})
+	c.Write(append(frame, '\n'))
+}
+
+// drainConns waits up to timeout for conns to close and then ends the
+// rest as gently as each allows
+func drainConns(report DrainReport, conns []*Connection, timeout time.Duration) DrainReport {
+	start := time.Now()
+	report.Connections = len(conns)
+	for _, c := range conns {
+		notifyClosing(c, timeout)
+	}
+	deadline := start.Add(timeout)
+	open := openConns(conns)
+	for len(open) > 0 && time.Now().Before(deadline) {
+		time.Sleep(min(drainPollInterval, time.Until(deadline)))
+		open = openConns(open)
+	}
+
+	if len(open) > 0 {
+		stuck := make(map[*Connection]bool, len(open))
+		for _, c := range open {
+			stuck[c] = true
+		}
+		for _, t := range activeTransfers() {
+			if c := t.pauseConn(); c != nil && stuck[c] && t.setPaused("local", true) == nil {
+				report.Checkpointed++
+			}
+		}
+		// Closed after unlocking: a close writes a goaway, which can block
+		// on a slow link and would hold up every other lookup meanwhile
+		var links []*muxSession
+		muxMu.Lock()
+		for _, m := range muxes {
+			for c := range stuck {
+				if m.ConnID == c.ID {
+					links = append(links, m.session)
+				}
+			}
+		}
+		muxMu.Unlock()
+		for _, session := range links {
+			session.Close()
+		}
+		for _, c := range open {
+			c.Abort()
+		}
+	}
+	report.ForceClosed = len(open)
+	report.Closed = report.Connections - report.ForceClosed
+	report.WaitedMs = time.Since(start).Milliseconds()
+	return report
+}
+
+// pauseConn is the connection a pausable transfer streams over, nil when
+// it cannot be paused
+func (t *Transfer) pauseConn() *Connection {
+	g := &t.pause
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.enabled {
+		return nil
+	}
+	return g.conn
+}
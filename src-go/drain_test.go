@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDrainClosesWhatOutstaysTheTimeout(t *testing.T) {
+	var conns []*Connection
+	state.Mutex.Lock()
+	for _, id := range []string{"drain-quick", "drain-slow"} {
+		a, b := net.Pipe()
+		defer b.Close()
+		c := &Connection{ID: id, Direction: "inbound", Network: "tcp", Created: time.Now(), Limiter: newRateLimiter(0), ListenerID: "drain-ln"}
+		c.setConn(a)
+		state.Conns[id] = c
+		conns = append(conns, c)
+	}
+	state.Mutex.Unlock()
+	quick, slow := conns[0], conns[1]
+	untrack := func(c *Connection) {
+		state.Mutex.Lock()
+		delete(state.Conns, c.ID)
+		state.Mutex.Unlock()
+	}
+	defer untrack(slow)
+
+	tr := newTransfer("receive", "movie.mkv", "", "peer:1", 1)
+	defer tr.finish(nil)
+	tr.enablePause(slow, func(bool) error { return nil })
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		untrack(quick)
+	}()
+	report := drainConns(DrainReport{ListenerID: "drain-ln"}, conns, 300*time.Millisecond)
+	if report.Connections != 2 || report.Closed != 1 || report.ForceClosed != 1 {
+		t.Errorf("drain reported %+v", report)
+	}
+	if local, _ := tr.pausedBy(); !local || report.Checkpointed != 1 {
+		t.Errorf("transfer on the force-closed connection not paused first: %+v", report)
+	}
+	if !slow.closing.Load() {
+		t.Error("the connection that outstayed the timeout was left open")
+	}
+	if report.WaitedMs < 300 {
+		t.Errorf("drain gave up after %dms", report.WaitedMs)
+	}
+}
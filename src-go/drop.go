@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/grandcat/zeroconf"
+)
+
+// Drop mode turns a transfer listener into an advertised inbox: every
+// incoming file or directory is held as an offer until accept_offer or
+// reject_offer answers it. Senders mark their header as an offer and wait
+// for that answer before streaming anything.
+const (
+	dropService         = "_lumina-drop._tcp"
+	defaultOfferTimeout = 60 * time.Second
+	// senders wait longer than any receiver so the receiver's verdict,
+	// including a timeout, is what ends the offer
+	defaultOfferSenderWait = 5 * time.Minute
+)
+
+var (
+	errOfferRejected = errors.New("offer rejected")
+	errOfferExpired  = errors.New("offer timed out")
+	errOffersOnly    = errors.New("receiver only accepts offers")
+	errNotDiscovered = errors.New("sender is not a discovered peer")
+)
+
+// DropOptions makes a transfer listener hold transfers as offers
+type DropOptions struct {
+	OfferTimeoutMs int  `json:"offer_timeout_ms"` // how long an offer waits for an answer
+	DiscoveredOnly bool `json:"discovered_only"`  // refuse senders not seen through discovery
+}
+
+func (o DropOptions) timeout() time.Duration {
+	if o.OfferTimeoutMs > 0 {
+		return time.Duration(o.OfferTimeoutMs) * time.Millisecond
+	}
+	return defaultOfferTimeout
+}
+
+// offerDecision is how accept_offer and reject_offer answer an offer
+type offerDecision struct {
+	accept bool
+	dest   receiveDest // overrides the listener's download directory or storage when set
+	reason string
+}
+
+// Offer is a transfer waiting for the user to accept or reject it
+type Offer struct {
+	ID       string    `json:"id"`
+	Listener string    `json:"listener"`
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Files    int       `json:"files,omitempty"` // set for directories
+	From     string    `json:"from,omitempty"`  // name the sender announced
+	Peer     string    `json:"peer,omitempty"`  // discovered instance the sender's address belongs to
+	Remote   string    `json:"remote"`
+	Created  time.Time `json:"created"`
+	Expires  time.Time `json:"expires"`
+
+	decision chan offerDecision
+}
+
+var (
+	offerSeq atomic.Uint64
+	offersMu sync.Mutex
+	offers   = make(map[string]*Offer)
+)
+
+// answerOffer deals with the offer stage of an incoming header and returns
+// the directory to receive into. Plain listeners accept offers at once;
+// drop listeners ask the user and refuse anything that is not an offer.
+func answerOffer(c *Connection, header TransferHeader, dest receiveDest) (receiveDest, error) {
+	l := c.server
+	if l == nil || l.Drop == nil {
+		if header.Offer {
+			writeAck(c, nil)
+		}
+		return dest, nil
+	}
+	if !header.Offer {
+		return dest, errOffersOnly
+	}
+
+	remote := c.Info().RemoteAddr
+	peer, known := discoveredPeer(remote)
+	if l.Drop.DiscoveredOnly && !known {
+		return dest, errNotDiscovered
+	}
+
+	timeout := l.Drop.timeout()
+	o := &Offer{
+		ID:       fmt.Sprintf("offer-%d", offerSeq.Add(1)),
+		Listener: l.Addr,
+		Name:     header.Name,
+		Size:     header.Size,
+		From:     header.From,
+		Peer:     peer,
+		Remote:   remote,
+		Created:  time.Now(),
+		Expires:  time.Now().Add(timeout),
+		decision: make(chan offerDecision, 1),
+	}
+	if header.Manifest != nil {
+		o.Files, _ = header.Manifest.Totals()
+	}
+
+	offersMu.Lock()
+	offers[o.ID] = o
+	offersMu.Unlock()
+	defer func() {
+		offersMu.Lock()
+		delete(offers, o.ID)
+		offersMu.Unlock()
+	}()
+
+	logger.Info("incoming offer", "id", o.ID, "name", o.Name, "size", o.Size, "remote", remote)
+	emitEvent("incoming_offer", o)
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case d := <-o.decision:
+		if !d.accept {
+			emitEvent("offer_rejected", map[string]interface{}{"id": o.ID, "reason": d.reason})
+			if d.reason != "" {
+				return dest, fmt.Errorf("%w: %s", errOfferRejected, d.reason)
+			}
+			return dest, errOfferRejected
+		}
+		if d.dest != (receiveDest{}) {
+			dest = d.dest
+		}
+	case <-timer.C:
+		emitEvent("offer_expired", map[string]interface{}{"id": o.ID})
+		return dest, errOfferExpired
+	}
+
+	accepted := map[string]interface{}{"id": o.ID, "dir": dest.dir}
+	if dest.storage != "" {
+		accepted = map[string]interface{}{"id": o.ID, "storage": dest.storage}
+	}
+	emitEvent("offer_accepted", accepted)
+	writeAck(c, nil)
+	return dest, nil
+}
+
+// discoveredPeer finds the discovered instance that advertises the IP of
+// addr, if any
+func discoveredPeer(addr string) (string, bool) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", false
+	}
+	discovery.Mutex.Lock()
+	defer discovery.Mutex.Unlock()
+	for name, peer := range discovery.Peers {
+		for _, s := range append(append([]string{}, peer.IPv4...), peer.IPv6...) {
+			if sameHost(s, host) {
+				return name, true
+			}
+		}
+	}
+	return "", false
+}
+
+// senderName is what outgoing offers announce as their origin
+func senderName() string {
+	discovery.Mutex.Lock()
+	instance := discovery.Instance
+	discovery.Mutex.Unlock()
+	if instance != "" {
+		return instance
+	}
+	host, _ := os.Hostname()
+	return host
+}
+
+type DecideOfferPayload struct {
+	ID      string `json:"id"`
+	Dir     string `json:"dir"`     // accept_offer: receive somewhere other than the listener's directory
+	Storage string `json:"storage"` // accept_offer: or into this storage backend, see backends.go
+	Reason  string `json:"reason"`  // reject_offer: passed on to the sender
+}
+
+func handleAcceptOffer(payload json.RawMessage, writer *Output) {
+	decideOffer(payload, writer, "accept_offer", true)
+}
+
+func handleRejectOffer(payload json.RawMessage, writer *Output) {
+	decideOffer(payload, writer, "reject_offer", false)
+}
+
+func decideOffer(payload json.RawMessage, writer *Output, command string, accept bool) {
+	var p DecideOfferPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		sendInvalidPayload(writer, command)
+		return
+	}
+
+	dest := receiveDest{dir: p.Dir}
+	if accept && p.Storage != "" {
+		if p.Dir != "" {
+			sendError(writer, message("backends.accept_dir_or_storage"))
+			return
+		}
+		var err error
+		if dest, err = resolveStorage(p.Storage); err != nil {
+			sendFailure(writer, err)
+			return
+		}
+	}
+
+	offersMu.Lock()
+	o, exists := offers[p.ID]
+	directory := exists && o.Files > 0
+	if exists && !(directory && dest.storage != "") {
+		delete(offers, p.ID) // answered offers cannot be answered again
+	}
+	offersMu.Unlock()
+	if !exists {
+		sendErrorCode(writer, ErrNotFound, message("drop.offer_not_found"), nil)
+		return
+	}
+	if directory && dest.storage != "" {
+		sendError(writer, message("backends.single_files_only", "name", dest.storage))
+		return
+	}
+
+	o.decision <- offerDecision{accept: accept, dest: dest, reason: p.Reason}
+	m := message("drop.offer_rejected")
+	if accept {
+		m = message("drop.offer_accepted")
+	}
+	writer.Encode(okResponse(m, o))
+}
+
+func handleListOffers(writer *Output) {
+	offersMu.Lock()
+	list := make([]*Offer, 0, len(offers))
+	for _, o := range offers {
+		list = append(list, o)
+	}
+	offersMu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+
+	writer.Encode(ProtocolResponse{
+		Status: "ok",
+		Data:   map[string]interface{}{"offers": list},
+	})
+}
+
+// DropModeState is the advertised drop receiver, if one is enabled
+type DropModeState struct {
+	mu         sync.Mutex
+	addr       string
+	listenerID string
+	instance   string
+	port       int
+	text       []string
+	server     *zeroconf.Server
+}
+
+var dropMode DropModeState
+
+type EnableDropModePayload struct {
+	Instance string `json:"instance"` // advertised name, defaults to the hostname
+	Host     string `json:"host"`
+	Port     int    `json:"port"` // 0 picks a free port
+	Dir      string `json:"dir"`
+	DropOptions
+	Auth AuthOptions `json:"auth"`
+}
+
+// handleEnableDropMode starts a drop transfer listener and advertises it
+// under dropService so nearby peers can find it
+func handleEnableDropMode(payload json.RawMessage, writer *Output) {
+	var p EnableDropModePayload
+	if len(payload) > 0 && string(payload) != "null" {
+		if err := json.Unmarshal(payload, &p); err != nil {
+			sendInvalidPayload(writer, "enable_drop_mode")
+			return
+		}
+	}
+	if p.Instance == "" {
+		p.Instance, _ = os.Hostname()
+	}
+
+	dropMode.mu.Lock()
+	defer dropMode.mu.Unlock()
+	if dropMode.server != nil {
+		sendErrorCode(writer, ErrAlreadyRunning, message("drop.mode_already_enabled", "addr", dropMode.addr), nil)
+		return
+	}
+
+	drop := p.DropOptions
+	start, _ := json.Marshal(StartServerPayload{
+		Host: p.Host, Port: p.Port, Type: "transfer", Dir: p.Dir, Drop: &drop, Auth: p.Auth,
+	})
+	var buf bytes.Buffer
+	handleStartServer(start, NewOutput(&buf))
+	var resp struct {
+		Status      string                 `json:"status"`
+		MessageKey  string                 `json:"message_key"`
+		MessageArgs map[string]string      `json:"message_args"`
+		Code        string                 `json:"code"`
+		Details     map[string]interface{} `json:"details"`
+		Data        map[string]interface{} `json:"data"`
+	}
+	json.Unmarshal(buf.Bytes(), &resp)
+	if resp.Status != "ok" {
+		sendErrorCode(writer, resp.Code, Message{Key: resp.MessageKey, Args: resp.MessageArgs}, resp.Details)
+		return
+	}
+	addr, _ := resp.Data["addr"].(string)
+	id, _ := resp.Data["listener_id"].(string)
+	port := int(resp.Data["port"].(float64))
+
+	text := []string{"drop=1", "name=" + p.Instance, "port=" + strconv.Itoa(port)}
+	server, err := zeroconf.Register(p.Instance, dropService, discoveryDomain, port, text, nil)
+	if err != nil {
+		stopListener(id)
+		sendError(writer, message("common.failed_advertise", "service", dropService, "error", err))
+		return
+	}
+	dropMode.addr, dropMode.listenerID, dropMode.instance, dropMode.server = addr, id, p.Instance, server
+	dropMode.port, dropMode.text = port, text
+	logger.Info("drop mode enabled", "addr", addr, "instance", p.Instance)
+
+	resp.Data["instance"] = p.Instance
+	resp.Data["service"] = dropService
+	writer.Encode(okResponse(message("drop.mode_enabled", "addr", addr), resp.Data))
+}
+
+// rebindDropLocked registers the drop advertisement again, which binds it
+// to the interfaces there are now; dropMode.mu must be held. A failed
+// registration leaves the old, shut down server in place for
+// disable_drop_mode to stop.
+func rebindDropLocked() error {
+	if dropMode.server == nil {
+		return nil
+	}
+	dropMode.server.Shutdown()
+	server, err := zeroconf.Register(dropMode.instance, dropService, discoveryDomain, dropMode.port, dropMode.text, nil)
+	if err != nil {
+		return err
+	}
+	dropMode.server = server
+	return nil
+}
+
+// handleDisableDropMode withdraws the advertisement, stops the listener
+// and rejects whatever is still waiting
+func handleDisableDropMode(writer *Output) {
+	dropMode.mu.Lock()
+	defer dropMode.mu.Unlock()
+	if dropMode.server == nil {
+		sendErrorCode(writer, ErrNotRunning, message("drop.mode_not_enabled"), nil)
+		return
+	}
+	dropMode.server.Shutdown()
+	stopListener(dropMode.listenerID)
+
+	offersMu.Lock()
+	for id, o := range offers {
+		if o.Listener == dropMode.addr {
+			delete(offers, id)
+			o.decision <- offerDecision{reason: "drop mode disabled"}
+		}
+	}
+	offersMu.Unlock()
+
+	logger.Info("drop mode disabled", "addr", dropMode.addr)
+	dropMode.addr, dropMode.listenerID, dropMode.instance, dropMode.server = "", "", "", nil
+	dropMode.port, dropMode.text = 0, nil
+	writer.Encode(okResponse(message("drop.mode_disabled"), nil))
+}
+
+// stopListener closes and forgets a listener started through start_server
+func stopListener(id string) {
+	state.Mutex.Lock()
+	defer state.Mutex.Unlock()
+	if l, exists := state.Listeners[id]; exists {
+		l.ln.Close()
+		l.TLS.stop()
+		delete(state.Listeners, id)
+	}
+}
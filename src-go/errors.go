@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+)
+
+// Error responses carry a stable code beside the message, so the frontend
+// can localize and branch on errors without parsing text. Codes are only
+// ever added, never renamed; messages may change at any time. Every call
+// site names its code: sendErrorCode for a message, with details when it
+// has any, and catalogError for an error that sendFailure sends on. Plain
+// sendError is for failures that fit no more specific code.
+const (
+	ErrInvalidPayload   = "ERR_INVALID_PAYLOAD"   // the payload did not decode; details.command, details.fields
+	ErrInvalidArgument  = "ERR_INVALID_ARGUMENT"  // a field is missing, out of range or inconsistent
+	ErrUnsupported      = "ERR_UNSUPPORTED"       // a mode, type or option this build does not offer
+	ErrUnknownCommand   = "ERR_UNKNOWN_COMMAND"   // details.command
+	ErrNotFound         = "ERR_NOT_FOUND"         // no connection, server, transfer or job by that id
+	ErrNotRunning       = "ERR_NOT_RUNNING"       // the service to stop or query is not running
+	ErrAlreadyRunning   = "ERR_ALREADY_RUNNING"   // the service to start is already running
+	ErrInvalidState     = "ERR_INVALID_STATE"     // the object exists but cannot do that right now
+	ErrPortInUse        = "ERR_PORT_IN_USE"       // details.addr, details.owners when the OS says who
+	ErrBindFailed       = "ERR_BIND_FAILED"       // details.addr, details.error
+	ErrPermissionDenied = "ERR_PERMISSION_DENIED" // the OS refused, e.g. a privileged port or raw socket
+	ErrConnectFailed    = "ERR_CONNECT_FAILED"    // details.addr, details.error
+	ErrShuttingDown     = "ERR_SHUTTING_DOWN"
+	ErrMessageTooLarge  = "ERR_MESSAGE_TOO_LARGE" // details.max_message_size
+	ErrRateLimited      = "ERR_RATE_LIMITED"      // details.commands_per_sec, details.burst, details.retry_after_ms
+	ErrNestingTooDeep   = "ERR_NESTING_TOO_DEEP"  // details.max_depth
+	ErrInternal         = "ERR_INTERNAL"          // a bug; details.command, details.dump
+	ErrFailed           = "ERR_FAILED"            // anything else
+)
+
+// sendError sends m as an error response with the catch-all ErrFailed
+func sendError(writer *Output, m Message) {
+	sendErrorCode(writer, ErrFailed, m, nil)
+}
+
+// sendInvalidPayload reports a payload for command that did not decode
+func sendInvalidPayload(writer *Output, command string) {
+	sendErrorCode(writer, ErrInvalidPayload, message("common.invalid_payload", "command", command),
+		map[string]interface{}{"command": command})
+}
+
+// sendFailure sends err as an error response with the code catalogError
+// gave it, or ErrFailed for an error from elsewhere
+func sendFailure(writer *Output, err error) {
+	code := ErrFailed
+	var e *messageError
+	if errors.As(err, &e) {
+		code = e.code
+	}
+	sendErrorCode(writer, code, messageOf(err), nil)
+}
+
+// sendErrorCode sends an error response with an explicit code and optional
+// details for the frontend to branch on
+func sendErrorCode(writer *Output, code string, m Message, details map[string]interface{}) {
+	metrics.Errors.Add(1)
+	writer.Encode(ProtocolResponse{Status: "error", Message: m.String(), MessageKey: m.Key, MessageArgs: m.Args, Code: code, Details: details})
+}
+
+// sendBindError reports a failed listen on addr with the code that fits
+// the cause. Finding who holds a busy port can take portOwnerTimeout, so
+// callers holding state.Mutex use bindFailure instead.
+func sendBindError(writer *Output, addr string, err error) {
+	code := ErrBindFailed
+	msg := message("errors.failed_bind", "addr", addr, "error", err)
+	details := map[string]interface{}{"addr": addr, "error": err.Error()}
+	switch {
+	case isAddrInUse(err):
+		code = ErrPortInUse
+		// Say which program has the port when the OS lets us find out
+		_, p, _ := net.SplitHostPort(addr)
+		port, _ := strconv.Atoi(p)
+		if owners, err := portOwners(bindNetwork(err), port); err == nil && len(owners) > 0 {
+			details["owners"] = owners
+			msg = message("portowner.port_used_by", "port", port, "app", describeOwners(owners))
+		}
+	case errors.Is(err, os.ErrPermission):
+		code = ErrPermissionDenied
+	}
+	sendErrorCode(writer, code, msg, details)
+}
+
+// bindFailure keeps a failed listen for a deferred send, made once the
+// handler has let go of state.Mutex
+type bindFailure struct {
+	addr string
+	err  error
+}
+
+func (f *bindFailure) send(writer *Output) {
+	if f.err != nil {
+		sendBindError(writer, f.addr, f.err)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestSendFailureCode(t *testing.T) {
+	for _, tt := range []struct {
+		err  error
+		code string
+	}{
+		{catalogError(ErrNotFound, "common.connection_not_found"), ErrNotFound},
+		{catalogError(ErrInvalidArgument, "netem.loss_percent_must_between"), ErrInvalidArgument},
+		{errors.New("disk full"), ErrFailed},
+	} {
+		var buf bytes.Buffer
+		sendFailure(NewOutput(&buf), tt.err)
+		var resp ProtocolResponse
+		if err := json.Unmarshal(buf.Bytes(), &resp); err != nil || resp.Code != tt.code || resp.Message != tt.err.Error() {
+			t.Errorf("%v sent as %s, want %s", tt.err, buf.String(), tt.code)
+		}
+	}
+
+	// A wrapped catalog error keeps its code and key
+	var buf bytes.Buffer
+	sendFailure(NewOutput(&buf), fmt.Errorf("profile: %w", catalogError(ErrNotFound, "common.connection_not_found")))
+	var resp ProtocolResponse
+	if err := json.Unmarshal(buf.Bytes(), &resp); err != nil || resp.Code != ErrNotFound || resp.MessageKey != "common.connection_not_found" {
+		t.Errorf("wrapped error sent as %s", buf.String())
+	}
+}
+
+func TestIsAddrInUse(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	_, err = net.Listen("tcp", ln.Addr().String())
+	if err == nil || !isAddrInUse(err) {
+		t.Errorf("second bind: %v, want address in use", err)
+	}
+}
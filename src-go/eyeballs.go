@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// Happy eyeballs (RFC 8305): a peer with both IPv4 and IPv6 addresses, or
+// several discovered ones, used to be dialed on the first address the
+// resolver gave, and a dead path cost the whole dial timeout before
+// anything else was tried. Now every address gets a turn. They are ordered
+// IPv6 first, alternating families, and each attempt has
+// connectionAttemptDelay to itself before the next one starts alongside
+// it; an attempt that fails starts the next at once. The first to connect
+// wins and the others are dropped. Which address won, and what it took,
+// is the connection's route.
+const connectionAttemptDelay = 250 * time.Millisecond
+
+// DialRoute is the path an outbound TCP connection took
+type DialRoute struct {
+	Addr       string `json:"addr"`
+	Family     string `json:"family"`     // "ipv4" or "ipv6"
+	Candidates int    `json:"candidates"` // addresses there were to try
+	Attempts   int    `json:"attempts"`   // dials started before one won
+	ElapsedMs  int64  `json:"elapsed_ms"`
+}
+
+// dialEyeballs connects to addr, or one of the other addresses of the same
+// peer, over a tcp network, whichever answers first
+func dialEyeballs(network, addr string, alternates []string, timeout time.Duration) (net.Conn, *DialRoute, error) {
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	candidates, err := dialCandidates(ctx, network, append([]string{addr}, alternates...))
+	if err != nil {
+		return nil, nil, err
+	}
+	conn, route, err := raceDial(ctx, network, candidates)
+	if err != nil {
+		return nil, nil, err
+	}
+	route.ElapsedMs = time.Since(start).Milliseconds()
+	return conn, route, nil
+}
+
+// dialCandidates resolves the host:port targets into the addresses to try,
+// in the order to try them. A name that fails to resolve is skipped as
+// long as another target yields an address.
+func dialCandidates(ctx context.Context, network string, targets []string) ([]netip.AddrPort, error) {
+	lookup := "ip"
+	if strings.HasSuffix(network, "4") || strings.HasSuffix(network, "6") {
+		lookup += network[len(network)-1:]
+	}
+	var v6, v4 []netip.AddrPort
+	seen := make(map[netip.AddrPort]bool)
+	var firstErr error
+	for _, target := range targets {
+		host, portStr, err := net.SplitHostPort(target)
+		if err != nil {
+			return nil, err
+		}
+		port, err := net.DefaultResolver.LookupPort(ctx, "tcp", portStr)
+		if err != nil {
+			return nil, err
+		}
+		var ips []netip.Addr
+		if ip, err := netip.ParseAddr(host); err == nil {
+			ips = []netip.Addr{ip}
+		} else if ips, err = net.DefaultResolver.LookupNetIP(ctx, lookup, host); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		for _, ip := range ips {
+			ap := netip.AddrPortFrom(ip.Unmap(), uint16(port))
+			if seen[ap] || (lookup == "ip4" && !ap.Addr().Is4()) || (lookup == "ip6" && ap.Addr().Is4()) {
+				continue
+			}
+			seen[ap] = true
+			if ap.Addr().Is4() {
+				v4 = append(v4, ap)
+			} else {
+				v6 = append(v6, ap)
+			}
+		}
+	}
+	candidates := interleaveFamilies(v6, v4)
+	if len(candidates) == 0 {
+		if firstErr == nil {
+			firstErr = errors.New("no address in the requested family")
+		}
+		return nil, firstErr
+	}
+	return candidates, nil
+}
+
+// interleaveFamilies alternates between the two families, IPv6 first,
+// keeping the resolver's order within each
+func interleaveFamilies(v6, v4 []netip.AddrPort) []netip.AddrPort {
+	out := make([]netip.AddrPort, 0, len(v6)+len(v4))
+	for i := 0; i < max(len(v6), len(v4)); i++ {
+		if i < len(v6) {
+			out = append(out, v6[i])
+		}
+		if i < len(v4) {
+			out = append(out, v4[i])
+		}
+	}
+	return out
+}
+
+// raceDial starts a dial to each candidate in turn, staggered, and keeps
+// the first that connects. ctx bounds the whole race; the error is the
+// first attempt's, which names the preferred address.
+func raceDial(ctx context.Context, network string, candidates []netip.AddrPort) (net.Conn, *DialRoute, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		conn net.Conn
+		addr netip.AddrPort
+		err  error
+	}
+	results := make(chan result, len(candidates))
+	var d net.Dialer
+	started, pending := 0, 0
+	next := func() {
+		ap := candidates[started]
+		started++
+		pending++
+		go func() {
+			var conn net.Conn
+			err := callSafe("dial "+ap.String(), func() (err error) {
+				conn, err = d.DialContext(ctx, network, ap.String())
+				return err
+			})
+			results <- result{conn, ap, err}
+		}()
+	}
+
+	next()
+	stagger := time.NewTimer(connectionAttemptDelay)
+	defer stagger.Stop()
+	var firstErr error
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// Losers that connect before the cancel lands are closed
+				n := pending
+				goSafe("dial "+r.addr.String(), func() {
+					for range n {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}
+				})
+				family := familyIPv4
+				if !r.addr.Addr().Is4() {
+					family = familyIPv6
+				}
+				return r.conn, &DialRoute{Addr: r.addr.String(), Family: family, Candidates: len(candidates), Attempts: started}, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if started < len(candidates) {
+				next()
+				stagger.Reset(connectionAttemptDelay)
+			}
+		case <-stagger.C:
+			if started < len(candidates) {
+				next()
+				stagger.Reset(connectionAttemptDelay)
+			}
+		}
+	}
+	return nil, nil, firstErr
+}
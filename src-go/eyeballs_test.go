@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestInterleaveFamilies(t *testing.T) {
+	a6, b6 := netip.MustParseAddrPort("[2001:db8::1]:80"), netip.MustParseAddrPort("[2001:db8::2]:80")
+	a4, b4, c4 := netip.MustParseAddrPort("192.0.2.1:80"), netip.MustParseAddrPort("192.0.2.2:80"), netip.MustParseAddrPort("192.0.2.3:80")
+	got := interleaveFamilies([]netip.AddrPort{a6, b6}, []netip.AddrPort{a4, b4, c4})
+	if want := []netip.AddrPort{a6, a4, b6, b4, c4}; !slices.Equal(got, want) {
+		t.Errorf("order %v, want %v", got, want)
+	}
+}
+
+func TestDialCandidatesFamilyAndDuplicates(t *testing.T) {
+	got, err := dialCandidates(context.Background(), "tcp4", []string{"127.0.0.1:80", "[::1]:80", "127.0.0.1:80", "192.0.2.1:http"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []netip.AddrPort{netip.MustParseAddrPort("127.0.0.1:80"), netip.MustParseAddrPort("192.0.2.1:80")}
+	if !slices.Equal(got, want) {
+		t.Errorf("candidates %v, want %v", got, want)
+	}
+	if _, err := dialCandidates(context.Background(), "tcp6", []string{"127.0.0.1:80"}); err == nil {
+		t.Error("an IPv4 address passed for tcp6")
+	}
+}
+
+func TestRaceDialMovesPastARefusedAddress(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused := closed.Addr().String()
+	closed.Close()
+
+	start := time.Now()
+	conn, route, err := dialEyeballs("tcp", refused, []string{ln.Addr().String()}, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if route.Addr != ln.Addr().String() || route.Family != familyIPv4 || route.Candidates != 2 || route.Attempts != 2 {
+		t.Errorf("route %+v", route)
+	}
+	if elapsed := time.Since(start); elapsed >= connectionAttemptDelay {
+		t.Errorf("a refused address held the next attempt back for %v", elapsed)
+	}
+
+	if _, _, err := dialEyeballs("tcp", refused, nil, 5*time.Second); err == nil {
+		t.Error("dialing only a refused address succeeded")
+	}
+}
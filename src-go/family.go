@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// Address families a listener, outbound connection or discovery browse can
+// be restricted to. "dual" is the default everywhere and lets the system
+// use both.
+const (
+	familyIPv4 = "ipv4"
+	familyIPv6 = "ipv6"
+	familyDual = "dual"
+)
+
+func validFamily(family string) bool {
+	switch family {
+	case "", familyIPv4, familyIPv6, familyDual:
+		return true
+	}
+	return false
+}
+
+// familyNetwork narrows "tcp" or "udp" to the requested family
+func familyNetwork(network, family string) (string, error) {
+	switch family {
+	case "", familyDual:
+		return network, nil
+	case familyIPv4:
+		return network + "4", nil
+	case familyIPv6:
+		return network + "6", nil
+	}
+	return "", catalogError(ErrUnsupported, "common.unsupported_address_family", "address_family", family)
+}
+
+// normalizeHost accepts an IPv6 literal with or without brackets, so
+// "[::1]" and "::1" both become "::1" before being joined with a port
+func normalizeHost(host string) string {
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		return host[1 : len(host)-1]
+	}
+	return host
+}
+
+// applyFamily folds a listener's address_family into its socket options;
+// an explicit socket setting that contradicts it is an error
+func (o *SocketOptions) applyFamily(family, host string) error {
+	ip := net.ParseIP(host)
+	switch family {
+	case "", familyDual:
+		if family == familyDual && (o.IPv4Only || (o.DualStack != nil && !*o.DualStack)) {
+			return errors.New("address_family dual conflicts with the socket options")
+		}
+	case familyIPv4:
+		if o.DualStack != nil || (ip != nil && ip.To4() == nil) {
+			return errors.New("address_family ipv4 needs an IPv4 or empty host")
+		}
+		o.IPv4Only = true
+	case familyIPv6:
+		if o.IPv4Only || (o.DualStack != nil && *o.DualStack) || (ip != nil && ip.To4() != nil) {
+			return errors.New("address_family ipv6 needs an IPv6 or empty host")
+		}
+		v6only := false
+		o.DualStack = &v6only
+	default:
+		return catalogError(ErrUnsupported, "common.unsupported_address_family", "address_family", family)
+	}
+	return nil
+}
+
+// sameHost compares two IP literals, ignoring IPv6 zones and the IPv4
+// mapping so "fe80::1%eth0" matches "fe80::1" and "::ffff:10.0.0.2" matches
+// "10.0.0.2"
+func sameHost(a, b string) bool {
+	x, err := netip.ParseAddr(a)
+	if err != nil {
+		return false
+	}
+	y, err := netip.ParseAddr(b)
+	if err != nil {
+		return false
+	}
+	return x.WithZone("").Unmap() == y.WithZone("").Unmap()
+}
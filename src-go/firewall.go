@@ -0,0 +1,474 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Firewall helper: check_firewall asks the OS firewall whether a port can
+// be reached from outside, and add_firewall_rule and remove_firewall_rule
+// change the rules that decide it. Rule changes are never made on the
+// spot: the command only describes what it would run and returns a change
+// ID, the frontend shows that to the user, and confirm_firewall_change
+// runs it once they agree. Windows rules go through netsh; on macOS the
+// application firewall (socketfilterfw) is per program, and pf rules live
+// in a lumina/<port> anchor that pf.conf must reference to take effect.
+const (
+	firewallNetsh          = "netsh"
+	firewallSocketfilterfw = "socketfilterfw"
+	firewallPF             = "pf"
+
+	socketfilterfwPath = "/usr/libexec/ApplicationFirewall/socketfilterfw"
+	pfAnchor           = "lumina"
+
+	firewallChangeTTL      = 2 * time.Minute
+	firewallCommandTimeout = 30 * time.Second
+)
+
+// runFirewallCommand runs one firewall tool and returns what it printed
+var runFirewallCommand = func(ctx context.Context, argv []string, stdin string) (string, error) {
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	if stdin != "" {
+		cmd.Stdin = strings.NewReader(stdin)
+	}
+	out, err := cmd.CombinedOutput()
+	return string(out), err
+}
+
+type FirewallPayload struct {
+	ListenerRef        // the listener whose port to check, or just a port
+	Protocol    string `json:"protocol"` // "tcp" or "udp", default the listener's
+	Backend     string `json:"backend"`  // macOS only: "socketfilterfw" (default) or "pf"
+}
+
+// firewallTarget is the port a firewall command is about
+type firewallTarget struct {
+	Backend  string
+	Port     int
+	Protocol string
+	Rule     string // netsh rule name or pf anchor
+	Program  string // socketfilterfw works on executables
+}
+
+// resolveFirewallTarget works out the port and backend of a payload,
+// reporting anything wrong to writer
+func resolveFirewallTarget(command string, payload json.RawMessage, writer *Output) (firewallTarget, bool) {
+	var p FirewallPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		sendInvalidPayload(writer, command)
+		return firewallTarget{}, false
+	}
+	t := firewallTarget{Port: p.Port, Protocol: p.Protocol}
+	if p.ListenerID != "" {
+		state.Mutex.Lock()
+		l, ok := findListenerLocked(p.ListenerRef, writer)
+		if ok {
+			t.Port = listenerPort(l.ln)
+			if t.Protocol == "" {
+				t.Protocol = socketNetwork(l.Transport)
+			}
+		}
+		state.Mutex.Unlock()
+		if !ok {
+			return t, false
+		}
+	}
+	if t.Port <= 0 || t.Port > 65535 {
+		sendErrorCode(writer, ErrInvalidArgument, message("firewall.requires_listener_or_port", "command", command), nil)
+		return t, false
+	}
+	switch t.Protocol {
+	case "":
+		t.Protocol = "tcp"
+	case "tcp", "udp":
+	default:
+		sendErrorCode(writer, ErrUnsupported, message("common.unsupported_protocol", "protocol", t.Protocol), nil)
+		return t, false
+	}
+
+	switch runtime.GOOS {
+	case "windows":
+		t.Backend = firewallNetsh
+		if p.Backend != "" && p.Backend != firewallNetsh {
+			sendErrorCode(writer, ErrUnsupported, message("firewall.unsupported_backend", "os", "windows", "backend", p.Backend), nil)
+			return t, false
+		}
+		t.Rule = fmt.Sprintf("Lumina %s %d", strings.ToUpper(t.Protocol), t.Port)
+	case "darwin":
+		t.Backend = p.Backend
+		switch t.Backend {
+		case "":
+			t.Backend = firewallSocketfilterfw
+		case firewallSocketfilterfw, firewallPF:
+		default:
+			sendErrorCode(writer, ErrUnsupported, message("firewall.unsupported_backend", "os", "darwin", "backend", p.Backend), nil)
+			return t, false
+		}
+		t.Rule = fmt.Sprintf("%s/%d", pfAnchor, t.Port)
+		t.Program, _ = os.Executable()
+	default:
+		sendErrorCode(writer, ErrUnsupported, message("firewall.rules_not_supported", "os", runtime.GOOS),
+			map[string]interface{}{"os": runtime.GOOS})
+		return t, false
+	}
+	return t, true
+}
+
+// FirewallStatus is what check_firewall found out. Blocked is nil when
+// the firewall cannot tell without trying a connection from outside.
+type FirewallStatus struct {
+	OS          string `json:"os"`
+	Backend     string `json:"backend"`
+	Port        int    `json:"port"`
+	Protocol    string `json:"protocol"`
+	Enabled     *bool  `json:"enabled"`
+	Rule        string `json:"rule,omitempty"`
+	RulePresent bool   `json:"rule_present"`
+	Program     string `json:"program,omitempty"`
+	BlockAll    bool   `json:"block_all,omitempty"`
+	PFEnabled   *bool  `json:"pf_enabled,omitempty"`
+	Blocked     *bool  `json:"blocked"`
+	Reason      string `json:"reason"`
+}
+
+func handleCheckFirewall(payload json.RawMessage, writer *Output) {
+	t, ok := resolveFirewallTarget("check_firewall", payload, writer)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), firewallCommandTimeout)
+	defer cancel()
+
+	s := FirewallStatus{OS: runtime.GOOS, Backend: t.Backend, Port: t.Port, Protocol: t.Protocol}
+	if t.Backend == firewallNetsh {
+		checkNetsh(ctx, t, &s)
+	} else {
+		checkMacFirewall(ctx, t, &s)
+	}
+	writer.Encode(ProtocolResponse{Status: "ok", Data: s})
+}
+
+func checkNetsh(ctx context.Context, t firewallTarget, s *FirewallStatus) {
+	s.Rule = t.Rule
+	out, err := runFirewallCommand(ctx, []string{"netsh", "advfirewall", "show", "currentprofile", "state"}, "")
+	if err == nil {
+		s.Enabled = parseNetshState(out)
+	}
+	out, err = runFirewallCommand(ctx, []string{"netsh", "advfirewall", "firewall", "show", "rule", "name=" + t.Rule}, "")
+	s.RulePresent = err == nil && netshRuleListed(out)
+
+	switch {
+	case s.Enabled == nil:
+		s.Reason = "netsh did not report the firewall state"
+	case !*s.Enabled:
+		s.Blocked, s.Reason = boolPtr(false), "the firewall is off for the current profile"
+	case s.RulePresent:
+		s.Blocked, s.Reason = boolPtr(false), "an allow rule for the port exists"
+	default:
+		// Windows blocks unsolicited inbound traffic unless a rule allows it
+		s.Blocked, s.Reason = boolPtr(true), "no allow rule for the port; add_firewall_rule creates one"
+	}
+}
+
+func checkMacFirewall(ctx context.Context, t firewallTarget, s *FirewallStatus) {
+	out, err := runFirewallCommand(ctx, []string{socketfilterfwPath, "--getglobalstate"}, "")
+	if err == nil {
+		s.Enabled = parseSocketfilterfwState(out)
+	}
+	if out, err := runFirewallCommand(ctx, []string{socketfilterfwPath, "--getblockall"}, ""); err == nil {
+		s.BlockAll = parseSocketfilterfwBlockAll(out)
+	}
+	// pfctl needs root; without it pf's state stays unknown
+	if out, err := runFirewallCommand(ctx, []string{"pfctl", "-s", "info"}, ""); err == nil {
+		s.PFEnabled = parsePFStatus(out)
+	}
+	appState := ""
+	if t.Program != "" {
+		s.Program = t.Program
+		if out, err := runFirewallCommand(ctx, []string{socketfilterfwPath, "--getappblocked", t.Program}, ""); err == nil {
+			appState = parseSocketfilterfwApp(out)
+		}
+	}
+	if t.Backend == firewallPF {
+		s.Rule = t.Rule
+		out, err := runFirewallCommand(ctx, []string{"pfctl", "-a", t.Rule, "-s", "rules"}, "")
+		s.RulePresent = err == nil && strings.Contains(out, "pass in")
+	} else {
+		s.RulePresent = appState == "permitted"
+	}
+
+	switch {
+	case s.PFEnabled != nil && *s.PFEnabled && t.Backend == firewallPF && !s.RulePresent:
+		s.Reason = "pf is on and the lumina anchor has no rule for the port"
+	case s.Enabled == nil:
+		s.Reason = "socketfilterfw did not report the firewall state"
+	case !*s.Enabled:
+		s.Blocked, s.Reason = boolPtr(false), "the application firewall is off"
+	case s.BlockAll:
+		s.Blocked, s.Reason = boolPtr(true), "the application firewall blocks all incoming connections"
+	case appState == "permitted":
+		s.Blocked, s.Reason = boolPtr(false), "the application firewall permits this program"
+	case appState == "blocked":
+		s.Blocked, s.Reason = boolPtr(true), "the application firewall blocks this program"
+	default:
+		s.Reason = "this program is not in the application firewall; macOS asks on the first incoming connection"
+	}
+}
+
+func boolPtr(b bool) *bool { return &b }
+
+// parseNetshState reads "State ON" from netsh advfirewall show ... state
+func parseNetshState(out string) *bool {
+	for _, line := range strings.Split(out, "\n") {
+		f := strings.Fields(line)
+		if len(f) == 2 && strings.EqualFold(f[0], "State") {
+			switch strings.ToUpper(f[1]) {
+			case "ON":
+				return boolPtr(true)
+			case "OFF":
+				return boolPtr(false)
+			}
+		}
+	}
+	return nil
+}
+
+// netshRuleListed is whether netsh ... show rule printed at least one rule
+func netshRuleListed(out string) bool {
+	return strings.Contains(out, "Rule Name:")
+}
+
+// parseSocketfilterfwState reads "Firewall is enabled. (State = 1)"
+func parseSocketfilterfwState(out string) *bool {
+	switch {
+	case strings.Contains(out, "State = 0"), strings.Contains(out, "is disabled"):
+		return boolPtr(false)
+	case strings.Contains(out, "State = 1"), strings.Contains(out, "State = 2"), strings.Contains(out, "is enabled"):
+		return boolPtr(true)
+	}
+	return nil
+}
+
+// parseSocketfilterfwBlockAll reads the answer to --getblockall, which
+// older releases word as "Block all DISABLED!"
+func parseSocketfilterfwBlockAll(out string) bool {
+	lower := strings.ToLower(out)
+	return !strings.Contains(lower, "disabled") &&
+		(strings.Contains(lower, "enabled") || strings.Contains(lower, "block all non-essential"))
+}
+
+// parseSocketfilterfwApp is "permitted", "blocked" or "" for a program
+// the firewall has no entry for
+func parseSocketfilterfwApp(out string) string {
+	switch {
+	case strings.Contains(out, "is permitted"):
+		return "permitted"
+	case strings.Contains(out, "is blocked"):
+		return "blocked"
+	}
+	return ""
+}
+
+// parsePFStatus reads "Status: Enabled for 0 days ..." from pfctl -s info
+func parsePFStatus(out string) *bool {
+	for _, line := range strings.Split(out, "\n") {
+		if rest, ok := strings.CutPrefix(strings.TrimSpace(line), "Status:"); ok {
+			return boolPtr(strings.HasPrefix(strings.TrimSpace(rest), "Enabled"))
+		}
+	}
+	return nil
+}
+
+// firewallStep is one command of a rule change
+type firewallStep struct {
+	Argv  []string `json:"argv"`
+	Stdin string   `json:"stdin,omitempty"`
+}
+
+// FirewallChange is a rule change waiting for the user's confirmation
+type FirewallChange struct {
+	ID       string         `json:"id"`
+	Action   string         `json:"action"` // "add" or "remove"
+	Backend  string         `json:"backend"`
+	Port     int            `json:"port"`
+	Protocol string         `json:"protocol"`
+	Rule     string         `json:"rule,omitempty"`
+	Program  string         `json:"program,omitempty"`
+	Commands []firewallStep `json:"commands"`
+	Elevated bool           `json:"elevated"` // this process has the administrator rights the commands need
+	Expires  time.Time      `json:"expires"`
+}
+
+var (
+	firewallSeq       atomic.Uint64
+	firewallChangesMu sync.Mutex
+	firewallChanges   = make(map[string]*FirewallChange)
+)
+
+// firewallSteps are the commands that add or remove the rule for t
+func firewallSteps(action string, t firewallTarget) []firewallStep {
+	switch t.Backend {
+	case firewallNetsh:
+		if action == "add" {
+			return []firewallStep{{Argv: []string{"netsh", "advfirewall", "firewall", "add", "rule",
+				"name=" + t.Rule, "dir=in", "action=allow", "protocol=" + strings.ToUpper(t.Protocol), "localport=" + strconv.Itoa(t.Port)}}}
+		}
+		return []firewallStep{{Argv: []string{"netsh", "advfirewall", "firewall", "delete", "rule", "name=" + t.Rule}}}
+	case firewallSocketfilterfw:
+		if action == "add" {
+			return []firewallStep{
+				{Argv: []string{socketfilterfwPath, "--add", t.Program}},
+				{Argv: []string{socketfilterfwPath, "--unblockapp", t.Program}},
+			}
+		}
+		return []firewallStep{{Argv: []string{socketfilterfwPath, "--remove", t.Program}}}
+	case firewallPF:
+		if action == "add" {
+			rule := fmt.Sprintf("pass in proto %s from any to any port %d\n", t.Protocol, t.Port)
+			return []firewallStep{{Argv: []string{"pfctl", "-a", t.Rule, "-f", "-"}, Stdin: rule}}
+		}
+		return []firewallStep{{Argv: []string{"pfctl", "-a", t.Rule, "-F", "rules"}}}
+	}
+	return nil
+}
+
+func handleAddFirewallRule(payload json.RawMessage, writer *Output) {
+	proposeFirewallChange("add_firewall_rule", "add", payload, writer)
+}
+
+func handleRemoveFirewallRule(payload json.RawMessage, writer *Output) {
+	proposeFirewallChange("remove_firewall_rule", "remove", payload, writer)
+}
+
+// proposeFirewallChange records a rule change and returns it for the user
+// to confirm; nothing runs until confirm_firewall_change
+func proposeFirewallChange(command, action string, payload json.RawMessage, writer *Output) {
+	t, ok := resolveFirewallTarget(command, payload, writer)
+	if !ok {
+		return
+	}
+	if t.Backend == firewallSocketfilterfw && t.Program == "" {
+		sendError(writer, message("firewall.failed_find_program_path"))
+		return
+	}
+	change := &FirewallChange{
+		ID:       fmt.Sprintf("fw-%d", firewallSeq.Add(1)),
+		Action:   action,
+		Backend:  t.Backend,
+		Port:     t.Port,
+		Protocol: t.Protocol,
+		Commands: firewallSteps(action, t),
+		Elevated: processElevated(),
+		Expires:  time.Now().Add(firewallChangeTTL),
+	}
+	if t.Backend == firewallSocketfilterfw {
+		change.Program = t.Program
+	} else {
+		change.Rule = t.Rule
+	}
+
+	firewallChangesMu.Lock()
+	now := time.Now()
+	for id, c := range firewallChanges {
+		if now.After(c.Expires) {
+			delete(firewallChanges, id)
+		}
+	}
+	firewallChanges[change.ID] = change
+	firewallChangesMu.Unlock()
+
+	writer.Encode(okResponse(message("firewall.change_needs_confirmation"), change))
+}
+
+type ConfirmFirewallChangePayload struct {
+	ID      string `json:"id"`
+	Approve bool   `json:"approve"` // false discards the change
+}
+
+// handleConfirmFirewallChange runs or discards a change the user answered
+func handleConfirmFirewallChange(payload json.RawMessage, writer *Output) {
+	var p ConfirmFirewallChangePayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		sendInvalidPayload(writer, "confirm_firewall_change")
+		return
+	}
+	firewallChangesMu.Lock()
+	change, ok := firewallChanges[p.ID]
+	delete(firewallChanges, p.ID)
+	firewallChangesMu.Unlock()
+	if !ok || time.Now().After(change.Expires) {
+		sendErrorCode(writer, ErrNotFound, message("firewall.change_not_found", "id", p.ID), map[string]interface{}{"id": p.ID})
+		return
+	}
+	if !p.Approve {
+		logger.Info("firewall change discarded", "id", change.ID, "action", change.Action, "port", change.Port)
+		writer.Encode(okResponse(message("firewall.change_discarded"), map[string]interface{}{"id": change.ID}))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), firewallCommandTimeout)
+	defer cancel()
+	for _, step := range change.Commands {
+		out, err := runFirewallCommand(ctx, step.Argv, step.Stdin)
+		if err == nil {
+			continue
+		}
+		out = strings.TrimSpace(out)
+		logger.Warn("firewall change failed", "id", change.ID, "command", step.Argv[0], "error", err, "output", out)
+		code := ErrFailed
+		if needsElevation(out, err) {
+			code = ErrPermissionDenied
+		}
+		sendErrorCode(writer, code, message("firewall.failed_change_firewall", "error", err),
+			map[string]interface{}{"id": change.ID, "command": strings.Join(step.Argv, " "), "output": out})
+		return
+	}
+
+	logger.Info("firewall changed", "id", change.ID, "action", change.Action, "backend", change.Backend, "port", change.Port)
+	emitEvent("firewall_changed", change)
+	m := message("firewall.rule_added")
+	if change.Action == "remove" {
+		m = message("firewall.rule_removed")
+	}
+	writer.Encode(okResponse(m, change))
+}
+
+// handleListFirewallChanges lists changes still waiting for an answer
+func handleListFirewallChanges(writer *Output) {
+	firewallChangesMu.Lock()
+	now := time.Now()
+	pending := []*FirewallChange{}
+	for _, c := range firewallChanges {
+		if now.Before(c.Expires) {
+			pending = append(pending, c)
+		}
+	}
+	firewallChangesMu.Unlock()
+	sort.Slice(pending, func(i, j int) bool { return pending[i].Expires.Before(pending[j].Expires) })
+	writer.Encode(ProtocolResponse{Status: "ok", Data: map[string]interface{}{"changes": pending}})
+}
+
+// needsElevation is whether a firewall tool failed for lack of rights
+func needsElevation(out string, err error) bool {
+	if errors.Is(err, os.ErrPermission) {
+		return true
+	}
+	lower := strings.ToLower(out)
+	for _, s := range []string{"elevation", "administrator", "must be root", "permission denied", "operation not permitted"} {
+		if strings.Contains(lower, s) {
+			return true
+		}
+	}
+	return false
+}
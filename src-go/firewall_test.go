@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFirewallParsers(t *testing.T) {
+	netsh := "\r\nPrivate Profile Settings:\r\n----------------------------------------------------------------------\r\nState                                 ON\r\nOk.\r\n"
+	if on := parseNetshState(netsh); on == nil || !*on {
+		t.Errorf("netsh state %v, want on", on)
+	}
+	if on := parseNetshState("State OFF\n"); on == nil || *on {
+		t.Errorf("netsh state %v, want off", on)
+	}
+	if on := parseSocketfilterfwState("Firewall is enabled. (State = 1)\n"); on == nil || !*on {
+		t.Errorf("socketfilterfw state %v, want on", on)
+	}
+	if on := parseSocketfilterfwState("Firewall is disabled. (State = 0)\n"); on == nil || *on {
+		t.Errorf("socketfilterfw state %v, want off", on)
+	}
+	if parseSocketfilterfwBlockAll("Block all DISABLED! \n") {
+		t.Error("block all DISABLED read as on")
+	}
+	if !parseSocketfilterfwBlockAll("Firewall is set to block all non-essential incoming connections\n") {
+		t.Error("block all read as off")
+	}
+	if got := parseSocketfilterfwApp("The application /Applications/Lumina.app is permitted\n"); got != "permitted" {
+		t.Errorf("app state %q", got)
+	}
+	if on := parsePFStatus("Status: Enabled for 0 days 00:12:03           Debug: Urgent\n"); on == nil || !*on {
+		t.Errorf("pf status %v, want on", on)
+	}
+}
+
+func TestConfirmFirewallChange(t *testing.T) {
+	var ran [][]string
+	defer func(run func(context.Context, []string, string) (string, error)) { runFirewallCommand = run }(runFirewallCommand)
+	runFirewallCommand = func(_ context.Context, argv []string, _ string) (string, error) {
+		ran = append(ran, argv)
+		if argv[0] == "fail" {
+			return "The requested operation requires elevation (Run as administrator).", errors.New("exit status 1")
+		}
+		return "Ok.", nil
+	}
+	output = NewOutput(&bytes.Buffer{})
+
+	confirm := func(id string, approve bool) ProtocolResponse {
+		var buf bytes.Buffer
+		payload, _ := json.Marshal(ConfirmFirewallChangePayload{ID: id, Approve: approve})
+		handleConfirmFirewallChange(payload, NewOutput(&buf))
+		var resp ProtocolResponse
+		json.Unmarshal(buf.Bytes(), &resp)
+		return resp
+	}
+	pending := func(id string, argv ...string) {
+		firewallChangesMu.Lock()
+		firewallChanges[id] = &FirewallChange{ID: id, Action: "add", Commands: []firewallStep{{Argv: argv}}, Expires: time.Now().Add(time.Minute)}
+		firewallChangesMu.Unlock()
+	}
+
+	pending("fw-test-1", "netsh", "advfirewall")
+	if resp := confirm("fw-test-1", false); resp.Status != "ok" || len(ran) != 0 {
+		t.Fatalf("discard: %+v, ran %v", resp, ran)
+	}
+	if resp := confirm("fw-test-1", true); resp.Code != ErrNotFound {
+		t.Errorf("discarded change ran again: %+v", resp)
+	}
+
+	pending("fw-test-2", "netsh", "advfirewall")
+	if resp := confirm("fw-test-2", true); resp.Status != "ok" || len(ran) != 1 {
+		t.Errorf("approve: %+v, ran %v", resp, ran)
+	}
+
+	pending("fw-test-3", "fail")
+	if resp := confirm("fw-test-3", true); resp.Code != ErrPermissionDenied || !strings.Contains(resp.Details["output"].(string), "elevation") {
+		t.Errorf("failed change: %+v", resp)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !windows
+
+package main
+
+import "os"
+
+// processElevated reports whether this process runs as root, which pfctl
+// and socketfilterfw need to change rules
+func processElevated() bool {
+	return os.Geteuid() == 0
+}
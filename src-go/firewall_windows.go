@@ -0,0 +1,9 @@
+package main
+
+import "golang.org/x/sys/windows"
+
+// processElevated reports whether this process holds an elevated token,
+// which netsh needs to change rules
+func processElevated() bool {
+	return windows.GetCurrentProcessToken().IsElevated()
+}
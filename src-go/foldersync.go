@@ -0,0 +1,484 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// A folder sync watches a local directory and pushes what changed to a
+// mirror directory under a peer's transfer listener, as directory transfers
+// with the sync conflict policy. It is one-way: edits made on the mirror
+// are never pulled back, but they are noticed. The receiver keeps a file
+// that changed on its side since the last sync, and both ends report it
+// with a sync_conflict event. What the peer holds is remembered only while
+// the sync runs, so the first pass after start_sync treats every file that
+// differs on the mirror as a conflict.
+const defaultSyncDebounce = time.Second
+
+// SyncInfo is the JSON view of a FolderSync
+type SyncInfo struct {
+	ID      string    `json:"id"`
+	Path    string    `json:"path"`
+	Peer    string    `json:"peer"`
+	Mirror  string    `json:"mirror"` // directory name on the receiver
+	DryRun  bool      `json:"dry_run,omitempty"`
+	Once    bool      `json:"once,omitempty"` // stops after the first pass
+	Started time.Time `json:"started"`
+
+	Passes    int       `json:"passes"` // passes that found something to push
+	LastSync  time.Time `json:"last_sync,omitempty"`
+	LastError string    `json:"last_error,omitempty"`
+	Conflicts []string  `json:"conflicts,omitempty"` // files left alone until they change here again
+}
+
+// syncFile is a file as the last pass saw it
+type syncFile struct {
+	size   int64
+	mod    time.Time
+	sha256 string
+}
+
+// FolderSync is one watched directory
+type FolderSync struct {
+	SyncInfo // guarded by mu, except the identity fields
+
+	mu          sync.Mutex
+	spec        dialSpec
+	compression CompressionOptions
+	streams     int
+	debounce    time.Duration
+	files       map[string]syncFile // hashes by size and mtime, so a pass only rereads what changed
+	base        map[string]string   // SHA-256 the mirror holds for each synced file
+	conflicted  map[string]string   // local SHA-256 that conflicted; resent once it changes
+}
+
+var (
+	syncsMu sync.Mutex
+	syncs   = make(map[string]*FolderSync)
+	syncSeq atomic.Uint64
+)
+
+func (s *FolderSync) Info() SyncInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	info := s.SyncInfo
+	info.Conflicts = make([]string, 0, len(s.conflicted))
+	for p := range s.conflicted {
+		info.Conflicts = append(info.Conflicts, p)
+	}
+	sort.Strings(info.Conflicts)
+	return info
+}
+
+type StartSyncPayload struct {
+	Host       string `json:"host"`
+	Port       int    `json:"port"`
+	Path       string `json:"path"`
+	Name       string `json:"name"`        // mirror directory name on the receiver, defaults to the base name
+	DryRun     bool   `json:"dry_run"`     // only report what would be pushed
+	Once       bool   `json:"once"`        // push once and stop instead of watching
+	DebounceMs int    `json:"debounce_ms"` // quiet time gathering changes into one push, default 1000
+	Streams    int    `json:"streams"`     // parallel file connections, default 1
+	TimeoutMs  int    `json:"timeout_ms"`
+	Encrypted  bool   `json:"encrypted"`
+	PeerKey    string `json:"peer_key"`
+
+	Compression CompressionOptions `json:"compression"`
+	Auth        ClientAuth         `json:"auth"`
+
+	AddressFamily string `json:"address_family"` // "ipv4", "ipv6" or "dual" (default)
+	Transport     string `json:"transport"`      // "tcp" (default) or "quic"
+
+	Schedule *ScheduleSpec `json:"schedule"` // run later or repeatedly instead of now
+}
+
+func handleStartSync(payload json.RawMessage, writer *Output) {
+	var p StartSyncPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		sendInvalidPayload(writer, "start_sync")
+		return
+	}
+	if p.Host == "" || p.Port <= 0 || p.Path == "" {
+		sendErrorCode(writer, ErrInvalidArgument, message("foldersync.start_sync_requires_host"), nil)
+		return
+	}
+	if p.Schedule != nil {
+		scheduleCommand(writer, "start_sync", payload, *p.Schedule)
+		return
+	}
+	if err := p.Auth.Validate(); err != nil {
+		sendFailure(writer, err)
+		return
+	}
+	if err := p.Compression.Validate(); err != nil {
+		sendFailure(writer, err)
+		return
+	}
+	root, err := filepath.Abs(p.Path)
+	if err != nil {
+		sendErrorCode(writer, ErrInvalidArgument, message("common.not_directory", "dir", p.Path), nil)
+		return
+	}
+	if info, err := os.Stat(root); err != nil || !info.IsDir() {
+		sendErrorCode(writer, ErrInvalidArgument, message("common.not_directory", "dir", p.Path), nil)
+		return
+	}
+	name := p.Name
+	if name == "" {
+		name = filepath.Base(root)
+	}
+	timeout := defaultDialTimeout
+	if p.TimeoutMs > 0 {
+		timeout = time.Duration(p.TimeoutMs) * time.Millisecond
+	}
+	debounce := defaultSyncDebounce
+	if p.DebounceMs > 0 {
+		debounce = time.Duration(p.DebounceMs) * time.Millisecond
+	}
+	network, isQUIC, err := transportNetwork(p.Transport, p.AddressFamily)
+	if err != nil {
+		sendFailure(writer, err)
+		return
+	}
+
+	var watcher *fsnotify.Watcher
+	if !p.Once {
+		watcher, err = fsnotify.NewWatcher()
+		if err == nil {
+			err = watchTree(watcher, root)
+		}
+		if err != nil {
+			if watcher != nil {
+				watcher.Close()
+			}
+			sendError(writer, message("foldersync.failed_watch", "path", p.Path, "error", err))
+			return
+		}
+	}
+
+	s := &FolderSync{
+		SyncInfo: SyncInfo{
+			ID:      fmt.Sprintf("sync-%d", syncSeq.Add(1)),
+			Path:    root,
+			Mirror:  name,
+			DryRun:  p.DryRun,
+			Once:    p.Once,
+			Started: time.Now(),
+		},
+		spec: dialSpec{
+			Network:   network,
+			Addr:      net.JoinHostPort(normalizeHost(p.Host), strconv.Itoa(p.Port)),
+			QUIC:      isQUIC,
+			Timeout:   timeout,
+			Encrypted: p.Encrypted,
+			PeerKey:   p.PeerKey,
+			Auth:      p.Auth,
+		},
+		compression: p.Compression,
+		streams:     max(1, min(p.Streams, maxTransferStreams)),
+		debounce:    debounce,
+		files:       make(map[string]syncFile),
+		base:        make(map[string]string),
+		conflicted:  make(map[string]string),
+	}
+	s.Peer = s.spec.Addr
+
+	syncsMu.Lock()
+	syncs[s.ID] = s
+	syncsMu.Unlock()
+	ctx, done := trackJob(s.ID, "sync", s.Peer)
+	logger.Info("sync started", "id", s.ID, "path", root, "peer", s.Peer, "dry_run", p.DryRun)
+
+	writer.Encode(okResponse(message("foldersync.sync_started"), s.Info()))
+	go func() {
+		defer recoverPanic("sync " + s.ID)
+		defer done()
+		s.run(ctx, watcher)
+	}()
+}
+
+// watchTree watches dir and every directory below it; fsnotify is not
+// recursive on its own
+func watchTree(w *fsnotify.Watcher, dir string) error {
+	return filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return w.Add(p)
+		}
+		return nil
+	})
+}
+
+// run pushes once, then again whenever changes settle, until canceled;
+// watcher is nil for a sync that only pushes once
+func (s *FolderSync) run(ctx context.Context, watcher *fsnotify.Watcher) {
+	defer func() {
+		if watcher != nil {
+			watcher.Close()
+		}
+		syncsMu.Lock()
+		delete(syncs, s.ID)
+		syncsMu.Unlock()
+		logger.Info("sync stopped", "id", s.ID)
+		emitEvent("sync_stopped", map[string]interface{}{"id": s.ID})
+	}()
+
+	s.pass(ctx)
+	if watcher == nil {
+		return
+	}
+	var due <-chan time.Time
+	var held <-chan struct{} // a pass waiting out a background pause
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-held:
+			held = nil
+			s.pass(ctx)
+		case ev, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if ev.Has(fsnotify.Create) {
+				if info, err := os.Lstat(ev.Name); err == nil && info.IsDir() {
+					if err := watchTree(watcher, ev.Name); err != nil {
+						logger.Warn("failed to watch new directory", "id", s.ID, "path", ev.Name, "error", err)
+					}
+				}
+			}
+			if due == nil {
+				due = time.After(s.debounce)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			// Events may have been dropped; the next pass rescans anyway
+			logger.Warn("sync watcher error", "id", s.ID, "error", err)
+			if due == nil {
+				due = time.After(s.debounce)
+			}
+		case <-due:
+			due = nil
+			if held = power.resumedChan(); held == nil {
+				s.pass(ctx)
+			}
+		}
+	}
+}
+
+// scan lists the tree and returns a manifest of the directories, the files
+// the mirror does not have yet and the files deleted since the last push
+func (s *FolderSync) scan() (*Manifest, error) {
+	listing, err := buildManifest(s.Path)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m := &Manifest{}
+	present := make(map[string]bool)
+	for _, e := range listing.Entries {
+		if e.Dir {
+			m.Entries = append(m.Entries, e)
+			continue
+		}
+		if isPartialName(path.Base(e.Path)) {
+			continue
+		}
+		info, err := os.Stat(filepath.Join(s.Path, filepath.FromSlash(e.Path)))
+		if err != nil {
+			continue // gone since the listing; the next pass sees it deleted
+		}
+		present[e.Path] = true
+		f, seen := s.files[e.Path]
+		if !seen || f.size != info.Size() || !f.mod.Equal(info.ModTime()) {
+			sum, err := hashFile(filepath.Join(s.Path, filepath.FromSlash(e.Path)))
+			if err != nil {
+				continue
+			}
+			f = syncFile{size: info.Size(), mod: info.ModTime(), sha256: sum}
+			s.files[e.Path] = f
+		}
+		if s.base[e.Path] == f.sha256 || s.conflicted[e.Path] == f.sha256 {
+			continue
+		}
+		e.Size, e.SHA256, e.Base = f.size, f.sha256, s.base[e.Path]
+		m.Entries = append(m.Entries, e)
+	}
+	for p := range s.files {
+		if !present[p] {
+			delete(s.files, p)
+		}
+	}
+	for p, sum := range s.base {
+		if !present[p] {
+			m.Deleted = append(m.Deleted, ManifestEntry{Path: p, Base: sum})
+		}
+	}
+	for p := range s.conflicted {
+		if !present[p] {
+			delete(s.conflicted, p)
+		}
+	}
+	sort.Slice(m.Deleted, func(i, j int) bool { return m.Deleted[i].Path < m.Deleted[j].Path })
+	return m, nil
+}
+
+// pass pushes whatever changed since the last one
+func (s *FolderSync) pass(ctx context.Context) {
+	m, err := s.scan()
+	if err != nil {
+		s.failed(err, "")
+		return
+	}
+	changed, deleted := []string{}, []string{}
+	for _, e := range m.Entries {
+		if !e.Dir {
+			changed = append(changed, e.Path)
+		}
+	}
+	for _, e := range m.Deleted {
+		deleted = append(deleted, e.Path)
+	}
+	if len(changed) == 0 && len(deleted) == 0 {
+		return
+	}
+	emitEvent("sync_changes", map[string]interface{}{
+		"id":      s.ID,
+		"changed": changed,
+		"deleted": deleted,
+		"dry_run": s.DryRun,
+	})
+	if s.DryRun {
+		return
+	}
+
+	files, size := m.Totals()
+	t := newTransferAt(priorityLow, "send", s.Mirror, s.Path, s.spec.Addr, size)
+	t.setFiles(files)
+	t.compression = s.compression
+	err = canceled(ctx, sendDirectory(ctx, t, s.Path, m, s.spec, conflictSync, s.streams))
+	t.finish(err)
+	if err != nil {
+		s.failed(err, t.ID)
+		return
+	}
+
+	conflicted := append([]string{}, t.Info().Conflicts...)
+	conflicts := make(map[string]bool)
+	for _, p := range conflicted {
+		conflicts[p] = true
+	}
+	s.mu.Lock()
+	for _, e := range m.Entries {
+		switch {
+		case e.Dir:
+		case conflicts[e.Path]:
+			s.conflicted[e.Path] = e.SHA256
+			emitSyncConflict(t, e.Path, "modified", s.ID)
+		default:
+			s.base[e.Path] = e.SHA256
+			delete(s.conflicted, e.Path)
+		}
+	}
+	for _, e := range m.Deleted {
+		// The mirror keeps a file it changed; stop trying to delete it
+		delete(s.base, e.Path)
+		if conflicts[e.Path] {
+			emitSyncConflict(t, e.Path, "deleted", s.ID)
+		}
+	}
+	s.Passes++
+	s.LastSync = time.Now()
+	s.LastError = ""
+	s.mu.Unlock()
+
+	emitEvent("sync_completed", map[string]interface{}{
+		"id":        s.ID,
+		"transfer":  t.ID,
+		"changed":   changed,
+		"deleted":   deleted,
+		"conflicts": conflicted,
+	})
+}
+
+func (s *FolderSync) failed(err error, transfer string) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	s.mu.Lock()
+	s.LastError = err.Error()
+	s.mu.Unlock()
+	logger.Warn("sync pass failed", "id", s.ID, "error", err)
+	data := map[string]interface{}{"id": s.ID, "error": err.Error()}
+	if transfer != "" {
+		data["transfer"] = transfer
+	}
+	emitEvent("sync_failed", data)
+}
+
+// emitSyncConflict reports a file both sides changed; the sending side
+// names its sync as well
+func emitSyncConflict(t *Transfer, path, change, syncID string) {
+	data := map[string]interface{}{
+		"transfer":  t.ID,
+		"direction": t.Direction,
+		"path":      path,
+		"change":    change, // what the sender did: "modified" or "deleted"
+	}
+	if syncID != "" {
+		data["id"] = syncID
+	}
+	emitEvent("sync_conflict", data)
+}
+
+type StopSyncPayload struct {
+	ID string `json:"id" required:"true"`
+}
+
+func handleStopSync(payload json.RawMessage, writer *Output) {
+	var p StopSyncPayload
+	if err := json.Unmarshal(payload, &p); err != nil || p.ID == "" {
+		sendErrorCode(writer, ErrInvalidArgument, message("foldersync.stop_sync_requires_id"), nil)
+		return
+	}
+	syncsMu.Lock()
+	_, exists := syncs[p.ID]
+	syncsMu.Unlock()
+	if !exists {
+		sendErrorCode(writer, ErrNotRunning, message("foldersync.sync_not_running", "id", p.ID), nil)
+		return
+	}
+	cancelJob(p.ID)
+	writer.Encode(okResponse(message("foldersync.stopping_id", "id", p.ID), nil))
+}
+
+func handleListSyncs(writer *Output) {
+	syncsMu.Lock()
+	list := make([]SyncInfo, 0, len(syncs))
+	for _, s := range syncs {
+		list = append(list, s.Info())
+	}
+	syncsMu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Started.Before(list[j].Started) })
+	writer.Encode(ProtocolResponse{Status: "ok", Data: map[string]interface{}{"syncs": list}})
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+)
+
+// Control channel framing modes. "line" is newline-delimited JSON and stays
+// the default so existing parents keep working; "length" prefixes every
+// message with its size as a 4-byte big-endian integer, which tolerates
+// embedded newlines and arbitrarily large payloads.
+const (
+	framingLine   = "line"
+	framingLength = "length"
+)
+
+const defaultMaxMessageSize = 16 << 20 // 16 MiB
+
+var errMessageTooLarge = errors.New("message too large")
+
+// FrameReader reads control messages from stdin in the negotiated framing
+type FrameReader struct {
+	r *bufio.Reader
+
+	mu      sync.Mutex
+	mode    string
+	maxSize int
+}
+
+func NewFrameReader(r io.Reader, mode string, maxSize int) *FrameReader {
+	return &FrameReader{r: bufio.NewReaderSize(r, 64<<10), mode: mode, maxSize: maxSize}
+}
+
+func (fr *FrameReader) Configure(mode string, maxSize int) {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	fr.mode = mode
+	fr.maxSize = maxSize
+}
+
+func (fr *FrameReader) settings() (string, int) {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	return fr.mode, fr.maxSize
+}
+
+// ReadFrame returns the next message. An oversized message is skipped and
+// reported as errMessageTooLarge so the caller can answer and carry on.
+func (fr *FrameReader) ReadFrame() ([]byte, error) {
+	mode, maxSize := fr.settings()
+	if mode == framingLength {
+		return fr.readLengthPrefixed(maxSize)
+	}
+	return fr.readLine(maxSize)
+}
+
+func (fr *FrameReader) readLengthPrefixed(maxSize int) ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(fr.r, header[:]); err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(header[:])
+	if uint64(size) > uint64(maxSize) {
+		if _, err := fr.r.Discard(int(size)); err != nil {
+			return nil, err
+		}
+		return nil, errMessageTooLarge
+	}
+
+	frame := make([]byte, size)
+	if _, err := io.ReadFull(fr.r, frame); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+func (fr *FrameReader) readLine(maxSize int) ([]byte, error) {
+	var line []byte
+	tooLarge := false
+	for {
+		chunk, err := fr.r.ReadSlice('\n')
+		if !tooLarge {
+			if len(line)+len(chunk) > maxSize+1 { // +1 for the newline itself
+				tooLarge = true
+				line = nil
+			} else {
+				line = append(line, chunk...)
+			}
+		}
+
+		switch err {
+		case nil:
+			if tooLarge {
+				return nil, errMessageTooLarge
+			}
+			return line, nil
+		case bufio.ErrBufferFull:
+			continue
+		default:
+			return nil, err
+		}
+	}
+}
+
+// writeLengthPrefixed writes data as a single length-prefixed frame
+func writeLengthPrefixed(w io.Writer, data []byte) error {
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(data)))
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+type SetFramingPayload struct {
+	Mode           string `json:"mode"` // "line", "length"
+	MaxMessageSize int    `json:"max_message_size"`
+}
+
+// handleSetFraming switches both directions of the channel the request
+// arrived on, stdin or a single control socket client. The response is
+// still written in the old framing; everything after it uses the new one.
+func handleSetFraming(payload json.RawMessage, writer *Output) {
+	var p SetFramingPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		sendInvalidPayload(writer, "set_framing")
+		return
+	}
+
+	in := readerFor(writer)
+	mode, current := in.settings()
+	if p.Mode != "" {
+		mode = p.Mode
+	}
+	if mode != framingLine && mode != framingLength {
+		sendErrorCode(writer, ErrUnsupported, message("framing.unsupported_framing_mode", "mode", mode), nil)
+		return
+	}
+	maxSize := current
+	if p.MaxMessageSize > 0 {
+		maxSize = p.MaxMessageSize
+	}
+
+	writer.Encode(okResponse(message("framing.set", "mode", mode),
+		map[string]interface{}{"mode": mode, "max_message_size": maxSize}))
+
+	in.Configure(mode, maxSize)
+	writer.SetFraming(mode)
+	logger.Info("control channel framing changed", "mode", mode, "max_message_size", maxSize)
+}
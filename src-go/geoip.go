@@ -0,0 +1,478 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// GeoIP annotates remote addresses with where they are and which network
+// they belong to, from MaxMind DB (.mmdb) files the user downloads, such
+// as GeoLite2-Country or -City and GeoLite2-ASN, or compatible ones. Nothing
+// is looked up online. Each configured database is searched and what they
+// know is merged, so a location database and an ASN one can be combined.
+// Connections and history records carry the result in geo, and lookup_ip
+// asks for any address.
+const (
+	geoCacheSize  = 1024
+	mmdbMaxDepth  = 32 // nesting of maps and arrays a record may have
+	mmdbMetaLimit = 128 << 10
+)
+
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+var errMMDBCorrupt = errors.New("corrupt MaxMind database")
+
+// GeoIPConfig is the config section naming the databases
+type GeoIPConfig struct {
+	Databases []string `json:"databases,omitempty"` // .mmdb files, searched in order
+}
+
+func (g GeoIPConfig) Validate() error {
+	for _, path := range g.Databases {
+		if path == "" {
+			return catalogError(ErrInvalidArgument, "geoip.databases_must_not_contain")
+		}
+	}
+	return nil
+}
+
+// GeoInfo is what the databases know about an address
+type GeoInfo struct {
+	Country     string `json:"country,omitempty"` // ISO 3166 code
+	CountryName string `json:"country_name,omitempty"`
+	City        string `json:"city,omitempty"`
+	ASN         uint64 `json:"asn,omitempty"`
+	ASOrg       string `json:"as_org,omitempty"`
+}
+
+func (g *GeoInfo) empty() bool { return *g == GeoInfo{} }
+
+// mmdb is an opened MaxMind database held in memory
+type mmdb struct {
+	path       string
+	data       []byte // whole file
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	dbType     string
+	dataStart  uint // offset of the data section in data
+	ipv4Start  uint // node IPv4 addresses start from in an IPv6 tree
+}
+
+func openMMDB(path string) (*mmdb, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	tail := data
+	if len(tail) > mmdbMetaLimit {
+		tail = tail[len(tail)-mmdbMetaLimit:]
+	}
+	i := bytes.LastIndex(tail, mmdbMetadataMarker)
+	if i < 0 {
+		return nil, fmt.Errorf("%s is not a MaxMind database", path)
+	}
+	metaStart := uint(len(data)-len(tail)+i) + uint(len(mmdbMetadataMarker))
+	d := mmdbDecoder{buf: data[metaStart:]}
+	v, _, err := d.decode(0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("%s: metadata: %w", path, err)
+	}
+	meta, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", path, errMMDBCorrupt)
+	}
+	db := &mmdb{
+		path:       path,
+		data:       data,
+		nodeCount:  uint(mmdbUint(meta["node_count"])),
+		recordSize: uint(mmdbUint(meta["record_size"])),
+		ipVersion:  uint(mmdbUint(meta["ip_version"])),
+	}
+	db.dbType, _ = meta["database_type"].(string)
+	switch db.recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("%s: unsupported record size %d", path, db.recordSize)
+	}
+	// Bound the node count by the file first, or the tree size can wrap
+	if db.nodeCount > uint(len(data))/(db.recordSize/4) {
+		return nil, fmt.Errorf("%s: %w", path, errMMDBCorrupt)
+	}
+	treeSize := db.recordSize * 2 / 8 * db.nodeCount
+	if treeSize+16 > metaStart || (db.ipVersion != 4 && db.ipVersion != 6) {
+		return nil, fmt.Errorf("%s: %w", path, errMMDBCorrupt)
+	}
+	db.dataStart = treeSize + 16
+	if db.ipVersion == 6 {
+		// IPv4 addresses live under ::/96
+		node := uint(0)
+		for i := 0; i < 96 && node < db.nodeCount; i++ {
+			node = db.record(node, 0)
+		}
+		db.ipv4Start = node
+	}
+	return db, nil
+}
+
+// record reads one of the two records of node; bit picks the right one
+func (db *mmdb) record(node uint, bit uint) uint {
+	size := db.recordSize * 2 / 8
+	b := db.data[node*size : node*size+size]
+	switch db.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit*4:]))
+	}
+}
+
+// lookup returns the record for ip, or nil when the database has none
+func (db *mmdb) lookup(ip netip.Addr) (interface{}, error) {
+	ip = ip.Unmap()
+	node, bits := uint(0), ip.AsSlice()
+	if ip.Is4() && db.ipVersion == 6 {
+		node = db.ipv4Start
+	} else if ip.Is6() && db.ipVersion == 4 {
+		return nil, nil
+	}
+	for i := 0; i < len(bits)*8 && node < db.nodeCount; i++ {
+		node = db.record(node, uint(bits[i/8]>>(7-i%8)&1))
+	}
+	switch {
+	case node == db.nodeCount:
+		return nil, nil
+	case node < db.nodeCount:
+		return nil, errMMDBCorrupt
+	}
+	offset := node - db.nodeCount - 16
+	d := mmdbDecoder{buf: db.data[db.dataStart:]}
+	v, _, err := d.decode(offset, 0)
+	return v, err
+}
+
+// mmdbDecoder reads the MaxMind DB data format
+type mmdbDecoder struct {
+	buf []byte
+}
+
+func (d *mmdbDecoder) next(offset, n uint) ([]byte, error) {
+	if offset+n > uint(len(d.buf)) || offset+n < offset {
+		return nil, errMMDBCorrupt
+	}
+	return d.buf[offset : offset+n], nil
+}
+
+// decode returns the value at offset and the offset after it
+func (d *mmdbDecoder) decode(offset uint, depth int) (interface{}, uint, error) {
+	if depth > mmdbMaxDepth {
+		return nil, 0, errMMDBCorrupt
+	}
+	b, err := d.next(offset, 1)
+	if err != nil {
+		return nil, 0, err
+	}
+	ctrl := b[0]
+	offset++
+	typ := uint(ctrl >> 5)
+	if typ == 1 {
+		return d.pointer(ctrl, offset, depth)
+	}
+	if typ == 0 {
+		if b, err = d.next(offset, 1); err != nil {
+			return nil, 0, err
+		}
+		typ = 7 + uint(b[0])
+		offset++
+	}
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if b, err = d.next(offset, n); err != nil {
+			return nil, 0, err
+		}
+		offset += n
+		switch n {
+		case 1:
+			size = 29 + uint(b[0])
+		case 2:
+			size = 285 + (uint(b[0])<<8 | uint(b[1]))
+		default:
+			size = 65821 + (uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2]))
+		}
+	}
+
+	switch typ {
+	case 7: // map
+		m := make(map[string]interface{}, min(size, 64))
+		for i := uint(0); i < size; i++ {
+			k, next, err := d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errMMDBCorrupt
+			}
+			v, after, err := d.decode(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[key], offset = v, after
+		}
+		return m, offset, nil
+	case 11: // array
+		a := make([]interface{}, 0, min(size, 64))
+		for i := uint(0); i < size; i++ {
+			v, next, err := d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a, offset = append(a, v), next
+		}
+		return a, offset, nil
+	case 14: // boolean, carried in the size
+		return size != 0, offset, nil
+	}
+
+	if b, err = d.next(offset, size); err != nil {
+		return nil, 0, err
+	}
+	offset += size
+	switch typ {
+	case 2: // string
+		return string(b), offset, nil
+	case 3: // double
+		if size != 8 {
+			return nil, 0, errMMDBCorrupt
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case 15: // float
+		if size != 4 {
+			return nil, 0, errMMDBCorrupt
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), offset, nil
+	case 4: // bytes
+		return append([]byte(nil), b...), offset, nil
+	case 5, 6, 9: // unsigned integers
+		if size > 8 {
+			return nil, 0, errMMDBCorrupt
+		}
+		var u uint64
+		for _, c := range b {
+			u = u<<8 | uint64(c)
+		}
+		return u, offset, nil
+	case 8: // int32
+		if size > 4 {
+			return nil, 0, errMMDBCorrupt
+		}
+		var u uint32
+		for _, c := range b {
+			u = u<<8 | uint32(c)
+		}
+		return int64(int32(u)), offset, nil
+	case 10: // uint128, kept as hex
+		return fmt.Sprintf("%x", b), offset, nil
+	default:
+		return nil, 0, errMMDBCorrupt
+	}
+}
+
+// pointer follows a pointer to the value it names; the data after the
+// pointer continues where the pointer itself ends
+func (d *mmdbDecoder) pointer(ctrl byte, offset uint, depth int) (interface{}, uint, error) {
+	n := uint(ctrl>>3&0x3) + 1
+	b, err := d.next(offset, n)
+	if err != nil {
+		return nil, 0, err
+	}
+	var p uint
+	if n < 4 {
+		p = uint(ctrl & 0x7)
+	}
+	for _, c := range b {
+		p = p<<8 | uint(c)
+	}
+	switch n {
+	case 2:
+		p += 2048
+	case 3:
+		p += 526336
+	}
+	v, _, err := d.decode(p, depth+1)
+	return v, offset + n, err
+}
+
+func mmdbUint(v interface{}) uint64 {
+	u, _ := v.(uint64)
+	return u
+}
+
+// mmdbPath walks the nested maps of a record
+func mmdbPath(v interface{}, keys ...string) interface{} {
+	for _, k := range keys {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = m[k]
+	}
+	return v
+}
+
+// geoFromRecord fills in what g does not know yet from a record in the
+// MaxMind layout, or the flat one of compatible databases
+func geoFromRecord(g *GeoInfo, rec interface{}) {
+	str := func(keys ...string) string {
+		s, _ := mmdbPath(rec, keys...).(string)
+		return s
+	}
+	fill := func(field *string, values ...string) {
+		for _, v := range values {
+			if *field == "" && v != "" {
+				*field = v
+			}
+		}
+	}
+	fill(&g.Country, str("country", "iso_code"), str("registered_country", "iso_code"), str("country_code"))
+	fill(&g.CountryName, str("country", "names", "en"), str("registered_country", "names", "en"), str("country_name"))
+	fill(&g.City, str("city", "names", "en"), str("city"))
+	fill(&g.ASOrg, str("autonomous_system_organization"), str("as_name"))
+	if g.ASN == 0 {
+		g.ASN = mmdbUint(mmdbPath(rec, "autonomous_system_number"))
+	}
+	if g.ASN == 0 {
+		// Flat databases write it as "AS64496"
+		if asn := strings.TrimPrefix(str("asn"), "AS"); asn != "" {
+			g.ASN, _ = strconv.ParseUint(asn, 10, 32)
+		}
+	}
+}
+
+// GeoIP holds the open databases and recent answers
+type GeoIP struct {
+	mu    sync.Mutex
+	dbs   []*mmdb
+	cache map[netip.Addr]*GeoInfo
+}
+
+var geoip = GeoIP{cache: make(map[netip.Addr]*GeoInfo)}
+
+// load opens the configured databases, replacing the open ones. A
+// database that fails to open is skipped and reported.
+func (g *GeoIP) load(cfg GeoIPConfig) error {
+	var dbs []*mmdb
+	var errs []error
+	for _, path := range cfg.Databases {
+		db, err := openMMDB(path)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		dbs = append(dbs, db)
+	}
+	g.mu.Lock()
+	g.dbs = dbs
+	clear(g.cache)
+	g.mu.Unlock()
+	return errors.Join(errs...)
+}
+
+// lookup answers for ip, or nil when no database knows it. Private and
+// local addresses are never looked up.
+func (g *GeoIP) lookup(ip netip.Addr) *GeoInfo {
+	ip = ip.Unmap()
+	if !ip.IsValid() || ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+		return nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if len(g.dbs) == 0 {
+		return nil
+	}
+	if info, ok := g.cache[ip]; ok {
+		return info
+	}
+	info := &GeoInfo{}
+	for _, db := range g.dbs {
+		rec, err := db.lookup(ip)
+		if err != nil {
+			logger.Debug("geoip lookup failed", "path", db.path, "ip", ip.String(), "error", err)
+			continue
+		}
+		if rec != nil {
+			geoFromRecord(info, rec)
+		}
+	}
+	if info.empty() {
+		info = nil
+	}
+	if len(g.cache) >= geoCacheSize {
+		clear(g.cache)
+	}
+	g.cache[ip] = info
+	return info
+}
+
+// geoForAddr looks up the host of a host:port address
+func geoForAddr(addr string) *GeoInfo {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return nil
+	}
+	return geoip.lookup(ip.WithZone(""))
+}
+
+type LookupIPPayload struct {
+	IP string `json:"ip" required:"true"`
+}
+
+// handleLookupIP answers what the databases know about an address
+func handleLookupIP(payload json.RawMessage, writer *Output) {
+	var p LookupIPPayload
+	if err := json.Unmarshal(payload, &p); err != nil || p.IP == "" {
+		sendErrorCode(writer, ErrInvalidArgument, message("geoip.lookup_ip_requires_ip"), nil)
+		return
+	}
+	ip, err := netip.ParseAddr(normalizeHost(p.IP))
+	if err != nil {
+		sendErrorCode(writer, ErrInvalidArgument, message("geoip.invalid_ip_address", "ip", p.IP), nil)
+		return
+	}
+	geoip.mu.Lock()
+	databases := make([]map[string]interface{}, 0, len(geoip.dbs))
+	for _, db := range geoip.dbs {
+		databases = append(databases, map[string]interface{}{"path": db.path, "type": db.dbType})
+	}
+	geoip.mu.Unlock()
+	if len(databases) == 0 {
+		sendError(writer, message("geoip.no_geoip_databases_configured"))
+		return
+	}
+	data := map[string]interface{}{"ip": ip.String(), "databases": databases}
+	if info := geoip.lookup(ip.WithZone("")); info != nil {
+		data["geo"] = info
+	}
+	writer.Encode(ProtocolResponse{Status: "ok", Data: data})
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// mmdbValue encodes v in the MaxMind DB data format
+func mmdbValue(buf *bytes.Buffer, v interface{}) {
+	head := func(typ, size int) {
+		extra := -1
+		if size >= 29 {
+			size, extra = 29, size-29 // up to 284 is enough here
+		}
+		if typ > 7 {
+			buf.WriteByte(byte(size))
+			buf.WriteByte(byte(typ - 7))
+		} else {
+			buf.WriteByte(byte(typ<<5 | size))
+		}
+		if extra >= 0 {
+			buf.WriteByte(byte(extra))
+		}
+	}
+	switch v := v.(type) {
+	case string:
+		head(2, len(v))
+		buf.WriteString(v)
+	case uint32:
+		head(6, 4)
+		binary.Write(buf, binary.BigEndian, v)
+	case uint16:
+		head(5, 2)
+		binary.Write(buf, binary.BigEndian, v)
+	case uint64:
+		head(9, 8)
+		binary.Write(buf, binary.BigEndian, v)
+	case map[string]interface{}:
+		head(7, len(v))
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			mmdbValue(buf, k)
+			mmdbValue(buf, v[k])
+		}
+	}
+}
+
+// writeTestMMDB writes an IPv4 database with one record for prefix/8
+func writeTestMMDB(t *testing.T, prefix byte, record map[string]interface{}) string {
+	return writeTestMMDBNodes(t, prefix, record, 8)
+}
+
+// writeTestMMDBNodes is writeTestMMDB claiming count nodes in its metadata
+func writeTestMMDBNodes(t *testing.T, prefix byte, record map[string]interface{}, count uint64) string {
+	const nodes = 8
+	var tree bytes.Buffer
+	put := func(r uint32) { tree.Write([]byte{byte(r >> 16), byte(r >> 8), byte(r)}) }
+	for i := 0; i < nodes; i++ {
+		next := uint32(i + 1)
+		if i == nodes-1 {
+			next = nodes + 16 // the data section's first record
+		}
+		if prefix>>(7-i)&1 == 0 {
+			put(next)
+			put(nodes)
+		} else {
+			put(nodes)
+			put(next)
+		}
+	}
+	var file bytes.Buffer
+	file.Write(tree.Bytes())
+	file.Write(make([]byte, 16))
+	mmdbValue(&file, record)
+	file.Write(mmdbMetadataMarker)
+	mmdbValue(&file, map[string]interface{}{
+		"node_count": count, "record_size": uint16(24), "ip_version": uint16(4), "database_type": "Test",
+	})
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	if err := os.WriteFile(path, file.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestGeoIPLookup(t *testing.T) {
+	city := writeTestMMDB(t, 81, map[string]interface{}{
+		"country": map[string]interface{}{"iso_code": "DE", "names": map[string]interface{}{"en": "Germany"}},
+		"city":    map[string]interface{}{"names": map[string]interface{}{"en": "Berlin"}},
+	})
+	asn := writeTestMMDB(t, 81, map[string]interface{}{
+		"autonomous_system_number":       uint32(3320),
+		"autonomous_system_organization": "Deutsche Telekom AG",
+	})
+	if err := geoip.load(GeoIPConfig{Databases: []string{city, asn}}); err != nil {
+		t.Fatal(err)
+	}
+	defer geoip.load(GeoIPConfig{})
+
+	got := geoForAddr("81.2.3.4:5000")
+	want := GeoInfo{Country: "DE", CountryName: "Germany", City: "Berlin", ASN: 3320, ASOrg: "Deutsche Telekom AG"}
+	if got == nil || *got != want {
+		t.Errorf("81.2.3.4 gave %+v", got)
+	}
+	if got := geoip.lookup(netip.MustParseAddr("82.2.3.4")); got != nil {
+		t.Errorf("unknown address gave %+v", got)
+	}
+	if got := geoForAddr("192.168.1.5:22"); got != nil {
+		t.Errorf("private address gave %+v", got)
+	}
+	if err := geoip.load(GeoIPConfig{Databases: []string{filepath.Join(t.TempDir(), "missing.mmdb")}}); err == nil {
+		t.Error("missing database loaded")
+	}
+}
+
+func TestOpenMMDBRefusesWrappingNodeCount(t *testing.T) {
+	// Six bytes a node times this wraps around to a tree of two bytes
+	path := writeTestMMDBNodes(t, 81, map[string]interface{}{"city": "x"}, math.MaxUint64/6+1)
+	if _, err := openMMDB(path); !errors.Is(err, errMMDBCorrupt) {
+		t.Errorf("opened with %v", err)
+	}
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+)
+
+// Peer groups are named lists of peers kept in the config, such as
+// "family" or "render-nodes". A member is a discovered instance name or
+// anything the trust store resolves: a name, instance, fingerprint or key.
+// broadcast_file sends one file to every member discovery sees right now,
+// each as its own transfer with the usual progress events, and reports
+// the whole run with broadcast_completed once the last one is over.
+const (
+	maxGroupName    = 64
+	maxGroupMembers = 256
+)
+
+// groupsMu serializes group edits, which read the config and write it back
+var groupsMu sync.Mutex
+
+var broadcastSeq atomic.Uint64
+
+func validateGroup(name string, members []string) error {
+	if name == "" || len(name) > maxGroupName {
+		return catalogError(ErrInvalidArgument, "groups.group_names_must_1", "max_group_name", maxGroupName)
+	}
+	if strings.IndexFunc(name, unicode.IsControl) >= 0 {
+		return catalogError(ErrInvalidArgument, "groups.invalid_group_name", "name", fmt.Sprintf("%q", name))
+	}
+	if len(members) > maxGroupMembers {
+		return catalogError(ErrInvalidArgument, "groups.group_most_members", "name", name, "max_group_members", maxGroupMembers)
+	}
+	seen := make(map[string]bool, len(members))
+	for _, m := range members {
+		if m == "" || seen[m] {
+			return catalogError(ErrInvalidArgument, "groups.group_members_must_unique", "name", name)
+		}
+		seen[m] = true
+	}
+	return nil
+}
+
+// updateGroup applies edit to the members of group and saves the config;
+// create is whether the group must not exist yet
+func updateGroup(name string, create bool, edit func([]string) ([]string, error)) ([]string, error) {
+	groupsMu.Lock()
+	defer groupsMu.Unlock()
+	members, exists := config.Get().Groups[name]
+	switch {
+	case create && exists:
+		return nil, catalogError(ErrFailed, "groups.group_already_exists", "name", name)
+	case !create && !exists:
+		return nil, catalogError(ErrNotFound, "groups.group_not_found", "group", name)
+	}
+	members, err := edit(append([]string{}, members...))
+	if err != nil {
+		return nil, err
+	}
+	patch, _ := json.Marshal(map[string]interface{}{"groups": map[string][]string{name: members}})
+	if _, err := config.Update(patch); err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+// onlinePeer is a group member discovery currently sees
+type onlinePeer struct {
+	instance string
+	host     string
+	others   []string // further addresses it announced, raced against host
+	port     int
+	key      string // public key from the trust store, if it knows one
+}
+
+// resolveMember finds where member can be reached right now
+func resolveMember(member, family string) (onlinePeer, bool) {
+	var known KnownPeer
+	trust.mu.Lock()
+	if p := trust.lookupLocked(member); p != nil {
+		known = *p
+	}
+	trust.mu.Unlock()
+
+	discovery.Mutex.Lock()
+	peer, ok := discovery.Peers[member]
+	if !ok && known.Fingerprint != "" {
+		for _, p := range discovery.Peers {
+			if p.Fingerprint == known.Fingerprint || (p.Fingerprint == "" && p.Instance == known.Instance) {
+				peer, ok = p, true
+				break
+			}
+		}
+	}
+	var instance string
+	var port int
+	if ok {
+		instance, port = peer.Instance, peer.Port
+	}
+	discovery.Mutex.Unlock()
+	if !ok {
+		return onlinePeer{}, false
+	}
+	online := onlinePeer{instance: instance, port: port, key: known.PublicKey}
+	hosts := peerHosts(instance, family)
+	if len(hosts) == 0 {
+		return online, false
+	}
+	online.host, online.others = hosts[0], hosts[1:]
+	return online, true
+}
+
+// GroupInfo is a group in list_groups, with which members are online
+type GroupInfo struct {
+	Name    string        `json:"name"`
+	Members []GroupMember `json:"members"`
+	Online  int           `json:"online"`
+}
+
+type GroupMember struct {
+	Peer     string `json:"peer"`
+	Online   bool   `json:"online"`
+	Instance string `json:"instance,omitempty"` // discovered instance the member resolved to
+}
+
+func groupInfo(name string, members []string) GroupInfo {
+	g := GroupInfo{Name: name, Members: make([]GroupMember, 0, len(members))}
+	for _, m := range members {
+		peer, online := resolveMember(m, "")
+		g.Members = append(g.Members, GroupMember{Peer: m, Online: online, Instance: peer.instance})
+		if online {
+			g.Online++
+		}
+	}
+	return g
+}
+
+type CreateGroupPayload struct {
+	Name    string   `json:"name"`
+	Members []string `json:"members"`
+}
+
+func handleCreateGroup(payload json.RawMessage, writer *Output) {
+	var p CreateGroupPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		sendInvalidPayload(writer, "create_group")
+		return
+	}
+	if p.Members == nil {
+		p.Members = []string{}
+	}
+	if err := validateGroup(p.Name, p.Members); err != nil {
+		sendFailure(writer, err)
+		return
+	}
+	members, err := updateGroup(p.Name, true, func([]string) ([]string, error) { return p.Members, nil })
+	if err != nil {
+		sendGroupError(writer, p.Name, err)
+		return
+	}
+	logger.Info("group created", "name", p.Name, "members", len(members))
+	writer.Encode(okResponse(message("groups.group_created", "name", p.Name), groupInfo(p.Name, members)))
+}
+
+type GroupPeerPayload struct {
+	Group string `json:"group" required:"true"`
+	Peer  string `json:"peer" required:"true"`
+}
+
+func handleAddPeerToGroup(payload json.RawMessage, writer *Output) {
+	var p GroupPeerPayload
+	if err := json.Unmarshal(payload, &p); err != nil || p.Group == "" || p.Peer == "" {
+		sendErrorCode(writer, ErrInvalidArgument, message("groups.add_peer_group_requires"), nil)
+		return
+	}
+	members, err := updateGroup(p.Group, false, func(members []string) ([]string, error) {
+		for _, m := range members {
+			if m == p.Peer {
+				return members, nil
+			}
+		}
+		return append(members, p.Peer), nil
+	})
+	if err != nil {
+		sendGroupError(writer, p.Group, err)
+		return
+	}
+	writer.Encode(okResponse(message("groups.peer_added", "group", p.Group), groupInfo(p.Group, members)))
+}
+
+func handleRemovePeerFromGroup(payload json.RawMessage, writer *Output) {
+	var p GroupPeerPayload
+	if err := json.Unmarshal(payload, &p); err != nil || p.Group == "" || p.Peer == "" {
+		sendErrorCode(writer, ErrInvalidArgument, message("groups.remove_peer_group_requires"), nil)
+		return
+	}
+	members, err := updateGroup(p.Group, false, func(members []string) ([]string, error) {
+		for i, m := range members {
+			if m == p.Peer {
+				return append(members[:i], members[i+1:]...), nil
+			}
+		}
+		return nil, catalogError(ErrNotFound, "groups.peer_not_found", "group", p.Group, "peer", p.Peer)
+	})
+	if err != nil {
+		sendGroupError(writer, p.Group, err)
+		return
+	}
+	writer.Encode(okResponse(message("groups.peer_removed", "group", p.Group), groupInfo(p.Group, members)))
+}
+
+type GroupPayload struct {
+	Name string `json:"name" required:"true"`
+}
+
+func handleDeleteGroup(payload json.RawMessage, writer *Output) {
+	var p GroupPayload
+	if err := json.Unmarshal(payload, &p); err != nil || p.Name == "" {
+		sendErrorCode(writer, ErrInvalidArgument, message("groups.delete_group_requires_name"), nil)
+		return
+	}
+	groupsMu.Lock()
+	defer groupsMu.Unlock()
+	if _, exists := config.Get().Groups[p.Name]; !exists {
+		sendErrorCode(writer, ErrNotFound, message("groups.group_not_found", "group", p.Name), map[string]interface{}{"name": p.Name})
+		return
+	}
+	patch, _ := json.Marshal(map[string]interface{}{"groups": map[string]interface{}{p.Name: nil}})
+	if _, err := config.Update(patch); err != nil {
+		sendFailure(writer, err)
+		return
+	}
+	logger.Info("group deleted", "name", p.Name)
+	writer.Encode(okResponse(message("groups.group_deleted", "name", p.Name), nil))
+}
+
+func handleListGroups(writer *Output) {
+	groups := config.Get().Groups
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	list := make([]GroupInfo, 0, len(names))
+	for _, name := range names {
+		list = append(list, groupInfo(name, groups[name]))
+	}
+	writer.Encode(ProtocolResponse{Status: "ok", Data: map[string]interface{}{"groups": list}})
+}
+
+// sendGroupError reports an updateGroup failure with the code it calls for
+func sendGroupError(writer *Output, group string, err error) {
+	if messageOf(err).Key == "groups.group_already_exists" {
+		sendErrorCode(writer, ErrInvalidState, messageOf(err), map[string]interface{}{"name": group})
+		return
+	}
+	sendFailure(writer, err)
+}
+
+type BroadcastFilePayload struct {
+	Group     string `json:"group"`
+	Path      string `json:"path"`
+	Name      string `json:"name"` // name announced to the receivers, defaults to the file's base name
+	Port      int    `json:"port"` // receivers' port; 0 uses the one each peer advertises
+	TimeoutMs int    `json:"timeout_ms"`
+	Encrypted bool   `json:"encrypted"` // members the trust store knows are pinned to their key
+
+	Compression CompressionOptions `json:"compression"`
+	Auth        ClientAuth         `json:"auth"`
+
+	AddressFamily string `json:"address_family"` // "ipv4", "ipv6" or "dual" (default)
+	Transport     string `json:"transport"`      // "tcp" (default) or "quic"
+	Dedup         bool   `json:"dedup"`
+}
+
+// BroadcastRecipient is one member's part of a broadcast
+type BroadcastRecipient struct {
+	Peer     string `json:"peer"`
+	Instance string `json:"instance,omitempty"`
+	Addr     string `json:"addr,omitempty"`
+	Transfer string `json:"transfer,omitempty"` // transfer id, for its progress events
+	State    string `json:"state"`              // "active", "completed", "failed", "canceled", "offline"
+	Bytes    int64  `json:"bytes"`
+	Error    string `json:"error,omitempty"`
+}
+
+// handleBroadcastFile starts one send of the file per online member of the
+// group; the answer lists the transfers, and broadcast_completed follows
+// once every one of them has finished
+func handleBroadcastFile(payload json.RawMessage, writer *Output) {
+	var p BroadcastFilePayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		sendInvalidPayload(writer, "broadcast_file")
+		return
+	}
+	if p.Group == "" || p.Path == "" {
+		sendErrorCode(writer, ErrInvalidArgument, message("groups.broadcast_file_requires_group"), nil)
+		return
+	}
+	members, exists := config.Get().Groups[p.Group]
+	if !exists {
+		sendErrorCode(writer, ErrNotFound, message("groups.group_not_found", "group", p.Group), map[string]interface{}{"name": p.Group})
+		return
+	}
+	if !validFamily(p.AddressFamily) {
+		sendErrorCode(writer, ErrUnsupported, message("common.unsupported_address_family", "address_family", p.AddressFamily), nil)
+		return
+	}
+	if err := p.Auth.Validate(); err != nil {
+		sendFailure(writer, err)
+		return
+	}
+	if err := p.Compression.Validate(); err != nil {
+		sendFailure(writer, err)
+		return
+	}
+	network, isQUIC, err := transportNetwork(p.Transport, p.AddressFamily)
+	if err != nil {
+		sendFailure(writer, err)
+		return
+	}
+	info, err := os.Stat(p.Path)
+	if err != nil {
+		sendError(writer, message("common.failed_open", "path", p.Path, "error", err))
+		return
+	}
+	if !info.Mode().IsRegular() {
+		sendErrorCode(writer, ErrInvalidArgument, message("common.not_regular_file", "path", p.Path), nil)
+		return
+	}
+	name := p.Name
+	if name == "" {
+		name = filepath.Base(p.Path)
+	}
+	timeout := defaultDialTimeout
+	if p.TimeoutMs > 0 {
+		timeout = time.Duration(p.TimeoutMs) * time.Millisecond
+	}
+
+	id := fmt.Sprintf("broadcast-%d", broadcastSeq.Add(1))
+	recipients := make([]BroadcastRecipient, len(members))
+	type launch struct {
+		i int
+		t *Transfer
+		f *os.File
+	}
+	var launches []launch
+	for i, member := range members {
+		r := &recipients[i]
+		r.Peer, r.State = member, "offline"
+		peer, online := resolveMember(member, p.AddressFamily)
+		port := p.Port
+		if port <= 0 {
+			port = peer.port
+		}
+		if !online || port <= 0 {
+			continue
+		}
+		r.Instance = peer.instance
+		r.Addr = net.JoinHostPort(normalizeHost(peer.host), strconv.Itoa(port))
+		f, err := os.Open(p.Path)
+		if err != nil {
+			r.State, r.Error = "failed", err.Error()
+			continue
+		}
+		spec := dialSpec{
+			Network:    network,
+			Addr:       r.Addr,
+			Alternates: joinHosts(peer.others, port),
+			QUIC:       isQUIC,
+			Timeout:    timeout,
+			Encrypted:  p.Encrypted,
+			Auth:       p.Auth,
+			Dedup:      p.Dedup,
+		}
+		if p.Encrypted {
+			spec.PeerKey = peer.key
+		}
+		t := newSendTransfer(info, name, p.Path, spec, p.Compression, "", "")
+		t.Broadcast = id
+		r.Transfer, r.State = t.ID, "active"
+		launches = append(launches, launch{i, t, f})
+	}
+	if len(launches) == 0 {
+		sendErrorCode(writer, ErrInvalidState, message("groups.no_member_group_online", "group", p.Group),
+			map[string]interface{}{"group": p.Group, "recipients": recipients})
+		return
+	}
+
+	logger.Info("broadcast started", "id", id, "group", p.Group, "name", name, "recipients", len(launches))
+	writer.Encode(okResponse(message("groups.broadcasting_members", "name", name, "launches", len(launches), "members", len(members)),
+		map[string]interface{}{"id": id, "group": p.Group, "name": name, "size": info.Size(), "recipients": recipients}))
+
+	started := time.Now()
+	var wg sync.WaitGroup
+	wg.Add(len(launches))
+	for _, l := range launches {
+		launchSendFile(l.t, l.f, false, wg.Done)
+	}
+	go func() {
+		defer recoverPanic("broadcast " + id)
+		wg.Wait()
+		counts := map[string]int{}
+		for _, l := range launches {
+			ti := l.t.Info()
+			r := &recipients[l.i]
+			r.State, r.Bytes, r.Error = ti.State, ti.Bytes, ti.Error
+		}
+		for _, r := range recipients {
+			counts[r.State]++
+		}
+		logger.Info("broadcast finished", "id", id, "group", p.Group, "completed", counts["completed"], "failed", counts["failed"])
+		emitEvent("broadcast_completed", map[string]interface{}{
+			"id":              id,
+			"group":           p.Group,
+			"name":            name,
+			"size":            info.Size(),
+			"recipients":      recipients,
+			"completed":       counts["completed"],
+			"failed":          counts["failed"] + counts["canceled"],
+			"offline":         counts["offline"],
+			"elapsed_seconds": time.Since(started).Seconds(),
+		})
+	}()
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// The gRPC server is another way in besides stdin and the control socket,
+// for local tools that would rather use a generated client than the line
+// protocol. It serves lumina.v1.Lumina (see lumina.proto): Call runs one
+// protocol request and returns its response, Events streams events, and
+// Progress streams the progress of one job or of all of them. Messages
+// are google.protobuf.Struct values shaped like the JSON protocol, so
+// every command is reachable without a message per payload. The server
+// answers reflection, which lets grpcurl explore it. It listens on a
+// socket file or named pipe only the current user can open, by default
+// the one beside the control socket. Loopback TCP is open to every local
+// user, so it needs a token that every call must present as
+// "authorization: Bearer <token>" metadata.
+const (
+	grpcService     = "lumina.v1.Lumina"
+	grpcEventBuffer = 1024            // events held for a slow stream before it is cut off
+	grpcStopGrace   = 2 * time.Second // for calls in flight when the server stops
+)
+
+var (
+	errGRPCAddr  = errors.New("gRPC listens on loopback only; use path for a socket")
+	errGRPCToken = errors.New("gRPC over TCP needs a token; use path for a socket")
+)
+
+// GRPCState is the gRPC server and the streams subscribed to events
+type GRPCState struct {
+	mu     sync.Mutex
+	addr   string // host:port or socket path
+	token  string // bearer token calls must present, for TCP
+	server *grpc.Server
+	subs   map[*grpcSub]bool
+}
+
+var grpcState = GRPCState{subs: make(map[*grpcSub]bool)}
+
+// grpcSub is one Events or Progress stream
+type grpcSub struct {
+	match     func(event, id string) bool
+	namespace string // only events outside any namespace or in this one
+	events    chan *structpb.Struct
+	overflow  chan struct{} // closed once the stream falls too far behind
+}
+
+// broadcastGRPC copies an event to every stream that wants it
+func broadcastGRPC(ev ProtocolEvent) {
+	grpcState.mu.Lock()
+	defer grpcState.mu.Unlock()
+	if len(grpcState.subs) == 0 {
+		return
+	}
+	raw, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	msg := &structpb.Struct{}
+	if err := protojson.Unmarshal(raw, msg); err != nil {
+		return
+	}
+	id := msg.GetFields()["data"].GetStructValue().GetFields()["id"].GetStringValue()
+	for sub := range grpcState.subs {
+		if !visible(ev.Namespace, sub.namespace) || !sub.match(ev.Event, id) {
+			continue
+		}
+		select {
+		case sub.events <- msg:
+		default:
+			delete(grpcState.subs, sub)
+			close(sub.overflow)
+		}
+	}
+}
+
+// grpcChannelCommands change the state of the channel they arrive on,
+// which a gRPC call does not have
+var grpcChannelCommands = map[string]bool{"set_framing": true, "set_locale": true, "set_namespace": true, "set_output_batching": true}
+
+// grpcCall runs one protocol request: {"command", "payload", "id"}
+func grpcCall(req *structpb.Struct) (*structpb.Struct, error) {
+	raw, err := protojson.Marshal(req)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	var r ProtocolRequest
+	if err := json.Unmarshal(raw, &r); err != nil || r.Command == "" {
+		return nil, status.Error(codes.InvalidArgument, "request needs a command")
+	}
+
+	var buf bytes.Buffer
+	w := NewOutput(&buf)
+	if grpcChannelCommands[r.Command] {
+		// Each call gets an Output of its own, so there is no channel
+		// for these to change
+		sendErrorCode(w.forRequest(r.ID), ErrUnsupported, message("grpc.channel_command_not_available", "command", r.Command), nil)
+	} else {
+		handleRequest(r, w.forRequest(r.ID))
+	}
+	line, _, _ := bytes.Cut(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	resp := &structpb.Struct{}
+	if err := protojson.Unmarshal(line, resp); err != nil {
+		return nil, status.Error(codes.Internal, "handler wrote no response")
+	}
+	return resp, nil
+}
+
+// grpcStream serves an Events or Progress stream until the client leaves.
+// Events takes {"events": [names]} to pick events, all of them by default.
+// Progress takes {"id": job} and then ends with that job's final event.
+// Either takes "namespace" to leave out other namespaces' events.
+func grpcStream(stream grpc.ServerStream, progress bool) error {
+	req := &structpb.Struct{}
+	if err := stream.RecvMsg(req); err != nil {
+		return err
+	}
+	fields := req.GetFields()
+	names := make(map[string]bool)
+	for _, v := range fields["events"].GetListValue().GetValues() {
+		names[v.GetStringValue()] = true
+	}
+	job := fields["id"].GetStringValue()
+
+	sub := &grpcSub{
+		events:    make(chan *structpb.Struct, grpcEventBuffer),
+		overflow:  make(chan struct{}),
+		namespace: fields["namespace"].GetStringValue(),
+	}
+	sub.match = func(event, id string) bool {
+		if !progress {
+			return len(names) == 0 || names[event]
+		}
+		if job != "" && id != job {
+			return false
+		}
+		return strings.HasSuffix(event, "_progress") || (job != "" && finalEvent(event))
+	}
+	grpcState.mu.Lock()
+	if grpcState.server == nil {
+		grpcState.mu.Unlock()
+		return status.Error(codes.Unavailable, "gRPC server is stopping")
+	}
+	grpcState.subs[sub] = true
+	grpcState.mu.Unlock()
+	defer func() {
+		grpcState.mu.Lock()
+		delete(grpcState.subs, sub)
+		grpcState.mu.Unlock()
+	}()
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-sub.overflow:
+			return status.Error(codes.ResourceExhausted, "stream fell too far behind on events")
+		case msg := <-sub.events:
+			if err := stream.SendMsg(msg); err != nil {
+				return err
+			}
+			if progress && job != "" && finalEvent(msg.GetFields()["event"].GetStringValue()) {
+				return nil
+			}
+		}
+	}
+}
+
+// finalEvent reports whether event ends a job
+func finalEvent(event string) bool {
+	return strings.HasSuffix(event, "_completed") || strings.HasSuffix(event, "_failed") || strings.HasSuffix(event, "_canceled")
+}
+
+// grpcServiceDesc is what protoc-gen-go-grpc would generate for
+// lumina.proto; a function, as the handlers lead back to the commands
+// that start the server
+func grpcServiceDesc() *grpc.ServiceDesc {
+	return &grpc.ServiceDesc{
+		ServiceName: grpcService,
+		HandlerType: (*interface{})(nil),
+		Methods: []grpc.MethodDesc{{
+			MethodName: "Call",
+			Handler: func(_ interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				req := &structpb.Struct{}
+				if err := dec(req); err != nil {
+					return nil, err
+				}
+				if interceptor == nil {
+					return grpcCall(req)
+				}
+				info := &grpc.UnaryServerInfo{FullMethod: "/" + grpcService + "/Call"}
+				return interceptor(ctx, req, info, func(_ context.Context, req interface{}) (interface{}, error) {
+					return grpcCall(req.(*structpb.Struct))
+				})
+			},
+		}},
+		Streams: []grpc.StreamDesc{
+			{StreamName: "Events", ServerStreams: true, Handler: func(_ interface{}, s grpc.ServerStream) error { return grpcStream(s, false) }},
+			{StreamName: "Progress", ServerStreams: true, Handler: func(_ interface{}, s grpc.ServerStream) error { return grpcStream(s, true) }},
+		},
+		Metadata: "lumina.proto",
+	}
+}
+
+var grpcDescriptorOnce sync.Once
+
+// registerGRPCDescriptor publishes lumina.proto to the registry
+// reflection reads from
+func registerGRPCDescriptor() {
+	grpcDescriptorOnce.Do(func() {
+		structType := ".google.protobuf.Struct"
+		method := func(name string, streaming bool) *descriptorpb.MethodDescriptorProto {
+			return &descriptorpb.MethodDescriptorProto{
+				Name:            proto.String(name),
+				InputType:       proto.String(structType),
+				OutputType:      proto.String(structType),
+				ServerStreaming: proto.Bool(streaming),
+			}
+		}
+		fd := &descriptorpb.FileDescriptorProto{
+			Name:       proto.String("lumina.proto"),
+			Package:    proto.String("lumina.v1"),
+			Dependency: []string{"google/protobuf/struct.proto"},
+			Syntax:     proto.String("proto3"),
+			Service: []*descriptorpb.ServiceDescriptorProto{{
+				Name:   proto.String("Lumina"),
+				Method: []*descriptorpb.MethodDescriptorProto{method("Call", false), method("Events", true), method("Progress", true)},
+			}},
+		}
+		file, err := protodesc.NewFile(fd, protoregistry.GlobalFiles)
+		if err == nil {
+			err = protoregistry.GlobalFiles.RegisterFile(file)
+		}
+		if err != nil {
+			logger.Warn("failed to register gRPC descriptor", "error", err)
+		}
+	})
+}
+
+// listenGRPC opens a loopback TCP socket, or the socket file or named pipe
+// at path
+func listenGRPC(addr, path string) (net.Listener, error) {
+	if path != "" {
+		return listenControl(path)
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, catalogError(ErrInvalidArgument, "grpc.addr_must_host_port", "err_grpc_addr", errGRPCAddr)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, errGRPCAddr
+	}
+	return net.Listen("tcp", addr)
+}
+
+// grpcAuth makes every call and stream present token
+func grpcAuth(token string) []grpc.ServerOption {
+	check := func(ctx context.Context) error {
+		md, _ := metadata.FromIncomingContext(ctx)
+		for _, v := range md.Get("authorization") {
+			if got, ok := strings.CutPrefix(v, "Bearer "); ok && subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1 {
+				return nil
+			}
+		}
+		return status.Error(codes.Unauthenticated, "missing or wrong token")
+	}
+	return []grpc.ServerOption{
+		grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			if err := check(ctx); err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv interface{}, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if err := check(ss.Context()); err != nil {
+				return err
+			}
+			return handler(srv, ss)
+		}),
+	}
+}
+
+// startGRPCLocked serves gRPC, on TCP only with a token; the caller holds
+// grpcState.mu
+func startGRPCLocked(addr, path, token string) error {
+	if grpcState.server != nil {
+		return fmt.Errorf("gRPC already listening on %s", grpcState.addr)
+	}
+	if path == "" && token == "" {
+		return errGRPCToken
+	}
+	ln, err := listenGRPC(addr, path)
+	if err != nil {
+		return err
+	}
+	registerGRPCDescriptor()
+	var opts []grpc.ServerOption
+	if token != "" {
+		opts = grpcAuth(token)
+	}
+	s := grpc.NewServer(opts...)
+	s.RegisterService(grpcServiceDesc(), struct{}{})
+	reflection.Register(s)
+
+	grpcState.server, grpcState.token = s, token
+	grpcState.addr = path
+	if path == "" {
+		grpcState.addr = ln.Addr().String()
+	}
+	go s.Serve(ln)
+	logger.Info("grpc listening", "addr", grpcState.addr)
+	return nil
+}
+
+// stopGRPCLocked ends every stream and closes the listener; the caller
+// holds grpcState.mu
+func stopGRPCLocked() {
+	if grpcState.server == nil {
+		return
+	}
+	for sub := range grpcState.subs {
+		delete(grpcState.subs, sub)
+		close(sub.overflow)
+	}
+	// Calls in flight, such as the stop_grpc that got us here, get a moment
+	// to answer; streams were ended above
+	s := grpcState.server
+	go func() {
+		t := time.AfterFunc(grpcStopGrace, s.Stop)
+		s.GracefulStop()
+		t.Stop()
+	}()
+	logger.Info("grpc stopped", "addr", grpcState.addr)
+	grpcState.addr, grpcState.token, grpcState.server = "", "", nil
+}
+
+type GRPCPayload struct {
+	Addr  string `json:"addr"`  // loopback host:port, only with token
+	Path  string `json:"path"`  // socket file, or \\.\pipe\name on Windows, default beside the control socket
+	Token string `json:"token"` // bearer token every call must present; required with addr
+}
+
+func handleStartGRPC(payload json.RawMessage, writer *Output) {
+	var p GRPCPayload
+	if len(payload) > 0 && string(payload) != "null" {
+		if err := json.Unmarshal(payload, &p); err != nil {
+			sendInvalidPayload(writer, "start_grpc")
+			return
+		}
+	}
+	if p.Addr != "" && p.Path != "" {
+		sendErrorCode(writer, ErrInvalidArgument, message("grpc.start_grpc_takes_addr"), nil)
+		return
+	}
+	if p.Addr == "" && p.Path == "" {
+		p.Path = defaultGRPCPath()
+	}
+
+	grpcState.mu.Lock()
+	defer grpcState.mu.Unlock()
+	if grpcState.server != nil {
+		sendErrorCode(writer, ErrAlreadyRunning, message("grpc.already_served", "addr", grpcState.addr), nil)
+		return
+	}
+	err := startGRPCLocked(p.Addr, p.Path, p.Token)
+	if errors.Is(err, errGRPCAddr) || errors.Is(err, errGRPCToken) {
+		sendErrorCode(writer, ErrInvalidArgument, messageOf(err), map[string]interface{}{"addr": p.Addr})
+		return
+	}
+	if err != nil {
+		sendBindError(writer, p.Addr+p.Path, err)
+		return
+	}
+	addr := grpcState.addr
+	writer.Encode(okResponse(message("grpc.listening", "addr", addr),
+		map[string]interface{}{"addr": addr, "service": grpcService}))
+}
+
+func handleStopGRPC(writer *Output) {
+	grpcState.mu.Lock()
+	defer grpcState.mu.Unlock()
+	if grpcState.server == nil {
+		sendErrorCode(writer, ErrNotRunning, message("grpc.not_running"), nil)
+		return
+	}
+	// A Call stopping the server it came through still gets its answer
+	writer.Encode(okResponse(message("grpc.stopped"), nil))
+	stopGRPCLocked()
+}
+
+func handleGRPCStatus(writer *Output) {
+	grpcState.mu.Lock()
+	defer grpcState.mu.Unlock()
+	writer.Encode(ProtocolResponse{
+		Status: "ok",
+		Data: map[string]interface{}{
+			"running": grpcState.server != nil,
+			"addr":    grpcState.addr,
+			"token":   grpcState.token != "",
+			"service": grpcService,
+			"streams": len(grpcState.subs),
+		},
+	})
+}
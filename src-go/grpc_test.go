@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestGRPCOverTCPNeedsToken(t *testing.T) {
+	grpcState.mu.Lock()
+	err := startGRPCLocked("127.0.0.1:0", "", "")
+	grpcState.mu.Unlock()
+	if err != errGRPCToken {
+		t.Fatalf("TCP without a token: %v", err)
+	}
+
+	grpcState.mu.Lock()
+	err = startGRPCLocked("127.0.0.1:0", "", "s3cret")
+	addr := grpcState.addr
+	grpcState.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		grpcState.mu.Lock()
+		stopGRPCLocked()
+		grpcState.mu.Unlock()
+	})
+
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	call := func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		req, _ := structpb.NewStruct(map[string]interface{}{"command": "grpc_status"})
+		return conn.Invoke(ctx, "/"+grpcService+"/Call", req, &structpb.Struct{})
+	}
+
+	if err := call(context.Background()); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("call without a token: %v", err)
+	}
+	if err := call(metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer wrong")); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("call with the wrong token: %v", err)
+	}
+	if err := call(metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer s3cret")); err != nil {
+		t.Errorf("call with the token: %v", err)
+	}
+}
+
+func TestGRPCRefusesChannelCommands(t *testing.T) {
+	for cmd := range grpcChannelCommands {
+		req, _ := structpb.NewStruct(map[string]interface{}{"command": cmd, "payload": map[string]interface{}{}})
+		resp, err := grpcCall(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fields := resp.GetFields()
+		if fields["status"].GetStringValue() != "error" || fields["code"].GetStringValue() != ErrUnsupported {
+			t.Errorf("%s: got %v", cmd, resp)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Control channel guardrails keep a misbehaving frontend from exhausting
+// the sidecar. Each channel, stdin and every control socket client, gets
+// its own command budget; messages over the size limit are skipped
+// without being buffered, and ones nested deeper than MaxDepth are
+// refused before they are decoded. All three answer with an error the
+// frontend can branch on and the channel carries on.
+const (
+	defaultCommandsPerSec = 1000
+	defaultCommandBurst   = 2000
+	defaultMaxDepth       = 64
+)
+
+// ControlLimits is the config section with the guardrails. Zero values
+// keep the defaults; -1 turns the rate limit off.
+type ControlLimits struct {
+	MaxMessageSize int     `json:"max_message_size,omitempty"` // bytes; the -max-message-size flag wins
+	CommandsPerSec float64 `json:"commands_per_sec,omitempty"` // sustained commands per channel
+	Burst          int     `json:"burst,omitempty"`            // commands a channel may send at once
+	MaxDepth       int     `json:"max_depth,omitempty"`        // deepest nesting of objects and arrays
+}
+
+func (l ControlLimits) Validate() error {
+	if l.MaxMessageSize < 0 || l.Burst < 0 || l.MaxDepth < 0 || (l.CommandsPerSec < 0 && l.CommandsPerSec != -1) {
+		return catalogError(ErrInvalidArgument, "guardrails.control_limits_must_not")
+	}
+	return nil
+}
+
+// effective fills in the defaults
+func (l ControlLimits) effective() ControlLimits {
+	if l.MaxMessageSize == 0 {
+		l.MaxMessageSize = defaultMaxMessageSize
+	}
+	if l.CommandsPerSec == 0 {
+		l.CommandsPerSec = defaultCommandsPerSec
+	}
+	if l.Burst == 0 {
+		l.Burst = max(defaultCommandBurst, int(l.CommandsPerSec))
+	}
+	if l.MaxDepth == 0 {
+		l.MaxDepth = defaultMaxDepth
+	}
+	return l
+}
+
+var controlLimits atomic.Pointer[ControlLimits]
+
+// maxMessageSizeFlag is set when -max-message-size was given, which wins
+// over the config
+var maxMessageSizeFlag bool
+
+func currentControlLimits() ControlLimits {
+	if l := controlLimits.Load(); l != nil {
+		return *l
+	}
+	return ControlLimits{}.effective()
+}
+
+func setControlLimits(l ControlLimits) {
+	l = l.effective()
+	controlLimits.Store(&l)
+}
+
+// commandBucket is one channel's command budget, refilled continuously
+type commandBucket struct {
+	tokens  float64
+	last    time.Time
+	limited bool // the last command was refused, so the next refusal is not logged again
+}
+
+// allow takes a token, reporting false when the channel is over its rate
+func (b *commandBucket) allow(l ControlLimits) bool {
+	if l.CommandsPerSec < 0 {
+		return true
+	}
+	now := time.Now()
+	if b.last.IsZero() {
+		b.tokens = float64(l.Burst)
+	} else {
+		b.tokens = min(float64(l.Burst), b.tokens+now.Sub(b.last).Seconds()*l.CommandsPerSec)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		if !b.limited {
+			logger.Warn("control channel over its command rate", "commands_per_sec", l.CommandsPerSec, "burst", l.Burst)
+		}
+		b.limited = true
+		return false
+	}
+	b.tokens--
+	b.limited = false
+	return true
+}
+
+// jsonDepth is how deeply the objects and arrays in data nest, without
+// decoding it
+func jsonDepth(data []byte) int {
+	depth, deepest := 0, 0
+	inString, escaped := false, false
+	for _, c := range data {
+		switch {
+		case escaped:
+			escaped = false
+		case inString:
+			if c == '\\' {
+				escaped = true
+			} else if c == '"' {
+				inString = false
+			}
+		case c == '"':
+			inString = true
+		case c == '{' || c == '[':
+			depth++
+			deepest = max(deepest, depth)
+		case c == '}' || c == ']':
+			depth--
+		}
+	}
+	return deepest
+}
+
+func sendMessageTooLarge(writer *Output, maxSize int) {
+	sendErrorCode(writer, ErrMessageTooLarge, message("guardrails.message_exceeds_maximum_size"),
+		map[string]interface{}{"max_message_size": maxSize})
+}
+
+func sendRateLimited(writer *Output, l ControlLimits) {
+	sendErrorCode(writer, ErrRateLimited, message("guardrails.too_many_commands_most", "commands_per_sec", fmt.Sprintf("%g", l.CommandsPerSec)),
+		map[string]interface{}{"commands_per_sec": l.CommandsPerSec, "burst": l.Burst, "retry_after_ms": int(1000/l.CommandsPerSec) + 1})
+}
+
+func sendTooDeep(writer *Output, l ControlLimits) {
+	sendErrorCode(writer, ErrNestingTooDeep, message("guardrails.message_nests_deeper_levels", "max_depth", l.MaxDepth),
+		map[string]interface{}{"max_depth": l.MaxDepth})
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestJSONDepth(t *testing.T) {
+	for data, want := range map[string]int{
+		`{"command":"status"}`:                              1,
+		`{"command":"x","payload":{"a":[1,[2]]}}`:           4,
+		`{"command":"x","payload":{"text":"{[{[{["}}`:       2,
+		`{"text":"quote \" then [[["}`:                      1,
+		strings.Repeat("[", 100) + strings.Repeat("]", 100): 100,
+	} {
+		if got := jsonDepth([]byte(data)); got != want {
+			t.Errorf("jsonDepth(%.40s) = %d, want %d", data, got, want)
+		}
+	}
+}
+
+func TestCommandBucket(t *testing.T) {
+	l := ControlLimits{CommandsPerSec: 10, Burst: 5}.effective()
+	var b commandBucket
+	allowed := 0
+	for i := 0; i < 20; i++ {
+		if b.allow(l) {
+			allowed++
+		}
+	}
+	if allowed != 5 {
+		t.Errorf("a burst of 20 let %d through, want 5", allowed)
+	}
+	if !(&commandBucket{}).allow(ControlLimits{CommandsPerSec: -1}.effective()) {
+		t.Error("unlimited bucket refused a command")
+	}
+}
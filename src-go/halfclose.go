@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// Half-close: shutdown_write sends FIN and keeps reading, for protocols
+// where the client marks the end of its request that way and then reads
+// the answer; shutdown_read stops taking data while the connection can
+// still send. set_linger chooses what closing does with unsent data: the
+// OS default (-1), a reset at once (0), or waiting up to that many
+// seconds. They reach through encryption and compression to the socket,
+// a QUIC stream or a mux stream underneath; encrypted records and
+// compressed chunks are whole after every write, so a FIN never cuts one
+// in half.
+//
+// A reader ends the connection when its read side ends, which would undo
+// a half-close. So after shutdown_read, or after the peer's FIN on a
+// connect with half_close set, the reader emits connection_read_closed
+// and keeps the connection for sending until shutdown_write or disconnect.
+
+// closeWriter and closeReader are transports that can shut one direction
+type (
+	closeWriter interface{ CloseWrite() error }
+	closeReader interface{ CloseRead() error }
+)
+
+// CloseWrite sends FIN on the stream and leaves reading open
+func (s *quicStream) CloseWrite() error {
+	return s.Stream.Close()
+}
+
+// CloseRead tells the peer to stop sending on the stream
+func (s *quicStream) CloseRead() error {
+	s.CancelRead(0)
+	return nil
+}
+
+// transportOf is the connection under conn's encryption and compression
+func transportOf(conn net.Conn) net.Conn {
+	for {
+		switch w := conn.(type) {
+		case *secureConn:
+			conn = w.Conn
+		case *compressedConn:
+			conn = w.Conn
+		default:
+			return conn
+		}
+	}
+}
+
+// holdHalfOpen is for readers of connections that may be half-closed. When
+// err ends a read side that should not end the connection, it emits
+// connection_read_closed, waits until the sending side is shut or the
+// connection closed, and returns true; the reader then finishes as it
+// would for a close.
+func holdHalfOpen(c *Connection, err error) bool {
+	local := c.readShut.Load()
+	if (!local && (!errors.Is(err, io.EOF) || !c.halfOpen.Load())) || c.writeShut.Load() || c.closing.Load() {
+		return false
+	}
+	by := "peer"
+	if local {
+		by = "local"
+	}
+	emitEvent("connection_read_closed", map[string]interface{}{"id": c.ID, "by": by})
+	for !c.writeShut.Load() && !c.closing.Load() && !isStopping() {
+		time.Sleep(reconnectPoll)
+	}
+	return true
+}
+
+// shutdownDirections is the connection's shutdown in ConnectionInfo
+func (c *Connection) shutdownDirections() string {
+	switch read, write := c.readShut.Load(), c.writeShut.Load(); {
+	case read && write:
+		return "both"
+	case read:
+		return "read"
+	case write:
+		return "write"
+	}
+	return ""
+}
+
+type HalfClosePayload struct {
+	ID string `json:"id"`
+}
+
+// handleShutdownWrite sends FIN on a connection; reading goes on
+func handleShutdownWrite(payload json.RawMessage, writer *Output) {
+	halfClose(payload, writer, "shutdown_write", func(c *Connection) error {
+		cw, ok := transportOf(c.Conn()).(closeWriter)
+		if !ok {
+			return catalogError(ErrFailed, "halfclose.send_unsupported")
+		}
+		if c.writeShut.Swap(true) {
+			return nil
+		}
+		return cw.CloseWrite()
+	})
+}
+
+// handleShutdownRead stops reading from a connection; sending goes on
+func handleShutdownRead(payload json.RawMessage, writer *Output) {
+	halfClose(payload, writer, "shutdown_read", func(c *Connection) error {
+		cr, ok := transportOf(c.Conn()).(closeReader)
+		if !ok {
+			return catalogError(ErrFailed, "halfclose.read_unsupported")
+		}
+		if c.readShut.Swap(true) {
+			return nil
+		}
+		return cr.CloseRead()
+	})
+}
+
+func halfClose(payload json.RawMessage, writer *Output, command string, shut func(*Connection) error) {
+	var p HalfClosePayload
+	if err := json.Unmarshal(payload, &p); err != nil || p.ID == "" {
+		sendErrorCode(writer, ErrInvalidArgument, message("halfclose.requires_id", "command", command), nil)
+		return
+	}
+	c, exists := lookupConn(p.ID, writer)
+	if !exists {
+		sendErrorCode(writer, ErrNotFound, message("common.connection_not_found"), nil)
+		return
+	}
+	if err := shut(c); err != nil {
+		sendErrorCode(writer, ErrInvalidState, messageOf(err), map[string]interface{}{"id": p.ID})
+		return
+	}
+	writer.Encode(ProtocolResponse{
+		Status: "ok",
+		Data:   map[string]interface{}{"id": p.ID, "shutdown": c.shutdownDirections()},
+	})
+}
+
+type SetLingerPayload struct {
+	ID      string `json:"id"`
+	Seconds *int   `json:"seconds" required:"true"` // -1 for the OS default, 0 to reset on close
+}
+
+// handleSetLinger sets what closing a TCP connection does with data not
+// yet sent
+func handleSetLinger(payload json.RawMessage, writer *Output) {
+	var p SetLingerPayload
+	if err := json.Unmarshal(payload, &p); err != nil || p.ID == "" || p.Seconds == nil {
+		sendErrorCode(writer, ErrInvalidArgument, message("halfclose.set_linger_requires"), nil)
+		return
+	}
+	if *p.Seconds < -1 {
+		sendErrorCode(writer, ErrInvalidArgument, message("halfclose.seconds_must_least"), nil)
+		return
+	}
+	c, exists := lookupConn(p.ID, writer)
+	if !exists {
+		sendErrorCode(writer, ErrNotFound, message("common.connection_not_found"), nil)
+		return
+	}
+	tcp, ok := transportOf(c.Conn()).(*net.TCPConn)
+	if !ok {
+		sendErrorCode(writer, ErrInvalidState, message("halfclose.linger_tcp_only"), map[string]interface{}{"id": p.ID})
+		return
+	}
+	if err := tcp.SetLinger(*p.Seconds); err != nil {
+		sendError(writer, message("halfclose.failed_set_linger", "id", p.ID, "error", err))
+		return
+	}
+	c.mu.Lock()
+	c.linger = p.Seconds
+	c.mu.Unlock()
+	writer.Encode(ProtocolResponse{
+		Status: "ok",
+		Data:   map[string]interface{}{"id": p.ID, "linger": *p.Seconds},
+	})
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShutdownWriteKeepsReading(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	served := make(chan []byte, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		request, _ := io.ReadAll(conn) // until our FIN
+		conn.Write([]byte("reply"))
+		served <- request
+	}()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Connection{ID: "half-c", Direction: "outbound", Network: "tcp", Created: time.Now(), Limiter: newRateLimiter(0)}
+	c.setConn(client)
+	state.Mutex.Lock()
+	state.Conns[c.ID] = c
+	state.Mutex.Unlock()
+	defer func() {
+		state.Mutex.Lock()
+		delete(state.Conns, c.ID)
+		state.Mutex.Unlock()
+		client.Close()
+	}()
+
+	c.Write([]byte("request"))
+	var buf bytes.Buffer
+	handleShutdownWrite(json.RawMessage(`{"id":"half-c"}`), NewOutput(&buf))
+	if !strings.Contains(buf.String(), `"shutdown":"write"`) {
+		t.Fatalf("shutdown_write answered %s", buf.String())
+	}
+	select {
+	case request := <-served:
+		if string(request) != "request" {
+			t.Errorf("peer read %q", request)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("peer never saw the FIN")
+	}
+	if reply, err := io.ReadAll(c); err != nil || string(reply) != "reply" {
+		t.Errorf("read %q, %v after shutting down the sending side", reply, err)
+	}
+
+	buf.Reset()
+	handleSend(json.RawMessage(`{"id":"half-c","data":"more"}`), NewOutput(&buf))
+	if !strings.Contains(buf.String(), "ERR_INVALID_STATE") {
+		t.Errorf("send after shutdown_write answered %s", buf.String())
+	}
+
+	buf.Reset()
+	handleSetLinger(json.RawMessage(`{"id":"half-c","seconds":0}`), NewOutput(&buf))
+	if info := c.Info(); info.Linger == nil || *info.Linger != 0 || info.Shutdown != "write" {
+		t.Errorf("set_linger answered %s, info %+v", buf.String(), info)
+	}
+}
+
+func TestHoldHalfOpenUntilWriteShut(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	c := &Connection{ID: "half-hold", Direction: "inbound", Network: "tcp", Created: time.Now(), Limiter: newRateLimiter(0)}
+	c.setConn(a)
+
+	if holdHalfOpen(c, io.EOF) {
+		t.Fatal("held open on a FIN without half_close")
+	}
+	c.readShut.Store(true)
+	done := make(chan bool, 1)
+	go func() { done <- holdHalfOpen(c, io.EOF) }()
+	select {
+	case <-done:
+		t.Fatal("reader let go while the sending side was open")
+	case <-time.After(100 * time.Millisecond):
+	}
+	c.writeShut.Store(true)
+	select {
+	case held := <-done:
+		if !held {
+			t.Error("holdHalfOpen reported no hold")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("reader still held after shutdown_write")
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+)
+
+// streamBufferSize is the read buffer of connections that pass bytes along
+const streamBufferSize = 64 << 10
+
+// connHandler serves the accepted connections of one listener type
+type connHandler struct {
+	serve func(c *Connection, l *Listener, dir string)
+	// stream handlers treat the connection as plain bytes, so clients may
+	// negotiate compression underneath them
+	stream bool
+}
+
+// connHandlers maps a start_server type to the behavior of its connections.
+// Each listener picks its own, so ports can run different protocols side
+// by side. "ws" and "http" listeners serve HTTP and are not in here.
+var connHandlers = map[string]connHandler{
+	"tcp":         {serve: handleEchoConnection, stream: true}, // historical name for "echo"
+	"echo":        {serve: handleEchoConnection, stream: true},
+	"discard":     {serve: handleDiscardConnection, stream: true},
+	"chat":        {serve: handleChatConnection, stream: true},
+	"custom-json": {serve: handleJSONConnection, stream: true},
+	"raw":         {serve: handleRawConnection, stream: true},
+	"transfer":    {serve: func(c *Connection, _ *Listener, dir string) { handleTransferConnection(c, dir) }},
+	"speedtest":   {serve: func(c *Connection, _ *Listener, _ string) { handleSpeedtestConnection(c) }},
+	"clipboard":   {serve: handleClipboardConnection},
+	"socks5":      {serve: handleSOCKSConnection},
+	"sftp":        {serve: handleSFTPConnection},
+	"mux":         {serve: handleMuxConnection, stream: true},
+	"logtail":     {serve: handleLogTailConnection},
+	"media":       {serve: handleMediaConnection},
+	"serial":      {serve: handleSerialConnection, stream: true},
+}
+
+// emitClosed reports the end of an inbound connection
+func emitClosed(c *Connection, err error) {
+	closed := map[string]interface{}{"id": c.ID}
+	if isTimeout(err) {
+		closed["reason"] = "timeout"
+	}
+	emitEvent("connection_closed", closed)
+}
+
+// handleEchoConnection writes everything it reads straight back
+func handleEchoConnection(conn *Connection, _ *Listener, _ string) {
+	defer untrackConn(conn)
+	emitEvent("connection_opened", conn.Info())
+
+	buffer := make([]byte, streamBufferSize)
+	for {
+		n, err := conn.Read(buffer)
+		if err != nil {
+			emitClosed(conn, err)
+			return
+		}
+		conn.Write(buffer[:n])
+	}
+}
+
+// handleDiscardConnection reads and drops everything, which makes it a sink
+// for throughput tests
+func handleDiscardConnection(conn *Connection, _ *Listener, _ string) {
+	defer untrackConn(conn)
+	emitEvent("connection_opened", conn.Info())
+
+	_, err := io.Copy(io.Discard, conn)
+	if err == nil {
+		err = io.EOF
+	}
+	emitClosed(conn, err)
+}
+
+// handleJSONConnection reads newline-delimited JSON messages and hands each
+// to the app as a json_message event; the app answers through send. Lines
+// that are not JSON are reported back to the peer and skipped.
+func handleJSONConnection(conn *Connection, l *Listener, _ string) {
+	defer untrackConn(conn)
+	emitEvent("connection_opened", conn.Info())
+
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			var msg json.RawMessage
+			if jerr := json.Unmarshal(line, &msg); jerr != nil {
+				reply, _ := json.Marshal(map[string]string{"error": "invalid JSON: " + jerr.Error()})
+				conn.Write(append(reply, '\n'))
+			} else {
+				emitEvent("json_message", map[string]interface{}{
+					"id":          conn.ID,
+					"listener":    l.Addr,
+					"listener_id": l.ID,
+					"message":     msg,
+				})
+			}
+		}
+		if err != nil {
+			// Answers can still go out after shutdown_read
+			holdHalfOpen(conn, err)
+			emitClosed(conn, err)
+			return
+		}
+	}
+}
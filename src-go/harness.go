@@ -0,0 +1,625 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"os"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Test harness: started with -test-harness, the sidecar keeps time on a
+// fake clock that only moves when test_advance_clock says so, and dials to
+// NAME.harness reach in-memory peers made with test_peer instead of the
+// network. The app's integration tests use it to drive timeouts, reconnect
+// backoff and transfer progress step by step, with no waiting on real
+// time and no sockets. A peer either plays a script, sending, expecting,
+// waiting on the clock, hanging up or stalling, then echoes what it gets;
+// or it hands every dial to one of our own listeners, a loopback that
+// carries send_file and the rest end to end. Dials to a peer can be made
+// to fail at once or to time out, and test_drop_peer cuts its connections
+// the way a dropped network would.
+//
+// The flag is left out of -help, and without it the test_* commands are
+// unknown like any other.
+const (
+	harnessFlag   = "test-harness"
+	harnessDomain = ".harness"
+)
+
+// harnessEpoch is where the fake clock starts. Real time is years past it,
+// which is why harnessConn moves deadlines onto the clock.
+var harnessEpoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Clock is where timeouts, retry waits and progress take their time from
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	// AfterFunc calls f once d has passed, unless stop comes first
+	AfterFunc(d time.Duration, f func()) (stop func() bool)
+	NewTicker(d time.Duration) *Ticker
+}
+
+// Ticker is a time.Ticker of a Clock
+type Ticker struct {
+	C    <-chan time.Time
+	stop func()
+}
+
+func (t *Ticker) Stop() { t.stop() }
+
+// clock is the real one outside the test harness
+var clock Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+func (realClock) AfterFunc(d time.Duration, f func()) func() bool {
+	return time.AfterFunc(d, f).Stop
+}
+
+func (realClock) NewTicker(d time.Duration) *Ticker {
+	t := time.NewTicker(d)
+	return &Ticker{C: t.C, stop: t.Stop}
+}
+
+// fakeClock stands still until advanced; timers fire in order of their
+// deadline as it passes them
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	at     time.Time
+	period time.Duration  // tickers fire again this much later
+	c      chan time.Time // nil for AfterFunc
+	f      func()
+}
+
+func newFakeClock(start time.Time) *fakeClock {
+	return &fakeClock{now: start}
+}
+
+func (f *fakeClock) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+func (f *fakeClock) add(t *fakeTimer) func() bool {
+	f.mu.Lock()
+	f.timers = append(f.timers, t)
+	f.mu.Unlock()
+	return func() bool {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		i := slices.Index(f.timers, t)
+		if i < 0 {
+			return false
+		}
+		f.timers = slices.Delete(f.timers, i, i+1)
+		return true
+	}
+}
+
+func (f *fakeClock) After(d time.Duration) <-chan time.Time {
+	c := make(chan time.Time, 1)
+	if d <= 0 {
+		c <- f.Now()
+		return c
+	}
+	f.add(&fakeTimer{at: f.Now().Add(d), c: c})
+	return c
+}
+
+func (f *fakeClock) AfterFunc(d time.Duration, fn func()) func() bool {
+	if d <= 0 {
+		go fn()
+		return func() bool { return false }
+	}
+	return f.add(&fakeTimer{at: f.Now().Add(d), f: fn})
+}
+
+func (f *fakeClock) NewTicker(d time.Duration) *Ticker {
+	c := make(chan time.Time, 1)
+	stop := f.add(&fakeTimer{at: f.Now().Add(d), period: d, c: c})
+	return &Ticker{C: c, stop: func() { stop() }}
+}
+
+// Pending is how many timers are waiting on the clock
+func (f *fakeClock) Pending() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.timers)
+}
+
+// Advance moves the clock on by d, firing the timers it passes in order,
+// each with the clock at its deadline. AfterFunc callbacks have run by the
+// time it returns. It returns how many timers fired.
+func (f *fakeClock) Advance(d time.Duration) int {
+	f.mu.Lock()
+	target := f.now.Add(d)
+	f.mu.Unlock()
+
+	fired := 0
+	for {
+		f.mu.Lock()
+		sort.SliceStable(f.timers, func(i, j int) bool { return f.timers[i].at.Before(f.timers[j].at) })
+		if len(f.timers) == 0 || f.timers[0].at.After(target) {
+			f.now = target
+			f.mu.Unlock()
+			return fired
+		}
+		t := f.timers[0]
+		f.now = t.at
+		if t.period > 0 {
+			t.at = t.at.Add(t.period)
+		} else {
+			f.timers = f.timers[1:]
+		}
+		f.mu.Unlock()
+
+		fired++
+		if t.f != nil {
+			t.f()
+			continue
+		}
+		// Like time.Ticker, a tick nobody took is dropped
+		select {
+		case t.c <- f.Now():
+		default:
+		}
+	}
+}
+
+// harness holds the test mode; fake is nil outside it
+var harness = struct {
+	mu    sync.Mutex
+	fake  *fakeClock
+	peers map[string]*harnessPeer
+	ports atomic.Int32 // local ports handed to harness connections
+}{peers: make(map[string]*harnessPeer)}
+
+// takeHarnessFlag removes -test-harness from args, so flag never lists it,
+// and reports whether it was there
+func takeHarnessFlag(args []string) ([]string, bool) {
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		if arg == "-"+harnessFlag || arg == "--"+harnessFlag {
+			return slices.Delete(slices.Clone(args), i, i+1), true
+		}
+	}
+	return args, false
+}
+
+// enableHarness switches to the fake clock and opens the test_* commands;
+// it runs at startup before anything asks the time
+func enableHarness() {
+	harness.fake = newFakeClock(harnessEpoch)
+	harness.ports.Store(49151)
+	clock = harness.fake
+	maps.Copy(payloadSchemas, harnessSchemas)
+	logger.Warn("test harness mode: fake clock and in-memory peers")
+}
+
+var harnessSchemas = map[string]reflect.Type{
+	"test_advance_clock": reflect.TypeFor[TestAdvanceClockPayload](),
+	"test_clock":         reflect.TypeFor[noPayload](),
+	"test_drop_peer":     reflect.TypeFor[TestDropPeerPayload](),
+	"test_peer":          reflect.TypeFor[TestPeerPayload](),
+}
+
+// handleHarnessCommand runs the test_* commands in harness mode; it is
+// false for any other command
+func handleHarnessCommand(req ProtocolRequest, writer *Output) bool {
+	if harness.fake == nil {
+		return false
+	}
+	switch req.Command {
+	case "test_clock":
+		handleTestClock(writer)
+	case "test_advance_clock":
+		handleTestAdvanceClock(req.Payload, writer)
+	case "test_peer":
+		handleTestPeer(req.Payload, writer)
+	case "test_drop_peer":
+		handleTestDropPeer(req.Payload, writer)
+	default:
+		return false
+	}
+	return true
+}
+
+func clockInfo() map[string]interface{} {
+	return map[string]interface{}{
+		"now":     harness.fake.Now().UTC().Format(time.RFC3339Nano),
+		"pending": harness.fake.Pending(),
+	}
+}
+
+// handleTestClock reports the fake time and how many timers wait on it,
+// so a test can tell the sidecar has started waiting before advancing
+func handleTestClock(writer *Output) {
+	writer.Encode(ProtocolResponse{Status: "ok", Data: clockInfo()})
+}
+
+type TestAdvanceClockPayload struct {
+	Ms int64 `json:"ms" required:"true"`
+}
+
+func handleTestAdvanceClock(payload json.RawMessage, writer *Output) {
+	var p TestAdvanceClockPayload
+	if err := json.Unmarshal(payload, &p); err != nil || p.Ms <= 0 {
+		sendErrorCode(writer, ErrInvalidArgument, message("harness.test_advance_clock_requires"), nil)
+		return
+	}
+	fired := harness.fake.Advance(time.Duration(p.Ms) * time.Millisecond)
+	data := clockInfo()
+	data["fired"] = fired
+	writer.Encode(ProtocolResponse{Status: "ok", Data: data})
+}
+
+// TestPeerStep is one thing a scripted peer does; set exactly one field
+type TestPeerStep struct {
+	Send   string `json:"send,omitempty"`    // write this text
+	Expect int    `json:"expect,omitempty"`  // read this many bytes, reported as test_peer_received
+	WaitMs int    `json:"wait_ms,omitempty"` // wait this long on the clock
+	Close  bool   `json:"close,omitempty"`   // hang up
+	Stall  bool   `json:"stall,omitempty"`   // stop reading and writing until hung up on or dropped
+}
+
+func (s TestPeerStep) Validate() error {
+	set := 0
+	for _, on := range []bool{s.Send != "", s.Expect > 0, s.WaitMs > 0, s.Close, s.Stall} {
+		if on {
+			set++
+		}
+	}
+	if set != 1 || s.Expect < 0 || s.WaitMs < 0 {
+		return catalogError(ErrInvalidArgument, "harness.step_needs_one_action")
+	}
+	return nil
+}
+
+type TestPeerPayload struct {
+	Name        string `json:"name" required:"true"` // dials to NAME.harness reach it
+	ListenerRef        // our own listener taking its dials, in place of a script
+
+	Dir            string         `json:"dir,omitempty"`             // download directory for a transfer listener
+	Script         []TestPeerStep `json:"script,omitempty"`          // played on every connection, then it echoes
+	RefuseDials    int            `json:"refuse_dials,omitempty"`    // the next this many dials are refused
+	BlackholeDials int            `json:"blackhole_dials,omitempty"` // the next this many dials time out
+}
+
+// harnessPeer is a peer made by test_peer
+type harnessPeer struct {
+	TestPeerPayload
+	listener *Listener
+	serve    func(*Connection) // runs an accepted connection of listener
+
+	mu        sync.Mutex
+	dials     int
+	refuse    int
+	blackhole int
+	ends      []*harnessConn // its ends of the connections made so far
+}
+
+// handleTestPeer creates a peer, or changes one; connections it already
+// has keep going the old way
+func handleTestPeer(payload json.RawMessage, writer *Output) {
+	var p TestPeerPayload
+	if err := json.Unmarshal(payload, &p); err != nil || p.Name == "" || strings.ContainsAny(p.Name, ".:") {
+		sendErrorCode(writer, ErrInvalidArgument, message("harness.test_peer_requires_name"), nil)
+		return
+	}
+	if p.RefuseDials < 0 || p.BlackholeDials < 0 {
+		sendErrorCode(writer, ErrInvalidArgument, message("harness.dials_not_negative"), nil)
+		return
+	}
+	for _, step := range p.Script {
+		if err := step.Validate(); err != nil {
+			sendFailure(writer, err)
+			return
+		}
+	}
+	peer := &harnessPeer{TestPeerPayload: p, refuse: p.RefuseDials, blackhole: p.BlackholeDials}
+	if p.ListenerRef.set() {
+		if len(p.Script) > 0 {
+			sendError(writer, message("harness.script_or_listener"))
+			return
+		}
+		state.Mutex.Lock()
+		l, ok := findListenerLocked(p.ListenerRef, writer)
+		state.Mutex.Unlock()
+		if !ok {
+			return
+		}
+		if _, served := connHandlers[l.Type]; !served {
+			sendErrorCode(writer, ErrUnsupported, message("main.unsupported_server_type", "type", l.Type), nil)
+			return
+		}
+		peer.listener = l
+		peer.serve = func(c *Connection) { serveInbound(c, l, downloadDirFor(p.Dir)) }
+	}
+
+	harness.mu.Lock()
+	if old, ok := harness.peers[p.Name]; ok {
+		old.mu.Lock()
+		peer.dials, peer.ends = old.dials, old.ends
+		old.mu.Unlock()
+	}
+	harness.peers[p.Name] = peer
+	harness.mu.Unlock()
+
+	data := map[string]interface{}{"name": p.Name, "host": p.Name + harnessDomain}
+	if peer.listener != nil {
+		data["listener_id"] = peer.listener.ID
+	}
+	writer.Encode(ProtocolResponse{Status: "ok", Data: data})
+}
+
+type TestDropPeerPayload struct {
+	Name   string `json:"name" required:"true"`
+	Forget bool   `json:"forget,omitempty"` // later dials fail as for an unknown host
+}
+
+// handleTestDropPeer cuts every connection a peer has, as a network
+// dropping out from under them would
+func handleTestDropPeer(payload json.RawMessage, writer *Output) {
+	var p TestDropPeerPayload
+	if err := json.Unmarshal(payload, &p); err != nil || p.Name == "" {
+		sendErrorCode(writer, ErrInvalidArgument, message("harness.test_drop_peer_requires"), nil)
+		return
+	}
+	harness.mu.Lock()
+	peer, ok := harness.peers[p.Name]
+	if ok && p.Forget {
+		delete(harness.peers, p.Name)
+	}
+	harness.mu.Unlock()
+	if !ok {
+		sendErrorCode(writer, ErrNotFound, message("harness.test_peer_not_found", "name", p.Name), map[string]interface{}{"name": p.Name})
+		return
+	}
+
+	peer.mu.Lock()
+	ends := peer.ends
+	peer.ends = nil
+	peer.mu.Unlock()
+	dropped := 0
+	for _, end := range ends {
+		if end.Close() == nil {
+			dropped++
+		}
+	}
+	writer.Encode(ProtocolResponse{
+		Status: "ok",
+		Data:   map[string]interface{}{"name": p.Name, "dropped": dropped, "forgotten": p.Forget},
+	})
+}
+
+// isHarnessAddr reports whether addr names a test peer's host
+func isHarnessAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	return harness.fake != nil && err == nil && strings.HasSuffix(host, harnessDomain)
+}
+
+// dialHarness connects to the test peer addr names, or fails as it was
+// told to
+func dialHarness(addr string, timeout time.Duration) (net.Conn, error) {
+	host, port, _ := net.SplitHostPort(addr)
+	name := strings.TrimSuffix(host, harnessDomain)
+	harness.mu.Lock()
+	peer, ok := harness.peers[name]
+	harness.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("dial %s: no such test peer", addr)
+	}
+
+	peer.mu.Lock()
+	peer.dials++
+	dial := peer.dials
+	refuse, blackhole := peer.refuse > 0, peer.refuse == 0 && peer.blackhole > 0
+	if refuse {
+		peer.refuse--
+	} else if blackhole {
+		peer.blackhole--
+	}
+	peer.mu.Unlock()
+	switch {
+	case refuse:
+		return nil, fmt.Errorf("dial %s: %w", addr, syscall.ECONNREFUSED)
+	case blackhole:
+		if timeout <= 0 {
+			timeout = defaultDialTimeout
+		}
+		<-clock.After(timeout)
+		return nil, fmt.Errorf("dial %s: %w", addr, os.ErrDeadlineExceeded)
+	}
+
+	remotePort, _ := strconv.Atoi(port)
+	if peer.listener != nil {
+		if _, p, err := net.SplitHostPort(peer.listener.Addr); err == nil {
+			remotePort, _ = strconv.Atoi(p)
+		}
+	}
+	local := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(harness.ports.Add(1))}
+	remote := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: remotePort}
+	a, b := net.Pipe()
+	ours, theirs := newHarnessConn(a, local, remote), newHarnessConn(b, remote, local)
+	peer.mu.Lock()
+	peer.ends = append(slices.DeleteFunc(peer.ends, (*harnessConn).isClosed), theirs)
+	peer.mu.Unlock()
+
+	if l := peer.listener; l != nil {
+		state.Mutex.Lock()
+		live := state.Listeners[l.ID] == l
+		state.Mutex.Unlock()
+		if !live {
+			return nil, fmt.Errorf("dial %s: %w", addr, syscall.ECONNREFUSED)
+		}
+		// Refused or not, acceptConn has dealt with the peer's end
+		if c, _ := acceptConn(theirs, l); c != nil {
+			go peer.serve(c)
+		}
+		return ours, nil
+	}
+	go peer.play(theirs, ours, dial)
+	return ours, nil
+}
+
+// play runs the script on the peer's end of a connection, then echoes
+func (p *harnessPeer) play(conn, other *harnessConn, dial int) {
+	defer conn.Close()
+	for i, step := range p.Script {
+		var err error
+		switch {
+		case step.Send != "":
+			_, err = conn.Write([]byte(step.Send))
+		case step.Expect > 0:
+			buf := make([]byte, step.Expect)
+			if _, err = io.ReadFull(conn, buf); err == nil {
+				emitEvent("test_peer_received", map[string]interface{}{
+					"name": p.Name,
+					"dial": dial,
+					"step": i,
+					"data": string(buf),
+				})
+			}
+		case step.WaitMs > 0:
+			<-clock.After(time.Duration(step.WaitMs) * time.Millisecond)
+		case step.Close:
+			return
+		case step.Stall:
+			select {
+			case <-conn.closed:
+			case <-other.closed:
+			}
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+	io.Copy(conn, conn)
+}
+
+// harnessPast is a deadline that has passed
+var harnessPast = time.Unix(1, 0)
+
+// harnessConn is one end of an in-memory connection. Its addresses look
+// like loopback TCP and its deadlines run on the clock: callers set them
+// in real time, like on any socket, and each is moved onto the clock as
+// the same distance from now.
+type harnessConn struct {
+	net.Conn
+	local, remote net.Addr
+
+	read, write harnessDeadline
+	closeOnce   sync.Once
+	closed      chan struct{}
+}
+
+func newHarnessConn(conn net.Conn, local, remote net.Addr) *harnessConn {
+	h := &harnessConn{Conn: conn, local: local, remote: remote, closed: make(chan struct{})}
+	h.read.set, h.write.set = conn.SetReadDeadline, conn.SetWriteDeadline
+	return h
+}
+
+func (h *harnessConn) LocalAddr() net.Addr  { return h.local }
+func (h *harnessConn) RemoteAddr() net.Addr { return h.remote }
+
+func (h *harnessConn) Close() error {
+	err := net.ErrClosed
+	h.closeOnce.Do(func() {
+		close(h.closed)
+		h.read.reset(time.Time{})
+		h.write.reset(time.Time{})
+		err = h.Conn.Close()
+	})
+	return err
+}
+
+func (h *harnessConn) isClosed() bool {
+	select {
+	case <-h.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (h *harnessConn) SetDeadline(t time.Time) error {
+	h.read.reset(onClock(t))
+	h.write.reset(onClock(t))
+	return nil
+}
+
+func (h *harnessConn) SetReadDeadline(t time.Time) error {
+	h.read.reset(onClock(t))
+	return nil
+}
+
+func (h *harnessConn) SetWriteDeadline(t time.Time) error {
+	h.write.reset(onClock(t))
+	return nil
+}
+
+// onClock moves a real deadline onto the clock
+func onClock(t time.Time) time.Time {
+	if t.IsZero() {
+		return t
+	}
+	return clock.Now().Add(time.Until(t))
+}
+
+// harnessDeadline is one direction's deadline: the pipe underneath gets
+// one in the past once the clock reaches it
+type harnessDeadline struct {
+	mu   sync.Mutex
+	gen  int
+	stop func() bool
+	set  func(time.Time) error
+}
+
+func (d *harnessDeadline) reset(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.gen++
+	if d.stop != nil {
+		d.stop()
+		d.stop = nil
+	}
+	switch {
+	case t.IsZero():
+		d.set(time.Time{})
+	case !t.After(clock.Now()):
+		d.set(harnessPast)
+	default:
+		d.set(time.Time{})
+		gen := d.gen
+		d.stop = clock.AfterFunc(t.Sub(clock.Now()), func() {
+			d.mu.Lock()
+			defer d.mu.Unlock()
+			if d.gen == gen {
+				d.set(harnessPast)
+			}
+		})
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFakeClock(t *testing.T) {
+	f := newFakeClock(harnessEpoch)
+	after := f.After(2 * time.Second)
+	ticker := f.NewTicker(time.Second)
+	var called atomic.Bool
+	f.AfterFunc(1500*time.Millisecond, func() { called.Store(true) })
+
+	if fired := f.Advance(time.Second); fired != 1 {
+		t.Errorf("first second fired %d timers", fired)
+	}
+	if tick := <-ticker.C; !tick.Equal(harnessEpoch.Add(time.Second)) {
+		t.Errorf("ticked at %v", tick)
+	}
+	if fired := f.Advance(time.Second); fired != 3 || !called.Load() {
+		t.Errorf("second second fired %d timers, callback run %v", fired, called.Load())
+	}
+	select {
+	case at := <-after:
+		if !at.Equal(harnessEpoch.Add(2 * time.Second)) {
+			t.Errorf("after fired at %v", at)
+		}
+	default:
+		t.Error("after did not fire")
+	}
+
+	stop := f.AfterFunc(time.Second, func() { t.Error("stopped callback ran") })
+	if !stop() {
+		t.Error("stop found nothing pending")
+	}
+	ticker.Stop()
+	if f.Advance(time.Hour) != 0 || f.Pending() != 0 {
+		t.Errorf("%d timers left after stopping them all", f.Pending())
+	}
+	if !f.Now().Equal(harnessEpoch.Add(time.Hour + 2*time.Second)) {
+		t.Errorf("clock reads %v", f.Now())
+	}
+}
+
+func TestTakeHarnessFlag(t *testing.T) {
+	args, on := takeHarnessFlag([]string{"-workers", "2", "--test-harness", "-daemon"})
+	if !on || !slices.Equal(args, []string{"-workers", "2", "-daemon"}) {
+		t.Errorf("got %v, %v", args, on)
+	}
+	if _, on := takeHarnessFlag([]string{"--", "-test-harness"}); on {
+		t.Error("flag after -- taken")
+	}
+}
+
+// eventRecorder collects the events written while a test runs
+type eventRecorder struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (r *eventRecorder) Write(b []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.buf.Write(b)
+}
+
+// wait returns the data of the nth event of that name, waiting for it
+func (r *eventRecorder) wait(t *testing.T, event string, nth int) map[string]interface{} {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		r.mu.Lock()
+		lines := strings.Split(r.buf.String(), "\n")
+		r.mu.Unlock()
+		seen := 0
+		for _, line := range lines {
+			var ev ProtocolEvent
+			if json.Unmarshal([]byte(line), &ev) == nil && ev.Event == event {
+				if seen++; seen == nth {
+					data, _ := ev.Data.(map[string]interface{})
+					return data
+				}
+			}
+		}
+	}
+	t.Fatalf("no %s event #%d", event, nth)
+	return nil
+}
+
+// useHarness turns test mode on for one test and collects its events
+func useHarness(t *testing.T) (*fakeClock, *eventRecorder) {
+	fake := newFakeClock(harnessEpoch)
+	savedClock, savedOutput := clock, output
+	events := &eventRecorder{}
+	harness.fake, clock, output = fake, fake, NewOutput(events)
+	t.Cleanup(func() {
+		harness.mu.Lock()
+		harness.peers = make(map[string]*harnessPeer)
+		harness.mu.Unlock()
+		harness.fake, clock, output = nil, savedClock, savedOutput
+	})
+	return fake, events
+}
+
+// waitPending waits until n timers are waiting on the clock
+func waitPending(t *testing.T, f *fakeClock, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); f.Pending() != n; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d timers pending, want %d", f.Pending(), n)
+		}
+	}
+}
+
+// harnessCall runs a handler and returns its response
+func harnessCall(t *testing.T, handler func(json.RawMessage, *Output), payload string) ProtocolResponse {
+	t.Helper()
+	var buf bytes.Buffer
+	handler(json.RawMessage(payload), NewOutput(&buf))
+	var resp ProtocolResponse
+	if err := json.Unmarshal(buf.Bytes(), &resp); err != nil || resp.Status != "ok" {
+		t.Fatalf("%s: %s", payload, buf.String())
+	}
+	return resp
+}
+
+func TestHarnessReconnectAndIdleTimeout(t *testing.T) {
+	fake, events := useHarness(t)
+	harnessCall(t, handleTestPeer, `{"name":"flaky"}`)
+	resp := harnessCall(t, handleConnect, `{"host":"flaky.harness","port":7,"timeouts":{"write_timeout_ms":0},
+		"reconnect":{"enabled":true,"delay_ms":1000,"jitter":-1,"max_retries":3}}`)
+	id := resp.Data.(map[string]interface{})["id"].(string)
+	t.Cleanup(func() { handleDisconnect(json.RawMessage(`{"id":"`+id+`"}`), NewOutput(io.Discard)) })
+
+	harnessCall(t, handleSend, `{"id":"`+id+`","data":"ping"}`)
+	if data := events.wait(t, "connection_data", 1); data["data"] != "cGluZw==" {
+		t.Errorf("echo came back as %v", data)
+	}
+
+	// The network drops and the first redial is refused: waits of 1s, then 2s
+	harnessCall(t, handleTestPeer, `{"name":"flaky","refuse_dials":1}`)
+	harnessCall(t, handleTestDropPeer, `{"name":"flaky"}`)
+	for attempt, delay := range []float64{1000, 2000} {
+		if data := events.wait(t, "connection_reconnecting", attempt+1); data["delay_ms"] != delay {
+			t.Errorf("attempt %d waits %v", attempt+1, data["delay_ms"])
+		}
+		waitPending(t, fake, 1)
+		fake.Advance(time.Duration(delay) * time.Millisecond)
+	}
+	if data := events.wait(t, "connection_reconnected", 1); data["attempt"] != float64(2) || data["downtime_ms"] != float64(3000) {
+		t.Errorf("reconnected %v", data)
+	}
+
+	// Five quiet seconds on the clock end it
+	harnessCall(t, handleSetConnectionTimeouts, `{"id":"`+id+`","idle_timeout_ms":5000}`)
+	waitPending(t, fake, 1)
+	fake.Advance(4 * time.Second)
+	fake.Advance(time.Second)
+	if data := events.wait(t, "connection_closed", 1); data["reason"] != "timeout" {
+		t.Errorf("closed %v", data)
+	}
+}
+
+func TestHarnessKeepsRealSocketDeadlines(t *testing.T) {
+	useHarness(t)
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	c := &Connection{ID: "harness-real", Direction: "inbound", Network: "tcp", Created: time.Now(), Limiter: newRateLimiter(0)}
+	c.setConn(a)
+	c.timeouts = Timeouts{Read: 5 * time.Second, Write: 5 * time.Second}
+
+	go b.Write([]byte("x"))
+	if _, err := c.Read(make([]byte, 1)); err != nil {
+		t.Errorf("read on a real socket: %v", err)
+	}
+	go b.Read(make([]byte, 1))
+	if _, err := c.Write([]byte("y")); err != nil {
+		t.Errorf("write on a real socket: %v", err)
+	}
+}
+
+func TestHarnessScriptAndLoopback(t *testing.T) {
+	fake, events := useHarness(t)
+
+	harnessCall(t, handleTestPeer, `{"name":"slow","script":[{"expect":5},{"wait_ms":30000},{"send":"world"},{"close":true}]}`)
+	resp := harnessCall(t, handleConnect, `{"host":"slow.harness","port":80,"timeouts":{"write_timeout_ms":0}}`)
+	id := resp.Data.(map[string]interface{})["id"].(string)
+	harnessCall(t, handleSend, `{"id":"`+id+`","data":"hello"}`)
+	if data := events.wait(t, "test_peer_received", 1); data["data"] != "hello" {
+		t.Errorf("peer received %v", data)
+	}
+	waitPending(t, fake, 1)
+	fake.Advance(30 * time.Second)
+	if data := events.wait(t, "connection_data", 1); data["data"] != "d29ybGQ=" {
+		t.Errorf("peer answered %v", data)
+	}
+	events.wait(t, "connection_closed", 1)
+
+	// A loopback peer hands its dials to our own echo listener
+	resp = harnessCall(t, handleStartServer, `{"host":"127.0.0.1","port":0,"type":"echo"}`)
+	listener := resp.Data.(map[string]interface{})["listener_id"].(string)
+	t.Cleanup(func() { harnessCall(t, handleStopServer, `{"listener_id":"`+listener+`"}`) })
+	harnessCall(t, handleTestPeer, `{"name":"loop","listener_id":"`+listener+`"}`)
+	resp = harnessCall(t, handleConnect, `{"host":"loop.harness","port":1}`)
+	id = resp.Data.(map[string]interface{})["id"].(string)
+	harnessCall(t, handleSend, `{"id":"`+id+`","data":"hi"}`)
+	if data := events.wait(t, "connection_data", 2); data["data"] != "aGk=" {
+		t.Errorf("listener echoed %v", data)
+	}
+	// The listener's side goes away with ours
+	harnessCall(t, handleDisconnect, `{"id":"`+id+`"}`)
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		state.Mutex.Lock()
+		open := len(state.Conns)
+		state.Mutex.Unlock()
+		if open == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d connections left open", open)
+		}
+	}
+}
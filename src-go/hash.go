@@ -0,0 +1,247 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/zeebo/blake3"
+)
+
+// Digest algorithms for hash_file and verify_transfer. Transfers always
+// verify with SHA-256, which both ends compute while the body streams.
+const (
+	hashSHA256 = "sha256"
+	hashBLAKE3 = "blake3"
+)
+
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+// resultChecksumMismatch is the ack Result for a body that failed verification
+const resultChecksumMismatch = "checksum_mismatch"
+
+// checksumError carries both digests of a failed verification
+type checksumError struct {
+	name             string
+	expected, actual string
+}
+
+func (e *checksumError) Error() string {
+	return fmt.Sprintf("%v for %s", errChecksumMismatch, e.name)
+}
+
+func (e *checksumError) Is(target error) bool { return target == errChecksumMismatch }
+
+// mismatchAck marks ack as a failed verification when err is one
+func mismatchAck(ack *TransferAck, err error) {
+	var ce *checksumError
+	if errors.As(err, &ce) {
+		ack.Result, ack.SHA256 = resultChecksumMismatch, ce.actual
+	}
+}
+
+var hashSeq atomic.Uint64
+
+func newHasher(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case "", hashSHA256:
+		return sha256.New(), nil
+	case hashBLAKE3:
+		return blake3.New(), nil
+	}
+	return nil, catalogError(ErrUnsupported, "hash.unsupported_hash_algorithm", "algorithm", algorithm)
+}
+
+// transferTrailer follows the body of a verified transfer
+type transferTrailer struct {
+	SHA256 string `json:"sha256"`
+}
+
+// emitVerifyFailed reports a file whose digest differs from the expected one
+func emitVerifyFailed(t *Transfer, path, algorithm, expected, actual string) {
+	logger.Warn("checksum mismatch", "id", t.ID, "path", path, "expected", expected, "actual", actual)
+	emitEvent("transfer_verify_failed", map[string]interface{}{
+		"id":        t.ID,
+		"direction": t.Direction,
+		"name":      t.Name,
+		"path":      path,
+		"algorithm": algorithm,
+		"expected":  expected,
+		"actual":    actual,
+	})
+}
+
+// hashProgress reports how far a hash job has read every progressInterval
+func hashProgress(id, path string, total int64, read *atomic.Int64, done <-chan struct{}) {
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			n := read.Load()
+			progress := map[string]interface{}{"id": id, "path": path, "bytes": n, "total": total}
+			if total > 0 {
+				progress["percent"] = float64(n) / float64(total) * 100
+			}
+			emitEvent("hash_progress", progress)
+		}
+	}
+}
+
+// digestFile streams path through the algorithm, emitting hash_progress
+// under id while it runs
+func digestFile(id, path, algorithm string) (string, int64, error) {
+	h, err := newHasher(algorithm)
+	if err != nil {
+		return "", 0, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", 0, err
+	}
+
+	var read atomic.Int64
+	done := make(chan struct{})
+	go hashProgress(id, path, info.Size(), &read, done)
+	n, err := io.CopyBuffer(h, countingReader{r: f, n: &read}, make([]byte, transferBufferSize))
+	close(done)
+	if err != nil {
+		return "", n, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+type HashFilePayload struct {
+	Path      string `json:"path"`
+	Algorithm string `json:"algorithm"` // "sha256" (default), "blake3"
+}
+
+// handleHashFile hashes a file in the background; large files take a
+// while, so the digest arrives in a hash_completed event
+func handleHashFile(payload json.RawMessage, writer *Output) {
+	var p HashFilePayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		sendInvalidPayload(writer, "hash_file")
+		return
+	}
+	if p.Algorithm == "" {
+		p.Algorithm = hashSHA256
+	}
+	if _, err := newHasher(p.Algorithm); err != nil {
+		sendFailure(writer, err)
+		return
+	}
+	if info, err := os.Stat(p.Path); err != nil || !info.Mode().IsRegular() {
+		sendErrorCode(writer, ErrInvalidArgument, message("common.not_regular_file", "path", p.Path), nil)
+		return
+	}
+
+	id := fmt.Sprintf("hash-%d", hashSeq.Add(1))
+	writer.Encode(okResponse(message("hash.hashing_started"),
+		map[string]interface{}{"id": id, "path": p.Path, "algorithm": p.Algorithm}))
+
+	go func() {
+		defer recoverPanic("hash " + id)
+		start := time.Now()
+		digest, size, err := digestFile(id, p.Path, p.Algorithm)
+		if err != nil {
+			emitEvent("hash_failed", map[string]interface{}{"id": id, "path": p.Path, "error": err.Error()})
+			return
+		}
+		emitEvent("hash_completed", map[string]interface{}{
+			"id":              id,
+			"path":            p.Path,
+			"algorithm":       p.Algorithm,
+			"digest":          digest,
+			"size":            size,
+			"elapsed_seconds": time.Since(start).Seconds(),
+		})
+	}()
+}
+
+type VerifyTransferPayload struct {
+	ID        string `json:"id"`
+	Algorithm string `json:"algorithm"` // defaults to sha256, the digest transfers record
+	Expected  string `json:"expected"`  // required unless the algorithm is sha256
+}
+
+// handleVerifyTransfer re-hashes a finished transfer's file on disk and
+// compares it with the digest recorded during the transfer or given here
+func handleVerifyTransfer(payload json.RawMessage, writer *Output) {
+	var p VerifyTransferPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		sendInvalidPayload(writer, "verify_transfer")
+		return
+	}
+	if p.Algorithm == "" {
+		p.Algorithm = hashSHA256
+	}
+	if _, err := newHasher(p.Algorithm); err != nil {
+		sendFailure(writer, err)
+		return
+	}
+
+	t, exists := lookupTransfer(p.ID, writer)
+	if !exists {
+		sendErrorCode(writer, ErrNotFound, message("common.transfer_not_found"), nil)
+		return
+	}
+	info := t.Info()
+	if info.Files > 0 {
+		sendErrorCode(writer, ErrInvalidArgument, message("hash.only_single_file_transfers"), nil)
+		return
+	}
+	if info.State != "completed" {
+		sendErrorCode(writer, ErrInvalidState, message("hash.transfer_not_completed", "state", info.State), nil)
+		return
+	}
+	expected := strings.ToLower(p.Expected)
+	if expected == "" && p.Algorithm == hashSHA256 {
+		expected = info.SHA256
+	}
+	if expected == "" {
+		sendErrorCode(writer, ErrInvalidArgument, message("hash.verify_transfer_needs_expected", "algorithm", p.Algorithm), nil)
+		return
+	}
+
+	id := fmt.Sprintf("hash-%d", hashSeq.Add(1))
+	writer.Encode(okResponse(message("hash.verification_started"),
+		map[string]interface{}{"id": id, "transfer": t.ID, "path": info.Path, "algorithm": p.Algorithm}))
+
+	go func() {
+		defer recoverPanic("verify " + id)
+		actual, _, err := digestFile(id, info.Path, p.Algorithm)
+		if err != nil {
+			emitEvent("hash_failed", map[string]interface{}{"id": id, "path": info.Path, "error": err.Error()})
+			return
+		}
+		match := actual == expected
+		if !match {
+			emitVerifyFailed(t, info.Path, p.Algorithm, expected, actual)
+		}
+		emitEvent("transfer_verified", map[string]interface{}{
+			"id":        id,
+			"transfer":  t.ID,
+			"path":      info.Path,
+			"algorithm": p.Algorithm,
+			"expected":  expected,
+			"actual":    actual,
+			"match":     match,
+		})
+	}()
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// Accept loops ride out transient errors such as running out of file
+// descriptors by backing off, as net/http does. Any other error while the
+// listener is still in service means its socket is gone: the listener is
+// reported down and rebound on the same address, with backoff, until it
+// comes back or is stopped.
+const (
+	acceptBackoffMin = 5 * time.Millisecond
+	acceptBackoffMax = time.Second
+	rebindBackoffMin = time.Second
+	rebindBackoffMax = 30 * time.Second
+)
+
+// serveListener accepts connections for a connection listener until it
+// is stopped or the service shuts down
+func serveListener(l *Listener, dir string) {
+	defer recoverPanic("listener " + l.ID)
+	state.Mutex.Lock()
+	ln := l.ln
+	state.Mutex.Unlock()
+
+	var delay time.Duration
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if !l.serving(ln) {
+				return // stopped
+			}
+			// Temporary is deprecated but still how net/http spots EMFILE and friends
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Temporary() {
+				delay = min(max(2*delay, acceptBackoffMin), acceptBackoffMax)
+				logger.Warn("accept failed, retrying", "addr", l.Addr, "error", err, "delay", delay.String())
+				time.Sleep(delay)
+				continue
+			}
+			if ln = l.rebind(ln, err); ln == nil {
+				return
+			}
+			delay = 0
+			continue
+		}
+		delay = 0
+		c, running := acceptConn(conn, l)
+		if !running {
+			return
+		}
+		if c == nil {
+			continue // refused, over the connection limit
+		}
+		go serveInbound(c, l, downloadDirFor(dir))
+	}
+}
+
+// serving reports whether ln is still the socket l is meant to accept on
+func (l *Listener) serving(ln net.Listener) bool {
+	state.Mutex.Lock()
+	defer state.Mutex.Unlock()
+	return state.Listeners[l.ID] == l && l.ln == ln
+}
+
+// rebind replaces the dead socket old, retrying until it succeeds or the
+// listener is stopped, in which case it returns nil
+func (l *Listener) rebind(old net.Listener, cause error) net.Listener {
+	old.Close()
+	down := clock.Now()
+	state.Mutex.Lock()
+	l.down, l.lastError = down, cause.Error()
+	state.Mutex.Unlock()
+	logger.Warn("listener down", "addr", l.Addr, "type", l.Type, "error", cause)
+	emitEvent("listener_down", map[string]interface{}{"addr": l.Addr, "listener_id": l.ID, "type": l.Type, "error": cause.Error()})
+
+	delay := rebindBackoffMin
+	for attempt := 1; ; attempt++ {
+		<-clock.After(delay)
+
+		state.Mutex.Lock()
+		if state.Listeners[l.ID] != l || l.ln != old {
+			state.Mutex.Unlock()
+			return nil
+		}
+		ln, err := l.bind()
+		if err == nil {
+			l.ln, l.down = ln, time.Time{}
+			l.Restarts++
+		} else {
+			l.lastError = err.Error()
+		}
+		state.Mutex.Unlock()
+
+		if err == nil {
+			logger.Info("listener recovered", "addr", l.Addr, "attempts", attempt)
+			emitEvent("listener_recovered", map[string]interface{}{
+				"addr":        l.Addr,
+				"listener_id": l.ID,
+				"type":        l.Type,
+				"attempts":    attempt,
+				"downtime_ms": clock.Now().Sub(down).Milliseconds(),
+			})
+			return ln
+		}
+		logger.Warn("listener rebind failed", "addr", l.Addr, "attempt", attempt, "error", err)
+		delay = min(2*delay, rebindBackoffMax)
+	}
+}
+
+// health describes l for status; the caller holds state.Mutex
+func (l *Listener) health() map[string]interface{} {
+	h := map[string]interface{}{"state": "up", "restarts": l.Restarts}
+	if !l.down.IsZero() {
+		h["state"], h["error"], h["down_since"] = "down", l.lastError, l.down.UTC().Format(time.RFC3339)
+	}
+	return h
+}
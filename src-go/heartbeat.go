@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// Heartbeats: every mux link, peer session ones included, pings the other
+// side each interval and counts the pings that go unanswered within it. A
+// link missing Misses in a row is declared unreachable, closed and
+// reported as peer_unreachable, so a sleeping laptop or a pulled cable is
+// noticed within seconds instead of when a read finally times out. Any
+// frame arriving while a ping is out counts as its answer: on a slow link
+// the answer can sit behind bulk data, and the data shows the peer is
+// there. The pings also feed the link's latency statistics.
+const (
+	defaultHeartbeatInterval = 2 * time.Second
+	defaultHeartbeatMisses   = 3
+	minHeartbeatInterval     = 250 * time.Millisecond
+	maxHeartbeatInterval     = time.Minute
+	maxHeartbeatMisses       = 20
+)
+
+// errPeerUnreachable ends a link whose peer stopped answering heartbeats
+var errPeerUnreachable = errors.New("peer stopped answering heartbeats")
+
+// HeartbeatConfig is the config section timing heartbeats on peer links.
+// Zero values keep the defaults.
+type HeartbeatConfig struct {
+	IntervalMs int `json:"interval_ms,omitempty"` // between heartbeats and how long each may take, default 2000
+	Misses     int `json:"misses,omitempty"`      // unanswered in a row before the peer is unreachable, default 3
+}
+
+func (h HeartbeatConfig) Validate() error {
+	if h.IntervalMs != 0 && (h.IntervalMs < int(minHeartbeatInterval/time.Millisecond) || h.IntervalMs > int(maxHeartbeatInterval/time.Millisecond)) {
+		return catalogError(ErrInvalidArgument, "heartbeat.interval_ms_must_between", "min", minHeartbeatInterval.Milliseconds(), "max", maxHeartbeatInterval.Milliseconds())
+	}
+	if h.Misses < 0 || h.Misses > maxHeartbeatMisses {
+		return catalogError(ErrInvalidArgument, "heartbeat.misses_must_between", "max", maxHeartbeatMisses)
+	}
+	return nil
+}
+
+// effective fills in the defaults
+func (h HeartbeatConfig) effective() HeartbeatConfig {
+	if h.IntervalMs == 0 {
+		h.IntervalMs = int(defaultHeartbeatInterval / time.Millisecond)
+	}
+	if h.Misses == 0 {
+		h.Misses = defaultHeartbeatMisses
+	}
+	return h
+}
+
+func (h HeartbeatConfig) interval() time.Duration {
+	return time.Duration(h.IntervalMs) * time.Millisecond
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// useHeartbeat sets the heartbeat config for the test
+func useHeartbeat(t *testing.T, hb HeartbeatConfig) {
+	config.mu.Lock()
+	saved := config.cfg
+	config.cfg.Heartbeat = hb
+	config.mu.Unlock()
+	t.Cleanup(func() {
+		config.mu.Lock()
+		config.cfg = saved
+		config.mu.Unlock()
+	})
+}
+
+func TestHeartbeatDetectsSilentPeer(t *testing.T) {
+	useHeartbeat(t, HeartbeatConfig{IntervalMs: 250, Misses: 2})
+
+	// The peer's end swallows everything and never answers, like a
+	// connection whose other side went to sleep
+	a, b := net.Pipe()
+	go io.Copy(io.Discard, b)
+	s := newMuxSession(a, true)
+	defer s.Close()
+	defer b.Close()
+
+	start := time.Now()
+	select {
+	case <-s.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("silent peer not detected")
+	}
+	if err := s.closeErr(); !errors.Is(err, errPeerUnreachable) {
+		t.Errorf("closed with %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 500*time.Millisecond {
+		t.Errorf("declared unreachable after %v, before two misses", elapsed)
+	}
+}
+
+func TestHeartbeatCountsDataAsAnswer(t *testing.T) {
+	useHeartbeat(t, HeartbeatConfig{IntervalMs: 250, Misses: 2})
+
+	// The peer never answers a ping but keeps sending data, like one whose
+	// answers are stuck behind a bulk transfer
+	a, b := net.Pipe()
+	go io.Copy(io.Discard, b)
+	s := newMuxSession(a, true)
+	defer s.Close()
+	defer b.Close()
+	sending := time.After(1500 * time.Millisecond)
+	frame := make([]byte, muxHeaderSize+1)
+	frame[0], frame[1] = muxVersion, muxData
+	binary.BigEndian.PutUint32(frame[4:], 2)
+	binary.BigEndian.PutUint32(frame[8:], 1)
+	for done := false; !done; {
+		select {
+		case <-s.Done():
+			t.Fatalf("closed while data arrived: %v", s.closeErr())
+		case <-sending:
+			done = true
+		case <-time.After(50 * time.Millisecond):
+			b.Write(frame)
+		}
+	}
+
+	// Once the data stops, the misses count again
+	select {
+	case <-s.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("silent peer not detected")
+	}
+	if err := s.closeErr(); !errors.Is(err, errPeerUnreachable) {
+		t.Errorf("closed with %v", err)
+	}
+}
+
+func TestHeartbeatConfigValidate(t *testing.T) {
+	if err := (HeartbeatConfig{}).Validate(); err != nil {
+		t.Error(err)
+	}
+	for _, bad := range []HeartbeatConfig{{IntervalMs: 10}, {IntervalMs: 120000}, {Misses: -1}, {Misses: 21}} {
+		if bad.Validate() == nil {
+			t.Errorf("%+v accepted", bad)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// The transfer history keeps one record per finished transfer for the
+// frontend's history view. It lives in a JSON file next to the config and
+// is rewritten after every transfer; the oldest records go first once it
+// holds maxHistoryEntries.
+const (
+	maxHistoryEntries   = 1000
+	defaultHistoryLimit = 100
+)
+
+// HistoryEntry is a completed or failed transfer
+type HistoryEntry struct {
+	ID              string    `json:"id"`
+	Direction       string    `json:"direction"`
+	Name            string    `json:"name"`
+	Path            string    `json:"path"`
+	Peer            string    `json:"peer"`
+	Instance        string    `json:"instance,omitempty"` // discovered peer behind Peer, if any
+	Size            int64     `json:"size"`
+	Bytes           int64     `json:"bytes"`
+	Files           int       `json:"files,omitempty"`
+	Result          string    `json:"result"` // "completed", "failed", "canceled"
+	Error           string    `json:"error,omitempty"`
+	StartedAt       time.Time `json:"started_at"`
+	FinishedAt      time.Time `json:"finished_at"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	AverageBps      float64   `json:"average_bps"`
+	SHA256          string    `json:"sha256,omitempty"`
+	Geo             *GeoInfo  `json:"geo,omitempty"` // where Peer was, when a GeoIP database knew
+}
+
+// HistoryStore is the loaded history and the file it is saved to
+type HistoryStore struct {
+	mu      sync.Mutex
+	path    string
+	entries []HistoryEntry // oldest first
+}
+
+var history HistoryStore
+
+// historyPath puts the history beside the config file
+func historyPath(configPath string) string {
+	return filepath.Join(filepath.Dir(configPath), "lumina-history.json")
+}
+
+// Load reads path into the store; a missing file is an empty history
+func (s *HistoryStore) Load(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.path = path
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var entries []HistoryEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("parse %s: %w", path, err)
+	}
+	s.entries = entries
+	return nil
+}
+
+// Record appends the outcome of t and saves the history
+func (s *HistoryStore) Record(t *Transfer) {
+	info := t.Info()
+	e := HistoryEntry{
+		ID:         info.ID,
+		Direction:  info.Direction,
+		Name:       info.Name,
+		Path:       info.Path,
+		Peer:       info.Peer,
+		Size:       info.Size,
+		Bytes:      info.Bytes,
+		Files:      info.Files,
+		Result:     info.State,
+		Error:      info.Error,
+		StartedAt:  info.StartedAt,
+		FinishedAt: clock.Now(),
+		SHA256:     info.SHA256,
+	}
+	e.DurationSeconds = e.FinishedAt.Sub(e.StartedAt).Seconds()
+	if e.DurationSeconds > 0 {
+		e.AverageBps = float64(e.Bytes) / e.DurationSeconds
+	}
+	if name, ok := discoveredPeer(e.Peer); ok {
+		e.Instance = name
+	}
+	e.Geo = geoForAddr(e.Peer)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries = append(s.entries, e)
+	if len(s.entries) > maxHistoryEntries {
+		s.entries = append([]HistoryEntry(nil), s.entries[len(s.entries)-maxHistoryEntries:]...)
+	}
+	if err := s.saveLocked(); err != nil {
+		logger.Warn("failed to save transfer history", "path", s.path, "error", err)
+	}
+}
+
+// saveLocked writes the history atomically, like the config
+func (s *HistoryStore) saveLocked() error {
+	if s.path == "" {
+		return nil
+	}
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(s.entries); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(s.path+".tmp", buf.Bytes(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(s.path+".tmp", s.path)
+}
+
+// HistoryFilter selects history entries. Every set field must match.
+type HistoryFilter struct {
+	Peer      string    `json:"peer"`      // instance name, "host:port" or host
+	Since     time.Time `json:"since"`     // finished at or after, RFC 3339
+	Until     time.Time `json:"until"`     // finished before, RFC 3339
+	Direction string    `json:"direction"` // "send", "receive"
+	Result    string    `json:"result"`    // "completed", "failed", "canceled"
+}
+
+func (f *HistoryFilter) match(e *HistoryEntry) bool {
+	if f.Peer != "" && f.Peer != e.Instance && f.Peer != e.Peer {
+		host, _, err := net.SplitHostPort(e.Peer)
+		if err != nil || !(host == f.Peer || sameHost(host, normalizeHost(f.Peer))) {
+			return false
+		}
+	}
+	switch {
+	case !f.Since.IsZero() && e.FinishedAt.Before(f.Since):
+		return false
+	case !f.Until.IsZero() && !e.FinishedAt.Before(f.Until):
+		return false
+	case f.Direction != "" && f.Direction != e.Direction:
+		return false
+	case f.Result != "" && f.Result != e.Result:
+		return false
+	}
+	return true
+}
+
+type ListHistoryPayload struct {
+	HistoryFilter
+	Limit  int `json:"limit"`  // newest entries returned, default 100
+	Offset int `json:"offset"` // newest entries skipped first, for paging
+}
+
+// handleListHistory returns matching entries, newest first
+func handleListHistory(payload json.RawMessage, writer *Output) {
+	var p ListHistoryPayload
+	if len(payload) > 0 && string(payload) != "null" {
+		if err := json.Unmarshal(payload, &p); err != nil {
+			sendInvalidPayload(writer, "list_history")
+			return
+		}
+	}
+	if p.Limit < 0 || p.Offset < 0 {
+		sendErrorCode(writer, ErrInvalidArgument, message("history.limit_offset_must_not"), nil)
+		return
+	}
+	if p.Limit == 0 {
+		p.Limit = defaultHistoryLimit
+	}
+
+	history.mu.Lock()
+	matched := 0
+	entries := []HistoryEntry{}
+	for i := len(history.entries) - 1; i >= 0; i-- {
+		e := &history.entries[i]
+		if !p.match(e) {
+			continue
+		}
+		if matched >= p.Offset && len(entries) < p.Limit {
+			entries = append(entries, *e)
+		}
+		matched++
+	}
+	history.mu.Unlock()
+
+	writer.Encode(ProtocolResponse{
+		Status: "ok",
+		Data: map[string]interface{}{
+			"entries": entries,
+			"total":   matched,
+		},
+	})
+}
+
+// handleClearHistory forgets matching entries, or all of them when the
+// payload sets no filter
+func handleClearHistory(payload json.RawMessage, writer *Output) {
+	var f HistoryFilter
+	if len(payload) > 0 && string(payload) != "null" {
+		if err := json.Unmarshal(payload, &f); err != nil {
+			sendInvalidPayload(writer, "clear_history")
+			return
+		}
+	}
+
+	history.mu.Lock()
+	kept := history.entries[:0]
+	for i := range history.entries {
+		if !f.match(&history.entries[i]) {
+			kept = append(kept, history.entries[i])
+		}
+	}
+	removed := len(history.entries) - len(kept)
+	history.entries = kept
+	err := history.saveLocked()
+	history.mu.Unlock()
+	if err != nil {
+		sendError(writer, message("history.failed_save_transfer_history", "error", err))
+		return
+	}
+
+	writer.Encode(okResponse(message("history.cleared_history_entries", "removed", removed),
+		map[string]interface{}{"removed": removed, "remaining": len(kept)}))
+}
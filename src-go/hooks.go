@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Post-receive hooks run, in the order configured, once a received
+// transfer has completed. A "move" hook files the transfer into another
+// directory, by default a subfolder per peer; a "command" hook runs a
+// program; a "webhook" hook POSTs to a URL. Hooks see the transfer through
+// placeholders such as {name}, {path}, {peer} and {size} in their
+// arguments, directory and body, and a move changes the {path} the hooks
+// after it see. A receive stored on a remote backend has no path: move
+// hooks skip it, and {location} and {storage} say where it went. Each hook
+// reports hook_completed or hook_failed; a failed hook does not stop the
+// ones after it.
+const (
+	hookMove    = "move"
+	hookCommand = "command"
+	hookWebhook = "webhook"
+
+	defaultHookTimeout = time.Minute
+	defaultHookDir     = "{peer}"
+	maxHookOutput      = 4 << 10
+)
+
+// TransferHook is one entry of the config's hooks
+type TransferHook struct {
+	Name      string            `json:"name,omitempty"` // shown in hook events; default the type and position
+	Type      string            `json:"type"`           // "move", "command" or "webhook"
+	Dir       string            `json:"dir,omitempty"`  // move: target directory, relative to the file's; default "{peer}"
+	Command   []string          `json:"command,omitempty"`
+	URL       string            `json:"url,omitempty"`
+	Body      string            `json:"body,omitempty"` // webhook: values are escaped for JSON strings; default an object of them all
+	Headers   map[string]string `json:"headers,omitempty"`
+	Peers     []string          `json:"peers,omitempty"` // only transfers from these names, fingerprints or hosts
+	TimeoutMs int               `json:"timeout_ms,omitempty"`
+}
+
+func (h TransferHook) Validate() error {
+	switch h.Type {
+	case hookMove:
+	case hookCommand:
+		if len(h.Command) == 0 || h.Command[0] == "" {
+			return catalogError(ErrInvalidArgument, "hooks.command_hooks_must_start")
+		}
+	case hookWebhook:
+		u, err := url.Parse(h.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return catalogError(ErrInvalidArgument, "hooks.webhook_hooks_need_http")
+		}
+	default:
+		return catalogError(ErrUnsupported, "hooks.unsupported_hook_type", "type", h.Type)
+	}
+	if h.TimeoutMs < 0 {
+		return catalogError(ErrInvalidArgument, "hooks.hook_timeout_ms_must")
+	}
+	return nil
+}
+
+func (h TransferHook) timeout() time.Duration {
+	if h.TimeoutMs > 0 {
+		return time.Duration(h.TimeoutMs) * time.Millisecond
+	}
+	return defaultHookTimeout
+}
+
+// hookFields are the placeholders a hook can use for transfer t
+func hookFields(t TransferInfo) map[string]string {
+	host := remoteHost(t.Peer)
+	size := t.Size
+	if size <= 0 {
+		size = t.Bytes
+	}
+	fields := map[string]string{
+		"id":        t.ID,
+		"name":      t.Name,
+		"path":      t.Path,
+		"dir":       filepath.Dir(t.Path),
+		"peer":      host,
+		"peer_addr": t.Peer,
+		"size":      strconv.FormatInt(size, 10),
+		"files":     strconv.Itoa(t.Files),
+		"sha256":    t.SHA256,
+		"time":      time.Now().UTC().Format(time.RFC3339),
+	}
+	if t.Storage != "" {
+		fields["path"], fields["dir"] = "", ""
+		fields["location"], fields["storage"] = t.Path, t.Storage
+	}
+	if p, ok := trust.atHost(host); ok {
+		fields["peer"] = p.displayName()
+		fields["fingerprint"] = p.Fingerprint
+	}
+	return fields
+}
+
+// expandHook fills in the placeholders of tmpl, each value passed through
+// escape first. Unknown placeholders are left as they are.
+func expandHook(tmpl string, fields map[string]string, escape func(string) string) string {
+	var b strings.Builder
+	for {
+		open := strings.IndexByte(tmpl, '{')
+		if open < 0 {
+			break
+		}
+		end := strings.IndexByte(tmpl[open:], '}')
+		if end < 0 {
+			break
+		}
+		v, ok := fields[tmpl[open+1:open+end]]
+		if !ok {
+			// Not a placeholder, but one may start after this brace
+			b.WriteString(tmpl[:open+1])
+			tmpl = tmpl[open+1:]
+			continue
+		}
+		b.WriteString(tmpl[:open])
+		b.WriteString(escape(v))
+		tmpl = tmpl[open+end+1:]
+	}
+	b.WriteString(tmpl)
+	return b.String()
+}
+
+// hookPathElement keeps a placeholder from adding directories of its own
+func hookPathElement(s string) string {
+	s = strings.Map(func(r rune) rune {
+		switch r {
+		case '/', '\\', ':', '*', '?', '"', '<', '>', '|':
+			return '_'
+		}
+		return r
+	}, s)
+	if s == "" || s == "." || s == ".." {
+		return "_"
+	}
+	return s
+}
+
+// jsonStringEscape escapes s for use inside a JSON string
+func jsonStringEscape(s string) string {
+	data, _ := json.Marshal(s)
+	return string(data[1 : len(data)-1])
+}
+
+func (h TransferHook) matches(fields map[string]string) bool {
+	if len(h.Peers) == 0 {
+		return true
+	}
+	for _, p := range h.Peers {
+		if p == fields["peer"] || p == fields["fingerprint"] || sameHost(p, remoteHost(fields["peer_addr"])) {
+			return true
+		}
+	}
+	return false
+}
+
+// runHooks runs the configured hooks for a completed receive
+func runHooks(t *Transfer) {
+	hooks := config.Get().Hooks
+	if len(hooks) == 0 {
+		return
+	}
+	fields := hookFields(t.Info())
+	for i, h := range hooks {
+		if !h.matches(fields) || (h.Type == hookMove && fields["storage"] != "") {
+			continue
+		}
+		name := h.Name
+		if name == "" {
+			name = fmt.Sprintf("%s-%d", h.Type, i+1)
+		}
+		data := map[string]interface{}{"id": t.ID, "hook": name, "type": h.Type}
+		if ns := t.Info().Namespace; ns != "" {
+			data["namespace"] = ns
+		}
+		output, err := h.run(t, fields)
+		if output != "" {
+			data["output"] = output
+		}
+		if err != nil {
+			data["error"] = err.Error()
+			logger.Warn("transfer hook failed", "id", t.ID, "hook", name, "error", err)
+			emitEvent("hook_failed", data)
+			continue
+		}
+		data["path"] = fields["path"]
+		logger.Info("transfer hook ran", "id", t.ID, "hook", name)
+		emitEvent("hook_completed", data)
+	}
+}
+
+// run runs one hook; a move updates fields and t to the new path
+func (h TransferHook) run(t *Transfer, fields map[string]string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout())
+	defer cancel()
+	switch h.Type {
+	case hookMove:
+		path, err := h.move(fields)
+		if err != nil {
+			return "", err
+		}
+		fields["path"], fields["dir"] = path, filepath.Dir(path)
+		t.mu.Lock()
+		t.Path = path
+		t.mu.Unlock()
+		return "", nil
+	case hookCommand:
+		args := make([]string, len(h.Command)-1)
+		for i, a := range h.Command[1:] {
+			args[i] = expandHook(a, fields, func(s string) string { return s })
+		}
+		cmd := exec.CommandContext(ctx, h.Command[0], args...)
+		var out bytes.Buffer
+		cmd.Stdout = &limitedBuffer{&out, maxHookOutput}
+		cmd.Stderr = cmd.Stdout
+		err := cmd.Run()
+		if ctx.Err() != nil {
+			err = errors.New("hook timed out after " + h.timeout().String())
+		}
+		return strings.TrimSpace(out.String()), err
+	default:
+		return "", h.post(ctx, fields)
+	}
+}
+
+// move renames the transfer's file or directory into the hook's directory
+// and returns where it went
+func (h TransferHook) move(fields map[string]string) (string, error) {
+	from := fields["path"]
+	if from == "" {
+		return "", errors.New("transfer has no local path")
+	}
+	tmpl := h.Dir
+	if tmpl == "" {
+		tmpl = defaultHookDir
+	}
+	dir := expandHook(tmpl, fields, hookPathElement)
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(filepath.Dir(from), dir)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	to, err := uniquePath(filepath.Join(dir, filepath.Base(from)))
+	if err != nil {
+		return "", err
+	}
+	if err := os.Rename(from, to); err != nil {
+		info, serr := os.Stat(from)
+		if serr != nil || info.IsDir() {
+			return "", err
+		}
+		// Another file system; copy it over instead
+		if err := copyFile(from, to); err != nil {
+			return "", err
+		}
+		os.Remove(from)
+	}
+	return to, nil
+}
+
+func (h TransferHook) post(ctx context.Context, fields map[string]string) error {
+	var body []byte
+	if h.Body != "" {
+		body = []byte(expandHook(h.Body, fields, jsonStringEscape))
+	} else {
+		body, _ = json.Marshal(fields)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "lumina-net/"+version)
+	for k, v := range h.Headers {
+		req.Header.Set(k, expandHook(v, fields, func(s string) string { return s }))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// validateHooks checks the config's hooks
+func validateHooks(hooks []TransferHook) error {
+	var names []string
+	for i, h := range hooks {
+		if err := h.Validate(); err != nil {
+			return catalogError(ErrInvalidArgument, "hooks.invalid_hook", "index", i+1, "error", err)
+		}
+		if h.Name != "" {
+			if slices.Contains(names, h.Name) {
+				return catalogError(ErrInvalidArgument, "hooks.duplicate_hook_name", "name", h.Name)
+			}
+			names = append(names, h.Name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExpandHook(t *testing.T) {
+	fields := map[string]string{"name": `a "b".txt`, "peer": "10.0.0.1"}
+	got := expandHook(`{"file":"{name}","from":"{peer}","x":"{unknown}"}`, fields, jsonStringEscape)
+	want := `{"file":"a \"b\".txt","from":"10.0.0.1","x":"{unknown}"}`
+	if got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if got := expandHook("in/{peer}", map[string]string{"peer": "fe80::1"}, hookPathElement); got != "in/fe80__1" {
+		t.Errorf("path element %s", got)
+	}
+}
+
+func TestHooksMoveThenWebhook(t *testing.T) {
+	var body string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		body = string(data)
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "report.pdf")
+	if err := os.WriteFile(path, []byte("pdf"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tr := &Transfer{TransferInfo: TransferInfo{ID: "transfer-1", Name: "report.pdf", Path: path, Peer: "192.0.2.7:4000", Size: 3}}
+	fields := hookFields(tr.Info())
+
+	move := TransferHook{Type: hookMove}
+	if _, err := move.run(tr, fields); err != nil {
+		t.Fatal(err)
+	}
+	moved := filepath.Join(dir, "192.0.2.7", "report.pdf")
+	if _, err := os.Stat(moved); err != nil || tr.Info().Path != moved {
+		t.Fatalf("not moved to %s: %v, path %s", moved, err, tr.Info().Path)
+	}
+
+	hook := TransferHook{Type: hookWebhook, URL: srv.URL, Body: `{"text":"{name} ({size} bytes) at {path}"}`}
+	if _, err := hook.run(tr, fields); err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"text":"report.pdf (3 bytes) at ` + jsonStringEscape(moved) + `"}`; body != want {
+		t.Errorf("webhook body %s, want %s", body, want)
+	}
+}
+
+func TestHooksOnBackendReceive(t *testing.T) {
+	bodies := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		bodies <- string(data)
+	}))
+	defer srv.Close()
+	config.mu.Lock()
+	saved := config.cfg
+	config.cfg.Hooks = []TransferHook{
+		{Type: hookMove},
+		{Type: hookWebhook, URL: srv.URL, Body: `{"at":"{location}","in":"{storage}","path":"{path}"}`},
+	}
+	config.mu.Unlock()
+	t.Cleanup(func() {
+		config.mu.Lock()
+		config.cfg = saved
+		config.mu.Unlock()
+	})
+	events := &eventRecorder{}
+	savedOutput := output
+	output = NewOutput(events)
+	t.Cleanup(func() { output = savedOutput })
+
+	tr := &Transfer{TransferInfo: TransferInfo{ID: "transfer-1", Name: "report.pdf", Path: "https://bucket.example/report.pdf",
+		Storage: "archive", Peer: "192.0.2.7:4000", Size: 3}}
+	runHooks(tr)
+	if got, want := <-bodies, `{"at":"https://bucket.example/report.pdf","in":"archive","path":""}`; got != want {
+		t.Errorf("webhook body %s, want %s", got, want)
+	}
+	if done := events.wait(t, "hook_completed", 1); done["type"] != hookWebhook {
+		t.Errorf("first hook to run was %v", done)
+	}
+}
+
+func TestValidateHooksNamesTheHook(t *testing.T) {
+	err := validateHooks([]TransferHook{{Type: hookMove}, {Type: hookWebhook, URL: "ftp://example.com/"}})
+	var e *messageError
+	if !errors.As(err, &e) || e.code != ErrInvalidArgument || e.Key != "hooks.invalid_hook" || e.Args["index"] != "2" {
+		t.Fatalf("got %v", err)
+	}
+	if len(e.wrapped) != 1 || messageOf(e.wrapped[0]).Key != "hooks.webhook_hooks_need_http" {
+		t.Errorf("lost the hook's own error: %v", e.wrapped)
+	}
+}
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// HTTP endpoints a listener can expose
+const (
+	endpointStatus   = "status"
+	endpointUpload   = "upload"
+	endpointDownload = "download"
+)
+
+var defaultHTTPRoutes = map[string]string{
+	endpointStatus:   "/status",
+	endpointUpload:   "/upload",
+	endpointDownload: "/download/",
+}
+
+// HTTPOptions configures an "http" listener
+type HTTPOptions struct {
+	Prefix    string            `json:"prefix"`    // prepended to every route, e.g. "/api"
+	Endpoints []string          `json:"endpoints"` // enabled endpoints, default all
+	Routes    map[string]string `json:"routes"`    // endpoint -> path overrides
+}
+
+// trackedListener registers every accepted socket in the connection
+// registry so HTTP traffic is metered and drained like everything else
+type trackedListener struct {
+	net.Listener
+	l *Listener
+}
+
+func (tl trackedListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := tl.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		c, running := acceptConn(conn, tl.l)
+		if !running {
+			return nil, net.ErrClosed
+		}
+		if c == nil {
+			continue // refused, over the connection limit
+		}
+		return trackedConn{c}, nil
+	}
+}
+
+// trackedConn removes itself from the registry when the server closes it
+type trackedConn struct {
+	*Connection
+}
+
+func (tc trackedConn) Close() error {
+	untrackConn(tc.Connection)
+	return nil
+}
+
+// serveHTTP runs the LAN REST API on ln, rooted at dir, or at the current
+// download directory when dir is empty
+func serveHTTP(l *Listener, ln net.Listener, dir string, opts HTTPOptions) {
+	mux := http.NewServeMux()
+	for endpoint, route := range httpRoutes(opts) {
+		switch endpoint {
+		case endpointStatus:
+			mux.HandleFunc(route, httpStatus(l))
+		case endpointUpload:
+			mux.HandleFunc(route, httpUpload(l, dir))
+		case endpointDownload:
+			mux.Handle(route, http.StripPrefix(route, httpDownload(dir)))
+		}
+	}
+
+	srv := &http.Server{Handler: requireAuth(l, mux), ReadHeaderTimeout: 10 * time.Second}
+	srv.Serve(trackedListener{Listener: ln, l: l}) // returns once the listener is closed
+}
+
+// httpRoutes resolves the enabled endpoints to their full paths
+func httpRoutes(opts HTTPOptions) map[string]string {
+	enabled := opts.Endpoints
+	if len(enabled) == 0 {
+		enabled = []string{endpointStatus, endpointUpload, endpointDownload}
+	}
+
+	prefix := strings.TrimSuffix(opts.Prefix, "/")
+	routes := make(map[string]string)
+	for _, endpoint := range enabled {
+		route, ok := opts.Routes[endpoint]
+		if !ok {
+			route = defaultHTTPRoutes[endpoint]
+		}
+		if !strings.HasPrefix(route, "/") {
+			route = "/" + route
+		}
+		// download serves a subtree, so its route must end with a slash
+		if endpoint == endpointDownload && !strings.HasSuffix(route, "/") {
+			route += "/"
+		}
+		routes[endpoint] = prefix + route
+	}
+	return routes
+}
+
+func validateHTTPOptions(opts HTTPOptions) error {
+	for _, endpoint := range opts.Endpoints {
+		if _, ok := defaultHTTPRoutes[endpoint]; !ok {
+			return catalogError(ErrUnsupported, "httpapi.unknown_http_endpoint", "endpoint", endpoint)
+		}
+	}
+	for endpoint := range opts.Routes {
+		if _, ok := defaultHTTPRoutes[endpoint]; !ok {
+			return catalogError(ErrUnsupported, "httpapi.unknown_http_endpoint", "endpoint", endpoint)
+		}
+	}
+	routes := httpRoutes(opts)
+	paths := make([]string, 0, len(routes))
+	for _, route := range routes {
+		if err := validRoutePath(route); err != nil {
+			return err
+		}
+		paths = append(paths, route)
+	}
+	return checkPatterns(paths)
+}
+
+// validRoutePath checks a path given for an HTTP route is a plain path:
+// ServeMux reads spaces, braces and the like as pattern syntax, and
+// panics on what it cannot parse
+func validRoutePath(p string) error {
+	u, err := url.ParseRequestURI(p)
+	if err != nil || u.Path != p || u.RawQuery != "" || u.Fragment != "" || strings.ContainsAny(p, " \t{}") {
+		return catalogError(ErrInvalidArgument, "httpapi.invalid_http_path", "path", fmt.Sprintf("%q", p))
+	}
+	return nil
+}
+
+// checkPatterns registers paths on a scratch ServeMux, turning the panic
+// a duplicate or conflicting one causes into an error
+func checkPatterns(paths []string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = catalogError(ErrInvalidArgument, "httpapi.invalid_http_routes", "error", r)
+		}
+	}()
+	mux := http.NewServeMux()
+	for _, p := range paths {
+		mux.Handle(p, http.NotFoundHandler())
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func httpStatus(l *Listener) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeJSON(w, http.StatusMethodNotAllowed, ProtocolResponse{Status: "error", Message: "Use GET"})
+			return
+		}
+		host, _ := os.Hostname()
+		writeJSON(w, http.StatusOK, ProtocolResponse{
+			Status: "ok",
+			Data: map[string]interface{}{
+				"name":           host,
+				"listener":       l.Addr,
+				"listener_id":    l.ID,
+				"uptime_seconds": time.Since(metrics.StartedAt).Seconds(),
+			},
+		})
+	}
+}
+
+// httpUpload accepts a raw body (name taken from ?name= or the
+// Content-Disposition header) or a multipart form with a "file" field
+func httpUpload(l *Listener, dir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost && r.Method != http.MethodPut {
+			writeJSON(w, http.StatusMethodNotAllowed, ProtocolResponse{Status: "error", Message: "Use POST or PUT"})
+			return
+		}
+
+		body, name, size := io.Reader(r.Body), r.URL.Query().Get("name"), r.ContentLength
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "multipart/form-data" {
+			reader, err := r.MultipartReader()
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, ProtocolResponse{Status: "error", Message: "Invalid multipart body"})
+				return
+			}
+			part, err := nextFilePart(reader)
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, ProtocolResponse{Status: "error", Message: err.Error()})
+				return
+			}
+			defer part.Close()
+			body, name, size = part, part.FileName(), -1
+		} else if name == "" {
+			if _, params, err := mime.ParseMediaType(r.Header.Get("Content-Disposition")); err == nil {
+				name = params["filename"]
+			}
+		}
+
+		if name == "" {
+			writeJSON(w, http.StatusBadRequest, ProtocolResponse{Status: "error", Message: "Missing file name"})
+			return
+		}
+		name, err := incomingName(name)
+		if err != nil {
+			rejectHTTPPath(w, r, l, err)
+			return
+		}
+
+		if err := checkHeader(TransferHeader{Name: name, Size: size}); err != nil {
+			reportRefusedHeader(err, r.RemoteAddr)
+			rejectHTTPPolicy(w, err)
+			return
+		}
+		if err := checkStorage(downloadDirFor(dir), size, r.RemoteAddr); err != nil {
+			rejectHTTPStorage(w, err)
+			return
+		}
+		if size < 0 {
+			// Nothing said how much is coming, so the body stops where
+			// the disk or a quota would
+			body = &storageReader{r: body, allow: allowStorage(downloadDirFor(dir), r.RemoteAddr)}
+		}
+		t := newTransfer("receive", name, "", r.RemoteAddr, size)
+		setScope(t.ID, scopeOf(l.ID))
+		ctx, done := trackJob(t.ID, "transfer", t.Peer)
+		defer done()
+		// Cancelling the job cuts the body off mid-read
+		stop := context.AfterFunc(ctx, func() {
+			t.disablePause(context.Canceled)
+			http.NewResponseController(w).SetReadDeadline(time.Now())
+		})
+		emitEvent("transfer_started", t.Info())
+		err = receiveHTTPBody(t, body, downloadDirFor(dir))
+		stop()
+		err = canceled(ctx, err)
+		t.finish(err)
+		var pe *PathError
+		if errors.As(err, &pe) {
+			rejectHTTPPath(w, r, l, err)
+			return
+		}
+		var pol *PolicyError
+		if errors.As(err, &pol) {
+			rejectHTTPPolicy(w, err)
+			return
+		}
+		var se *StorageError
+		if errors.As(err, &se) {
+			rejectHTTPStorage(w, err)
+			return
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, ProtocolResponse{Status: "error", Message: err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusCreated, ProtocolResponse{Status: "ok", Data: t.Info()})
+	}
+}
+
+// rejectHTTPPath answers an upload whose name was refused
+func rejectHTTPPath(w http.ResponseWriter, r *http.Request, l *Listener, err error) {
+	var pe *PathError
+	errors.As(err, &pe)
+	rejectedPath(l.Addr, r.RemoteAddr, pe)
+	writeJSON(w, http.StatusBadRequest, ProtocolResponse{
+		Status:  "error",
+		Message: pe.Error(),
+		Data:    map[string]interface{}{"rejected": pe.Path, "reason": pe.Reason},
+	})
+}
+
+// rejectHTTPPolicy answers an upload the receive policy refused
+func rejectHTTPPolicy(w http.ResponseWriter, err error) {
+	var pe *PolicyError
+	errors.As(err, &pe)
+	writeJSON(w, http.StatusForbidden, ProtocolResponse{
+		Status:  "error",
+		Message: pe.Error(),
+		Data:    map[string]interface{}{"rule": pe.Rule, "detail": pe.Detail},
+	})
+}
+
+// rejectHTTPStorage answers an upload the disk or a quota has no room for
+func rejectHTTPStorage(w http.ResponseWriter, err error) {
+	var se *StorageError
+	errors.As(err, &se)
+	writeJSON(w, http.StatusInsufficientStorage, ProtocolResponse{
+		Status:  "error",
+		Message: se.Error(),
+		Data:    map[string]interface{}{"storage": se.Reason, "needed": se.Needed, "available": se.Available},
+	})
+}
+
+func nextFilePart(reader *multipart.Reader) (*multipart.Part, error) {
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			return nil, errors.New("multipart body has no file field")
+		}
+		if part.FormName() == "file" && part.FileName() != "" {
+			return part, nil
+		}
+		part.Close()
+	}
+}
+
+// receiveHTTPBody stores an upload of possibly unknown length
+func receiveHTTPBody(t *Transfer, body io.Reader, dir string) error {
+	if t.Size >= 0 {
+		return receiveFile(t, body, dir)
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	target, err := safeJoin(dir, t.Name)
+	if err == nil {
+		target, err = uniquePath(target)
+	}
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	t.Path = target
+	t.mu.Unlock()
+
+	partial := target + ".part"
+	f, err := os.Create(partial)
+	if err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	go t.reportProgress(done)
+	body = &sizeReader{r: body, p: config.Get().ReceivePolicy, name: t.Name}
+	_, err = io.CopyBuffer(progressWriter{w: f, t: t}, body, make([]byte, transferBufferSize))
+	close(done)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(partial)
+		reportRefusedHeader(err, t.Peer)
+		return err
+	}
+	return finalizeReceived(t, partial, target)
+}
+
+// httpDownload lists dir at the root and serves individual files below it
+func httpDownload(dir string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			writeJSON(w, http.StatusMethodNotAllowed, ProtocolResponse{Status: "error", Message: "Use GET"})
+			return
+		}
+
+		dir := downloadDirFor(dir)
+		name := path.Clean("/" + r.URL.Path)
+		if name == "/" {
+			listDownloads(w, dir)
+			return
+		}
+
+		// Only plain files directly inside dir are served
+		name = path.Base(name)
+		if isPartialName(name) {
+			http.NotFound(w, r)
+			return
+		}
+		target := filepath.Join(dir, name)
+		if checkWithin(dir, target) != nil {
+			http.NotFound(w, r)
+			return
+		}
+		f, err := os.Open(target)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil || !info.Mode().IsRegular() {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+		http.ServeContent(w, r, name, info.ModTime(), f)
+		logger.Info("served http download", "name", name, "remote", r.RemoteAddr)
+	})
+}
+
+func listDownloads(w http.ResponseWriter, dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		writeJSON(w, http.StatusInternalServerError, ProtocolResponse{Status: "error", Message: "Cannot read directory"})
+		return
+	}
+
+	files := []map[string]interface{}{}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() || isPartialName(entry.Name()) {
+			continue
+		}
+		files = append(files, map[string]interface{}{
+			"name":     entry.Name(),
+			"size":     info.Size(),
+			"modified": info.ModTime(),
+		})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i]["name"].(string) < files[j]["name"].(string) })
+
+	writeJSON(w, http.StatusOK, ProtocolResponse{Status: "ok", Data: map[string]interface{}{"files": files}})
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateHTTPOptionsRefusesBadRoutes(t *testing.T) {
+	for _, opts := range []HTTPOptions{
+		{Routes: map[string]string{"status": "/a b"}},
+		{Routes: map[string]string{"status": "/{id}"}},
+		{Routes: map[string]string{"status": "/s?x=1"}},
+		{Routes: map[string]string{"status": "/upload"}},
+		{Prefix: "GET /api"},
+	} {
+		if err := validateHTTPOptions(opts); err == nil {
+			t.Errorf("%+v accepted", opts)
+		}
+	}
+	if err := validateHTTPOptions(HTTPOptions{Prefix: "/api", Routes: map[string]string{"download": "files"}}); err != nil {
+		t.Errorf("plain routes refused: %v", err)
+	}
+}
+
+func TestStartServerRefusesBadWebSocketPath(t *testing.T) {
+	var buf bytes.Buffer
+	handleStartServer(json.RawMessage(`{"host":"127.0.0.1","port":0,"type":"ws","path":"/a b"}`), NewOutput(&buf))
+	var resp ProtocolResponse
+	if err := json.Unmarshal(buf.Bytes(), &resp); err != nil || resp.Status != "error" {
+		t.Errorf("got %s", buf.String())
+	}
+}
+
+func TestUploadOfUnknownSizeStopsAtQuota(t *testing.T) {
+	config.mu.Lock()
+	saved := config.cfg
+	config.cfg.Storage = StorageConfig{QuotaBytes: 1000}
+	config.mu.Unlock()
+	t.Cleanup(func() {
+		config.mu.Lock()
+		config.cfg = saved
+		config.mu.Unlock()
+	})
+
+	// Chunked, so the quota check up front sees no size at all
+	dir := t.TempDir()
+	body := strings.NewReader(strings.Repeat("x", 4000))
+	req := httptest.NewRequest(http.MethodPost, "/upload?name=big.bin", body)
+	req.ContentLength = -1
+	rec := httptest.NewRecorder()
+	httpUpload(&Listener{}, dir)(rec, req)
+
+	if rec.Code != http.StatusInsufficientStorage {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+	}
+	var resp ProtocolResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := resp.Data.(map[string]interface{}); data["storage"] != storageQuota {
+		t.Errorf("got %s", rec.Body.String())
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("left %d files behind", len(entries))
+	}
+}
+
+func TestUploadOfUnknownSizeStopsAtMaxFileBytes(t *testing.T) {
+	config.mu.Lock()
+	saved := config.cfg
+	config.cfg.ReceivePolicy = ReceivePolicy{MaxFileBytes: 1000}
+	config.mu.Unlock()
+	t.Cleanup(func() {
+		config.mu.Lock()
+		config.cfg = saved
+		config.mu.Unlock()
+	})
+
+	dir := t.TempDir()
+	req := httptest.NewRequest(http.MethodPost, "/upload?name=big.bin", strings.NewReader(strings.Repeat("x", 4000)))
+	req.ContentLength = -1
+	rec := httptest.NewRecorder()
+	httpUpload(&Listener{}, dir)(rec, req)
+
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+	}
+	var resp ProtocolResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := resp.Data.(map[string]interface{}); data["rule"] != ruleSize {
+		t.Errorf("got %s", rec.Body.String())
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("left %d files behind", len(entries))
+	}
+}
+
+func TestUploadIsCancelableJob(t *testing.T) {
+	srv := httptest.NewServer(httpUpload(&Listener{}, t.TempDir()))
+	defer srv.Close()
+
+	// The client sends a little and then stalls, as a slow one would
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	go pw.Write([]byte("partial"))
+	answered := make(chan *http.Response, 1)
+	go func() {
+		resp, err := http.Post(srv.URL+"/upload?name=slow.bin", "application/octet-stream", pr)
+		if err != nil {
+			answered <- nil
+			return
+		}
+		answered <- resp
+	}()
+
+	var id string
+	deadline := time.Now().Add(5 * time.Second)
+	for id == "" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		jobsMu.Lock()
+		for _, j := range jobs {
+			if j.Kind == "transfer" {
+				id = j.ID
+			}
+		}
+		jobsMu.Unlock()
+	}
+	if id == "" {
+		t.Fatal("upload never showed up as a job")
+	}
+	if _, ok := cancelJob(id); !ok {
+		t.Fatal("cancel found no job")
+	}
+
+	select {
+	case resp := <-answered:
+		if resp != nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusCreated {
+				t.Error("canceled upload was stored")
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("canceled upload kept reading")
+	}
+	jobsMu.Lock()
+	_, running := jobs[id]
+	jobsMu.Unlock()
+	if running {
+		t.Error("job outlived its upload")
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net"
+)
+
+// InterfaceAddr is one address assigned to a network interface
+type InterfaceAddr struct {
+	IP     string `json:"ip"`
+	CIDR   string `json:"cidr"`
+	Family string `json:"family"` // "ipv4", "ipv6"
+}
+
+// InterfaceInfo describes a NIC the user can bind listeners to
+type InterfaceInfo struct {
+	Name         string          `json:"name"`
+	Index        int             `json:"index"`
+	MTU          int             `json:"mtu"`
+	HardwareAddr string          `json:"hardware_addr"`
+	Up           bool            `json:"up"`
+	Loopback     bool            `json:"loopback"`
+	Multicast    bool            `json:"multicast"`
+	Addresses    []InterfaceAddr `json:"addresses"`
+}
+
+func listInterfaces() ([]InterfaceInfo, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]InterfaceInfo, 0, len(ifaces))
+	for _, iface := range ifaces {
+		info := InterfaceInfo{
+			Name:         iface.Name,
+			Index:        iface.Index,
+			MTU:          iface.MTU,
+			HardwareAddr: iface.HardwareAddr.String(),
+			Up:           iface.Flags&net.FlagUp != 0,
+			Loopback:     iface.Flags&net.FlagLoopback != 0,
+			Multicast:    iface.Flags&net.FlagMulticast != 0,
+			Addresses:    []InterfaceAddr{},
+		}
+
+		// Some virtual adapters refuse to report addresses; list them anyway
+		addrs, _ := iface.Addrs()
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			family := "ipv6"
+			if ipnet.IP.To4() != nil {
+				family = "ipv4"
+			}
+			info.Addresses = append(info.Addresses, InterfaceAddr{
+				IP:     ipnet.IP.String(),
+				CIDR:   ipnet.String(),
+				Family: family,
+			})
+		}
+		list = append(list, info)
+	}
+	return list, nil
+}
+
+func handleListInterfaces(writer *Output) {
+	ifaces, err := listInterfaces()
+	if err != nil {
+		sendError(writer, message("interfaces.failed_list_interfaces", "error", err))
+		return
+	}
+
+	writer.Encode(ProtocolResponse{
+		Status: "ok",
+		Data:   map[string]interface{}{"interfaces": ifaces},
+	})
+}
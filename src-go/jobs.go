@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Long-running commands (transfers, speed tests, syncs, diagnostics) answer
+// straight away with an ID and report through events. Each runs as a job
+// whose context is canceled by the cancel command or at shutdown; the job
+// closes its connections when that happens.
+type Job struct {
+	ID      string    `json:"id"`
+	Kind    string    `json:"kind"` // "transfer", "speedtest", "sync", "ping", "traceroute", "scan"
+	Target  string    `json:"target"`
+	Started time.Time `json:"started"`
+
+	cancel context.CancelFunc
+}
+
+var (
+	diagnosticSeq atomic.Uint64
+	jobsMu        sync.Mutex
+	jobs          = make(map[string]*Job)
+)
+
+// trackJob registers a job under an ID its command already handed out.
+// The returned function must be called when the job ends.
+func trackJob(id, kind, target string) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	j := &Job{ID: id, Kind: kind, Target: target, Started: time.Now(), cancel: cancel}
+	jobsMu.Lock()
+	jobs[id] = j
+	jobsMu.Unlock()
+
+	return ctx, func() {
+		cancel()
+		jobsMu.Lock()
+		if jobs[id] == j {
+			delete(jobs, id)
+		}
+		jobsMu.Unlock()
+	}
+}
+
+// startDiagnostic starts run in the background as a job with a new ID
+func startDiagnostic(kind, target string, run func(ctx context.Context, id string)) string {
+	id := fmt.Sprintf("%s-%d", kind, diagnosticSeq.Add(1))
+	ctx, done := trackJob(id, kind, target)
+	go func() {
+		defer recoverPanic("job " + id)
+		defer done()
+		run(ctx, id)
+	}()
+	return id
+}
+
+func isDiagnostic(kind string) bool {
+	return kind != "transfer" && kind != "speedtest" && kind != "sync"
+}
+
+// cancelJob cancels a running job, reporting whether there was one
+func cancelJob(id string) (Job, bool) {
+	jobsMu.Lock()
+	j, exists := jobs[id]
+	jobsMu.Unlock()
+	if !exists {
+		return Job{}, false
+	}
+	j.cancel()
+	return *j, true
+}
+
+// canceled turns the error a job's aborted connection produced into
+// context.Canceled once the job was canceled
+func canceled(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+type CancelPayload struct {
+	ID string `json:"id" required:"true"`
+}
+
+// handleCancel aborts a job of any kind. Queued sends that have not
+// started are dropped from the queue; started ones cancel their transfer.
+func handleCancel(payload json.RawMessage, writer *Output) {
+	var p CancelPayload
+	if err := json.Unmarshal(payload, &p); err != nil || p.ID == "" {
+		sendErrorCode(writer, ErrInvalidArgument, message("jobs.cancel_requires_id"), nil)
+		return
+	}
+	if !inScope(p.ID, writer) {
+		sendErrorCode(writer, ErrNotRunning, message("jobs.job_not_running", "id", p.ID), nil)
+		return
+	}
+	id := p.ID
+	if j, transfer, found := transferQueue.cancelWaiting(id); found {
+		if j != nil {
+			writer.Encode(okResponse(message("common.job_canceled"), *j))
+			return
+		}
+		id = transfer
+	}
+	j, ok := cancelJob(id)
+	if !ok {
+		sendErrorCode(writer, ErrNotRunning, message("jobs.job_not_running", "id", p.ID), nil)
+		return
+	}
+	logger.Info("job canceled", "id", j.ID, "kind", j.Kind)
+	writer.Encode(okResponse(message("jobs.canceling_id", "id", j.ID), j))
+}
+
+type ListJobsPayload struct {
+	Kind string `json:"kind"` // only jobs of this kind
+}
+
+func handleListJobs(payload json.RawMessage, writer *Output) {
+	var p ListJobsPayload
+	if len(payload) > 0 && string(payload) != "null" {
+		if err := json.Unmarshal(payload, &p); err != nil {
+			sendInvalidPayload(writer, "list_jobs")
+			return
+		}
+	}
+	list := listJobs(func(j *Job) bool { return (p.Kind == "" || j.Kind == p.Kind) && inScope(j.ID, writer) })
+	writer.Encode(ProtocolResponse{Status: "ok", Data: map[string]interface{}{"jobs": list}})
+}
+
+func listJobs(keep func(*Job) bool) []Job {
+	jobsMu.Lock()
+	list := make([]Job, 0, len(jobs))
+	for _, j := range jobs {
+		if keep(j) {
+			list = append(list, *j)
+		}
+	}
+	jobsMu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Started.Before(list[j].Started) })
+	return list
+}
+
+type CancelDiagnosticPayload struct {
+	ID string `json:"id"`
+}
+
+func handleCancelDiagnostic(payload json.RawMessage, writer *Output) {
+	var p CancelDiagnosticPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		sendInvalidPayload(writer, "cancel_diagnostic")
+		return
+	}
+	jobsMu.Lock()
+	j, exists := jobs[p.ID]
+	jobsMu.Unlock()
+	if !exists || !isDiagnostic(j.Kind) {
+		sendErrorCode(writer, ErrNotRunning, message("jobs.diagnostic_not_running", "id", p.ID), nil)
+		return
+	}
+	j.cancel()
+	writer.Encode(okResponse(message("jobs.canceling_id", "id", p.ID), nil))
+}
+
+func handleListDiagnostics(writer *Output) {
+	list := listJobs(func(j *Job) bool { return isDiagnostic(j.Kind) })
+	writer.Encode(ProtocolResponse{Status: "ok", Data: map[string]interface{}{"running": list}})
+}
+
+// cancelAllJobs stops every job; shutdown uses it
+func cancelAllJobs() {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	for _, j := range jobs {
+		j.cancel()
+	}
+}
+
+// sleepCtx waits for d or until ctx is done, reporting whether to go on
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
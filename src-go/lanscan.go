@@ -0,0 +1,636 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// scan_lan takes an inventory of the local network. Every address of the
+// target is probed, with an ICMP echo when the platform permits one and
+// TCP handshakes otherwise; either makes the kernel resolve the address,
+// so afterwards the neighbor table (/proc/net/arp on Linux, arp -a
+// elsewhere) also names hosts that ignored the probes. MACs are matched
+// against a short built-in vendor list, or a full one given as oui_file,
+// and names come from reverse DNS.
+const (
+	defaultLANConcurrency = 64
+	maxLANConcurrency     = 256
+	defaultLANTimeout     = time.Second
+	maxLANHosts           = 4096
+	maxLANSubnetBits      = 10 // default subnets wider than a /22 shrink to the /24 around us
+	lanLookupTimeout      = time.Second
+	neighborRefresh       = 500 * time.Millisecond
+)
+
+// defaultLANPorts answer, or refuse, on most machines that drop pings
+var defaultLANPorts = []int{22, 80, 139, 443, 445, 8080, 62078}
+
+// builtinOUI names vendors whose prefixes say something useful about the
+// device; oui_file covers the rest
+var builtinOUI = map[string]string{
+	"B827EB": "Raspberry Pi Foundation",
+	"DCA632": "Raspberry Pi Trading",
+	"E45F01": "Raspberry Pi Trading",
+	"28CDC1": "Raspberry Pi Trading",
+	"000C29": "VMware",
+	"005056": "VMware",
+	"000569": "VMware",
+	"080027": "Oracle VirtualBox",
+	"00163E": "Xen",
+	"00155D": "Microsoft Hyper-V",
+	"525400": "QEMU/KVM",
+	"000393": "Apple",
+	"000A95": "Apple",
+	"18FE34": "Espressif",
+	"240AC4": "Espressif",
+	"30AEA4": "Espressif",
+	"001788": "Philips Hue",
+	"001132": "Synology",
+	"00044B": "NVIDIA",
+	"000DB9": "PC Engines",
+	"00000C": "Cisco",
+	"001B21": "Intel",
+	"0418D6": "Ubiquiti",
+	"24A43C": "Ubiquiti",
+	"F09FC2": "Ubiquiti",
+}
+
+// Neighbor is an entry of the operating system's ARP table
+type Neighbor struct {
+	IP     string
+	MAC    net.HardwareAddr
+	Device string // interface name, or its address on Windows
+}
+
+// normalizeMAC pads the single-digit octets BSD's arp prints, as in 0:1b:2:..
+func normalizeMAC(s string) (net.HardwareAddr, error) {
+	sep := ":"
+	if strings.Contains(s, "-") {
+		sep = "-"
+	}
+	parts := strings.Split(s, sep)
+	for i, part := range parts {
+		if len(part) == 1 {
+			parts[i] = "0" + part
+		}
+	}
+	return net.ParseMAC(strings.Join(parts, ":"))
+}
+
+// usableMAC leaves out the broadcast and multicast entries tables carry
+func usableMAC(mac net.HardwareAddr) bool {
+	if len(mac) != 6 || mac[0]&1 != 0 {
+		return false
+	}
+	for _, b := range mac {
+		if b != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// parseProcARP reads Linux's /proc/net/arp. Flags 0x0 marks an address
+// the kernel asked for and nobody answered.
+func parseProcARP(r io.Reader) []Neighbor {
+	var list []Neighbor
+	sc := bufio.NewScanner(r)
+	sc.Scan() // column titles
+	for sc.Scan() {
+		f := strings.Fields(sc.Text())
+		if len(f) < 6 || f[2] == "0x0" {
+			continue
+		}
+		mac, err := net.ParseMAC(f[3])
+		if err != nil || !usableMAC(mac) {
+			continue
+		}
+		list = append(list, Neighbor{IP: f[0], MAC: mac, Device: f[5]})
+	}
+	return list
+}
+
+// parseBSDARP reads `arp -an` on macOS and the BSDs:
+// ? (192.168.1.1) at 0:11:22:33:44:55 on en0 ifscope [ethernet]
+func parseBSDARP(r io.Reader) []Neighbor {
+	var list []Neighbor
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		f := strings.Fields(sc.Text())
+		if len(f) < 4 || f[2] != "at" {
+			continue
+		}
+		mac, err := normalizeMAC(f[3])
+		if err != nil || !usableMAC(mac) {
+			continue
+		}
+		n := Neighbor{IP: strings.Trim(f[1], "()"), MAC: mac}
+		if len(f) >= 6 && f[4] == "on" {
+			n.Device = f[5]
+		}
+		list = append(list, n)
+	}
+	return list
+}
+
+// parseWindowsARP reads `arp -a`, whose entries sit under a line naming
+// the interface by address:
+// Interface: 192.168.1.5 --- 0xb
+//
+//	192.168.1.1           aa-bb-cc-dd-ee-ff     dynamic
+func parseWindowsARP(r io.Reader) []Neighbor {
+	var list []Neighbor
+	device := ""
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		f := strings.Fields(sc.Text())
+		if len(f) >= 2 && strings.HasSuffix(f[0], ":") {
+			device = f[1]
+			continue
+		}
+		if len(f) < 3 || net.ParseIP(f[0]) == nil {
+			continue
+		}
+		mac, err := normalizeMAC(f[1])
+		if err != nil || !usableMAC(mac) {
+			continue
+		}
+		list = append(list, Neighbor{IP: f[0], MAC: mac, Device: device})
+	}
+	return list
+}
+
+// readNeighbors returns the ARP table and where it came from
+func readNeighbors(ctx context.Context) ([]Neighbor, string, error) {
+	if runtime.GOOS == "linux" {
+		f, err := os.Open("/proc/net/arp")
+		if err != nil {
+			return nil, "", err
+		}
+		defer f.Close()
+		return parseProcARP(f), "/proc/net/arp", nil
+	}
+	args, parse := []string{"-an"}, parseBSDARP
+	if runtime.GOOS == "windows" {
+		args, parse = []string{"-a"}, parseWindowsARP
+	}
+	out, err := exec.CommandContext(ctx, "arp", args...).Output()
+	if err != nil {
+		return nil, "", fmt.Errorf("arp %s: %v", strings.Join(args, " "), err)
+	}
+	return parse(strings.NewReader(string(out))), "arp " + strings.Join(args, " "), nil
+}
+
+// loadOUI reads a vendor list in Wireshark's manuf format or the IEEE's
+// oui.txt. Only 24-bit prefixes are kept.
+func loadOUI(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	vendors := make(map[string]string)
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		var prefix, vendor string
+		if p, rest, ok := strings.Cut(line, "(hex)"); ok {
+			// oui.txt: 00-00-0C   (hex)		Cisco Systems, Inc
+			prefix, vendor = strings.TrimSpace(p), strings.TrimSpace(rest)
+		} else {
+			// manuf: 00:00:0C	Cisco	Cisco Systems, Inc
+			f := strings.Split(line, "\t")
+			if len(f) < 2 {
+				continue
+			}
+			prefix, vendor = f[0], strings.TrimSpace(f[len(f)-1])
+		}
+		prefix = strings.ToUpper(strings.NewReplacer(":", "", "-", "", ".", "").Replace(prefix))
+		if len(prefix) == 6 && vendor != "" {
+			vendors[prefix] = vendor
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return vendors, nil
+}
+
+// macVendor looks the prefix of mac up in extra, then the built-in list
+func macVendor(mac net.HardwareAddr, extra map[string]string) string {
+	if len(mac) < 3 {
+		return ""
+	}
+	key := fmt.Sprintf("%02X%02X%02X", mac[0], mac[1], mac[2])
+	if v, ok := extra[key]; ok {
+		return v
+	}
+	return builtinOUI[key]
+}
+
+// localSubnets lists the IPv4 blocks of interfaces that are up, or of the
+// one named, along with our own addresses in them
+func localSubnets(name string) ([]netip.Prefix, map[string]bool, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, nil, err
+	}
+	var blocks []netip.Prefix
+	own := make(map[string]bool)
+	found := false
+	for _, ifi := range ifaces {
+		if name != "" && ifi.Name != name {
+			continue
+		}
+		found = true
+		if ifi.Flags&net.FlagUp == 0 || ifi.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, _ := ifi.Addrs()
+		for _, a := range addrs {
+			ipnet, ok := a.(*net.IPNet)
+			if !ok || ipnet.IP.To4() == nil {
+				continue
+			}
+			ip, _ := netip.AddrFromSlice(ipnet.IP.To4())
+			own[ip.String()] = true
+			ones, _ := ipnet.Mask.Size()
+			if 32-ones > maxLANSubnetBits {
+				ones = 24
+			}
+			if ones >= 31 {
+				continue
+			}
+			blocks = append(blocks, netip.PrefixFrom(ip, ones).Masked())
+		}
+	}
+	if name != "" && !found {
+		return nil, nil, fmt.Errorf("unknown interface %s", name)
+	}
+	return blocks, own, nil
+}
+
+// LANHost is a device found by scan_lan
+type LANHost struct {
+	IP        string  `json:"ip"`
+	MAC       string  `json:"mac,omitempty"`
+	Vendor    string  `json:"vendor,omitempty"`
+	RandomMAC bool    `json:"random_mac,omitempty"` // locally administered, as phones use for privacy
+	Hostname  string  `json:"hostname,omitempty"`
+	Interface string  `json:"interface,omitempty"`
+	Method    string  `json:"method"` // "icmp", "tcp", "arp"
+	RTTMs     float64 `json:"rtt_ms,omitempty"`
+	Peer      string  `json:"peer,omitempty"` // instance name when it is a Lumina peer
+}
+
+// lanProbeSeq numbers the echo requests of concurrent probes, which share
+// an ID, so one target's reply is not taken for another's
+var lanProbeSeq atomic.Uint32
+
+// lanProbe finds out whether ip answers, by ICMP echo or by a TCP
+// handshake on one of ports; a refused connection counts
+func lanProbe(ctx context.Context, ip string, ports []int, timeout time.Duration) (string, time.Duration, bool) {
+	target := &net.IPAddr{IP: net.ParseIP(ip)}
+	if s, err := openICMP(target, false); err == nil {
+		seq := int(lanProbeSeq.Add(1) & 0xffff)
+		rtt, _, err := icmpProbe(s, os.Getpid()&0xffff, 16)(seq, timeout)
+		s.conn.Close()
+		if err == nil {
+			return "icmp", rtt, true
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	answered := make(chan time.Duration, len(ports))
+	var wg sync.WaitGroup
+	for _, port := range ports {
+		wg.Add(1)
+		go func() {
+			defer recoverPanic("lan probe of " + ip)
+			defer wg.Done()
+			dialer := net.Dialer{}
+			start := time.Now()
+			conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip, strconv.Itoa(port)))
+			if err == nil {
+				conn.Close()
+			}
+			if err == nil || isRefused(err) {
+				answered <- time.Since(start)
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(answered)
+	}()
+	if rtt, ok := <-answered; ok {
+		return "tcp", rtt, true
+	}
+	return "", 0, false
+}
+
+// lanPeers maps the addresses of discovered Lumina peers to their names
+func lanPeers() map[string]string {
+	discovery.Mutex.Lock()
+	defer discovery.Mutex.Unlock()
+	peers := make(map[string]string)
+	for _, p := range discovery.Peers {
+		for _, ip := range p.IPv4 {
+			peers[ip] = p.Instance
+		}
+	}
+	return peers
+}
+
+// neighborCache rereads the ARP table at most every neighborRefresh
+type neighborCache struct {
+	mu     sync.Mutex
+	read   time.Time
+	byIP   map[string]Neighbor
+	source string
+	err    error
+}
+
+func (c *neighborCache) lookup(ctx context.Context, ip string, fresh bool) (Neighbor, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if fresh || time.Since(c.read) >= neighborRefresh {
+		list, source, err := readNeighbors(ctx)
+		c.read, c.source, c.err = time.Now(), source, err
+		if err == nil {
+			c.byIP = make(map[string]Neighbor, len(list))
+			for _, n := range list {
+				c.byIP[n.IP] = n
+			}
+		}
+	}
+	n, ok := c.byIP[ip]
+	return n, ok
+}
+
+type ScanLANPayload struct {
+	Target      string `json:"target"`      // CIDR block; by default the subnets of our interfaces
+	Interface   string `json:"interface"`   // only this interface's subnets and neighbors
+	Ports       string `json:"ports"`       // TCP ports probed when ICMP is unavailable or unanswered
+	Concurrency int    `json:"concurrency"` // hosts probed at once, default 64
+	TimeoutMs   int    `json:"timeout_ms"`  // per host, default 1000
+	OUIFile     string `json:"oui_file"`    // Wireshark manuf or IEEE oui.txt for vendor names
+	NoResolve   bool   `json:"no_resolve"`  // skip reverse DNS
+}
+
+// handleScanLAN starts an inventory. Devices arrive as lan_host_found
+// events, with lan_scan_progress about once a second and
+// lan_scan_completed at the end.
+func handleScanLAN(payload json.RawMessage, writer *Output) {
+	var p ScanLANPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		sendInvalidPayload(writer, "scan_lan")
+		return
+	}
+	ports := defaultLANPorts
+	if p.Ports != "" {
+		var err error
+		if ports, err = parsePortList(p.Ports); err != nil {
+			sendFailure(writer, err)
+			return
+		}
+		if len(ports) > 32 {
+			sendErrorCode(writer, ErrInvalidArgument, message("lanscan.ports_must_list_most"), nil)
+			return
+		}
+	}
+	if p.Concurrency <= 0 {
+		p.Concurrency = defaultLANConcurrency
+	}
+	if p.Concurrency > maxLANConcurrency {
+		sendErrorCode(writer, ErrInvalidArgument, message("common.concurrency_must_most", "max_lan_concurrency", maxLANConcurrency), nil)
+		return
+	}
+	timeout := defaultLANTimeout
+	if p.TimeoutMs > 0 {
+		timeout = time.Duration(p.TimeoutMs) * time.Millisecond
+	}
+	var vendors map[string]string
+	if p.OUIFile != "" {
+		var err error
+		if vendors, err = loadOUI(p.OUIFile); err != nil {
+			sendError(writer, message("lanscan.failed_read_oui_file", "error", err))
+			return
+		}
+	}
+
+	blocks, own, err := localSubnets(p.Interface)
+	if err != nil {
+		sendFailure(writer, err)
+		return
+	}
+	if p.Target != "" {
+		prefix, err := netip.ParsePrefix(p.Target)
+		if err != nil || !prefix.Addr().Is4() {
+			sendErrorCode(writer, ErrInvalidArgument, message("lanscan.invalid_target_scan_lan_takes"), nil)
+			return
+		}
+		blocks = []netip.Prefix{prefix.Masked()}
+	}
+	if len(blocks) == 0 {
+		sendErrorCode(writer, ErrInvalidState, message("lanscan.no_ipv4_subnet_scan"), nil)
+		return
+	}
+	var hosts, targets []string
+	seen := make(map[string]bool)
+	for _, b := range blocks {
+		list, err := scanHosts(b.String(), maxLANHosts-len(hosts))
+		if err != nil {
+			sendErrorCode(writer, ErrInvalidArgument, message("lanscan.invalid_target_scan_lan", "max_lan_hosts", maxLANHosts), nil)
+			return
+		}
+		targets = append(targets, b.String())
+		for _, h := range list {
+			if !seen[h] && !own[h] {
+				seen[h] = true
+				hosts = append(hosts, h)
+			}
+		}
+	}
+
+	id := startDiagnostic("lan_scan", strings.Join(targets, ","), func(ctx context.Context, id string) {
+		runLANScan(ctx, id, p, targets, hosts, ports, timeout, vendors)
+	})
+	writer.Encode(okResponse(message("lanscan.scanning_addresses", "hosts", len(hosts), "targets", strings.Join(targets, ", ")),
+		map[string]interface{}{"id": id, "targets": targets, "total": len(hosts)}))
+}
+
+func runLANScan(ctx context.Context, id string, p ScanLANPayload, targets, hosts []string, ports []int, timeout time.Duration, vendors map[string]string) {
+	start := time.Now()
+	cache := &neighborCache{}
+	peers := lanPeers()
+	var mu sync.Mutex
+	found := make(map[string]*LANHost)
+
+	// report fills in what the ARP table and DNS know and emits the host,
+	// unless it is on another interface than the one asked for
+	report := func(h *LANHost, n Neighbor, known bool) {
+		if known {
+			if p.Interface != "" && n.Device != "" && n.Device != p.Interface && !localAddrOf(p.Interface, n.Device) {
+				return
+			}
+			h.MAC, h.Interface = n.MAC.String(), n.Device
+			h.Vendor = macVendor(n.MAC, vendors)
+			h.RandomMAC = n.MAC[0]&2 != 0
+		}
+		if !p.NoResolve {
+			rctx, cancel := context.WithTimeout(ctx, lanLookupTimeout)
+			if names, err := net.DefaultResolver.LookupAddr(rctx, h.IP); err == nil && len(names) > 0 {
+				h.Hostname = strings.TrimSuffix(names[0], ".")
+			}
+			cancel()
+		}
+		h.Peer = peers[h.IP]
+		mu.Lock()
+		found[h.IP] = h
+		mu.Unlock()
+		emitEvent("lan_host_found", map[string]interface{}{"id": id, "host": h})
+	}
+
+	probes := make(chan string)
+	go func() {
+		defer close(probes)
+		for _, ip := range hosts {
+			select {
+			case probes <- ip:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	var done atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < p.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer recoverPanic("lan scan " + id)
+			defer wg.Done()
+			for ip := range probes {
+				method, rtt, alive := lanProbe(ctx, ip, ports, timeout)
+				if ctx.Err() != nil {
+					return
+				}
+				done.Add(1)
+				if alive {
+					n, known := cache.lookup(ctx, ip, false)
+					report(&LANHost{IP: ip, Method: method, RTTMs: millis(rtt)}, n, known)
+				}
+			}
+		}()
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+	ticker := time.NewTicker(scanProgressInterval)
+	defer ticker.Stop()
+	for running := true; running; {
+		select {
+		case <-finished:
+			running = false
+		case <-ticker.C:
+			mu.Lock()
+			n := len(found)
+			mu.Unlock()
+			emitEvent("lan_scan_progress", map[string]interface{}{
+				"id": id, "probed": done.Load(), "total": len(hosts), "found": n,
+			})
+		}
+	}
+
+	// Hosts that ignored every probe still had to answer ARP
+	if ctx.Err() == nil {
+		inTarget := make(map[string]bool, len(hosts))
+		for _, ip := range hosts {
+			inTarget[ip] = true
+		}
+		cache.lookup(ctx, "", true)
+		var silent []Neighbor
+		mu.Lock()
+		for ip, n := range cache.byIP {
+			if inTarget[ip] && found[ip] == nil {
+				silent = append(silent, n)
+			}
+		}
+		for ip, h := range found {
+			if n, ok := cache.byIP[ip]; ok && h.MAC == "" {
+				h.MAC, h.Interface = n.MAC.String(), n.Device
+				h.Vendor = macVendor(n.MAC, vendors)
+				h.RandomMAC = n.MAC[0]&2 != 0
+			}
+		}
+		mu.Unlock()
+		for _, n := range silent {
+			report(&LANHost{IP: n.IP, Method: "arp"}, n, true)
+		}
+	}
+	if cache.err != nil {
+		logger.Warn("neighbor table unavailable", "id", id, "error", cache.err)
+	}
+
+	list := make([]*LANHost, 0, len(found))
+	for _, h := range found {
+		list = append(list, h)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		a, _ := netip.ParseAddr(list[i].IP)
+		b, _ := netip.ParseAddr(list[j].IP)
+		return a.Less(b)
+	})
+	logger.Info("lan scan finished", "id", id, "targets", targets, "probed", done.Load(), "found", len(list))
+	data := map[string]interface{}{
+		"id":               id,
+		"targets":          targets,
+		"probed":           done.Load(),
+		"total":            len(hosts),
+		"hosts":            list,
+		"neighbor_table":   cache.source,
+		"duration_seconds": time.Since(start).Seconds(),
+		"canceled":         ctx.Err() != nil,
+	}
+	if cache.err != nil {
+		data["neighbor_error"] = cache.err.Error()
+	}
+	emitEvent("lan_scan_completed", data)
+}
+
+// localAddrOf reports whether addr belongs to interface name, which is
+// how Windows' arp names interfaces
+func localAddrOf(name, addr string) bool {
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		return false
+	}
+	addrs, _ := ifi.Addrs()
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.String() == addr {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseNeighborTables(t *testing.T) {
+	tests := []struct {
+		name  string
+		parse func(io.Reader) []Neighbor
+		input string
+		want  []Neighbor
+	}{
+		{
+			"linux",
+			parseProcARP,
+			"IP address       HW type     Flags       HW address            Mask     Device\n" +
+				"192.168.1.1      0x1         0x2         aa:bb:cc:dd:ee:01     *        eth0\n" +
+				"192.168.1.9      0x1         0x0         00:00:00:00:00:00     *        eth0\n" +
+				"10.0.0.7         0x1         0x2         b8:27:eb:00:00:02     *        wlan0\n",
+			[]Neighbor{
+				{IP: "192.168.1.1", MAC: mustMAC("aa:bb:cc:dd:ee:01"), Device: "eth0"},
+				{IP: "10.0.0.7", MAC: mustMAC("b8:27:eb:00:00:02"), Device: "wlan0"},
+			},
+		},
+		{
+			"bsd",
+			parseBSDARP,
+			"? (192.168.1.1) at 0:11:22:3:44:55 on en0 ifscope [ethernet]\n" +
+				"? (192.168.1.8) at (incomplete) on en0 ifscope [ethernet]\n" +
+				"? (192.168.1.255) at ff:ff:ff:ff:ff:ff on en0 ifscope [ethernet]\n" +
+				"? (224.0.0.251) at 1:0:5e:0:0:fb on en0 ifscope permanent [ethernet]\n",
+			[]Neighbor{{IP: "192.168.1.1", MAC: mustMAC("00:11:22:03:44:55"), Device: "en0"}},
+		},
+		{
+			"windows",
+			parseWindowsARP,
+			"\r\nInterface: 192.168.1.5 --- 0xb\r\n" +
+				"  Internet Address      Physical Address      Type\r\n" +
+				"  192.168.1.1           aa-bb-cc-dd-ee-ff     dynamic\r\n" +
+				"  192.168.1.255         ff-ff-ff-ff-ff-ff     static\r\n",
+			[]Neighbor{{IP: "192.168.1.1", MAC: mustMAC("aa:bb:cc:dd:ee:ff"), Device: "192.168.1.5"}},
+		},
+	}
+	for _, tt := range tests {
+		got := tt.parse(strings.NewReader(tt.input))
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i].IP != tt.want[i].IP || got[i].MAC.String() != tt.want[i].MAC.String() || got[i].Device != tt.want[i].Device {
+				t.Errorf("%s: entry %d is %v, want %v", tt.name, i, got[i], tt.want[i])
+			}
+		}
+	}
+}
+
+func TestLoadOUI(t *testing.T) {
+	dir := t.TempDir()
+	manuf := filepath.Join(dir, "manuf")
+	os.WriteFile(manuf, []byte("# comment\n00:00:0C\tCisco\tCisco Systems, Inc\nAC:DE:48\tPrivate\n00:1B:C5:00:00:00/36\tConverge\tConverging Systems\n"), 0o644)
+	vendors, err := loadOUI(manuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vendors["00000C"] != "Cisco Systems, Inc" || vendors["ACDE48"] != "Private" || len(vendors) != 2 {
+		t.Errorf("manuf: %v", vendors)
+	}
+
+	oui := filepath.Join(dir, "oui.txt")
+	os.WriteFile(oui, []byte("00-00-0C   (hex)\t\tCisco Systems, Inc\n00000C     (base 16)\t\tCisco Systems, Inc\n"), 0o644)
+	if vendors, err = loadOUI(oui); err != nil {
+		t.Fatal(err)
+	}
+	if got := macVendor(mustMAC("00:00:0c:12:34:56"), vendors); got != "Cisco Systems, Inc" {
+		t.Errorf("oui.txt: vendor %q", got)
+	}
+	if got := macVendor(mustMAC("b8:27:eb:12:34:56"), vendors); got != "Raspberry Pi Foundation" {
+		t.Errorf("built-in: vendor %q", got)
+	}
+}
+
+func mustMAC(s string) net.HardwareAddr {
+	mac, err := net.ParseMAC(s)
+	if err != nil {
+		panic(err)
+	}
+	return mac
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Peer link latency: mux links, peer session ones included, ping the other
+// side every few seconds and keep a histogram of every round trip plus a
+// window of recent ones to take percentiles over, so a frontend can show
+// how good a link is before starting a big transfer on it
+const latencyWindow = 256 // recent round trips percentiles are taken over
+
+// latencyBuckets are the upper bounds, in milliseconds, of round trip
+// histograms
+var latencyBuckets = []float64{1, 2, 5, 10, 20, 50, 100, 200, 500, 1000, 2000, 5000}
+
+// latencyStats collects one link's round trips
+type latencyStats struct {
+	mu     sync.Mutex
+	hist   *histogram
+	recent [latencyWindow]float64
+	next   int
+	filled int
+	lost   uint64
+	last   float64
+	min    float64
+	max    float64
+}
+
+func (l *latencyStats) observe(rtt time.Duration) {
+	ms := millis(rtt)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.hist == nil {
+		l.hist = newHistogram(latencyBuckets)
+		l.min, l.max = ms, ms
+	}
+	l.hist.observe(ms)
+	l.recent[l.next] = ms
+	l.next = (l.next + 1) % latencyWindow
+	l.filled = min(l.filled+1, latencyWindow)
+	l.last, l.min, l.max = ms, min(l.min, ms), max(l.max, ms)
+}
+
+// miss counts a probe that got no answer in time
+func (l *latencyStats) miss() {
+	l.mu.Lock()
+	l.lost++
+	l.mu.Unlock()
+}
+
+// LatencySummary is a link's round trip statistics; the percentiles cover
+// the most recent round trips, the rest the link's whole life
+type LatencySummary struct {
+	Samples     uint64          `json:"samples"`
+	Lost        uint64          `json:"lost"`
+	LossPercent float64         `json:"loss_percent"`
+	LastMs      float64         `json:"last_ms"`
+	MinMs       float64         `json:"min_ms"`
+	MeanMs      float64         `json:"mean_ms"`
+	MaxMs       float64         `json:"max_ms"`
+	P50Ms       float64         `json:"p50_ms"`
+	P95Ms       float64         `json:"p95_ms"`
+	P99Ms       float64         `json:"p99_ms"`
+	Buckets     []LatencyBucket `json:"buckets,omitempty"`
+}
+
+// LatencyBucket counts the round trips of at most LeMs; the last bucket,
+// with LeMs 0, counts all of them
+type LatencyBucket struct {
+	LeMs  float64 `json:"le_ms"`
+	Count uint64  `json:"count"`
+}
+
+func (l *latencyStats) summary(buckets bool) LatencySummary {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s := LatencySummary{Lost: l.lost}
+	if l.hist == nil {
+		if s.Lost > 0 {
+			s.LossPercent = 100
+		}
+		return s
+	}
+	s.Samples = l.hist.count
+	s.LossPercent = 100 * float64(s.Lost) / float64(s.Samples+s.Lost)
+	s.LastMs, s.MinMs, s.MaxMs = l.last, l.min, l.max
+	s.MeanMs = l.hist.sum / float64(l.hist.count)
+
+	recent := append([]float64(nil), l.recent[:l.filled]...)
+	sort.Float64s(recent)
+	s.P50Ms, s.P95Ms, s.P99Ms = percentile(recent, 50), percentile(recent, 95), percentile(recent, 99)
+	if buckets {
+		for i, bound := range l.hist.bounds {
+			s.Buckets = append(s.Buckets, LatencyBucket{LeMs: bound, Count: l.hist.counts[i]})
+		}
+		s.Buckets = append(s.Buckets, LatencyBucket{Count: l.hist.count})
+	}
+	return s
+}
+
+// percentile picks the nearest-rank p-th percentile of sorted values
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(p/100*float64(len(sorted))+0.999999) - 1
+	return sorted[max(0, min(rank, len(sorted)-1))]
+}
+
+type PeerLatencyPayload struct {
+	ID string `json:"id"` // a mux link; empty for all of them
+}
+
+// PeerLatency is one link's entry in get_peer_latency
+type PeerLatency struct {
+	ID         string         `json:"id"`
+	Direction  string         `json:"direction"`
+	RemoteAddr string         `json:"remote_addr"`
+	Latency    LatencySummary `json:"latency"`
+}
+
+func (m *Mux) latency(buckets bool) PeerLatency {
+	return PeerLatency{ID: m.ID, Direction: m.Direction, RemoteAddr: m.RemoteAddr, Latency: m.session.latency.summary(buckets)}
+}
+
+// peerLatencies summarizes every live link, oldest first
+func peerLatencies(buckets bool) []PeerLatency {
+	muxMu.Lock()
+	links := make([]*Mux, 0, len(muxes))
+	for _, m := range muxes {
+		links = append(links, m)
+	}
+	muxMu.Unlock()
+	sort.Slice(links, func(i, j int) bool { return links[i].Created.Before(links[j].Created) })
+	list := make([]PeerLatency, 0, len(links))
+	for _, m := range links {
+		list = append(list, m.latency(buckets))
+	}
+	return list
+}
+
+func handleGetPeerLatency(payload json.RawMessage, writer *Output) {
+	var p PeerLatencyPayload
+	if len(payload) > 0 && string(payload) != "null" {
+		if err := json.Unmarshal(payload, &p); err != nil {
+			sendInvalidPayload(writer, "get_peer_latency")
+			return
+		}
+	}
+	if p.ID == "" {
+		writer.Encode(ProtocolResponse{Status: "ok", Data: map[string]interface{}{"peers": peerLatencies(true)}})
+		return
+	}
+	m, ok := lookupMux(p.ID)
+	if !ok {
+		sendErrorCode(writer, ErrNotFound, message("common.mux_link_not_found", "id", p.ID), nil)
+		return
+	}
+	writer.Encode(ProtocolResponse{Status: "ok", Data: m.latency(true)})
+}
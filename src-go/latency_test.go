@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLatencyPercentiles(t *testing.T) {
+	var l latencyStats
+	for i := 1; i <= 100; i++ {
+		l.observe(time.Duration(i) * time.Millisecond)
+	}
+	l.miss()
+	s := l.summary(true)
+	if s.P50Ms != 50 || s.P95Ms != 95 || s.P99Ms != 99 || s.MinMs != 1 || s.MaxMs != 100 {
+		t.Errorf("percentiles %+v", s)
+	}
+	if s.Samples != 100 || s.Lost != 1 {
+		t.Errorf("counted %d samples and %d lost", s.Samples, s.Lost)
+	}
+	if last := s.Buckets[len(s.Buckets)-1]; last.Count != 100 {
+		t.Errorf("total bucket %d", last.Count)
+	}
+
+	// Percentiles follow the recent window, not the whole history
+	for i := 0; i < latencyWindow; i++ {
+		l.observe(time.Second)
+	}
+	if s := l.summary(false); s.P50Ms != 1000 || s.MinMs != 1 || s.Buckets != nil {
+		t.Errorf("after the window moved: %+v", s)
+	}
+}
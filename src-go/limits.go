@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// What a listener does with connections beyond its limit
+const (
+	overLimitRefuse = "refuse"
+	overLimitQueue  = "queue"
+)
+
+const defaultQueueTimeout = 5 * time.Second
+
+const errConnectionLimit = "Connection limit reached"
+
+// globalGate caps inbound connections across all listeners
+var globalGate = &Gate{}
+
+// Gate is a counting semaphore for inbound connections. A max of zero
+// means unlimited.
+type Gate struct {
+	mu     sync.Mutex
+	max    int
+	active int
+	full   bool          // limit was hit and has not cleared yet
+	freed  chan struct{} // closed and replaced whenever a slot frees up
+}
+
+func (g *Gate) SetMax(max int) {
+	g.mu.Lock()
+	g.max = max
+	g.wakeLocked()
+	g.mu.Unlock()
+}
+
+func (g *Gate) Max() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.max
+}
+
+// Acquire takes a slot, waiting up to timeout for one to free up. onFull
+// runs, before any waiting, when this call is the first to find the gate full.
+func (g *Gate) Acquire(timeout time.Duration, onFull func()) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		g.mu.Lock()
+		if g.max <= 0 || g.active < g.max {
+			g.active++
+			g.mu.Unlock()
+			return true
+		}
+		hit := !g.full
+		g.full = true
+		if g.freed == nil {
+			g.freed = make(chan struct{})
+		}
+		freed := g.freed
+		g.mu.Unlock()
+
+		if hit {
+			onFull()
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return false
+		}
+		timer := time.NewTimer(remaining)
+		select {
+		case <-freed:
+			timer.Stop()
+		case <-timer.C:
+			return false
+		}
+	}
+}
+
+// Release frees a slot and reports whether the gate just stopped being full
+func (g *Gate) Release() (cleared bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.active--
+	g.wakeLocked()
+	if g.full && (g.max <= 0 || g.active < g.max) {
+		g.full = false
+		return true
+	}
+	return false
+}
+
+func (g *Gate) wakeLocked() {
+	if g.freed != nil {
+		close(g.freed)
+		g.freed = nil
+	}
+}
+
+// admit takes a listener slot and a global slot for a new inbound
+// connection, queueing or refusing according to the listener's policy
+func admit(l *Listener) bool {
+	timeout := time.Duration(0)
+	if l.OverLimit == overLimitQueue {
+		timeout = l.QueueTimeout
+	}
+	start := time.Now()
+
+	ok := l.Gate.Acquire(timeout, func() {
+		emitLimitEvent("connection_limit_reached", l, "listener", l.Gate.Max())
+	})
+	if ok {
+		ok = globalGate.Acquire(timeout-time.Since(start), func() {
+			emitLimitEvent("connection_limit_reached", l, "global", globalGate.Max())
+		})
+		if !ok {
+			releaseListenerSlot(l)
+		}
+	}
+	if !ok {
+		l.Refused.Add(1)
+	}
+	return ok
+}
+
+// acceptConn admits and registers a freshly accepted socket. Refused
+// sockets are answered and closed off the accept loop; the second result
+// is false only once shutdown has started.
+func acceptConn(conn net.Conn, l *Listener) (*Connection, bool) {
+	switch screenPeer(l, conn.RemoteAddr()) {
+	case filterAllow:
+	case filterThrottle:
+		go refuseConn(conn, l, http.StatusTooManyRequests, errThrottled)
+		return nil, true
+	default:
+		conn.Close()
+		return nil, true
+	}
+	if known, blocked := trust.blockedAddr(conn.RemoteAddr()); blocked {
+		l.Refused.Add(1)
+		rejectBlocked(l, conn.RemoteAddr().String(), known, "accept")
+		conn.Close()
+		return nil, true
+	}
+	if !admit(l) {
+		go refuseConn(conn, l, http.StatusServiceUnavailable, errConnectionLimit)
+		logger.Debug("connection refused", "listener", l.Addr, "remote", conn.RemoteAddr().String())
+		return nil, true
+	}
+
+	c := trackConn(conn, "inbound", l.Transport, l)
+	if c == nil {
+		releaseServerSlots(l)
+		conn.Close()
+		return nil, false
+	}
+	return c, true
+}
+
+// releaseServerSlots gives back the slots acceptConn took for a connection
+func releaseServerSlots(l *Listener) {
+	releaseListenerSlot(l)
+	if globalGate.Release() {
+		emitLimitEvent("connection_limit_cleared", l, "global", globalGate.Max())
+	}
+}
+
+func releaseListenerSlot(l *Listener) {
+	if l.Gate.Release() {
+		emitLimitEvent("connection_limit_cleared", l, "listener", l.Gate.Max())
+	}
+}
+
+func emitLimitEvent(event string, l *Listener, scope string, limit int) {
+	emitEvent(event, map[string]interface{}{
+		"listener":    l.Addr,
+		"listener_id": l.ID,
+		"scope":       scope, // "listener", "global"
+		"limit":       limit,
+		"action":      l.OverLimit,
+	})
+}
+
+// refuseConn tells the peer why it is being dropped in the listener's own
+// protocol, so clients can tell a full server from a broken one; status
+// is the HTTP status http listeners answer with
+func refuseConn(conn net.Conn, l *Listener, status int, msg string) {
+	defer recoverPanic("refusal on " + l.Addr)
+	defer conn.Close()
+	// Reads too: writing on a TLS socket first waits for the handshake
+	conn.SetDeadline(time.Now().Add(time.Second))
+
+	body, _ := json.Marshal(ProtocolResponse{Status: "error", Message: msg})
+	switch l.Type {
+	case "http":
+		fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nContent-Type: application/json\r\n"+
+			"Content-Length: %d\r\nConnection: close\r\n\r\n%s", status, http.StatusText(status), len(body), body)
+	case "transfer":
+		ack, _ := json.Marshal(TransferAck{Status: "error", Message: strings.ToLower(msg)})
+		conn.Write(append(ack, '\n'))
+	default:
+		conn.Write(append(body, '\n'))
+	}
+}
+
+type SetMaxConnectionsPayload struct {
+	ListenerRef        // neither listener_id nor port sets the global cap
+	MaxConnections int `json:"max_connections"`
+}
+
+func handleSetMaxConnections(payload json.RawMessage, writer *Output) {
+	var p SetMaxConnectionsPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		sendInvalidPayload(writer, "set_max_connections")
+		return
+	}
+	if p.MaxConnections < 0 {
+		sendErrorCode(writer, ErrInvalidArgument, message("common.max_connections_must_not"), nil)
+		return
+	}
+
+	scope := "global"
+	if p.ListenerRef.set() {
+		state.Mutex.Lock()
+		l, ok := findListenerLocked(p.ListenerRef, writer)
+		state.Mutex.Unlock()
+		if !ok {
+			return
+		}
+		l.Gate.SetMax(p.MaxConnections)
+		scope = l.Addr
+	} else {
+		globalGate.SetMax(p.MaxConnections)
+	}
+
+	writer.Encode(okResponse(message("limits.connection_limit_set", "scope", scope, "max_connections", p.MaxConnections), nil))
+}
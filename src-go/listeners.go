@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"sync/atomic"
+)
+
+// Listeners are keyed by the ID start_server hands out rather than by
+// address, so one port can be bound on two interfaces, over TCP and QUIC,
+// or once per address family. Commands that act on a listener take
+// listener_id; host and port still work while they name only one.
+var listenerSeq atomic.Uint64
+
+// assignID gives a new listener its ID
+func (l *Listener) assignID() {
+	l.seq = listenerSeq.Add(1)
+	l.ID = fmt.Sprintf("listener-%d", l.seq)
+}
+
+// ListenerRef names a listener in a command payload
+type ListenerRef struct {
+	ListenerID string `json:"listener_id"`
+	Host       string `json:"host"`
+	Port       int    `json:"port"`
+}
+
+func (r ListenerRef) set() bool { return r.ListenerID != "" || r.Port > 0 }
+
+// socketNetwork is "udp" for QUIC listeners and "tcp" for the rest
+func socketNetwork(transport string) string {
+	if transport == "quic" {
+		return "udp"
+	}
+	return "tcp"
+}
+
+// socketFamily is the address family a listening socket takes, "dual" when
+// it is not narrowed to one
+func socketFamily(o SocketOptions) string {
+	switch {
+	case o.IPv4Only:
+		return familyIPv4
+	case o.DualStack != nil && !*o.DualStack:
+		return familyIPv6
+	}
+	return familyDual
+}
+
+func familiesOverlap(a, b string) bool {
+	return a == b || a == familyDual || b == familyDual
+}
+
+// conflictLocked finds a listener already holding addr on the same socket
+// network and an overlapping family; the caller holds state.Mutex
+func conflictLocked(addr, network, family string) *Listener {
+	for _, l := range state.Listeners {
+		if l.Addr == addr && socketNetwork(l.Transport) == network && familiesOverlap(socketFamily(l.Socket), family) {
+			return l
+		}
+	}
+	return nil
+}
+
+// listenersAtLocked returns the listeners bound to addr, oldest first; the
+// caller holds state.Mutex
+func listenersAtLocked(addr string) []*Listener {
+	var found []*Listener
+	for _, l := range state.Listeners {
+		if l.Addr == addr {
+			found = append(found, l)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].seq < found[j].seq })
+	return found
+}
+
+// findListenerLocked resolves a reference to one listener, answering with
+// an error when there is none or the address is ambiguous; the caller
+// holds state.Mutex
+func findListenerLocked(ref ListenerRef, writer *Output) (*Listener, bool) {
+	if ref.ListenerID != "" {
+		if l, exists := state.Listeners[ref.ListenerID]; exists && inScope(l.ID, writer) {
+			return l, true
+		}
+		sendErrorCode(writer, ErrNotFound, message("common.server_id_not_found", "listener_id", ref.ListenerID), map[string]interface{}{"listener_id": ref.ListenerID})
+		return nil, false
+	}
+	addr := listenAddr(ref.Host, ref.Port)
+	found := slices.DeleteFunc(listenersAtLocked(addr), func(l *Listener) bool { return !inScope(l.ID, writer) })
+	switch len(found) {
+	case 0:
+		sendErrorCode(writer, ErrNotFound, message("common.server_not_found"), nil)
+		return nil, false
+	case 1:
+		return found[0], true
+	}
+	ids := make([]string, len(found))
+	for i, l := range found {
+		ids[i] = l.ID
+	}
+	sendErrorCode(writer, ErrInvalidArgument,
+		message("listeners.share_choosing_one_requires", "found", len(found), "addr", addr),
+		map[string]interface{}{"addr": addr, "listener_ids": ids})
+	return nil, false
+}
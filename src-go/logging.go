@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	defaultLogMaxSize    = 10 << 20 // 10 MiB
+	defaultLogMaxBackups = 3
+)
+
+var logLevel = new(slog.LevelVar)
+
+var logSink = &LogSink{stderr: os.Stderr}
+
+// logger writes one JSON object per line to stderr (and the log file, if set)
+// so the Tauri process can parse and surface them in its diagnostics panel
+var logger = slog.New(slog.NewJSONHandler(logSink, &slog.HandlerOptions{Level: logLevel}))
+
+// LogSink fans log lines out to stderr, an optional rotating file and
+// any remote log tails
+type LogSink struct {
+	mu     sync.Mutex
+	stderr io.Writer
+	file   *RotatingFile
+	tails  map[*logTail]struct{}
+}
+
+func (s *LogSink) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file != nil {
+		// A full disk must not take stderr logging down with it
+		s.file.Write(p)
+	}
+	if len(s.tails) > 0 {
+		level := lineLevel(p)
+		for t := range s.tails {
+			if level >= t.level {
+				t.offer(p)
+			}
+		}
+	}
+	return s.stderr.Write(p)
+}
+
+func (s *LogSink) SetFile(f *RotatingFile) {
+	s.mu.Lock()
+	old := s.file
+	s.file = f
+	s.mu.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+}
+
+// RotatingFile is an append-only file that is renamed to path.1, path.2, ...
+// once it grows past maxSize, keeping at most maxBackups old files
+type RotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	size       int64
+	f          *os.File
+}
+
+func OpenRotatingFile(path string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	r := &RotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *RotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f = f
+	r.size = info.Size()
+	return nil
+}
+
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.f == nil {
+		return 0, os.ErrClosed
+	}
+	if r.size+int64(len(p)) > r.maxSize && r.size > 0 {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *RotatingFile) rotate() error {
+	r.f.Close()
+	r.f = nil
+
+	os.Remove(fmt.Sprintf("%s.%d", r.path, r.maxBackups))
+	for i := r.maxBackups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+	}
+	if r.maxBackups > 0 {
+		os.Rename(r.path, r.path+".1")
+	} else {
+		os.Remove(r.path)
+	}
+	return r.open()
+}
+
+func (r *RotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
+
+func parseLogLevel(name string) (slog.Level, bool) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return slog.LevelDebug, true
+	case "info":
+		return slog.LevelInfo, true
+	case "warn", "warning":
+		return slog.LevelWarn, true
+	case "error":
+		return slog.LevelError, true
+	}
+	return 0, false
+}
+
+type SetLogLevelPayload struct {
+	Level string `json:"level"` // "debug", "info", "warn", "error"
+}
+
+func handleSetLogLevel(payload json.RawMessage, writer *Output) {
+	var p SetLogLevelPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		sendInvalidPayload(writer, "set_log_level")
+		return
+	}
+
+	level, ok := parseLogLevel(p.Level)
+	if !ok {
+		sendErrorCode(writer, ErrUnsupported, message("common.unknown_log_level", "level", p.Level), nil)
+		return
+	}
+	logLevel.Set(level)
+	logger.Info("log level changed", "level", level.String())
+
+	writer.Encode(okResponse(message("logging.log_level_set", "level", level.String()), nil))
+}
+
+type SetLogFilePayload struct {
+	Path       string `json:"path"` // empty disables file logging
+	MaxSize    int64  `json:"max_size"`
+	MaxBackups *int   `json:"max_backups"`
+}
+
+func handleSetLogFile(payload json.RawMessage, writer *Output) {
+	var p SetLogFilePayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		sendInvalidPayload(writer, "set_log_file")
+		return
+	}
+
+	if p.Path == "" {
+		logSink.SetFile(nil)
+		writer.Encode(okResponse(message("logging.file_logging_disabled"), nil))
+		return
+	}
+
+	maxSize := int64(defaultLogMaxSize)
+	if p.MaxSize > 0 {
+		maxSize = p.MaxSize
+	}
+	maxBackups := defaultLogMaxBackups
+	if p.MaxBackups != nil && *p.MaxBackups >= 0 {
+		maxBackups = *p.MaxBackups
+	}
+
+	f, err := OpenRotatingFile(p.Path, maxSize, maxBackups)
+	if err != nil {
+		sendError(writer, message("logging.failed_open_log_file", "error", err))
+		return
+	}
+	logSink.SetFile(f)
+	logger.Info("file logging enabled", "path", p.Path, "max_size", maxSize, "max_backups", maxBackups)
+
+	writer.Encode(okResponse(message("logging.path", "path", p.Path), nil))
+}
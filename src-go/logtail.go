@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+// Remote log tail: a "logtail" listener streams this node's structured
+// log to peers that connect and log in, so someone helping from another
+// machine can watch what goes wrong as it happens. The client sends one
+// JSON line naming the lowest level it wants, the listener acks and then
+// writes every log line at or above that level as it is logged. The
+// node's own log level still applies; nothing below it is produced.
+// start_log_tail runs the client side as a job and hands each line to
+// the frontend as a remote_log event; cancel ends it.
+const (
+	logTailBuffer    = 256              // lines held for a slow peer before dropping
+	logTailKeepalive = 30 * time.Second // empty line that keeps idle timeouts away
+	logTailHandshake = 30 * time.Second
+	logTailMaxLine   = 64 << 10 // longest request or log line read
+)
+
+var logTailSeq atomic.Uint64
+
+// logTailRequest is the line a log tail client opens with
+type logTailRequest struct {
+	Level string `json:"level"` // "debug", "info" (default), "warn", "error"
+}
+
+// logTail is one peer's subscription to the log
+type logTail struct {
+	level   slog.Level
+	lines   chan []byte
+	dropped atomic.Uint64
+}
+
+// offer queues a copy of line without ever blocking the logger
+func (t *logTail) offer(line []byte) {
+	select {
+	case t.lines <- append([]byte(nil), line...):
+	default:
+		t.dropped.Add(1)
+	}
+}
+
+func (s *LogSink) addTail(level slog.Level) *logTail {
+	t := &logTail{level: level, lines: make(chan []byte, logTailBuffer)}
+	s.mu.Lock()
+	if s.tails == nil {
+		s.tails = make(map[*logTail]struct{})
+	}
+	s.tails[t] = struct{}{}
+	s.mu.Unlock()
+	return t
+}
+
+func (s *LogSink) removeTail(t *logTail) {
+	s.mu.Lock()
+	delete(s.tails, t)
+	s.mu.Unlock()
+}
+
+// lineLevel reads the level of a JSON log line; lines it cannot read
+// count as errors so a tail never misses them
+func lineLevel(line []byte) slog.Level {
+	var entry struct {
+		Level slog.Level `json:"level"`
+	}
+	if err := json.Unmarshal(line, &entry); err != nil {
+		return slog.LevelError
+	}
+	return entry.Level
+}
+
+// handleLogTailConnection streams the log to one peer until it hangs up
+func handleLogTailConnection(c *Connection, _ *Listener, _ string) {
+	defer untrackConn(c)
+
+	reader := bufio.NewReader(c)
+	c.SetReadDeadline(time.Now().Add(logTailHandshake))
+	line, err := readLineLimit(reader, logTailMaxLine)
+	if err != nil {
+		return
+	}
+	c.SetReadDeadline(time.Time{})
+	var req logTailRequest
+	if err := json.Unmarshal(line, &req); err != nil {
+		writeAck(c, errors.New("invalid log tail request"))
+		return
+	}
+	if req.Level == "" {
+		req.Level = "info"
+	}
+	level, ok := parseLogLevel(req.Level)
+	if !ok {
+		writeAck(c, errors.New("unsupported log level: "+req.Level))
+		return
+	}
+
+	info := c.Info()
+	opened := map[string]interface{}{"id": c.ID, "remote": info.RemoteAddr, "level": req.Level}
+	if peer, known := discoveredPeer(info.RemoteAddr); known {
+		opened["peer"] = peer
+	}
+	tail := logSink.addTail(level)
+	defer logSink.removeTail(tail)
+	logger.Info("log tail started", "id", c.ID, "remote", info.RemoteAddr, "level", req.Level)
+	emitEvent("log_tail_opened", opened)
+	writeAck(c, nil)
+
+	// The peer sends nothing more; a read that returns means it hung up
+	gone := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, reader)
+		close(gone)
+	}()
+
+	keepalive := time.NewTicker(logTailKeepalive)
+	defer keepalive.Stop()
+	for {
+		var out []byte
+		select {
+		case <-gone:
+			emitEvent("log_tail_closed", map[string]interface{}{"id": c.ID})
+			return
+		case <-keepalive.C:
+			out = []byte{'\n'}
+		case line := <-tail.lines:
+			if n := tail.dropped.Swap(0); n > 0 {
+				notice, _ := json.Marshal(map[string]interface{}{
+					"time": time.Now(), "level": slog.LevelWarn.String(), "msg": "log tail dropped lines", "dropped": n,
+				})
+				out = append(notice, '\n')
+			}
+			out = append(out, line...)
+		}
+		if _, err := c.Write(out); err != nil {
+			c.Abort()
+			<-gone
+			emitEvent("log_tail_closed", map[string]interface{}{"id": c.ID, "error": err.Error()})
+			return
+		}
+	}
+}
+
+type StartLogTailPayload struct {
+	clipboardTarget
+
+	Level string `json:"level"` // lowest level to receive, default "info"
+}
+
+// handleStartLogTail connects to a peer's logtail listener and relays its
+// log lines as remote_log events until canceled or the peer hangs up
+func handleStartLogTail(payload json.RawMessage, writer *Output) {
+	var p StartLogTailPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		sendInvalidPayload(writer, "start_log_tail")
+		return
+	}
+	spec, err := p.spec("start_log_tail")
+	if err != nil {
+		sendFailure(writer, err)
+		return
+	}
+	if p.Level == "" {
+		p.Level = "info"
+	}
+	if _, ok := parseLogLevel(p.Level); !ok {
+		sendErrorCode(writer, ErrUnsupported, message("common.unknown_log_level", "level", p.Level), nil)
+		return
+	}
+
+	id := fmt.Sprintf("logtail-%d", logTailSeq.Add(1))
+	ctx, done := trackJob(id, "logtail", spec.Addr)
+	writer.Encode(okResponse(message("logtail.log_tail_started"),
+		map[string]interface{}{"id": id, "addr": spec.Addr, "level": p.Level}))
+
+	go func() {
+		defer recoverPanic("logtail " + id)
+		defer done()
+		lines, err := tailRemoteLog(ctx, spec, p.Level, func(entry json.RawMessage) {
+			emitEvent("remote_log", map[string]interface{}{"id": id, "addr": spec.Addr, "entry": entry})
+		})
+		ended := map[string]interface{}{"id": id, "addr": spec.Addr, "lines": lines}
+		if ctx.Err() != nil {
+			ended["canceled"] = true
+		} else if err != nil {
+			logger.Warn("log tail failed", "id", id, "addr", spec.Addr, "error", err)
+			ended["error"] = err.Error()
+		}
+		emitEvent("log_tail_ended", ended)
+	}()
+}
+
+// tailRemoteLog asks the logtail listener in spec for lines at level and
+// passes each to emit until ctx is canceled or the connection ends
+func tailRemoteLog(ctx context.Context, spec dialSpec, level string, emit func(json.RawMessage)) (int, error) {
+	conn, secure, err := spec.dial()
+	if err != nil {
+		return 0, err
+	}
+	c := trackConn(conn, "outbound", "tcp", nil)
+	if c == nil {
+		conn.Close()
+		return 0, errors.New("service is shutting down")
+	}
+	defer untrackConn(c)
+	c.setSecure(secure)
+	stop := context.AfterFunc(ctx, func() { c.Abort() })
+	defer stop()
+
+	line, _ := json.Marshal(logTailRequest{Level: level})
+	if _, err := c.Write(append(line, '\n')); err != nil {
+		return 0, err
+	}
+	reader := bufio.NewReader(c)
+	if _, err := readAck(reader, c, spec.Timeout); err != nil {
+		return 0, err
+	}
+
+	lines := 0
+	for {
+		// Keepalives arrive well within the idle timeout
+		c.SetReadDeadline(time.Now().Add(2 * logTailKeepalive))
+		line, err := readLineLimit(reader, logTailMaxLine)
+		if entry := bytes.TrimSpace(line); len(entry) > 0 && json.Valid(entry) {
+			lines++
+			emit(json.RawMessage(entry))
+		}
+		if err != nil {
+			if ctx.Err() != nil || err == io.EOF {
+				return lines, nil
+			}
+			return lines, err
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestLogTailFiltersAndDrops(t *testing.T) {
+	sink := &LogSink{stderr: io.Discard}
+	log := slog.New(slog.NewJSONHandler(sink, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	tail := sink.addTail(slog.LevelWarn)
+
+	log.Info("quiet")
+	log.Warn("loud", "n", 1)
+	log.Error("louder")
+	if len(tail.lines) != 2 {
+		t.Fatalf("tail holds %d lines, want 2", len(tail.lines))
+	}
+	if line := string(<-tail.lines); !strings.Contains(line, `"msg":"loud"`) {
+		t.Errorf("first line %s", line)
+	}
+	<-tail.lines
+
+	for i := 0; i < logTailBuffer+5; i++ {
+		log.Error("flood")
+	}
+	if got := tail.dropped.Load(); got != 5 {
+		t.Errorf("dropped %d lines, want 5", got)
+	}
+
+	sink.removeTail(tail)
+	for len(tail.lines) > 0 {
+		<-tail.lines
+	}
+	log.Error("after")
+	if len(tail.lines) != 0 {
+		t.Error("removed tail still receives lines")
+	}
+}
+
+func TestLogTailListenerRefusesUnpinned(t *testing.T) {
+	var buf bytes.Buffer
+	handleStartServer(json.RawMessage(`{"host":"127.0.0.1","port":0,"type":"logtail","encrypted":true,"allow_unpinned":true}`), NewOutput(&buf))
+	if !strings.Contains(buf.String(), "cannot allow unpinned peers") {
+		t.Errorf("unpinned logtail listener answered %s", buf.String())
+	}
+}
@@ -1,186 +1,1242 @@
 package main
 
 import (
-	"bufio"
 	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
 	"net"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 // ProtocolRequest represents a request from the main Tauri process
 type ProtocolRequest struct {
+	ID      json.RawMessage `json:"id,omitempty"` // any JSON value, echoed in the response
 	Command string          `json:"command"`
 	Payload json.RawMessage `json:"payload"`
+
+	Namespace    string `json:"namespace,omitempty"`     // scopes this request, see namespace.go
+	ValidateOnly bool   `json:"validate_only,omitempty"` // only check the payload, see schema.go
 }
 
 // ProtocolResponse represents a response to the main Tauri process
 type ProtocolResponse struct {
-	Status  string      `json:"status"`
-	Message string      `json:"message,omitempty"`
-	Data    interface{} `json:"data,omitempty"`
+	Status  string          `json:"status"`
+	Message string          `json:"message,omitempty"`
+	Data    interface{}     `json:"data,omitempty"`
+	ID      json.RawMessage `json:"id,omitempty"` // the request's id, if it had one
+
+	// Set for messages in the catalog, see catalog.go
+	MessageKey  string            `json:"message_key,omitempty"`
+	MessageArgs map[string]string `json:"message_args,omitempty"`
+
+	// Error responses only, see errors.go
+	Code    string                 `json:"code,omitempty"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// ProtocolEvent is pushed to the main Tauri process without a matching request
+type ProtocolEvent struct {
+	Status string      `json:"status"` // always "event"
+	Event  string      `json:"event"`
+	Data   interface{} `json:"data,omitempty"`
+	Seq    uint64      `json:"seq,omitempty"` // numbers every event, for attach to replay from
+
+	Namespace string `json:"namespace,omitempty"` // of what the event is about, if any
+}
+
+// Listener is a server started through start_server
+type Listener struct {
+	ID        string // key in state.Listeners, see assignID
+	Addr      string
+	Type      string
+	Transport string       // "tcp" or "quic"
+	Profile   string       // the profile it was started from, if any; guarded by state.Mutex
+	Limiter   *RateLimiter // caps the aggregate throughput of all its connections
+
+	Encrypted     bool     // every connection must complete the encrypted handshake
+	AllowUnpinned bool     // accept encrypted peers whose key is not pinned
+	Timeouts      Timeouts // starting timeouts for each accepted connection
+
+	Gate         *Gate         // caps concurrent connections on this listener
+	OverLimit    string        // "refuse" or "queue" once Gate is full
+	QueueTimeout time.Duration // how long a queued connection waits for a slot
+	Refused      atomic.Uint64
+	Filter       *AcceptFilter // allow and deny lists and per-IP throttling, nil for none
+
+	Compression bool // stream listeners accept compression proposed by clients
+
+	Auth    *ListenerAuth // nil when peers need no credentials
+	Drop    *DropOptions  // "transfer" listeners holding every transfer as an offer
+	Storage string        // "transfer" listeners: remote storage backend files go to, see backends.go
+	SOCKS   *SOCKSOptions // "socks5" listeners
+	SFTP    *sshServer    // "sftp" listeners
+	Media   *MediaOptions // "media" listeners
+	Serial  *serialBridge // "serial" listeners
+	TLS     *certStore    // certificate of listeners serving TLS
+
+	relay *Relay                // set for "relay" listeners
+	sim   atomic.Pointer[Netem] // conditions set_netem simulates on its connections
+	seq   uint64                // orders listeners sharing an address
+
+	Socket SocketOptions // how the listening socket was tuned
+
+	In       Meter
+	Out      Meter
+	BytesIn  atomic.Uint64
+	BytesOut atomic.Uint64
+	Accepted atomic.Uint64
+
+	// Health of the accept loop, guarded by state.Mutex
+	Restarts  uint64
+	down      time.Time // when the socket died; zero while serving
+	lastError string
+
+	ln   net.Listener
+	bind func() (net.Listener, error) // opens another socket on Addr
 }
 
 // ServerState holds the state of our network services
 type ServerState struct {
-	Listeners map[string]net.Listener
+	Listeners map[string]*Listener
+	Conns     map[string]*Connection
+	Relays    map[string]*Relay
 	Mutex     sync.Mutex
+
+	// active tracks in-flight connection handlers so shutdown can drain them
+	active   sync.WaitGroup
+	stopping bool
 }
 
 var state = ServerState{
-	Listeners: make(map[string]net.Listener),
+	Listeners: make(map[string]*Listener),
+	Conns:     make(map[string]*Connection),
+	Relays:    make(map[string]*Relay),
 }
 
+var (
+	output = NewOutput(os.Stdout)
+	input  *FrameReader
+)
+
 func main() {
-	reader := bufio.NewReader(os.Stdin)
-	writer := json.NewEncoder(os.Stdout)
+	framing := flag.String("framing", framingLine, `control channel framing: "line" or "length"`)
+	maxMessageSize := flag.Int("max-message-size", defaultMaxMessageSize, "largest accepted control message in bytes")
+	maxConnections := flag.Int("max-connections", 0, "cap on inbound connections across all listeners, 0 for unlimited")
+	configPath := flag.String("config", defaultConfigPath(), "JSON file with persistent settings and servers to start")
+	controlPath := flag.String("control-socket", "", "also accept protocol requests on this Unix socket or named pipe")
+	grpcAddr := flag.String("grpc", "", `also serve gRPC on "unix:PATH" for a socket, or on a loopback host:port with the token in LUMINA_NET_GRPC_TOKEN`)
+	workers := flag.Int("workers", defaultRequestWorkers, "requests with an id handled at the same time")
+	daemonize := flag.Bool("daemon", false, "keep running when stdin closes and serve the control socket for frontends to attach")
+	// The test harness flag is kept out of -help, see harness.go
+	args, testHarness := takeHarnessFlag(os.Args[1:])
+	flag.CommandLine.Parse(args)
+	if testHarness {
+		enableHarness()
+	}
+
+	if err := config.Load(*configPath); err != nil {
+		fmt.Fprintf(os.Stderr, "config: %v\n", err)
+		os.Exit(2)
+	}
+	if err := applyConfig(config.Get(), nil); err != nil {
+		fmt.Fprintf(os.Stderr, "config: %v\n", err)
+	}
+	crashDir = crashDirPath(*configPath)
+	if err := history.Load(historyPath(*configPath)); err != nil {
+		fmt.Fprintf(os.Stderr, "history: %v\n", err)
+	}
+	if err := chunkIndex.Load(chunkIndexPath(*configPath)); err != nil {
+		fmt.Fprintf(os.Stderr, "chunk index: %v\n", err)
+	}
+	if err := usage.Load(usagePath(*configPath)); err != nil {
+		fmt.Fprintf(os.Stderr, "usage: %v\n", err)
+	}
+	goSafe("usage counter", usage.run)
+	goSafe("clock watcher", sleeper.watchClock)
+	goSafe("sleep watcher", watchOSSleep)
+	goSafe("network watcher", watchNetwork)
+	if err := scheduler.Load(schedulesPath(*configPath)); err != nil {
+		fmt.Fprintf(os.Stderr, "schedules: %v\n", err)
+	}
+	if err := keys.LoadIdentity(identityPath(*configPath)); err != nil {
+		fmt.Fprintf(os.Stderr, "identity: %v\n", err)
+	}
+	if err := trust.Load(trustPath(*configPath)); err != nil {
+		fmt.Fprintf(os.Stderr, "trust store: %v\n", err)
+	}
+	if err := audit.Open(auditPath(*configPath), config.Get().Audit); err != nil {
+		fmt.Fprintf(os.Stderr, "audit log: %v\n", err)
+	}
+	// Flags given on the command line win over the config file
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "max-connections":
+			globalGate.SetMax(*maxConnections)
+		case "max-message-size":
+			maxMessageSizeFlag = true
+		}
+	})
+
+	if *framing != framingLine && *framing != framingLength {
+		fmt.Fprintf(os.Stderr, "unsupported framing %q\n", *framing)
+		os.Exit(2)
+	}
+
+	if *workers < 1 {
+		fmt.Fprintf(os.Stderr, "workers must be at least 1\n")
+		os.Exit(2)
+	}
+	requestPool = newWorkerPool(*workers)
+
+	messageSize := *maxMessageSize
+	if limit := config.Get().ControlLimits.MaxMessageSize; limit > 0 && !maxMessageSizeFlag {
+		messageSize = limit
+	}
+	input = NewFrameReader(os.Stdin, *framing, messageSize)
+	output.SetFraming(*framing)
+	writer := output
+
+	if level, ok := parseLogLevel(os.Getenv("LUMINA_NET_LOG_LEVEL")); ok {
+		logLevel.Set(level)
+	}
 
 	// Log startup
-	fmt.Fprintln(os.Stderr, "Lumina Net (Go) Service Started")
+	logger.Info("Lumina Net (Go) service started", "pid", os.Getpid(), "config", config.Path())
+	startConfiguredServers(config.Get())
+
+	// Shut down cleanly when the parent process asks us to terminate
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		logger.Info("received signal, shutting down", "signal", sig.String())
+		shutdown(defaultDrainTimeout)
+	}()
 
-	for {
-		line, err := reader.ReadString('\n')
+	if *controlPath != "" {
+		control.mu.Lock()
+		err := startControlLocked(*controlPath)
+		control.mu.Unlock()
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error reading stdin: %v\n", err)
-			break
+			logger.Error("failed to start control socket", "path", *controlPath, "error", err)
 		}
-
-		line = strings.TrimSpace(line)
-		if line == "" {
-			continue
+	}
+	if *grpcAddr != "" {
+		addr, path := *grpcAddr, ""
+		if rest, ok := strings.CutPrefix(addr, "unix:"); ok {
+			addr, path = "", rest
 		}
+		grpcState.mu.Lock()
+		err := startGRPCLocked(addr, path, os.Getenv("LUMINA_NET_GRPC_TOKEN"))
+		grpcState.mu.Unlock()
+		if err != nil {
+			logger.Error("failed to start grpc", "addr", *grpcAddr, "error", err)
+		}
+	}
 
-		var req ProtocolRequest
-		if err := json.Unmarshal([]byte(line), &req); err != nil {
-			sendError(writer, "Invalid JSON format")
-			continue
+	if *daemonize {
+		if _, err := enableDaemon(); err != nil {
+			logger.Error("failed to start daemon mode", "error", err)
 		}
+	}
 
-		handleRequest(req, writer)
+	err := readRequests(input, writer)
+	if err == io.EOF {
+		logger.Info("stdin closed")
+	} else {
+		logger.Error("error reading stdin", "error", err)
+	}
+	if daemonEnabled() {
+		waitAsDaemon()
 	}
+	// The parent went away; there is nobody left to serve
+	shutdown(defaultDrainTimeout)
 }
 
-func handleRequest(req ProtocolRequest, writer *json.Encoder) {
+func handleRequest(req ProtocolRequest, writer *Output) {
+	defer recoverRequest(req.Command, writer)
+	// A missing payload decodes like an empty object, so handlers never
+	// trip over requests that leave out optional arguments
+	if len(req.Payload) == 0 || string(req.Payload) == "null" {
+		req.Payload = json.RawMessage("{}")
+	}
+	if r := audit.begin(req); r != nil {
+		writer = writer.audited(r)
+		defer r.done()
+	}
+	if req.Namespace != "" {
+		if !validNamespace(req.Namespace) {
+			sendErrorCode(writer, ErrInvalidArgument, message("namespace.namespace_must_most", "max", maxNamespaceLen), nil)
+			return
+		}
+		writer = writer.inNamespace(req.Namespace)
+	}
+	if req.ValidateOnly {
+		validatePayload(req, writer)
+		return
+	}
+	if !checkPayload(req, writer) {
+		return
+	}
+
 	switch req.Command {
+	case "hello":
+		handleHello(req.Payload, writer)
 	case "start_server":
 		handleStartServer(req.Payload, writer)
 	case "stop_server":
 		handleStopServer(req.Payload, writer)
+	case "start_profile":
+		handleStartProfile(req.Payload, writer)
+	case "stop_profile":
+		handleStopProfile(req.Payload, writer)
+	case "list_profiles":
+		handleListProfiles(writer)
+	case "save_profile":
+		handleSaveProfile(req.Payload, writer)
+	case "delete_profile":
+		handleDeleteProfile(req.Payload, writer)
 	case "status":
 		handleStatus(writer)
+	case "status_since":
+		handleStatusSince(req.Payload, writer)
+	case "share_file":
+		handleShareFile(req.Payload, writer)
+	case "stop_share":
+		handleStopShare(req.Payload, writer)
+	case "list_shares":
+		handleListShares(writer)
+	case "open_mux":
+		handleOpenMux(req.Payload, writer)
+	case "close_mux":
+		handleCloseMux(req.Payload, writer)
+	case "list_muxes":
+		handleListMuxes(writer)
+	case "p2p_offer":
+		handleP2POffer(req.Payload, writer)
+	case "p2p_answer":
+		handleP2PAnswer(req.Payload, writer)
+	case "p2p_accept":
+		handleP2PAccept(req.Payload, writer)
+	case "p2p_add_candidate":
+		handleP2PAddCandidate(req.Payload, writer)
+	case "p2p_close":
+		handleP2PClose(req.Payload, writer)
+	case "list_p2p":
+		handleListP2P(writer)
+	case "get_peer_latency":
+		handleGetPeerLatency(req.Payload, writer)
+	case "dedup_cache_status":
+		handleDedupCacheStatus(writer)
+	case "clear_dedup_cache":
+		handleClearDedupCache(writer)
+	case "attach":
+		handleAttach(req.Payload, writer)
+	case "detach":
+		handleDetach(writer)
+	case "create_group":
+		handleCreateGroup(req.Payload, writer)
+	case "add_peer_to_group":
+		handleAddPeerToGroup(req.Payload, writer)
+	case "remove_peer_from_group":
+		handleRemovePeerFromGroup(req.Payload, writer)
+	case "delete_group":
+		handleDeleteGroup(req.Payload, writer)
+	case "list_groups":
+		handleListGroups(writer)
+	case "broadcast_file":
+		handleBroadcastFile(req.Payload, writer)
+	case "set_locale":
+		handleSetLocale(req.Payload, writer)
+	case "get_message_catalog":
+		handleGetMessageCatalog(req.Payload, writer)
+	case "check_firewall":
+		handleCheckFirewall(req.Payload, writer)
+	case "add_firewall_rule":
+		handleAddFirewallRule(req.Payload, writer)
+	case "remove_firewall_rule":
+		handleRemoveFirewallRule(req.Payload, writer)
+	case "confirm_firewall_change":
+		handleConfirmFirewallChange(req.Payload, writer)
+	case "list_firewall_changes":
+		handleListFirewallChanges(writer)
+	case "start_log_tail":
+		handleStartLogTail(req.Payload, writer)
+	case "rekey_connection":
+		handleRekeyConnection(req.Payload, writer)
+	case "storage_status":
+		handleStorageStatus(writer)
+	case "subscribe_stats":
+		handleSubscribeStats(req.Payload, writer)
+	case "unsubscribe_stats":
+		handleUnsubscribeStats(req.Payload, writer)
+	case "start_discovery":
+		handleStartDiscovery(req.Payload, writer)
+	case "stop_discovery":
+		handleStopDiscovery(writer)
+	case "list_peers":
+		handleListPeers(writer)
+	case "connect":
+		handleConnect(req.Payload, writer)
+	case "send":
+		handleSend(req.Payload, writer)
+	case "list_scheduled":
+		handleListScheduled(writer)
+	case "cancel_scheduled":
+		handleCancelScheduled(req.Payload, writer)
+	case "tap_connection":
+		handleTapConnection(req.Payload, writer)
+	case "untap_connection":
+		handleUntapConnection(req.Payload, writer)
+	case "shutdown_write":
+		handleShutdownWrite(req.Payload, writer)
+	case "shutdown_read":
+		handleShutdownRead(req.Payload, writer)
+	case "set_linger":
+		handleSetLinger(req.Payload, writer)
+	case "set_raw_channel":
+		handleSetRawChannel(req.Payload, writer)
+	case "send_raw":
+		handleSendRaw(req.Payload, writer)
+	case "disconnect":
+		handleDisconnect(req.Payload, writer)
+	case "list_connections":
+		handleListConnections(writer)
+	case "set_rate_limit":
+		handleSetRateLimit(req.Payload, writer)
+	case "set_netem":
+		handleSetNetem(req.Payload, writer)
+	case "pause_background":
+		handlePauseBackground(req.Payload, writer)
+	case "resume_background":
+		handleResumeBackground(req.Payload, writer)
+	case "export_state":
+		handleExportState(req.Payload, writer)
+	case "import_state":
+		handleImportState(req.Payload, writer)
+	case "set_log_level":
+		handleSetLogLevel(req.Payload, writer)
+	case "set_log_file":
+		handleSetLogFile(req.Payload, writer)
+	case "who_uses_port":
+		handleWhoUsesPort(req.Payload, writer)
+	case "set_namespace":
+		handleSetNamespace(req.Payload, writer)
+	case "set_transfer_priority":
+		handleSetTransferPriority(req.Payload, writer)
+	case "set_output_batching":
+		handleSetOutputBatching(req.Payload, writer)
+	case "flush_output":
+		handleFlushOutput(writer)
+	case "system_sleep":
+		handleSystemSleep(req.Payload, writer)
+	case "system_wake":
+		handleSystemWake(req.Payload, writer)
+	case "get_audit_log":
+		handleGetAuditLog(req.Payload, writer)
+	case "lookup_ip":
+		handleLookupIP(req.Payload, writer)
+	case "publish_media_frame":
+		handlePublishMediaFrame(req.Payload, writer)
+	case "list_media_subscribers":
+		handleListMediaSubscribers(req.Payload, writer)
+	case "kick_media_subscriber":
+		handleKickMediaSubscriber(req.Payload, writer)
+	case "download_url":
+		handleDownloadURL(req.Payload, writer)
+	case "send_file":
+		handleSendFile(req.Payload, writer)
+	case "reload_certs":
+		handleReloadCerts(req.Payload, writer)
+	case "send_archive":
+		handleSendArchive(req.Payload, writer)
+	case "extract_archive":
+		handleExtractArchive(req.Payload, writer)
+	case "send_directory":
+		handleSendDirectory(req.Payload, writer)
+	case "start_sync":
+		handleStartSync(req.Payload, writer)
+	case "stop_sync":
+		handleStopSync(req.Payload, writer)
+	case "list_syncs":
+		handleListSyncs(writer)
+	case "pause_transfer":
+		handlePauseTransfer(req.Payload, writer)
+	case "resume_transfer":
+		handleResumeTransfer(req.Payload, writer)
+	case "enqueue_transfer":
+		handleEnqueueTransfer(req.Payload, writer)
+	case "list_queue":
+		handleListQueue(writer)
+	case "reorder_queue":
+		handleReorderQueue(req.Payload, writer)
+	case "cancel_queued":
+		handleCancelQueued(req.Payload, writer)
+	case "set_queue_concurrency":
+		handleSetQueueConcurrency(req.Payload, writer)
+	case "clear_queue_history":
+		handleClearQueueHistory(writer)
+	case "list_transfers":
+		handleListTransfers(writer)
+	case "list_interfaces":
+		handleListInterfaces(writer)
+	case "wake_host":
+		handleWakeHost(req.Payload, writer)
+	case "scan_lan":
+		handleScanLAN(req.Payload, writer)
+	case "doctor":
+		handleDoctor(req.Payload, writer)
+	case "set_framing":
+		handleSetFraming(req.Payload, writer)
+	case "reset_metrics":
+		handleResetMetrics(writer)
+	case "generate_keypair":
+		handleGenerateKeypair(req.Payload, writer)
+	case "export_keypair":
+		handleExportKeypair(req.Payload, writer)
+	case "import_keypair":
+		handleImportKeypair(req.Payload, writer)
+	case "pin_peer_key":
+		handlePinPeerKey(req.Payload, writer)
+	case "unpin_peer_key":
+		handleUnpinPeerKey(req.Payload, writer)
+	case "list_pinned_keys":
+		handleListPinnedKeys(writer)
+	case "list_known_peers":
+		handleListKnownPeers(req.Payload, writer)
+	case "trust_peer":
+		handleTrustPeer(req.Payload, writer)
+	case "block_peer":
+		handleBlockPeer(req.Payload, writer)
+	case "unblock_peer":
+		handleUnblockPeer(req.Payload, writer)
+	case "rename_peer":
+		handleRenamePeer(req.Payload, writer)
+	case "forget_peer":
+		handleForgetPeer(req.Payload, writer)
+	case "test_proxy":
+		handleTestProxy(req.Payload, writer)
+	case "resolve":
+		handleResolve(req.Payload, writer)
+	case "reverse_lookup":
+		handleReverseLookup(req.Payload, writer)
+	case "dns_benchmark":
+		handleDNSBenchmark(req.Payload, writer)
+	case "crypto_benchmark":
+		handleCryptoBenchmark(req.Payload, writer)
+	case "check_update":
+		handleCheckUpdate(req.Payload, writer)
+	case "apply_update":
+		handleApplyUpdate(req.Payload, writer)
+	case "icmp_ping":
+		handleICMPPing(req.Payload, writer)
+	case "traceroute":
+		handleTraceroute(req.Payload, writer)
+	case "scan_ports":
+		handleScanPorts(req.Payload, writer)
+	case "cancel":
+		handleCancel(req.Payload, writer)
+	case "list_jobs":
+		handleListJobs(req.Payload, writer)
+	case "list_diagnostics":
+		handleListDiagnostics(writer)
+	case "cancel_diagnostic":
+		handleCancelDiagnostic(req.Payload, writer)
+	case "stun_discover":
+		handleSTUNDiscover(req.Payload, writer)
+	case "punch_hole":
+		handlePunchHole(req.Payload, writer)
+	case "set_connection_timeouts":
+		handleSetConnectionTimeouts(req.Payload, writer)
+	case "check_port":
+		handleCheckPort(req.Payload, writer)
+	case "set_max_connections":
+		handleSetMaxConnections(req.Payload, writer)
+	case "start_relay":
+		handleStartRelay(req.Payload, writer)
+	case "stop_relay":
+		handleStopRelay(req.Payload, writer)
+	case "list_relays":
+		handleListRelays(writer)
+	case "issue_auth_token":
+		handleIssueAuthToken(req.Payload, writer)
+	case "revoke_auth_token":
+		handleRevokeAuthToken(req.Payload, writer)
+	case "get_config":
+		handleGetConfig(writer)
+	case "set_download_dir":
+		handleSetDownloadDir(req.Payload, writer)
+	case "set_config":
+		handleSetConfig(req.Payload, writer)
+	case "enable_drop_mode":
+		handleEnableDropMode(req.Payload, writer)
+	case "disable_drop_mode":
+		handleDisableDropMode(writer)
+	case "accept_offer":
+		handleAcceptOffer(req.Payload, writer)
+	case "reject_offer":
+		handleRejectOffer(req.Payload, writer)
+	case "list_offers":
+		handleListOffers(writer)
+	case "run_speedtest":
+		handleRunSpeedtest(req.Payload, writer)
+	case "hash_file":
+		handleHashFile(req.Payload, writer)
+	case "verify_transfer":
+		handleVerifyTransfer(req.Payload, writer)
+	case "push_clipboard":
+		handlePushClipboard(req.Payload, writer)
+	case "push_text":
+		handlePushText(req.Payload, writer)
+	case "send_message":
+		handleSendMessage(req.Payload, writer)
+	case "broadcast_message":
+		handleBroadcastMessage(req.Payload, writer)
+	case "set_chat_history":
+		handleSetChatHistory(req.Payload, writer)
+	case "get_chat_history":
+		handleGetChatHistory(req.Payload, writer)
+	case "clear_chat_history":
+		handleClearChatHistory(req.Payload, writer)
+	case "list_history":
+		handleListHistory(req.Payload, writer)
+	case "get_usage":
+		handleGetUsage(req.Payload, writer)
+	case "clear_history":
+		handleClearHistory(req.Payload, writer)
+	case "add_port_mapping":
+		handleAddPortMapping(req.Payload, writer)
+	case "list_port_mappings":
+		handleListPortMappings(writer)
+	case "remove_port_mapping":
+		handleRemovePortMapping(req.Payload, writer)
+	case "start_metrics":
+		handleStartMetrics(req.Payload, writer)
+	case "stop_metrics":
+		handleStopMetrics(writer)
+	case "join_multicast":
+		handleJoinMulticast(req.Payload, writer)
+	case "leave_multicast":
+		handleLeaveMulticast(req.Payload, writer)
+	case "list_multicast":
+		handleListMulticast(writer)
+	case "send_multicast":
+		handleSendMulticast(req.Payload, writer)
+	case "start_control_socket":
+		handleStartControlSocket(req.Payload, writer)
+	case "stop_control_socket":
+		handleStopControlSocket(writer)
+	case "control_status":
+		handleControlStatus(writer)
+	case "begin_payload":
+		handleBeginPayload(req.Payload, writer)
+	case "payload_chunk":
+		handlePayloadChunk(req.Payload, writer)
+	case "end_payload":
+		handleEndPayload(req.Payload, writer)
+	case "start_grpc":
+		handleStartGRPC(req.Payload, writer)
+	case "stop_grpc":
+		handleStopGRPC(writer)
+	case "grpc_status":
+		handleGRPCStatus(writer)
+	case "shutdown":
+		handleShutdown(req.Payload, writer)
 	case "ping":
-		writer.Encode(ProtocolResponse{Status: "ok", Message: "pong"})
+		writer.Encode(okResponse(message("main.pong"), nil))
 	default:
-		sendError(writer, "Unknown command: "+req.Command)
+		if handleHarnessCommand(req, writer) {
+			return
+		}
+		// Newer frontends can tell an old sidecar from a failed command
+		metrics.Errors.Add(1)
+		m := message("main.unknown_command", "command", req.Command)
+		writer.Encode(ProtocolResponse{
+			Status:      "error",
+			Message:     m.String(),
+			MessageKey:  m.Key,
+			MessageArgs: m.Args,
+			Code:        ErrUnknownCommand,
+			Details:     map[string]interface{}{"command": req.Command},
+			Data:        map[string]interface{}{"command": req.Command, "unknown_command": true, "protocol_version": protocolVersion},
+		})
 	}
 }
 
 type StartServerPayload struct {
+	Host string `json:"host"` // bind address, empty for all interfaces
 	Port int    `json:"port"`
-	Type string `json:"type"` // "tcp", "udp"
+	Type string `json:"type"` // a connHandlers type such as "echo" or "chat", or "ws", "http"
+	Path string `json:"path"` // HTTP path for "ws" listeners, default "/"
+	Dir  string `json:"dir"`  // download directory for "transfer" and "http" listeners
+
+	HTTP HTTPOptions `json:"http"` // routes and endpoints for "http" listeners
+
+	Encrypted     bool `json:"encrypted"`      // require the encrypted handshake
+	AllowUnpinned bool `json:"allow_unpinned"` // accept encrypted peers with unknown keys
+
+	Timeouts TimeoutOptions `json:"timeouts"` // per-connection timeouts and TCP keepalive
+
+	MaxConnections int    `json:"max_connections"`  // 0 for unlimited
+	OverLimit      string `json:"over_limit"`       // "refuse" (default) or "queue"
+	QueueTimeoutMs int    `json:"queue_timeout_ms"` // how long "queue" waits for a free slot
+
+	AcceptFilterOptions // per_ip_rate, per_ip_burst, allow and deny
+
+	// Compression lets clients of stream types negotiate compression;
+	// transfers negotiate compression per file on their own
+	Compression bool `json:"compression"`
+
+	Auth AuthOptions `json:"auth"` // require a shared secret or issued tokens
+
+	Drop *DropOptions `json:"drop"` // hold "transfer" uploads until accept_offer
+
+	Storage string `json:"storage"` // "transfer" listeners: storage backend to receive into instead of dir
+
+	SOCKS *SOCKSOptions `json:"socks"` // credentials for "socks5" listeners
+	SFTP  *SFTPOptions  `json:"sftp"`  // logins and host key of "sftp" listeners
+	Media *MediaOptions `json:"media"` // streams and queueing of "media" listeners
+
+	Serial *SerialOptions `json:"serial"` // device and line settings of "serial" listeners
+
+	TLS *TLSOptions `json:"tls"` // serve TLS with a certificate from disk, tcp only
+
+	Socket SocketOptions `json:"socket"` // socket tuning for high-speed links
+
+	AddressFamily string `json:"address_family"` // "ipv4", "ipv6" or "dual" (default)
+
+	// Transport is "tcp" (default) or "quic", which accepts each QUIC
+	// stream as a connection of the listener's type
+	Transport string `json:"transport"`
 }
 
-func handleStartServer(payload json.RawMessage, writer *json.Encoder) {
+func handleStartServer(payload json.RawMessage, writer *Output) {
 	var p StartServerPayload
 	if err := json.Unmarshal(payload, &p); err != nil {
-		sendError(writer, "Invalid payload for start_server")
+		sendInvalidPayload(writer, "start_server")
 		return
 	}
+	p.Host = normalizeHost(p.Host)
+
+	if p.Type == "" {
+		p.Type = "tcp"
+	}
+	if port, ok := defaultPort(payload, p.Type); ok {
+		p.Port = port
+	}
+	addr := listenAddr(p.Host, p.Port)
 
-	addr := fmt.Sprintf(":%d", p.Port)
-	
+	handler, isConn := connHandlers[p.Type]
+	switch {
+	case isConn:
+	case p.Type == "ws", p.Type == "http":
+		if p.Encrypted {
+			sendErrorCode(writer, ErrUnsupported, message("main.encryption_not_supported_listeners", "type", p.Type), nil)
+			return
+		}
+	default:
+		sendErrorCode(writer, ErrUnsupported, message("main.unsupported_server_type", "type", p.Type), nil)
+		return
+	}
+	switch p.Transport {
+	case "":
+		p.Transport = "tcp"
+	case "tcp":
+	case "quic":
+		if !isConn {
+			sendErrorCode(writer, ErrUnsupported, message("main.quic_not_supported_listeners", "type", p.Type), nil)
+			return
+		}
+		if p.TLS != nil {
+			sendErrorCode(writer, ErrInvalidArgument, message("main.tls_requires_tcp_listener"), nil)
+			return
+		}
+		if p.Socket.tcpOnly() {
+			sendError(writer, message("main.socket_options_other_address"))
+			return
+		}
+	default:
+		sendErrorCode(writer, ErrUnsupported, message("common.unsupported_transport", "transport", p.Transport), nil)
+		return
+	}
+	if p.Compression && !handler.stream {
+		sendErrorCode(writer, ErrUnsupported, message("main.stream_compression_not_supported", "type", p.Type), nil)
+		return
+	}
+	if p.Drop != nil && p.Type != "transfer" {
+		sendErrorCode(writer, ErrInvalidArgument, message("main.drop_mode_requires_transfer"), nil)
+		return
+	}
+	var dest receiveDest
+	if p.Storage != "" {
+		if p.Type != "transfer" {
+			sendErrorCode(writer, ErrInvalidArgument, message("backends.storage_requires_transfer"), nil)
+			return
+		}
+		if p.Dir != "" {
+			sendError(writer, message("backends.transfer_dir_or_storage"))
+			return
+		}
+		var err error
+		if dest, err = resolveStorage(p.Storage); err != nil {
+			sendFailure(writer, err)
+			return
+		}
+		// A local backend is only a name for a directory
+		p.Dir = dest.dir
+	}
+	if p.SOCKS != nil && p.Type != "socks5" {
+		sendErrorCode(writer, ErrInvalidArgument, message("main.socks_options_require_socks5"), nil)
+		return
+	}
+	if p.Type == "socks5" {
+		// SOCKS clients speak plain TCP and log in the SOCKS way
+		if p.Encrypted || p.Auth.Enabled() || p.Transport == "quic" {
+			sendError(writer, message("main.socks5_listeners_take_socks"))
+			return
+		}
+		if err := p.SOCKS.Validate(); err != nil {
+			sendFailure(writer, err)
+			return
+		}
+	}
+	if p.SFTP != nil && p.Type != "sftp" {
+		sendErrorCode(writer, ErrInvalidArgument, message("main.sftp_options_require_sftp"), nil)
+		return
+	}
+	if p.Type == "sftp" {
+		// SSH brings its own encryption and logins
+		if p.Encrypted || p.Auth.Enabled() || p.Transport == "quic" || p.TLS != nil {
+			sendError(writer, message("main.sftp_listeners_take_sftp"))
+			return
+		}
+		if err := p.SFTP.Validate(); err != nil {
+			sendFailure(writer, err)
+			return
+		}
+	}
+	if p.Media != nil && p.Type != "media" {
+		sendErrorCode(writer, ErrInvalidArgument, message("media.media_options_require_media"), nil)
+		return
+	}
+	if err := p.Media.Validate(); err != nil {
+		sendFailure(writer, err)
+		return
+	}
+	if p.Serial != nil && p.Type != "serial" {
+		sendErrorCode(writer, ErrInvalidArgument, message("main.serial_options_require_serial"), nil)
+		return
+	}
+	if p.Type == "serial" {
+		if err := p.Serial.Validate(); err != nil {
+			sendFailure(writer, err)
+			return
+		}
+	}
+	if p.Type == "logtail" && !p.Encrypted && !p.Auth.Enabled() {
+		// The log names peers, paths and addresses; never hand it to anyone
+		sendErrorCode(writer, ErrInvalidArgument, message("logtail.listeners_require_encrypted_auth"), nil)
+		return
+	}
+	if p.Type == "logtail" && p.AllowUnpinned {
+		// Anyone could complete an unpinned handshake
+		sendErrorCode(writer, ErrInvalidArgument, message("logtail.listeners_cannot_allow_unpinned"), nil)
+		return
+	}
+	switch p.OverLimit {
+	case "":
+		p.OverLimit = overLimitRefuse
+	case overLimitRefuse, overLimitQueue:
+	default:
+		sendErrorCode(writer, ErrUnsupported, message("main.unsupported_over_limit_policy", "over_limit", p.OverLimit), nil)
+		return
+	}
+	if p.MaxConnections < 0 {
+		sendErrorCode(writer, ErrInvalidArgument, message("common.max_connections_must_not"), nil)
+		return
+	}
+	queueTimeout := defaultQueueTimeout
+	if p.QueueTimeoutMs > 0 {
+		queueTimeout = time.Duration(p.QueueTimeoutMs) * time.Millisecond
+	}
+	if err := p.Socket.applyFamily(p.AddressFamily, p.Host); err != nil {
+		sendFailure(writer, err)
+		return
+	}
+	if err := p.Socket.Validate(p.Host); err != nil {
+		sendFailure(writer, err)
+		return
+	}
+	if p.Type == "http" {
+		if err := validateHTTPOptions(p.HTTP); err != nil {
+			sendFailure(writer, err)
+			return
+		}
+	}
+	if p.Type == "ws" && p.Path != "" {
+		if err := validRoutePath(p.Path); err != nil {
+			sendFailure(writer, err)
+			return
+		}
+	}
+	if err := p.TLS.Validate(); err != nil {
+		sendFailure(writer, err)
+		return
+	}
+	filter, err := newAcceptFilter(p.AcceptFilterOptions)
+	if err != nil {
+		sendFailure(writer, err)
+		return
+	}
+
+	var failed bindFailure
+	defer failed.send(writer)
 	state.Mutex.Lock()
 	defer state.Mutex.Unlock()
 
-	if _, exists := state.Listeners[addr]; exists {
-		sendError(writer, fmt.Sprintf("Server already running on %s", addr))
+	if other := conflictLocked(addr, socketNetwork(p.Transport), socketFamily(p.Socket)); other != nil {
+		sendErrorCode(writer, ErrAlreadyRunning, message("common.server_already_running", "addr", addr),
+			map[string]interface{}{"addr": addr, "listener_id": other.ID})
 		return
 	}
 
-	ln, err := net.Listen("tcp", addr)
+	var certs *certStore
+	if p.TLS != nil {
+		var err error
+		if certs, err = newCertStore(*p.TLS); err != nil {
+			sendError(writer, message("main.failed_load_certificate", "error", err))
+			return
+		}
+	}
+	listen := func(addr string) (net.Listener, error) {
+		if p.Transport == "quic" {
+			return listenQUIC(p.Socket.udpNetwork(), addr)
+		}
+		ln, err := listenTCP(addr, p.Socket)
+		if err == nil && certs != nil {
+			ln = tlsListener(ln, certs)
+		}
+		return ln, err
+	}
+	ln, err := listen(addr)
 	if err != nil {
-		sendError(writer, fmt.Sprintf("Failed to bind %s: %v", addr, err))
+		certs.stop()
+		failed = bindFailure{addr, err}
 		return
 	}
+	// Port 0 lets the OS pick; record the port it actually got
+	port := listenerPort(ln)
+	addr = listenAddr(p.Host, port)
+	bound := map[string]interface{}{"addr": addr, "host": p.Host, "port": port, "transport": p.Transport}
+	if p.AddressFamily != "" {
+		bound["address_family"] = p.AddressFamily
+	}
 
-	state.Listeners[addr] = ln
+	l := &Listener{
+		Addr:          addr,
+		Type:          p.Type,
+		Transport:     p.Transport,
+		Limiter:       newRateLimiter(config.Get().RateLimits.Listener),
+		Encrypted:     p.Encrypted,
+		AllowUnpinned: p.AllowUnpinned,
+		Timeouts:      p.Timeouts.Apply(defaultTimeouts),
+		Gate:          &Gate{max: p.MaxConnections},
+		OverLimit:     p.OverLimit,
+		QueueTimeout:  queueTimeout,
+		Filter:        filter,
+		Compression:   p.Compression,
+		Auth:          newListenerAuth(p.Auth),
+		Drop:          p.Drop,
+		Storage:       dest.storage,
+		SOCKS:         p.SOCKS,
+		Media:         p.Media,
+		TLS:           certs,
+		Socket:        p.Socket,
+		ln:            ln,
+	}
+	if certs != nil {
+		if err := certs.start(addr); err != nil {
+			ln.Close()
+			sendError(writer, message("main.failed_watch_certificate", "error", err))
+			return
+		}
+		bound["tls"] = certs.Info()
+	}
+	if p.SFTP != nil {
+		if l.SFTP, err = newSSHServer(*p.SFTP, l); err != nil {
+			ln.Close()
+			sendError(writer, message("main.failed_set_up_ssh", "error", err))
+			return
+		}
+		bound["host_key_fingerprint"] = l.SFTP.fingerprint
+	}
+	if p.Serial != nil {
+		l.Serial = newSerialBridge(*p.Serial)
+		bound["serial"] = l.Serial.Info()
+	}
+	l.bind = func() (net.Listener, error) { return listen(l.Addr) }
+	l.assignID()
+	state.Listeners[l.ID] = l
+	setScope(l.ID, writer.Namespace())
+	bound["listener_id"] = l.ID
+	if l.Auth != nil {
+		bound["auth"] = true
+	}
+	if filter != nil {
+		bound["accept_filter"] = filter.Info()
+	}
+
+	if p.Type == "ws" {
+		path := p.Path
+		if path == "" {
+			path = "/"
+		}
+		goSafe("listener "+l.ID, func() { serveWebSocket(l, ln, path) })
+		logger.Info("server started", "addr", addr, "type", p.Type, "path", path)
+
+		bound["path"] = path
+		writer.Encode(okResponse(message("main.websocket_server_started", "url", addr+path), bound))
+		return
+	}
+
+	// Listeners without a dir follow set_download_dir
+	dir := downloadDirFor(p.Dir)
+
+	if p.Type == "http" {
+		bound["routes"], bound["dir"] = httpRoutes(p.HTTP), dir
+		goSafe("listener "+l.ID, func() { serveHTTP(l, ln, p.Dir, p.HTTP) })
+		logger.Info("server started", "addr", addr, "type", p.Type, "dir", dir)
+
+		writer.Encode(okResponse(message("main.http_server_started", "addr", addr), bound))
+		return
+	}
+
+	logger.Info("server started", "addr", addr, "type", p.Type, "transport", p.Transport)
 
 	// Start accepting connections in a goroutine
-	go func(listener net.Listener) {
-		for {
-			conn, err := listener.Accept()
-			if err != nil {
-				return // Listener closed
-			}
-			go handleConnection(conn)
-		}
-	}(ln)
-
-	writer.Encode(ProtocolResponse{
-		Status: "ok",
-		Message: fmt.Sprintf("Server started on %s", addr),
-	})
+	go serveListener(l, p.Dir)
+
+	if l.Storage != "" {
+		bound["storage"] = l.Storage
+	} else if p.Type == "transfer" || p.Type == "sftp" || p.Type == "mux" {
+		bound["dir"] = dir
+	}
+	writer.Encode(okResponse(message("main.server_started", "addr", addr), bound))
 }
 
-func handleStopServer(payload json.RawMessage, writer *json.Encoder) {
-	var p StartServerPayload
+func handleStopServer(payload json.RawMessage, writer *Output) {
+	var p StopServerPayload
 	if err := json.Unmarshal(payload, &p); err != nil {
-		sendError(writer, "Invalid payload for stop_server")
+		sendInvalidPayload(writer, "stop_server")
+		return
+	}
+	if p.TimeoutMs < 0 {
+		sendErrorCode(writer, ErrInvalidArgument, message("p2p.timeout_ms_must_not"), nil)
 		return
 	}
-
-	addr := fmt.Sprintf(":%d", p.Port)
 
 	state.Mutex.Lock()
-	defer state.Mutex.Unlock()
+	l, ok := findListenerLocked(p.ListenerRef, writer)
+	if !ok {
+		state.Mutex.Unlock()
+		return
+	}
+	report := DrainReport{ListenerID: l.ID, Addr: l.Addr}
+	var conns []*Connection
+	if p.Drain {
+		conns = listenerConnsLocked(l)
+	}
+	m := stopServerLocked(l)
+	state.Mutex.Unlock()
 
-	if ln, exists := state.Listeners[addr]; exists {
-		ln.Close()
-		delete(state.Listeners, addr)
-		writer.Encode(ProtocolResponse{Status: "ok", Message: "Server stopped"})
-	} else {
-		sendError(writer, "Server not found")
+	data := map[string]interface{}{"listener_id": report.ListenerID}
+	if !p.Drain {
+		writer.Encode(okResponse(m, data))
+		return
+	}
+	timeout := defaultDrainTimeout
+	if p.TimeoutMs > 0 {
+		timeout = time.Duration(p.TimeoutMs) * time.Millisecond
+	}
+	data["draining"] = len(conns)
+	data["timeout_ms"] = timeout.Milliseconds()
+	writer.Encode(okResponse(m, data))
+
+	go func() {
+		report = drainConns(report, conns, timeout)
+		logger.Info("server drained", "listener", report.ListenerID, "connections", report.Connections, "force_closed", report.ForceClosed)
+		emitEvent("server_drained", report)
+	}()
+}
+
+// stopServerLocked closes a listener, or the relay it belongs to, and
+// says which; the caller holds state.Mutex
+func stopServerLocked(l *Listener) Message {
+	if l.relay != nil {
+		l.relay.stopLocked()
+		return message("relay.stopped")
 	}
+	l.ln.Close()
+	l.TLS.stop()
+	delete(state.Listeners, l.ID)
+	dropScope(l.ID)
+	logger.Info("server stopped", "id", l.ID, "addr", l.Addr)
+	return message("main.server_stopped")
 }
 
-func handleStatus(writer *json.Encoder) {
+func handleStatus(writer *Output) {
+	data := statusData(writer.Namespace())
+	data["seq"] = statusTrackerFor(writer.Namespace()).observe(data).seq
+	writer.Encode(ProtocolResponse{Status: "ok", Data: data})
+}
+
+// statusData is the status of what namespace ns can see
+func statusData(ns string) map[string]interface{} {
 	state.Mutex.Lock()
 	defer state.Mutex.Unlock()
 
+	open := make(map[string]int)
+	var inBps, outBps float64
+	var conns, encrypted int
+	var rekeys uint64
+	for _, c := range state.Conns {
+		if !visible(scopeOf(c.ID), ns) {
+			continue
+		}
+		conns++
+		inBps += c.In.Rate()
+		outBps += c.Out.Rate()
+		if c.ListenerID != "" {
+			open[c.ListenerID]++
+		}
+		if s := secureOf(c.Conn()); s != nil {
+			encrypted++
+			rekeys += s.Session().Rekeys
+		}
+	}
+
 	active := []string{}
-	for addr := range state.Listeners {
-		active = append(active, addr)
+	listeners := []map[string]interface{}{}
+	for id, l := range state.Listeners {
+		if !visible(scopeOf(id), ns) {
+			continue
+		}
+		active = append(active, l.Addr)
+		entry := map[string]interface{}{
+			"listener_id":     id,
+			"addr":            l.Addr,
+			"type":            l.Type,
+			"transport":       l.Transport,
+			"health":          l.health(),
+			"connections":     open[id],
+			"timeouts":        l.Timeouts,
+			"socket":          l.Socket,
+			"accepted":        l.Accepted.Load(),
+			"refused":         l.Refused.Load(),
+			"max_connections": l.Gate.Max(),
+			"auth":            l.Auth != nil,
+			"drop":            l.Drop != nil,
+			"bytes_in":        l.BytesIn.Load(),
+			"bytes_out":       l.BytesOut.Load(),
+			"bytes_per_sec":   l.Limiter.Rate(),
+			"in_bps":          l.In.Rate(),
+			"out_bps":         l.Out.Rate(),
+		}
+		if l.TLS != nil {
+			entry["tls"] = l.TLS.Info()
+		}
+		if l.Filter != nil {
+			entry["accept_filter"] = l.Filter.Info()
+		}
+		if l.Profile != "" {
+			entry["profile"] = l.Profile
+		}
+		if scope := scopeOf(id); scope != "" {
+			entry["namespace"] = scope
+		}
+		if sim := l.sim.Load(); sim != nil {
+			entry["netem"] = sim.Info("listener")
+		}
+		if l.SFTP != nil {
+			entry["host_key_fingerprint"] = l.SFTP.fingerprint
+		}
+		if l.Serial != nil {
+			entry["serial"] = l.Serial.Info()
+		}
+		listeners = append(listeners, entry)
 	}
 
-	writer.Encode(ProtocolResponse{
-		Status: "ok",
-		Data: map[string]interface{}{
-			"active_servers": active,
-			"goroutines":     1, // Placeholder
-		},
-	})
+	data := map[string]interface{}{
+		"active_servers":   active,
+		"listeners":        listeners,
+		"connections":      conns,
+		"in_bps":           inBps,
+		"max_connections":  globalGate.Max(),
+		"out_bps":          outBps,
+		"panics_recovered": panicsRecovered.Load(),
+		"peer_links":       peerLatencies(false),
+		"power":            power.Info(),
+		"sleep":            sleeper.Info(),
+		"sessions":         map[string]interface{}{"encrypted": encrypted, "rekeys": rekeys},
+	}
+	for k, v := range metrics.Snapshot() {
+		data[k] = v
+	}
+	return data
 }
 
-func handleConnection(conn net.Conn) {
-	defer conn.Close()
-	// Basic echo for now, or custom protocol logic
-	// In a real scenario, this would handle high-speed data transfer
-	buffer := make([]byte, 4096)
-	conn.SetReadDeadline(time.Now().Add(30 * time.Second))
-	
-	for {
-		n, err := conn.Read(buffer)
-		if err != nil {
+// serveInbound secures and authenticates an accepted connection if required
+// and hands it to the handler for the listener's type
+func serveInbound(c *Connection, l *Listener, dir string) {
+	defer recoverConn(c)
+	if err := handshakeTLS(c); err != nil {
+		logger.Warn("TLS handshake failed", "id", c.ID, "listener", l.Addr, "error", err)
+		untrackConn(c)
+		return
+	}
+	if l.Encrypted {
+		if err := secureInbound(c, l); err != nil {
+			logger.Warn("encrypted handshake failed", "id", c.ID, "listener", l.Addr, "error", err)
+			untrackConn(c)
+			return
+		}
+	}
+	if l.Auth != nil {
+		if err := authInbound(c, l); err != nil {
+			untrackConn(c)
+			return
+		}
+	}
+	if l.Compression {
+		if err := compressInbound(c); err != nil {
+			logger.Warn("compression negotiation failed", "id", c.ID, "listener", l.Addr, "error", err)
+			untrackConn(c)
 			return
 		}
-		// Echo back
-		conn.Write(buffer[:n])
 	}
+
+	connHandlers[l.Type].serve(c, l, dir)
+}
+
+// listenAddr builds the bind address for a listener
+func listenAddr(host string, port int) string {
+	return net.JoinHostPort(normalizeHost(host), strconv.Itoa(port))
 }
 
-func sendError(writer *json.Encoder, msg string) {
-	writer.Encode(ProtocolResponse{Status: "error", Message: msg})
+// emitEvent pushes an unsolicited event; safe to call from any goroutine
+func emitEvent(event string, data interface{}) {
+	ev := ProtocolEvent{Status: "event", Event: event, Data: data, Namespace: eventNamespace(data)}
+	eventLog.record(&ev)
+	output.Encode(ev)
+	broadcastControl(ev)
+	broadcastGRPC(ev)
+	forwardWebhooks(ev)
 }
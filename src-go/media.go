@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Media relay: a "media" listener forwards continuous streams such as a
+// screen share or camera feed that the frontend produces. Peers connect,
+// name the stream they want in one JSON line and, once acked, receive its
+// frames as they are published with publish_media_frame. Each frame goes
+// out as a 4-byte big-endian length, a flags byte and the frame; an empty
+// frame is a keepalive. Latency matters more than completeness, so every
+// subscriber has a short queue instead of an unbounded buffer. When it is
+// full the subscriber drops frames: on streams that mark keyframes it skips
+// ahead to the next one, since the frames in between cannot be decoded
+// without what was lost, and on other streams it drops its oldest frame.
+const (
+	defaultMediaStream    = "default"
+	defaultMediaQueue     = 8   // frames held for a subscriber
+	maxMediaQueue         = 256 // frames a listener may ask to hold
+	maxMediaFrame         = defaultMaxMessageSize
+	mediaFrameHeader      = 5
+	mediaKeepalive        = 15 * time.Second
+	mediaWriteTimeout     = 10 * time.Second // a subscriber this stuck is dropped
+	mediaHandshakeTimeout = 30 * time.Second
+	maxMediaRequest       = 4 << 10 // a subscriber's request line
+)
+
+// Media frame flags
+const mediaFlagKeyframe = 1 << 0
+
+// MediaOptions configure a "media" listener
+type MediaOptions struct {
+	Streams        []string `json:"streams"`         // streams it serves, empty for any
+	QueueFrames    int      `json:"queue_frames"`    // frames held per subscriber, default 8
+	MaxSubscribers int      `json:"max_subscribers"` // per stream, 0 for unlimited
+}
+
+func (o *MediaOptions) Validate() error {
+	if o == nil {
+		return nil
+	}
+	if o.QueueFrames < 0 || o.QueueFrames > maxMediaQueue {
+		return catalogError(ErrInvalidArgument, "media.queue_frames_must_between", "max", maxMediaQueue)
+	}
+	if o.MaxSubscribers < 0 {
+		return catalogError(ErrInvalidArgument, "media.max_subscribers_must_not")
+	}
+	for _, s := range o.Streams {
+		if s == "" {
+			return catalogError(ErrInvalidArgument, "media.streams_must_not_contain")
+		}
+	}
+	return nil
+}
+
+// mediaRequest is the line a media subscriber opens with
+type mediaRequest struct {
+	Stream string `json:"stream"` // default "default"
+}
+
+type mediaFrame struct {
+	data []byte
+	key  bool
+}
+
+// mediaSubscriber is one peer receiving a stream
+type mediaSubscriber struct {
+	id       string // the connection's ID
+	stream   string
+	remote   string
+	peer     string
+	listener string
+	joined   time.Time
+	frames   chan mediaFrame
+	kick     chan struct{}
+	kickOnce sync.Once
+
+	mu      sync.Mutex
+	waitKey bool // skipping frames until the next keyframe
+	sent    uint64
+	bytes   uint64
+	dropped uint64
+}
+
+// MediaSubscriberInfo is the JSON view of a subscriber
+type MediaSubscriberInfo struct {
+	ID       string    `json:"id"` // connection ID, for kick_media_subscriber
+	Stream   string    `json:"stream"`
+	Remote   string    `json:"remote"`
+	Peer     string    `json:"peer,omitempty"` // discovered instance at that address
+	Listener string    `json:"listener_id"`
+	Joined   time.Time `json:"joined"`
+	Frames   uint64    `json:"frames"`
+	Bytes    uint64    `json:"bytes"`
+	Dropped  uint64    `json:"dropped"`
+	Queued   int       `json:"queued"`
+	Waiting  bool      `json:"waiting_for_keyframe,omitempty"`
+}
+
+func (s *mediaSubscriber) Info() MediaSubscriberInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return MediaSubscriberInfo{
+		ID: s.id, Stream: s.stream, Remote: s.remote, Peer: s.peer, Listener: s.listener, Joined: s.joined,
+		Frames: s.sent, Bytes: s.bytes, Dropped: s.dropped, Queued: len(s.frames), Waiting: s.waitKey,
+	}
+}
+
+// offer queues f without ever blocking the publisher and reports whether
+// it was queued. keyed says whether the stream marks keyframes.
+func (s *mediaSubscriber) offer(f mediaFrame, keyed bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.waitKey {
+		if !f.key {
+			s.dropped++
+			return false
+		}
+		s.waitKey = false
+	}
+	for {
+		select {
+		case s.frames <- f:
+			return true
+		default:
+		}
+		switch {
+		case f.key:
+			// Nothing queued is needed once this frame is decoded
+			s.dropped += uint64(drainFrames(s.frames))
+		case keyed:
+			s.dropped++
+			s.waitKey = true
+			return false
+		default:
+			select {
+			case <-s.frames:
+				s.dropped++
+			default:
+			}
+		}
+	}
+}
+
+func drainFrames(frames chan mediaFrame) int {
+	for n := 0; ; n++ {
+		select {
+		case <-frames:
+		default:
+			return n
+		}
+	}
+}
+
+func (s *mediaSubscriber) sentFrame(n int) {
+	s.mu.Lock()
+	s.sent++
+	s.bytes += uint64(n)
+	s.mu.Unlock()
+}
+
+func (s *mediaSubscriber) disconnect() {
+	s.kickOnce.Do(func() { close(s.kick) })
+}
+
+// mediaRelay holds the subscribers of every media listener
+type mediaRelay struct {
+	mu    sync.Mutex
+	subs  map[string]*mediaSubscriber
+	keyed map[string]bool // streams that have published a keyframe
+}
+
+var media = mediaRelay{subs: make(map[string]*mediaSubscriber), keyed: make(map[string]bool)}
+
+// join adds a subscriber unless the stream already has max of them
+func (m *mediaRelay) join(s *mediaSubscriber, max int) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if max > 0 && len(m.streamLocked(s.stream)) >= max {
+		return false
+	}
+	// A late joiner cannot decode anything before the next keyframe
+	s.waitKey = m.keyed[s.stream]
+	m.subs[s.id] = s
+	return true
+}
+
+func (m *mediaRelay) leave(s *mediaSubscriber) {
+	m.mu.Lock()
+	delete(m.subs, s.id)
+	m.mu.Unlock()
+}
+
+func (m *mediaRelay) streamLocked(stream string) []*mediaSubscriber {
+	var subs []*mediaSubscriber
+	for _, s := range m.subs {
+		if stream == "" || s.stream == stream {
+			subs = append(subs, s)
+		}
+	}
+	return subs
+}
+
+// publish hands f to every subscriber of stream and returns how many
+// queued and how many dropped it
+func (m *mediaRelay) publish(stream string, f mediaFrame) (queued, dropped int) {
+	m.mu.Lock()
+	if f.key {
+		m.keyed[stream] = true
+	}
+	keyed := m.keyed[stream]
+	subs := m.streamLocked(stream)
+	m.mu.Unlock()
+	for _, s := range subs {
+		if s.offer(f, keyed) {
+			queued++
+		} else {
+			dropped++
+		}
+	}
+	return queued, dropped
+}
+
+func (m *mediaRelay) list(stream string) []MediaSubscriberInfo {
+	m.mu.Lock()
+	subs := m.streamLocked(stream)
+	m.mu.Unlock()
+	list := make([]MediaSubscriberInfo, 0, len(subs))
+	for _, s := range subs {
+		list = append(list, s.Info())
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Joined.Before(list[j].Joined) })
+	return list
+}
+
+// writeMediaFrame writes one frame in the wire format
+func writeMediaFrame(w io.Writer, f mediaFrame) error {
+	buf := make([]byte, mediaFrameHeader+len(f.data))
+	binary.BigEndian.PutUint32(buf, uint32(len(f.data)))
+	if f.key {
+		buf[4] = mediaFlagKeyframe
+	}
+	copy(buf[mediaFrameHeader:], f.data)
+	_, err := w.Write(buf)
+	return err
+}
+
+// handleMediaConnection relays one stream to a subscriber until either
+// side hangs up or it is kicked
+func handleMediaConnection(c *Connection, l *Listener, _ string) {
+	defer untrackConn(c)
+
+	reader := bufio.NewReader(c)
+	c.SetReadDeadline(time.Now().Add(mediaHandshakeTimeout))
+	line, err := readLineLimit(reader, maxMediaRequest)
+	if err != nil {
+		return
+	}
+	c.SetReadDeadline(time.Time{})
+	var req mediaRequest
+	if err := json.Unmarshal(line, &req); err != nil {
+		writeAck(c, errors.New("invalid media request"))
+		return
+	}
+	if req.Stream == "" {
+		req.Stream = defaultMediaStream
+	}
+	opts := MediaOptions{}
+	if l.Media != nil {
+		opts = *l.Media
+	}
+	if len(opts.Streams) > 0 && !slices.Contains(opts.Streams, req.Stream) {
+		writeAck(c, errors.New("no such stream: "+req.Stream))
+		return
+	}
+	if opts.QueueFrames == 0 {
+		opts.QueueFrames = defaultMediaQueue
+	}
+
+	info := c.Info()
+	sub := &mediaSubscriber{
+		id:       c.ID,
+		stream:   req.Stream,
+		remote:   info.RemoteAddr,
+		listener: l.ID,
+		joined:   time.Now(),
+		frames:   make(chan mediaFrame, opts.QueueFrames),
+		kick:     make(chan struct{}),
+	}
+	sub.peer, _ = discoveredPeer(info.RemoteAddr)
+	if !media.join(sub, opts.MaxSubscribers) {
+		writeAck(c, errors.New("stream has too many subscribers"))
+		return
+	}
+	defer media.leave(sub)
+	logger.Info("media subscriber joined", "id", c.ID, "stream", req.Stream, "remote", info.RemoteAddr)
+	emitEvent("media_subscriber_joined", sub.Info())
+	writeAck(c, nil)
+
+	// The subscriber sends nothing more; a read that returns means it hung up
+	gone := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, reader)
+		close(gone)
+	}()
+
+	left := func(reason string, err error) {
+		data := map[string]interface{}{"subscriber": sub.Info(), "reason": reason}
+		if err != nil {
+			data["error"] = err.Error()
+		}
+		logger.Info("media subscriber left", "id", c.ID, "stream", req.Stream, "reason", reason)
+		emitEvent("media_subscriber_left", data)
+	}
+	keepalive := time.NewTicker(mediaKeepalive)
+	defer keepalive.Stop()
+	for {
+		var f mediaFrame
+		select {
+		case <-gone:
+			left("closed", nil)
+			return
+		case <-sub.kick:
+			c.Abort()
+			<-gone
+			left("kicked", nil)
+			return
+		case <-keepalive.C:
+		case f = <-sub.frames:
+		}
+		c.SetWriteDeadline(time.Now().Add(mediaWriteTimeout))
+		if err := writeMediaFrame(c, f); err != nil {
+			c.Abort()
+			<-gone
+			left("error", err)
+			return
+		}
+		if f.data != nil {
+			sub.sentFrame(len(f.data))
+		}
+	}
+}
+
+type PublishMediaFramePayload struct {
+	Stream   string `json:"stream"`   // default "default"
+	Data     string `json:"data"`     // base64 frame
+	Keyframe bool   `json:"keyframe"` // decodable on its own; late and lagging subscribers start here
+}
+
+// handlePublishMediaFrame relays one frame to the stream's subscribers
+func handlePublishMediaFrame(payload json.RawMessage, writer *Output) {
+	var p PublishMediaFramePayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		sendInvalidPayload(writer, "publish_media_frame")
+		return
+	}
+	if p.Stream == "" {
+		p.Stream = defaultMediaStream
+	}
+	data, err := base64.StdEncoding.DecodeString(p.Data)
+	if err != nil {
+		sendErrorCode(writer, ErrInvalidArgument, message("common.invalid_base64_data"), nil)
+		return
+	}
+	if len(data) == 0 || len(data) > maxMediaFrame {
+		sendErrorCode(writer, ErrInvalidArgument, message("media.media_frames_must_between", "max", maxMediaFrame), nil)
+		return
+	}
+
+	queued, dropped := media.publish(p.Stream, mediaFrame{data: data, key: p.Keyframe})
+	writer.Encode(ProtocolResponse{
+		Status: "ok",
+		Data:   map[string]interface{}{"stream": p.Stream, "queued": queued, "dropped": dropped},
+	})
+}
+
+type ListMediaSubscribersPayload struct {
+	Stream string `json:"stream"` // empty for every stream
+}
+
+func handleListMediaSubscribers(payload json.RawMessage, writer *Output) {
+	var p ListMediaSubscribersPayload
+	if len(payload) > 0 && string(payload) != "null" {
+		if err := json.Unmarshal(payload, &p); err != nil {
+			sendInvalidPayload(writer, "list_media_subscribers")
+			return
+		}
+	}
+	writer.Encode(ProtocolResponse{
+		Status: "ok",
+		Data:   map[string]interface{}{"subscribers": media.list(p.Stream)},
+	})
+}
+
+type KickMediaSubscriberPayload struct {
+	ID string `json:"id" required:"true"`
+}
+
+// handleKickMediaSubscriber disconnects one subscriber
+func handleKickMediaSubscriber(payload json.RawMessage, writer *Output) {
+	var p KickMediaSubscriberPayload
+	if err := json.Unmarshal(payload, &p); err != nil || p.ID == "" {
+		sendErrorCode(writer, ErrInvalidArgument, message("media.kick_media_subscriber_requires_id"), nil)
+		return
+	}
+	media.mu.Lock()
+	sub, ok := media.subs[p.ID]
+	media.mu.Unlock()
+	if !ok {
+		sendErrorCode(writer, ErrNotFound, message("media.media_subscriber_not_found", "id", p.ID), nil)
+		return
+	}
+	sub.disconnect()
+	writer.Encode(okResponse(message("media.media_subscriber_kicked"), map[string]interface{}{"id": p.ID, "stream": sub.stream}))
+}
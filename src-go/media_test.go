@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func newTestSubscriber(id, stream string, queue int) *mediaSubscriber {
+	return &mediaSubscriber{id: id, stream: stream, frames: make(chan mediaFrame, queue), kick: make(chan struct{})}
+}
+
+func TestMediaBackpressure(t *testing.T) {
+	// Without keyframes a full queue drops its oldest frame
+	plain := newTestSubscriber("media-plain", "audio", 2)
+	if !media.join(plain, 0) {
+		t.Fatal("join refused")
+	}
+	defer media.leave(plain)
+	for _, b := range []byte("abc") {
+		media.publish("audio", mediaFrame{data: []byte{b}})
+	}
+	if got := string((<-plain.frames).data) + string((<-plain.frames).data); got != "bc" || plain.Info().Dropped != 1 {
+		t.Errorf("plain stream kept %q, dropped %d", got, plain.Info().Dropped)
+	}
+
+	// With keyframes it skips to the next one
+	video := newTestSubscriber("media-video", "screen", 2)
+	media.join(video, 0)
+	defer media.leave(video)
+	media.publish("screen", mediaFrame{data: []byte("K1"), key: true})
+	media.publish("screen", mediaFrame{data: []byte("d1")})
+	media.publish("screen", mediaFrame{data: []byte("d2")})
+	if !video.Info().Waiting {
+		t.Error("full subscriber not waiting for a keyframe")
+	}
+	media.publish("screen", mediaFrame{data: []byte("d3")})
+	media.publish("screen", mediaFrame{data: []byte("K2"), key: true})
+	if info := video.Info(); info.Waiting || info.Queued != 1 || info.Dropped != 4 {
+		t.Errorf("after keyframe %+v", info)
+	}
+	if f := <-video.frames; string(f.data) != "K2" || !f.key {
+		t.Errorf("queued %q", f.data)
+	}
+
+	// Late joiners start at a keyframe and the cap holds
+	late := newTestSubscriber("media-late", "screen", 2)
+	if !media.join(late, 2) || !late.Info().Waiting {
+		t.Error("late joiner not waiting for a keyframe")
+	}
+	defer media.leave(late)
+	if media.join(newTestSubscriber("media-extra", "screen", 2), 2) {
+		t.Error("joined past max_subscribers")
+	}
+}
+
+func TestWriteMediaFrame(t *testing.T) {
+	var buf bytes.Buffer
+	writeMediaFrame(&buf, mediaFrame{data: []byte("hi"), key: true})
+	writeMediaFrame(&buf, mediaFrame{})
+	if want := []byte{0, 0, 0, 2, mediaFlagKeyframe, 'h', 'i', 0, 0, 0, 0, 0}; !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("wire % x", buf.Bytes())
+	}
+}
+
+func TestMediaRefusesOversizedRequest(t *testing.T) {
+	savedOutput := output
+	output = NewOutput(io.Discard)
+	t.Cleanup(func() { output = savedOutput })
+
+	resp := harnessCall(t, handleStartServer, `{"host":"127.0.0.1","port":0,"type":"media"}`)
+	data := resp.Data.(map[string]interface{})
+	t.Cleanup(func() { harnessCall(t, handleStopServer, `{"listener_id":"`+data["listener_id"].(string)+`"}`) })
+	conn, err := net.DialTimeout("tcp", data["addr"].(string), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// A request line that never ends is cut off at the bound
+	go conn.Write(bytes.Repeat([]byte("x"), 2*maxMediaRequest))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("connection still open: %v", err)
+	}
+}
@@ -0,0 +1,588 @@
+package main
+
+// messageCatalog is every message responses carry, in English, by a
+// stable key. {name} is a placeholder filled from the response's
+// message_args, and {{ and }} are literal braces. A message that changes
+// meaning gets a new key rather than new text under the old one; a
+// message that is not listed goes out without a key.
+var messageCatalog = map[string]string{
+	"archive.extract_archive_requires_password":     "extract_archive requires password for an encrypted archive",
+	"archive.extract_archive_requires_path":         "extract_archive requires path",
+	"archive.extracted":                             "Archive extracted",
+	"archive.failed_extract":                        "Failed to extract {path}: {error}",
+	"archive.nothing_archive":                       "Nothing to archive",
+	"archive.password_requires_format_zip":          "password requires format zip",
+	"archive.send_archive_requires_host":            "send_archive requires host, port and paths",
+	"archive.tar_zst_level_must":                    "tar.zst level must be between 1 and 22",
+	"archive.two_paths_named":                       "Two paths are named {base}",
+	"archive.unsupported_archive":                   "Unsupported archive: {archive}",
+	"archive.unsupported_archive_format":            "Unsupported archive format: {format}",
+	"archive.wrong_archive_password":                "Wrong archive password",
+	"archive.zip_level_must_between":                "zip level must be between 1 and 9",
+	"audit.audit_log_not_open":                      "The audit log is not open",
+	"audit.failed_read_audit_log":                   "Failed to read the audit log: {error}",
+	"audit.limit_must_between":                      "limit must be between 0 and {max}",
+	"audit.max_size_max_backups_must":               "audit.max_size and audit.max_backups must not be negative",
+	"auth.authentication_required":                  "Authentication required",
+	"auth.failed_issue_token":                       "Failed to issue token: {error}",
+	"auth.server_does_not_accept":                   "Server does not accept tokens; start it with auth.tokens",
+	"auth.server_does_not_require":                  "Server does not require authentication",
+	"auth.takes_secret_or_token":                    "auth takes a secret or a token, not both",
+	"auth.token_not_found":                          "Token not found",
+	"auth.token_revoked":                            "Token revoked",
+	"auth.uses_must_not_negative":                   "uses must not be negative",
+	"backends.accept_dir_or_storage":                "accept_offer takes dir or storage, not both",
+	"backends.backend_not_found":                    "Storage backend not found: {name}",
+	"backends.local_requires_dir":                   "a local storage backend requires dir",
+	"backends.names_not_empty":                      "storage_backends names must not be empty",
+	"backends.s3_requires":                          "an s3 storage backend requires bucket, access_key and secret_key",
+	"backends.single_files_only":                    "storage backend {name} takes single files only",
+	"backends.storage_requires_transfer":            "storage requires a transfer listener",
+	"backends.transfer_dir_or_storage":              "A transfer listener takes dir or storage, not both",
+	"backends.unsupported_type":                     "Unsupported storage backend type: {type}",
+	"backends.url_must_http":                        "{field} must be an http or https URL",
+	"batching.failed_flush_output":                  "Failed to flush output: {error}",
+	"batching.field_must_between":                   "{field} must be between 0 and {max}",
+	"catalog.locale_set":                            "Locale set to {locale}",
+	"catalog.message_key_not_found":                 "Message key not found: {key}",
+	"catalog.messages_must_hold_most":               "messages must hold at most {max_locale_messages} translations",
+	"catalog.set_locale_requires_locale":            "set_locale requires a locale such as uk or ja-JP",
+	"chat.connection_does_not_speak":                "Connection does not speak the chat protocol",
+	"chat.failed_send_message":                      "Failed to send message on {id}: {error}",
+	"chat.history_cleared":                          "Chat history cleared",
+	"chat.keeping_messages_per_peer":                "Keeping {limit} messages per peer",
+	"chat.message_exceeds_bytes":                    "Message exceeds {max_chat_message} bytes",
+	"chat.message_sent_connections":                 "Message sent to {messages} connections",
+	"chat.set_chat_history_requires":                "set_chat_history requires a non-negative limit",
+	"client.authentication_requires_tcp_connection": "Authentication requires a tcp connection",
+	"client.compression_requires_tcp_connection":    "Compression requires a tcp connection",
+	"client.connect_requires_host_port":             "connect requires host and port, or mux",
+	"client.connected_addr":                         "Connected to {addr}",
+	"client.connection_closed":                      "Connection closed",
+	"client.encryption_requires_tcp_connection":     "Encryption requires a tcp connection",
+	"client.failed_send":                            "Failed to send on {id}: {error}",
+	"client.reconnect_backoff_must_least":           "reconnect backoff must be at least 1",
+	"client.reconnect_jitter_must_between":          "reconnect jitter must be between 0 and 1, or -1 for none",
+	"client.reconnect_max_retries_delay":            "reconnect max_retries, delay_ms and max_delay_ms must not be negative",
+	"client.sending_side_shut":                      "Connection's sending side is shut down",
+	"client.service_requires_mux":                   "service requires mux",
+	"client.unsupported_connection_type":            "Unsupported connection type: {network}",
+	"clipboard.item_exceeds_bytes":                  "Clipboard item exceeds {max_clipboard_size} bytes",
+	"clipboard.peer_not_found":                      "Peer not found: {peer}",
+	"clipboard.push_started":                        "Clipboard push started",
+	"clipboard.push_text_requires_text":             "push_text requires text",
+	"clipboard.requires_host_peer_port":             "{command} requires host or peer, and port",
+	"clipboard.text_exceeds_bytes":                  "Text exceeds {max_snippet_size} bytes",
+	"clipboard.text_push_started":                   "Text push started",
+	"clipboard.unsupported_clipboard_kind":          "Unsupported clipboard kind: {kind}",
+	"clock.warn_seconds_must_not":                   "clock_skew.warn_seconds must not be negative, except -1 to turn warnings off",
+	"common.bytes_per_sec_must":                     "bytes_per_sec must not be negative",
+	"common.concurrency_must_most":                  "concurrency must be at most {max_lan_concurrency}",
+	"common.connection_not_found":                   "Connection not found",
+	"common.error":                                  "{error}",
+	"common.failed_advertise":                       "Failed to advertise {service}: {error}",
+	"common.failed_connect":                         "Failed to connect to {addr}: {error}",
+	"common.failed_create":                          "Failed to create {dir}: {error}",
+	"common.failed_open":                            "Failed to open {path}: {error}",
+	"common.failed_open_udp_socket":                 "Failed to open UDP socket: {error}",
+	"common.failed_read":                            "Failed to read {path}: {error}",
+	"common.invalid_base64_data":                    "Invalid base64 data",
+	"common.invalid_candidate":                      "Invalid candidate {addr}: {error}",
+	"common.invalid_hex_data":                       "Invalid hex data",
+	"common.invalid_payload":                        "Invalid payload for {command}",
+	"common.job_canceled":                           "Job canceled",
+	"common.max_connections_must_not":               "max_connections must not be negative",
+	"common.mux_link_not_found":                     "Mux link not found: {id}",
+	"common.not_directory":                          "Not a directory: {dir}",
+	"common.not_regular_file":                       "Not a regular file: {path}",
+	"common.server_already_running":                 "Server already running on {addr}",
+	"common.server_id_not_found":                    "Server not found: {listener_id}",
+	"common.server_not_found":                       "Server not found",
+	"common.service_shutting_down":                  "Service is shutting down",
+	"common.transfer_not_found":                     "Transfer not found",
+	"common.transfer_started":                       "Transfer started",
+	"common.unknown_log_level":                      "Unknown log level: {level}",
+	"common.unsupported_address_family":             "Unsupported address_family: {address_family}",
+	"common.unsupported_encoding":                   "Unsupported encoding: {encoding}",
+	"common.unsupported_network":                    "Unsupported network: {network}",
+	"common.unsupported_protocol":                   "Unsupported protocol: {protocol}",
+	"common.unsupported_transport":                  "Unsupported transport: {transport}",
+	"compress.gzip_level_must_between":              "gzip level must be between 1 and 9",
+	"compress.zstd_level_must_between":              "zstd level must be between 1 and 22",
+	"config.failed_save_config":                     "Failed to save config: {error}",
+	"config.invalid_config":                         "Invalid config: {error}",
+	"config.invalid_locale":                         "Invalid locale: {locale}",
+	"config.rate_limits_must_not":                   "rate limits must not be negative",
+	"config.saved":                                  "Config saved to {path}",
+	"config.saved_but_not_applied":                  "Config saved but not applied: {error}",
+	"control.failed_start_control_socket":           "Failed to start control socket: {error}",
+	"control.invalid_json_format":                   "Invalid JSON format",
+	"control.socket_listening":                      "Control socket listening on {path}",
+	"control.socket_not_running":                    "Control socket not running",
+	"control.socket_stopped":                        "Control socket stopped",
+	"crash.internal_error":                          "Internal error in {command}",
+	"crypto.failed_generate_keypair":                "Failed to generate keypair: {error}",
+	"crypto.failed_load_keypair":                    "Failed to load keypair: {error}",
+	"crypto.failed_read_keypair":                    "Failed to read keypair: {error}",
+	"crypto.failed_save_identity":                   "Failed to save identity: {error}",
+	"crypto.failed_save_keypair":                    "Failed to save keypair: {error}",
+	"crypto.invalid_private_key":                    "Invalid private key: {error}",
+	"crypto.keypair_generated":                      "Keypair generated",
+	"crypto.keypair_imported":                       "Keypair imported",
+	"crypto.no_key_pinned":                          "No key pinned for {name}",
+	"crypto.pin_peer_key_requires":                  "pin_peer_key requires name",
+	"crypto.pinned_key":                             "Pinned key for {name}",
+	"crypto.private_key_must_base64":                "Private key must be base64",
+	"crypto.public_key_must_32":                     "public key must be 32 bytes of base64",
+	"crypto.unpinned_key":                           "Unpinned key for {name}",
+	"daemon.detached_attach_through":                "Detached; attach through {path}",
+	"daemon.failed_detach":                          "Failed to detach: {error}",
+	"daemon.replayed_events":                        "Replayed {events} events",
+	"dedup.cache_cleared":                           "Dedup cache cleared",
+	"dedup.failed_clear_dedup_cache":                "Failed to clear the dedup cache: {error}",
+	"dirtransfer.send_directory_requires_path":      "send_directory requires path, and host and port or mux",
+	"dirtransfer.unsupported_conflict_policy":       "Unsupported conflict policy: {conflict}",
+	"discovery.already_running":                     "Discovery already running",
+	"discovery.not_running":                         "Discovery not running",
+	"discovery.started":                             "Discovery started for {service}",
+	"discovery.stopped":                             "Discovery stopped",
+	"dns.benchmark_requires_servers":                "dns_benchmark requires servers",
+	"dns.benchmark_takes_most_servers":              "dns_benchmark takes at most {max_benchmark_servers} servers",
+	"dns.resolve_requires_name":                     "resolve requires name",
+	"dns.reverse_lookup_requires_ip":                "reverse_lookup requires an IP address",
+	"dns.rounds_must_most":                          "rounds must be at most {max_benchmark_rounds}",
+	"dns.unsupported_record_type":                   "Unsupported record type: {type}",
+	"doctor.unsupported_check":                      "Unsupported check: {name}",
+	"download.download_started":                     "Download started",
+	"download.download_url_requires_http":           "download_url requires an http or https url",
+	"download.segments_must_between":                "segments must be between 0 and {max_download_segments}",
+	"drop.mode_already_enabled":                     "Drop mode already enabled on {addr}",
+	"drop.mode_disabled":                            "Drop mode disabled",
+	"drop.mode_enabled":                             "Drop mode enabled on {addr}",
+	"drop.mode_not_enabled":                         "Drop mode not enabled",
+	"drop.offer_accepted":                           "Offer accepted",
+	"drop.offer_not_found":                          "Offer not found",
+	"drop.offer_rejected":                           "Offer rejected",
+	"errors.failed_bind":                            "Failed to bind {addr}: {error}",
+	"firewall.change_discarded":                     "Firewall change discarded",
+	"firewall.change_needs_confirmation":            "Firewall change needs confirmation",
+	"firewall.change_not_found":                     "Firewall change not found: {id}",
+	"firewall.failed_change_firewall":               "Failed to change the firewall: {error}",
+	"firewall.failed_find_program_path":             "Failed to find this program's path for socketfilterfw",
+	"firewall.requires_listener_or_port":            "{command} requires listener_id or a port",
+	"firewall.rule_added":                           "Firewall rule added",
+	"firewall.rule_removed":                         "Firewall rule removed",
+	"firewall.rules_not_supported":                  "Firewall rules are not supported on {os}",
+	"firewall.unsupported_backend":                  "Unsupported firewall backend on {os}: {backend}",
+	"foldersync.failed_watch":                       "Failed to watch {path}: {error}",
+	"foldersync.start_sync_requires_host":           "start_sync requires host, port and path",
+	"foldersync.stop_sync_requires_id":              "stop_sync requires id",
+	"foldersync.stopping_id":                        "Stopping {id}",
+	"foldersync.sync_not_running":                   "Sync not running: {id}",
+	"foldersync.sync_started":                       "Sync started",
+	"framing.set":                                   "Framing set to {mode}",
+	"framing.unsupported_framing_mode":              "Unsupported framing mode: {mode}",
+	"geoip.databases_must_not_contain":              "geoip.databases must not contain an empty path",
+	"geoip.invalid_ip_address":                      "Invalid IP address: {ip}",
+	"geoip.lookup_ip_requires_ip":                   "lookup_ip requires ip",
+	"geoip.no_geoip_databases_configured":           "No GeoIP databases are configured",
+	"groups.add_peer_group_requires":                "add_peer_to_group requires group and peer",
+	"groups.broadcast_file_requires_group":          "broadcast_file requires group and path",
+	"groups.broadcasting_members":                   "Broadcasting {name} to {launches} of {members} members",
+	"groups.delete_group_requires_name":             "delete_group requires name",
+	"groups.group_already_exists":                   "Group already exists: {name}",
+	"groups.group_created":                          "Group created: {name}",
+	"groups.group_deleted":                          "Group deleted: {name}",
+	"groups.group_members_must_unique":              "group {name}: members must be unique and not empty",
+	"groups.group_most_members":                     "group {name}: at most {max_group_members} members",
+	"groups.group_names_must_1":                     "group names must be 1 to {max_group_name} characters",
+	"groups.group_not_found":                        "Group not found: {group}",
+	"groups.invalid_group_name":                     "Invalid group name {name}",
+	"groups.no_member_group_online":                 "No member of group {group} is online",
+	"groups.peer_added":                             "Peer added to {group}",
+	"groups.peer_not_found":                         "Peer not found in {group}: {peer}",
+	"groups.peer_removed":                           "Peer removed from {group}",
+	"groups.remove_peer_group_requires":             "remove_peer_from_group requires group and peer",
+	"grpc.addr_must_host_port":                      "{err_grpc_addr}: addr must be host:port",
+	"grpc.already_served":                           "gRPC already served on {addr}",
+	"grpc.channel_command_not_available":            "{command} is not available over gRPC",
+	"grpc.listening":                                "gRPC listening on {addr}",
+	"grpc.not_running":                              "gRPC not running",
+	"grpc.start_grpc_takes_addr":                    "start_grpc takes addr or path, not both",
+	"grpc.stopped":                                  "gRPC stopped",
+	"guardrails.control_limits_must_not":            "control_limits must not be negative, except commands_per_sec -1 for no limit",
+	"guardrails.message_exceeds_maximum_size":       "Message exceeds maximum size",
+	"guardrails.message_nests_deeper_levels":        "Message nests deeper than {max_depth} levels",
+	"guardrails.too_many_commands_most":             "Too many commands: at most {commands_per_sec} per second",
+	"halfclose.failed_set_linger":                   "Failed to set linger on {id}: {error}",
+	"halfclose.linger_tcp_only":                     "Linger applies to TCP connections only",
+	"halfclose.read_unsupported":                    "Connection does not support shutting down its reading side",
+	"halfclose.requires_id":                         "{command} requires id",
+	"halfclose.seconds_must_least":                  "seconds must be -1 or more",
+	"halfclose.send_unsupported":                    "Connection does not support shutting down its sending side",
+	"halfclose.set_linger_requires":                 "set_linger requires id and seconds",
+	"harness.dials_not_negative":                    "refuse_dials and blackhole_dials must not be negative",
+	"harness.script_or_listener":                    "A test peer takes a script or a listener, not both",
+	"harness.step_needs_one_action":                 "each script step needs exactly one of send, expect, wait_ms, close or stall",
+	"harness.test_advance_clock_requires":           "test_advance_clock requires a positive ms",
+	"harness.test_drop_peer_requires":               "test_drop_peer requires name",
+	"harness.test_peer_not_found":                   "Test peer not found: {name}",
+	"harness.test_peer_requires_name":               "test_peer requires a name without dots or colons",
+	"hash.hashing_started":                          "Hashing started",
+	"hash.only_single_file_transfers":               "Only single-file transfers can be verified",
+	"hash.transfer_not_completed":                   "Transfer is {state}, not completed",
+	"hash.unsupported_hash_algorithm":               "Unsupported hash algorithm: {algorithm}",
+	"hash.verification_started":                     "Verification started",
+	"hash.verify_transfer_needs_expected":           "verify_transfer needs an expected digest for {algorithm}",
+	"heartbeat.interval_ms_must_between":            "heartbeat.interval_ms must be between {min} and {max}",
+	"heartbeat.misses_must_between":                 "heartbeat.misses must be between 1 and {max}",
+	"history.cleared_history_entries":               "Cleared {removed} history entries",
+	"history.failed_save_transfer_history":          "Failed to save transfer history: {error}",
+	"history.limit_offset_must_not":                 "limit and offset must not be negative",
+	"hooks.command_hooks_must_start":                "command hooks must start with a command",
+	"hooks.duplicate_hook_name":                     "Duplicate hook name: {name}",
+	"hooks.hook_timeout_ms_must":                    "hook timeout_ms must not be negative",
+	"hooks.invalid_hook":                            "hook {index}: {error}",
+	"hooks.unsupported_hook_type":                   "Unsupported hook type: {type}",
+	"hooks.webhook_hooks_need_http":                 "webhook hooks need an http or https url",
+	"httpapi.cannot_read_directory":                 "Cannot read directory",
+	"httpapi.invalid_http_path":                     "Invalid HTTP path {path}: use a plain path such as /api/status",
+	"httpapi.invalid_http_routes":                   "Invalid HTTP routes: {error}",
+	"httpapi.invalid_multipart_body":                "Invalid multipart body",
+	"httpapi.missing_file_name":                     "Missing file name",
+	"httpapi.unknown_http_endpoint":                 "Unknown http endpoint: {endpoint}",
+	"httpapi.use_get":                               "Use GET",
+	"httpapi.use_post_put":                          "Use POST or PUT",
+	"interfaces.failed_list_interfaces":             "Failed to list interfaces: {error}",
+	"jobs.cancel_requires_id":                       "cancel requires id",
+	"jobs.canceling_id":                             "Canceling {id}",
+	"jobs.diagnostic_not_running":                   "Diagnostic not running: {id}",
+	"jobs.job_not_running":                          "Job not running: {id}",
+	"lanscan.failed_read_oui_file":                  "Failed to read oui_file: {error}",
+	"lanscan.invalid_target_scan_lan":               "Invalid target: scan_lan covers at most {max_lan_hosts} addresses",
+	"lanscan.invalid_target_scan_lan_takes":         "Invalid target: scan_lan takes an IPv4 CIDR block",
+	"lanscan.no_ipv4_subnet_scan":                   "No IPv4 subnet to scan",
+	"lanscan.ports_must_list_most":                  "ports must list at most 32 ports",
+	"lanscan.scanning_addresses":                    "Scanning {hosts} addresses on {targets}",
+	"limits.connection_limit_set":                   "Connection limit for {scope} set to {max_connections}",
+	"listeners.share_choosing_one_requires":         "{found} listeners share {addr}; choosing one requires listener_id",
+	"logging.failed_open_log_file":                  "Failed to open log file: {error}",
+	"logging.file_logging_disabled":                 "File logging disabled",
+	"logging.log_level_set":                         "Log level set to {level}",
+	"logging.path":                                  "Logging to {path}",
+	"logtail.listeners_cannot_allow_unpinned":       "logtail listeners cannot allow unpinned peers",
+	"logtail.listeners_require_encrypted_auth":      "logtail listeners require encrypted or auth",
+	"logtail.log_tail_started":                      "Log tail started",
+	"main.drop_mode_requires_transfer":              "Drop mode requires a transfer listener",
+	"main.encryption_not_supported_listeners":       "Encryption is not supported for {type} listeners",
+	"main.failed_load_certificate":                  "Failed to load certificate: {error}",
+	"main.failed_set_up_ssh":                        "Failed to set up ssh: {error}",
+	"main.failed_watch_certificate":                 "Failed to watch certificate: {error}",
+	"main.http_server_started":                      "HTTP server started on {addr}",
+	"main.pong":                                     "pong",
+	"main.quic_not_supported_listeners":             "QUIC is not supported for {type} listeners",
+	"main.serial_options_require_serial":            "serial options require a serial listener",
+	"main.server_started":                           "Server started on {addr}",
+	"main.server_stopped":                           "Server stopped",
+	"main.sftp_listeners_take_sftp":                 "sftp listeners take sftp.username with a password or keys instead of encryption, auth, tls or quic",
+	"main.sftp_options_require_sftp":                "sftp options require an sftp listener",
+	"main.socket_options_other_address":             "Socket options other than the address family need a tcp listener",
+	"main.socks5_listeners_take_socks":              "socks5 listeners take socks.username and socks.password instead of encryption, auth or quic",
+	"main.socks_options_require_socks5":             "socks options require a socks5 listener",
+	"main.stream_compression_not_supported":         "Stream compression is not supported for {type} listeners",
+	"main.tls_requires_tcp_listener":                "tls requires a tcp listener; QUIC brings its own",
+	"main.unknown_command":                          "Unknown command: {command}",
+	"main.unsupported_over_limit_policy":            "Unsupported over_limit policy: {over_limit}",
+	"main.unsupported_server_type":                  "Unsupported server type: {type}",
+	"main.websocket_server_started":                 "WebSocket server started on {url}",
+	"media.kick_media_subscriber_requires_id":       "kick_media_subscriber requires id",
+	"media.max_subscribers_must_not":                "media.max_subscribers must not be negative",
+	"media.media_frames_must_between":               "Media frames must be between 1 and {max} bytes",
+	"media.media_options_require_media":             "media options require a media listener",
+	"media.media_subscriber_kicked":                 "Media subscriber kicked",
+	"media.media_subscriber_not_found":              "Media subscriber not found: {id}",
+	"media.queue_frames_must_between":               "media.queue_frames must be between 0 and {max}",
+	"media.streams_must_not_contain":                "media.streams must not contain an empty name",
+	"metrics.reset":                                 "Metrics reset",
+	"multicast.datagram_exceeds_bytes":              "Datagram exceeds {max_datagram_size} bytes",
+	"multicast.failed_configure_multicast_socket":   "Failed to configure multicast socket: {error}",
+	"multicast.failed_join":                         "Failed to join {gaddr}: {error}",
+	"multicast.failed_send":                         "Failed to send to {gaddr}: {error}",
+	"multicast.group_not_found":                     "Multicast group not found",
+	"multicast.joined_gaddr":                        "Joined {gaddr}",
+	"multicast.left_group":                          "Left {group}",
+	"multicast.not_multicast_address":               "Not a multicast address: {group}",
+	"multicast.requires_port":                       "Multicast requires a port",
+	"multicast.ttl_must_most_255":                   "ttl must be at most 255",
+	"mux.close_mux_requires_id":                     "close_mux requires id",
+	"mux.did_not_answer_mux":                        "{addr} did not answer as a mux listener: {error}",
+	"mux.link_closed":                               "Mux link closed",
+	"mux.link_not_found":                            "Mux link not found",
+	"mux.link_open":                                 "Mux link open to {addr}",
+	"mux.open_mux_requires_host":                    "open_mux requires host and port",
+	"mux.streams_must_take_their":                   "mux streams must take their transport, encryption, auth and compression from open_mux",
+	"mux.unsupported_service":                       "Unsupported service: {service}",
+	"namespace.namespace_must_most":                 "namespace must be at most {max} letters, digits, dots, dashes or underscores",
+	"nat.failed_bind_udp_port":                      "Failed to bind UDP port {local_port}: {error}",
+	"nat.failed_resolve_stun_server":                "Failed to resolve STUN server: {error}",
+	"nat.hole_punching_started":                     "Hole punching started",
+	"nat.punch_hole_requires_candidates":            "punch_hole requires candidates and token",
+	"nat.stun_server_did_not":                       "STUN server did not answer",
+	"netem.latency_plus_jitter_must":                "latency_ms plus jitter_ms must be at most 10000",
+	"netem.latency_jitter_bytes_must":               "latency_ms, jitter_ms and bytes_per_sec must not be negative",
+	"netem.loss_percent_must_between":               "loss_percent must be between 0 and 100",
+	"netem.only_available_developer_mode":           "set_netem is only available in developer mode",
+	"netem.set_netem_requires":                      "set_netem requires listener_id, port or id",
+	"netem.simulation_started":                      "Network simulation started",
+	"netem.simulation_stopped":                      "Network simulation stopped",
+	"netem.unsupported_direction":                   "Unsupported direction: {direction}",
+	"p2p.accept_must_given_answer":                  "p2p_accept must be given the answer to one of our offers",
+	"p2p.accept_requires_id_answer":                 "p2p_accept requires id and answer",
+	"p2p.add_candidate_requires_id":                 "p2p_add_candidate requires id and candidate.candidate",
+	"p2p.answer_must_given_offer":                   "p2p_answer must be given an offer description",
+	"p2p.answer_requires_offer":                     "p2p_answer requires offer",
+	"p2p.candidate_added":                           "Candidate added",
+	"p2p.checking_paths_peer":                       "Checking paths to the peer",
+	"p2p.close_requires_id":                         "p2p_close requires id",
+	"p2p.description_requires_sdp":                  "description must have sdp",
+	"p2p.failed_start_peer_session":                 "Failed to start peer session: {error}",
+	"p2p.invalid_answer":                            "Invalid answer: {error}",
+	"p2p.invalid_offer":                             "Invalid offer: {error}",
+	"p2p.invalid_turn_url":                          "Invalid TURN url {url}: must be turn:host[:port] or turns:host[:port]",
+	"p2p.peer_session_closed":                       "Peer session closed",
+	"p2p.peer_session_not_found":                    "Peer session not found",
+	"p2p.timeout_ms_must_not":                       "timeout_ms must not be negative",
+	"pathmtu.datagram_exceeds_path":                 "Datagram of {size} bytes exceeds the path's max_datagram of {max_datagram} bytes",
+	"paths.downloads_go":                            "Downloads go to {dir}",
+	"paths.invalid_download_directory":              "Invalid download directory: {error}",
+	"pause.failed_pause_transfer":                   "Failed to pause transfer: {error}",
+	"pause.failed_resume_transfer":                  "Failed to resume transfer: {error}",
+	"pause.only_single_file_transfers":              "Only single-file transfers can be paused",
+	"pause.transfer_cannot_paused_until":            "Transfer cannot be paused until its body streams, or the peer does not support pausing",
+	"pause.transfer_not_active":                     "Transfer is {state}, not active",
+	"pause.transfer_not_paused":                     "Transfer is not paused",
+	"pause.transfer_paused":                         "Transfer paused",
+	"pause.transfer_paused_peer":                    "Transfer was paused by the peer",
+	"pause.transfer_resumed":                        "Transfer resumed",
+	"payloads.assembled_payload_not_valid":          "Assembled payload is not valid JSON",
+	"payloads.end_payload_requires_command":         "end_payload requires command",
+	"payloads.expected_chunk_got":                   "Expected chunk {next}, got {seq}",
+	"payloads.invalid_payload":                      "Invalid payload: {error}",
+	"payloads.invalid_payload_text":                 "Invalid payload text: {error}",
+	"payloads.not_available_through_end":            "{command} is not available through end_payload",
+	"payloads.payload_bytes_begin_payload":          "Payload is {len} bytes, begin_payload declared {size}",
+	"payloads.payload_exceeds_bytes":                "Payload exceeds {limit} bytes",
+	"payloads.payload_not_found":                    "Payload not found",
+	"payloads.payload_requires_field":               "payload requires field",
+	"payloads.size_must_between_0":                  "size must be between 0 and {max_assembled_payload}",
+	"payloads.too_many_payloads_progress":           "Too many payloads in progress",
+	"ping.count_must_most":                          "count must be at most {max_ping_count}",
+	"ping.failed_resolve":                           "Failed to resolve {host}: {error}",
+	"ping.icmp_not_available":                       "ICMP is not available: {error}",
+	"ping.icmp_ping_requires_host":                  "icmp_ping requires host",
+	"ping.pinging_over":                             "Pinging {host} ({target}) over {mode}",
+	"ping.size_must_most":                           "size must be at most {max_ping_size}",
+	"ping.traceroute_allows_most_hops":              "traceroute allows at most {max_traceroute_hop} hops and 10 probes per hop",
+	"ping.traceroute_needs_raw_icmp":                "Traceroute needs raw ICMP sockets: {error}",
+	"ping.traceroute_requires_host":                 "traceroute requires host",
+	"ping.tracing_route":                            "Tracing route to {host} ({target})",
+	"ping.unsupported_ping_mode":                    "Unsupported ping mode: {mode}",
+	"plaintext.bytes_between":                       "bytes must be between 0 and {max}",
+	"plaintext.invalid_subnet":                      "Invalid plaintext subnet: {subnet}",
+	"policy.invalid_mime_pattern":                   "Invalid MIME pattern {pattern}",
+	"policy.receive_policy_limits_must":             "receive_policy limits must not be negative",
+	"policy.receive_policy_scanner_must":            "receive_policy.scanner must start with a command",
+	"portmap.add_port_mapping_requires":             "add_port_mapping requires a valid port",
+	"portmap.failed_map_port":                       "Failed to map port {port}: {error}",
+	"portmap.failed_remove_mapping":                 "Failed to remove mapping on {gateway}: {error}",
+	"portmap.nat_pmp_request_refused":               "NAT-PMP request refused with result code {code}",
+	"portmap.port_mapped":                           "Port {port} mapped to {join_host_port}",
+	"portmap.port_mapping_not_found":                "Port mapping not found",
+	"portmap.port_mapping_removed":                  "Port mapping removed",
+	"portmap.port_mapping_unavailable":              "Port mapping unavailable: {error}",
+	"portmap.unsupported_mapping_method":            "Unsupported mapping method: {method}",
+	"portowner.failed_find_port_owners":             "Failed to find port owners: {error}",
+	"portowner.finding_port_owners_not":             "Finding port owners is not supported on {os}",
+	"portowner.nothing_listening_port":              "Nothing is listening on port {port}",
+	"portowner.port_used_by":                        "Port {port} is used by {app}",
+	"portowner.who_uses_port_requires":              "who_uses_port requires a port between 1 and 65535",
+	"ports.port_must_between_0":                     "Port must be between 0 and 65535",
+	"power.background_paused":                       "Background activity paused",
+	"power.background_resumed":                      "Background activity resumed",
+	"power.background_still_paused":                 "Background activity still paused",
+	"priority.bytes_per_sec_must_not":               "transfer_priority.bytes_per_sec must not be negative",
+	"priority.priority_must_low":                    "priority must be low, normal or high",
+	"priority.shares_must_positive":                 "transfer_priority.shares must be positive",
+	"priority.shares_unknown_level":                 "transfer_priority.shares has unknown level {level}",
+	"priority.transfer_priority_set":                "Transfer priority set to {priority}",
+	"profiles.delete_profile_requires_name":         "delete_profile requires name",
+	"profiles.invalid_overrides":                    "Invalid overrides: {error}",
+	"profiles.invalid_profile":                      "Invalid profile {name}",
+	"profiles.invalid_profile_name":                 "Invalid profile name {name}",
+	"profiles.profile_already_running":              "Profile {name} already running on {addr}",
+	"profiles.profile_deleted":                      "Profile deleted: {name}",
+	"profiles.profile_names_must_1":                 "profile names must be 1 to {max_profile_name} characters",
+	"profiles.profile_not_found":                    "Profile not found: {name}",
+	"profiles.profile_not_running":                  "Profile not running: {name}",
+	"profiles.profile_saved":                        "Profile saved: {name}",
+	"profiles.profile_started":                      "Profile {name} started: {message}",
+	"profiles.save_profile_requires_server":         "save_profile requires server, a start_server payload",
+	"profiles.start_profile_requires_name":          "start_profile requires name",
+	"profiles.stop_profile_requires_name":           "stop_profile requires name",
+	"prometheus.metrics_already_served":             "Metrics already served on {addr}",
+	"prometheus.metrics_listener_not_running":       "Metrics listener not running",
+	"prometheus.metrics_listener_stopped":           "Metrics listener stopped",
+	"prometheus.metrics_path_must_start":            "Metrics path must start with /",
+	"prometheus.metrics_served_http":                "Metrics served on {url}",
+	"proxy.can_only_carry_tcp":                      "A proxy can only carry tcp connections",
+	"proxy.invalid_proxy_bypass":                    "Invalid proxy bypass {bypass}",
+	"proxy.invalid_proxy_url":                       "Invalid proxy URL {url}",
+	"proxy.reached_through_proxy":                   "Reached {target} through the proxy",
+	"proxy.target_must_host_port":                   "target must be host:port",
+	"proxy.test_failed":                             "Proxy test failed: {error}",
+	"proxy.test_proxy_requires_proxy":               "test_proxy requires proxy, or a proxy in the config",
+	"proxy.unsupported_proxy_scheme":                "Unsupported proxy scheme: {scheme}",
+	"queue.cleared_finished_jobs":                   "Cleared {n} finished jobs",
+	"queue.enqueue_transfer_requires_host":          "enqueue_transfer requires host, port and path or paths",
+	"queue.job_already_started_use":                 "Job already started as {transfer}; use cancel to stop it",
+	"queue.job_not_found":                           "Job not found",
+	"queue.job_not_waiting_queue":                   "Job is not waiting in the queue",
+	"queue.max_must_most":                           "max must be at most {max_queue_concurrency}",
+	"queue.path_not_kind":                           "{path} is not a {kind}",
+	"queue.queued_transfers":                        "Queued {jobs} transfers",
+	"queue.reorder_queue_requires_id":               "reorder_queue requires id and position or priority",
+	"queue.running_up_queued_transfers":             "Running up to {max} queued transfers",
+	"queue.schedule_not_queued":                     "Queued transfers cannot have a schedule; schedule send_file or send_directory instead",
+	"queue.set_queue_concurrency_requires":          "set_queue_concurrency requires a positive max",
+	"queue.unsupported_job_kind":                    "Unsupported job kind: {kind}",
+	"ratelimit.rate_limit_set_bytes":                "Rate limit set to {bytes_per_sec} bytes/sec",
+	"ratelimit.set_rate_limit_requires":             "set_rate_limit requires listener_id, port or id",
+	"rawchannel.chunk_too_large":                    "Chunk is {len} bytes, the raw channel takes at most {max}",
+	"rawchannel.max_chunk_not_negative":             "max_chunk must not be negative",
+	"rawchannel.send_raw_requires":                  "send_raw requires id and data",
+	"rawchannel.set_raw_channel_requires_id":        "set_raw_channel requires id",
+	"rawchannel.speaks_chat":                        "Connection speaks the chat protocol",
+	"rekey.bytes_at_least_one_record":               "rekey.bytes must be at least one record of 16384 bytes",
+	"rekey.connection_not_encrypted":                "Connection is not encrypted",
+	"rekey.must_not_negative":                       "rekey must not be negative, except -1 to turn a trigger off",
+	"rekey.started":                                 "Rekey started",
+	"relay.not_found":                               "Relay not found",
+	"relay.relaying_addr_target":                    "Relaying {addr} to {target}",
+	"relay.start_relay_requires_target":             "start_relay requires target_host and target_port",
+	"relay.stopped":                                 "Relay stopped",
+	"resume.file_changed_since_transfer":            "File changed since the transfer failed: {path}",
+	"resume.only_single_file_sends":                 "Only single-file sends can be resumed",
+	"resume.transfer_not_failed_canceled":           "Transfer is {state}, not failed or canceled",
+	"scan.invalid_port_range":                       "Invalid port or range: {part}",
+	"scan.no_ports_scan":                            "No ports to scan",
+	"scan.ports_requires_target":                    "scan_ports requires target",
+	"scan.scanning_ports_hosts":                     "Scanning {ports} ports on {hosts} hosts",
+	"scan.would_send_probes_limit":                  "Scan would send {total} probes; the limit is {max_scan_probes}",
+	"schedule.canceled":                             "Schedule canceled",
+	"schedule.cron_never_matches_date":              "cron never matches a date",
+	"schedule.must_future":                          "schedule.at must be in the future",
+	"schedule.must_rfc_3339_time":                   "schedule.at must be an RFC 3339 time",
+	"schedule.not_found":                            "Schedule not found",
+	"schedule.requires_cron":                        "schedule requires at or cron",
+	"schedule.scheduled_command":                    "Scheduled {command}",
+	"schedule.takes_cron_not_both":                  "schedule takes at or cron, not both",
+	"schedule.unsupported_command":                  "Unsupported command: {command}",
+	"schema.invalid_payload_for":                    "Invalid payload for {command}: {problems}",
+	"selfupdate.cannot_locate":                      "Cannot locate the running binary: {error}",
+	"selfupdate.in_progress":                        "An update is already in progress",
+	"selfupdate.manifest_url_invalid":               "update.manifest_url must be an http or https url",
+	"selfupdate.manifest_url_unset":                 "Self-update is not configured; set update.manifest_url",
+	"selfupdate.no_release_key":                     "This build has no release key; self-update is not available",
+	"selfupdate.up_to_date":                         "Already up to date: {version} is not newer than {current}",
+	"selfupdate.update_started":                     "Update started",
+	"serial.baud_must_not":                          "serial.baud must not be negative",
+	"serial.data_bits_must_between":                 "serial.data_bits must be between 5 and 8",
+	"serial.flow_control_must_none":                 "serial.flow_control must be none or rtscts, not {flow_control}",
+	"serial.parity_must_none_even":                  "serial.parity must be none, even or odd, not {parity}",
+	"serial.serial_listeners_require_device":        "serial listeners require serial.device",
+	"serial.stop_bits_must":                         "serial.stop_bits must be 1 or 2",
+	"sftp.invalid_authorized_key":                   "Invalid authorized key: {error}",
+	"sftp.listeners_require_password":               "sftp listeners require sftp.password or authorized keys",
+	"sftp.listeners_require_username":               "sftp listeners require sftp.username",
+	"share.failed_create_token":                     "Failed to create token: {error}",
+	"share.file_must_given_regular":                 "share_file must be given a regular file",
+	"share.file_not_found":                          "File not found: {path}",
+	"share.file_requires_path":                      "share_file requires path",
+	"share.invalid_name":                            "Invalid name: {error}",
+	"share.max_downloads_must_not":                  "max_downloads must not be negative",
+	"share.not_found":                               "Share not found",
+	"share.sharing_name":                            "Sharing {name}",
+	"share.stop_share_requires_id":                  "stop_share requires id",
+	"share.stopped":                                 "Share stopped",
+	"share.ttl_ms_must_between":                     "ttl_ms must be between 0 and {milliseconds}",
+	"shutdown.shutting_down_drain_timeout":          "Shutting down (drain timeout {timeout})",
+	"sleep.awake":                                   "Awake",
+	"sleep.ready_for_sleep":                         "Ready for sleep",
+	"snapshot.export_state_requires_path":           "export_state requires path",
+	"snapshot.failed_export_state":                  "Failed to export state: {error}",
+	"snapshot.import_state_requires_path":           "import_state requires path",
+	"snapshot.import_would_change_existing":         "Import would change {count} existing values",
+	"snapshot.not_lumina_state_file":                "Not a Lumina state file: {path}",
+	"snapshot.state_exported":                       "State exported to {path}",
+	"snapshot.state_file_holds_no":                  "State file holds no identity; export it with include_identity",
+	"snapshot.state_file_version_newer":             "State file version {version} is newer than this build reads",
+	"snapshot.state_imported":                       "State imported from {path}",
+	"snapshot.unsupported_on_conflict":              "Unsupported on_conflict: {on_conflict}",
+	"snapshot.unsupported_section":                  "Unsupported section: {section}",
+	"sockopts.ipv4_only_cannot_combined":            "ipv4_only cannot be combined with IPv6 binding",
+	"sockopts.socket_buffers_must_between":          "socket buffers must be between 0 and {max_socket_buffer} bytes",
+	"socks.username_socks_password_must":            "socks.username and socks.password must be at most 255 bytes",
+	"socks.username_socks_password_must_set":        "socks.username and socks.password must be set together",
+	"speedtest.run_speedtest_requires_host":         "run_speedtest requires host and port",
+	"speedtest.speed_test_started":                  "Speed test started",
+	"speedtest.unsupported_speed_test_direction":    "Unsupported speed test direction: {direction}",
+	"statsfeed.interval_ms_must_between":            "interval_ms must be between {milliseconds} and {milliseconds2}",
+	"statsfeed.most_stats_subscriptions_can":        "at most {max_stats_subs} stats subscriptions can be open",
+	"statsfeed.stats_subscriptions_ended":           "{ended} stats subscriptions ended",
+	"statsfeed.subscription_not_found":              "Subscription not found",
+	"storage.limits_must_not_negative":              "storage limits must not be negative",
+	"tap.connection_already_tapped":                 "Connection is already tapped",
+	"tap.connection_not_tapped":                     "Connection is not tapped",
+	"tap.connection_requires_events_pcap":           "tap_connection requires events, pcap or both",
+	"tap.max_chunk_must_between":                    "max_chunk must be between 1 and {max_tap_chunk}",
+	"tap.started":                                   "Tap started",
+	"tap.stopped":                                   "Tap stopped",
+	"throttle.per_ip_burst_requires":                "per_ip_burst requires per_ip_rate",
+	"throttle.per_ip_rate_per":                      "per_ip_rate and per_ip_burst must not be negative",
+	"timeouts.updated":                              "Timeouts updated for {id}",
+	"tlscerts.failed_reload_certificates":           "Failed to reload certificates",
+	"tlscerts.listener_does_not_serve":              "Listener does not serve TLS",
+	"tlscerts.reloaded_certificates":                "Reloaded {value} of {stores} certificates",
+	"tlscerts.tls_requires_cert_file":               "tls requires cert_file and key_file",
+	"transfer.chunk_checksums_cannot_combined":      "chunk_checksums cannot be combined with streams",
+	"transfer.chunk_retries_must_between":           "chunk_retries must be between 0 and {max_chunk_retries}",
+	"transfer.chunk_retries_requires_chunk":         "chunk_retries requires chunk_checksums",
+	"transfer.dedup_cannot_combined_streams":        "dedup cannot be combined with streams, resume or chunk_checksums",
+	"transfer.plaintext_cannot_combined":            "plaintext cannot be combined with encrypted, mux or quic",
+	"transfer.send_file_requires_path":              "send_file requires path, and host and port or mux",
+	"transfer.streams_cannot_combined_resume":       "streams cannot be combined with resume or compression",
+	"transfersession.send_over_mux_link_cannot":     "A send over a mux link cannot be redirected to another host",
+	"trust.display_name_trust":                      "{display_name} is {trust}",
+	"trust.failed_save_trust_store":                 "Failed to save trust store: {error}",
+	"trust.forget_peer_requires_peer":               "forget_peer requires peer",
+	"trust.forgot_display_name":                     "Forgot {display_name}",
+	"trust.name_already_use":                        "Name already in use: {name}",
+	"trust.unknown_peer":                            "Unknown peer: {peer}",
+	"usage.month_must_yyyy_mm":                      "month must be YYYY-MM",
+	"usage.since_until_must_yyyy":                   "since and until must be YYYY-MM-DD",
+	"usage.unsupported_group":                       "Unsupported group_by: {group_by}",
+	"version.frontend_protocol_older":               "Frontend protocol is older than this build supports",
+	"version.hello":                                 "Hello",
+	"webhooks.duplicate_webhook_name":               "Duplicate webhook name: {name}",
+	"webhooks.webhook_retries_must_between":         "webhook retries must be between -1 and {max}",
+	"webhooks.webhook_timeout_ms_must":              "webhook timeout_ms must not be negative",
+	"webhooks.webhooks_need_http":                   "webhooks need an http or https url",
+	"webhooks.webhooks_need_least":                  "webhooks need at least one event",
+	"wol.count_must_most_20":                        "count must be at most 20",
+	"wol.failed_send_magic_packet":                  "Failed to send magic packet to {dst}: {error}",
+	"wol.invalid_broadcast_address":                 "Invalid broadcast address: {broadcast}",
+	"wol.magic_packet_sent":                         "Magic packet sent to {mac}",
+	"wol.port_must_between_1":                       "port must be between 1 and 65535",
+	"wol.waiting_requires_both_host":                "Waiting requires both host and wait_port",
+	"wol.wake_host_requires_6":                      "wake_host requires a 6-byte mac such as aa:bb:cc:dd:ee:ff",
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics are process-wide counters reported by status
+type Metrics struct {
+	StartedAt time.Time
+
+	BytesIn     atomic.Uint64
+	BytesOut    atomic.Uint64
+	Connections atomic.Uint64 // connections opened since the last reset
+	Errors      atomic.Uint64 // error responses sent to the frontend
+
+	mu        sync.Mutex
+	resetAt   time.Time
+	transfers map[transferOutcome]*histogram
+}
+
+// transferOutcome keys the transfer duration histograms
+type transferOutcome struct {
+	direction string // "send", "receive"
+	result    string // "completed", "failed"
+}
+
+// transferBuckets are the upper bounds, in seconds, of the transfer
+// duration histogram
+var transferBuckets = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 900, 3600}
+
+// histogram counts observations into cumulative buckets
+type histogram struct {
+	bounds []float64
+	counts []uint64 // one per bounds entry
+	count  uint64
+	sum    float64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds))}
+}
+
+func (h *histogram) observe(v float64) {
+	for i, bound := range h.bounds {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// ObserveTransfer records how long a finished transfer took
+func (m *Metrics) ObserveTransfer(direction string, err error, elapsed time.Duration) {
+	key := transferOutcome{direction: direction, result: "completed"}
+	if err != nil {
+		key.result = "failed"
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h, exists := m.transfers[key]
+	if !exists {
+		h = newHistogram(transferBuckets)
+		m.transfers[key] = h
+	}
+	h.observe(elapsed.Seconds())
+}
+
+var metrics = newMetrics()
+
+func newMetrics() *Metrics {
+	now := time.Now()
+	return &Metrics{StartedAt: now, resetAt: now, transfers: make(map[transferOutcome]*histogram)}
+}
+
+// Snapshot returns the counters plus Go runtime statistics
+func (m *Metrics) Snapshot() map[string]interface{} {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	m.mu.Lock()
+	resetAt := m.resetAt
+	m.mu.Unlock()
+
+	return map[string]interface{}{
+		"goroutines":        runtime.NumGoroutine(),
+		"uptime_seconds":    time.Since(m.StartedAt).Seconds(),
+		"started_at":        m.StartedAt,
+		"metrics_since":     resetAt,
+		"bytes_in":          m.BytesIn.Load(),
+		"bytes_out":         m.BytesOut.Load(),
+		"connections_total": m.Connections.Load(),
+		"errors_total":      m.Errors.Load(),
+		"memory": map[string]interface{}{
+			"heap_alloc":  mem.HeapAlloc,
+			"heap_inuse":  mem.HeapInuse,
+			"heap_sys":    mem.HeapSys,
+			"total_alloc": mem.TotalAlloc,
+			"sys":         mem.Sys,
+			"num_gc":      mem.NumGC,
+		},
+	}
+}
+
+// Reset zeroes the traffic counters; uptime keeps counting from process start
+func (m *Metrics) Reset() {
+	m.BytesIn.Store(0)
+	m.BytesOut.Store(0)
+	m.Connections.Store(0)
+	m.Errors.Store(0)
+
+	m.mu.Lock()
+	m.resetAt = time.Now()
+	m.transfers = make(map[transferOutcome]*histogram)
+	m.mu.Unlock()
+}
+
+func handleResetMetrics(writer *Output) {
+	metrics.Reset()
+
+	state.Mutex.Lock()
+	for _, l := range state.Listeners {
+		l.BytesIn.Store(0)
+		l.BytesOut.Store(0)
+		l.Accepted.Store(0)
+	}
+	state.Mutex.Unlock()
+
+	writer.Encode(okResponse(message("metrics.reset"), nil))
+}
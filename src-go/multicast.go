@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Multicast groups carry LAN-wide announcements that mDNS does not cover.
+// Each joined group gets its own socket and reports every datagram as a
+// multicast_received event.
+const (
+	defaultMulticastTTL = 1 // stay on the local link unless asked otherwise
+	maxDatagramSize     = 65507
+)
+
+// MulticastGroup is a group joined through join_multicast
+type MulticastGroup struct {
+	ID        string    `json:"id"`
+	Group     string    `json:"group"`
+	Port      int       `json:"port"`
+	Interface string    `json:"interface,omitempty"`
+	Joined    time.Time `json:"joined"`
+	Packets   uint64    `json:"packets"`
+	Bytes     uint64    `json:"bytes"`
+
+	packets atomic.Uint64
+	bytes   atomic.Uint64
+	conn    *net.UDPConn
+}
+
+var (
+	multicastSeq atomic.Uint64
+	multicastMu  sync.Mutex
+	multicasts   = make(map[string]*MulticastGroup)
+)
+
+// multicastInterface resolves an interface name, nil meaning the system default
+func multicastInterface(name string) (*net.Interface, error) {
+	if name == "" {
+		return nil, nil
+	}
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown interface %s", name)
+	}
+	if ifi.Flags&net.FlagMulticast == 0 {
+		return nil, fmt.Errorf("interface %s does not support multicast", name)
+	}
+	return ifi, nil
+}
+
+// multicastAddr parses a group address and checks it is one
+func multicastAddr(group string, port int) (*net.UDPAddr, string, error) {
+	ip := net.ParseIP(group)
+	if ip == nil || !ip.IsMulticast() {
+		return nil, "", catalogError(ErrInvalidArgument, "multicast.not_multicast_address", "group", group)
+	}
+	if port <= 0 || port > 65535 {
+		return nil, "", catalogError(ErrInvalidArgument, "multicast.requires_port")
+	}
+	network := "udp4"
+	if ip.To4() == nil {
+		network = "udp6"
+	}
+	return &net.UDPAddr{IP: ip, Port: port}, network, nil
+}
+
+type JoinMulticastPayload struct {
+	Group     string `json:"group"` // e.g. "239.255.42.1" or "ff02::4c"
+	Port      int    `json:"port"`
+	Interface string `json:"interface"` // interface name, empty for the default
+	Loopback  *bool  `json:"loopback"`  // receive our own packets, default true
+}
+
+func handleJoinMulticast(payload json.RawMessage, writer *Output) {
+	var p JoinMulticastPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		sendInvalidPayload(writer, "join_multicast")
+		return
+	}
+	gaddr, network, err := multicastAddr(p.Group, p.Port)
+	if err != nil {
+		sendFailure(writer, err)
+		return
+	}
+	ifi, err := multicastInterface(p.Interface)
+	if err != nil {
+		sendFailure(writer, err)
+		return
+	}
+
+	conn, err := net.ListenMulticastUDP(network, ifi, gaddr)
+	if err != nil {
+		sendError(writer, message("multicast.failed_join", "gaddr", gaddr, "error", err))
+		return
+	}
+	if p.Loopback != nil {
+		if network == "udp4" {
+			ipv4.NewPacketConn(conn).SetMulticastLoopback(*p.Loopback)
+		} else {
+			ipv6.NewPacketConn(conn).SetMulticastLoopback(*p.Loopback)
+		}
+	}
+
+	g := &MulticastGroup{
+		ID:        fmt.Sprintf("mcast-%d", multicastSeq.Add(1)),
+		Group:     gaddr.IP.String(),
+		Port:      p.Port,
+		Interface: p.Interface,
+		Joined:    time.Now(),
+		conn:      conn,
+	}
+	multicastMu.Lock()
+	multicasts[g.ID] = g
+	multicastMu.Unlock()
+	goSafe("multicast "+g.ID, func() { readMulticast(g) })
+	logger.Info("joined multicast group", "id", g.ID, "group", gaddr.String(), "interface", p.Interface)
+
+	writer.Encode(okResponse(message("multicast.joined_gaddr", "gaddr", gaddr.String()), g.info()))
+}
+
+func readMulticast(g *MulticastGroup) {
+	buffer := make([]byte, maxDatagramSize)
+	for {
+		n, from, err := g.conn.ReadFromUDP(buffer)
+		if err != nil {
+			return // left the group
+		}
+		g.packets.Add(1)
+		g.bytes.Add(uint64(n))
+		metrics.BytesIn.Add(uint64(n))
+		emitEvent("multicast_received", map[string]interface{}{
+			"id":    g.ID,
+			"group": g.Group,
+			"from":  from.String(),
+			"size":  n,
+			"data":  base64.StdEncoding.EncodeToString(buffer[:n]),
+		})
+	}
+}
+
+func (g *MulticastGroup) info() MulticastGroup {
+	return MulticastGroup{
+		ID: g.ID, Group: g.Group, Port: g.Port, Interface: g.Interface, Joined: g.Joined,
+		Packets: g.packets.Load(), Bytes: g.bytes.Load(),
+	}
+}
+
+type LeaveMulticastPayload struct {
+	ID string `json:"id"`
+}
+
+func handleLeaveMulticast(payload json.RawMessage, writer *Output) {
+	var p LeaveMulticastPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		sendInvalidPayload(writer, "leave_multicast")
+		return
+	}
+	multicastMu.Lock()
+	g, exists := multicasts[p.ID]
+	delete(multicasts, p.ID)
+	multicastMu.Unlock()
+	if !exists {
+		sendErrorCode(writer, ErrNotFound, message("multicast.group_not_found"), nil)
+		return
+	}
+	g.conn.Close()
+	logger.Info("left multicast group", "id", g.ID, "group", g.Group)
+	writer.Encode(okResponse(message("multicast.left_group", "group", g.Group), g.info()))
+}
+
+func handleListMulticast(writer *Output) {
+	multicastMu.Lock()
+	list := make([]MulticastGroup, 0, len(multicasts))
+	for _, g := range multicasts {
+		list = append(list, g.info())
+	}
+	multicastMu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Joined.Before(list[j].Joined) })
+
+	writer.Encode(ProtocolResponse{
+		Status: "ok",
+		Data:   map[string]interface{}{"groups": list},
+	})
+}
+
+// leaveAllMulticast closes every group socket; shutdown uses it
+func leaveAllMulticast() {
+	multicastMu.Lock()
+	defer multicastMu.Unlock()
+	for id, g := range multicasts {
+		g.conn.Close()
+		delete(multicasts, id)
+	}
+}
+
+type SendMulticastPayload struct {
+	Group     string `json:"group"`
+	Port      int    `json:"port"`
+	Data      string `json:"data"`
+	Encoding  string `json:"encoding"`  // "utf8" (default), "base64"
+	TTL       int    `json:"ttl"`       // hop limit, default 1
+	Interface string `json:"interface"` // outgoing interface, empty for the default
+	Loopback  *bool  `json:"loopback"`  // deliver to our own joined groups, default true
+}
+
+func handleSendMulticast(payload json.RawMessage, writer *Output) {
+	var p SendMulticastPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		sendInvalidPayload(writer, "send_multicast")
+		return
+	}
+	gaddr, network, err := multicastAddr(p.Group, p.Port)
+	if err != nil {
+		sendFailure(writer, err)
+		return
+	}
+	ifi, err := multicastInterface(p.Interface)
+	if err != nil {
+		sendFailure(writer, err)
+		return
+	}
+	data, err := decodeData(p.Data, p.Encoding)
+	if err != nil {
+		sendFailure(writer, err)
+		return
+	}
+	if len(data) > maxDatagramSize {
+		sendErrorCode(writer, ErrInvalidArgument, message("multicast.datagram_exceeds_bytes", "max_datagram_size", maxDatagramSize), nil)
+		return
+	}
+	ttl := defaultMulticastTTL
+	if p.TTL > 0 {
+		if p.TTL > 255 {
+			sendErrorCode(writer, ErrInvalidArgument, message("multicast.ttl_must_most_255"), nil)
+			return
+		}
+		ttl = p.TTL
+	}
+
+	conn, err := net.ListenUDP(network, nil)
+	if err != nil {
+		sendError(writer, message("common.failed_open_udp_socket", "error", err))
+		return
+	}
+	defer conn.Close()
+
+	if network == "udp4" {
+		pc := ipv4.NewPacketConn(conn)
+		err = pc.SetMulticastTTL(ttl)
+		if err == nil && ifi != nil {
+			err = pc.SetMulticastInterface(ifi)
+		}
+		if err == nil && p.Loopback != nil {
+			err = pc.SetMulticastLoopback(*p.Loopback)
+		}
+	} else {
+		pc := ipv6.NewPacketConn(conn)
+		err = pc.SetMulticastHopLimit(ttl)
+		if err == nil && ifi != nil {
+			err = pc.SetMulticastInterface(ifi)
+		}
+		if err == nil && p.Loopback != nil {
+			err = pc.SetMulticastLoopback(*p.Loopback)
+		}
+	}
+	if err != nil {
+		sendError(writer, message("multicast.failed_configure_multicast_socket", "error", err))
+		return
+	}
+
+	n, err := conn.WriteToUDP(data, gaddr)
+	if err != nil {
+		sendError(writer, message("multicast.failed_send", "gaddr", gaddr, "error", err))
+		return
+	}
+	metrics.BytesOut.Add(uint64(n))
+	writer.Encode(ProtocolResponse{
+		Status: "ok",
+		Data: map[string]interface{}{
+			"group": gaddr.IP.String(),
+			"port":  p.Port,
+			"bytes": n,
+			"ttl":   ttl,
+			"from":  conn.LocalAddr().String(),
+		},
+	})
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Mux links carry several streams to one peer over a single connection.
+// open_mux dials a "mux" listener once, running encryption, auth and
+// compression for the whole link, and connect, send_file and send_directory
+// then open streams on it by passing mux instead of host and port. Each
+// stream starts with a one-line hello naming the listener service it wants,
+// answered with a status line, and is then served like a connection of its
+// own: it shows up in list_connections with the link's ID in mux.
+const muxHelloTimeout = 10 * time.Second
+
+// muxServices are the services a stream may ask for, served as the
+// listener types of the same names serve their connections
+var muxServices = map[string]func(c *Connection, l *Listener, dir string){
+	"echo":        handleEchoConnection,
+	"discard":     handleDiscardConnection,
+	"chat":        handleChatConnection,
+	"custom-json": handleJSONConnection,
+	"raw":         handleRawConnection,
+	"transfer":    func(c *Connection, _ *Listener, dir string) { handleTransferConnection(c, dir) },
+	"speedtest":   func(c *Connection, _ *Listener, _ string) { handleSpeedtestConnection(c) },
+	"clipboard":   handleClipboardConnection,
+}
+
+type OpenMuxPayload struct {
+	Host      string `json:"host"`
+	Port      int    `json:"port"`
+	Transport string `json:"transport"` // "tcp" (default) or "quic"
+	TimeoutMs int    `json:"timeout_ms"`
+	Encrypted bool   `json:"encrypted"`
+	PeerKey   string `json:"peer_key"`
+
+	Compression CompressionOptions `json:"compression"`
+	Auth        ClientAuth         `json:"auth"`
+
+	AddressFamily string `json:"address_family"`
+	Proxy         string `json:"proxy"`
+}
+
+type CloseMuxPayload struct {
+	ID string `json:"id" required:"true"`
+}
+
+// muxHello opens every stream
+type muxHello struct {
+	Service string `json:"service"`
+}
+
+// Mux is a live mux link, opened by us or accepted by a mux listener
+type Mux struct {
+	ID         string
+	Direction  string // "inbound", "outbound"
+	RemoteAddr string
+	ListenerID string // inbound links
+	ConnID     string // inbound links: the connection carrying it
+	Created    time.Time
+
+	session *muxSession
+	secure  *SecureInfo
+	auth    string
+	opened  atomic.Uint64
+}
+
+// MuxInfo is the JSON view of a Mux
+type MuxInfo struct {
+	ID           string         `json:"id"`
+	Direction    string         `json:"direction"`
+	RemoteAddr   string         `json:"remote_addr"`
+	ListenerID   string         `json:"listener_id,omitempty"`
+	ConnectionID string         `json:"connection_id,omitempty"`
+	Created      time.Time      `json:"created"`
+	Streams      int            `json:"streams"`
+	Opened       uint64         `json:"opened"`
+	RTTMs        float64        `json:"rtt_ms"`
+	Latency      LatencySummary `json:"latency"`
+	Encrypted    bool           `json:"encrypted"`
+	Secure       *SecureInfo    `json:"secure,omitempty"`
+}
+
+var (
+	muxMu  sync.Mutex
+	muxes  = make(map[string]*Mux)
+	muxSeq atomic.Uint64
+)
+
+func (m *Mux) Info() MuxInfo {
+	return MuxInfo{
+		ID:           m.ID,
+		Direction:    m.Direction,
+		RemoteAddr:   m.RemoteAddr,
+		ListenerID:   m.ListenerID,
+		ConnectionID: m.ConnID,
+		Created:      m.Created,
+		Streams:      m.session.Streams(),
+		Opened:       m.opened.Load(),
+		RTTMs:        float64(m.session.RTT().Microseconds()) / 1000,
+		Latency:      m.session.latency.summary(false),
+		Encrypted:    m.secure != nil,
+		Secure:       m.secure,
+	}
+}
+
+// registerMux starts tracking a link and reports it once it ends
+func registerMux(m *Mux) {
+	m.ID = fmt.Sprintf("mux-%d", muxSeq.Add(1))
+	m.Created = time.Now()
+	muxMu.Lock()
+	muxes[m.ID] = m
+	muxMu.Unlock()
+	logger.Info("mux link opened", "id", m.ID, "direction", m.Direction, "remote", m.RemoteAddr)
+
+	go func() {
+		<-m.session.Done()
+		muxMu.Lock()
+		delete(muxes, m.ID)
+		muxMu.Unlock()
+		err := m.session.closeErr()
+		reason := err.Error()
+		if errors.Is(err, errPeerUnreachable) {
+			unreachable := map[string]interface{}{"id": m.ID, "remote": m.RemoteAddr, "reason": reason}
+			if peer, known := discoveredPeer(m.RemoteAddr); known {
+				unreachable["peer"] = peer
+			}
+			logger.Warn("peer unreachable", "id", m.ID, "remote", m.RemoteAddr, "reason", reason)
+			emitEvent("peer_unreachable", unreachable)
+		}
+		logger.Info("mux link closed", "id", m.ID, "reason", reason, "streams_opened", m.opened.Load())
+		emitEvent("mux_closed", map[string]interface{}{"id": m.ID, "reason": reason, "opened": m.opened.Load()})
+	}()
+}
+
+func lookupMux(id string) (*Mux, bool) {
+	muxMu.Lock()
+	defer muxMu.Unlock()
+	m, ok := muxes[id]
+	return m, ok
+}
+
+// useMux points a dial spec at a stream of the outbound link id
+func (d *dialSpec) useMux(id, service string) error {
+	m, ok := lookupMux(id)
+	if !ok || m.Direction == "inbound" {
+		return catalogError(ErrNotFound, "common.mux_link_not_found", "id", id)
+	}
+	d.Mux, d.Service, d.Addr = m, service, m.RemoteAddr
+	return nil
+}
+
+// checkMuxOptions refuses link options given per stream; a stream has
+// what open_mux set up for its link
+func checkMuxOptions(transport string, encrypted bool, auth ClientAuth, compression CompressionOptions, proxy string) error {
+	if (transport != "" && transport != "tcp") || encrypted || auth.Enabled() || compression.Enabled() || proxy != "" {
+		return catalogError(ErrInvalidArgument, "mux.streams_must_take_their")
+	}
+	return nil
+}
+
+// openStream opens a stream for service and waits for the listener to take it
+func (m *Mux) openStream(service string, timeout time.Duration) (net.Conn, error) {
+	st, err := m.session.Open()
+	if err != nil {
+		return nil, err
+	}
+	st.SetDeadline(time.Now().Add(timeout))
+	line, _ := json.Marshal(muxHello{Service: service})
+	if _, err := st.Write(append(line, '\n')); err != nil {
+		st.Close()
+		return nil, err
+	}
+	answer, err := readMuxLine(st)
+	if err != nil {
+		st.Close()
+		return nil, err
+	}
+	var resp ProtocolResponse
+	if err := json.Unmarshal(answer, &resp); err != nil {
+		st.Close()
+		return nil, errors.New("invalid mux stream answer")
+	}
+	if resp.Status != "ok" {
+		st.Close()
+		return nil, errors.New(resp.Message)
+	}
+	st.SetDeadline(time.Time{})
+	m.opened.Add(1)
+	return st, nil
+}
+
+// readMuxLine reads one line without reading past it, so what follows
+// stays in the stream for its handler
+func readMuxLine(st *muxStream) ([]byte, error) {
+	var line bytes.Buffer
+	b := make([]byte, 1)
+	for line.Len() < 1024 {
+		if _, err := st.Read(b); err != nil {
+			return nil, err
+		}
+		if b[0] == '\n' {
+			return line.Bytes(), nil
+		}
+		line.WriteByte(b[0])
+	}
+	return nil, errors.New("mux stream hello too long")
+}
+
+func answerMuxStream(st *muxStream, err error) {
+	resp := ProtocolResponse{Status: "ok"}
+	if err != nil {
+		resp = ProtocolResponse{Status: "error", Message: err.Error()}
+	}
+	line, _ := json.Marshal(resp)
+	st.Write(append(line, '\n'))
+}
+
+// handleMuxConnection runs a link over an accepted connection and serves
+// each stream the peer opens with the handler of the service it names.
+// The link takes one slot of the listener's max_connections, however many
+// streams it carries.
+func handleMuxConnection(c *Connection, l *Listener, dir string) {
+	defer untrackConn(c)
+	// The link pings itself; the connection's idle timeout no longer applies
+	raw := c.Conn()
+	raw.SetDeadline(time.Time{})
+	c.setProtocol("mux")
+	info := c.Info()
+
+	m := &Mux{
+		Direction:  "inbound",
+		RemoteAddr: info.RemoteAddr,
+		ListenerID: l.ID,
+		ConnID:     c.ID,
+		session:    newMuxSession(raw, false),
+		secure:     info.Secure,
+		auth:       info.Auth,
+	}
+	registerMux(m)
+	emitEvent("mux_opened", m.Info())
+	for {
+		st, err := m.session.Accept()
+		if err != nil {
+			return
+		}
+		go serveMuxStream(m, st, l, dir)
+	}
+}
+
+// serveMuxStream serves one stream the peer opened. l is nil on peer
+// session links, which offer only the services that need no listener.
+func serveMuxStream(m *Mux, st *muxStream, l *Listener, dir string) {
+	defer recoverPanic("mux " + m.ID)
+	services, network := p2pServices, "webrtc"
+	if l != nil {
+		services, network = muxServices, l.Transport
+	}
+	st.SetReadDeadline(time.Now().Add(muxHelloTimeout))
+	line, err := readMuxLine(st)
+	var hello muxHello
+	if err == nil && json.Unmarshal(line, &hello) != nil {
+		err = errors.New("invalid mux stream hello")
+	}
+	serve := services[hello.Service]
+	if err == nil && serve == nil {
+		err = catalogError(ErrUnsupported, "mux.unsupported_service", "service", hello.Service)
+	}
+	if err != nil {
+		logger.Debug("mux stream refused", "mux", m.ID, "error", err)
+		answerMuxStream(st, err)
+		st.Close()
+		return
+	}
+	st.SetReadDeadline(time.Time{})
+
+	c := trackStream(st, "inbound", network, l, m.ID)
+	if c == nil {
+		answerMuxStream(st, catalogError(ErrShuttingDown, "common.service_shutting_down"))
+		st.Close()
+		return
+	}
+	c.setSecure(m.secure)
+	c.setAuth(m.auth)
+	if hello.Service == chatProtocol {
+		c.setProtocol(chatProtocol)
+	}
+	m.opened.Add(1)
+	answerMuxStream(st, nil)
+	serve(c, l, dir)
+}
+
+func handleOpenMux(payload json.RawMessage, writer *Output) {
+	var p OpenMuxPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		sendInvalidPayload(writer, "open_mux")
+		return
+	}
+	if p.Host == "" || p.Port <= 0 {
+		sendErrorCode(writer, ErrInvalidArgument, message("mux.open_mux_requires_host"), nil)
+		return
+	}
+	if err := p.Auth.Validate(); err != nil {
+		sendFailure(writer, err)
+		return
+	}
+	if err := p.Compression.Validate(); err != nil {
+		sendFailure(writer, err)
+		return
+	}
+	network, isQUIC, err := transportNetwork(p.Transport, p.AddressFamily)
+	if err == nil && isQUIC {
+		err = validProxy(p.Proxy, "quic")
+	} else if err == nil {
+		err = validProxy(p.Proxy, "tcp")
+	}
+	if err != nil {
+		sendFailure(writer, err)
+		return
+	}
+	timeout := defaultDialTimeout
+	if p.TimeoutMs > 0 {
+		timeout = time.Duration(p.TimeoutMs) * time.Millisecond
+	}
+	if isStopping() {
+		sendErrorCode(writer, ErrShuttingDown, message("common.service_shutting_down"), nil)
+		return
+	}
+
+	spec := dialSpec{
+		Network:   network,
+		Addr:      net.JoinHostPort(normalizeHost(p.Host), strconv.Itoa(p.Port)),
+		QUIC:      isQUIC,
+		Timeout:   timeout,
+		Encrypted: p.Encrypted,
+		PeerKey:   p.PeerKey,
+
+		Compression: p.Compression,
+		Auth:        p.Auth,
+		Proxy:       p.Proxy,
+	}
+	conn, secure, err := spec.dial()
+	if err != nil {
+		sendErrorCode(writer, ErrConnectFailed, message("common.failed_connect", "addr", spec.Addr, "error", err), map[string]interface{}{"addr": spec.Addr, "error": err.Error()})
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	m := &Mux{
+		Direction:  "outbound",
+		RemoteAddr: spec.Addr,
+		session:    newMuxSession(conn, true),
+		secure:     secure,
+	}
+	// Most listeners of other types fail the framing at once; find that out
+	// now rather than on the first transfer
+	if _, err := m.session.Ping(timeout); err != nil {
+		m.session.close(err)
+		sendErrorCode(writer, ErrConnectFailed, message("mux.did_not_answer_mux", "addr", spec.Addr, "error", err), map[string]interface{}{"addr": spec.Addr, "error": err.Error()})
+		return
+	}
+	registerMux(m)
+
+	writer.Encode(okResponse(message("mux.link_open", "addr", spec.Addr), m.Info()))
+}
+
+func handleCloseMux(payload json.RawMessage, writer *Output) {
+	var p CloseMuxPayload
+	if err := json.Unmarshal(payload, &p); err != nil || p.ID == "" {
+		sendErrorCode(writer, ErrInvalidArgument, message("mux.close_mux_requires_id"), nil)
+		return
+	}
+	m, ok := lookupMux(p.ID)
+	if !ok {
+		sendErrorCode(writer, ErrNotFound, message("mux.link_not_found"), nil)
+		return
+	}
+	m.session.Close()
+	writer.Encode(okResponse(message("mux.link_closed"), nil))
+}
+
+func handleListMuxes(writer *Output) {
+	muxMu.Lock()
+	list := make([]MuxInfo, 0, len(muxes))
+	for _, m := range muxes {
+		list = append(list, m.Info())
+	}
+	muxMu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+	writer.Encode(ProtocolResponse{Status: "ok", Data: map[string]interface{}{"muxes": list}})
+}
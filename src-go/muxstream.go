@@ -0,0 +1,629 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A mux session carries many streams over one connection, so transfers,
+// chat and control traffic to a peer share a single handshake. The framing
+// follows yamux: a 12 byte header of version, type, flags, stream ID and
+// length, then the payload of data frames. Each stream may have up to its
+// window of unread data in flight and grants more as it is read, so one
+// busy stream cannot starve the others. Clients open odd stream IDs and
+// servers even ones.
+const (
+	muxVersion       = 0
+	muxHeaderSize    = 12
+	muxInitialWindow = 256 << 10
+	muxMaxFrame      = 64 << 10
+	muxMaxStreams    = 256
+	muxAcceptBacklog = 64
+	muxWriteTimeout  = 30 * time.Second
+)
+
+// Frame types
+const (
+	muxData byte = iota
+	muxWindowUpdate
+	muxPing
+	muxGoAway
+)
+
+// Frame flags
+const (
+	muxSYN uint16 = 1 << iota
+	muxACK
+	muxFIN
+	muxRST
+)
+
+var (
+	errMuxClosed   = errors.New("mux session closed")
+	errMuxReset    = errors.New("mux stream reset by peer")
+	errMuxTooMany  = errors.New("too many mux streams")
+	errMuxProtocol = errors.New("mux protocol error")
+)
+
+// muxSession is one end of a multiplexed connection
+type muxSession struct {
+	conn   net.Conn
+	client bool
+
+	writeMu sync.Mutex
+	hdr     [muxHeaderSize]byte
+
+	mu       sync.Mutex
+	streams  map[uint32]*muxStream
+	nextID   uint32
+	pings    map[uint32]chan struct{}
+	pingSeq  uint32
+	rtt      time.Duration
+	latency  latencyStats
+	err      error
+	accepted chan *muxStream
+	closed   chan struct{}
+	lastRecv atomic.Int64 // when the last frame arrived, in Unix nanoseconds
+}
+
+func newMuxSession(conn net.Conn, client bool) *muxSession {
+	s := &muxSession{
+		conn:     conn,
+		client:   client,
+		streams:  make(map[uint32]*muxStream),
+		nextID:   2,
+		pings:    make(map[uint32]chan struct{}),
+		accepted: make(chan *muxStream, muxAcceptBacklog),
+		closed:   make(chan struct{}),
+	}
+	if client {
+		s.nextID = 1
+	}
+	go s.recvLoop()
+	go s.keepalive()
+	return s
+}
+
+// writeFrame sends one frame; a failed write ends the session
+func (s *muxSession) writeFrame(typ byte, flags uint16, id, length uint32, payload []byte) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	select {
+	case <-s.closed:
+		return s.closeErr()
+	default:
+	}
+	s.hdr[0], s.hdr[1] = muxVersion, typ
+	binary.BigEndian.PutUint16(s.hdr[2:], flags)
+	binary.BigEndian.PutUint32(s.hdr[4:], id)
+	binary.BigEndian.PutUint32(s.hdr[8:], length)
+	s.conn.SetWriteDeadline(time.Now().Add(muxWriteTimeout))
+	_, err := s.conn.Write(s.hdr[:])
+	if err == nil && len(payload) > 0 {
+		_, err = s.conn.Write(payload)
+	}
+	if err != nil {
+		s.close(err)
+	}
+	return err
+}
+
+func (s *muxSession) closeErr() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err == nil || errors.Is(s.err, io.EOF) || errors.Is(s.err, net.ErrClosed) {
+		return errMuxClosed
+	}
+	return s.err
+}
+
+// Close tells the peer the session is going away and tears it down
+func (s *muxSession) Close() error {
+	s.writeFrame(muxGoAway, 0, 0, 0, nil)
+	s.close(errMuxClosed)
+	return nil
+}
+
+func (s *muxSession) close(err error) {
+	s.mu.Lock()
+	select {
+	case <-s.closed:
+		s.mu.Unlock()
+		return
+	default:
+	}
+	s.err = err
+	close(s.closed)
+	streams := s.streams
+	s.streams = make(map[uint32]*muxStream)
+	s.mu.Unlock()
+
+	s.conn.Close()
+	for _, st := range streams {
+		st.abort()
+	}
+}
+
+// Done is closed once the session has ended
+func (s *muxSession) Done() <-chan struct{} { return s.closed }
+
+func (s *muxSession) Streams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+// RTT is the round trip of the last keepalive ping
+func (s *muxSession) RTT() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rtt
+}
+
+// Open starts a new stream to the peer
+func (s *muxSession) Open() (*muxStream, error) {
+	s.mu.Lock()
+	select {
+	case <-s.closed:
+		s.mu.Unlock()
+		return nil, s.closeErr()
+	default:
+	}
+	if len(s.streams) >= muxMaxStreams {
+		s.mu.Unlock()
+		return nil, errMuxTooMany
+	}
+	st := newMuxStream(s, s.nextID)
+	s.nextID += 2
+	s.streams[st.id] = st
+	s.mu.Unlock()
+
+	if err := s.writeFrame(muxWindowUpdate, muxSYN, st.id, 0, nil); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// Accept waits for the peer to open a stream
+func (s *muxSession) Accept() (*muxStream, error) {
+	select {
+	case st := <-s.accepted:
+		return st, nil
+	case <-s.closed:
+		return nil, s.closeErr()
+	}
+}
+
+// Ping measures one round trip to the peer
+func (s *muxSession) Ping(timeout time.Duration) (time.Duration, error) {
+	s.mu.Lock()
+	s.pingSeq++
+	id, done := s.pingSeq, make(chan struct{})
+	s.pings[id] = done
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.pings, id)
+		s.mu.Unlock()
+	}()
+
+	start := time.Now()
+	if err := s.writeFrame(muxPing, muxSYN, 0, id, nil); err != nil {
+		return 0, err
+	}
+	select {
+	case <-done:
+		rtt := time.Since(start)
+		s.mu.Lock()
+		s.rtt = rtt
+		s.mu.Unlock()
+		s.latency.observe(rtt)
+		return rtt, nil
+	case <-s.closed:
+		return 0, s.closeErr()
+	case <-time.After(timeout):
+		s.latency.miss()
+		return 0, os.ErrDeadlineExceeded
+	}
+}
+
+// keepalive sends the link's heartbeats, see heartbeat.go, and gives up on
+// one that misses too many in a row
+func (s *muxSession) keepalive() {
+	missed := 0
+	for {
+		// Read every time so set_config applies to running links
+		hb := config.Get().Heartbeat.effective()
+		select {
+		case <-s.closed:
+			return
+		case <-time.After(hb.interval()):
+		}
+		if power.paused() {
+			// The peer's own heartbeats still reach us; start counting afresh on resume
+			missed = 0
+			continue
+		}
+		sent := time.Now().UnixNano()
+		_, err := s.Ping(hb.interval())
+		switch {
+		case err == nil:
+			missed = 0
+		case !errors.Is(err, os.ErrDeadlineExceeded):
+			s.close(fmt.Errorf("keepalive failed: %w", err))
+			return
+		case s.lastRecv.Load() >= sent:
+			// The answer is queued behind data the peer is sending, which
+			// shows it is there just as well
+			missed = 0
+		default:
+			if missed++; missed >= hb.Misses {
+				s.close(fmt.Errorf("%w: %d missed in a row", errPeerUnreachable, missed))
+				return
+			}
+		}
+	}
+}
+
+func (s *muxSession) recvLoop() {
+	var hdr [muxHeaderSize]byte
+	for {
+		if _, err := io.ReadFull(s.conn, hdr[:]); err != nil {
+			s.close(err)
+			return
+		}
+		s.lastRecv.Store(time.Now().UnixNano())
+		if hdr[0] != muxVersion {
+			s.close(fmt.Errorf("%w: version %d", errMuxProtocol, hdr[0]))
+			return
+		}
+		typ, flags := hdr[1], binary.BigEndian.Uint16(hdr[2:])
+		id, length := binary.BigEndian.Uint32(hdr[4:]), binary.BigEndian.Uint32(hdr[8:])
+
+		var err error
+		switch typ {
+		case muxData, muxWindowUpdate:
+			err = s.handleStreamFrame(typ, flags, id, length)
+		case muxPing:
+			if flags&muxSYN != 0 {
+				go s.writeFrame(muxPing, muxACK, 0, length, nil)
+			} else {
+				s.mu.Lock()
+				if done, ok := s.pings[length]; ok {
+					close(done)
+					delete(s.pings, length)
+				}
+				s.mu.Unlock()
+			}
+		case muxGoAway:
+			err = errMuxClosed
+		default:
+			err = fmt.Errorf("%w: frame type %d", errMuxProtocol, typ)
+		}
+		if err != nil {
+			s.close(err)
+			return
+		}
+		s.lastRecv.Store(time.Now().UnixNano())
+	}
+}
+
+func (s *muxSession) handleStreamFrame(typ byte, flags uint16, id, length uint32) error {
+	if typ == muxData && length > muxMaxFrame {
+		return fmt.Errorf("%w: %d byte frame", errMuxProtocol, length)
+	}
+	s.mu.Lock()
+	st := s.streams[id]
+	if flags&muxSYN != 0 && st == nil {
+		// The peer's streams have the other parity from ours
+		if (id%2 == 1) == s.client || id == 0 {
+			s.mu.Unlock()
+			return fmt.Errorf("%w: stream %d opened by the wrong side", errMuxProtocol, id)
+		}
+		if len(s.streams) >= muxMaxStreams {
+			s.mu.Unlock()
+			go s.writeFrame(muxWindowUpdate, muxRST, id, 0, nil)
+			return s.discard(typ, length)
+		}
+		st = newMuxStream(s, id)
+		s.streams[id] = st
+		select {
+		case s.accepted <- st:
+		default:
+			delete(s.streams, id)
+			s.mu.Unlock()
+			go s.writeFrame(muxWindowUpdate, muxRST, id, 0, nil)
+			return s.discard(typ, length)
+		}
+		go s.writeFrame(muxWindowUpdate, muxACK, id, 0, nil)
+	}
+	s.mu.Unlock()
+
+	if st == nil {
+		// A stream we already closed; whatever is still in flight is dropped
+		return s.discard(typ, length)
+	}
+	if typ == muxData {
+		if err := st.receive(s.conn, length); err != nil {
+			return err
+		}
+	} else if length > 0 {
+		st.grant(length)
+	}
+	if flags&muxRST != 0 {
+		s.forget(id)
+		st.abort()
+	} else if flags&muxFIN != 0 {
+		st.remoteClose()
+	}
+	return nil
+}
+
+func (s *muxSession) discard(typ byte, length uint32) error {
+	if typ != muxData || length == 0 {
+		return nil
+	}
+	_, err := io.CopyN(io.Discard, s.conn, int64(length))
+	return err
+}
+
+func (s *muxSession) forget(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
+
+// muxStream is one stream of a session; it is a net.Conn of its own
+type muxStream struct {
+	s  *muxSession
+	id uint32
+
+	mu         sync.Mutex
+	buf        bytes.Buffer
+	recvWindow uint32 // what the peer may still send
+	unacked    uint32 // read since the last window update
+	sendWindow uint32 // what we may still send
+	remoteDone bool   // FIN received
+	finSent    bool   // FIN sent; no more writes
+	localDone  bool   // closed on our side; no more reads
+	reset      bool
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readable      chan struct{}
+	writable      chan struct{}
+}
+
+func newMuxStream(s *muxSession, id uint32) *muxStream {
+	return &muxStream{
+		s:          s,
+		id:         id,
+		recvWindow: muxInitialWindow,
+		sendWindow: muxInitialWindow,
+		readable:   make(chan struct{}, 1),
+		writable:   make(chan struct{}, 1),
+	}
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// receive reads a data frame's payload off the session into the buffer
+func (st *muxStream) receive(r io.Reader, length uint32) error {
+	if length == 0 {
+		return nil
+	}
+	st.mu.Lock()
+	if length > st.recvWindow {
+		st.mu.Unlock()
+		return fmt.Errorf("%w: stream %d overran its window", errMuxProtocol, st.id)
+	}
+	st.recvWindow -= length
+	keep := !st.localDone && !st.reset
+	st.mu.Unlock()
+
+	if !keep {
+		_, err := io.CopyN(io.Discard, r, int64(length))
+		return err
+	}
+	chunk := make([]byte, length)
+	if _, err := io.ReadFull(r, chunk); err != nil {
+		return err
+	}
+	st.mu.Lock()
+	st.buf.Write(chunk)
+	st.mu.Unlock()
+	notify(st.readable)
+	return nil
+}
+
+func (st *muxStream) grant(n uint32) {
+	st.mu.Lock()
+	st.sendWindow += n
+	st.mu.Unlock()
+	notify(st.writable)
+}
+
+func (st *muxStream) remoteClose() {
+	st.mu.Lock()
+	st.remoteDone = true
+	both := st.finSent
+	st.mu.Unlock()
+	if both {
+		st.s.forget(st.id)
+	}
+	notify(st.readable)
+}
+
+// abort fails pending and future reads and writes
+func (st *muxStream) abort() {
+	st.mu.Lock()
+	st.reset = true
+	st.mu.Unlock()
+	notify(st.readable)
+	notify(st.writable)
+}
+
+// wait blocks until ch fires, the deadline passes or the session ends
+func (st *muxStream) wait(ch chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-ch:
+		return nil
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	case <-st.s.closed:
+		return st.s.closeErr()
+	}
+}
+
+func (st *muxStream) Read(b []byte) (int, error) {
+	for {
+		st.mu.Lock()
+		if st.buf.Len() > 0 {
+			n, _ := st.buf.Read(b)
+			st.unacked += uint32(n)
+			var update uint32
+			if st.unacked >= muxInitialWindow/2 && !st.remoteDone {
+				update, st.unacked = st.unacked, 0
+				st.recvWindow += update
+			}
+			st.mu.Unlock()
+			if update > 0 {
+				st.s.writeFrame(muxWindowUpdate, 0, st.id, update, nil)
+			}
+			return n, nil
+		}
+		switch {
+		case st.localDone:
+			st.mu.Unlock()
+			return 0, net.ErrClosed
+		case st.remoteDone:
+			st.mu.Unlock()
+			return 0, io.EOF
+		case st.reset:
+			st.mu.Unlock()
+			return 0, st.resetErr()
+		}
+		deadline := st.readDeadline
+		st.mu.Unlock()
+		if err := st.wait(st.readable, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (st *muxStream) resetErr() error {
+	select {
+	case <-st.s.closed:
+		return st.s.closeErr()
+	default:
+		return errMuxReset
+	}
+}
+
+func (st *muxStream) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		st.mu.Lock()
+		switch {
+		case st.finSent:
+			st.mu.Unlock()
+			return written, net.ErrClosed
+		case st.reset:
+			st.mu.Unlock()
+			return written, st.resetErr()
+		}
+		if st.sendWindow == 0 {
+			deadline := st.writeDeadline
+			st.mu.Unlock()
+			if err := st.wait(st.writable, deadline); err != nil {
+				return written, err
+			}
+			continue
+		}
+		n := min(uint32(len(b)-written), st.sendWindow, muxMaxFrame)
+		st.sendWindow -= n
+		st.mu.Unlock()
+		if err := st.s.writeFrame(muxData, 0, st.id, n, b[written:written+int(n)]); err != nil {
+			return written, err
+		}
+		written += int(n)
+	}
+	return written, nil
+}
+
+// CloseWrite sends FIN; the peer reads EOF once it has drained the stream
+func (st *muxStream) CloseWrite() error {
+	return st.finish(false)
+}
+
+// Close sends FIN and stops reading; data still arriving is dropped
+func (st *muxStream) Close() error {
+	return st.finish(true)
+}
+
+func (st *muxStream) finish(full bool) error {
+	st.mu.Lock()
+	fin := !st.finSent && !st.reset
+	st.finSent = true
+	if full {
+		st.localDone = true
+	}
+	forget := full || st.remoteDone
+	st.mu.Unlock()
+	if forget {
+		st.s.forget(st.id)
+	}
+	notify(st.readable)
+	notify(st.writable)
+	if !fin {
+		return nil
+	}
+	return st.s.writeFrame(muxWindowUpdate, muxFIN, st.id, 0, nil)
+}
+
+func (st *muxStream) LocalAddr() net.Addr  { return st.s.conn.LocalAddr() }
+func (st *muxStream) RemoteAddr() net.Addr { return st.s.conn.RemoteAddr() }
+
+func (st *muxStream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	return st.SetWriteDeadline(t)
+}
+
+func (st *muxStream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.readDeadline = t
+	st.mu.Unlock()
+	notify(st.readable)
+	return nil
+}
+
+func (st *muxStream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.writeDeadline = t
+	st.mu.Unlock()
+	notify(st.writable)
+	return nil
+}
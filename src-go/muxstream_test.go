@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func muxPair(t *testing.T) (*muxSession, *muxSession) {
+	a, b := net.Pipe()
+	client, server := newMuxSession(a, true), newMuxSession(b, false)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func TestMuxStreamsCarryDataBothWays(t *testing.T) {
+	client, server := muxPair(t)
+
+	// More than a window each way, so the transfer depends on updates
+	payload := make([]byte, 3*muxInitialWindow+123)
+	rand.Read(payload)
+
+	const streams = 4
+	errs := make(chan error, streams)
+	go func() {
+		for i := 0; i < streams; i++ {
+			st, err := server.Accept()
+			if err != nil {
+				errs <- err
+				return
+			}
+			go func() {
+				// Echo everything back, then half-close
+				_, err := io.Copy(st, st)
+				st.CloseWrite()
+				errs <- err
+			}()
+		}
+	}()
+
+	for i := 0; i < streams; i++ {
+		st, err := client.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			st.Write(payload)
+			st.CloseWrite()
+		}()
+		got, err := io.ReadAll(st)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, payload) {
+			t.Fatalf("stream %d: got %d bytes back, want %d", i, len(got), len(payload))
+		}
+		st.Close()
+	}
+	for i := 0; i < streams; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMuxStreamReadDeadline(t *testing.T) {
+	client, server := muxPair(t)
+	go server.Accept()
+	st, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, err := st.Read(make([]byte, 1)); !isTimeout(err) {
+		t.Fatalf("read past the deadline returned %v", err)
+	}
+}
+
+func TestMuxRejectsOverrun(t *testing.T) {
+	a, b := net.Pipe()
+	server := newMuxSession(b, false)
+	defer server.Close()
+
+	// A data frame larger than the stream's window ends the session
+	hdr := make([]byte, muxHeaderSize)
+	hdr[1] = muxData
+	binary.BigEndian.PutUint16(hdr[2:], muxSYN)
+	binary.BigEndian.PutUint32(hdr[4:], 1)
+	binary.BigEndian.PutUint32(hdr[8:], muxMaxFrame+1)
+	go func() {
+		a.Write(hdr)
+		io.Copy(io.Discard, a)
+	}()
+	select {
+	case <-server.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("session survived an oversized frame")
+	}
+	if err := server.closeErr(); !errors.Is(err, errMuxProtocol) {
+		t.Fatalf("closed with %v, want a protocol error", err)
+	}
+}
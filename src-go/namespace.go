@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// Namespaces let several frontend windows, or several user profiles in one
+// frontend, drive the same service without stepping on each other. A
+// request carrying "namespace" puts the listeners, connections and
+// transfers it starts in that namespace, and only lists, stops or cancels
+// what is in it. set_namespace does the same for every request on a
+// channel and also filters the channel's events down to that namespace.
+// Anything started outside a namespace belongs to everyone, and a request
+// without one sees everything, as before namespaces existed.
+const maxNamespaceLen = 64
+
+// scopes maps listener, connection and transfer ids to their namespace.
+// Ids outside any namespace are not in it, and a finished transfer moves
+// its namespace into its TransferInfo. It is a sync.Map so emitEvent
+// can tag events from goroutines holding state.Mutex or a transfer's lock.
+var scopes sync.Map
+
+// setScope puts id in namespace ns
+func setScope(id, ns string) {
+	if ns != "" {
+		scopes.Store(id, ns)
+	}
+}
+
+// dropScope forgets an id that is gone for good
+func dropScope(id string) {
+	scopes.Delete(id)
+}
+
+// scopeOf is the namespace of id, "" for none
+func scopeOf(id string) string {
+	if ns, ok := scopes.Load(id); ok {
+		return ns.(string)
+	}
+	return ""
+}
+
+// visible reports whether something in namespace ns is visible to a
+// request in namespace from
+func visible(ns, from string) bool {
+	return from == "" || ns == "" || ns == from
+}
+
+// inScope reports whether the listener, connection or transfer id is
+// visible to requests answered through writer
+func inScope(id string, writer *Output) bool {
+	return visible(scopeOf(id), writer.Namespace())
+}
+
+// validNamespace accepts up to 64 letters, digits, dots, dashes and
+// underscores
+func validNamespace(ns string) bool {
+	if ns == "" || len(ns) > maxNamespaceLen {
+		return false
+	}
+	for _, r := range ns {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '.' || r == '-' || r == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// eventNamespace finds the namespace of the listener, connection or
+// transfer an event is about
+func eventNamespace(data interface{}) string {
+	switch d := data.(type) {
+	case TransferInfo:
+		return d.Namespace
+	case TransferProgress:
+		return scopeOf(d.ID)
+	case ConnectionInfo:
+		return scopeOf(d.ID)
+	case map[string]interface{}:
+		if ns, ok := d["namespace"].(string); ok {
+			return ns
+		}
+		for _, key := range []string{"id", "transfer_id", "connection_id", "listener_id"} {
+			if id, ok := d[key].(string); ok {
+				if ns := scopeOf(id); ns != "" {
+					return ns
+				}
+			}
+		}
+	}
+	return ""
+}
+
+type SetNamespacePayload struct {
+	Namespace string `json:"namespace"` // "" leaves the channel's namespace
+}
+
+// handleSetNamespace scopes every later request on the channel, and the
+// events it receives, to a namespace
+func handleSetNamespace(payload json.RawMessage, writer *Output) {
+	var p SetNamespacePayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		sendInvalidPayload(writer, "set_namespace")
+		return
+	}
+	if p.Namespace != "" && !validNamespace(p.Namespace) {
+		sendErrorCode(writer, ErrInvalidArgument, message("namespace.namespace_must_most", "max", maxNamespaceLen), nil)
+		return
+	}
+	writer.SetNamespace(p.Namespace)
+	writer.Encode(ProtocolResponse{Status: "ok", Data: map[string]interface{}{"namespace": p.Namespace}})
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestNamespaceFiltersEvents(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewOutput(&buf)
+	handleSetNamespace(json.RawMessage(`{"namespace":"window-1"}`), w)
+	buf.Reset()
+
+	for _, ns := range []string{"window-1", "window-2", ""} {
+		w.Encode(ProtocolEvent{Status: "event", Event: "probe_" + strings.ReplaceAll(ns, "-", "_"), Namespace: ns})
+	}
+	got := buf.String()
+	if !strings.Contains(got, "probe_window_1") || !strings.Contains(got, `"probe_"`) || strings.Contains(got, "probe_window_2") {
+		t.Errorf("channel in window-1 received %s", got)
+	}
+
+	buf.Reset()
+	handleSetNamespace(json.RawMessage(`{"namespace":"bad namespace"}`), w)
+	if !strings.Contains(buf.String(), `"error"`) {
+		t.Errorf("invalid namespace accepted: %s", buf.String())
+	}
+}
+
+func TestNamespaceScopesRequests(t *testing.T) {
+	mine := newTransfer("send", "mine.txt", "", "peer:1", 1)
+	setScope(mine.ID, "alice")
+	theirs := newTransfer("send", "theirs.txt", "", "peer:1", 1)
+	setScope(theirs.ID, "bob")
+	shared := newTransfer("send", "shared.txt", "", "peer:1", 1)
+	defer func() {
+		for _, tr := range []*Transfer{mine, theirs, shared} {
+			tr.finish(nil)
+		}
+	}()
+
+	if ev := eventNamespace(mine.Info()); ev != "alice" {
+		t.Errorf("event about alice's transfer tagged %q", ev)
+	}
+	if ev := eventNamespace(map[string]interface{}{"id": theirs.ID}); ev != "bob" {
+		t.Errorf("event about bob's transfer tagged %q", ev)
+	}
+
+	var buf bytes.Buffer
+	handleRequest(ProtocolRequest{Command: "list_transfers", Namespace: "alice"}, NewOutput(&buf))
+	got := buf.String()
+	if !strings.Contains(got, mine.ID+`"`) || !strings.Contains(got, shared.ID+`"`) || strings.Contains(got, theirs.ID+`"`) {
+		t.Errorf("alice listed %s", got)
+	}
+
+	buf.Reset()
+	handleRequest(ProtocolRequest{Command: "cancel", Namespace: "alice",
+		Payload: json.RawMessage(`{"id":"` + theirs.ID + `"}`)}, NewOutput(&buf))
+	if !strings.Contains(buf.String(), `"error"`) {
+		t.Errorf("alice canceled bob's transfer: %s", buf.String())
+	}
+
+	buf.Reset()
+	handleRequest(ProtocolRequest{Command: "list_transfers"}, NewOutput(&buf))
+	if !strings.Contains(buf.String(), theirs.ID+`"`) {
+		t.Errorf("a request without a namespace missed bob's transfer: %s", buf.String())
+	}
+}
+
+func TestNamespaceHidesListeners(t *testing.T) {
+	l := &Listener{Addr: "127.0.0.1:1", Type: "tcp"}
+	l.assignID()
+	state.Mutex.Lock()
+	state.Listeners[l.ID] = l
+	state.Mutex.Unlock()
+	setScope(l.ID, "alice")
+	defer func() {
+		state.Mutex.Lock()
+		delete(state.Listeners, l.ID)
+		state.Mutex.Unlock()
+		dropScope(l.ID)
+	}()
+
+	for ns, want := range map[string]bool{"alice": true, "bob": false, "": true} {
+		w := NewOutput(&bytes.Buffer{})
+		if ns != "" {
+			w = w.inNamespace(ns)
+		}
+		state.Mutex.Lock()
+		_, byID := findListenerLocked(ListenerRef{ListenerID: l.ID}, w)
+		_, byAddr := findListenerLocked(ListenerRef{Host: "127.0.0.1", Port: 1}, w)
+		state.Mutex.Unlock()
+		if byID != want || byAddr != want {
+			t.Errorf("namespace %q found the listener by id %v, by address %v", ns, byID, byAddr)
+		}
+	}
+}
+
+func TestNamespaceScopesLookups(t *testing.T) {
+	c := &Connection{ID: "conn-scope-test", Direction: "inbound", Network: "tcp", Limiter: newRateLimiter(0)}
+	state.Mutex.Lock()
+	state.Conns[c.ID] = c
+	state.Mutex.Unlock()
+	setScope(c.ID, "bob")
+	defer func() {
+		state.Mutex.Lock()
+		delete(state.Conns, c.ID)
+		state.Mutex.Unlock()
+		dropScope(c.ID)
+	}()
+
+	var buf bytes.Buffer
+	handleRequest(ProtocolRequest{Command: "set_connection_timeouts", Namespace: "alice",
+		Payload: json.RawMessage(`{"id":"` + c.ID + `","idle_timeout_ms":1000}`)}, NewOutput(&buf))
+	if !strings.Contains(buf.String(), "Connection not found") {
+		t.Errorf("alice set timeouts on bob's connection: %s", buf.String())
+	}
+	if _, ok := lookupConn(c.ID, NewOutput(&buf)); !ok {
+		t.Error("a request without a namespace missed bob's connection")
+	}
+
+	// A finished transfer leaves scopes but stays in its namespace
+	tr := newTransfer("receive", "done.txt", "", "peer:1", 1)
+	setScope(tr.ID, "bob")
+	tr.finish(nil)
+	if _, ok := scopes.Load(tr.ID); ok {
+		t.Error("finished transfer still in scopes")
+	}
+	for ns, want := range map[string]bool{"alice": false, "bob": true, "": true} {
+		w := NewOutput(&bytes.Buffer{})
+		if ns != "" {
+			w = w.inNamespace(ns)
+		}
+		if _, ok := lookupTransfer(tr.ID, w); ok != want {
+			t.Errorf("namespace %q found the finished transfer: %v", ns, ok)
+		}
+	}
+	if ev := eventNamespace(tr.Info()); ev != "bob" {
+		t.Errorf("event about the finished transfer tagged %q", ev)
+	}
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSTUNServer = "stun.l.google.com:19302"
+
+	stunBindingRequest  = 0x0001
+	stunBindingResponse = 0x0101
+	stunMagicCookie     = 0x2112A442
+	stunMappedAddress   = 0x0001
+	stunXorMappedAddr   = 0x0020
+
+	punchInterval       = 200 * time.Millisecond
+	defaultPunchTimeout = 15 * time.Second
+)
+
+// Punch packets carry a shared token so stray datagrams are ignored.
+// "SYN" opens the hole, "ACK" confirms the peer saw us.
+const (
+	punchSyn = "LUMINA-PUNCH-SYN "
+	punchAck = "LUMINA-PUNCH-ACK "
+)
+
+// stunRequest sends a Binding request from conn and returns the
+// server-reflexive (public) address the server saw
+func stunRequest(conn *net.UDPConn, server *net.UDPAddr, timeout time.Duration) (*net.UDPAddr, error) {
+	txID := make([]byte, 12)
+	rand.Read(txID)
+
+	req := make([]byte, 20)
+	binary.BigEndian.PutUint16(req[0:], stunBindingRequest)
+	binary.BigEndian.PutUint16(req[2:], 0)
+	binary.BigEndian.PutUint32(req[4:], stunMagicCookie)
+	copy(req[8:], txID)
+
+	deadline := time.Now().Add(timeout)
+	buf := make([]byte, 1500)
+	// Retransmit with a growing interval as RFC 5389 suggests, until the deadline
+	for wait := 500 * time.Millisecond; time.Now().Before(deadline); wait *= 2 {
+		if _, err := conn.WriteToUDP(req, server); err != nil {
+			return nil, err
+		}
+
+		attemptEnd := time.Now().Add(wait)
+		if attemptEnd.After(deadline) {
+			attemptEnd = deadline
+		}
+		conn.SetReadDeadline(attemptEnd)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				break // retransmit
+			}
+			if !from.IP.Equal(server.IP) || from.Port != server.Port {
+				continue
+			}
+			if addr, err := parseSTUNResponse(buf[:n], txID); err == nil {
+				conn.SetReadDeadline(time.Time{})
+				return addr, nil
+			}
+		}
+	}
+	conn.SetReadDeadline(time.Time{})
+	return nil, catalogError(ErrFailed, "nat.stun_server_did_not")
+}
+
+func parseSTUNResponse(msg, txID []byte) (*net.UDPAddr, error) {
+	if len(msg) < 20 || binary.BigEndian.Uint16(msg[0:]) != stunBindingResponse {
+		return nil, errors.New("not a binding response")
+	}
+	if binary.BigEndian.Uint32(msg[4:]) != stunMagicCookie || !bytes.Equal(msg[8:20], txID) {
+		return nil, errors.New("transaction mismatch")
+	}
+
+	length := int(binary.BigEndian.Uint16(msg[2:]))
+	if 20+length > len(msg) {
+		return nil, errors.New("truncated response")
+	}
+	attrs := msg[20 : 20+length]
+
+	var mapped *net.UDPAddr
+	for len(attrs) >= 4 {
+		attrType := binary.BigEndian.Uint16(attrs[0:])
+		attrLen := int(binary.BigEndian.Uint16(attrs[2:]))
+		if 4+attrLen > len(attrs) {
+			break
+		}
+		value := attrs[4 : 4+attrLen]
+
+		switch attrType {
+		case stunXorMappedAddr:
+			if addr := decodeSTUNAddress(value, true, txID); addr != nil {
+				return addr, nil
+			}
+		case stunMappedAddress:
+			mapped = decodeSTUNAddress(value, false, txID)
+		}
+
+		// Attributes are padded to a multiple of four bytes
+		advance := 4 + (attrLen+3)&^3
+		if advance > len(attrs) {
+			break
+		}
+		attrs = attrs[advance:]
+	}
+	if mapped != nil {
+		return mapped, nil
+	}
+	return nil, errors.New("response has no mapped address")
+}
+
+func decodeSTUNAddress(value []byte, xor bool, txID []byte) *net.UDPAddr {
+	if len(value) < 8 {
+		return nil
+	}
+	family := value[1]
+	port := binary.BigEndian.Uint16(value[2:])
+
+	var ip net.IP
+	switch {
+	case family == 0x01 && len(value) >= 8:
+		ip = append(net.IP{}, value[4:8]...)
+	case family == 0x02 && len(value) >= 20:
+		ip = append(net.IP{}, value[4:20]...)
+	default:
+		return nil
+	}
+
+	if xor {
+		port ^= uint16(stunMagicCookie >> 16)
+		key := make([]byte, 16)
+		binary.BigEndian.PutUint32(key, stunMagicCookie)
+		copy(key[4:], txID)
+		for i := range ip {
+			ip[i] ^= key[i]
+		}
+	}
+	return &net.UDPAddr{IP: ip, Port: int(port)}
+}
+
+type STUNPayload struct {
+	Server    string `json:"server"`
+	LocalPort int    `json:"local_port"` // reuse the same port for punch_hole afterwards
+	TimeoutMs int    `json:"timeout_ms"`
+}
+
+func handleSTUNDiscover(payload json.RawMessage, writer *Output) {
+	var p STUNPayload
+	if len(payload) > 0 && string(payload) != "null" {
+		if err := json.Unmarshal(payload, &p); err != nil {
+			sendInvalidPayload(writer, "stun_discover")
+			return
+		}
+	}
+	if p.Server == "" {
+		p.Server = defaultSTUNServer
+	}
+	timeout := 5 * time.Second
+	if p.TimeoutMs > 0 {
+		timeout = time.Duration(p.TimeoutMs) * time.Millisecond
+	}
+
+	server, err := net.ResolveUDPAddr("udp4", p.Server)
+	if err != nil {
+		sendError(writer, message("nat.failed_resolve_stun_server", "error", err))
+		return
+	}
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{Port: p.LocalPort})
+	if err != nil {
+		sendErrorCode(writer, ErrBindFailed, message("nat.failed_bind_udp_port", "local_port", p.LocalPort, "error", err), nil)
+		return
+	}
+	defer conn.Close()
+
+	public, err := stunRequest(conn, server, timeout)
+	if err != nil {
+		sendFailure(writer, err)
+		return
+	}
+
+	local := conn.LocalAddr().(*net.UDPAddr)
+	writer.Encode(ProtocolResponse{
+		Status: "ok",
+		Data: map[string]interface{}{
+			"public_ip":   public.IP.String(),
+			"public_port": public.Port,
+			"public_addr": public.String(),
+			"local_port":  local.Port,
+			"server":      p.Server,
+			// The mapping is only directly reachable when the NAT preserves the port
+			"port_preserved": public.Port == local.Port,
+		},
+	})
+}
+
+type PunchHolePayload struct {
+	LocalPort  int      `json:"local_port"`
+	Candidates []string `json:"candidates"` // peer "host:port" addresses to try
+	Token      string   `json:"token"`      // shared secret exchanged out of band
+	TimeoutMs  int      `json:"timeout_ms"`
+}
+
+func handlePunchHole(payload json.RawMessage, writer *Output) {
+	var p PunchHolePayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		sendInvalidPayload(writer, "punch_hole")
+		return
+	}
+	if len(p.Candidates) == 0 || p.Token == "" {
+		sendErrorCode(writer, ErrInvalidArgument, message("nat.punch_hole_requires_candidates"), nil)
+		return
+	}
+
+	var candidates []*net.UDPAddr
+	for _, candidate := range p.Candidates {
+		addr, err := net.ResolveUDPAddr("udp4", candidate)
+		if err != nil {
+			sendErrorCode(writer, ErrInvalidArgument, message("common.invalid_candidate", "addr", candidate, "error", err), nil)
+			return
+		}
+		candidates = append(candidates, addr)
+	}
+
+	timeout := defaultPunchTimeout
+	if p.TimeoutMs > 0 {
+		timeout = time.Duration(p.TimeoutMs) * time.Millisecond
+	}
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{Port: p.LocalPort})
+	if err != nil {
+		sendErrorCode(writer, ErrBindFailed, message("nat.failed_bind_udp_port", "local_port", p.LocalPort, "error", err), nil)
+		return
+	}
+
+	local := conn.LocalAddr().(*net.UDPAddr)
+	writer.Encode(okResponse(message("nat.hole_punching_started"),
+		map[string]interface{}{"local_port": local.Port, "candidates": p.Candidates}))
+
+	go punch(conn, candidates, p.Token, timeout)
+}
+
+// punch sprays SYNs at every candidate until one answers, then hands the
+// socket over to the connection registry bound to the winning address
+func punch(conn *net.UDPConn, candidates []*net.UDPAddr, token string, timeout time.Duration) {
+	syn := []byte(punchSyn + token)
+	ack := []byte(punchAck + token)
+
+	stop := make(chan struct{})
+	var stopOnce sync.Once
+	go func() {
+		ticker := time.NewTicker(punchInterval)
+		defer ticker.Stop()
+		for {
+			for _, addr := range candidates {
+				conn.WriteToUDP(syn, addr)
+			}
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	defer stopOnce.Do(func() { close(stop) })
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			conn.Close()
+			emitEvent("punch_failed", map[string]interface{}{
+				"local_port": conn.LocalAddr().(*net.UDPAddr).Port,
+				"reason":     "no response from any candidate",
+			})
+			return
+		}
+
+		switch string(buf[:n]) {
+		case string(syn):
+			// The peer's SYN got through, so our side of the hole is open too
+			conn.WriteToUDP(ack, from)
+		case string(ack):
+		default:
+			continue
+		}
+
+		stopOnce.Do(func() { close(stop) })
+		// Make sure the peer sees an ACK even if it has not yet received one
+		conn.WriteToUDP(ack, from)
+		conn.SetReadDeadline(time.Time{})
+
+		c := trackConn(newUDPPathConn(&udpPeerConn{UDPConn: conn, remote: from, ack: ack, syn: syn}), "outbound", "udp", nil)
+		if c == nil {
+			conn.Close()
+			return
+		}
+		emitEvent("punch_succeeded", c.Info())
+		logger.Info("udp hole punched", "id", c.ID, "remote", from.String())
+		readOutbound(c, dialSpec{}, ReconnectOptions{})
+		return
+	}
+}
+
+// udpPeerConn is an unconnected UDP socket pinned to one remote address.
+// Leftover punch packets are swallowed so they never reach the application.
+type udpPeerConn struct {
+	*net.UDPConn
+	remote   *net.UDPAddr
+	syn, ack []byte
+}
+
+func (u *udpPeerConn) Read(b []byte) (int, error) {
+	for {
+		n, from, err := u.ReadFromUDP(b)
+		if err != nil {
+			return 0, err
+		}
+		if !from.IP.Equal(u.remote.IP) || from.Port != u.remote.Port {
+			continue
+		}
+		if bytes.Equal(b[:n], u.syn) || bytes.Equal(b[:n], u.ack) {
+			continue
+		}
+		return n, nil
+	}
+}
+
+func (u *udpPeerConn) Write(b []byte) (int, error) {
+	return u.WriteToUDP(b, u.remote)
+}
+
+func (u *udpPeerConn) RemoteAddr() net.Addr {
+	return u.remote
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"net"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/grandcat/zeroconf"
+)
+
+// Network changes: a laptop that roams to another Wi-Fi network, or brings
+// a VPN up or down, kept its mDNS sockets on the interfaces it started
+// with and its peers' addresses from the network it left, and so
+// disappeared from peers until restart. watchNetwork polls the interfaces
+// and their addresses. On a change it registers the discovery and drop
+// mode advertisements again on the interfaces there are now, starts a fresh browse pass rather than
+// waiting out the current one, drops peer addresses no local network
+// reaches any more, pings the mux links as a wake does when addresses went
+// away, and reports it all as network_changed.
+const netWatchInterval = 5 * time.Second
+
+// networkSnapshot maps each interface that is up, loopback aside, to its
+// addresses in CIDR form, sorted
+type networkSnapshot map[string][]string
+
+// readNetworks takes a snapshot of the interfaces; a variable so tests can
+// stage a change
+var readNetworks = func() (networkSnapshot, error) {
+	ifaces, err := listInterfaces()
+	if err != nil {
+		return nil, err
+	}
+	snap := make(networkSnapshot)
+	for _, ifi := range ifaces {
+		if !ifi.Up || ifi.Loopback {
+			continue
+		}
+		cidrs := []string{}
+		for _, a := range ifi.Addresses {
+			cidrs = append(cidrs, a.CIDR)
+		}
+		sort.Strings(cidrs)
+		snap[ifi.Name] = cidrs
+	}
+	return snap, nil
+}
+
+// NetworkChange is what differs between two snapshots
+type NetworkChange struct {
+	InterfacesUp   []string `json:"interfaces_up"`
+	InterfacesDown []string `json:"interfaces_down"`
+	Added          []string `json:"addresses_added"`   // "interface cidr"
+	Removed        []string `json:"addresses_removed"` // "interface cidr"
+}
+
+func (c NetworkChange) empty() bool {
+	return len(c.InterfacesUp)+len(c.InterfacesDown)+len(c.Added)+len(c.Removed) == 0
+}
+
+// lostAddresses is whether something went away, which can break what
+// already runs; a new network only needs announcing on
+func (c NetworkChange) lostAddresses() bool {
+	return len(c.InterfacesDown) > 0 || len(c.Removed) > 0
+}
+
+func diffNetworks(old, cur networkSnapshot) NetworkChange {
+	ch := NetworkChange{InterfacesUp: []string{}, InterfacesDown: []string{}, Added: []string{}, Removed: []string{}}
+	for name, addrs := range cur {
+		prev, ok := old[name]
+		if !ok {
+			ch.InterfacesUp = append(ch.InterfacesUp, name)
+		}
+		for _, a := range addrs {
+			if !slices.Contains(prev, a) {
+				ch.Added = append(ch.Added, name+" "+a)
+			}
+		}
+	}
+	for name, addrs := range old {
+		now, ok := cur[name]
+		if !ok {
+			ch.InterfacesDown = append(ch.InterfacesDown, name)
+		}
+		for _, a := range addrs {
+			if !slices.Contains(now, a) {
+				ch.Removed = append(ch.Removed, name+" "+a)
+			}
+		}
+	}
+	for _, list := range [][]string{ch.InterfacesUp, ch.InterfacesDown, ch.Added, ch.Removed} {
+		sort.Strings(list)
+	}
+	return ch
+}
+
+// watchNetwork notices interfaces and addresses coming and going
+func watchNetwork() {
+	last, err := readNetworks()
+	if err != nil {
+		logger.Warn("cannot read network interfaces", "error", err)
+	}
+	for range time.Tick(netWatchInterval) {
+		cur, err := readNetworks()
+		if err != nil {
+			continue
+		}
+		// Without a first snapshot there is nothing to compare against
+		if last != nil {
+			if ch := diffNetworks(last, cur); !ch.empty() {
+				networkChanged(ch, cur)
+			}
+		}
+		last = cur
+	}
+}
+
+// networkChanged catches the node up with the networks in cur
+func networkChanged(ch NetworkChange, cur networkSnapshot) {
+	rediscovering := false
+	discovery.Mutex.Lock()
+	if discovery.Running {
+		rediscovering = true
+		if err := rebindDiscoveryLocked(); err != nil {
+			logger.Warn("discovery could not advertise after a network change", "error", err)
+		}
+	}
+	discovery.Mutex.Unlock()
+	dropMode.mu.Lock()
+	if err := rebindDropLocked(); err != nil {
+		logger.Warn("drop mode could not advertise after a network change", "error", err)
+	}
+	dropMode.mu.Unlock()
+
+	stale, lost := dropStalePeerAddrs(cur)
+	lostNames := []string{}
+	for _, peer := range lost {
+		lostNames = append(lostNames, peer.Instance)
+		emitEvent("peer_lost", peer)
+	}
+	sort.Strings(lostNames)
+
+	alive, linksLost := []string{}, []string{}
+	if ch.lostAddresses() {
+		alive, linksLost = checkMuxLinks()
+	}
+	logger.Info("network changed", "up", ch.InterfacesUp, "down", ch.InterfacesDown,
+		"added", len(ch.Added), "removed", len(ch.Removed), "stale_addresses", stale, "links_lost", len(linksLost))
+	emitEvent("network_changed", map[string]interface{}{
+		"interfaces_up":     ch.InterfacesUp,
+		"interfaces_down":   ch.InterfacesDown,
+		"addresses_added":   ch.Added,
+		"addresses_removed": ch.Removed,
+		"rediscovering":     rediscovering,
+		"stale_addresses":   stale,
+		"peers_lost":        lostNames,
+		"links_ok":          alive,
+		"links_lost":        linksLost,
+	})
+}
+
+// rebindDiscoveryLocked registers the advertisement again, which binds it
+// to the interfaces there are now, and restarts browsing with a fresh
+// pass; discovery.Mutex must be held
+func rebindDiscoveryLocked() error {
+	if discovery.cancel != nil {
+		discovery.cancel()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	discovery.cancel = cancel
+	service, self, family := discovery.Service, discovery.Instance, discovery.family
+	goSafe("discovery browser", func() { browseLoop(ctx, service, self, family) })
+
+	if discovery.port == 0 {
+		return nil
+	}
+	if discovery.server != nil {
+		discovery.server.Shutdown()
+		discovery.server = nil
+	}
+	server, err := zeroconf.Register(discovery.Instance, discovery.Service, discoveryDomain, discovery.port, discovery.text, nil)
+	if err != nil {
+		return err
+	}
+	discovery.server = server
+	return nil
+}
+
+// dropStalePeerAddrs removes the peer addresses no network in cur reaches:
+// those outside every local subnet, and link-local ones zoned to an
+// interface that went away. It returns how many it removed and the peers
+// left without any, which are forgotten.
+func dropStalePeerAddrs(cur networkSnapshot) (int, []*Peer) {
+	var subnets []*net.IPNet
+	for _, cidrs := range cur {
+		for _, cidr := range cidrs {
+			if _, n, err := net.ParseCIDR(cidr); err == nil {
+				subnets = append(subnets, n)
+			}
+		}
+	}
+	reachable := func(addr string) bool {
+		host, zone, zoned := strings.Cut(addr, "%")
+		if zoned {
+			_, up := cur[zone]
+			return up
+		}
+		ip := net.ParseIP(host)
+		return ip != nil && slices.ContainsFunc(subnets, func(n *net.IPNet) bool { return n.Contains(ip) })
+	}
+	keep := func(addrs []string) ([]string, int) {
+		kept := []string{}
+		for _, addr := range addrs {
+			if reachable(addr) {
+				kept = append(kept, addr)
+			}
+		}
+		return kept, len(addrs) - len(kept)
+	}
+
+	stale := 0
+	var lost []*Peer
+	discovery.Mutex.Lock()
+	defer discovery.Mutex.Unlock()
+	for name, peer := range discovery.Peers {
+		v4, n4 := keep(peer.IPv4)
+		v6, n6 := keep(peer.IPv6)
+		if n4+n6 == 0 {
+			continue
+		}
+		stale += n4 + n6
+		if len(v4)+len(v6) == 0 {
+			delete(discovery.Peers, name)
+			lost = append(lost, peer)
+			continue
+		}
+		// Events already emitted may still hold the old one
+		updated := *peer
+		updated.IPv4, updated.IPv6 = v4, v6
+		discovery.Peers[name] = &updated
+	}
+	return stale, lost
+}
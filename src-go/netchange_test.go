@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestDiffNetworks(t *testing.T) {
+	old := networkSnapshot{
+		"wlan0": {"192.168.1.5/24", "fe80::1/64"},
+		"tun0":  {"10.8.0.2/24"},
+	}
+	cur := networkSnapshot{
+		"wlan0": {"172.20.3.9/16", "fe80::1/64"},
+		"eth0":  {},
+	}
+	ch := diffNetworks(old, cur)
+	if !slices.Equal(ch.InterfacesUp, []string{"eth0"}) || !slices.Equal(ch.InterfacesDown, []string{"tun0"}) {
+		t.Errorf("interfaces up %v, down %v", ch.InterfacesUp, ch.InterfacesDown)
+	}
+	if !slices.Equal(ch.Added, []string{"wlan0 172.20.3.9/16"}) {
+		t.Errorf("added %v", ch.Added)
+	}
+	if !slices.Equal(ch.Removed, []string{"tun0 10.8.0.2/24", "wlan0 192.168.1.5/24"}) {
+		t.Errorf("removed %v", ch.Removed)
+	}
+	if !diffNetworks(cur, cur).empty() {
+		t.Error("an unchanged network reported a change")
+	}
+}
+
+func TestNetworkChangeDropsStalePeerAddresses(t *testing.T) {
+	discovery.Mutex.Lock()
+	saved := discovery.Peers
+	discovery.Peers = map[string]*Peer{
+		"desk": {Instance: "desk", IPv4: []string{"192.168.1.9", "10.8.0.7"}, IPv6: []string{"fe80::2%tun0", "fe80::3%wlan0"}},
+		"vpn":  {Instance: "vpn", IPv4: []string{"10.8.0.7"}, IPv6: []string{}},
+	}
+	discovery.Mutex.Unlock()
+	t.Cleanup(func() {
+		discovery.Mutex.Lock()
+		discovery.Peers = saved
+		discovery.Mutex.Unlock()
+	})
+	var events bytes.Buffer
+	savedOutput := output
+	output = NewOutput(&events)
+	t.Cleanup(func() { output = savedOutput })
+
+	// The VPN went down, the Wi-Fi stayed
+	cur := networkSnapshot{"wlan0": {"192.168.1.5/24", "fe80::1/64"}}
+	networkChanged(NetworkChange{InterfacesDown: []string{"tun0"}, Removed: []string{"tun0 10.8.0.2/24"}}, cur)
+
+	discovery.Mutex.Lock()
+	desk, kept := discovery.Peers["desk"]
+	_, vpn := discovery.Peers["vpn"]
+	discovery.Mutex.Unlock()
+	if !kept || vpn {
+		t.Fatalf("peers left: desk %v, vpn %v", kept, vpn)
+	}
+	if !slices.Equal(desk.IPv4, []string{"192.168.1.9"}) || !slices.Equal(desk.IPv6, []string{"fe80::3%wlan0"}) {
+		t.Errorf("desk kept %v %v", desk.IPv4, desk.IPv6)
+	}
+
+	var changed map[string]interface{}
+	lost := false
+	for _, line := range strings.Split(strings.TrimSpace(events.String()), "\n") {
+		var ev ProtocolEvent
+		if err := json.Unmarshal([]byte(line), &ev); err != nil {
+			t.Fatal(err)
+		}
+		switch ev.Event {
+		case "peer_lost":
+			lost = true
+		case "network_changed":
+			changed, _ = ev.Data.(map[string]interface{})
+		}
+	}
+	if !lost || changed == nil {
+		t.Fatalf("events: %s", events.String())
+	}
+	if changed["stale_addresses"] != float64(3) || changed["rediscovering"] != false {
+		t.Errorf("network_changed %v", changed)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"math/rand/v2"
+	"sync/atomic"
+	"time"
+)
+
+// Simulated network conditions, for testing the frontend against a bad
+// network without a real one. set_netem adds latency, jitter, loss and a
+// bandwidth cap to a connection, or to every connection of a listener,
+// inside Connection's Read and Write, much like Linux netem does to an
+// interface. It is a developer tool and only answers once the config
+// turns on developer mode.
+//
+// Latency and jitter delay each read and write, so chatty protocols slow
+// down the way they do over a long link. On UDP a lost datagram is
+// dropped; on a stream it stalls for a retransmission timeout instead,
+// which is what the application sees of loss under TCP.
+const (
+	maxNetemLatency  = 10 * time.Second
+	minNetemStall    = 200 * time.Millisecond // the least TCP waits before resending
+	defaultNetemSide = "both"
+)
+
+// NetemOptions are the conditions to simulate; all zero removes them
+type NetemOptions struct {
+	LatencyMs   int     `json:"latency_ms,omitempty"`
+	JitterMs    int     `json:"jitter_ms,omitempty"`    // latency varies by up to this much either way
+	LossPercent float64 `json:"loss_percent,omitempty"` // chance each read or write is lost
+	BytesPerSec int64   `json:"bytes_per_sec,omitempty"`
+	Direction   string  `json:"direction,omitempty"` // "in", "out" or "both" (default)
+}
+
+func (o NetemOptions) Validate() error {
+	switch {
+	case o.LatencyMs < 0 || o.JitterMs < 0 || o.BytesPerSec < 0:
+		return catalogError(ErrInvalidArgument, "netem.latency_jitter_bytes_must")
+	// Each on its own first, as a huge pair can overflow the sum
+	case o.LatencyMs > int(maxNetemLatency/time.Millisecond) || o.JitterMs > int(maxNetemLatency/time.Millisecond) ||
+		time.Duration(o.LatencyMs+o.JitterMs)*time.Millisecond > maxNetemLatency:
+		return catalogError(ErrInvalidArgument, "netem.latency_plus_jitter_must")
+	case o.LossPercent < 0 || o.LossPercent > 100:
+		return catalogError(ErrInvalidArgument, "netem.loss_percent_must_between")
+	}
+	switch o.Direction {
+	case "", "in", "out", "both":
+	default:
+		return catalogError(ErrUnsupported, "netem.unsupported_direction", "direction", o.Direction)
+	}
+	return nil
+}
+
+func (o NetemOptions) empty() bool {
+	return o.LatencyMs == 0 && o.JitterMs == 0 && o.LossPercent == 0 && o.BytesPerSec == 0
+}
+
+// Netem applies one set of conditions; a listener's is shared by all of
+// its connections, so the bandwidth cap holds for them together
+type Netem struct {
+	opts    NetemOptions
+	limiter *RateLimiter
+	since   time.Time
+
+	delayed atomic.Uint64
+	lost    atomic.Uint64
+}
+
+func newNetem(o NetemOptions) *Netem {
+	if o.Direction == "" {
+		o.Direction = defaultNetemSide
+	}
+	return &Netem{opts: o, limiter: newRateLimiter(o.BytesPerSec), since: time.Now()}
+}
+
+// applies reports whether traffic in direction dir is affected
+func (n *Netem) applies(dir string) bool {
+	return n != nil && (n.opts.Direction == "both" || n.opts.Direction == dir)
+}
+
+// delay is one latency sample
+func (n *Netem) delay() time.Duration {
+	d := time.Duration(n.opts.LatencyMs) * time.Millisecond
+	if j := n.opts.JitterMs; j > 0 {
+		d += time.Duration(rand.IntN(2*j+1)-j) * time.Millisecond
+	}
+	return max(d, 0)
+}
+
+// pass holds up size bytes as the conditions say. It is false when a
+// datagram is lost and must not be delivered.
+func (n *Netem) pass(size int, datagram bool) bool {
+	n.limiter.WaitN(size)
+	wait := n.delay()
+	if n.opts.LossPercent > 0 && rand.Float64()*100 < n.opts.LossPercent {
+		n.lost.Add(1)
+		if datagram {
+			return false
+		}
+		// The stream gets through after a resend, a round trip or more later
+		wait += max(minNetemStall, 2*time.Duration(n.opts.LatencyMs)*time.Millisecond)
+	}
+	if wait > 0 {
+		n.delayed.Add(1)
+		time.Sleep(wait)
+	}
+	return true
+}
+
+// NetemInfo is the JSON view of simulated conditions
+type NetemInfo struct {
+	NetemOptions
+	Scope   string    `json:"scope"` // "connection" or "listener"
+	Since   time.Time `json:"since"`
+	Delayed uint64    `json:"delayed"` // reads and writes held up
+	Lost    uint64    `json:"lost"`    // datagrams dropped or stream stalls
+}
+
+func (n *Netem) Info(scope string) *NetemInfo {
+	return &NetemInfo{NetemOptions: n.opts, Scope: scope, Since: n.since, Delayed: n.delayed.Load(), Lost: n.lost.Load()}
+}
+
+// netem is the simulation in effect on c: its own, else its listener's
+func (c *Connection) netem() (*Netem, string) {
+	if n := c.sim.Load(); n != nil {
+		return n, "connection"
+	}
+	if c.server != nil {
+		if n := c.server.sim.Load(); n != nil {
+			return n, "listener"
+		}
+	}
+	return nil, ""
+}
+
+type SetNetemPayload struct {
+	ListenerRef        // listener whose connections all get the conditions
+	ID          string `json:"id"` // or a single connection
+	NetemOptions
+}
+
+// handleSetNetem starts, changes or, given no conditions, stops simulating
+// a bad network on a connection or listener
+func handleSetNetem(payload json.RawMessage, writer *Output) {
+	var p SetNetemPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		sendInvalidPayload(writer, "set_netem")
+		return
+	}
+	if !config.Get().Developer {
+		sendErrorCode(writer, ErrInvalidState, message("netem.only_available_developer_mode"), nil)
+		return
+	}
+	if err := p.NetemOptions.Validate(); err != nil {
+		sendFailure(writer, err)
+		return
+	}
+	var sim *Netem
+	if !p.empty() {
+		sim = newNetem(p.NetemOptions)
+	}
+
+	data := map[string]interface{}{"active": sim != nil}
+	switch {
+	case p.ID != "":
+		c, exists := lookupConn(p.ID, writer)
+		if !exists {
+			sendErrorCode(writer, ErrNotFound, message("common.connection_not_found"), nil)
+			return
+		}
+		c.sim.Store(sim)
+		data["id"] = c.ID
+	case p.ListenerRef.set():
+		state.Mutex.Lock()
+		l, ok := findListenerLocked(p.ListenerRef, writer)
+		state.Mutex.Unlock()
+		if !ok {
+			return
+		}
+		l.sim.Store(sim)
+		data["listener_id"] = l.ID
+	default:
+		sendErrorCode(writer, ErrInvalidArgument, message("netem.set_netem_requires"), nil)
+		return
+	}
+
+	m := message("netem.simulation_stopped")
+	if sim != nil {
+		m = message("netem.simulation_started")
+		data["netem"] = sim.opts
+		logger.Warn("simulating network conditions", "id", p.ID, "listener_id", data["listener_id"],
+			"latency_ms", p.LatencyMs, "jitter_ms", p.JitterMs, "loss_percent", p.LossPercent, "bytes_per_sec", p.BytesPerSec)
+	}
+	writer.Encode(okResponse(m, data))
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestNetemPass(t *testing.T) {
+	if err := (NetemOptions{LossPercent: 101}).Validate(); err == nil {
+		t.Error("loss over 100% accepted")
+	}
+	if err := (NetemOptions{LatencyMs: 9000, JitterMs: 2000}).Validate(); err == nil {
+		t.Error("latency over the cap accepted")
+	}
+	if err := (NetemOptions{LatencyMs: math.MaxInt, JitterMs: 1}).Validate(); err == nil {
+		t.Error("latency wrapping past the cap accepted")
+	}
+
+	lossy := newNetem(NetemOptions{LossPercent: 100})
+	if lossy.pass(100, true) {
+		t.Error("datagram got through at 100% loss")
+	}
+	start := time.Now()
+	if !lossy.pass(100, false) {
+		t.Error("stream data was dropped")
+	}
+	if waited := time.Since(start); waited < minNetemStall {
+		t.Errorf("stream loss stalled %v, want at least %v", waited, minNetemStall)
+	}
+	if info := lossy.Info("connection"); info.Lost != 2 || info.Direction != "both" {
+		t.Errorf("info %+v", info)
+	}
+
+	out := newNetem(NetemOptions{LatencyMs: 5, Direction: "out"})
+	if out.applies("in") || !out.applies("out") {
+		t.Error("direction out applied to the wrong side")
+	}
+	var none *Netem
+	if none.applies("in") {
+		t.Error("no simulation applied")
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// Output serializes protocol messages written to the Tauri process.
+// Handlers and background goroutines share it, so every message is
+// written atomically and in the order Encode was called.
+type Output struct {
+	mu     sync.Mutex
+	w      io.Writer
+	buf    *bufio.Writer
+	enc    *json.Encoder
+	mode   string
+	locale string // set_locale's choice; empty follows the config
+	closed bool
+
+	// namespace is set_namespace's choice on a channel, which also filters
+	// its events, and a request's own namespace on a view
+	namespace string
+
+	// A request's view of a channel answers through parent and tags each
+	// response with the request's id
+	parent *Output
+	id     json.RawMessage
+
+	audit *auditRecord // notified of the first response, see audited
+
+	// batch holds events back to write several at once, see batching.go;
+	// flushTimer is armed while some wait
+	batch      OutputBatching
+	flushTimer *time.Timer
+}
+
+func NewOutput(w io.Writer) *Output {
+	buf := bufio.NewWriter(w)
+	return &Output{w: w, buf: buf, enc: json.NewEncoder(buf), mode: framingLine}
+}
+
+// forRequest returns the writer a request with the given id is answered
+// through; without an id that is o itself
+func (o *Output) forRequest(id json.RawMessage) *Output {
+	if len(id) == 0 {
+		return o
+	}
+	return &Output{parent: o.channel(), id: id}
+}
+
+// channel is the Output that owns the underlying stream
+func (o *Output) channel() *Output {
+	if o.parent != nil {
+		return o.parent.channel()
+	}
+	return o
+}
+
+// audited returns a view of o that reports responses to r
+func (o *Output) audited(r *auditRecord) *Output {
+	return &Output{parent: o, id: o.id, audit: r}
+}
+
+// inNamespace returns a view of o whose requests run in namespace ns
+func (o *Output) inNamespace(ns string) *Output {
+	return &Output{parent: o, id: o.id, namespace: ns}
+}
+
+// Namespace is the namespace requests answered through o run in, "" for
+// none
+func (o *Output) Namespace() string {
+	if o.parent != nil {
+		if o.namespace != "" {
+			return o.namespace
+		}
+		return o.parent.Namespace()
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.namespace
+}
+
+// SetNamespace scopes the channel's requests and events to ns
+func (o *Output) SetNamespace(ns string) {
+	if o.parent != nil {
+		o.parent.SetNamespace(ns)
+		return
+	}
+	o.mu.Lock()
+	o.namespace = ns
+	o.mu.Unlock()
+}
+
+// SetFraming switches how subsequent messages are delimited
+func (o *Output) SetFraming(mode string) {
+	if o.parent != nil {
+		o.parent.SetFraming(mode)
+		return
+	}
+	o.mu.Lock()
+	o.mode = mode
+	o.mu.Unlock()
+}
+
+// SetLocale picks the language of subsequent responses
+func (o *Output) SetLocale(locale string) {
+	if o.parent != nil {
+		o.parent.SetLocale(locale)
+		return
+	}
+	o.mu.Lock()
+	o.locale = locale
+	o.mu.Unlock()
+}
+
+// Encode writes v as a single framed JSON message. Responses are flushed
+// immediately, events too unless the channel batches them.
+func (o *Output) Encode(v interface{}) error {
+	if o.parent != nil {
+		if resp, ok := v.(ProtocolResponse); ok {
+			if o.audit != nil {
+				o.audit.answered(resp)
+			}
+			resp.ID = o.id
+			v = resp
+		}
+		return o.parent.Encode(v)
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.closed {
+		return io.ErrClosedPipe
+	}
+	if resp, ok := v.(ProtocolResponse); ok {
+		v = localize(resp, o.locale)
+	}
+	if ev, ok := v.(ProtocolEvent); ok && !visible(ev.Namespace, o.namespace) {
+		return nil // another namespace's business
+	}
+	if o.mode == framingLength {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		if err := writeLengthPrefixed(o.buf, data); err != nil {
+			return err
+		}
+	} else if err := o.enc.Encode(v); err != nil {
+		return err
+	}
+	if _, ok := v.(ProtocolEvent); ok && o.batch.enabled() {
+		return o.deferFlushLocked()
+	}
+	return o.flushLocked()
+}
+
+// Close flushes anything still buffered and rejects further messages
+func (o *Output) Close() error {
+	if o.parent != nil {
+		return nil // only the channel's owner closes it
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.closed {
+		return nil
+	}
+	o.closed = true
+	return o.flushLocked()
+}
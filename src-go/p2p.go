@@ -0,0 +1,794 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/datachannel"
+	"github.com/pion/logging"
+	"github.com/pion/stun/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+// Peer sessions connect two sidecars that can only reach each other across
+// the internet over a WebRTC data channel, with the frontends passing the
+// SDP offer and answer between them. p2p_offer creates a peer connection
+// with one data channel and returns its offer once candidates are gathered
+// (local interfaces, the public address a STUN server sees and, when a
+// TURN server is configured, a relayed address on it); p2p_answer takes
+// the offer and returns the answer, which p2p_accept hands to the offering
+// side. Candidates found after a description went out arrive as
+// p2p_candidate events for the frontend to pass on with p2p_add_candidate.
+// ICE then picks a working pair, preferring a direct path to the relay,
+// and DTLS checks the certificate fingerprint the other SDP announced. The
+// data channel carries a mux link, so connect, send_file and
+// send_directory reach the peer by passing the link's ID as mux, and both
+// sides can open streams to the other.
+const (
+	p2pChannelLabel   = "lumina"
+	defaultP2PTimeout = 30 * time.Second
+	p2pGatherTimeout  = 3 * time.Second
+	// p2pMaxMessage is the most one data channel message carries; larger
+	// writes are split, as not every peer takes messages past 64 KiB
+	p2pMaxMessage = 16 << 10
+	p2pReadBuffer = 64 << 10
+	// p2pMaxBuffered is how much a write may leave queued in the channel
+	// before it waits for the peer to take some
+	p2pMaxBuffered = 1 << 20
+)
+
+// p2pLoopback offers loopback candidates too, for tests on one host
+var p2pLoopback bool
+
+// p2pServices are what peer session streams may ask for; the listener
+// specific ones of mux listeners are left out
+var p2pServices = map[string]func(c *Connection, l *Listener, dir string){
+	"echo":      handleEchoConnection,
+	"discard":   handleDiscardConnection,
+	"chat":      handleChatConnection,
+	"transfer":  func(c *Connection, _ *Listener, dir string) { handleTransferConnection(c, dir) },
+	"speedtest": func(c *Connection, _ *Listener, _ string) { handleSpeedtestConnection(c) },
+}
+
+// P2PConfig is the config section with the servers peer sessions use
+type P2PConfig struct {
+	STUNServer string      `json:"stun_server,omitempty"` // default stun.l.google.com:19302, "none" to skip
+	TURN       *TURNServer `json:"turn,omitempty"`
+}
+
+func (c P2PConfig) Validate() error {
+	return c.TURN.Validate()
+}
+
+// TURNServer is a relay peer sessions fall back to when no direct path works
+type TURNServer struct {
+	URL      string `json:"url"` // "turn:host[:port][?transport=udp|tcp]" or "turns:host[:port]"
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+func (t *TURNServer) Validate() error {
+	if t == nil {
+		return nil
+	}
+	if u, err := stun.ParseURI(t.URL); err != nil || (u.Scheme != stun.SchemeTypeTURN && u.Scheme != stun.SchemeTypeTURNS) {
+		return catalogError(ErrInvalidArgument, "p2p.invalid_turn_url", "url", fmt.Sprintf("%q", t.URL))
+	}
+	return nil
+}
+
+// P2PDescription is an SDP offer or answer, shaped like the browser's
+// RTCSessionDescriptionInit
+type P2PDescription struct {
+	Type string `json:"type"` // "offer", "answer"
+	SDP  string `json:"sdp"`
+}
+
+// P2PCandidate is an ICE candidate sent after its description, shaped
+// like the browser's RTCIceCandidateInit
+type P2PCandidate struct {
+	Candidate     string  `json:"candidate"`
+	SDPMid        *string `json:"sdpMid,omitempty"`
+	SDPMLineIndex *uint16 `json:"sdpMLineIndex,omitempty"`
+}
+
+type P2POfferPayload struct {
+	STUNServer string      `json:"stun_server"` // overrides the config; "none" to skip
+	TURN       *TURNServer `json:"turn"`
+	Dir        string      `json:"dir"` // where files the peer sends land
+	TimeoutMs  int         `json:"timeout_ms"`
+}
+
+type P2PAnswerPayload struct {
+	P2POfferPayload
+	Offer *P2PDescription `json:"offer"`
+}
+
+type P2PAcceptPayload struct {
+	ID     string          `json:"id"`
+	Answer *P2PDescription `json:"answer"`
+}
+
+type P2PCandidatePayload struct {
+	ID        string       `json:"id"`
+	Candidate P2PCandidate `json:"candidate"`
+}
+
+type P2PClosePayload struct {
+	ID string `json:"id"`
+}
+
+// P2P session states
+const (
+	p2pNew       = "new"
+	p2pChecking  = "checking"
+	p2pConnected = "connected"
+	p2pFailed    = "failed"
+	p2pClosed    = "closed"
+)
+
+// P2PSession is one peer session, from gathering to its mux link
+type P2PSession struct {
+	ID      string
+	Role    string // "offer" opens the data channel, "answer" takes it
+	Created time.Time
+
+	pc      *webrtc.PeerConnection
+	dir     string
+	timeout time.Duration
+
+	mu         sync.Mutex
+	state      string
+	reason     string
+	local      P2PDescription
+	remote     *P2PDescription
+	trickle    bool   // our description went out, so new candidates go as events
+	path       string // "direct" or "relay"
+	remoteAddr string
+	mux        *Mux
+
+	started   chan struct{} // closed once the remote description is known
+	done      chan struct{}
+	closeOnce sync.Once
+	startOnce sync.Once
+}
+
+// P2PInfo is the JSON view of a P2PSession
+type P2PInfo struct {
+	ID          string          `json:"id"`
+	Role        string          `json:"role"`
+	State       string          `json:"state"`
+	Reason      string          `json:"reason,omitempty"`
+	Created     time.Time       `json:"created"`
+	Description P2PDescription  `json:"description"`
+	Remote      *P2PDescription `json:"remote,omitempty"`
+	Path        string          `json:"path,omitempty"` // "direct" or "relay"
+	RemoteAddr  string          `json:"remote_addr,omitempty"`
+	Mux         string          `json:"mux,omitempty"`
+}
+
+var (
+	p2pMu       sync.Mutex
+	p2pSessions = make(map[string]*P2PSession)
+	p2pSeq      atomic.Uint64
+)
+
+func (s *P2PSession) Info() P2PInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	info := P2PInfo{
+		ID:          s.ID,
+		Role:        s.Role,
+		State:       s.state,
+		Reason:      s.reason,
+		Created:     s.Created,
+		Description: s.local,
+		Remote:      s.remote,
+		Path:        s.path,
+		RemoteAddr:  s.remoteAddr,
+	}
+	if s.mux != nil {
+		info.Mux = s.mux.ID
+	}
+	return info
+}
+
+func certFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// p2pICEServers lists the STUN and TURN servers of p, or of the config
+// where p names none
+func p2pICEServers(p P2POfferPayload) []webrtc.ICEServer {
+	cfg := config.Get().P2P
+	stunServer := p.STUNServer
+	if stunServer == "" {
+		stunServer = cfg.STUNServer
+	}
+	if stunServer == "" {
+		stunServer = defaultSTUNServer
+	}
+	var servers []webrtc.ICEServer
+	if stunServer != "none" {
+		servers = append(servers, webrtc.ICEServer{URLs: []string{"stun:" + stunServer}})
+	}
+	turn := p.TURN
+	if turn == nil {
+		turn = cfg.TURN
+	}
+	if turn != nil {
+		servers = append(servers, webrtc.ICEServer{URLs: []string{turn.URL}, Username: turn.Username, Credential: turn.Password})
+	}
+	return servers
+}
+
+// newP2PSession creates the session's peer connection; the offering side
+// opens the data channel, the answering side waits for it
+func newP2PSession(role string, p P2POfferPayload) (*P2PSession, error) {
+	var se webrtc.SettingEngine
+	se.DetachDataChannels()
+	se.SetIncludeLoopbackCandidate(p2pLoopback)
+	se.LoggerFactory = pionLoggers{}
+	pc, err := webrtc.NewAPI(webrtc.WithSettingEngine(se)).NewPeerConnection(webrtc.Configuration{ICEServers: p2pICEServers(p)})
+	if err != nil {
+		return nil, err
+	}
+	s := &P2PSession{
+		ID:      fmt.Sprintf("p2p-%d", p2pSeq.Add(1)),
+		Role:    role,
+		Created: time.Now(),
+		pc:      pc,
+		dir:     downloadDirFor(p.Dir),
+		timeout: defaultP2PTimeout,
+		state:   p2pNew,
+		started: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if p.TimeoutMs > 0 {
+		s.timeout = time.Duration(p.TimeoutMs) * time.Millisecond
+	}
+	pc.OnICECandidate(s.trickleCandidate)
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		switch state {
+		case webrtc.PeerConnectionStateFailed:
+			s.fail("no path to the peer worked")
+		case webrtc.PeerConnectionStateClosed:
+			s.close("peer connection closed")
+		}
+	})
+	if role == "offer" {
+		dc, err := pc.CreateDataChannel(p2pChannelLabel, nil)
+		if err != nil {
+			pc.Close()
+			return nil, err
+		}
+		s.useChannel(dc)
+	} else {
+		pc.OnDataChannel(func(dc *webrtc.DataChannel) {
+			if dc.Label() != p2pChannelLabel {
+				dc.Close()
+				return
+			}
+			s.useChannel(dc)
+		})
+	}
+	return s, nil
+}
+
+// describe sets desc as our description and returns it with the
+// candidates gathered by the time gathering ends or p2pGatherTimeout
+// passes, along with warnings about servers that gave us no candidate
+func (s *P2PSession) describe(desc webrtc.SessionDescription, p P2POfferPayload) (P2PDescription, []string, error) {
+	gathered := webrtc.GatheringCompletePromise(s.pc)
+	if err := s.pc.SetLocalDescription(desc); err != nil {
+		return P2PDescription{}, nil, err
+	}
+	timer := time.NewTimer(p2pGatherTimeout)
+	select {
+	case <-gathered:
+	case <-timer.C:
+	}
+	timer.Stop()
+	s.mu.Lock()
+	s.trickle = true
+	s.mu.Unlock()
+	// Taken after trickle is set, so a candidate is at worst sent twice
+	local := s.pc.LocalDescription()
+	d := P2PDescription{Type: local.Type.String(), SDP: local.SDP}
+	s.mu.Lock()
+	s.local = d
+	s.mu.Unlock()
+
+	var warnings []string
+	for _, server := range p2pICEServers(p) {
+		url := server.URLs[0]
+		want := " typ srflx"
+		if strings.HasPrefix(url, "turn") {
+			want = " typ relay"
+		}
+		if !strings.Contains(d.SDP, want) {
+			warnings = append(warnings, url+": no candidate from this server")
+		}
+	}
+	return d, warnings, nil
+}
+
+// trickleCandidate sends a candidate found after our description went out
+// to the frontend, to pass on to the peer
+func (s *P2PSession) trickleCandidate(c *webrtc.ICECandidate) {
+	if c == nil {
+		return
+	}
+	s.mu.Lock()
+	trickle := s.trickle
+	s.mu.Unlock()
+	if !trickle {
+		return
+	}
+	init := c.ToJSON()
+	emitEvent("p2p_candidate", map[string]interface{}{
+		"id":        s.ID,
+		"candidate": P2PCandidate{Candidate: init.Candidate, SDPMid: init.SDPMid, SDPMLineIndex: init.SDPMLineIndex},
+	})
+}
+
+// addCandidate adds a candidate the peer sent after its description
+func (s *P2PSession) addCandidate(c P2PCandidate) error {
+	err := s.pc.AddICECandidate(webrtc.ICECandidateInit{Candidate: c.Candidate, SDPMid: c.SDPMid, SDPMLineIndex: c.SDPMLineIndex})
+	if err != nil {
+		return catalogError(ErrInvalidArgument, "common.invalid_candidate", "addr", c.Candidate, "error", err)
+	}
+	return nil
+}
+
+// start takes the remote description and begins checking
+func (s *P2PSession) start(remote *P2PDescription) error {
+	if remote.SDP == "" {
+		return catalogError(ErrInvalidArgument, "p2p.description_requires_sdp")
+	}
+	s.mu.Lock()
+	if s.remote != nil {
+		s.mu.Unlock()
+		return errors.New("session already has a remote description")
+	}
+	s.mu.Unlock()
+	if err := s.pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.NewSDPType(remote.Type), SDP: remote.SDP}); err != nil {
+		return err
+	}
+	r := *remote
+	s.mu.Lock()
+	s.remote = &r
+	if s.state == p2pNew {
+		s.state = p2pChecking
+	}
+	s.mu.Unlock()
+	s.startOnce.Do(func() {
+		close(s.started)
+		go s.watch()
+	})
+	return nil
+}
+
+// watch fails the session unless it connects within its timeout
+func (s *P2PSession) watch() {
+	timer := time.NewTimer(s.timeout)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		s.mu.Lock()
+		connected := s.state == p2pConnected
+		s.mu.Unlock()
+		if !connected {
+			s.fail("no path to the peer worked")
+		}
+	case <-s.done:
+	}
+}
+
+// useChannel runs the mux link over dc once it opens
+func (s *P2PSession) useChannel(dc *webrtc.DataChannel) {
+	dc.OnOpen(func() {
+		raw, err := dc.DetachWithDeadline()
+		if err != nil {
+			s.fail(err.Error())
+			return
+		}
+		goSafe("p2p "+s.ID, func() { s.run(dc, raw) })
+	})
+}
+
+// run serves the mux link over the open data channel until it closes
+func (s *P2PSession) run(dc *webrtc.DataChannel, raw datachannel.ReadWriteCloserDeadliner) {
+	conn := newP2PChannel(dc, raw)
+	path := "direct"
+	if pair, err := s.pc.SCTP().Transport().ICETransport().GetSelectedCandidatePair(); err == nil && pair != nil {
+		conn.local, conn.remote = candidateAddr(pair.Local), candidateAddr(pair.Remote)
+		if pair.Local.Typ == webrtc.ICECandidateTypeRelay || pair.Remote.Typ == webrtc.ICECandidateTypeRelay {
+			path = "relay"
+		}
+	}
+	m := &Mux{
+		Direction:  "p2p",
+		RemoteAddr: conn.RemoteAddr().String(),
+		session:    newMuxSession(conn, s.Role == "offer"),
+		secure:     &SecureInfo{Fingerprint: certFingerprint(s.pc.SCTP().Transport().GetRemoteCertificate())},
+	}
+	registerMux(m)
+	s.mu.Lock()
+	s.mux, s.state, s.path, s.remoteAddr = m, p2pConnected, path, m.RemoteAddr
+	s.mu.Unlock()
+
+	info := s.Info()
+	logger.Info("peer session connected", "id", s.ID, "mux", m.ID, "remote", info.RemoteAddr, "path", info.Path)
+	emitEvent("p2p_connected", info)
+	go func() {
+		select {
+		case <-m.session.Done():
+			s.close("mux link closed")
+		case <-s.done:
+		}
+	}()
+	for {
+		st, err := m.session.Accept()
+		if err != nil {
+			return
+		}
+		go serveMuxStream(m, st, nil, s.dir)
+	}
+}
+
+func candidateAddr(c *webrtc.ICECandidate) net.Addr {
+	return &net.UDPAddr{IP: net.ParseIP(c.Address), Port: int(c.Port)}
+}
+
+func (s *P2PSession) fail(reason string) {
+	s.mu.Lock()
+	if s.state == p2pFailed || s.state == p2pClosed {
+		s.mu.Unlock()
+		return
+	}
+	s.state, s.reason = p2pFailed, reason
+	s.mu.Unlock()
+	logger.Warn("peer session failed", "id", s.ID, "reason", reason)
+	emitEvent("p2p_failed", map[string]interface{}{"id": s.ID, "reason": reason})
+	s.close(reason)
+}
+
+// close ends the session, its link and its peer connection
+func (s *P2PSession) close(reason string) {
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		if s.state != p2pFailed {
+			s.state, s.reason = p2pClosed, reason
+		}
+		m := s.mux
+		s.mu.Unlock()
+		close(s.done)
+		if m != nil {
+			m.session.Close()
+		}
+		s.pc.Close()
+
+		p2pMu.Lock()
+		delete(p2pSessions, s.ID)
+		p2pMu.Unlock()
+		emitEvent("p2p_closed", map[string]interface{}{"id": s.ID, "reason": reason})
+	})
+}
+
+// p2pChannel is a detached data channel as the byte stream a mux session
+// runs over: writes are split into messages and held back while too much
+// is queued, and messages are read back as bytes
+type p2pChannel struct {
+	dc            *webrtc.DataChannel
+	rw            datachannel.ReadWriteCloserDeadliner
+	local, remote net.Addr
+
+	readMu sync.Mutex
+	buf    []byte
+	unread []byte
+
+	drained       chan struct{}
+	closed        chan struct{}
+	closeOnce     sync.Once
+	writeDeadline atomic.Pointer[time.Time]
+}
+
+func newP2PChannel(dc *webrtc.DataChannel, rw datachannel.ReadWriteCloserDeadliner) *p2pChannel {
+	c := &p2pChannel{
+		dc:      dc,
+		rw:      rw,
+		local:   &net.UDPAddr{},
+		remote:  &net.UDPAddr{},
+		buf:     make([]byte, p2pReadBuffer),
+		drained: make(chan struct{}, 1),
+		closed:  make(chan struct{}),
+	}
+	dc.SetBufferedAmountLowThreshold(p2pMaxBuffered / 2)
+	dc.OnBufferedAmountLow(func() { notify(c.drained) })
+	return c
+}
+
+func (c *p2pChannel) Read(b []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	for len(c.unread) == 0 {
+		n, err := c.rw.Read(c.buf)
+		if err != nil {
+			return 0, err
+		}
+		c.unread = c.buf[:n]
+	}
+	n := copy(b, c.unread)
+	c.unread = c.unread[n:]
+	return n, nil
+}
+
+func (c *p2pChannel) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		if err := c.waitDrained(); err != nil {
+			return written, err
+		}
+		end := min(written+p2pMaxMessage, len(b))
+		n, err := c.rw.Write(b[written:end])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// waitDrained waits while the channel has more than p2pMaxBuffered queued
+func (c *p2pChannel) waitDrained() error {
+	for c.dc.BufferedAmount() >= p2pMaxBuffered {
+		var timeout <-chan time.Time
+		if d := c.writeDeadline.Load(); d != nil && !d.IsZero() {
+			left := time.Until(*d)
+			if left <= 0 {
+				return os.ErrDeadlineExceeded
+			}
+			timer := time.NewTimer(left)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case <-c.drained:
+		case <-c.closed:
+			return net.ErrClosed
+		case <-timeout:
+			return os.ErrDeadlineExceeded
+		}
+	}
+	return nil
+}
+
+func (c *p2pChannel) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return c.rw.Close()
+}
+
+func (c *p2pChannel) LocalAddr() net.Addr  { return c.local }
+func (c *p2pChannel) RemoteAddr() net.Addr { return c.remote }
+
+func (c *p2pChannel) SetDeadline(t time.Time) error {
+	c.SetWriteDeadline(t)
+	return c.rw.SetReadDeadline(t)
+}
+
+func (c *p2pChannel) SetReadDeadline(t time.Time) error { return c.rw.SetReadDeadline(t) }
+
+func (c *p2pChannel) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.Store(&t)
+	return c.rw.SetWriteDeadline(t)
+}
+
+// pionLoggers sends pion's logs to ours. pion warns about what is routine
+// while ICE settles, so only its errors are worth a warning.
+type pionLoggers struct{}
+
+func (pionLoggers) NewLogger(scope string) logging.LeveledLogger {
+	return pionLogger{logger.With("scope", "pion/"+scope)}
+}
+
+type pionLogger struct{ l *slog.Logger }
+
+func (pionLogger) Trace(string)                     {}
+func (pionLogger) Tracef(string, ...any)            {}
+func (p pionLogger) Debug(msg string)               { p.l.Debug(msg) }
+func (p pionLogger) Debugf(format string, a ...any) { p.l.Debug(fmt.Sprintf(format, a...)) }
+func (p pionLogger) Info(msg string)                { p.l.Debug(msg) }
+func (p pionLogger) Infof(format string, a ...any)  { p.l.Debug(fmt.Sprintf(format, a...)) }
+func (p pionLogger) Warn(msg string)                { p.l.Debug(msg) }
+func (p pionLogger) Warnf(format string, a ...any)  { p.l.Debug(fmt.Sprintf(format, a...)) }
+func (p pionLogger) Error(msg string)               { p.l.Warn(msg) }
+func (p pionLogger) Errorf(format string, a ...any) { p.l.Warn(fmt.Sprintf(format, a...)) }
+
+func lookupP2P(id string) (*P2PSession, bool) {
+	p2pMu.Lock()
+	defer p2pMu.Unlock()
+	s, ok := p2pSessions[id]
+	return s, ok
+}
+
+func registerP2P(s *P2PSession) {
+	p2pMu.Lock()
+	p2pSessions[s.ID] = s
+	p2pMu.Unlock()
+	// A session nobody completes is dropped once its timeout passes
+	go func() {
+		select {
+		case <-s.started:
+		case <-s.done:
+		case <-time.After(s.timeout + time.Minute):
+			s.fail("no remote description arrived")
+		}
+	}()
+}
+
+func (p P2POfferPayload) validate() error {
+	if p.TimeoutMs < 0 {
+		return catalogError(ErrInvalidArgument, "p2p.timeout_ms_must_not")
+	}
+	return p.TURN.Validate()
+}
+
+func handleP2POffer(payload json.RawMessage, writer *Output) {
+	var p P2POfferPayload
+	if len(payload) > 0 && string(payload) != "null" {
+		if err := json.Unmarshal(payload, &p); err != nil {
+			sendInvalidPayload(writer, "p2p_offer")
+			return
+		}
+	}
+	if err := p.validate(); err != nil {
+		sendFailure(writer, err)
+		return
+	}
+	s, err := newP2PSession("offer", p)
+	if err != nil {
+		sendError(writer, message("p2p.failed_start_peer_session", "error", err))
+		return
+	}
+	registerP2P(s)
+	offer, err := s.pc.CreateOffer(nil)
+	var desc P2PDescription
+	var warnings []string
+	if err == nil {
+		desc, warnings, err = s.describe(offer, p)
+	}
+	if err != nil {
+		s.close("failed to start")
+		sendError(writer, message("p2p.failed_start_peer_session", "error", err))
+		return
+	}
+	logger.Info("peer session offered", "id", s.ID)
+	writer.Encode(ProtocolResponse{Status: "ok", Data: p2pAnswerData(s, desc, warnings)})
+}
+
+func handleP2PAnswer(payload json.RawMessage, writer *Output) {
+	var p P2PAnswerPayload
+	if err := json.Unmarshal(payload, &p); err != nil || p.Offer == nil {
+		sendErrorCode(writer, ErrInvalidArgument, message("p2p.answer_requires_offer"), nil)
+		return
+	}
+	if p.Offer.Type != "offer" {
+		sendErrorCode(writer, ErrInvalidArgument, message("p2p.answer_must_given_offer"), nil)
+		return
+	}
+	if err := p.validate(); err != nil {
+		sendFailure(writer, err)
+		return
+	}
+	s, err := newP2PSession("answer", p.P2POfferPayload)
+	if err != nil {
+		sendError(writer, message("p2p.failed_start_peer_session", "error", err))
+		return
+	}
+	registerP2P(s)
+	if err := s.start(p.Offer); err != nil {
+		s.close("invalid offer")
+		sendErrorCode(writer, ErrInvalidArgument, message("p2p.invalid_offer", "error", err), nil)
+		return
+	}
+	answer, err := s.pc.CreateAnswer(nil)
+	var desc P2PDescription
+	var warnings []string
+	if err == nil {
+		desc, warnings, err = s.describe(answer, p.P2POfferPayload)
+	}
+	if err != nil {
+		s.close("failed to start")
+		sendError(writer, message("p2p.failed_start_peer_session", "error", err))
+		return
+	}
+	logger.Info("peer session answered", "id", s.ID)
+	writer.Encode(ProtocolResponse{Status: "ok", Data: p2pAnswerData(s, desc, warnings)})
+}
+
+func p2pAnswerData(s *P2PSession, desc P2PDescription, warnings []string) map[string]interface{} {
+	data := map[string]interface{}{"id": s.ID, "description": desc}
+	if len(warnings) > 0 {
+		data["warnings"] = warnings
+	}
+	return data
+}
+
+func handleP2PAccept(payload json.RawMessage, writer *Output) {
+	var p P2PAcceptPayload
+	if err := json.Unmarshal(payload, &p); err != nil || p.ID == "" || p.Answer == nil {
+		sendErrorCode(writer, ErrInvalidArgument, message("p2p.accept_requires_id_answer"), nil)
+		return
+	}
+	s, ok := lookupP2P(p.ID)
+	if !ok {
+		sendErrorCode(writer, ErrNotFound, message("p2p.peer_session_not_found"), nil)
+		return
+	}
+	if s.Role != "offer" || p.Answer.Type != "answer" {
+		sendErrorCode(writer, ErrInvalidArgument, message("p2p.accept_must_given_answer"), nil)
+		return
+	}
+	if err := s.start(p.Answer); err != nil {
+		sendErrorCode(writer, ErrInvalidArgument, message("p2p.invalid_answer", "error", err), nil)
+		return
+	}
+	writer.Encode(okResponse(message("p2p.checking_paths_peer"), s.Info()))
+}
+
+func handleP2PAddCandidate(payload json.RawMessage, writer *Output) {
+	var p P2PCandidatePayload
+	if err := json.Unmarshal(payload, &p); err != nil || p.ID == "" || p.Candidate.Candidate == "" {
+		sendErrorCode(writer, ErrInvalidArgument, message("p2p.add_candidate_requires_id"), nil)
+		return
+	}
+	s, ok := lookupP2P(p.ID)
+	if !ok {
+		sendErrorCode(writer, ErrNotFound, message("p2p.peer_session_not_found"), nil)
+		return
+	}
+	if err := s.addCandidate(p.Candidate); err != nil {
+		sendFailure(writer, err)
+		return
+	}
+	writer.Encode(okResponse(message("p2p.candidate_added"), nil))
+}
+
+func handleP2PClose(payload json.RawMessage, writer *Output) {
+	var p P2PClosePayload
+	if err := json.Unmarshal(payload, &p); err != nil || p.ID == "" {
+		sendErrorCode(writer, ErrInvalidArgument, message("p2p.close_requires_id"), nil)
+		return
+	}
+	s, ok := lookupP2P(p.ID)
+	if !ok {
+		sendErrorCode(writer, ErrNotFound, message("p2p.peer_session_not_found"), nil)
+		return
+	}
+	s.close("closed")
+	writer.Encode(okResponse(message("p2p.peer_session_closed"), nil))
+}
+
+func handleListP2P(writer *Output) {
+	p2pMu.Lock()
+	list := make([]P2PInfo, 0, len(p2pSessions))
+	for _, s := range p2pSessions {
+		list = append(list, s.Info())
+	}
+	p2pMu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+	writer.Encode(ProtocolResponse{Status: "ok", Data: map[string]interface{}{"sessions": list}})
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestP2PSessionsConnect(t *testing.T) {
+	p2pLoopback = true
+	t.Cleanup(func() { p2pLoopback = false })
+	events := &eventRecorder{}
+	savedOutput := output
+	output = NewOutput(events)
+	t.Cleanup(func() { output = savedOutput })
+
+	offer := harnessCall(t, handleP2POffer, `{"stun_server":"none","timeout_ms":10000}`).Data.(map[string]interface{})
+	offerDesc, _ := json.Marshal(offer["description"])
+	answer := harnessCall(t, handleP2PAnswer, `{"stun_server":"none","timeout_ms":10000,"offer":`+string(offerDesc)+`}`).Data.(map[string]interface{})
+	answerDesc, _ := json.Marshal(answer["description"])
+	for _, id := range []interface{}{offer["id"], answer["id"]} {
+		t.Cleanup(func() { handleP2PClose(json.RawMessage(`{"id":"`+id.(string)+`"}`), NewOutput(io.Discard)) })
+	}
+	harnessCall(t, handleP2PAccept, `{"id":"`+offer["id"].(string)+`","answer":`+string(answerDesc)+`}`)
+
+	events.wait(t, "p2p_connected", 2)
+	s, _ := lookupP2P(offer["id"].(string))
+	info := s.Info()
+	m, ok := lookupMux(info.Mux)
+	if !ok || info.State != p2pConnected || info.Path != "direct" || m.secure.Fingerprint == "" {
+		t.Fatalf("connected as %+v", info)
+	}
+
+	// Larger than a data channel message, so it is split and rejoined
+	conn, err := m.openStream("echo", 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	want := bytes.Repeat([]byte("lumina"), 50000)
+	go conn.Write(want)
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(conn, got); err != nil || !bytes.Equal(got, want) {
+		t.Errorf("echo: %v", err)
+	}
+}
+
+func TestTURNServerURL(t *testing.T) {
+	for url, ok := range map[string]bool{
+		"turn:relay.example.org":                true,
+		"turn:relay.example.org:3479":           true,
+		"turn:relay.example.org?transport=udp":  true,
+		"turn:relay.example.org?transport=tcp":  true,
+		"turns:relay.example.org":               true,
+		"turn:relay.example.org?transport=sctp": false,
+		"stun:relay.example.org":                false,
+		"relay.example.org:3478":                false,
+		"turn:[2001:db8::1]:3478?transport=udp": true,
+	} {
+		if err := (&TURNServer{URL: url}).Validate(); ok != (err == nil) {
+			t.Errorf("%s: %v", url, err)
+		}
+	}
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A send_file with streams > 1 splits the body into fixed-size chunks and
+// sends them over that many connections at once, which fills long fat
+// links a single TCP stream cannot. The control connection carries the
+// header, and at the end the sender's digest and the receiver's verdict;
+// every other connection carries chunk headers, each followed by its bytes.
+// Workers take the next chunk as they free up, so a slow stream sends less.
+
+// parallelChunkSize is the unit streams take work in
+const parallelChunkSize = 4 << 20
+
+// sendParallel sends f over spec.Streams connections
+func sendParallel(ctx context.Context, t *Transfer, f *os.File, spec dialSpec) error {
+	conn, secure, err := spec.dial()
+	if err != nil {
+		return err
+	}
+	c := trackConn(conn, "outbound", spec.transport(), nil)
+	if c == nil {
+		conn.Close()
+		return errors.New("service is shutting down")
+	}
+	defer untrackConn(c)
+	defer t.cancelOn(ctx, c)()
+	c.setSecure(secure)
+
+	chunks := (t.Size + parallelChunkSize - 1) / parallelChunkSize
+	header := TransferHeader{Name: t.Name, Size: t.Size, Streams: int(min(int64(spec.Streams), chunks)), ChunkSize: parallelChunkSize}
+	if spec.OfferWait > 0 {
+		header.Offer, header.From = true, senderName()
+	}
+	line, _ := json.Marshal(header)
+	if _, err := c.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	control := bufio.NewReader(c)
+	if header.Offer {
+		if _, err := readAck(control, c, spec.OfferWait); err != nil {
+			return err
+		}
+	}
+	ack, err := readAck(control, c, spec.Timeout)
+	if err != nil {
+		return err
+	}
+
+	// The digest is taken in order alongside the streams; the chunks are
+	// read again from the page cache
+	sum := make(chan string, 1)
+	var sumErr error
+	go func() {
+		var digest string
+		sumErr = callSafe("checksum for "+t.ID, func() error {
+			h := sha256.New()
+			io.Copy(h, io.NewSectionReader(f, 0, t.Size))
+			digest = hex.EncodeToString(h.Sum(nil))
+			return nil
+		})
+		sum <- digest
+	}()
+
+	queue := make(chan int64, chunks)
+	for i := int64(0); i < chunks; i++ {
+		queue <- i * parallelChunkSize
+	}
+	close(queue)
+
+	done := make(chan struct{})
+	go t.reportProgress(done)
+	err = sendParallelStreams(ctx, t, f, spec, ack.Batch, header.Streams, queue)
+	close(done)
+
+	digest := <-sum
+	if err == nil {
+		err = sumErr
+	}
+	final := TransferAck{Status: "ok", SHA256: digest}
+	if err != nil {
+		final = TransferAck{Status: "error", Message: err.Error()}
+	}
+	line, _ = json.Marshal(final)
+	if _, werr := c.Write(append(line, '\n')); err == nil {
+		err = werr
+	}
+	if err != nil {
+		return err
+	}
+	ack, err = readAck(control, c, spec.Timeout)
+	if ack.Result == resultChecksumMismatch {
+		emitVerifyFailed(t, t.Path, hashSHA256, digest, ack.SHA256)
+		return &checksumError{name: t.Name, expected: digest, actual: ack.SHA256}
+	}
+	if err == nil {
+		t.mu.Lock()
+		t.SHA256 = digest
+		t.mu.Unlock()
+	}
+	return err
+}
+
+// sendParallelStreams drains queue over parallel connections, stopping
+// every stream at the first error
+func sendParallelStreams(ctx context.Context, t *Transfer, f *os.File, spec dialSpec, id string, streams int, queue <-chan int64) error {
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+		failed   = make(chan struct{})
+	)
+	for i := 0; i < streams; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := callSafe("transfer "+t.ID, func() error {
+				return sendChunks(ctx, t, f, spec, id, queue, failed)
+			})
+			if err != nil {
+				errOnce.Do(func() {
+					firstErr = err
+					close(failed)
+				})
+			}
+		}()
+	}
+	wg.Wait()
+	return firstErr
+}
+
+func sendChunks(ctx context.Context, t *Transfer, f *os.File, spec dialSpec, id string, queue <-chan int64, failed <-chan struct{}) error {
+	conn, secure, err := spec.dial()
+	if err != nil {
+		return err
+	}
+	c := trackConn(conn, "outbound", spec.transport(), nil)
+	if c == nil {
+		conn.Close()
+		return errors.New("service is shutting down")
+	}
+	defer untrackConn(c)
+	defer t.cancelOn(ctx, c)()
+	c.setSecure(secure)
+
+	buf := make([]byte, transferBufferSize)
+	for offset := range queue {
+		select {
+		case <-failed:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		n := min(parallelChunkSize, t.Size-offset)
+		header := TransferHeader{Name: t.Name, Size: n, Parallel: id, Offset: offset}
+		line, _ := json.Marshal(header)
+		if _, err := c.Write(append(line, '\n')); err != nil {
+			return err
+		}
+		if _, err := io.CopyBuffer(progressWriter{w: c, t: t}, io.NewSectionReader(f, offset, n), buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// incomingParallel is a parallel transfer being received
+type incomingParallel struct {
+	t         *Transfer
+	f         *os.File
+	chunkSize int64
+
+	mu        sync.Mutex
+	claimed   map[int64]bool
+	remaining int64
+	complete  chan struct{} // closed once every chunk is on disk
+	failed    chan struct{} // closed with err set when a chunk stream breaks
+	err       error
+}
+
+var incomingParallels = make(map[string]*incomingParallel) // guarded by incomingMu
+
+func lookupIncomingParallel(id string) (*incomingParallel, bool) {
+	incomingMu.Lock()
+	defer incomingMu.Unlock()
+	p, ok := incomingParallels[id]
+	return p, ok
+}
+
+// claim reserves the chunk at offset for one stream; each chunk must be
+// whole and arrive only once
+func (p *incomingParallel) claim(offset, size int64) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if offset < 0 || offset >= p.t.Size || offset%p.chunkSize != 0 || size != min(p.chunkSize, p.t.Size-offset) {
+		return fmt.Errorf("invalid chunk at %d", offset)
+	}
+	if p.claimed[offset] {
+		return fmt.Errorf("chunk at %d sent twice", offset)
+	}
+	p.claimed[offset] = true
+	return nil
+}
+
+func (p *incomingParallel) stored() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.remaining--; p.remaining == 0 {
+		close(p.complete)
+	}
+}
+
+func (p *incomingParallel) fail(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err == nil {
+		p.err = err
+		close(p.failed)
+	}
+}
+
+// receiveParallel handles the control connection of a parallel transfer.
+// The body is written in place into a preallocated .part file as chunks
+// arrive, then hashed and checked against the sender's digest.
+func receiveParallel(c *Connection, reader *bufio.Reader, dir string, header TransferHeader) {
+	name, err := incomingName(header.Name)
+	if err == nil && header.ChunkSize < transferBufferSize {
+		err = errors.New("invalid chunk size")
+	}
+	if err != nil {
+		writeAck(c, err)
+		return
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		writeAck(c, err)
+		return
+	}
+	path, err := safeJoin(dir, name)
+	if err == nil {
+		path, err = uniquePath(path)
+	}
+	if err != nil {
+		writeAck(c, err)
+		return
+	}
+	f, err := os.Create(path + ".part")
+	if err == nil {
+		err = f.Truncate(header.Size)
+	}
+	if err != nil {
+		if f != nil {
+			f.Close()
+			os.Remove(path + ".part")
+		}
+		writeAck(c, err)
+		return
+	}
+
+	t := newTransfer("receive", name, path, c.Info().RemoteAddr, header.Size)
+	setScope(t.ID, scopeOf(c.ID))
+	t.notePlaintext(c)
+	p := &incomingParallel{
+		t:         t,
+		f:         f,
+		chunkSize: header.ChunkSize,
+		claimed:   make(map[int64]bool),
+		remaining: (header.Size + header.ChunkSize - 1) / header.ChunkSize,
+		complete:  make(chan struct{}),
+		failed:    make(chan struct{}),
+	}
+	if p.remaining == 0 {
+		close(p.complete)
+	}
+	incomingMu.Lock()
+	incomingParallels[t.ID] = p
+	incomingMu.Unlock()
+	defer func() {
+		incomingMu.Lock()
+		delete(incomingParallels, t.ID)
+		incomingMu.Unlock()
+	}()
+
+	line, _ := json.Marshal(TransferAck{Status: "ok", Batch: t.ID})
+	if _, err := c.Write(append(line, '\n')); err != nil {
+		f.Close()
+		os.Remove(path + ".part")
+		t.finish(err)
+		return
+	}
+	emitEvent("transfer_started", t.Info())
+	ctx, endJob := trackJob(t.ID, "transfer", t.Peer)
+	defer endJob()
+	defer t.cancelOn(ctx, c)()
+
+	// Chunks arrive on other connections, so this one is quiet for as long
+	// as they take; rely on keepalive to notice a dead sender instead
+	timeouts := c.Timeouts()
+	timeouts.Idle, timeouts.Read = 0, 0
+	c.SetTimeouts(timeouts)
+
+	done := make(chan struct{})
+	go t.reportProgress(done)
+	err = canceled(ctx, p.wait(ctx, reader))
+	close(done)
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = finalizeReceived(t, path+".part", path)
+	}
+	if err != nil {
+		os.Remove(path + ".part")
+	}
+	writeAck(c, err)
+	t.finish(err)
+}
+
+// wait reads the sender's outcome, waits for the chunks still in flight
+// and checks the digest of what was stored
+func (p *incomingParallel) wait(ctx context.Context, reader *bufio.Reader) error {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("sender went away: %w", err)
+	}
+	var final TransferAck
+	if err := json.Unmarshal([]byte(line), &final); err != nil {
+		return errors.New("invalid message from sender")
+	}
+	if final.Status != "ok" {
+		return fmt.Errorf("sender aborted: %s", final.Message)
+	}
+
+	select {
+	case <-p.complete:
+	case <-p.failed:
+		return p.err
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(30 * time.Second):
+		return errors.New("chunks missing after the sender finished")
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(p.f, 0, p.t.Size)); err != nil {
+		return err
+	}
+	actual := hex.EncodeToString(h.Sum(nil))
+	if !strings.EqualFold(actual, final.SHA256) {
+		emitVerifyFailed(p.t, p.t.Path, hashSHA256, strings.ToLower(final.SHA256), actual)
+		return &checksumError{name: p.t.Name, expected: final.SHA256, actual: actual}
+	}
+	p.t.mu.Lock()
+	p.t.SHA256 = actual
+	p.t.mu.Unlock()
+	return nil
+}
+
+// receiveChunks stores the chunks one stream of a parallel transfer
+// carries until the sender closes it
+func receiveChunks(c *Connection, reader *bufio.Reader, header TransferHeader) {
+	p, ok := lookupIncomingParallel(header.Parallel)
+	if !ok {
+		writeAck(c, errors.New("unknown transfer "+header.Parallel))
+		return
+	}
+	buf := make([]byte, transferBufferSize)
+	for {
+		if err := p.claim(header.Offset, header.Size); err != nil {
+			p.fail(err)
+			return
+		}
+		w := io.NewOffsetWriter(p.f, header.Offset)
+		n, err := io.CopyBuffer(progressWriter{w: w, t: p.t}, io.LimitReader(reader, header.Size), buf)
+		if err == nil && n != header.Size {
+			err = fmt.Errorf("stream closed inside the chunk at %d", header.Offset)
+		}
+		if err != nil {
+			p.fail(err)
+			return
+		}
+		p.stored()
+
+		c.SetReadDeadline(time.Now().Add(30 * time.Second))
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return // the sender is done with this stream
+		}
+		c.SetReadDeadline(time.Time{})
+		header = TransferHeader{}
+		if err := json.Unmarshal([]byte(line), &header); err != nil || header.Parallel != p.t.ID {
+			p.fail(errors.New("invalid chunk header"))
+			return
+		}
+	}
+}
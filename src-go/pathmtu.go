@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"syscall"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/qlog"
+	"github.com/quic-go/quic-go/qlogwriter"
+)
+
+// Path MTU: a datagram bigger than the path carries is fragmented, and
+// many VPNs and PPPoE links with a broken MSS clamp drop the fragments,
+// so a UDP transfer stalls as soon as the first full-sized packet goes
+// out. QUIC connections start with packets that fit any path QUIC runs
+// on and let quic-go probe upwards (DPLPMTUD, RFC 8899). Raw UDP
+// connections set the don't-fragment bit, size datagrams to the MTU of
+// the interface the route leaves by and step down whenever the kernel
+// refuses a datagram as too big. A write is one datagram, so one larger
+// than the path carries fails, naming max_datagram; only a connection
+// carrying Lumina's own encryption or compression, whose records do not
+// keep to datagrams anyway, has its writes split to fit. Either way the
+// connection's info shows the size in use as "path".
+const (
+	quicInitialPacketSize = 1200 // the least QUIC requires of a path
+
+	ipv4UDPOverhead = 20 + 8
+	ipv6UDPOverhead = 40 + 8
+	minIPv4MTU      = 576
+	minIPv6MTU      = 1280
+	defaultPathMTU  = 1500
+)
+
+// mtuPlateaus are common path MTUs, largest first: Ethernet, PPPoE,
+// IPv6-in-IPv4, WireGuard and typical IPsec and OpenVPN tunnels
+var mtuPlateaus = []int{1500, 1492, 1480, 1420, 1400, 1380, 1280, 576}
+
+// PathInfo is what a UDP-based connection knows about its path
+type PathInfo struct {
+	MTU         int    `json:"mtu"`          // largest IP packet in use
+	MaxDatagram int    `json:"max_datagram"` // UDP payload that fits in it
+	Source      string `json:"source"`       // "probe", "interface", "kernel" or "plateau"
+	Searching   bool   `json:"searching,omitempty"`
+	TooBig      uint64 `json:"too_big,omitempty"` // datagrams the kernel refused as too big
+}
+
+func udpOverhead(addr net.Addr) int {
+	if a, ok := addr.(*net.UDPAddr); ok && a.IP.To4() == nil {
+		return ipv6UDPOverhead
+	}
+	return ipv4UDPOverhead
+}
+
+// quicPath follows the packet size quic-go settles on for one connection.
+// It is the connection's qlog trace but only keeps MTU updates.
+type quicPath struct {
+	mu   sync.Mutex
+	size int // UDP payload per packet
+	done bool
+}
+
+// quicPathTracer gives every QUIC connection a quicPath
+func quicPathTracer(context.Context, bool, quic.ConnectionID) qlogwriter.Trace {
+	return &quicPath{size: quicInitialPacketSize}
+}
+
+func (p *quicPath) AddProducer() qlogwriter.Recorder   { return p }
+func (p *quicPath) SupportsSchemas(schema string) bool { return schema == qlog.EventSchema }
+func (p *quicPath) Close() error                       { return nil }
+
+func (p *quicPath) RecordEvent(e qlogwriter.Event) {
+	if u, ok := e.(qlog.MTUUpdated); ok {
+		p.mu.Lock()
+		p.size, p.done = u.Value, u.Done
+		p.mu.Unlock()
+	}
+}
+
+func (s *quicStream) Path() *PathInfo {
+	p, ok := s.conn.QlogTrace().(*quicPath)
+	if !ok {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return &PathInfo{
+		MTU:         p.size + udpOverhead(s.conn.RemoteAddr()),
+		MaxDatagram: p.size,
+		Source:      "probe",
+		Searching:   !p.done,
+	}
+}
+
+// udpPathConn sizes the datagrams of a raw UDP connection to its path
+type udpPathConn struct {
+	net.Conn
+	overhead int
+	framed   bool // carries Lumina records, which may be split across datagrams
+
+	mu     sync.Mutex
+	mtu    int
+	source string
+	tooBig uint64
+}
+
+// newUDPPathConn sets the don't-fragment bit on conn's socket and starts
+// from the MTU of the route to the peer
+func newUDPPathConn(conn net.Conn) *udpPathConn {
+	u := &udpPathConn{Conn: conn, overhead: udpOverhead(conn.RemoteAddr()), mtu: defaultPathMTU, source: "plateau"}
+	if mtu := routeMTU(conn.LocalAddr(), conn.RemoteAddr()); mtu > 0 {
+		u.mtu, u.source = mtu, "interface"
+	}
+	if sc, ok := conn.(syscall.Conn); ok {
+		if rc, err := sc.SyscallConn(); err == nil {
+			rc.Control(func(fd uintptr) {
+				if err := setDontFragment(fd, u.overhead == ipv6UDPOverhead); err != nil {
+					logger.Debug("don't-fragment not set", "remote", conn.RemoteAddr().String(), "error", err)
+				}
+				if mtu, err := kernelPathMTU(fd, u.overhead == ipv6UDPOverhead); err == nil && mtu > 0 && mtu < u.mtu {
+					u.mtu, u.source = mtu, "kernel"
+				}
+			})
+		}
+	}
+	return u
+}
+
+func (u *udpPathConn) maxDatagram() int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return min(u.mtu-u.overhead, maxDatagramSize)
+}
+
+// Write sends b as one datagram, refusing it when it is bigger than the
+// path carries. A framed connection instead sends b in as many datagrams
+// as it takes to keep each one within the path MTU. An empty b still goes
+// out as one empty datagram.
+func (u *udpPathConn) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return u.Conn.Write(b)
+	}
+	written := 0
+	for len(b) > 0 {
+		n := min(len(b), u.maxDatagram())
+		if n < len(b) && !u.framed {
+			// Unframed writes are whole datagrams, so nothing went out yet
+			return written, catalogError(ErrInvalidArgument, "pathmtu.datagram_exceeds_path", "size", len(b), "max_datagram", n)
+		}
+		if _, err := u.Conn.Write(b[:n]); err != nil {
+			if isMessageTooBig(err) && u.shrink(n) {
+				continue
+			}
+			return written, err
+		}
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// shrink lowers the MTU after a datagram of n bytes was refused as too
+// big: to what the kernel learned from ICMP when it says, otherwise to
+// the next plateau. It is false once there is nowhere lower to go.
+func (u *udpPathConn) shrink(n int) bool {
+	mtu, source := 0, "kernel"
+	if sc, ok := u.Conn.(syscall.Conn); ok {
+		if rc, err := sc.SyscallConn(); err == nil {
+			rc.Control(func(fd uintptr) {
+				mtu, _ = kernelPathMTU(fd, u.overhead == ipv6UDPOverhead)
+			})
+		}
+	}
+	refused := n + u.overhead
+	if mtu <= 0 || mtu >= refused {
+		mtu, source = 0, "plateau"
+		for _, p := range mtuPlateaus {
+			if p < refused {
+				mtu = p
+				break
+			}
+		}
+	}
+	floor := minIPv4MTU
+	if u.overhead == ipv6UDPOverhead {
+		floor = minIPv6MTU
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.tooBig++
+	if mtu < floor {
+		return false
+	}
+	if mtu < u.mtu {
+		logger.Info("path mtu lowered", "remote", u.RemoteAddr().String(), "from", u.mtu, "to", mtu, "source", source)
+		u.mtu, u.source = mtu, source
+	}
+	return true
+}
+
+func (u *udpPathConn) Path() *PathInfo {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return &PathInfo{
+		MTU:         u.mtu,
+		MaxDatagram: min(u.mtu-u.overhead, maxDatagramSize),
+		Source:      u.source,
+		TooBig:      u.tooBig,
+	}
+}
+
+// routeMTU is the MTU of the interface packets to remote leave by, or 0
+// when it cannot tell. An unconnected socket bound to the wildcard asks
+// the routing table through a UDP dial, which sends nothing.
+func routeMTU(local, remote net.Addr) int {
+	la, _ := local.(*net.UDPAddr)
+	if la == nil || la.IP.IsUnspecified() {
+		probe, err := net.Dial("udp", remote.String())
+		if err != nil {
+			return 0
+		}
+		la, _ = probe.LocalAddr().(*net.UDPAddr)
+		probe.Close()
+		if la == nil {
+			return 0
+		}
+	}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return 0
+	}
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if n, ok := a.(*net.IPNet); ok && n.IP.Equal(la.IP) {
+				return iface.MTU
+			}
+		}
+	}
+	return 0
+}
+
+// pathOf finds the path information of a UDP-based connection beneath
+// any encryption or compression
+func pathOf(conn net.Conn) *PathInfo {
+	for {
+		switch w := conn.(type) {
+		case *quicStream:
+			return w.Path()
+		case *udpPathConn:
+			return w.Path()
+		case *secureConn:
+			conn = w.Conn
+		case *compressedConn:
+			conn = w.Conn
+		default:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"errors"
+
+	"golang.org/x/sys/unix"
+)
+
+// setDontFragment makes the kernel refuse datagrams larger than the
+// interface MTU rather than fragmenting them
+func setDontFragment(fd uintptr, ipv6 bool) error {
+	if ipv6 {
+		return unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_DONTFRAG, 1)
+	}
+	return unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_DONTFRAG, 1)
+}
+
+// kernelPathMTU is not readable on macOS; sizing falls back to plateaus
+func kernelPathMTU(uintptr, bool) (int, error) {
+	return 0, errors.ErrUnsupported
+}
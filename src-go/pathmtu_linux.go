@@ -0,0 +1,20 @@
+package main
+
+import "golang.org/x/sys/unix"
+
+// setDontFragment makes the kernel refuse datagrams larger than the path
+// MTU it knows, which it learns from ICMP "fragmentation needed"
+func setDontFragment(fd uintptr, ipv6 bool) error {
+	if ipv6 {
+		return unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER, unix.IPV6_PMTUDISC_DO)
+	}
+	return unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, unix.IP_PMTUDISC_DO)
+}
+
+// kernelPathMTU is the path MTU the kernel holds for a connected socket
+func kernelPathMTU(fd uintptr, ipv6 bool) (int, error) {
+	if ipv6 {
+		return unix.GetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_MTU)
+	}
+	return unix.GetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_MTU)
+}
@@ -0,0 +1,14 @@
+//go:build !linux && !darwin && !windows
+
+package main
+
+import "errors"
+
+// Elsewhere datagrams are only sized to the interface MTU
+func setDontFragment(uintptr, bool) error {
+	return errors.ErrUnsupported
+}
+
+func kernelPathMTU(uintptr, bool) (int, error) {
+	return 0, errors.ErrUnsupported
+}
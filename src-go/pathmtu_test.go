@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUDPPathConnSizesDatagrams(t *testing.T) {
+	server, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	raw, err := net.Dial("udp4", server.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := newUDPPathConn(raw)
+	defer u.Close()
+
+	u.mtu = 100 + ipv4UDPOverhead
+	n, err := u.Write(make([]byte, 250))
+	if m := messageOf(err); n != 0 || m.Key != "pathmtu.datagram_exceeds_path" || m.Args["max_datagram"] != "100" {
+		t.Fatalf("unframed write of 250 wrote %d, %v", n, err)
+	}
+	if n, err := u.Write(make([]byte, 100)); n != 100 || err != nil {
+		t.Fatalf("wrote %d, %v", n, err)
+	}
+	u.framed = true
+	if n, err := u.Write(make([]byte, 250)); n != 250 || err != nil {
+		t.Fatalf("framed wrote %d, %v", n, err)
+	}
+	buf := make([]byte, 2048)
+	server.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for _, want := range []int{100, 100, 100, 50} {
+		n, _, err := server.ReadFromUDP(buf)
+		if err != nil || n != want {
+			t.Fatalf("datagram of %d bytes, %v; want %d", n, err, want)
+		}
+	}
+
+	// Loopback's kernel MTU is far above the refused size, so the next
+	// plateau below it is taken
+	u.mtu = 1500
+	if !u.shrink(1500 - ipv4UDPOverhead) {
+		t.Fatal("shrink from 1500 gave up")
+	}
+	if p := u.Path(); p.MTU != 1492 || p.MaxDatagram != 1464 || p.Source != "plateau" || p.TooBig != 1 {
+		t.Errorf("after shrink %+v", p)
+	}
+	u.mtu = minIPv4MTU
+	if u.shrink(minIPv4MTU - ipv4UDPOverhead) {
+		t.Error("shrink went below the IPv4 minimum")
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import "golang.org/x/sys/windows"
+
+// Socket options x/sys/windows does not name
+const (
+	ipDontFragment = 14 // IP_DONTFRAGMENT, and IPV6_DONTFRAG likewise
+	ipMTU          = 73 // IP_MTU
+	ipv6MTU        = 72 // IPV6_MTU
+)
+
+// setDontFragment makes the stack refuse datagrams larger than the path
+// MTU it knows
+func setDontFragment(fd uintptr, ipv6 bool) error {
+	if ipv6 {
+		return windows.SetsockoptInt(windows.Handle(fd), windows.IPPROTO_IPV6, ipDontFragment, 1)
+	}
+	return windows.SetsockoptInt(windows.Handle(fd), windows.IPPROTO_IP, ipDontFragment, 1)
+}
+
+// kernelPathMTU is the path MTU the stack holds for a connected socket,
+// which Windows 10 and later report
+func kernelPathMTU(fd uintptr, ipv6 bool) (int, error) {
+	if ipv6 {
+		return windows.GetsockoptInt(windows.Handle(fd), windows.IPPROTO_IPV6, ipv6MTU)
+	}
+	return windows.GetsockoptInt(windows.Handle(fd), windows.IPPROTO_IP, ipMTU)
+}
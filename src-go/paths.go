@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Every path a peer sends is resolved under the receiving directory. Names
+// that are absolute, climb out with "..", or lead through a symlink to
+// somewhere outside the directory are refused with a PathError, which the
+// receiver reports in its ack and in a path_rejected event.
+const (
+	reasonEmpty    = "empty"
+	reasonAbsolute = "absolute"
+	reasonParent   = "parent"
+	reasonSymlink  = "symlink"
+	reasonInvalid  = "invalid"
+)
+
+// PathError is an incoming path the receiver refused
+type PathError struct {
+	Path   string
+	Reason string // one of the reason constants
+}
+
+func (e *PathError) Error() string {
+	switch e.Reason {
+	case reasonEmpty:
+		return "rejected path: empty name"
+	case reasonAbsolute:
+		return fmt.Sprintf("rejected path %q: absolute paths are not allowed", e.Path)
+	case reasonParent:
+		return fmt.Sprintf("rejected path %q: \"..\" is not allowed", e.Path)
+	case reasonSymlink:
+		return fmt.Sprintf("rejected path %q: leads through a symlink outside the download directory", e.Path)
+	}
+	return fmt.Sprintf("rejected path %q: not a valid local name", e.Path)
+}
+
+// checkRelative refuses a slash-separated path that would not stay below
+// the directory it is joined to
+func checkRelative(rel string) error {
+	local := filepath.FromSlash(rel)
+	for _, part := range strings.FieldsFunc(rel, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if part == ".." {
+			return &PathError{Path: rel, Reason: reasonParent}
+		}
+	}
+	switch {
+	case strings.TrimSpace(rel) == "":
+		return &PathError{Path: rel, Reason: reasonEmpty}
+	case strings.HasPrefix(rel, "/") || strings.HasPrefix(rel, `\`) || filepath.IsAbs(local) || filepath.VolumeName(local) != "":
+		return &PathError{Path: rel, Reason: reasonAbsolute}
+	case !filepath.IsLocal(local):
+		return &PathError{Path: rel, Reason: reasonInvalid}
+	}
+	return nil
+}
+
+// incomingName turns the name a sender announced for a file or directory
+// into a single path element
+func incomingName(name string) (string, error) {
+	if err := checkRelative(name); err != nil {
+		return "", err
+	}
+	return filepath.Base(filepath.Clean(filepath.FromSlash(name))), nil
+}
+
+// safeJoin resolves a slash-separated path under root. The last element is
+// not followed: receivers write through a temporary file and rename it into
+// place, which replaces a symlink rather than writing through it.
+func safeJoin(root, rel string) (string, error) {
+	if err := checkRelative(rel); err != nil {
+		return "", err
+	}
+	target := filepath.Join(root, filepath.FromSlash(rel))
+	if err := checkWithin(root, filepath.Dir(target)); err != nil {
+		return "", &PathError{Path: rel, Reason: reasonSymlink}
+	}
+	return target, nil
+}
+
+// checkWithin makes sure path, after following symlinks as far as it
+// exists, still lies under root
+func checkWithin(root, path string) error {
+	realRoot, err := filepath.EvalSymlinks(root)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil // nothing under a missing root can be a link yet
+	}
+	if err != nil {
+		return err
+	}
+	existing := path
+	real, err := filepath.EvalSymlinks(existing)
+	for errors.Is(err, os.ErrNotExist) {
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			return nil
+		}
+		existing = parent
+		real, err = filepath.EvalSymlinks(existing)
+	}
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(realRoot, real)
+	if err != nil || (rel != "." && !filepath.IsLocal(rel)) {
+		return errors.New("outside the download directory")
+	}
+	return nil
+}
+
+// pathAck adds the rejected path to ack when err is a PathError and reports
+// it in a path_rejected event
+func pathAck(c *Connection, ack *TransferAck, err error) {
+	var pe *PathError
+	if !errors.As(err, &pe) {
+		return
+	}
+	ack.Rejected, ack.Reason = pe.Path, pe.Reason
+	rejectedPath(c.Listener, c.Info().RemoteAddr, pe)
+}
+
+func rejectedPath(listener, remote string, pe *PathError) {
+	logger.Warn("rejected incoming path", "path", pe.Path, "reason", pe.Reason, "remote", remote)
+	emitEvent("path_rejected", map[string]interface{}{
+		"listener": listener,
+		"remote":   remote,
+		"path":     pe.Path,
+		"reason":   pe.Reason,
+		"message":  pe.Error(),
+	})
+}
+
+// downloadDirFor is the directory a listener receives into: the one it was
+// started with, or else the current download directory
+func downloadDirFor(explicit string) string {
+	if explicit != "" {
+		return explicit
+	}
+	return defaultDownloadDir()
+}
+
+type SetDownloadDirPayload struct {
+	Dir string `json:"dir"` // empty restores the default
+}
+
+// handleSetDownloadDir changes where listeners started without a dir store
+// what they receive, and saves the choice in the config
+func handleSetDownloadDir(payload json.RawMessage, writer *Output) {
+	var p SetDownloadDirPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		sendInvalidPayload(writer, "set_download_dir")
+		return
+	}
+	previous := defaultDownloadDir()
+	if p.Dir != "" {
+		dir, err := filepath.Abs(p.Dir)
+		if err != nil {
+			sendErrorCode(writer, ErrInvalidArgument, message("paths.invalid_download_directory", "error", err), nil)
+			return
+		}
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			sendError(writer, message("common.failed_create", "dir", dir, "error", err))
+			return
+		}
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			sendErrorCode(writer, ErrInvalidArgument, message("common.not_directory", "dir", dir), nil)
+			return
+		}
+		p.Dir = dir
+	}
+
+	patch, _ := json.Marshal(map[string]string{"download_dir": p.Dir})
+	if _, err := config.Update(patch); err != nil {
+		sendFailure(writer, err)
+		return
+	}
+	dir := defaultDownloadDir()
+	logger.Info("download directory changed", "dir", dir, "previous", previous)
+	writer.Encode(okResponse(message("paths.downloads_go", "dir", dir),
+		map[string]interface{}{"dir": dir, "previous": previous, "default": p.Dir == ""}))
+}
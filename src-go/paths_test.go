@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestCheckRelative(t *testing.T) {
+	tests := []struct {
+		path   string
+		reason string // "" when the path is accepted
+	}{
+		{"file.txt", ""},
+		{"dir/file.txt", ""},
+		{"dir/sub/file.txt", ""},
+		{"dir/./file.txt", ""},
+		{"..file", ""},
+		{"file..", ""},
+		{"", reasonEmpty},
+		{"   ", reasonEmpty},
+		{"..", reasonParent},
+		{"../file", reasonParent},
+		{"dir/../../file", reasonParent},
+		{"dir/..", reasonParent},
+		{`dir\..\file`, reasonParent},
+		{`..\file`, reasonParent},
+		{"/etc/passwd", reasonAbsolute},
+		{"//server/share/file", reasonAbsolute},
+		{`\file`, reasonAbsolute},
+		{`\\server\share\file`, reasonAbsolute},
+	}
+	if runtime.GOOS == "windows" {
+		tests = append(tests, []struct {
+			path   string
+			reason string
+		}{
+			{`C:\Windows\file`, reasonAbsolute},
+			{`C:file`, reasonAbsolute},
+			{"C:/file", reasonAbsolute},
+			{"NUL", reasonInvalid},
+			{"dir/COM1.txt", reasonInvalid},
+		}...)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			err := checkRelative(tt.path)
+			if tt.reason == "" {
+				if err != nil {
+					t.Fatalf("checkRelative(%q) = %v, want accepted", tt.path, err)
+				}
+				return
+			}
+			var pe *PathError
+			if !errors.As(err, &pe) {
+				t.Fatalf("checkRelative(%q) = %v, want a PathError", tt.path, err)
+			}
+			if pe.Reason != tt.reason || pe.Path != tt.path {
+				t.Fatalf("checkRelative(%q) rejected %q as %q, want %q", tt.path, pe.Path, pe.Reason, tt.reason)
+			}
+		})
+	}
+}
+
+func TestIncomingName(t *testing.T) {
+	tests := []struct {
+		name, want string
+		ok         bool
+	}{
+		{"report.pdf", "report.pdf", true},
+		{"photos/", "photos", true},
+		{"photos/2024", "2024", true},
+		{"../report.pdf", "", false},
+		{"/report.pdf", "", false},
+	}
+	for _, tt := range tests {
+		got, err := incomingName(tt.name)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("incomingName(%q) = %q, %v; want %q, ok=%v", tt.name, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+// symlink creates a link or skips the test where the platform refuses
+func symlink(t *testing.T, target, link string) {
+	t.Helper()
+	if err := os.Symlink(target, link); err != nil {
+		t.Skipf("symlinks unavailable: %v", err)
+	}
+}
+
+func TestSafeJoin(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "inside", "deep"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	symlink(t, outside, filepath.Join(root, "escape"))
+	symlink(t, filepath.Join(root, "inside"), filepath.Join(root, "alias"))
+	symlink(t, filepath.Join(outside, "target"), filepath.Join(root, "inside", "leaf"))
+	symlink(t, "..", filepath.Join(root, "inside", "up"))
+
+	tests := []struct {
+		rel    string
+		reason string // "" when the path is accepted
+	}{
+		{"file.txt", ""},
+		{"inside/deep/file.txt", ""},
+		{"new/dirs/file.txt", ""},
+		{"alias/file.txt", ""},             // a link that stays under root
+		{"inside/leaf", ""},                // the last element is replaced, not followed
+		{"inside/up/file.txt", ""},         // climbs back to root, not beyond
+		{"escape/file.txt", reasonSymlink}, // a parent leads outside root
+		{"escape/new/file.txt", reasonSymlink},
+		{"inside/up/escape/file.txt", reasonSymlink},
+		{"../file.txt", reasonParent},
+		{"/etc/passwd", reasonAbsolute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.rel, func(t *testing.T) {
+			got, err := safeJoin(root, tt.rel)
+			if tt.reason == "" {
+				if err != nil {
+					t.Fatalf("safeJoin(%q) = %v, want accepted", tt.rel, err)
+				}
+				if want := filepath.Join(root, filepath.FromSlash(tt.rel)); got != want {
+					t.Fatalf("safeJoin(%q) = %q, want %q", tt.rel, got, want)
+				}
+				return
+			}
+			var pe *PathError
+			if !errors.As(err, &pe) || pe.Reason != tt.reason {
+				t.Fatalf("safeJoin(%q) = %q, %v; want reason %q", tt.rel, got, err, tt.reason)
+			}
+		})
+	}
+}
+
+func TestCheckWithin(t *testing.T) {
+	base := t.TempDir()
+	root := filepath.Join(base, "root")
+	if err := os.Mkdir(root, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	// The download directory may itself be reached through a link
+	linkedRoot := filepath.Join(base, "linked-root")
+	symlink(t, root, linkedRoot)
+	symlink(t, base, filepath.Join(root, "parent"))
+
+	tests := []struct {
+		root, path string
+		ok         bool
+	}{
+		{root, root, true},
+		{root, filepath.Join(root, "missing", "dir"), true},
+		{linkedRoot, filepath.Join(linkedRoot, "dir"), true},
+		{linkedRoot, filepath.Join(root, "dir"), true},
+		{root, base, false},
+		{root, filepath.Join(root, "parent"), false},
+		{root, filepath.Join(root, "parent", "missing"), false},
+		{filepath.Join(base, "missing-root"), filepath.Join(base, "anything"), true},
+	}
+	for _, tt := range tests {
+		if err := checkWithin(tt.root, tt.path); (err == nil) != tt.ok {
+			t.Errorf("checkWithin(%q, %q) = %v, want ok=%v", tt.root, tt.path, err, tt.ok)
+		}
+	}
+}
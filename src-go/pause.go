@@ -0,0 +1,458 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A pausable body is split into frames so the sender can tell the receiver
+// where it stopped and started again; the receiver asks the sender to stop
+// with control lines on the back channel. The body streams only while
+// neither side has paused it.
+const (
+	frameData byte = iota
+	framePause
+	frameResume
+	frameEnd
+
+	frameHeaderSize = 5 // type, then a big-endian length
+
+	// pausedReadWindow replaces the idle timeout while a transfer is paused;
+	// keepalive still notices a peer that went away
+	pausedReadWindow = 24 * time.Hour
+)
+
+var errNotPausable = errors.New("transfer is not streaming a pausable body")
+
+// pauseGate tracks who paused a transfer and holds the sender while anyone has
+type pauseGate struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	enabled bool
+	local   bool
+	remote  bool
+	err     error         // why streaming stopped, wakes a held sender
+	window  time.Duration // read deadline to restore on resume, zero for the configured timeouts
+
+	conn   *Connection
+	notify func(paused bool) error // tells the peer about a local pause
+}
+
+// enablePause lets the transfer be paused while its body streams over c
+func (t *Transfer) enablePause(c *Connection, notify func(paused bool) error) {
+	g := &t.pause
+	g.mu.Lock()
+	g.cond = sync.NewCond(&g.mu)
+	g.enabled, g.err, g.window = true, nil, 0
+	g.conn, g.notify = c, notify
+	g.mu.Unlock()
+	priorities.rebalance() // a low priority transfer can be preempted from now on
+}
+
+// disablePause ends pausing once the body is done or broken; err, if set,
+// is what a held sender returns
+func (t *Transfer) disablePause(err error) {
+	g := &t.pause
+	g.mu.Lock()
+	if !g.enabled {
+		g.mu.Unlock()
+		return
+	}
+	wasPaused := g.local || g.remote
+	g.enabled, g.err = false, err
+	g.local, g.remote = false, false
+	g.cond.Broadcast()
+	g.mu.Unlock()
+
+	g.conn.SetReadDeadline(time.Time{})
+	if wasPaused {
+		t.mu.Lock()
+		t.Paused = false
+		t.mu.Unlock()
+	}
+}
+
+// setPaused records a pause or resume by "local" or "remote" and emits
+// transfer_paused or transfer_resumed when it changes anything
+func (t *Transfer) setPaused(by string, paused bool) error {
+	g := &t.pause
+	g.mu.Lock()
+	if !g.enabled {
+		g.mu.Unlock()
+		return errNotPausable
+	}
+	flag := &g.remote
+	if by == "local" {
+		flag = &g.local
+	}
+	if *flag == paused {
+		g.mu.Unlock()
+		return nil
+	}
+	if by == "local" && g.notify != nil {
+		if err := g.notify(paused); err != nil {
+			g.mu.Unlock()
+			return err
+		}
+	}
+	*flag = paused
+	anyPaused := g.local || g.remote
+	g.cond.Broadcast()
+	g.applyDeadlineLocked()
+	g.mu.Unlock()
+
+	t.mu.Lock()
+	t.Paused = anyPaused
+	t.mu.Unlock()
+
+	event := "transfer_resumed"
+	if paused {
+		event = "transfer_paused"
+	}
+	logger.Info(strings.Replace(event, "_", " ", 1), "id", t.ID, "by", by)
+	emitEvent(event, map[string]interface{}{
+		"id":     t.ID,
+		"by":     by,
+		"paused": anyPaused, // still held by the other side
+		"bytes":  t.bytes.Load(),
+	})
+	return nil
+}
+
+// applyDeadlineLocked sets the read deadline for the pause state. Nothing
+// moves while paused, so timeouts must not end the transfer then.
+func (g *pauseGate) applyDeadlineLocked() {
+	switch {
+	case g.local || g.remote:
+		g.conn.SetReadDeadline(time.Now().Add(pausedReadWindow))
+	case g.window > 0:
+		g.conn.SetReadDeadline(time.Now().Add(g.window))
+	default:
+		g.conn.SetReadDeadline(time.Time{})
+	}
+}
+
+// setAckWindow limits how long the sender waits for the final ack, counting
+// only time the transfer is not paused
+func (t *Transfer) setAckWindow(window time.Duration) {
+	g := &t.pause
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.window = window
+	if g.enabled {
+		g.applyDeadlineLocked()
+	} else {
+		g.conn.SetReadDeadline(time.Now().Add(window))
+	}
+}
+
+// waitWhileLocal holds the receiver while this side paused, so the sender
+// sees backpressure as well as the control line
+func (t *Transfer) waitWhileLocal() {
+	g := &t.pause
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for g.enabled && g.local {
+		g.cond.Wait()
+	}
+}
+
+// pausedBy reports whether each side currently holds the transfer
+func (t *Transfer) pausedBy() (local, remote bool) {
+	g := &t.pause
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.local, g.remote
+}
+
+// waitWhilePaused blocks the sender until neither side holds the transfer
+func (t *Transfer) waitWhilePaused() error {
+	g := &t.pause
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for g.enabled && (g.local || g.remote) {
+		g.cond.Wait()
+	}
+	return g.err
+}
+
+func writeFrame(w io.Writer, typ byte, data []byte) error {
+	frame := make([]byte, frameHeaderSize+len(data))
+	frame[0] = typ
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(data)))
+	copy(frame[frameHeaderSize:], data)
+	// One Write per frame keeps control frames from landing inside data
+	_, err := w.Write(frame)
+	return err
+}
+
+// pausableWriter frames a body on the sending side
+type pausableWriter struct {
+	mu     sync.Mutex
+	w      io.Writer
+	t      *Transfer
+	closed bool
+	chunks *chunkLog // frames are checked, see chunkcheck.go
+}
+
+func (pw *pausableWriter) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		if err := pw.t.waitWhilePaused(); err != nil {
+			return written, err
+		}
+		chunk := b[:min(len(b), transferBufferSize)]
+		var err error
+		if pw.chunks != nil {
+			err = pw.writeChecked(chunk)
+		} else {
+			pw.mu.Lock()
+			err = writeFrame(pw.w, frameData, chunk)
+			pw.mu.Unlock()
+		}
+		if err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		b = b[len(chunk):]
+	}
+	return written, nil
+}
+
+// control tells the receiver the sender paused or resumed
+func (pw *pausableWriter) control(paused bool) error {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	if pw.closed {
+		return errNotPausable
+	}
+	typ := frameResume
+	if paused {
+		typ = framePause
+	}
+	return writeFrame(pw.w, typ, nil)
+}
+
+// finish ends the body, once the receiver has every checked frame
+func (pw *pausableWriter) finish() error {
+	if pw.chunks != nil {
+		if err := pw.settleChecked(); err != nil {
+			return err
+		}
+	}
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	pw.closed = true
+	return writeFrame(pw.w, frameEnd, nil)
+}
+
+// pausableReader unframes a body on the receiving side and follows the
+// sender's pause state
+type pausableReader struct {
+	r    *bufio.Reader
+	t    *Transfer
+	left uint32 // bytes left in the current data frame
+	done bool
+
+	// Checked frames, see chunkcheck.go
+	back   func(transferControl) error
+	expect uint32 // sequence number of the next frame to keep
+	bad    int    // failed checksums since the last good frame
+	buf    []byte
+	ready  []byte // data of the last good frame not yet read
+}
+
+func (pr *pausableReader) Read(b []byte) (int, error) {
+	pr.t.waitWhileLocal()
+	for pr.left == 0 && len(pr.ready) == 0 {
+		if pr.done {
+			return 0, io.EOF
+		}
+		var header [frameHeaderSize]byte
+		if _, err := io.ReadFull(pr.r, header[:]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		switch n := binary.BigEndian.Uint32(header[1:]); header[0] {
+		case frameData:
+			pr.left = n
+		case frameChecked:
+			if pr.back == nil {
+				return 0, errors.New("checked frame on a body that did not ask for them")
+			}
+			if err := pr.readChecked(n); err != nil {
+				return 0, err
+			}
+		case framePause, frameResume:
+			pr.t.setPaused("remote", header[0] == framePause)
+		case frameEnd:
+			pr.done = true
+		default:
+			return 0, fmt.Errorf("invalid body frame type %d", header[0])
+		}
+	}
+
+	if len(pr.ready) > 0 {
+		n := copy(b, pr.ready)
+		pr.ready = pr.ready[n:]
+		return n, nil
+	}
+	if uint32(len(b)) > pr.left {
+		b = b[:pr.left]
+	}
+	n, err := pr.r.Read(b)
+	pr.left -= uint32(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// finish reads up to the end frame so the trailer comes next
+func (pr *pausableReader) finish() error {
+	_, err := io.Copy(io.Discard, pr)
+	return err
+}
+
+// transferControl is a line the receiver sends while the body streams
+type transferControl struct {
+	Control string `json:"control"`       // "pause", "resume", "chunk_ack", "retransmit"
+	Seq     uint32 `json:"seq,omitempty"` // checked frame the last two are about
+}
+
+// backChannel writes the receiver's control lines, which come from both
+// the body reader and pause_transfer
+type backChannel struct {
+	mu sync.Mutex
+	c  *Connection
+}
+
+func (b *backChannel) send(control transferControl) error {
+	line, _ := json.Marshal(control)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, err := b.c.Write(append(line, '\n'))
+	return err
+}
+
+func (b *backChannel) pause(paused bool) error {
+	if paused {
+		return b.send(transferControl{Control: "pause"})
+	}
+	return b.send(transferControl{Control: "resume"})
+}
+
+type ackResult struct {
+	ack TransferAck
+	err error
+}
+
+// watchControl reads the receiver's control lines while a pausable body is
+// sent, then hands over the final ack. chunks is nil unless frames are
+// checked.
+func watchControl(t *Transfer, r *bufio.Reader, chunks *chunkLog) <-chan ackResult {
+	acks := make(chan ackResult, 1)
+	go func() {
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				err = fmt.Errorf("no acknowledgement from receiver: %w", err)
+				t.disablePause(err)
+				if chunks != nil {
+					chunks.fail(err)
+				}
+				acks <- ackResult{err: err}
+				return
+			}
+			var control transferControl
+			if json.Unmarshal([]byte(line), &control) == nil && control.Control != "" {
+				switch control.Control {
+				case "chunk_ack", "retransmit":
+					if chunks == nil {
+						break
+					}
+					if control.Control == "chunk_ack" {
+						chunks.ack(control.Seq)
+					} else {
+						chunks.retransmit(control.Seq)
+					}
+				default:
+					t.setPaused("remote", control.Control == "pause")
+				}
+				continue
+			}
+			ack, err := parseAck(line)
+			if err != nil {
+				t.disablePause(err)
+				if chunks != nil {
+					chunks.fail(err)
+				}
+			}
+			acks <- ackResult{ack: ack, err: err}
+			return
+		}
+	}()
+	return acks
+}
+
+type PauseTransferPayload struct {
+	ID string `json:"id"`
+}
+
+func handlePauseTransfer(payload json.RawMessage, writer *Output) {
+	var p PauseTransferPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		sendInvalidPayload(writer, "pause_transfer")
+		return
+	}
+	t, exists := lookupTransfer(p.ID, writer)
+	if !exists {
+		sendErrorCode(writer, ErrNotFound, message("common.transfer_not_found"), nil)
+		return
+	}
+	info := t.Info()
+	if info.Files > 0 {
+		sendErrorCode(writer, ErrInvalidArgument, message("pause.only_single_file_transfers"), nil)
+		return
+	}
+	if info.State != "active" {
+		sendErrorCode(writer, ErrInvalidState, message("pause.transfer_not_active", "state", info.State), nil)
+		return
+	}
+	if err := t.setPaused("local", true); err != nil {
+		if errors.Is(err, errNotPausable) {
+			sendErrorCode(writer, ErrInvalidState, message("pause.transfer_cannot_paused_until"), nil)
+			return
+		}
+		sendError(writer, message("pause.failed_pause_transfer", "error", err))
+		return
+	}
+	writer.Encode(okResponse(message("pause.transfer_paused"), t.Info()))
+}
+
+// resumePaused continues an active transfer this side paused
+func resumePaused(t *Transfer, writer *Output) {
+	local, remote := t.pausedBy()
+	if !local {
+		if remote {
+			sendErrorCode(writer, ErrInvalidState, message("pause.transfer_paused_peer"), nil)
+		} else {
+			sendErrorCode(writer, ErrInvalidState, message("pause.transfer_not_paused"), nil)
+		}
+		return
+	}
+	if err := t.setPaused("local", false); err != nil {
+		sendError(writer, message("pause.failed_resume_transfer", "error", err))
+		return
+	}
+	writer.Encode(okResponse(message("pause.transfer_resumed"), t.Info()))
+}
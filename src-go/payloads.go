@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Payloads too big for one control message, such as a clipboard image,
+// arrive in pieces: begin_payload opens a buffer, payload_chunk appends
+// text to it in order, and end_payload runs a command on the result. The
+// text is either the command's whole JSON payload or, with field, the
+// string value of one field merged into a small payload sent alongside,
+// which spares the frontend from escaping base64 data into JSON twice.
+// Buffers belong to the channel that opened them and are dropped when
+// left idle.
+const (
+	maxAssembledPayload = 256 << 20 // 256 MiB
+	maxOpenPayloads     = 16
+	payloadIdleTimeout  = 2 * time.Minute
+)
+
+// assembly is a payload being put together
+type assembly struct {
+	id      string
+	channel *Output
+	size    int // declared total, 0 when unknown
+	next    int // sequence number of the expected chunk
+	buf     bytes.Buffer
+	timer   *time.Timer
+}
+
+var (
+	payloadSeq  atomic.Uint64
+	payloadsMu  sync.Mutex
+	assemblies  = make(map[string]*assembly)
+	chunkedSelf = map[string]bool{"begin_payload": true, "payload_chunk": true, "end_payload": true}
+)
+
+type BeginPayloadPayload struct {
+	Size int `json:"size"` // total length in bytes, optional, checked at the end
+}
+
+func handleBeginPayload(payload json.RawMessage, writer *Output) {
+	var p BeginPayloadPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		sendInvalidPayload(writer, "begin_payload")
+		return
+	}
+	if p.Size < 0 || p.Size > maxAssembledPayload {
+		sendErrorCode(writer, ErrInvalidArgument, message("payloads.size_must_between_0", "max_assembled_payload", maxAssembledPayload), nil)
+		return
+	}
+
+	payloadsMu.Lock()
+	defer payloadsMu.Unlock()
+	if len(assemblies) >= maxOpenPayloads {
+		sendErrorCode(writer, ErrInvalidState, message("payloads.too_many_payloads_progress"), map[string]interface{}{"limit": maxOpenPayloads})
+		return
+	}
+	a := &assembly{id: fmt.Sprintf("payload-%d", payloadSeq.Add(1)), channel: writer.channel(), size: p.Size}
+	if p.Size > 0 {
+		a.buf.Grow(p.Size)
+	}
+	a.timer = time.AfterFunc(payloadIdleTimeout, func() { expirePayload(a) })
+	assemblies[a.id] = a
+	writer.Encode(ProtocolResponse{
+		Status: "ok",
+		Data: map[string]interface{}{
+			"payload_id": a.id,
+			"max_size":   maxAssembledPayload,
+		},
+	})
+}
+
+// expirePayload drops a payload nobody finished
+func expirePayload(a *assembly) {
+	payloadsMu.Lock()
+	if assemblies[a.id] != a {
+		payloadsMu.Unlock()
+		return
+	}
+	delete(assemblies, a.id)
+	received := a.buf.Len()
+	payloadsMu.Unlock()
+	logger.Warn("payload expired", "payload_id", a.id, "received", received)
+}
+
+// takeAssembly finds a payload opened on writer's channel; the caller
+// holds payloadsMu
+func takeAssembly(id string, writer *Output) (*assembly, bool) {
+	a, exists := assemblies[id]
+	if !exists || a.channel != writer.channel() {
+		sendErrorCode(writer, ErrNotFound, message("payloads.payload_not_found"), map[string]interface{}{"payload_id": id})
+		return nil, false
+	}
+	return a, true
+}
+
+type PayloadChunkPayload struct {
+	PayloadID string `json:"payload_id"`
+	Seq       int    `json:"seq"`  // 0 for the first chunk, then one more each time
+	Data      string `json:"data"` // the next piece of text
+}
+
+func handlePayloadChunk(payload json.RawMessage, writer *Output) {
+	var p PayloadChunkPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		sendInvalidPayload(writer, "payload_chunk")
+		return
+	}
+
+	payloadsMu.Lock()
+	defer payloadsMu.Unlock()
+	a, ok := takeAssembly(p.PayloadID, writer)
+	if !ok {
+		return
+	}
+	if p.Seq != a.next {
+		sendErrorCode(writer, ErrInvalidArgument, message("payloads.expected_chunk_got", "next", a.next, "seq", p.Seq),
+			map[string]interface{}{"payload_id": a.id, "expected_seq": a.next})
+		return
+	}
+	limit := maxAssembledPayload
+	if a.size > 0 {
+		limit = a.size
+	}
+	if a.buf.Len()+len(p.Data) > limit {
+		// Nothing useful can come of the rest
+		a.timer.Stop()
+		delete(assemblies, a.id)
+		sendErrorCode(writer, ErrInvalidArgument, message("payloads.payload_exceeds_bytes", "limit", limit),
+			map[string]interface{}{"payload_id": a.id, "limit": limit})
+		return
+	}
+	a.buf.WriteString(p.Data)
+	a.next++
+	a.timer.Reset(payloadIdleTimeout)
+	writer.Encode(ProtocolResponse{
+		Status: "ok",
+		Data:   map[string]interface{}{"payload_id": a.id, "seq": p.Seq, "received": a.buf.Len()},
+	})
+}
+
+type EndPayloadPayload struct {
+	PayloadID string `json:"payload_id"`
+	Command   string `json:"command"` // what to run on the assembled payload
+
+	// With field, the assembled text becomes that string field of payload
+	// rather than the whole payload
+	Field   string                     `json:"field"`
+	Payload map[string]json.RawMessage `json:"payload"`
+}
+
+// handleEndPayload closes a payload and runs its command, which answers
+// in its own words
+func handleEndPayload(payload json.RawMessage, writer *Output) {
+	var p EndPayloadPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		sendInvalidPayload(writer, "end_payload")
+		return
+	}
+	if p.Command == "" {
+		sendErrorCode(writer, ErrInvalidArgument, message("payloads.end_payload_requires_command"), nil)
+		return
+	}
+	if chunkedSelf[p.Command] || inlineCommands[p.Command] {
+		sendErrorCode(writer, ErrUnsupported, message("payloads.not_available_through_end", "command", p.Command), nil)
+		return
+	}
+	if p.Payload != nil && p.Field == "" {
+		sendErrorCode(writer, ErrInvalidArgument, message("payloads.payload_requires_field"), nil)
+		return
+	}
+
+	payloadsMu.Lock()
+	a, ok := takeAssembly(p.PayloadID, writer)
+	if !ok {
+		payloadsMu.Unlock()
+		return
+	}
+	a.timer.Stop()
+	delete(assemblies, a.id)
+	payloadsMu.Unlock()
+
+	if a.size > 0 && a.buf.Len() != a.size {
+		sendErrorCode(writer, ErrInvalidArgument, message("payloads.payload_bytes_begin_payload", "len", a.buf.Len(), "size", a.size),
+			map[string]interface{}{"payload_id": a.id})
+		return
+	}
+
+	body := a.buf.Bytes()
+	if p.Field != "" {
+		value, err := json.Marshal(a.buf.String())
+		if err != nil {
+			sendErrorCode(writer, ErrInvalidArgument, message("payloads.invalid_payload_text", "error", err), nil)
+			return
+		}
+		a.buf = bytes.Buffer{} // the text lives on in value
+		if p.Payload == nil {
+			p.Payload = make(map[string]json.RawMessage)
+		}
+		p.Payload[p.Field] = value
+		if body, err = json.Marshal(p.Payload); err != nil {
+			sendErrorCode(writer, ErrInvalidArgument, message("payloads.invalid_payload", "error", err), nil)
+			return
+		}
+	} else if !json.Valid(body) {
+		sendError(writer, message("payloads.assembled_payload_not_valid"))
+		return
+	}
+	logger.Debug("payload assembled", "payload_id", a.id, "command", p.Command, "bytes", len(body))
+	handleRequest(ProtocolRequest{Command: p.Command, Payload: body}, writer)
+}
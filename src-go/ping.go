@@ -0,0 +1,539 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math"
+	"math/rand/v2"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// icmp_ping prefers ICMP echo, first through an unprivileged ICMP socket
+// and then a raw one. When neither is permitted it falls back to timing a
+// TCP handshake, or a UDP probe answered by port unreachable. traceroute
+// needs a raw socket to see the routers' Time Exceeded replies.
+const (
+	defaultPingCount    = 4
+	maxPingCount        = 1000
+	defaultPingInterval = time.Second
+	minPingInterval     = 100 * time.Millisecond
+	defaultPingTimeout  = time.Second
+	defaultPingSize     = 56
+	maxPingSize         = 65000
+	defaultTCPPingPort  = 80
+	defaultUDPPingPort  = 33434
+
+	defaultMaxHops   = 30
+	maxTracerouteHop = 64
+	defaultHopProbes = 3
+
+	protocolICMP   = 1
+	protocolICMPv6 = 58
+)
+
+// resolvePingTarget resolves host within the requested address family
+func resolvePingTarget(host, family string) (*net.IPAddr, error) {
+	network, err := familyNetwork("ip", family)
+	if err != nil {
+		return nil, err
+	}
+	addr, err := net.ResolveIPAddr(network, normalizeHost(host))
+	if err != nil {
+		return nil, catalogError(ErrFailed, "ping.failed_resolve", "host", host, "error", err)
+	}
+	return addr, nil
+}
+
+// icmpSocket is an ICMP endpoint and the address echo requests go to
+type icmpSocket struct {
+	conn *icmp.PacketConn
+	dst  net.Addr
+	v4   bool
+	raw  bool // a raw socket sees every ICMP message, not just our echo replies
+}
+
+// openICMP opens an unprivileged ICMP socket for target, or a raw one when
+// that fails or raw is required
+func openICMP(target *net.IPAddr, rawOnly bool) (*icmpSocket, error) {
+	v4 := target.IP.To4() != nil
+	dgram, rawNet, wildcard := "udp6", "ip6:ipv6-icmp", "::"
+	if v4 {
+		dgram, rawNet, wildcard = "udp4", "ip4:icmp", "0.0.0.0"
+	}
+	if !rawOnly {
+		if conn, err := icmp.ListenPacket(dgram, wildcard); err == nil {
+			return &icmpSocket{conn: conn, dst: &net.UDPAddr{IP: target.IP, Zone: target.Zone}, v4: v4}, nil
+		}
+	}
+	conn, err := icmp.ListenPacket(rawNet, wildcard)
+	if err != nil {
+		return nil, err
+	}
+	return &icmpSocket{conn: conn, dst: target, v4: v4, raw: true}, nil
+}
+
+func (s *icmpSocket) echo(id, seq int, data []byte) ([]byte, error) {
+	var typ icmp.Type = ipv6.ICMPTypeEchoRequest
+	if s.v4 {
+		typ = ipv4.ICMPTypeEcho
+	}
+	msg := icmp.Message{Type: typ, Body: &icmp.Echo{ID: id, Seq: seq, Data: data}}
+	return msg.Marshal(nil)
+}
+
+func (s *icmpSocket) protocol() int {
+	if s.v4 {
+		return protocolICMP
+	}
+	return protocolICMPv6
+}
+
+func (s *icmpSocket) setTTL(ttl int) error {
+	if s.v4 {
+		return s.conn.IPv4PacketConn().SetTTL(ttl)
+	}
+	return s.conn.IPv6PacketConn().SetHopLimit(ttl)
+}
+
+// icmpReply is an ICMP message that answers one of our echo requests
+type icmpReply struct {
+	from    string
+	reached bool // an echo reply from the target rather than a router's error
+	kind    string
+}
+
+// readReply waits until deadline for the answer to echo id/seq. An
+// unprivileged socket has its ID rewritten by the kernel, so only the
+// sequence number is compared there. An echo reply must come from the
+// target, as a raw socket also sees the replies to other probes.
+func (s *icmpSocket) readReply(id, seq int, deadline time.Time) (icmpReply, error) {
+	buf := make([]byte, 1500)
+	s.conn.SetReadDeadline(deadline)
+	for {
+		n, peer, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return icmpReply{}, err
+		}
+		msg, err := icmp.ParseMessage(s.protocol(), buf[:n])
+		if err != nil {
+			continue
+		}
+		from := peer.String()
+		if a, ok := peer.(*net.UDPAddr); ok {
+			from = (&net.IPAddr{IP: a.IP, Zone: a.Zone}).String()
+		}
+		switch body := msg.Body.(type) {
+		case *icmp.Echo:
+			if (msg.Type == ipv4.ICMPTypeEchoReply || msg.Type == ipv6.ICMPTypeEchoReply) &&
+				body.Seq == seq && (!s.raw || body.ID == id) && icmpPeerIP(peer).Equal(icmpPeerIP(s.dst)) {
+				return icmpReply{from: from, reached: true, kind: "echo_reply"}, nil
+			}
+		case *icmp.TimeExceeded:
+			if s.matchEmbedded(body.Data, id, seq) {
+				return icmpReply{from: from, kind: "time_exceeded"}, nil
+			}
+		case *icmp.DstUnreach:
+			if s.matchEmbedded(body.Data, id, seq) {
+				return icmpReply{from: from, kind: "unreachable"}, nil
+			}
+		}
+	}
+}
+
+// icmpPeerIP is the IP address of an ICMP socket's peer
+func icmpPeerIP(a net.Addr) net.IP {
+	switch a := a.(type) {
+	case *net.IPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+// matchEmbedded checks that the packet quoted in an ICMP error is our echo
+func (s *icmpSocket) matchEmbedded(data []byte, id, seq int) bool {
+	if s.v4 {
+		if len(data) < 20 {
+			return false
+		}
+		// The header length comes from the network, so it may claim more
+		// than was quoted or less than a header holds
+		ihl := int(data[0]&0x0f) * 4
+		if ihl < 20 || ihl > len(data) {
+			return false
+		}
+		data = data[ihl:]
+	} else {
+		if len(data) < 40 {
+			return false
+		}
+		data = data[40:]
+	}
+	if len(data) < 8 {
+		return false
+	}
+	return int(binary.BigEndian.Uint16(data[4:6])) == id && int(binary.BigEndian.Uint16(data[6:8])) == seq
+}
+
+// pingProbe sends one probe and returns its round trip time
+type pingProbe func(seq int, timeout time.Duration) (rtt time.Duration, from string, err error)
+
+func icmpProbe(s *icmpSocket, id, size int) pingProbe {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	return func(seq int, timeout time.Duration) (time.Duration, string, error) {
+		packet, err := s.echo(id, seq, data)
+		if err != nil {
+			return 0, "", err
+		}
+		start := time.Now()
+		if _, err := s.conn.WriteTo(packet, s.dst); err != nil {
+			return 0, "", err
+		}
+		for {
+			reply, err := s.readReply(id, seq, start.Add(timeout))
+			if err != nil {
+				return 0, "", err
+			}
+			if reply.reached {
+				return time.Since(start), reply.from, nil
+			}
+			// A router reporting the target unreachable is an answer too
+			if reply.kind == "unreachable" {
+				return 0, reply.from, errors.New("destination unreachable")
+			}
+		}
+	}
+}
+
+// tcpProbe times a handshake; a refused connection still proves the host is up
+func tcpProbe(target *net.IPAddr, port int) pingProbe {
+	addr := net.JoinHostPort(target.String(), strconv.Itoa(port))
+	return func(seq int, timeout time.Duration) (time.Duration, string, error) {
+		start := time.Now()
+		conn, err := net.DialTimeout("tcp", addr, timeout)
+		rtt := time.Since(start)
+		if err == nil {
+			conn.Close()
+			return rtt, addr, nil
+		}
+		if isRefused(err) {
+			return rtt, addr, nil
+		}
+		return 0, "", err
+	}
+}
+
+// udpProbe sends a datagram to a port that is normally closed and waits
+// for the port unreachable error, which the socket reports as refused
+func udpProbe(target *net.IPAddr, port int) pingProbe {
+	addr := net.JoinHostPort(target.String(), strconv.Itoa(port))
+	return func(seq int, timeout time.Duration) (time.Duration, string, error) {
+		conn, err := net.Dial("udp", addr)
+		if err != nil {
+			return 0, "", err
+		}
+		defer conn.Close()
+		start := time.Now()
+		conn.SetDeadline(start.Add(timeout))
+		if _, err := conn.Write([]byte("lumina-ping " + strconv.Itoa(seq))); err != nil {
+			return 0, "", err
+		}
+		_, err = conn.Read(make([]byte, 512))
+		rtt := time.Since(start)
+		if err == nil || isRefused(err) {
+			return rtt, addr, nil
+		}
+		return 0, "", err
+	}
+}
+
+// PingStats summarizes a ping run
+type PingStats struct {
+	Sent        int     `json:"sent"`
+	Received    int     `json:"received"`
+	LossPercent float64 `json:"loss_percent"`
+	MinMs       float64 `json:"min_ms"`
+	AvgMs       float64 `json:"avg_ms"`
+	MaxMs       float64 `json:"max_ms"`
+	StddevMs    float64 `json:"stddev_ms"`
+}
+
+func newPingStats(sent int, rtts []float64) PingStats {
+	stats := PingStats{Sent: sent, Received: len(rtts)}
+	if sent > 0 {
+		stats.LossPercent = 100 * float64(sent-len(rtts)) / float64(sent)
+	}
+	if len(rtts) == 0 {
+		return stats
+	}
+	stats.MinMs, stats.MaxMs = rtts[0], rtts[0]
+	var sum float64
+	for _, r := range rtts {
+		stats.MinMs, stats.MaxMs = math.Min(stats.MinMs, r), math.Max(stats.MaxMs, r)
+		sum += r
+	}
+	stats.AvgMs = sum / float64(len(rtts))
+	var variance float64
+	for _, r := range rtts {
+		variance += (r - stats.AvgMs) * (r - stats.AvgMs)
+	}
+	stats.StddevMs = math.Sqrt(variance / float64(len(rtts)))
+	return stats
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+type ICMPPingPayload struct {
+	Host          string `json:"host" required:"true"`
+	Count         int    `json:"count"`       // default 4
+	IntervalMs    int    `json:"interval_ms"` // default 1000, at least 100
+	TimeoutMs     int    `json:"timeout_ms"`  // per probe, default 1000
+	Size          int    `json:"size"`        // ICMP payload bytes, default 56
+	Mode          string `json:"mode"`        // "auto" (default), "icmp", "tcp", "udp"
+	Port          int    `json:"port"`        // for tcp (default 80) and udp (default 33434)
+	AddressFamily string `json:"address_family"`
+}
+
+// handleICMPPing starts a ping run and streams a ping_probe event per
+// probe, then ping_completed with the statistics
+func handleICMPPing(payload json.RawMessage, writer *Output) {
+	var p ICMPPingPayload
+	if err := json.Unmarshal(payload, &p); err != nil || p.Host == "" {
+		sendErrorCode(writer, ErrInvalidArgument, message("ping.icmp_ping_requires_host"), nil)
+		return
+	}
+	if p.Count <= 0 {
+		p.Count = defaultPingCount
+	}
+	if p.Count > maxPingCount {
+		sendErrorCode(writer, ErrInvalidArgument, message("ping.count_must_most", "max_ping_count", maxPingCount), nil)
+		return
+	}
+	interval := defaultPingInterval
+	if p.IntervalMs > 0 {
+		interval = max(time.Duration(p.IntervalMs)*time.Millisecond, minPingInterval)
+	}
+	timeout := defaultPingTimeout
+	if p.TimeoutMs > 0 {
+		timeout = time.Duration(p.TimeoutMs) * time.Millisecond
+	}
+	if p.Size <= 0 {
+		p.Size = defaultPingSize
+	}
+	if p.Size > maxPingSize {
+		sendErrorCode(writer, ErrInvalidArgument, message("ping.size_must_most", "max_ping_size", maxPingSize), nil)
+		return
+	}
+	target, err := resolvePingTarget(p.Host, p.AddressFamily)
+	if err != nil {
+		sendFailure(writer, err)
+		return
+	}
+
+	mode := p.Mode
+	var probe pingProbe
+	var closer func()
+	switch mode {
+	case "", "auto", "icmp":
+		s, err := openICMP(target, false)
+		if err == nil {
+			mode, probe, closer = "icmp", icmpProbe(s, rand.IntN(0xffff), p.Size), func() { s.conn.Close() }
+			break
+		}
+		if mode == "icmp" {
+			sendErrorCode(writer, ErrUnsupported, message("ping.icmp_not_available", "error", err), nil)
+			return
+		}
+		logger.Info("icmp not permitted, falling back to tcp ping", "error", err)
+		mode = "tcp"
+		fallthrough
+	case "tcp":
+		if p.Port <= 0 {
+			p.Port = defaultTCPPingPort
+		}
+		mode, probe = "tcp", tcpProbe(target, p.Port)
+	case "udp":
+		if p.Port <= 0 {
+			p.Port = defaultUDPPingPort
+		}
+		probe = udpProbe(target, p.Port)
+	default:
+		sendErrorCode(writer, ErrUnsupported, message("ping.unsupported_ping_mode", "mode", p.Mode), nil)
+		return
+	}
+
+	id := startDiagnostic("ping", p.Host, func(ctx context.Context, id string) {
+		if closer != nil {
+			defer closer()
+		}
+		var rtts []float64
+		sent := 0
+		for seq := 1; seq <= p.Count; seq++ {
+			if seq > 1 && !sleepCtx(ctx, interval) {
+				break
+			}
+			sent++
+			rtt, from, err := probe(seq, timeout)
+			ev := map[string]interface{}{"id": id, "seq": seq, "mode": mode, "ok": err == nil}
+			if err != nil {
+				ev["error"] = probeError(err)
+			} else {
+				ev["from"], ev["rtt_ms"] = from, millis(rtt)
+				rtts = append(rtts, millis(rtt))
+			}
+			emitEvent("ping_probe", ev)
+		}
+		emitEvent("ping_completed", map[string]interface{}{
+			"id":       id,
+			"host":     p.Host,
+			"ip":       target.String(),
+			"mode":     mode,
+			"stats":    newPingStats(sent, rtts),
+			"canceled": ctx.Err() != nil,
+		})
+	})
+
+	data := map[string]interface{}{"id": id, "ip": target.String(), "mode": mode}
+	if mode != "icmp" {
+		data["port"] = p.Port
+	}
+	writer.Encode(okResponse(message("ping.pinging_over", "host", p.Host, "target", target, "mode", mode), data))
+}
+
+// probeError shortens a probe failure for the UI
+func probeError(err error) string {
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return "timeout"
+	}
+	return err.Error()
+}
+
+// TracerouteHop is what one TTL step answered
+type TracerouteHop struct {
+	TTL      int       `json:"ttl"`
+	Addr     string    `json:"addr,omitempty"` // first router that answered
+	Hostname string    `json:"hostname,omitempty"`
+	RTTMs    []float64 `json:"rtt_ms"` // one per answered probe
+	Lost     int       `json:"lost"`
+	Reached  bool      `json:"reached"`
+}
+
+type TraceroutePayload struct {
+	Host          string `json:"host" required:"true"`
+	MaxHops       int    `json:"max_hops"`   // default 30
+	Probes        int    `json:"probes"`     // per hop, default 3
+	TimeoutMs     int    `json:"timeout_ms"` // per probe, default 1000
+	Resolve       bool   `json:"resolve"`    // reverse-resolve hop addresses
+	AddressFamily string `json:"address_family"`
+}
+
+// handleTraceroute starts a traceroute and streams traceroute_probe and
+// traceroute_hop events, then traceroute_completed
+func handleTraceroute(payload json.RawMessage, writer *Output) {
+	var p TraceroutePayload
+	if err := json.Unmarshal(payload, &p); err != nil || p.Host == "" {
+		sendErrorCode(writer, ErrInvalidArgument, message("ping.traceroute_requires_host"), nil)
+		return
+	}
+	if p.MaxHops <= 0 {
+		p.MaxHops = defaultMaxHops
+	}
+	if p.Probes <= 0 {
+		p.Probes = defaultHopProbes
+	}
+	if p.MaxHops > maxTracerouteHop || p.Probes > 10 {
+		sendErrorCode(writer, ErrInvalidArgument, message("ping.traceroute_allows_most_hops", "max_traceroute_hop", maxTracerouteHop), nil)
+		return
+	}
+	timeout := defaultPingTimeout
+	if p.TimeoutMs > 0 {
+		timeout = time.Duration(p.TimeoutMs) * time.Millisecond
+	}
+	target, err := resolvePingTarget(p.Host, p.AddressFamily)
+	if err != nil {
+		sendFailure(writer, err)
+		return
+	}
+	s, err := openICMP(target, true)
+	if err != nil {
+		sendErrorCode(writer, ErrUnsupported, message("ping.traceroute_needs_raw_icmp", "error", err), nil)
+		return
+	}
+
+	icmpID := rand.IntN(0xffff)
+	id := startDiagnostic("traceroute", p.Host, func(ctx context.Context, id string) {
+		defer s.conn.Close()
+		data := []byte("lumina-traceroute")
+		hops := []TracerouteHop{}
+		reached := false
+		seq := 0
+		for ttl := 1; ttl <= p.MaxHops && !reached && ctx.Err() == nil; ttl++ {
+			hop := TracerouteHop{TTL: ttl, RTTMs: []float64{}}
+			if err := s.setTTL(ttl); err != nil {
+				emitEvent("traceroute_failed", map[string]interface{}{"id": id, "error": err.Error()})
+				return
+			}
+			for probe := 1; probe <= p.Probes && ctx.Err() == nil; probe++ {
+				seq++
+				ev := map[string]interface{}{"id": id, "ttl": ttl, "probe": probe}
+				packet, _ := s.echo(icmpID, seq, data)
+				start := time.Now()
+				_, err := s.conn.WriteTo(packet, s.dst)
+				var reply icmpReply
+				if err == nil {
+					reply, err = s.readReply(icmpID, seq, start.Add(timeout))
+				}
+				if err != nil {
+					hop.Lost++
+					ev["lost"], ev["error"] = true, probeError(err)
+				} else {
+					rtt := millis(time.Since(start))
+					hop.RTTMs = append(hop.RTTMs, rtt)
+					if hop.Addr == "" {
+						hop.Addr = reply.from
+					}
+					hop.Reached = hop.Reached || reply.reached || reply.kind == "unreachable"
+					ev["from"], ev["rtt_ms"], ev["reply"] = reply.from, rtt, reply.kind
+				}
+				emitEvent("traceroute_probe", ev)
+			}
+			if p.Resolve && hop.Addr != "" {
+				lookupCtx, cancel := context.WithTimeout(ctx, time.Second)
+				if names, err := net.DefaultResolver.LookupAddr(lookupCtx, hop.Addr); err == nil && len(names) > 0 {
+					hop.Hostname = strings.TrimSuffix(names[0], ".")
+				}
+				cancel()
+			}
+			reached = hop.Reached
+			hops = append(hops, hop)
+			emitEvent("traceroute_hop", map[string]interface{}{"id": id, "hop": hop})
+		}
+		emitEvent("traceroute_completed", map[string]interface{}{
+			"id":       id,
+			"host":     p.Host,
+			"ip":       target.String(),
+			"reached":  reached,
+			"hops":     hops,
+			"canceled": ctx.Err() != nil,
+		})
+	})
+
+	writer.Encode(okResponse(message("ping.tracing_route", "host", p.Host, "target", target),
+		map[string]interface{}{"id": id, "ip": target.String(), "max_hops": p.MaxHops}))
+}
@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func TestMatchEmbeddedChecksHeaderLength(t *testing.T) {
+	s := &icmpSocket{v4: true}
+	quoted := func(ihl byte, size int) []byte {
+		b := make([]byte, size)
+		b[0] = 0x40 | ihl
+		if off := int(ihl) * 4; off >= 20 && off+8 <= size {
+			b[off+4], b[off+5], b[off+6], b[off+7] = 0, 7, 0, 3
+		}
+		return b
+	}
+	if !s.matchEmbedded(quoted(5, 28), 7, 3) {
+		t.Error("a well-formed quote did not match")
+	}
+	for _, data := range [][]byte{quoted(15, 28), quoted(2, 28), quoted(15, 60)} {
+		if s.matchEmbedded(data, 7, 3) {
+			t.Errorf("header length %d in %d bytes matched", data[0]&0x0f, len(data))
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"runtime"
+	"time"
+)
+
+// Plaintext transfers: between two machines on a LAN the user trusts, the
+// encryption an encrypted transfer listener demands can cost more CPU than
+// the link is worth. The encryption config section names the subnets
+// trusted that much. A send_file with plaintext set then opens with
+// plaintextMagic in place of the handshake, and an encrypted transfer
+// listener lets it through when the local and remote address of the
+// connection both lie in one of its trusted subnets. Each side checks its
+// own policy, so neither can talk the other out of encryption. Without a
+// handshake there is no key to pin, so only listeners that take unpinned
+// peers anyway (allow_unpinned) waive it, and blocked hosts are turned
+// away as on the encrypted path.
+// crypto_benchmark tells what the encryption costs on this machine.
+const (
+	plaintextMagic = "LUMPLN01" // as long as secureMagic, so one read tells them apart
+
+	defaultCryptoBenchmarkBytes = 64 << 20
+	maxCryptoBenchmarkBytes     = 1 << 30
+)
+
+// EncryptionConfig is the config section on when encryption may be skipped
+type EncryptionConfig struct {
+	// PlaintextSubnets are CIDR prefixes; a plaintext transfer needs both
+	// ends in the same one. Empty means encrypted listeners never waive
+	// the handshake.
+	PlaintextSubnets []string `json:"plaintext_subnets,omitempty"`
+}
+
+func (e EncryptionConfig) Validate() error {
+	for _, s := range e.PlaintextSubnets {
+		if _, err := netip.ParsePrefix(s); err != nil {
+			return catalogError(ErrInvalidArgument, "plaintext.invalid_subnet", "subnet", s)
+		}
+	}
+	return nil
+}
+
+// trustedSubnet returns the configured subnet holding both addresses, or
+// "" if there is none
+func (e EncryptionConfig) trustedSubnet(local, remote net.Addr) string {
+	l, lok := addrIP(local)
+	r, rok := addrIP(remote)
+	if !lok || !rok {
+		return ""
+	}
+	for _, s := range e.PlaintextSubnets {
+		prefix, err := netip.ParsePrefix(s)
+		if err == nil && prefix.Contains(l) && prefix.Contains(r) {
+			return prefix.Masked().String()
+		}
+	}
+	return ""
+}
+
+// addrIP is the IP of a TCP address, without zone or IPv4 mapping
+func addrIP(a net.Addr) (netip.Addr, bool) {
+	if a == nil {
+		return netip.Addr{}, false
+	}
+	ap, err := netip.ParseAddrPort(a.String())
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return ap.Addr().Unmap().WithZone(""), true
+}
+
+// plaintextClient tells an encrypted listener the connection stays
+// unencrypted, after checking our own policy allows that
+func plaintextClient(conn net.Conn) error {
+	if config.Get().Encryption.trustedSubnet(conn.LocalAddr(), conn.RemoteAddr()) == "" {
+		return errors.New("plaintext transfers need both peers on a subnet in encryption.plaintext_subnets")
+	}
+	_, err := conn.Write([]byte(plaintextMagic))
+	return err
+}
+
+// replayConn gives back bytes already read off the connection before
+// reading more
+type replayConn struct {
+	net.Conn
+	head []byte
+}
+
+func (r *replayConn) Read(b []byte) (int, error) {
+	if len(r.head) > 0 {
+		n := copy(b, r.head)
+		r.head = r.head[n:]
+		return n, nil
+	}
+	return r.Conn.Read(b)
+}
+
+// acceptPlaintext reads the first bytes of a connection to an encrypted
+// transfer listener whose peer is on a trusted subnet. It reports whether
+// the peer asked to skip encryption, which fails for blocked hosts and on
+// listeners that insist on pinned keys; otherwise the bytes are handed
+// back through the returned conn for the handshake.
+func acceptPlaintext(c *Connection, l *Listener, subnet string) (net.Conn, bool, error) {
+	conn := c.Conn()
+	head := make([]byte, len(plaintextMagic))
+	conn.SetReadDeadline(time.Now().Add(secureHandshakeTTL))
+	_, err := io.ReadFull(conn, head)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return nil, false, fmt.Errorf("handshake failed: %w", err)
+	}
+	if string(head) != plaintextMagic {
+		return &replayConn{Conn: conn, head: head}, false, nil
+	}
+	if known, blocked := trust.blockedAddr(conn.RemoteAddr()); blocked {
+		rejectBlocked(l, conn.RemoteAddr().String(), known, "handshake")
+		return nil, false, errors.New("peer is blocked")
+	}
+	if !l.AllowUnpinned {
+		emitEvent("encryption_rejected", map[string]interface{}{
+			"id":          c.ID,
+			"listener":    l.Addr,
+			"listener_id": l.ID,
+			"remote_addr": conn.RemoteAddr().String(),
+			"reason":      "plaintext needs a listener that allows unpinned peers",
+		})
+		return nil, false, errors.New("plaintext needs a listener that allows unpinned peers")
+	}
+	c.setPlaintext(subnet)
+	emitEvent("plaintext_accepted", map[string]interface{}{
+		"id":          c.ID,
+		"listener":    l.Addr,
+		"listener_id": l.ID,
+		"remote_addr": conn.RemoteAddr().String(),
+		"subnet":      subnet,
+	})
+	return conn, true, nil
+}
+
+func (c *Connection) setPlaintext(subnet string) {
+	c.mu.Lock()
+	c.trusted = subnet
+	c.mu.Unlock()
+}
+
+// notePlaintext marks a receive transfer arriving over a connection that
+// skipped encryption
+func (t *Transfer) notePlaintext(c *Connection) {
+	c.mu.Lock()
+	plaintext := c.trusted != ""
+	c.mu.Unlock()
+	t.mu.Lock()
+	t.Plaintext = plaintext
+	t.mu.Unlock()
+}
+
+// CryptoBenchmarkResult is one side of crypto_benchmark
+type CryptoBenchmarkResult struct {
+	Bytes     int64   `json:"bytes"`
+	ElapsedMs float64 `json:"elapsed_ms"`
+	MBps      float64 `json:"mb_per_sec"`
+}
+
+type CryptoBenchmarkPayload struct {
+	Bytes int64 `json:"bytes"` // pushed through each side, default 64 MiB
+}
+
+// handleCryptoBenchmark pushes the same bytes through an in-memory
+// connection pair, once plain and once over an encrypted session, and
+// reports the throughput of each. The pipe costs both the same, so the
+// difference is what sealing and opening the records takes on this CPU.
+func handleCryptoBenchmark(payload json.RawMessage, writer *Output) {
+	var p CryptoBenchmarkPayload
+	if len(payload) > 0 && string(payload) != "null" {
+		if err := json.Unmarshal(payload, &p); err != nil {
+			sendInvalidPayload(writer, "crypto_benchmark")
+			return
+		}
+	}
+	if p.Bytes < 0 || p.Bytes > maxCryptoBenchmarkBytes {
+		sendErrorCode(writer, ErrInvalidArgument, message("plaintext.bytes_between", "max", maxCryptoBenchmarkBytes), nil)
+		return
+	}
+	if p.Bytes == 0 {
+		p.Bytes = defaultCryptoBenchmarkBytes
+	}
+
+	plain, err := benchmarkPipe(p.Bytes, false)
+	if err != nil {
+		sendFailure(writer, err)
+		return
+	}
+	encrypted, err := benchmarkPipe(p.Bytes, true)
+	if err != nil {
+		sendFailure(writer, err)
+		return
+	}
+	data := map[string]interface{}{
+		"cipher":    "chacha20-poly1305",
+		"cpus":      runtime.NumCPU(),
+		"plaintext": plain,
+		"encrypted": encrypted,
+	}
+	if encrypted.MBps > 0 {
+		data["slowdown"] = plain.MBps / encrypted.MBps // how many times faster plaintext went
+	}
+	writer.Encode(ProtocolResponse{Status: "ok", Data: data})
+}
+
+// benchmarkPipe times writing n bytes into one end of a net.Pipe and
+// reading them out of the other, with the encrypted handshake run first
+// if encrypted is set
+func benchmarkPipe(n int64, encrypted bool) (CryptoBenchmarkResult, error) {
+	var a, b net.Conn
+	a, b = net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	if encrypted {
+		type result struct {
+			s   *secureConn
+			err error
+		}
+		done := make(chan result, 1)
+		go func() {
+			s, err := secureHandshake(b, false)
+			done <- result{s, err}
+		}()
+		sa, err := secureHandshake(a, true)
+		r := <-done
+		if err == nil {
+			err = r.err
+		}
+		if err != nil {
+			return CryptoBenchmarkResult{}, err
+		}
+		a, b = sa, r.s
+	}
+
+	buf := make([]byte, secureMaxRecord)
+	rand.Read(buf)
+	start := time.Now()
+	writeErr := make(chan error, 1)
+	go func() {
+		for left := n; left > 0; {
+			chunk := buf[:min(left, int64(len(buf)))]
+			if _, err := a.Write(chunk); err != nil {
+				writeErr <- err
+				return
+			}
+			left -= int64(len(chunk))
+		}
+		writeErr <- nil
+	}()
+	if _, err := io.CopyN(io.Discard, b, n); err != nil {
+		return CryptoBenchmarkResult{}, err
+	}
+	if err := <-writeErr; err != nil {
+		return CryptoBenchmarkResult{}, err
+	}
+	elapsed := time.Since(start)
+	return CryptoBenchmarkResult{
+		Bytes:     n,
+		ElapsedMs: float64(elapsed.Microseconds()) / 1000,
+		MBps:      float64(n) / (1 << 20) / elapsed.Seconds(),
+	}, nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTrustedSubnet(t *testing.T) {
+	policy := EncryptionConfig{PlaintextSubnets: []string{"192.168.1.7/24", "fd00::/8"}}
+	addr := func(s string) net.Addr {
+		a, _ := net.ResolveTCPAddr("tcp", s)
+		return a
+	}
+	cases := []struct {
+		local, remote, want string
+	}{
+		{"192.168.1.5:4000", "192.168.1.9:51000", "192.168.1.0/24"},
+		{"[::ffff:192.168.1.5]:4000", "192.168.1.9:51000", "192.168.1.0/24"},
+		{"192.168.1.5:4000", "192.168.2.9:51000", ""},
+		{"[fd00::1]:4000", "[fd12::2]:51000", "fd00::/8"},
+		{"[fd00::1]:4000", "192.168.1.9:51000", ""},
+	}
+	for _, c := range cases {
+		if got := policy.trustedSubnet(addr(c.local), addr(c.remote)); got != c.want {
+			t.Errorf("%s to %s: got %q, want %q", c.local, c.remote, got, c.want)
+		}
+	}
+	if got := (EncryptionConfig{}).trustedSubnet(addr("10.0.0.1:1"), addr("10.0.0.2:2")); got != "" {
+		t.Errorf("empty policy trusted %q", got)
+	}
+	if err := (EncryptionConfig{PlaintextSubnets: []string{"192.168.1.0"}}).Validate(); err == nil {
+		t.Error("subnet without a prefix length accepted")
+	}
+}
+
+func TestEncryptedListenerWaivesHandshakeOnTrustedSubnet(t *testing.T) {
+	config.mu.Lock()
+	saved := config.cfg
+	config.cfg.Encryption = EncryptionConfig{PlaintextSubnets: []string{"127.0.0.0/8"}}
+	config.mu.Unlock()
+	t.Cleanup(func() {
+		config.mu.Lock()
+		config.cfg = saved
+		config.mu.Unlock()
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	l := &Listener{ID: "plain-ln", Addr: ln.Addr().String(), Type: "transfer", Encrypted: true, AllowUnpinned: true}
+
+	// accept runs the listener's side for one dial and returns its connection
+	accept := func(spec dialSpec) (*Connection, net.Conn, error) {
+		done := make(chan *Connection, 1)
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				done <- nil
+				return
+			}
+			c := &Connection{ID: "plain-in", Direction: "inbound", Network: "tcp", Created: time.Now(), Limiter: newRateLimiter(0)}
+			c.setConn(conn)
+			if err := secureInbound(c, l); err != nil {
+				conn.Close()
+				done <- nil
+				return
+			}
+			done <- c
+		}()
+		client, _, _, err := spec.dialRoute()
+		c := <-done
+		if c != nil {
+			t.Cleanup(func() { c.Conn().Close() })
+		}
+		if client != nil {
+			t.Cleanup(func() { client.Close() })
+		}
+		return c, client, err
+	}
+	spec := dialSpec{Network: "tcp", Addr: ln.Addr().String(), Timeout: 5 * time.Second, Proxy: "direct"}
+
+	plain := spec
+	plain.Plaintext = true
+	c, client, err := accept(plain)
+	if err != nil || c == nil {
+		t.Fatalf("plaintext dial refused: %v", err)
+	}
+	if info := c.Info(); info.Plaintext != "127.0.0.0/8" || info.Encrypted {
+		t.Errorf("plaintext connection reported as %+v", info)
+	}
+	client.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := c.Conn().Read(buf); err != nil || string(buf) != "hello" {
+		t.Errorf("read %q, %v after the marker", buf, err)
+	}
+
+	// A peer that does encrypt still gets the handshake, read-ahead and all
+	encrypted := spec
+	encrypted.Encrypted = true
+	c, _, err = accept(encrypted)
+	if err != nil || c == nil {
+		t.Fatalf("encrypted dial failed on a trusted subnet: %v", err)
+	}
+	if info := c.Info(); !info.Encrypted || info.Plaintext != "" {
+		t.Errorf("encrypted connection reported as %+v", info)
+	}
+
+	// Nothing is pinned without a handshake, so the listener must allow that
+	l.AllowUnpinned = false
+	if c, _, err := accept(plain); err == nil && c != nil {
+		t.Error("plaintext allowed on a listener that insists on pinned keys")
+	}
+	l.AllowUnpinned = true
+
+	// Blocked hosts are turned away without a key to recognise them by
+	trust.mu.Lock()
+	trust.peers["blocked-local"] = &KnownPeer{Fingerprint: "blocked-local", Trust: trustBlocked, Addrs: []string{"127.0.0.1"}}
+	trust.mu.Unlock()
+	t.Cleanup(func() {
+		trust.mu.Lock()
+		delete(trust.peers, "blocked-local")
+		trust.mu.Unlock()
+	})
+	if c, _, err := accept(plain); err == nil && c != nil {
+		t.Error("plaintext allowed from a blocked host")
+	}
+	trust.mu.Lock()
+	delete(trust.peers, "blocked-local")
+	trust.mu.Unlock()
+
+	// Our own policy has to allow it too
+	config.mu.Lock()
+	config.cfg.Encryption = EncryptionConfig{}
+	config.mu.Unlock()
+	if c, _, err := accept(plain); err == nil || c != nil {
+		t.Error("plaintext allowed without a trusted subnet")
+	}
+}
+
+func TestBenchmarkPipe(t *testing.T) {
+	for _, encrypted := range []bool{false, true} {
+		r, err := benchmarkPipe(1<<20, encrypted)
+		if err != nil {
+			t.Fatalf("encrypted=%v: %v", encrypted, err)
+		}
+		if r.Bytes != 1<<20 || r.MBps <= 0 {
+			t.Errorf("encrypted=%v: %+v", encrypted, r)
+		}
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// The receive policy vets every incoming file before it gets its final
+// name. Names and announced sizes are checked as soon as a header arrives,
+// so a refused file is never sent; the content is checked once it is on
+// disk, by sniffing its MIME type and, when a scanner is configured, by
+// running it with the file's path as the last argument. Exit status 0 from
+// the scanner means clean, anything else rejects the file. Rejected files
+// are moved to the quarantine directory, or deleted, and reported with
+// policy_violation.
+const (
+	defaultScannerTimeout = 5 * time.Minute
+	maxScannerOutput      = 4 << 10
+	sniffLen              = 512
+)
+
+// ReceivePolicy is the config section for incoming files
+type ReceivePolicy struct {
+	AllowExtensions  []string `json:"allow_extensions,omitempty"` // only these, e.g. [".jpg", ".tar.gz"]
+	DenyExtensions   []string `json:"deny_extensions,omitempty"`
+	AllowMIME        []string `json:"allow_mime,omitempty"` // sniffed types, "image/*" matches any image
+	DenyMIME         []string `json:"deny_mime,omitempty"`
+	MaxFileBytes     int64    `json:"max_file_bytes,omitempty"`
+	Scanner          []string `json:"scanner,omitempty"` // command and arguments, e.g. ["clamscan", "--no-summary"]
+	ScannerTimeoutMs int      `json:"scanner_timeout_ms,omitempty"`
+	QuarantineDir    string   `json:"quarantine_dir,omitempty"` // default "quarantine" beside the config
+	DeleteRejected   bool     `json:"delete_rejected,omitempty"`
+}
+
+func (p ReceivePolicy) Validate() error {
+	if p.MaxFileBytes < 0 || p.ScannerTimeoutMs < 0 {
+		return catalogError(ErrInvalidArgument, "policy.receive_policy_limits_must")
+	}
+	if len(p.Scanner) > 0 && p.Scanner[0] == "" {
+		return catalogError(ErrInvalidArgument, "policy.receive_policy_scanner_must")
+	}
+	for _, pattern := range append(append([]string{}, p.AllowMIME...), p.DenyMIME...) {
+		if !strings.Contains(pattern, "/") {
+			return catalogError(ErrInvalidArgument, "policy.invalid_mime_pattern", "pattern", fmt.Sprintf("%q", pattern))
+		}
+	}
+	return nil
+}
+
+// Rules in PolicyError and policy_violation
+const (
+	ruleExtension = "extension"
+	ruleMIME      = "mime"
+	ruleSize      = "size"
+	ruleScanner   = "scanner"
+)
+
+// PolicyError refuses a file the receive policy does not allow
+type PolicyError struct {
+	Name   string
+	Rule   string
+	Detail string
+}
+
+func (e *PolicyError) Error() string {
+	return fmt.Sprintf("%s refused by receive policy (%s): %s", e.Name, e.Rule, e.Detail)
+}
+
+// checkName applies the extension lists
+func (p ReceivePolicy) checkName(name string) error {
+	lower := strings.ToLower(name)
+	matches := func(exts []string) bool {
+		for _, ext := range exts {
+			ext = strings.ToLower(ext)
+			if !strings.HasPrefix(ext, ".") {
+				ext = "." + ext
+			}
+			if strings.HasSuffix(lower, ext) {
+				return true
+			}
+		}
+		return false
+	}
+	if matches(p.DenyExtensions) {
+		return &PolicyError{Name: name, Rule: ruleExtension, Detail: "extension is denied"}
+	}
+	if len(p.AllowExtensions) > 0 && !matches(p.AllowExtensions) {
+		return &PolicyError{Name: name, Rule: ruleExtension, Detail: "extension is not allowed"}
+	}
+	return nil
+}
+
+func (p ReceivePolicy) checkSize(name string, size int64) error {
+	if p.MaxFileBytes > 0 && size > p.MaxFileBytes {
+		return &PolicyError{Name: name, Rule: ruleSize, Detail: fmt.Sprintf("%d bytes is over the %d byte limit", size, p.MaxFileBytes)}
+	}
+	return nil
+}
+
+// sizeReader passes a body of unknown size through until it goes over
+// max_file_bytes, then fails with a PolicyError
+type sizeReader struct {
+	r    io.Reader
+	p    ReceivePolicy
+	name string
+	read int64
+}
+
+func (s *sizeReader) Read(b []byte) (int, error) {
+	if s.p.MaxFileBytes > 0 {
+		b = b[:min(int64(len(b)), s.p.MaxFileBytes-s.read+1)]
+	}
+	n, err := s.r.Read(b)
+	s.read += int64(n)
+	if perr := s.p.checkSize(s.name, s.read); perr != nil {
+		return n, perr
+	}
+	return n, err
+}
+
+// checkHeader vets what a plain file header announces
+func checkHeader(h TransferHeader) error {
+	if h.Manifest != nil || h.Archive != "" {
+		return nil // their files are vetted one by one as they land
+	}
+	p := config.Get().ReceivePolicy
+	if err := p.checkName(h.Name); err != nil {
+		return err
+	}
+	return p.checkSize(h.Name, h.Size)
+}
+
+// checkMIME vets the type sniffed from the first sniffLen bytes of a file
+func (p ReceivePolicy) checkMIME(name string, head []byte) error {
+	mime, _, _ := strings.Cut(http.DetectContentType(head), ";")
+	if mimeMatches(p.DenyMIME, mime) {
+		return &PolicyError{Name: name, Rule: ruleMIME, Detail: mime + " is denied"}
+	}
+	if len(p.AllowMIME) > 0 && !mimeMatches(p.AllowMIME, mime) {
+		return &PolicyError{Name: name, Rule: ruleMIME, Detail: mime + " is not allowed"}
+	}
+	return nil
+}
+
+func mimeMatches(patterns []string, mime string) bool {
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if prefix, ok := strings.CutSuffix(pattern, "/*"); ok {
+			if strings.HasPrefix(mime, prefix+"/") {
+				return true
+			}
+		} else if pattern == mime {
+			return true
+		}
+	}
+	return false
+}
+
+// checkContent sniffs and scans the file at path, which will be called name
+func (p ReceivePolicy) checkContent(name, path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if err := p.checkSize(name, info.Size()); err != nil {
+		return err
+	}
+	if len(p.AllowMIME) > 0 || len(p.DenyMIME) > 0 {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		head := make([]byte, sniffLen)
+		n, _ := io.ReadFull(f, head)
+		f.Close()
+		if err := p.checkMIME(name, head[:n]); err != nil {
+			return err
+		}
+	}
+	if len(p.Scanner) > 0 {
+		return p.scan(name, path)
+	}
+	return nil
+}
+
+func (p ReceivePolicy) scan(name, path string) error {
+	timeout := defaultScannerTimeout
+	if p.ScannerTimeoutMs > 0 {
+		timeout = time.Duration(p.ScannerTimeoutMs) * time.Millisecond
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	args := append(append([]string{}, p.Scanner[1:]...), path)
+	cmd := exec.CommandContext(ctx, p.Scanner[0], args...)
+	var out bytes.Buffer
+	cmd.Stdout = &limitedBuffer{&out, maxScannerOutput}
+	cmd.Stderr = cmd.Stdout
+	err := cmd.Run()
+	if err == nil {
+		return nil
+	}
+	detail := strings.TrimSpace(out.String())
+	switch {
+	case ctx.Err() != nil:
+		detail = "scanner timed out after " + timeout.String()
+	case detail == "":
+		detail = err.Error()
+	}
+	// A scanner that cannot run rejects the file too; an unscanned file is
+	// not a clean one
+	return &PolicyError{Name: name, Rule: ruleScanner, Detail: detail}
+}
+
+// limitedBuffer keeps the first n bytes written and drops the rest
+type limitedBuffer struct {
+	b *bytes.Buffer
+	n int
+}
+
+func (l *limitedBuffer) Write(p []byte) (int, error) {
+	if room := l.n - l.b.Len(); room > 0 {
+		l.b.Write(p[:min(len(p), room)])
+	}
+	return len(p), nil
+}
+
+// finalizeReceived gives a received file its final name once the policy
+// lets it through. partial may equal path for files written in place.
+// t may be nil for files unpacked from an archive.
+func finalizeReceived(t *Transfer, partial, path string) error {
+	p := config.Get().ReceivePolicy
+	name := filepath.Base(path)
+	err := p.checkName(name)
+	if err == nil {
+		err = p.checkContent(name, partial)
+	}
+	var pe *PolicyError
+	if !errors.As(err, &pe) {
+		if err != nil {
+			return err
+		}
+		if partial == path {
+			return nil
+		}
+		return os.Rename(partial, path)
+	}
+	quarantined := quarantine(p, partial, name)
+	data := map[string]interface{}{
+		"name":   name,
+		"path":   path,
+		"rule":   pe.Rule,
+		"detail": pe.Detail,
+	}
+	if quarantined != "" {
+		data["quarantined"] = quarantined
+	}
+	if t != nil {
+		data["id"] = t.ID
+		data["peer"] = t.Peer
+	}
+	logger.Warn("receive policy rejected a file", "name", name, "rule", pe.Rule, "detail", pe.Detail, "quarantined", quarantined)
+	emitEvent("policy_violation", data)
+	return err
+}
+
+// reportRefusedHeader tells the frontend about a file refused before it was sent
+func reportRefusedHeader(err error, remote string) {
+	var pe *PolicyError
+	if !errors.As(err, &pe) {
+		return
+	}
+	logger.Warn("receive policy refused a transfer", "name", pe.Name, "rule", pe.Rule, "remote", remote)
+	emitEvent("policy_violation", map[string]interface{}{
+		"name":   pe.Name,
+		"rule":   pe.Rule,
+		"detail": pe.Detail,
+		"peer":   remote,
+	})
+}
+
+func quarantineDir(p ReceivePolicy) string {
+	if p.QuarantineDir != "" {
+		return p.QuarantineDir
+	}
+	return filepath.Join(filepath.Dir(config.Path()), "quarantine")
+}
+
+// quarantine moves a rejected file out of the download directory, or
+// deletes it, and returns where it went
+func quarantine(p ReceivePolicy, file, name string) string {
+	if p.DeleteRejected {
+		os.Remove(file)
+		return ""
+	}
+	dir := quarantineDir(p)
+	target, err := uniquePath(filepath.Join(dir, name))
+	if err == nil {
+		err = os.MkdirAll(dir, 0o700)
+	}
+	if err == nil {
+		if err = os.Rename(file, target); err != nil {
+			// Another file system; copy it over instead
+			err = copyFile(file, target)
+			os.Remove(file)
+		}
+	}
+	if err != nil {
+		logger.Warn("failed to quarantine file, deleting it", "name", name, "error", err)
+		os.Remove(file)
+		return ""
+	}
+	return target
+}
+
+func copyFile(from, to string) error {
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(to)
+	}
+	return err
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReceivePolicyNames(t *testing.T) {
+	p := ReceivePolicy{AllowExtensions: []string{"jpg", ".tar.gz"}, DenyExtensions: []string{".exe"}}
+	for name, ok := range map[string]bool{
+		"photo.JPG":      true,
+		"backup.tar.gz":  true,
+		"backup.gz":      false,
+		"setup.exe":      false,
+		"setup.jpg.exe":  false,
+		"no-extension":   false,
+		"archive.tar.gz": true,
+	} {
+		err := p.checkName(name)
+		var pe *PolicyError
+		if ok != (err == nil) || (err != nil && (!errors.As(err, &pe) || pe.Rule != ruleExtension)) {
+			t.Errorf("checkName(%q) = %v, want allowed %v", name, err, ok)
+		}
+	}
+}
+
+func TestReceivePolicyContent(t *testing.T) {
+	dir := t.TempDir()
+	png := filepath.Join(dir, "picture.txt")
+	os.WriteFile(png, []byte("\x89PNG\r\n\x1a\n0000"), 0o644)
+	text := filepath.Join(dir, "notes.txt")
+	os.WriteFile(text, []byte("just some notes"), 0o644)
+
+	p := ReceivePolicy{DenyMIME: []string{"image/*"}}
+	var pe *PolicyError
+	if err := p.checkContent("picture.txt", png); !errors.As(err, &pe) || pe.Rule != ruleMIME {
+		t.Errorf("png sniffed as allowed: %v", err)
+	}
+	if err := p.checkContent("notes.txt", text); err != nil {
+		t.Errorf("text refused: %v", err)
+	}
+
+	p = ReceivePolicy{AllowMIME: []string{"text/plain"}, MaxFileBytes: 10}
+	if err := p.checkContent("notes.txt", text); !errors.As(err, &pe) || pe.Rule != ruleSize {
+		t.Errorf("oversized file allowed: %v", err)
+	}
+}
@@ -0,0 +1,591 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackpal/gateway"
+)
+
+// Port mappings ask the router to forward an external port to one of our
+// listeners, through NAT-PMP (RFC 6886) or a UPnP Internet Gateway Device.
+// Both hand out leases, so each mapping renews itself at half its lifetime
+// until it is removed.
+const (
+	mapNATPMP = "natpmp"
+	mapUPnP   = "upnp"
+
+	natPMPPort            = 5351
+	ssdpAddr              = "239.255.255.250:1900"
+	defaultMappingTimeout = 3 * time.Second
+	defaultMappingLease   = time.Hour
+)
+
+var errNoGateway = errors.New("no NAT-PMP or UPnP gateway found")
+
+// portMapper is one way of talking to the router
+type portMapper interface {
+	Method() string
+	Gateway() string
+	ExternalIP() (net.IP, error)
+	// Map returns the external port and lease the router granted, which
+	// may differ from what was asked for
+	Map(protocol string, internal, external int, lease time.Duration, description string) (int, time.Duration, error)
+	Unmap(protocol string, internal, external int) error
+}
+
+// natPMP talks NAT-PMP to the default gateway
+type natPMP struct {
+	gateway net.IP
+	timeout time.Duration
+}
+
+func newNATPMP(timeout time.Duration) (*natPMP, error) {
+	gw, err := gateway.DiscoverGateway()
+	if err != nil {
+		return nil, fmt.Errorf("find default gateway: %w", err)
+	}
+	return &natPMP{gateway: gw, timeout: timeout}, nil
+}
+
+func (n *natPMP) Method() string  { return mapNATPMP }
+func (n *natPMP) Gateway() string { return n.gateway.String() }
+
+// call sends request and retransmits with doubling delays, as RFC 6886
+// asks, until the matching response arrives or the timeout passes
+func (n *natPMP) call(request []byte, size int) ([]byte, error) {
+	conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: n.gateway, Port: natPMPPort})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(n.timeout)
+	response := make([]byte, 16)
+	for wait := 250 * time.Millisecond; time.Now().Before(deadline); wait *= 2 {
+		if _, err := conn.Write(request); err != nil {
+			return nil, err
+		}
+		next := time.Now().Add(wait)
+		if next.After(deadline) {
+			next = deadline
+		}
+		conn.SetReadDeadline(next)
+		got, err := conn.Read(response)
+		if err != nil {
+			if isTimeout(err) {
+				continue
+			}
+			return nil, err
+		}
+		if got < size || response[0] != 0 || response[1] != request[1]|0x80 {
+			continue
+		}
+		if code := binary.BigEndian.Uint16(response[2:4]); code != 0 {
+			return nil, catalogError(ErrFailed, "portmap.nat_pmp_request_refused", "code", code)
+		}
+		return response[:got], nil
+	}
+	return nil, fmt.Errorf("no NAT-PMP response from %s", n.gateway)
+}
+
+func (n *natPMP) ExternalIP() (net.IP, error) {
+	response, err := n.call([]byte{0, 0}, 12)
+	if err != nil {
+		return nil, err
+	}
+	return net.IP(response[8:12]), nil
+}
+
+func (n *natPMP) Map(protocol string, internal, external int, lease time.Duration, _ string) (int, time.Duration, error) {
+	op := byte(2)
+	if protocol == "udp" {
+		op = 1
+	}
+	request := make([]byte, 12)
+	request[1] = op
+	binary.BigEndian.PutUint16(request[4:6], uint16(internal))
+	binary.BigEndian.PutUint16(request[6:8], uint16(external))
+	binary.BigEndian.PutUint32(request[8:12], uint32(lease/time.Second))
+	response, err := n.call(request, 16)
+	if err != nil {
+		return 0, 0, err
+	}
+	mapped := int(binary.BigEndian.Uint16(response[10:12]))
+	granted := time.Duration(binary.BigEndian.Uint32(response[12:16])) * time.Second
+	return mapped, granted, nil
+}
+
+func (n *natPMP) Unmap(protocol string, internal, _ int) error {
+	_, _, err := n.Map(protocol, internal, 0, 0, "")
+	return err
+}
+
+// upnpIGD talks to the WAN connection service of a UPnP gateway
+type upnpIGD struct {
+	controlURL  string
+	serviceType string
+	host        string
+	localIP     net.IP
+	timeout     time.Duration
+}
+
+// upnpDevice is the part of an IGD device description we search
+type upnpDevice struct {
+	Services []struct {
+		ServiceType string `xml:"serviceType"`
+		ControlURL  string `xml:"controlURL"`
+	} `xml:"serviceList>service"`
+	Devices []upnpDevice `xml:"deviceList>device"`
+}
+
+func (d *upnpDevice) wanService() (string, string, bool) {
+	for _, s := range d.Services {
+		if strings.Contains(s.ServiceType, ":WANIPConnection:") || strings.Contains(s.ServiceType, ":WANPPPConnection:") {
+			return s.ServiceType, s.ControlURL, true
+		}
+	}
+	for i := range d.Devices {
+		if typ, control, ok := d.Devices[i].wanService(); ok {
+			return typ, control, ok
+		}
+	}
+	return "", "", false
+}
+
+// discoverIGD finds a gateway with SSDP and reads its device description
+func discoverIGD(timeout time.Duration) (*upnpIGD, error) {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	dst, _ := net.ResolveUDPAddr("udp4", ssdpAddr)
+	search := "M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: " + ssdpAddr + "\r\n" +
+		"ST: urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"MX: 2\r\n\r\n"
+	if _, err := conn.WriteTo([]byte(search), dst); err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(timeout)
+	conn.SetReadDeadline(deadline)
+	buf := make([]byte, 2048)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return nil, errors.New("no UPnP gateway answered")
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+		if err != nil {
+			continue
+		}
+		location := resp.Header.Get("Location")
+		if location == "" {
+			continue
+		}
+		if igd, err := describeIGD(location, time.Until(deadline)); err == nil {
+			igd.timeout = timeout
+			return igd, nil
+		}
+	}
+}
+
+func describeIGD(location string, timeout time.Duration) (*upnpIGD, error) {
+	base, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	client := http.Client{Timeout: timeout}
+	resp, err := client.Get(location)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var root struct {
+		URLBase string     `xml:"URLBase"`
+		Device  upnpDevice `xml:"device"`
+	}
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&root); err != nil {
+		return nil, err
+	}
+	serviceType, control, ok := root.Device.wanService()
+	if !ok {
+		return nil, errors.New("gateway has no WAN connection service")
+	}
+	if root.URLBase != "" {
+		if b, err := url.Parse(root.URLBase); err == nil {
+			base = b
+		}
+	}
+	ref, err := url.Parse(control)
+	if err != nil {
+		return nil, err
+	}
+	controlURL := base.ResolveReference(ref)
+
+	// The internal client is whichever local address routes to the gateway
+	probe, err := net.Dial("udp4", controlURL.Host)
+	if err != nil {
+		host := controlURL.Hostname()
+		probe, err = net.Dial("udp4", net.JoinHostPort(host, "80"))
+		if err != nil {
+			return nil, err
+		}
+	}
+	localIP := probe.LocalAddr().(*net.UDPAddr).IP
+	probe.Close()
+
+	return &upnpIGD{
+		controlURL:  controlURL.String(),
+		serviceType: serviceType,
+		host:        controlURL.Hostname(),
+		localIP:     localIP,
+		timeout:     timeout,
+	}, nil
+}
+
+func (u *upnpIGD) Method() string  { return mapUPnP }
+func (u *upnpIGD) Gateway() string { return u.host }
+
+// soap invokes action on the WAN service and returns the response body
+func (u *upnpIGD) soap(action string, args [][2]string) ([]byte, error) {
+	var body strings.Builder
+	body.WriteString(`<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" ` +
+		`s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`)
+	fmt.Fprintf(&body, `<u:%s xmlns:u="%s">`, action, u.serviceType)
+	for _, arg := range args {
+		fmt.Fprintf(&body, "<%s>", arg[0])
+		xml.EscapeText(&body, []byte(arg[1]))
+		fmt.Fprintf(&body, "</%s>", arg[0])
+	}
+	fmt.Fprintf(&body, `</u:%s></s:Body></s:Envelope>`, action)
+
+	req, err := http.NewRequest(http.MethodPost, u.controlURL, strings.NewReader(body.String()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", fmt.Sprintf(`"%s#%s"`, u.serviceType, action))
+	client := http.Client{Timeout: u.timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var fault struct {
+			Code        string `xml:"Body>Fault>detail>UPnPError>errorCode"`
+			Description string `xml:"Body>Fault>detail>UPnPError>errorDescription"`
+		}
+		xml.Unmarshal(data, &fault)
+		if fault.Code != "" {
+			return nil, fmt.Errorf("%s refused: %s %s", action, fault.Code, fault.Description)
+		}
+		return nil, fmt.Errorf("%s refused: %s", action, resp.Status)
+	}
+	return data, nil
+}
+
+func (u *upnpIGD) ExternalIP() (net.IP, error) {
+	data, err := u.soap("GetExternalIPAddress", nil)
+	if err != nil {
+		return nil, err
+	}
+	var resp struct {
+		IP string `xml:"Body>GetExternalIPAddressResponse>NewExternalIPAddress"`
+	}
+	if err := xml.Unmarshal(data, &resp); err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(resp.IP)
+	if ip == nil {
+		return nil, errors.New("gateway returned no external address")
+	}
+	return ip, nil
+}
+
+func (u *upnpIGD) Map(protocol string, internal, external int, lease time.Duration, description string) (int, time.Duration, error) {
+	if external == 0 {
+		external = internal
+	}
+	_, err := u.soap("AddPortMapping", [][2]string{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", strconv.Itoa(external)},
+		{"NewProtocol", strings.ToUpper(protocol)},
+		{"NewInternalPort", strconv.Itoa(internal)},
+		{"NewInternalClient", u.localIP.String()},
+		{"NewEnabled", "1"},
+		{"NewPortMappingDescription", description},
+		{"NewLeaseDuration", strconv.Itoa(int(lease / time.Second))},
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return external, lease, nil
+}
+
+func (u *upnpIGD) Unmap(protocol string, _, external int) error {
+	_, err := u.soap("DeletePortMapping", [][2]string{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", strconv.Itoa(external)},
+		{"NewProtocol", strings.ToUpper(protocol)},
+	})
+	return err
+}
+
+// findMapper returns a mapper for method, trying NAT-PMP and then UPnP
+// for "auto"
+func findMapper(method string, timeout time.Duration) (portMapper, error) {
+	var errs []string
+	if method == "" || method == "auto" || method == mapNATPMP {
+		n, err := newNATPMP(timeout)
+		if err == nil {
+			// Asking for the external address is how NAT-PMP is detected
+			if _, err = n.ExternalIP(); err == nil {
+				return n, nil
+			}
+		}
+		errs = append(errs, err.Error())
+	}
+	if method == "" || method == "auto" || method == mapUPnP {
+		u, err := discoverIGD(timeout)
+		if err == nil {
+			return u, nil
+		}
+		errs = append(errs, err.Error())
+	}
+	return nil, fmt.Errorf("%w: %s", errNoGateway, strings.Join(errs, "; "))
+}
+
+// PortMapping is a forwarded port held on the router
+type PortMapping struct {
+	ID           string    `json:"id"`
+	Method       string    `json:"method"`
+	Gateway      string    `json:"gateway"`
+	Protocol     string    `json:"protocol"`
+	InternalPort int       `json:"internal_port"`
+	ExternalPort int       `json:"external_port"`
+	ExternalIP   string    `json:"external_ip"`
+	Description  string    `json:"description"`
+	Lease        float64   `json:"lease_seconds"`
+	Created      time.Time `json:"created"`
+	Renewed      time.Time `json:"renewed"`
+
+	mapper portMapper
+	stop   chan struct{}
+}
+
+var (
+	mappingSeq atomic.Uint64
+	mappingsMu sync.Mutex
+	mappings   = make(map[string]*PortMapping)
+)
+
+// renew refreshes the lease at half its length until the mapping is removed
+func (m *PortMapping) renew(lease time.Duration) {
+	for {
+		mappingsMu.Lock()
+		granted := time.Duration(m.Lease * float64(time.Second))
+		mappingsMu.Unlock()
+		if granted <= 0 {
+			return // permanent
+		}
+		select {
+		case <-m.stop:
+			return
+		case <-time.After(granted / 2):
+		}
+
+		_, got, err := m.mapper.Map(m.Protocol, m.InternalPort, m.ExternalPort, lease, m.Description)
+		if err != nil {
+			logger.Warn("port mapping renewal failed", "id", m.ID, "error", err)
+			mappingsMu.Lock()
+			delete(mappings, m.ID)
+			mappingsMu.Unlock()
+			emitEvent("port_mapping_lost", map[string]interface{}{"id": m.ID, "error": err.Error()})
+			return
+		}
+		mappingsMu.Lock()
+		m.Lease, m.Renewed = got.Seconds(), time.Now()
+		mappingsMu.Unlock()
+		logger.Debug("port mapping renewed", "id", m.ID, "lease", got)
+	}
+}
+
+type AddPortMappingPayload struct {
+	Port         int    `json:"port"`          // local port, usually a started server's
+	ExternalPort int    `json:"external_port"` // requested external port, 0 to match port
+	Protocol     string `json:"protocol"`      // "tcp" (default), "udp"
+	Method       string `json:"method"`        // "auto" (default), "natpmp", "upnp"
+	LeaseSeconds int    `json:"lease_seconds"`
+	Description  string `json:"description"`
+	TimeoutMs    int    `json:"timeout_ms"`
+}
+
+func handleAddPortMapping(payload json.RawMessage, writer *Output) {
+	var p AddPortMappingPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		sendInvalidPayload(writer, "add_port_mapping")
+		return
+	}
+	if p.Port <= 0 || p.Port > 65535 || p.ExternalPort < 0 || p.ExternalPort > 65535 {
+		sendErrorCode(writer, ErrInvalidArgument, message("portmap.add_port_mapping_requires"), nil)
+		return
+	}
+	if p.Protocol == "" {
+		p.Protocol = "tcp"
+	}
+	if p.Protocol != "tcp" && p.Protocol != "udp" {
+		sendErrorCode(writer, ErrUnsupported, message("common.unsupported_protocol", "protocol", p.Protocol), nil)
+		return
+	}
+	switch p.Method {
+	case "", "auto", mapNATPMP, mapUPnP:
+	default:
+		sendErrorCode(writer, ErrUnsupported, message("portmap.unsupported_mapping_method", "method", p.Method), nil)
+		return
+	}
+	if p.ExternalPort == 0 {
+		p.ExternalPort = p.Port
+	}
+	if p.Description == "" {
+		p.Description = "Lumina " + strconv.Itoa(p.Port)
+	}
+	lease := defaultMappingLease
+	if p.LeaseSeconds > 0 {
+		lease = time.Duration(p.LeaseSeconds) * time.Second
+	}
+	timeout := defaultMappingTimeout
+	if p.TimeoutMs > 0 {
+		timeout = time.Duration(p.TimeoutMs) * time.Millisecond
+	}
+
+	mapper, err := findMapper(p.Method, timeout)
+	if err != nil {
+		sendError(writer, message("portmap.port_mapping_unavailable", "error", err))
+		return
+	}
+	external, granted, err := mapper.Map(p.Protocol, p.Port, p.ExternalPort, lease, p.Description)
+	if err != nil {
+		sendError(writer, message("portmap.failed_map_port", "port", p.Port, "error", err))
+		return
+	}
+	var externalIP string
+	if ip, err := mapper.ExternalIP(); err == nil {
+		externalIP = ip.String()
+	}
+
+	m := &PortMapping{
+		ID:           fmt.Sprintf("map-%d", mappingSeq.Add(1)),
+		Method:       mapper.Method(),
+		Gateway:      mapper.Gateway(),
+		Protocol:     p.Protocol,
+		InternalPort: p.Port,
+		ExternalPort: external,
+		ExternalIP:   externalIP,
+		Description:  p.Description,
+		Lease:        granted.Seconds(),
+		Created:      time.Now(),
+		Renewed:      time.Now(),
+		mapper:       mapper,
+		stop:         make(chan struct{}),
+	}
+	mapped := *m
+	mappingsMu.Lock()
+	mappings[m.ID] = m
+	mappingsMu.Unlock()
+	go m.renew(lease)
+	logger.Info("port mapped", "id", m.ID, "method", m.Method, "internal", p.Port, "external", external, "ip", externalIP)
+
+	writer.Encode(okResponse(message("portmap.port_mapped", "port", p.Port, "join_host_port", net.JoinHostPort(externalIP, strconv.Itoa(external))),
+		mapped))
+}
+
+func handleListPortMappings(writer *Output) {
+	mappingsMu.Lock()
+	list := make([]PortMapping, 0, len(mappings))
+	for _, m := range mappings {
+		list = append(list, *m)
+	}
+	mappingsMu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+
+	writer.Encode(ProtocolResponse{
+		Status: "ok",
+		Data:   map[string]interface{}{"mappings": list},
+	})
+}
+
+type RemovePortMappingPayload struct {
+	ID string `json:"id"`
+}
+
+func handleRemovePortMapping(payload json.RawMessage, writer *Output) {
+	var p RemovePortMappingPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		sendInvalidPayload(writer, "remove_port_mapping")
+		return
+	}
+	mappingsMu.Lock()
+	m, exists := mappings[p.ID]
+	delete(mappings, p.ID)
+	mappingsMu.Unlock()
+	if !exists {
+		sendErrorCode(writer, ErrNotFound, message("portmap.port_mapping_not_found"), nil)
+		return
+	}
+
+	close(m.stop)
+	if err := m.mapper.Unmap(m.Protocol, m.InternalPort, m.ExternalPort); err != nil {
+		sendError(writer, message("portmap.failed_remove_mapping", "gateway", m.Gateway, "error", err))
+		return
+	}
+	logger.Info("port mapping removed", "id", m.ID)
+	writer.Encode(okResponse(message("portmap.port_mapping_removed"), nil))
+}
+
+// releasePortMappings deletes every mapping on the router; shutdown uses it
+// so nothing stays forwarded to a process that is gone
+func releasePortMappings() {
+	mappingsMu.Lock()
+	list := make([]*PortMapping, 0, len(mappings))
+	for id, m := range mappings {
+		list = append(list, m)
+		delete(mappings, id)
+	}
+	mappingsMu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, m := range list {
+		close(m.stop)
+		wg.Add(1)
+		go func(m *PortMapping) {
+			defer wg.Done()
+			m.mapper.Unmap(m.Protocol, m.InternalPort, m.ExternalPort)
+		}(m)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Port owners: a bind that fails because the port is taken says which
+// program has it, so the app can show "Port 8080 is used by Docker" rather
+// than the OS error, and who_uses_port asks the same of any port. Linux
+// answers from /proc, macOS from lsof and Windows from netstat and
+// tasklist. Without root, Linux and macOS only name processes of the same
+// user; a port held by another user's process still shows that user.
+const (
+	portOwnerTimeout = 5 * time.Second
+	maxOwnerCommand  = 256
+)
+
+// runPortOwnerCommand runs one lookup tool and returns what it printed
+var runPortOwnerCommand = func(ctx context.Context, argv ...string) (string, error) {
+	out, err := exec.CommandContext(ctx, argv[0], argv[1:]...).Output()
+	return string(out), err
+}
+
+// PortOwner is a process holding a port
+type PortOwner struct {
+	PID     int    `json:"pid,omitempty"` // 0 when the OS would not say
+	Name    string `json:"name,omitempty"`
+	App     string `json:"app"` // the program as users know it, e.g. "Docker"
+	Command string `json:"command,omitempty"`
+	User    string `json:"user,omitempty"`
+	Addr    string `json:"addr,omitempty"` // local address it is bound to
+	Self    bool   `json:"self,omitempty"` // this sidecar
+}
+
+// portApps names well-known programs by the start of their process name
+var portApps = []struct{ prefix, app string }{
+	{"com.docker", "Docker"},
+	{"docker", "Docker"},
+	{"vpnkit", "Docker"},
+	{"wslrelay", "WSL"},
+	{"nginx", "nginx"},
+	{"httpd", "Apache"},
+	{"apache", "Apache"},
+	{"caddy", "Caddy"},
+	{"postgres", "PostgreSQL"},
+	{"mysqld", "MySQL"},
+	{"mariadb", "MariaDB"},
+	{"redis-server", "Redis"},
+	{"mongod", "MongoDB"},
+	{"controlce", "AirPlay Receiver"}, // macOS ControlCenter takes 5000 and 7000
+	{"airplay", "AirPlay Receiver"},
+	{"node", "Node.js"},
+	{"java", "Java"},
+	{"python", "Python"},
+	{"skype", "Skype"},
+	{"steam", "Steam"},
+	{"svchost", "a Windows service"},
+}
+
+// portAppNames names programs whose whole process name is too common a
+// prefix, such as Windows' System beside Linux's systemd-resolved
+var portAppNames = map[string]string{
+	"system": "Windows",
+}
+
+// appName is how users know the program behind a process name
+func appName(name string) string {
+	lower := strings.ToLower(strings.TrimSuffix(name, ".exe"))
+	if app, ok := portAppNames[lower]; ok {
+		return app
+	}
+	for _, a := range portApps {
+		if strings.HasPrefix(lower, a.prefix) {
+			return a.app
+		}
+	}
+	return name
+}
+
+// portOwners finds the processes listening on port; network is "tcp" or
+// "udp". It is errors.ErrUnsupported where the OS offers no way to ask.
+func portOwners(network string, port int) ([]PortOwner, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), portOwnerTimeout)
+	defer cancel()
+	var owners []PortOwner
+	var err error
+	switch runtime.GOOS {
+	case "linux", "android":
+		owners, err = procPortOwners(network, port)
+	case "darwin", "freebsd":
+		var out string
+		out, err = runPortOwnerCommand(ctx, lsofArgs(network, port)...)
+		if err != nil && out == "" {
+			// lsof exits 1 when nothing matches
+			var exit *exec.ExitError
+			if errors.As(err, &exit) {
+				err = nil
+			}
+		}
+		owners = parseLsof(out)
+	case "windows":
+		var out string
+		if out, err = runPortOwnerCommand(ctx, "netstat", "-ano", "-p", strings.ToUpper(network)); err == nil {
+			owners = parseNetstat(out, network, port)
+		}
+		if len(owners) > 0 {
+			if out, err := runPortOwnerCommand(ctx, "tasklist", "/FO", "CSV", "/NH"); err == nil {
+				names := parseTasklist(out)
+				for i := range owners {
+					owners[i].Name = names[owners[i].PID]
+				}
+			}
+		}
+	default:
+		return nil, errors.ErrUnsupported
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i := range owners {
+		o := &owners[i]
+		o.Self = o.PID == os.Getpid()
+		switch {
+		case o.Self:
+			o.App = "Lumina"
+		case o.Name != "":
+			o.App = appName(o.Name)
+		case o.User != "":
+			o.App = "a process of user " + o.User
+		default:
+			o.App = "another program"
+		}
+	}
+	return owners, nil
+}
+
+// describeOwners is a phrase like "Docker" or "nginx and Node.js"
+func describeOwners(owners []PortOwner) string {
+	var apps []string
+	for _, o := range owners {
+		if !slices.Contains(apps, o.App) {
+			apps = append(apps, o.App)
+		}
+	}
+	if len(apps) > 1 {
+		return strings.Join(apps[:len(apps)-1], ", ") + " and " + apps[len(apps)-1]
+	}
+	return strings.Join(apps, "")
+}
+
+func lsofArgs(network string, port int) []string {
+	if network == "udp" {
+		return []string{"lsof", "-nP", "-iUDP:" + strconv.Itoa(port), "-F", "pcLn"}
+	}
+	return []string{"lsof", "-nP", "-iTCP:" + strconv.Itoa(port), "-sTCP:LISTEN", "-F", "pcLn"}
+}
+
+// parseLsof reads lsof -F pcLn output: a p line starts each process and
+// c, L and n lines describe it and its sockets
+func parseLsof(out string) []PortOwner {
+	var owners []PortOwner
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if line == "" {
+			continue
+		}
+		value := line[1:]
+		switch line[0] {
+		case 'p':
+			pid, _ := strconv.Atoi(value)
+			owners = append(owners, PortOwner{PID: pid})
+		case 'c':
+			if len(owners) > 0 {
+				owners[len(owners)-1].Name = value
+			}
+		case 'L':
+			if len(owners) > 0 {
+				owners[len(owners)-1].User = value
+			}
+		case 'n':
+			if len(owners) > 0 && owners[len(owners)-1].Addr == "" {
+				owners[len(owners)-1].Addr = value
+			}
+		}
+	}
+	return owners
+}
+
+// parseNetstat reads netstat -ano for sockets on port: listening TCP ones,
+// or every UDP one, which has no state
+func parseNetstat(out, network string, port int) []PortOwner {
+	suffix := ":" + strconv.Itoa(port)
+	seen := map[int]bool{}
+	var owners []PortOwner
+	for _, line := range strings.Split(out, "\n") {
+		f := strings.Fields(line)
+		if len(f) < 4 || !strings.EqualFold(f[0], network) || !strings.HasSuffix(f[1], suffix) {
+			continue
+		}
+		if network == "tcp" && (len(f) < 5 || f[3] != "LISTENING") {
+			continue
+		}
+		pid, err := strconv.Atoi(f[len(f)-1])
+		if err != nil || seen[pid] {
+			continue
+		}
+		seen[pid] = true
+		owners = append(owners, PortOwner{PID: pid, Addr: f[1]})
+	}
+	return owners
+}
+
+// parseTasklist maps PIDs to image names from tasklist /FO CSV /NH
+func parseTasklist(out string) map[int]string {
+	names := map[int]string{}
+	r := csv.NewReader(strings.NewReader(out))
+	r.FieldsPerRecord = -1
+	for {
+		rec, err := r.Read()
+		if err != nil {
+			break
+		}
+		if len(rec) < 2 {
+			continue
+		}
+		if pid, err := strconv.Atoi(rec[1]); err == nil {
+			names[pid] = rec[0]
+		}
+	}
+	return names
+}
+
+// procSocket is a socket from /proc/net
+type procSocket struct {
+	addr  string
+	uid   string
+	inode string
+}
+
+// parseProcNet reads /proc/net/tcp and the like for sockets on port: those
+// listening for tcp, any bound one for udp
+func parseProcNet(data, network string, port int) []procSocket {
+	var sockets []procSocket
+	sc := bufio.NewScanner(strings.NewReader(data))
+	sc.Scan() // header
+	for sc.Scan() {
+		f := strings.Fields(sc.Text())
+		if len(f) < 10 {
+			continue
+		}
+		ip, p, ok := strings.Cut(f[1], ":")
+		if !ok {
+			continue
+		}
+		if n, err := strconv.ParseUint(p, 16, 16); err != nil || int(n) != port {
+			continue
+		}
+		if network == "tcp" && f[3] != "0A" { // TCP_LISTEN
+			continue
+		}
+		sockets = append(sockets, procSocket{addr: net.JoinHostPort(procIP(ip), strconv.Itoa(port)), uid: f[7], inode: f[9]})
+	}
+	return sockets
+}
+
+// procIP decodes a /proc/net address, stored as host-order 32-bit words
+func procIP(hex string) string {
+	var b []byte
+	for i := 0; i+8 <= len(hex); i += 8 {
+		w, err := strconv.ParseUint(hex[i:i+8], 16, 32)
+		if err != nil {
+			return hex
+		}
+		b = append(b, byte(w), byte(w>>8), byte(w>>16), byte(w>>24))
+	}
+	return net.IP(b).String()
+}
+
+func procPortOwners(network string, port int) ([]PortOwner, error) {
+	var sockets []procSocket
+	found := false
+	for _, file := range []string{network, network + "6"} {
+		data, err := os.ReadFile(filepath.Join("/proc/net", file))
+		if err != nil {
+			continue
+		}
+		found = true
+		sockets = append(sockets, parseProcNet(string(data), network, port)...)
+	}
+	if !found {
+		return nil, errors.ErrUnsupported
+	}
+	if len(sockets) == 0 {
+		return nil, nil
+	}
+	byInode := make(map[string]procSocket, len(sockets))
+	for _, s := range sockets {
+		byInode["socket:["+s.inode+"]"] = s
+	}
+
+	var owners []PortOwner
+	named := map[string]bool{}
+	procs, _ := filepath.Glob("/proc/[0-9]*")
+	for _, dir := range procs {
+		fds, err := os.ReadDir(filepath.Join(dir, "fd"))
+		if err != nil {
+			continue // another user's process
+		}
+		for _, fd := range fds {
+			link, err := os.Readlink(filepath.Join(dir, "fd", fd.Name()))
+			s, ok := byInode[link]
+			if err != nil || !ok {
+				continue
+			}
+			pid, _ := strconv.Atoi(filepath.Base(dir))
+			comm, _ := os.ReadFile(filepath.Join(dir, "comm"))
+			cmdline, _ := os.ReadFile(filepath.Join(dir, "cmdline"))
+			command := strings.TrimSpace(strings.ReplaceAll(string(cmdline), "\x00", " "))
+			if len(command) > maxOwnerCommand {
+				command = command[:maxOwnerCommand]
+			}
+			owners = append(owners, PortOwner{PID: pid, Name: strings.TrimSpace(string(comm)), Command: command, Addr: s.addr, User: userName(s.uid)})
+			named[s.inode] = true
+			break
+		}
+	}
+	// Sockets of processes we may not look into still tell their user
+	for _, s := range sockets {
+		if !named[s.inode] {
+			owners = append(owners, PortOwner{Addr: s.addr, User: userName(s.uid)})
+			named[s.inode] = true
+		}
+	}
+	return owners, nil
+}
+
+func userName(uid string) string {
+	if u, err := user.LookupId(uid); err == nil {
+		return u.Username
+	}
+	return uid
+}
+
+// bindNetwork is "tcp" or "udp" for the network a failed bind was on
+func bindNetwork(err error) string {
+	var op *net.OpError
+	if errors.As(err, &op) && strings.HasPrefix(op.Net, "udp") {
+		return "udp"
+	}
+	return "tcp"
+}
+
+type WhoUsesPortPayload struct {
+	Port    int    `json:"port"`
+	Network string `json:"network"` // "tcp" (default) or "udp"
+}
+
+func handleWhoUsesPort(payload json.RawMessage, writer *Output) {
+	var p WhoUsesPortPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		sendInvalidPayload(writer, "who_uses_port")
+		return
+	}
+	if p.Port <= 0 || p.Port > 65535 {
+		sendErrorCode(writer, ErrInvalidArgument, message("portowner.who_uses_port_requires"), nil)
+		return
+	}
+	switch p.Network {
+	case "":
+		p.Network = "tcp"
+	case "tcp", "udp":
+	default:
+		sendErrorCode(writer, ErrUnsupported, message("common.unsupported_network", "network", p.Network), nil)
+		return
+	}
+	owners, err := portOwners(p.Network, p.Port)
+	if errors.Is(err, errors.ErrUnsupported) {
+		sendErrorCode(writer, ErrUnsupported, message("portowner.finding_port_owners_not", "os", runtime.GOOS),
+			map[string]interface{}{"os": runtime.GOOS})
+		return
+	}
+	if err != nil {
+		sendError(writer, message("portowner.failed_find_port_owners", "error", err))
+		return
+	}
+	sort.Slice(owners, func(i, j int) bool { return owners[i].PID < owners[j].PID })
+	if owners == nil {
+		owners = []PortOwner{}
+	}
+	m := message("portowner.nothing_listening_port", "port", p.Port)
+	if len(owners) > 0 {
+		m = message("portowner.port_used_by", "port", p.Port, "app", describeOwners(owners))
+	}
+	writer.Encode(okResponse(m, map[string]interface{}{"port": p.Port, "network": p.Network, "owners": owners}))
+}
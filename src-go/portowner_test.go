@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net"
+	"runtime"
+	"testing"
+)
+
+func TestParsePortOwnerOutput(t *testing.T) {
+	procNet := `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 0100007F:1F90 00000000:0000 0A 00000000:00000000 00:00000000 00000000  1000        0 4242 1 0000000000000000 100 0 0 10 0
+   1: 0100007F:1F90 0100007F:D431 01 00000000:00000000 00:00000000 00000000  1000        0 4343 1 0000000000000000 20 4 30 10 -1
+`
+	sockets := parseProcNet(procNet, "tcp", 8080)
+	if len(sockets) != 1 || sockets[0].inode != "4242" || sockets[0].addr != "127.0.0.1:8080" {
+		t.Errorf("proc sockets %+v", sockets)
+	}
+
+	owners := parseLsof("p312\ncnginx\nLwww\nn*:8080\np313\ncnginx\nn*:8080\n")
+	if len(owners) != 2 || owners[0].PID != 312 || owners[0].Name != "nginx" || owners[0].User != "www" || owners[0].Addr != "*:8080" {
+		t.Errorf("lsof owners %+v", owners)
+	}
+
+	netstat := `
+  Proto  Local Address          Foreign Address        State           PID
+  TCP    0.0.0.0:8080           0.0.0.0:0              LISTENING       4120
+  TCP    127.0.0.1:8080         127.0.0.1:50000        ESTABLISHED     4120
+  TCP    0.0.0.0:18080          0.0.0.0:0              LISTENING       77
+`
+	owners = parseNetstat(netstat, "tcp", 8080)
+	if len(owners) != 1 || owners[0].PID != 4120 {
+		t.Errorf("netstat owners %+v", owners)
+	}
+	names := parseTasklist(`"com.docker.backend.exe","4120","Console","1","52,112 K"` + "\r\n")
+	if names[4120] != "com.docker.backend.exe" || appName(names[4120]) != "Docker" {
+		t.Errorf("tasklist names %v", names)
+	}
+	for name, app := range map[string]string{"System": "Windows", "systemd-resolved": "systemd-resolved"} {
+		if got := appName(name); got != app {
+			t.Errorf("%s is %q", name, got)
+		}
+	}
+	if got := describeOwners([]PortOwner{{App: "nginx"}, {App: "nginx"}, {App: "Node.js"}}); got != "nginx and Node.js" {
+		t.Errorf("describe %q", got)
+	}
+}
+
+func TestPortOwnersFindsSelf(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("reads /proc")
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	owners, err := portOwners("tcp", ln.Addr().(*net.TCPAddr).Port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(owners) != 1 || !owners[0].Self || owners[0].App != "Lumina" {
+		t.Errorf("owners %+v", owners)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+)
+
+type CheckPortPayload struct {
+	Host    string `json:"host"`    // bind address, empty for all interfaces
+	Port    int    `json:"port"`    // 0 asks for a free port
+	Network string `json:"network"` // "tcp" (default), "udp"
+}
+
+// handleCheckPort reports whether a port can be bound by briefly binding it.
+// With port 0 it returns a port that was free at the time of the check.
+func handleCheckPort(payload json.RawMessage, writer *Output) {
+	var p CheckPortPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		sendInvalidPayload(writer, "check_port")
+		return
+	}
+	if p.Port < 0 || p.Port > 65535 {
+		sendErrorCode(writer, ErrInvalidArgument, message("ports.port_must_between_0"), nil)
+		return
+	}
+	if p.Network == "" {
+		p.Network = "tcp"
+	}
+
+	addr := listenAddr(p.Host, p.Port)
+	data := map[string]interface{}{"host": p.Host, "port": p.Port, "network": p.Network}
+
+	state.Mutex.Lock()
+	ours := false
+	for _, l := range listenersAtLocked(addr) {
+		if socketNetwork(l.Transport) == p.Network {
+			ours = true
+			data["listener_id"] = l.ID
+		}
+	}
+	state.Mutex.Unlock()
+	data["lumina_listener"] = ours
+
+	var bound net.Addr
+	var err error
+	switch p.Network {
+	case "tcp":
+		var ln net.Listener
+		if ln, err = net.Listen("tcp", addr); err == nil {
+			bound = ln.Addr()
+			ln.Close()
+		}
+	case "udp":
+		var pc net.PacketConn
+		if pc, err = net.ListenPacket("udp", addr); err == nil {
+			bound = pc.LocalAddr()
+			pc.Close()
+		}
+	default:
+		sendErrorCode(writer, ErrUnsupported, message("common.unsupported_network", "network", p.Network), nil)
+		return
+	}
+
+	data["available"] = err == nil
+	if err != nil {
+		data["reason"] = err.Error()
+		if isAddrInUse(err) && p.Port > 0 {
+			if owners, err := portOwners(p.Network, p.Port); err == nil && len(owners) > 0 {
+				data["owners"] = owners
+			}
+		}
+	} else if p.Port == 0 {
+		switch a := bound.(type) {
+		case *net.TCPAddr:
+			data["port"] = a.Port
+		case *net.UDPAddr:
+			data["port"] = a.Port
+		}
+	}
+
+	writer.Encode(ProtocolResponse{Status: "ok", Data: data})
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Background pause: a laptop on battery saver, or a frontend the user has
+// sent to the background, should not keep the radio busy. pause_background
+// holds everything the node does on its own: discovery browsing (the mDNS
+// chatter), keepalives on connections and mux links, and folder sync
+// pushes, which are deferred until resume_background. Transfers and
+// anything else the user asked for keep going, and the node still answers
+// peers, including their discovery queries. Each pause names a reason, such
+// as "battery_saver" or "background"; the node stays paused until every
+// reason is resumed, so the two can come and go independently.
+type powerState struct {
+	mu      sync.Mutex
+	reasons map[string]time.Time // reason -> when it paused
+	resumed chan struct{}        // closed when the last reason goes
+}
+
+var power = powerState{reasons: make(map[string]time.Time)}
+
+// paused reports whether background activity is on hold
+func (p *powerState) paused() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.reasons) > 0
+}
+
+// wait blocks while background activity is on hold. It is false when ctx
+// ends first.
+func (p *powerState) wait(ctx context.Context) bool {
+	p.mu.Lock()
+	resumed := p.resumed
+	p.mu.Unlock()
+	if resumed == nil {
+		return ctx.Err() == nil
+	}
+	select {
+	case <-resumed:
+		return ctx.Err() == nil
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// resumedChan is closed once background activity may go on; nil when it
+// is not on hold
+func (p *powerState) resumedChan() <-chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.resumed
+}
+
+// PowerInfo is the JSON view of the background pause
+type PowerInfo struct {
+	Paused  bool       `json:"paused"`
+	Reasons []string   `json:"reasons"`
+	Since   *time.Time `json:"since,omitempty"` // when the earliest reason paused
+}
+
+func (p *powerState) Info() PowerInfo {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	info := PowerInfo{Paused: len(p.reasons) > 0, Reasons: []string{}}
+	for reason, at := range p.reasons {
+		info.Reasons = append(info.Reasons, reason)
+		if info.Since == nil || at.Before(*info.Since) {
+			since := at
+			info.Since = &since
+		}
+	}
+	sort.Strings(info.Reasons)
+	return info
+}
+
+// pause adds a reason; it reports whether the node was running before
+func (p *powerState) pause(reason string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.reasons[reason]; !ok {
+		p.reasons[reason] = time.Now()
+	}
+	if p.resumed != nil {
+		return false
+	}
+	p.resumed = make(chan struct{})
+	return true
+}
+
+// resume drops a reason, or all of them for "", and reports whether that
+// let background activity go on
+func (p *powerState) resume(reason string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if reason == "" {
+		clear(p.reasons)
+	} else {
+		delete(p.reasons, reason)
+	}
+	if len(p.reasons) > 0 || p.resumed == nil {
+		return false
+	}
+	close(p.resumed)
+	p.resumed = nil
+	return true
+}
+
+// applyPowerKeepalives turns TCP keepalives off on every tracked
+// connection while paused and back to each one's setting on resume
+func applyPowerKeepalives() {
+	state.Mutex.Lock()
+	conns := make([]*Connection, 0, len(state.Conns))
+	for _, c := range state.Conns {
+		conns = append(conns, c)
+	}
+	state.Mutex.Unlock()
+	for _, c := range conns {
+		applyKeepalive(c.Conn(), c.Timeouts().Keepalive)
+	}
+}
+
+type BackgroundPayload struct {
+	Reason string `json:"reason"` // "battery_saver", "background" or any other name; default "manual"
+}
+
+func handlePauseBackground(payload json.RawMessage, writer *Output) {
+	var p BackgroundPayload
+	if len(payload) > 0 && string(payload) != "null" {
+		if err := json.Unmarshal(payload, &p); err != nil {
+			sendInvalidPayload(writer, "pause_background")
+			return
+		}
+	}
+	if p.Reason == "" {
+		p.Reason = "manual"
+	}
+	if power.pause(p.Reason) {
+		applyPowerKeepalives()
+		logger.Info("background activity paused", "reason", p.Reason)
+		emitEvent("background_paused", power.Info())
+	}
+	writer.Encode(okResponse(message("power.background_paused"), power.Info()))
+}
+
+func handleResumeBackground(payload json.RawMessage, writer *Output) {
+	var p BackgroundPayload
+	if len(payload) > 0 && string(payload) != "null" {
+		if err := json.Unmarshal(payload, &p); err != nil {
+			sendInvalidPayload(writer, "resume_background")
+			return
+		}
+	}
+	m := message("power.background_still_paused")
+	if power.resume(p.Reason) {
+		applyPowerKeepalives()
+		logger.Info("background activity resumed", "reason", p.Reason)
+		emitEvent("background_resumed", power.Info())
+		m = message("power.background_resumed")
+	} else if !power.paused() {
+		m = message("power.background_resumed")
+	}
+	writer.Encode(okResponse(m, power.Info()))
+}
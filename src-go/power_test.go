@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPowerReasons(t *testing.T) {
+	p := powerState{reasons: make(map[string]time.Time)}
+	if !p.pause("battery_saver") || p.pause("background") {
+		t.Fatal("only the first reason should pause")
+	}
+	woke := make(chan bool)
+	go func() { woke <- p.wait(context.Background()) }()
+
+	if p.resume("battery_saver") {
+		t.Error("resumed with background still paused")
+	}
+	select {
+	case <-woke:
+		t.Fatal("wait returned while paused")
+	case <-time.After(20 * time.Millisecond):
+	}
+	if info := p.Info(); !info.Paused || len(info.Reasons) != 1 || info.Reasons[0] != "background" {
+		t.Errorf("info %+v", info)
+	}
+	if !p.resume("background") || !<-woke {
+		t.Error("last reason did not resume")
+	}
+
+	p.pause("manual")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if p.wait(ctx) {
+		t.Error("wait ignored a canceled context")
+	}
+	if !p.resume("") || p.paused() {
+		t.Error("resume without a reason left it paused")
+	}
+}
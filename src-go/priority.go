@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sync"
+)
+
+// Transfers run at one of three priorities. With transfer_priority's
+// bytes_per_sec set, that bandwidth is split between the active transfers
+// in proportion to the share of their level, so a bulk backup leaves most
+// of the link to what the user is waiting for. On top of that a send at
+// normal or high priority preempts the low ones: they are paused while it
+// runs and resumed once no such send is left. Only transfers whose body
+// is pausable can be preempted; the rest just get their share. Scheduled
+// runs and folder syncs are low priority unless they say otherwise,
+// everything else is normal.
+const (
+	priorityLow    = "low"
+	priorityNormal = "normal"
+	priorityHigh   = "high"
+)
+
+// defaultPriorityShares weigh the levels against each other
+var defaultPriorityShares = map[string]int{priorityLow: 1, priorityNormal: 4, priorityHigh: 16}
+
+// PriorityConfig is the config section of transfer priorities. Zero values
+// keep the defaults.
+type PriorityConfig struct {
+	BytesPerSec       int64          `json:"bytes_per_sec,omitempty"`      // shared by every transfer, 0 for no cap
+	Shares            map[string]int `json:"shares,omitempty"`             // weight of each level, default low 1, normal 4, high 16
+	DisablePreemption bool           `json:"disable_preemption,omitempty"` // keep low priority transfers running
+}
+
+func (c PriorityConfig) Validate() error {
+	if c.BytesPerSec < 0 {
+		return catalogError(ErrInvalidArgument, "priority.bytes_per_sec_must_not")
+	}
+	for level, share := range c.Shares {
+		if !validPriority(level) || level == "" {
+			return catalogError(ErrInvalidArgument, "priority.shares_unknown_level", "level", fmt.Sprintf("%q", level))
+		}
+		if share <= 0 {
+			return catalogError(ErrInvalidArgument, "priority.shares_must_positive")
+		}
+	}
+	return nil
+}
+
+// share is the weight of level
+func (c PriorityConfig) share(level string) int {
+	if s, ok := c.Shares[level]; ok {
+		return s
+	}
+	return defaultPriorityShares[level]
+}
+
+// validPriority accepts the levels, and "" for the default
+func validPriority(level string) bool {
+	switch level {
+	case "", priorityLow, priorityNormal, priorityHigh:
+		return true
+	}
+	return false
+}
+
+// PriorityScheduler divides bandwidth between active transfers and
+// preempts low priority ones
+type PriorityScheduler struct {
+	mu        sync.Mutex
+	active    map[*Transfer]bool
+	preempted map[*Transfer]bool // paused by the scheduler, resumed by it
+}
+
+var priorities = PriorityScheduler{active: make(map[*Transfer]bool), preempted: make(map[*Transfer]bool)}
+
+// join starts scheduling a new transfer
+func (s *PriorityScheduler) join(t *Transfer) {
+	s.mu.Lock()
+	s.active[t] = true
+	s.mu.Unlock()
+	s.rebalance()
+}
+
+// leave stops scheduling a finished transfer
+func (s *PriorityScheduler) leave(t *Transfer) {
+	s.mu.Lock()
+	delete(s.active, t)
+	delete(s.preempted, t)
+	s.mu.Unlock()
+	s.rebalance()
+}
+
+// rebalance preempts or restores low priority transfers as needed and
+// hands out the bandwidth again. It runs whenever a transfer starts,
+// finishes, changes priority or becomes pausable, and when the config
+// changes.
+func (s *PriorityScheduler) rebalance() {
+	cfg := config.Get().TransferPriority
+
+	s.mu.Lock()
+	var urgent []string
+	for t := range s.active {
+		if t.Direction == "send" && t.priority() != priorityLow {
+			urgent = append(urgent, t.ID)
+		}
+	}
+	slices.Sort(urgent)
+	var pause, restore []*Transfer
+	for t := range s.active {
+		switch {
+		case len(urgent) > 0 && !cfg.DisablePreemption:
+			if t.priority() == priorityLow && !s.preempted[t] {
+				pause = append(pause, t)
+			}
+		case s.preempted[t]:
+			restore = append(restore, t)
+			delete(s.preempted, t)
+		}
+	}
+	s.mu.Unlock()
+
+	// Pausing tells the peer, so it happens outside the lock
+	for _, t := range pause {
+		if local, _ := t.pausedBy(); local || t.setPaused("local", true) != nil {
+			continue // paused by the user, or not pausable yet
+		}
+		s.mu.Lock()
+		if s.active[t] {
+			s.preempted[t] = true
+		}
+		s.mu.Unlock()
+		logger.Info("transfer preempted", "id", t.ID, "by", urgent)
+		emitEvent("transfer_preempted", map[string]interface{}{"id": t.ID, "by": urgent})
+	}
+	for _, t := range restore {
+		if t.setPaused("local", false) == nil {
+			logger.Info("transfer restored", "id", t.ID)
+			emitEvent("transfer_restored", map[string]interface{}{"id": t.ID})
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	total := 0
+	for t := range s.active {
+		if !s.preempted[t] {
+			total += cfg.share(t.priority())
+		}
+	}
+	for t := range s.active {
+		var rate int64
+		if cfg.BytesPerSec > 0 {
+			share, weights := cfg.share(t.priority()), total
+			if s.preempted[t] {
+				weights += share // in case the user resumes it
+			}
+			rate = max(1, cfg.BytesPerSec*int64(share)/int64(weights))
+		}
+		t.share.SetRate(rate)
+	}
+}
+
+// isPreempted reports whether the scheduler holds t
+func (s *PriorityScheduler) isPreempted(t *Transfer) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.preempted[t]
+}
+
+func (t *Transfer) priority() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.Priority
+}
+
+// setPriority moves t to level, "" keeping normal
+func (t *Transfer) setPriority(level string) {
+	if level == "" {
+		level = priorityNormal
+	}
+	t.mu.Lock()
+	changed := t.Priority != level
+	t.Priority = level
+	t.mu.Unlock()
+	if changed {
+		priorities.rebalance()
+	}
+}
+
+type SetTransferPriorityPayload struct {
+	ID       string `json:"id" required:"true"`
+	Priority string `json:"priority" required:"true"` // "low", "normal" or "high"
+}
+
+// handleSetTransferPriority changes the priority of an active transfer
+func handleSetTransferPriority(payload json.RawMessage, writer *Output) {
+	var p SetTransferPriorityPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		sendInvalidPayload(writer, "set_transfer_priority")
+		return
+	}
+	if p.Priority == "" || !validPriority(p.Priority) {
+		sendErrorCode(writer, ErrInvalidArgument, message("priority.priority_must_low"), nil)
+		return
+	}
+	t, exists := lookupTransfer(p.ID, writer)
+	if !exists {
+		sendErrorCode(writer, ErrNotFound, message("common.transfer_not_found"), nil)
+		return
+	}
+	if state := t.Info().State; state != "active" {
+		sendErrorCode(writer, ErrInvalidState, message("pause.transfer_not_active", "state", state), nil)
+		return
+	}
+	t.setPriority(p.Priority)
+	writer.Encode(okResponse(message("priority.transfer_priority_set", "priority", p.Priority),
+		map[string]interface{}{"id": t.ID, "priority": p.Priority, "preempted": priorities.isPreempted(t)}))
+}
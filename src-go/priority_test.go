@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestPriorityConfigValidate(t *testing.T) {
+	for _, c := range []PriorityConfig{
+		{BytesPerSec: -1},
+		{Shares: map[string]int{"urgent": 2}},
+		{Shares: map[string]int{priorityLow: 0}},
+	} {
+		var e *messageError
+		if err := c.Validate(); !errors.As(err, &e) || e.code != ErrInvalidArgument {
+			t.Errorf("%+v gave %v", c, err)
+		}
+	}
+	c := PriorityConfig{Shares: map[string]int{priorityHigh: 8}}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if c.share(priorityHigh) != 8 || c.share(priorityLow) != 1 {
+		t.Errorf("shares are high %d, low %d", c.share(priorityHigh), c.share(priorityLow))
+	}
+}
+
+func TestPrioritySplitsBandwidth(t *testing.T) {
+	config.mu.Lock()
+	saved := config.cfg
+	config.cfg.TransferPriority = PriorityConfig{BytesPerSec: 5000, DisablePreemption: true}
+	config.mu.Unlock()
+	defer func() {
+		config.mu.Lock()
+		config.cfg = saved
+		config.mu.Unlock()
+		priorities.rebalance()
+	}()
+
+	bulk := newTransferAt(priorityLow, "send", "backup.tar", "", "peer:1", 1)
+	user := newTransfer("send", "photo.jpg", "", "peer:1", 1)
+	defer bulk.finish(nil)
+	defer user.finish(nil)
+
+	if got := bulk.share.Rate(); got != 1000 {
+		t.Errorf("low transfer got %d B/s, want 1000", got)
+	}
+	if got := user.share.Rate(); got != 4000 {
+		t.Errorf("normal transfer got %d B/s, want 4000", got)
+	}
+
+	user.setPriority(priorityHigh)
+	if got := bulk.share.Rate(); got != 5000/17 {
+		t.Errorf("low transfer got %d B/s next to a high one, want %d", got, 5000/17)
+	}
+	if bulk.Info().Priority != priorityLow || user.Info().Priority != priorityHigh {
+		t.Errorf("priorities are %s and %s", bulk.Info().Priority, user.Info().Priority)
+	}
+}
+
+func TestSetTransferPriority(t *testing.T) {
+	tr := newTransfer("receive", "a.bin", "", "peer:1", 1)
+	defer tr.finish(nil)
+
+	var buf bytes.Buffer
+	handleSetTransferPriority(json.RawMessage(`{"id":"`+tr.ID+`","priority":"urgent"}`), NewOutput(&buf))
+	if !strings.Contains(buf.String(), `"error"`) {
+		t.Errorf("unknown level accepted: %s", buf.String())
+	}
+
+	buf.Reset()
+	handleSetTransferPriority(json.RawMessage(`{"id":"`+tr.ID+`","priority":"low"}`), NewOutput(&buf))
+	if !strings.Contains(buf.String(), `"ok"`) || tr.priority() != priorityLow {
+		t.Errorf("set_transfer_priority answered %s, priority is %s", buf.String(), tr.priority())
+	}
+}
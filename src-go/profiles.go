@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Profiles are start_server payloads saved in the config under a name,
+// such as "file-receiver" or "relay-to-nas", so the frontend can launch a
+// listener by name instead of resending every option. start_profile may
+// override fields for one launch; a profile runs at most once at a time
+// and stop_profile stops the listener it started.
+const maxProfileName = 64
+
+type ProfilePayload struct {
+	Name string `json:"name" required:"true"`
+}
+
+type StartProfilePayload struct {
+	Name      string                     `json:"name" required:"true"`
+	Overrides map[string]json.RawMessage `json:"overrides"` // replace these top-level fields for this launch, e.g. {"port": 0}
+}
+
+type SaveProfilePayload struct {
+	Name   string          `json:"name"`
+	Server json.RawMessage `json:"server"` // a start_server payload, plus an optional bytes_per_sec
+}
+
+func validateProfileName(name string) error {
+	if name == "" || len(name) > maxProfileName {
+		return catalogError(ErrInvalidArgument, "profiles.profile_names_must_1", "max_profile_name", maxProfileName)
+	}
+	if strings.IndexFunc(name, unicode.IsControl) >= 0 {
+		return catalogError(ErrInvalidArgument, "profiles.invalid_profile_name", "name", fmt.Sprintf("%q", name))
+	}
+	return nil
+}
+
+// profileListenerLocked finds the listener a profile started; the caller
+// holds state.Mutex
+func profileListenerLocked(name string) *Listener {
+	for _, l := range state.Listeners {
+		if l.Profile == name {
+			return l
+		}
+	}
+	return nil
+}
+
+func handleStartProfile(payload json.RawMessage, writer *Output) {
+	var p StartProfilePayload
+	if err := json.Unmarshal(payload, &p); err != nil || p.Name == "" {
+		sendErrorCode(writer, ErrInvalidArgument, message("profiles.start_profile_requires_name"), nil)
+		return
+	}
+	raw, exists := config.Get().Profiles[p.Name]
+	if !exists {
+		sendErrorCode(writer, ErrNotFound, message("profiles.profile_not_found", "name", p.Name), map[string]interface{}{"name": p.Name})
+		return
+	}
+	state.Mutex.Lock()
+	running := profileListenerLocked(p.Name)
+	state.Mutex.Unlock()
+	if running != nil {
+		sendErrorCode(writer, ErrAlreadyRunning, message("profiles.profile_already_running", "name", p.Name, "addr", running.Addr),
+			map[string]interface{}{"name": p.Name, "addr": running.Addr})
+		return
+	}
+
+	if len(p.Overrides) > 0 {
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &fields); err != nil || fields == nil {
+			sendErrorCode(writer, ErrInvalidArgument, message("profiles.invalid_profile", "name", p.Name), nil)
+			return
+		}
+		for k, v := range p.Overrides {
+			fields[k] = v
+		}
+		var err error
+		if raw, err = json.Marshal(fields); err != nil {
+			sendErrorCode(writer, ErrInvalidArgument, message("profiles.invalid_overrides", "error", err), nil)
+			return
+		}
+		if err := validateServerEntry(raw); err != nil {
+			sendErrorCode(writer, ErrInvalidArgument, message("profiles.invalid_overrides", "error", err), nil)
+			return
+		}
+	}
+
+	resp := startServerEntry(raw)
+	if resp.Status != "ok" {
+		writer.Encode(resp)
+		return
+	}
+	bound, _ := resp.Data.(map[string]interface{})
+	addr, _ := bound["addr"].(string)
+	id, _ := bound["listener_id"].(string)
+	state.Mutex.Lock()
+	if l, exists := state.Listeners[id]; exists {
+		l.Profile = p.Name
+	}
+	state.Mutex.Unlock()
+	logger.Info("profile started", "name", p.Name, "addr", addr, "listener_id", id)
+
+	bound["profile"] = p.Name
+	writer.Encode(okResponse(message("profiles.profile_started", "name", p.Name, "message", resp.Message), bound))
+}
+
+func handleStopProfile(payload json.RawMessage, writer *Output) {
+	var p ProfilePayload
+	if err := json.Unmarshal(payload, &p); err != nil || p.Name == "" {
+		sendErrorCode(writer, ErrInvalidArgument, message("profiles.stop_profile_requires_name"), nil)
+		return
+	}
+	state.Mutex.Lock()
+	defer state.Mutex.Unlock()
+	l := profileListenerLocked(p.Name)
+	if l == nil {
+		sendErrorCode(writer, ErrNotFound, message("profiles.profile_not_running", "name", p.Name), map[string]interface{}{"name": p.Name})
+		return
+	}
+	addr, id := l.Addr, l.ID
+	m := stopServerLocked(l)
+	writer.Encode(okResponse(m, map[string]interface{}{"profile": p.Name, "addr": addr, "listener_id": id}))
+}
+
+// handleListProfiles returns the saved profiles and where each is running
+func handleListProfiles(writer *Output) {
+	profiles := config.Get().Profiles
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	state.Mutex.Lock()
+	running := make(map[string]*Listener)
+	for _, l := range state.Listeners {
+		if l.Profile != "" {
+			running[l.Profile] = l
+		}
+	}
+	state.Mutex.Unlock()
+
+	list := make([]map[string]interface{}, 0, len(names))
+	for _, name := range names {
+		entry := map[string]interface{}{"name": name, "server": profiles[name]}
+		if l, ok := running[name]; ok {
+			entry["running"], entry["addr"], entry["listener_id"] = true, l.Addr, l.ID
+		} else {
+			entry["running"] = false
+		}
+		list = append(list, entry)
+	}
+	writer.Encode(ProtocolResponse{Status: "ok", Data: map[string]interface{}{"profiles": list}})
+}
+
+// handleSaveProfile stores a profile, replacing one of the same name. A
+// listener already running from it keeps its old options.
+func handleSaveProfile(payload json.RawMessage, writer *Output) {
+	var p SaveProfilePayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		sendInvalidPayload(writer, "save_profile")
+		return
+	}
+	if err := validateProfileName(p.Name); err != nil {
+		sendFailure(writer, err)
+		return
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(p.Server, &fields); err != nil || fields == nil {
+		sendErrorCode(writer, ErrInvalidArgument, message("profiles.save_profile_requires_server"), nil)
+		return
+	}
+	patch, _ := json.Marshal(map[string]interface{}{"profiles": map[string]json.RawMessage{p.Name: p.Server}})
+	if _, err := config.Update(patch); err != nil {
+		sendFailure(writer, err)
+		return
+	}
+	logger.Info("profile saved", "name", p.Name)
+	writer.Encode(okResponse(message("profiles.profile_saved", "name", p.Name),
+		map[string]interface{}{"name": p.Name, "path": config.Path()}))
+}
+
+func handleDeleteProfile(payload json.RawMessage, writer *Output) {
+	var p ProfilePayload
+	if err := json.Unmarshal(payload, &p); err != nil || p.Name == "" {
+		sendErrorCode(writer, ErrInvalidArgument, message("profiles.delete_profile_requires_name"), nil)
+		return
+	}
+	if _, exists := config.Get().Profiles[p.Name]; !exists {
+		sendErrorCode(writer, ErrNotFound, message("profiles.profile_not_found", "name", p.Name), map[string]interface{}{"name": p.Name})
+		return
+	}
+	patch, _ := json.Marshal(map[string]interface{}{"profiles": map[string]interface{}{p.Name: nil}})
+	if _, err := config.Update(patch); err != nil {
+		sendFailure(writer, err)
+		return
+	}
+	logger.Info("profile deleted", "name", p.Name)
+	writer.Encode(okResponse(message("profiles.profile_deleted", "name", p.Name), nil))
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The metrics listener serves the counters behind status in the Prometheus
+// text exposition format, for people running Lumina on a headless box
+const defaultMetricsPath = "/metrics"
+
+// MetricsServer is the running metrics listener, if any
+type MetricsServer struct {
+	mu     sync.Mutex
+	addr   string
+	path   string
+	server *http.Server
+}
+
+var metricsServer MetricsServer
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// promWriter writes metric families in the text exposition format
+type promWriter struct {
+	b strings.Builder
+}
+
+func (w *promWriter) family(name, typ, help string) {
+	fmt.Fprintf(&w.b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// sample writes one sample; labels alternate names and values
+func (w *promWriter) sample(name string, value float64, labels ...string) {
+	w.b.WriteString(name)
+	if len(labels) > 0 {
+		w.b.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				w.b.WriteByte(',')
+			}
+			fmt.Fprintf(&w.b, `%s="%s"`, labels[i], labelEscaper.Replace(labels[i+1]))
+		}
+		w.b.WriteByte('}')
+	}
+	w.b.WriteByte(' ')
+	w.b.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+	w.b.WriteByte('\n')
+}
+
+// renderMetrics assembles the whole exposition
+func renderMetrics() string {
+	var w promWriter
+
+	w.family("lumina_uptime_seconds", "gauge", "Seconds since the sidecar started.")
+	w.sample("lumina_uptime_seconds", time.Since(metrics.StartedAt).Seconds())
+	w.family("lumina_received_bytes_total", "counter", "Bytes received on all connections.")
+	w.sample("lumina_received_bytes_total", float64(metrics.BytesIn.Load()))
+	w.family("lumina_sent_bytes_total", "counter", "Bytes sent on all connections.")
+	w.sample("lumina_sent_bytes_total", float64(metrics.BytesOut.Load()))
+	w.family("lumina_connections_opened_total", "counter", "Connections opened.")
+	w.sample("lumina_connections_opened_total", float64(metrics.Connections.Load()))
+	w.family("lumina_command_errors_total", "counter", "Error responses sent to the frontend.")
+	w.sample("lumina_command_errors_total", float64(metrics.Errors.Load()))
+
+	state.Mutex.Lock()
+	open := make(map[string]int)
+	for _, c := range state.Conns {
+		if c.ListenerID != "" {
+			open[c.ListenerID]++
+		}
+	}
+	w.family("lumina_connections_open", "gauge", "Connections currently open.")
+	w.sample("lumina_connections_open", float64(len(state.Conns)))
+
+	listeners := make([]*Listener, 0, len(state.Listeners))
+	for _, l := range state.Listeners {
+		listeners = append(listeners, l)
+	}
+	sort.Slice(listeners, func(i, j int) bool { return listeners[i].seq < listeners[j].seq })
+	perListener := []struct {
+		name, typ, help string
+		value           func(l *Listener) float64
+	}{
+		{"lumina_listener_connections", "gauge", "Connections open on a listener.",
+			func(l *Listener) float64 { return float64(open[l.ID]) }},
+		{"lumina_listener_accepted_total", "counter", "Connections a listener accepted.",
+			func(l *Listener) float64 { return float64(l.Accepted.Load()) }},
+		{"lumina_listener_refused_total", "counter", "Connections a listener refused over its limit.",
+			func(l *Listener) float64 { return float64(l.Refused.Load()) }},
+		{"lumina_listener_received_bytes_total", "counter", "Bytes received by a listener's connections.",
+			func(l *Listener) float64 { return float64(l.BytesIn.Load()) }},
+		{"lumina_listener_sent_bytes_total", "counter", "Bytes sent by a listener's connections.",
+			func(l *Listener) float64 { return float64(l.BytesOut.Load()) }},
+		{"lumina_listener_auth_failures_total", "counter", "Failed authentication attempts on a listener.",
+			func(l *Listener) float64 {
+				if l.Auth == nil {
+					return 0
+				}
+				return float64(l.Auth.Failures.Load())
+			}},
+	}
+	for _, m := range perListener {
+		w.family(m.name, m.typ, m.help)
+		for _, l := range listeners {
+			w.sample(m.name, m.value(l), "listener", l.Addr, "listener_id", l.ID, "type", l.Type)
+		}
+	}
+	state.Mutex.Unlock()
+
+	active := map[string]int{"send": 0, "receive": 0}
+	transfersMu.Lock()
+	for _, t := range transfers {
+		if info := t.Info(); info.State == "active" {
+			active[info.Direction]++
+		}
+	}
+	transfersMu.Unlock()
+	w.family("lumina_transfers_active", "gauge", "Transfers in progress.")
+	for _, direction := range []string{"receive", "send"} {
+		w.sample("lumina_transfers_active", float64(active[direction]), "direction", direction)
+	}
+
+	w.family("lumina_transfer_duration_seconds", "histogram", "How long finished transfers took.")
+	metrics.mu.Lock()
+	outcomes := make([]transferOutcome, 0, len(metrics.transfers))
+	for o := range metrics.transfers {
+		outcomes = append(outcomes, o)
+	}
+	sort.Slice(outcomes, func(i, j int) bool {
+		if outcomes[i].direction != outcomes[j].direction {
+			return outcomes[i].direction < outcomes[j].direction
+		}
+		return outcomes[i].result < outcomes[j].result
+	})
+	for _, o := range outcomes {
+		h := metrics.transfers[o]
+		for i, bound := range transferBuckets {
+			w.sample("lumina_transfer_duration_seconds_bucket", float64(h.counts[i]),
+				"direction", o.direction, "result", o.result, "le", strconv.FormatFloat(bound, 'g', -1, 64))
+		}
+		w.sample("lumina_transfer_duration_seconds_bucket", float64(h.count),
+			"direction", o.direction, "result", o.result, "le", "+Inf")
+		w.sample("lumina_transfer_duration_seconds_sum", h.sum, "direction", o.direction, "result", o.result)
+		w.sample("lumina_transfer_duration_seconds_count", float64(h.count), "direction", o.direction, "result", o.result)
+	}
+	metrics.mu.Unlock()
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	w.family("go_goroutines", "gauge", "Number of goroutines that currently exist.")
+	w.sample("go_goroutines", float64(runtime.NumGoroutine()))
+	w.family("go_memstats_heap_alloc_bytes", "gauge", "Bytes of allocated heap objects.")
+	w.sample("go_memstats_heap_alloc_bytes", float64(mem.HeapAlloc))
+	w.family("go_memstats_sys_bytes", "gauge", "Bytes of memory obtained from the OS.")
+	w.sample("go_memstats_sys_bytes", float64(mem.Sys))
+	return w.b.String()
+}
+
+type StartMetricsPayload struct {
+	Host  string `json:"host"` // defaults to loopback; metrics are not for the whole LAN unless asked
+	Port  int    `json:"port"`
+	Path  string `json:"path"`
+	Token string `json:"token"` // require "Authorization: Bearer <token>" when set
+}
+
+func handleStartMetrics(payload json.RawMessage, writer *Output) {
+	var p StartMetricsPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		sendInvalidPayload(writer, "start_metrics")
+		return
+	}
+	if p.Host == "" {
+		p.Host = "127.0.0.1"
+	}
+	if p.Path == "" {
+		p.Path = defaultMetricsPath
+	}
+	if !strings.HasPrefix(p.Path, "/") {
+		sendErrorCode(writer, ErrInvalidArgument, message("prometheus.metrics_path_must_start"), nil)
+		return
+	}
+	// ServeMux panics on a path it reads as a malformed pattern
+	if err := validRoutePath(p.Path); err != nil {
+		sendFailure(writer, err)
+		return
+	}
+
+	metricsServer.mu.Lock()
+	defer metricsServer.mu.Unlock()
+	if metricsServer.server != nil {
+		sendErrorCode(writer, ErrAlreadyRunning, message("prometheus.metrics_already_served", "addr", metricsServer.addr), nil)
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(p.Path, func(w http.ResponseWriter, r *http.Request) {
+		if p.Token != "" {
+			given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(given), []byte(p.Token)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Write([]byte(renderMetrics()))
+	})
+
+	ln, err := net.Listen("tcp", listenAddr(p.Host, p.Port))
+	if err != nil {
+		sendBindError(writer, listenAddr(p.Host, p.Port), err)
+		return
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	addr := listenAddr(p.Host, port)
+
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go server.Serve(ln)
+	metricsServer.addr, metricsServer.path, metricsServer.server = addr, p.Path, server
+	logger.Info("metrics listener started", "addr", addr, "path", p.Path)
+
+	writer.Encode(okResponse(message("prometheus.metrics_served_http", "url", "http://"+addr+p.Path),
+		map[string]interface{}{"addr": addr, "host": p.Host, "port": port, "path": p.Path}))
+}
+
+func handleStopMetrics(writer *Output) {
+	metricsServer.mu.Lock()
+	defer metricsServer.mu.Unlock()
+	if metricsServer.server == nil {
+		sendErrorCode(writer, ErrNotRunning, message("prometheus.metrics_listener_not_running"), nil)
+		return
+	}
+	stopMetricsLocked()
+	writer.Encode(okResponse(message("prometheus.metrics_listener_stopped"), nil))
+}
+
+// stopMetricsLocked closes the metrics listener; the caller holds
+// metricsServer.mu
+func stopMetricsLocked() {
+	if metricsServer.server == nil {
+		return
+	}
+	metricsServer.server.Close()
+	logger.Info("metrics listener stopped", "addr", metricsServer.addr)
+	metricsServer.addr, metricsServer.path, metricsServer.server = "", "", nil
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestStartMetricsRefusesPatternPaths(t *testing.T) {
+	for _, path := range []string{"/metrics/{id}", "/a b", "/m?x=1"} {
+		var buf bytes.Buffer
+		raw, _ := json.Marshal(map[string]interface{}{"port": 0, "path": path})
+		handleStartMetrics(raw, NewOutput(&buf))
+		var resp ProtocolResponse
+		if err := json.Unmarshal(buf.Bytes(), &resp); err != nil || resp.MessageKey != "httpapi.invalid_http_path" {
+			t.Errorf("%s: %s", path, buf.String())
+		}
+	}
+	metricsServer.mu.Lock()
+	defer metricsServer.mu.Unlock()
+	if metricsServer.server != nil {
+		t.Error("a metrics listener started")
+	}
+}
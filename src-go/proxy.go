@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// Outbound TCP dials can go through an HTTP CONNECT or SOCKS5 proxy, for
+// networks that only let traffic out that way. The proxy in the config
+// applies to every dial unless it bypasses the target; a dial may name its
+// own proxy, or "direct" to skip the configured one. Loopback targets are
+// always dialed directly. UDP and QUIC cannot be proxied.
+const proxyDirect = "direct"
+
+// ProxyConfig is the proxy outbound dials use by default
+type ProxyConfig struct {
+	// URL is socks5://, socks5h:// (the proxy resolves names), http:// or
+	// https://, with optional user:password@ credentials
+	URL string `json:"url"`
+
+	// Bypass lists targets dialed directly: host names, *.domain suffixes,
+	// IP addresses and CIDR blocks
+	Bypass []string `json:"bypass,omitempty"`
+}
+
+func (c *ProxyConfig) Validate() error {
+	if c == nil || c.URL == "" {
+		return nil
+	}
+	if _, err := parseProxyURL(c.URL); err != nil {
+		return err
+	}
+	for _, b := range c.Bypass {
+		if strings.Contains(b, "/") {
+			if _, err := netip.ParsePrefix(b); err != nil {
+				return catalogError(ErrInvalidArgument, "proxy.invalid_proxy_bypass", "bypass", fmt.Sprintf("%q", b))
+			}
+		}
+	}
+	return nil
+}
+
+// parseProxyURL checks a proxy URL; "direct" is handled by the caller
+func parseProxyURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return nil, catalogError(ErrInvalidArgument, "proxy.invalid_proxy_url", "url", fmt.Sprintf("%q", raw))
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h", "http", "https":
+	default:
+		return nil, catalogError(ErrUnsupported, "proxy.unsupported_proxy_scheme", "scheme", u.Scheme)
+	}
+	if u.Port() == "" {
+		return nil, errors.New("proxy URL needs a port")
+	}
+	return u, nil
+}
+
+// validProxy checks a per-dial proxy setting against the network it is
+// for; the error is ready to send to the app
+func validProxy(setting, network string) error {
+	if setting == "" || setting == proxyDirect {
+		return nil
+	}
+	if _, err := parseProxyURL(setting); err != nil {
+		return err
+	}
+	if network != "tcp" {
+		return catalogError(ErrFailed, "proxy.can_only_carry_tcp")
+	}
+	return nil
+}
+
+// proxyFor picks the proxy for a dial to addr, nil for a direct dial
+func proxyFor(setting, addr string) (*url.URL, error) {
+	switch setting {
+	case proxyDirect:
+		return nil, nil
+	case "":
+		cfg := config.Get().Proxy
+		if cfg == nil || cfg.URL == "" || bypassProxy(cfg.Bypass, addr) {
+			return nil, nil
+		}
+		setting = cfg.URL
+	}
+	if bypassProxy(nil, addr) {
+		return nil, nil
+	}
+	return parseProxyURL(setting)
+}
+
+// bypassProxy reports whether addr is loopback or matches a bypass rule
+func bypassProxy(rules []string, addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	ip, err := netip.ParseAddr(host)
+	isIP := err == nil
+	if host == "localhost" || (isIP && ip.IsLoopback()) {
+		return true
+	}
+	for _, rule := range rules {
+		rule = strings.ToLower(rule)
+		switch {
+		case strings.Contains(rule, "/"):
+			if prefix, err := netip.ParsePrefix(rule); err == nil && isIP && prefix.Contains(ip.Unmap()) {
+				return true
+			}
+		case strings.HasPrefix(rule, "*."), strings.HasPrefix(rule, "."):
+			suffix := strings.TrimPrefix(rule, "*")
+			if strings.HasSuffix(host, suffix) || host == suffix[1:] {
+				return true
+			}
+		case rule == host:
+			return true
+		}
+	}
+	return false
+}
+
+// dialProxy connects to addr through the proxy at u
+func dialProxy(u *url.URL, addr string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	direct := &net.Dialer{Timeout: timeout}
+
+	if u.Scheme == "socks5" || u.Scheme == "socks5h" {
+		var auth *proxy.Auth
+		if u.User != nil {
+			pass, _ := u.User.Password()
+			auth = &proxy.Auth{User: u.User.Username(), Password: pass}
+		}
+		if u.Scheme == "socks5" {
+			// Resolve here rather than at the proxy
+			host, port, _ := net.SplitHostPort(addr)
+			if _, err := netip.ParseAddr(host); err != nil {
+				ips, err := net.DefaultResolver.LookupHost(ctx, host)
+				if err != nil {
+					return nil, err
+				}
+				addr = net.JoinHostPort(ips[0], port)
+			}
+		}
+		dialer, err := proxy.SOCKS5("tcp", u.Host, auth, direct)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := dialer.(proxy.ContextDialer).DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return nil, fmt.Errorf("via proxy %s: %w", u.Host, err)
+		}
+		return conn, nil
+	}
+
+	conn, err := direct.DialContext(ctx, "tcp", u.Host)
+	if err != nil {
+		return nil, fmt.Errorf("proxy %s: %w", u.Host, err)
+	}
+	if u.Scheme == "https" {
+		tc := tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+		if err := tc.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("proxy %s: %w", u.Host, err)
+		}
+		conn = tc
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	req := "CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\n"
+	if u.User != nil {
+		pass, _ := u.User.Password()
+		req += "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(u.User.Username()+":"+pass)) + "\r\n"
+	}
+	if _, err := conn.Write([]byte(req + "\r\n")); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// Read the reply byte by byte so none of the tunnel's bytes are buffered away
+	resp, err := http.ReadResponse(bufio.NewReaderSize(byteReader{conn}, 16), &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: %w", u.Host, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s refused CONNECT: %s", u.Host, resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// byteReader reads one byte at a time
+type byteReader struct{ c net.Conn }
+
+func (r byteReader) Read(b []byte) (int, error) {
+	if len(b) > 1 {
+		b = b[:1]
+	}
+	return r.c.Read(b)
+}
+
+type TestProxyPayload struct {
+	Proxy     string `json:"proxy"`  // default the configured proxy
+	Target    string `json:"target"` // host:port to reach through it, default example.com:80
+	TimeoutMs int    `json:"timeout_ms"`
+}
+
+// handleTestProxy opens a tunnel to the target through the proxy to show
+// the proxy settings work
+func handleTestProxy(payload json.RawMessage, writer *Output) {
+	var p TestProxyPayload
+	if len(payload) > 0 && string(payload) != "null" {
+		if err := json.Unmarshal(payload, &p); err != nil {
+			sendInvalidPayload(writer, "test_proxy")
+			return
+		}
+	}
+	if p.Proxy == "" {
+		if cfg := config.Get().Proxy; cfg != nil {
+			p.Proxy = cfg.URL
+		}
+	}
+	if p.Proxy == "" || p.Proxy == proxyDirect {
+		sendErrorCode(writer, ErrInvalidArgument, message("proxy.test_proxy_requires_proxy"), nil)
+		return
+	}
+	u, err := parseProxyURL(p.Proxy)
+	if err != nil {
+		sendFailure(writer, err)
+		return
+	}
+	if p.Target == "" {
+		p.Target = "example.com:80"
+	}
+	if _, _, err := net.SplitHostPort(p.Target); err != nil {
+		sendErrorCode(writer, ErrInvalidArgument, message("proxy.target_must_host_port"), nil)
+		return
+	}
+	timeout := defaultDialTimeout
+	if p.TimeoutMs > 0 {
+		timeout = time.Duration(p.TimeoutMs) * time.Millisecond
+	}
+
+	start := time.Now()
+	conn, err := dialProxy(u, p.Target, timeout)
+	if err != nil {
+		sendErrorCode(writer, ErrConnectFailed, message("proxy.test_failed", "error", err),
+			map[string]interface{}{"proxy": u.Redacted(), "target": p.Target, "error": err.Error()})
+		return
+	}
+	conn.Close()
+	writer.Encode(okResponse(message("proxy.reached_through_proxy", "target", p.Target), map[string]interface{}{
+		"proxy":      u.Redacted(),
+		"target":     p.Target,
+		"connect_ms": millis(time.Since(start)),
+	}))
+}
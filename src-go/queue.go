@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The transfer queue holds sends the app dropped on the sidecar in bulk and
+// starts them a few at a time. Jobs wait in order; a new job goes ahead of
+// every waiting job with a lower priority, and reorder_queue moves jobs by
+// hand. Finished jobs stay listed until the history fills up.
+const (
+	defaultQueueConcurrency = 3
+	maxQueueConcurrency     = 32
+	maxQueueHistory         = 200
+)
+
+// QueueJob is one send waiting in, running from, or finished by the queue
+type QueueJob struct {
+	ID       string     `json:"id"`
+	Kind     string     `json:"kind"` // "file", "directory"
+	Path     string     `json:"path"`
+	Addr     string     `json:"addr"`
+	Priority int        `json:"priority"`
+	State    string     `json:"state"`              // "queued", "active", "completed", "failed", "canceled"
+	Transfer string     `json:"transfer,omitempty"` // transfer ID once started
+	Error    string     `json:"error,omitempty"`
+	Added    time.Time  `json:"added"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+
+	payload json.RawMessage // send_file or send_directory payload
+}
+
+// TransferQueue schedules queued jobs
+type TransferQueue struct {
+	mu      sync.Mutex
+	max     int
+	waiting []*QueueJob          // in the order they will start
+	active  map[string]*QueueJob // transfer ID -> job
+	history []*QueueJob          // finished, oldest first
+}
+
+var (
+	transferQueue = TransferQueue{max: defaultQueueConcurrency, active: make(map[string]*QueueJob)}
+	queueSeq      atomic.Uint64
+)
+
+// insertLocked places j behind every waiting job of the same or higher priority
+func (q *TransferQueue) insertLocked(j *QueueJob) {
+	i := len(q.waiting)
+	for i > 0 && q.waiting[i-1].Priority < j.Priority {
+		i--
+	}
+	q.waiting = append(q.waiting, nil)
+	copy(q.waiting[i+1:], q.waiting[i:])
+	q.waiting[i] = j
+}
+
+// scheduleLocked starts waiting jobs while there are free slots
+func (q *TransferQueue) scheduleLocked() {
+	for len(q.active) < q.max && len(q.waiting) > 0 {
+		j := q.waiting[0]
+		q.waiting = q.waiting[1:]
+		q.startLocked(j)
+	}
+}
+
+func (q *TransferQueue) startLocked(j *QueueJob) {
+	var buf bytes.Buffer
+	if j.Kind == "directory" {
+		handleSendDirectory(j.payload, NewOutput(&buf))
+	} else {
+		handleSendFile(j.payload, NewOutput(&buf))
+	}
+	var resp struct {
+		Status  string `json:"status"`
+		Message string `json:"message"`
+		Data    struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	json.Unmarshal(buf.Bytes(), &resp)
+
+	now := time.Now()
+	j.Started = &now
+	if resp.Status != "ok" {
+		q.finishLocked(j, "failed", errors.New(resp.Message))
+		return
+	}
+	j.State, j.Transfer = "active", resp.Data.ID
+	q.active[j.Transfer] = j
+	logger.Info("queued transfer started", "id", j.ID, "transfer", j.Transfer, "path", j.Path)
+	emitEvent("queue_job_started", *j)
+}
+
+func (q *TransferQueue) finishLocked(j *QueueJob, state string, err error) {
+	now := time.Now()
+	j.State, j.Finished = state, &now
+	if err != nil {
+		j.Error = err.Error()
+	}
+	q.history = append(q.history, j)
+	if len(q.history) > maxQueueHistory {
+		q.history = q.history[len(q.history)-maxQueueHistory:]
+	}
+	emitEvent("queue_job_finished", *j)
+}
+
+// transferFinished moves the job behind a transfer to the history and
+// starts the next one; Transfer.finish calls it for every transfer
+func (q *TransferQueue) transferFinished(id string, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	j, ok := q.active[id]
+	if !ok {
+		return
+	}
+	delete(q.active, id)
+	state := "completed"
+	switch {
+	case errors.Is(err, context.Canceled):
+		state, err = "canceled", nil
+	case err != nil:
+		state = "failed"
+	}
+	q.finishLocked(j, state, err)
+	q.scheduleLocked()
+}
+
+type EnqueueTransferPayload struct {
+	Kind     string   `json:"kind"`     // "file" (default), "directory"
+	Priority int      `json:"priority"` // higher starts first, default 0
+	Path     string   `json:"path"`
+	Paths    []string `json:"paths"` // one job per path, all with the same settings
+	Host     string   `json:"host"`
+	Port     int      `json:"port"`
+}
+
+// handleEnqueueTransfer queues send_file or send_directory jobs. Everything
+// in the payload besides kind, priority and paths is passed on as the send
+// payload, except a schedule: a scheduled send starts no transfer, so the
+// job would hold its slot forever.
+func handleEnqueueTransfer(payload json.RawMessage, writer *Output) {
+	var p EnqueueTransferPayload
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &p); err != nil || json.Unmarshal(payload, &fields) != nil {
+		sendInvalidPayload(writer, "enqueue_transfer")
+		return
+	}
+	switch p.Kind {
+	case "":
+		p.Kind = "file"
+	case "file", "directory":
+	default:
+		sendErrorCode(writer, ErrUnsupported, message("queue.unsupported_job_kind", "kind", p.Kind), nil)
+		return
+	}
+	paths := p.Paths
+	if p.Path != "" {
+		paths = append([]string{p.Path}, paths...)
+	}
+	if p.Host == "" || p.Port <= 0 || len(paths) == 0 {
+		sendErrorCode(writer, ErrInvalidArgument, message("queue.enqueue_transfer_requires_host"), nil)
+		return
+	}
+	if s, ok := fields["schedule"]; ok && string(s) != "null" {
+		sendErrorCode(writer, ErrInvalidArgument, message("queue.schedule_not_queued"), nil)
+		return
+	}
+	// Check every path first so a bad one does not leave half a batch queued
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			sendError(writer, message("common.failed_open", "path", path, "error", err))
+			return
+		}
+		if info.IsDir() != (p.Kind == "directory") {
+			sendErrorCode(writer, ErrInvalidArgument, message("queue.path_not_kind", "path", path, "kind", p.Kind), nil)
+			return
+		}
+	}
+	delete(fields, "kind")
+	delete(fields, "priority")
+	delete(fields, "paths")
+
+	jobs := make([]QueueJob, 0, len(paths))
+	transferQueue.mu.Lock()
+	for _, path := range paths {
+		fields["path"], _ = json.Marshal(path)
+		send, _ := json.Marshal(fields)
+		j := &QueueJob{
+			ID:       fmt.Sprintf("queue-%d", queueSeq.Add(1)),
+			Kind:     p.Kind,
+			Path:     path,
+			Addr:     listenAddr(p.Host, p.Port),
+			Priority: p.Priority,
+			State:    "queued",
+			Added:    time.Now(),
+			payload:  send,
+		}
+		transferQueue.insertLocked(j)
+		jobs = append(jobs, *j)
+		emitEvent("queue_job_added", *j)
+	}
+	transferQueue.scheduleLocked()
+	transferQueue.mu.Unlock()
+
+	writer.Encode(okResponse(message("queue.queued_transfers", "jobs", len(jobs)), map[string]interface{}{"jobs": jobs}))
+}
+
+func handleListQueue(writer *Output) {
+	transferQueue.mu.Lock()
+	waiting := make([]QueueJob, len(transferQueue.waiting))
+	for i, j := range transferQueue.waiting {
+		waiting[i] = *j
+	}
+	active := make([]QueueJob, 0, len(transferQueue.active))
+	for _, j := range transferQueue.active {
+		active = append(active, *j)
+	}
+	finished := make([]QueueJob, len(transferQueue.history))
+	for i, j := range transferQueue.history {
+		finished[i] = *j
+	}
+	concurrency := transferQueue.max
+	transferQueue.mu.Unlock()
+	sort.Slice(active, func(i, j int) bool { return active[i].Started.Before(*active[j].Started) })
+
+	writer.Encode(ProtocolResponse{
+		Status: "ok",
+		Data: map[string]interface{}{
+			"concurrency": concurrency,
+			"queued":      waiting,
+			"active":      active,
+			"finished":    finished,
+		},
+	})
+}
+
+type ReorderQueuePayload struct {
+	ID       string `json:"id"`
+	Position *int   `json:"position"` // new index among waiting jobs, 0 starts next
+	Priority *int   `json:"priority"` // change the priority and requeue by it
+}
+
+func handleReorderQueue(payload json.RawMessage, writer *Output) {
+	var p ReorderQueuePayload
+	if err := json.Unmarshal(payload, &p); err != nil || p.ID == "" || (p.Position == nil && p.Priority == nil) {
+		sendErrorCode(writer, ErrInvalidArgument, message("queue.reorder_queue_requires_id"), nil)
+		return
+	}
+	transferQueue.mu.Lock()
+	defer transferQueue.mu.Unlock()
+
+	q := &transferQueue
+	index := -1
+	for i, j := range q.waiting {
+		if j.ID == p.ID {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		sendErrorCode(writer, ErrInvalidState, message("queue.job_not_waiting_queue"), nil)
+		return
+	}
+	j := q.waiting[index]
+	q.waiting = append(q.waiting[:index], q.waiting[index+1:]...)
+	if p.Priority != nil {
+		j.Priority = *p.Priority
+	}
+	if p.Position == nil {
+		q.insertLocked(j)
+	} else {
+		pos := min(max(*p.Position, 0), len(q.waiting))
+		q.waiting = append(q.waiting, nil)
+		copy(q.waiting[pos+1:], q.waiting[pos:])
+		q.waiting[pos] = j
+	}
+
+	order := make([]string, len(q.waiting))
+	for i, w := range q.waiting {
+		order[i] = w.ID
+	}
+	writer.Encode(ProtocolResponse{
+		Status: "ok",
+		Data:   map[string]interface{}{"job": *j, "order": order},
+	})
+}
+
+type CancelQueuedPayload struct {
+	ID string `json:"id"`
+}
+
+// cancelWaiting drops a job that has not started yet and returns it. For a
+// job that already started it returns its transfer ID instead.
+func (q *TransferQueue) cancelWaiting(id string) (*QueueJob, string, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, j := range q.waiting {
+		if j.ID == id {
+			q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+			q.finishLocked(j, "canceled", nil)
+			return j, "", true
+		}
+	}
+	for _, j := range q.active {
+		if j.ID == id {
+			return nil, j.Transfer, true
+		}
+	}
+	return nil, "", false
+}
+
+// handleCancelQueued drops a job that has not started yet
+func handleCancelQueued(payload json.RawMessage, writer *Output) {
+	var p CancelQueuedPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		sendInvalidPayload(writer, "cancel_queued")
+		return
+	}
+	j, transfer, found := transferQueue.cancelWaiting(p.ID)
+	switch {
+	case !found:
+		sendErrorCode(writer, ErrNotFound, message("queue.job_not_found"), nil)
+	case j == nil:
+		sendErrorCode(writer, ErrInvalidState, message("queue.job_already_started_use", "transfer", transfer), nil)
+	default:
+		writer.Encode(okResponse(message("common.job_canceled"), *j))
+	}
+}
+
+type SetQueueConcurrencyPayload struct {
+	Max int `json:"max"`
+}
+
+func handleSetQueueConcurrency(payload json.RawMessage, writer *Output) {
+	var p SetQueueConcurrencyPayload
+	if err := json.Unmarshal(payload, &p); err != nil || p.Max <= 0 {
+		sendErrorCode(writer, ErrInvalidArgument, message("queue.set_queue_concurrency_requires"), nil)
+		return
+	}
+	if p.Max > maxQueueConcurrency {
+		sendErrorCode(writer, ErrInvalidArgument, message("queue.max_must_most", "max_queue_concurrency", maxQueueConcurrency), nil)
+		return
+	}
+	transferQueue.mu.Lock()
+	transferQueue.max = p.Max
+	// Lowering the limit lets running jobs finish; raising it starts more now
+	transferQueue.scheduleLocked()
+	transferQueue.mu.Unlock()
+	writer.Encode(okResponse(message("queue.running_up_queued_transfers", "max", p.Max),
+		map[string]interface{}{"concurrency": p.Max}))
+}
+
+// handleClearQueueHistory forgets finished jobs
+func handleClearQueueHistory(writer *Output) {
+	transferQueue.mu.Lock()
+	n := len(transferQueue.history)
+	transferQueue.history = nil
+	transferQueue.mu.Unlock()
+	writer.Encode(okResponse(message("queue.cleared_finished_jobs", "n", n), nil))
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEnqueueTransferRefusesSchedule(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a.txt")
+	os.WriteFile(path, []byte("a"), 0o600)
+	var buf bytes.Buffer
+	handleEnqueueTransfer(json.RawMessage(`{"host":"127.0.0.1","port":9,"path":"`+jsonStringEscape(path)+`","schedule":{"at":"2030-01-01T00:00:00Z"}}`), NewOutput(&buf))
+	var resp ProtocolResponse
+	json.Unmarshal(buf.Bytes(), &resp)
+	if resp.Status != "error" || resp.Code != ErrInvalidArgument {
+		t.Fatalf("answered %s", buf.String())
+	}
+	transferQueue.mu.Lock()
+	defer transferQueue.mu.Unlock()
+	if len(transferQueue.waiting) != 0 || len(transferQueue.active) != 0 {
+		t.Errorf("queued %d, started %d", len(transferQueue.waiting), len(transferQueue.active))
+	}
+}
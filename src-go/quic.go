@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// QUIC runs every listener type and outbound connection over streams of a
+// QUIC connection instead of separate TCP connections. Dials to the same
+// address share one QUIC connection, so concurrent transfers to a peer
+// each get their own stream and recover from loss independently.
+//
+// QUIC always runs TLS, but its certificate is a throwaway one generated at
+// startup and is not checked. Peers are authenticated the same way as over
+// TCP: by the encrypted handshake and pinned keys, or by auth.
+const quicALPN = "lumina-net"
+
+// quicStreamHello is written first on every stream: a stream only reaches
+// the listener once it carries data, and some handshakes start with the
+// listener speaking
+const quicStreamHello = 0x01
+
+var quicConfig = &quic.Config{
+	KeepAlivePeriod:   15 * time.Second,
+	MaxIdleTimeout:    time.Minute,
+	InitialPacketSize: quicInitialPacketSize,
+	Tracer:            quicPathTracer,
+}
+
+var (
+	quicCertOnce sync.Once
+	quicCert     tls.Certificate
+	quicCertErr  error
+)
+
+// quicServerTLS returns the TLS config QUIC listeners present
+func quicServerTLS() (*tls.Config, error) {
+	quicCertOnce.Do(func() { quicCert, quicCertErr = selfSignedCert() })
+	if quicCertErr != nil {
+		return nil, quicCertErr
+	}
+	return &tls.Config{Certificates: []tls.Certificate{quicCert}, NextProtos: []string{quicALPN}}, nil
+}
+
+func selfSignedCert() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "lumina-net"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(10, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// quicStream adapts one bidirectional stream to net.Conn
+type quicStream struct {
+	*quic.Stream
+	conn *quic.Conn
+}
+
+func (s *quicStream) LocalAddr() net.Addr  { return s.conn.LocalAddr() }
+func (s *quicStream) RemoteAddr() net.Addr { return s.conn.RemoteAddr() }
+
+// Close ends both directions like closing a socket does; closing a QUIC
+// stream on its own only ends what we send
+func (s *quicStream) Close() error {
+	s.CancelRead(0)
+	return s.Stream.Close()
+}
+
+// quicListener accepts streams from any QUIC connection made to it, so the
+// usual accept loop can treat each stream as a connection
+type quicListener struct {
+	pc      net.PacketConn
+	ln      *quic.Listener
+	streams chan net.Conn
+	done    chan struct{}
+	once    sync.Once
+}
+
+// listenQUIC binds a UDP socket on network ("udp", "udp4", "udp6") and
+// serves QUIC on it
+func listenQUIC(network, addr string) (*quicListener, error) {
+	conf, err := quicServerTLS()
+	if err != nil {
+		return nil, err
+	}
+	pc, err := net.ListenPacket(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	ln, err := quic.Listen(pc, conf, quicConfig)
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	l := &quicListener{pc: pc, ln: ln, streams: make(chan net.Conn), done: make(chan struct{})}
+	go l.acceptConns()
+	return l, nil
+}
+
+func (l *quicListener) acceptConns() {
+	defer recoverPanic("quic listener")
+	for {
+		conn, err := l.ln.Accept(context.Background())
+		if err != nil {
+			return
+		}
+		go l.acceptStreams(conn)
+	}
+}
+
+func (l *quicListener) acceptStreams(conn *quic.Conn) {
+	defer recoverPanic("quic connection")
+	for {
+		s, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		go l.greet(&quicStream{Stream: s, conn: conn})
+	}
+}
+
+// greet consumes a new stream's hello and queues it for Accept
+func (l *quicListener) greet(s *quicStream) {
+	defer recoverPanic("quic stream")
+	s.SetReadDeadline(time.Now().Add(defaultDialTimeout))
+	var hello [1]byte
+	if _, err := io.ReadFull(s, hello[:]); err != nil || hello[0] != quicStreamHello {
+		s.Close()
+		return
+	}
+	s.SetReadDeadline(time.Time{})
+	select {
+	case l.streams <- s:
+	case <-l.done:
+		s.Close()
+	}
+}
+
+func (l *quicListener) Accept() (net.Conn, error) {
+	select {
+	case s := <-l.streams:
+		return s, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops the listener along with the QUIC connections made to it,
+// which all share its socket
+func (l *quicListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		l.ln.Close()
+		l.pc.Close()
+	})
+	return nil
+}
+
+func (l *quicListener) Addr() net.Addr { return l.pc.LocalAddr() }
+
+// quicConns holds the outbound QUIC connection to each address
+var quicConns = struct {
+	sync.Mutex
+	m map[string]*quic.Conn
+}{m: make(map[string]*quic.Conn)}
+
+// dialQUIC opens a new stream to addr, reusing the QUIC connection to it
+// when one is up
+func dialQUIC(network, addr string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	raddr, err := net.ResolveUDPAddr(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	key := raddr.String()
+	for attempt := 0; ; attempt++ {
+		conn, err := quicConnTo(ctx, key, attempt > 0)
+		if err != nil {
+			return nil, err
+		}
+		s, err := conn.OpenStreamSync(ctx)
+		if err == nil {
+			qs := &quicStream{Stream: s, conn: conn}
+			if _, err := qs.Write([]byte{quicStreamHello}); err != nil {
+				qs.Close()
+				return nil, err
+			}
+			return qs, nil
+		}
+		if attempt > 0 || ctx.Err() != nil {
+			return nil, err
+		}
+		// The shared connection died since it was last used; dial afresh
+	}
+}
+
+// quicConnTo returns the pooled connection to addr, dialing one if there
+// is none, it has closed or fresh is set
+func quicConnTo(ctx context.Context, addr string, fresh bool) (*quic.Conn, error) {
+	quicConns.Lock()
+	conn := quicConns.m[addr]
+	quicConns.Unlock()
+	if conn != nil && !fresh && conn.Context().Err() == nil {
+		return conn, nil
+	}
+
+	conf := &tls.Config{
+		InsecureSkipVerify: true, // see the note on quicALPN
+		NextProtos:         []string{quicALPN},
+	}
+	conn, err := quic.DialAddr(ctx, addr, conf, quicConfig)
+	if err != nil {
+		return nil, err
+	}
+	quicConns.Lock()
+	if old := quicConns.m[addr]; old != nil && old != conn && !fresh && old.Context().Err() == nil {
+		// Another dial won the race; use its connection
+		quicConns.Unlock()
+		conn.CloseWithError(0, "duplicate")
+		return old, nil
+	}
+	quicConns.m[addr] = conn
+	quicConns.Unlock()
+	context.AfterFunc(conn.Context(), func() {
+		quicConns.Lock()
+		if quicConns.m[addr] == conn {
+			delete(quicConns.m, addr)
+		}
+		quicConns.Unlock()
+	})
+	return conn, nil
+}
+
+// transportNetwork maps a payload's transport and address family to the
+// network dialSpec dials
+func transportNetwork(transport, family string) (string, bool, error) {
+	switch transport {
+	case "", "tcp":
+		network, err := familyNetwork("tcp", family)
+		return network, false, err
+	case "quic":
+		network, err := familyNetwork("udp", family)
+		return network, true, err
+	}
+	return "", false, catalogError(ErrUnsupported, "common.unsupported_transport", "transport", transport)
+}
+
+// listenerPort is the port a TCP or QUIC listener ended up bound to
+func listenerPort(ln net.Listener) int {
+	switch a := ln.Addr().(type) {
+	case *net.TCPAddr:
+		return a.Port
+	case *net.UDPAddr:
+		return a.Port
+	}
+	return 0
+}
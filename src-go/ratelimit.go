@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket capping throughput at a number of bytes per
+// second. A zero rate means unlimited. The bucket holds one second of burst.
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(bytesPerSec int64) *RateLimiter {
+	l := &RateLimiter{}
+	if bytesPerSec > 0 {
+		l.SetRate(bytesPerSec)
+	}
+	return l
+}
+
+func (l *RateLimiter) SetRate(bytesPerSec int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.rate = float64(bytesPerSec)
+	l.tokens = l.rate
+	l.last = time.Now()
+}
+
+func (l *RateLimiter) Rate() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int64(l.rate)
+}
+
+// WaitN blocks until n bytes may pass. Requests larger than the bucket are
+// let through once the resulting debt has been paid off.
+func (l *RateLimiter) WaitN(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	if l.rate <= 0 {
+		l.mu.Unlock()
+		return
+	}
+
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// meterWindow is the span over which Meter averages throughput
+const meterWindow = 5
+
+// Meter tracks recent throughput in one-second buckets
+type Meter struct {
+	mu      sync.Mutex
+	buckets [meterWindow]uint64
+	seconds [meterWindow]int64
+}
+
+func (m *Meter) Add(n int) {
+	if n <= 0 {
+		return
+	}
+	now := time.Now().Unix()
+	i := now % meterWindow
+
+	m.mu.Lock()
+	if m.seconds[i] != now {
+		m.seconds[i] = now
+		m.buckets[i] = 0
+	}
+	m.buckets[i] += uint64(n)
+	m.mu.Unlock()
+}
+
+// Rate returns the average bytes per second over the last complete window
+func (m *Meter) Rate() float64 {
+	now := time.Now().Unix()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var total uint64
+	for i := range m.buckets {
+		// Skip the bucket still filling up and anything older than the window
+		if age := now - m.seconds[i]; age >= 1 && age <= meterWindow {
+			total += m.buckets[i]
+		}
+	}
+	return float64(total) / meterWindow
+}
+
+type SetRateLimitPayload struct {
+	ListenerRef        // listener to cap in aggregate
+	ID          string `json:"id"`            // or a single connection
+	BytesPerSec int64  `json:"bytes_per_sec"` // 0 removes the limit
+}
+
+func handleSetRateLimit(payload json.RawMessage, writer *Output) {
+	var p SetRateLimitPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		sendInvalidPayload(writer, "set_rate_limit")
+		return
+	}
+	if p.BytesPerSec < 0 {
+		sendErrorCode(writer, ErrInvalidArgument, message("common.bytes_per_sec_must"), nil)
+		return
+	}
+
+	switch {
+	case p.ID != "":
+		c, exists := lookupConn(p.ID, writer)
+		if !exists {
+			sendErrorCode(writer, ErrNotFound, message("common.connection_not_found"), nil)
+			return
+		}
+		c.Limiter.SetRate(p.BytesPerSec)
+	case p.ListenerRef.set():
+		state.Mutex.Lock()
+		l, ok := findListenerLocked(p.ListenerRef, writer)
+		state.Mutex.Unlock()
+		if !ok {
+			return
+		}
+		l.Limiter.SetRate(p.BytesPerSec)
+	default:
+		sendErrorCode(writer, ErrInvalidArgument, message("ratelimit.set_rate_limit_requires"), nil)
+		return
+	}
+
+	writer.Encode(okResponse(message("ratelimit.rate_limit_set_bytes", "bytes_per_sec", p.BytesPerSec), nil))
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"sync/atomic"
+)
+
+// Raw channels let the frontend speak its own protocol over a managed
+// connection. set_raw_channel negotiates the terms: the frontend proposes
+// an encoding, base64 (default) or hex, and the largest chunk it wants in
+// one message, and the answer holds what the sidecar will use, the chunk
+// clamped to what the control channel carries comfortably. From then on
+// data arriving on the connection comes as recv events of at most that
+// many bytes, numbered so a gap shows, in place of connection_data, and
+// send_raw takes chunks up to the same size. A "raw" listener hands every
+// accepted connection to the frontend this way, where "echo" answers by
+// itself.
+const (
+	defaultRawChunk = 16 << 10
+	minRawChunk     = 512
+	maxRawChunk     = 1 << 20
+)
+
+// RawChannel is the negotiated framing of a connection's data events
+type RawChannel struct {
+	Encoding string `json:"encoding"`  // "base64" or "hex"
+	MaxChunk int    `json:"max_chunk"` // bytes of data per recv event and send_raw
+
+	seq atomic.Uint64 // recv events emitted so far
+}
+
+// newRawChannel settles a proposal: unknown encodings are refused, the
+// chunk size is clamped
+func newRawChannel(encoding string, maxChunk int) (*RawChannel, error) {
+	switch encoding {
+	case "":
+		encoding = "base64"
+	case "base64", "hex":
+	default:
+		return nil, catalogError(ErrUnsupported, "common.unsupported_encoding", "encoding", encoding)
+	}
+	if maxChunk <= 0 {
+		maxChunk = defaultRawChunk
+	}
+	return &RawChannel{Encoding: encoding, MaxChunk: min(max(maxChunk, minRawChunk), maxRawChunk)}, nil
+}
+
+func (r *RawChannel) encode(b []byte) string {
+	if r.Encoding == "hex" {
+		return hex.EncodeToString(b)
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// emitData reports bytes read from c: as recv events once a raw channel is
+// negotiated, as connection_data before
+func emitData(c *Connection, b []byte) {
+	r := c.raw.Load()
+	if r == nil {
+		emitEvent("connection_data", map[string]interface{}{
+			"id":   c.ID,
+			"data": base64.StdEncoding.EncodeToString(b),
+		})
+		return
+	}
+	for len(b) > 0 {
+		n := min(len(b), r.MaxChunk)
+		emitEvent("recv", map[string]interface{}{
+			"id":       c.ID,
+			"seq":      r.seq.Add(1),
+			"encoding": r.Encoding,
+			"data":     r.encode(b[:n]),
+		})
+		b = b[n:]
+	}
+}
+
+type SetRawChannelPayload struct {
+	ID       string `json:"id"`
+	Encoding string `json:"encoding"`  // "base64" (default) or "hex"
+	MaxChunk int    `json:"max_chunk"` // proposed bytes per message, default 16 KiB
+}
+
+// handleSetRawChannel negotiates a raw channel on a connection; the
+// answer is what was agreed
+func handleSetRawChannel(payload json.RawMessage, writer *Output) {
+	var p SetRawChannelPayload
+	if err := json.Unmarshal(payload, &p); err != nil || p.ID == "" {
+		sendErrorCode(writer, ErrInvalidArgument, message("rawchannel.set_raw_channel_requires_id"), nil)
+		return
+	}
+	if p.MaxChunk < 0 {
+		sendErrorCode(writer, ErrInvalidArgument, message("rawchannel.max_chunk_not_negative"), nil)
+		return
+	}
+	c, exists := lookupConn(p.ID, writer)
+	if !exists {
+		sendErrorCode(writer, ErrNotFound, message("common.connection_not_found"), nil)
+		return
+	}
+	if c.speaksChat() {
+		sendErrorCode(writer, ErrInvalidState, message("rawchannel.speaks_chat"), map[string]interface{}{"id": p.ID})
+		return
+	}
+	r, err := newRawChannel(p.Encoding, p.MaxChunk)
+	if err != nil {
+		sendFailure(writer, err)
+		return
+	}
+	if old := c.raw.Load(); old != nil {
+		// Renegotiating keeps the numbering going
+		r.seq.Store(old.seq.Load())
+	}
+	c.raw.Store(r)
+	writer.Encode(ProtocolResponse{
+		Status: "ok",
+		Data:   map[string]interface{}{"id": p.ID, "encoding": r.Encoding, "max_chunk": r.MaxChunk, "min_chunk": minRawChunk, "limit": maxRawChunk},
+	})
+}
+
+type SendRawPayload struct {
+	ID       string `json:"id"`
+	Data     string `json:"data"`
+	Encoding string `json:"encoding"` // default the channel's, or base64 before one is set
+}
+
+// handleSendRaw writes one chunk of binary data to a connection
+func handleSendRaw(payload json.RawMessage, writer *Output) {
+	var p SendRawPayload
+	if err := json.Unmarshal(payload, &p); err != nil || p.ID == "" {
+		sendErrorCode(writer, ErrInvalidArgument, message("rawchannel.send_raw_requires"), nil)
+		return
+	}
+	c, exists := lookupConn(p.ID, writer)
+	if !exists {
+		sendErrorCode(writer, ErrNotFound, message("common.connection_not_found"), nil)
+		return
+	}
+	limit := defaultRawChunk
+	encoding := "base64"
+	if r := c.raw.Load(); r != nil {
+		limit, encoding = r.MaxChunk, r.Encoding
+	}
+	if p.Encoding != "" {
+		encoding = p.Encoding
+	}
+	if encoding == "utf8" {
+		sendErrorCode(writer, ErrUnsupported, message("common.unsupported_encoding", "encoding", "utf8"), nil)
+		return
+	}
+	data, err := decodeData(p.Data, encoding)
+	if err != nil {
+		sendFailure(writer, err)
+		return
+	}
+	if len(data) > limit {
+		sendErrorCode(writer, ErrInvalidArgument, message("rawchannel.chunk_too_large", "len", len(data), "max", limit), nil)
+		return
+	}
+	if c.writeShut.Load() {
+		sendErrorCode(writer, ErrInvalidState, message("client.sending_side_shut"), map[string]interface{}{"id": p.ID})
+		return
+	}
+	n, err := c.Write(data)
+	if err != nil {
+		sendError(writer, message("client.failed_send", "id", p.ID, "error", err))
+		return
+	}
+	writer.Encode(ProtocolResponse{
+		Status: "ok",
+		Data:   map[string]interface{}{"id": p.ID, "bytes": n},
+	})
+}
+
+// handleRawConnection passes an accepted connection's data to the frontend
+// as recv events, which answers with send_raw
+func handleRawConnection(c *Connection, _ *Listener, _ string) {
+	defer untrackConn(c)
+	r, _ := newRawChannel("", 0)
+	c.raw.Store(r)
+	emitEvent("connection_opened", c.Info())
+
+	buffer := make([]byte, streamBufferSize)
+	for {
+		n, err := c.Read(buffer)
+		if n > 0 {
+			emitData(c, buffer[:n])
+		}
+		if err != nil {
+			holdHalfOpen(c, err)
+			emitClosed(c, err)
+			return
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRawChannelNegotiatesAndChunks(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	c := &Connection{ID: "raw-c", Direction: "outbound", Network: "tcp", Created: time.Now(), Limiter: newRateLimiter(0)}
+	c.setConn(a)
+	state.Mutex.Lock()
+	state.Conns[c.ID] = c
+	state.Mutex.Unlock()
+	defer func() {
+		state.Mutex.Lock()
+		delete(state.Conns, c.ID)
+		state.Mutex.Unlock()
+	}()
+
+	negotiate := func(payload string) map[string]interface{} {
+		var buf bytes.Buffer
+		handleSetRawChannel(json.RawMessage(payload), NewOutput(&buf))
+		var resp ProtocolResponse
+		json.Unmarshal(buf.Bytes(), &resp)
+		data, _ := resp.Data.(map[string]interface{})
+		return data
+	}
+	if got := negotiate(`{"id":"raw-c","max_chunk":10}`); got["max_chunk"] != float64(minRawChunk) || got["encoding"] != "base64" {
+		t.Errorf("small chunk settled as %v", got)
+	}
+	if got := negotiate(`{"id":"raw-c","encoding":"hex","max_chunk":600}`); got["max_chunk"] != float64(600) || got["encoding"] != "hex" {
+		t.Errorf("hex channel settled as %v", got)
+	}
+
+	var events bytes.Buffer
+	saved := output
+	output = NewOutput(&events)
+	emitData(c, bytes.Repeat([]byte{0xab}, 1300))
+	output = saved
+	var sizes []int
+	scanner := bufio.NewScanner(&events)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var ev struct {
+			Event string `json:"event"`
+			Data  struct {
+				Seq  uint64 `json:"seq"`
+				Data string `json:"data"`
+			} `json:"data"`
+		}
+		json.Unmarshal(scanner.Bytes(), &ev)
+		if ev.Event != "recv" {
+			continue
+		}
+		raw, err := hex.DecodeString(ev.Data.Data)
+		if err != nil || ev.Data.Seq != uint64(len(sizes)+1) {
+			t.Errorf("recv %d: seq %d, %v", len(sizes)+1, ev.Data.Seq, err)
+		}
+		sizes = append(sizes, len(raw))
+	}
+	if len(sizes) != 3 || sizes[0] != 600 || sizes[2] != 100 {
+		t.Errorf("1300 bytes arrived in chunks of %v", sizes)
+	}
+
+	var buf bytes.Buffer
+	handleSendRaw(json.RawMessage(`{"id":"raw-c","data":"`+strings.Repeat("00", 601)+`"}`), NewOutput(&buf))
+	if !strings.Contains(buf.String(), `"error"`) {
+		t.Errorf("oversized chunk accepted: %s", buf.String())
+	}
+	got := make(chan []byte, 1)
+	go func() {
+		p := make([]byte, 3)
+		io.ReadFull(b, p)
+		got <- p
+	}()
+	buf.Reset()
+	handleSendRaw(json.RawMessage(`{"id":"raw-c","data":"00ff10"}`), NewOutput(&buf))
+	if p := <-got; !bytes.Equal(p, []byte{0, 0xff, 0x10}) {
+		t.Errorf("peer read %x after %s", p, buf.String())
+	}
+}
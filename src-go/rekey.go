@@ -0,0 +1,362 @@
+package main
+
+import (
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Rekeying gives long encrypted sessions forward secrecy. Either side
+// starts one once it has sealed rekey.bytes under its sending key, held
+// that key for rekey.interval_minutes, or on rekey_connection: it sends a
+// fresh ephemeral X25519 key in a control record, the peer answers with
+// one of its own, and both feed the DH result and the session's root key
+// through HKDF for the next root and a key per direction. The ephemeral
+// keys and the old root are dropped right away, so whoever learns the
+// current keys cannot work back to the ones before the last rekey.
+//
+// The answering side switches its sending key straight after the answer.
+// The starting side switches its receiving key on reading the answer and
+// its sending key after a switch record that tells the peer to follow.
+// When both start at once, the dialer's rekey goes ahead.
+const (
+	rekeyStart  byte = 1 // the starter's ephemeral public key
+	rekeyAnswer byte = 2 // the answerer's ephemeral public key
+	rekeySwitch byte = 3 // records after this one use the new key
+
+	// secureControl marks a record header whose record is a rekey message
+	secureControl = 1 << 31
+
+	defaultRekeyBytes    = 1 << 30
+	defaultRekeyInterval = 30 * time.Minute
+)
+
+var errRekeyProtocol = errors.New("unexpected rekey message")
+
+// RekeyConfig is the config section deciding how often encrypted sessions
+// rekey. Zero values keep the defaults; -1 turns a trigger off.
+type RekeyConfig struct {
+	Bytes           int64 `json:"bytes,omitempty"`            // sealed under one key, default 1 GiB
+	IntervalMinutes int   `json:"interval_minutes,omitempty"` // age of a key, default 30
+}
+
+func (r RekeyConfig) Validate() error {
+	if (r.Bytes < 0 && r.Bytes != -1) || (r.IntervalMinutes < 0 && r.IntervalMinutes != -1) {
+		return catalogError(ErrInvalidArgument, "rekey.must_not_negative")
+	}
+	if r.Bytes > 0 && r.Bytes < secureMaxRecord {
+		return catalogError(ErrInvalidArgument, "rekey.bytes_at_least_one_record")
+	}
+	return nil
+}
+
+// effective fills in the defaults
+func (r RekeyConfig) effective() RekeyConfig {
+	if r.Bytes == 0 {
+		r.Bytes = defaultRekeyBytes
+	}
+	if r.IntervalMinutes == 0 {
+		r.IntervalMinutes = int(defaultRekeyInterval / time.Minute)
+	}
+	return r
+}
+
+// rekeyState is a session's rekeying progress. sent and keyTime belong to
+// the writer, under the connection's writeMu; the rest is guarded by mu.
+type rekeyState struct {
+	policy  RekeyConfig
+	sent    atomic.Uint64 // bytes sealed under the current sending key
+	keyTime time.Time     // when the current sending key took over
+
+	mu        sync.Mutex
+	root      []byte
+	busy      bool             // a rekey is under way
+	ephemeral *ecdh.PrivateKey // ours, while we wait for the answer
+	nextOpen  cipher.AEAD      // the peer's next key, used after its switch
+	pending   *pendingSwitch   // waiting for writeMu
+	rekeys    uint64
+	last      time.Time
+}
+
+func (r *rekeyState) init(root []byte) {
+	r.policy = config.Get().Rekey.effective()
+	r.root = root
+	r.keyTime = time.Now()
+}
+
+// nextKeysLocked derives the next root and a key for each direction of a rekey
+func (r *rekeyState) nextKeysLocked(dh []byte) (toAnswerer, toStarter cipher.AEAD, err error) {
+	material, err := hkdf.Key(sha256.New, dh, r.root, "lumina-net rekey", 3*chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, nil, err
+	}
+	if toAnswerer, err = chacha20poly1305.New(material[:chacha20poly1305.KeySize]); err != nil {
+		return nil, nil, err
+	}
+	if toStarter, err = chacha20poly1305.New(material[chacha20poly1305.KeySize : 2*chacha20poly1305.KeySize]); err != nil {
+		return nil, nil, err
+	}
+	clear(r.root)
+	r.root = material[2*chacha20poly1305.KeySize:]
+	return toAnswerer, toStarter, nil
+}
+
+func (r *rekeyState) finishLocked() {
+	r.busy = false
+	r.rekeys++
+	r.last = time.Now()
+}
+
+// rekeyDueLocked is whether the sending key has done its share; the
+// caller holds writeMu
+func (s *secureConn) rekeyDueLocked() bool {
+	p := s.rekey.policy
+	return (p.Bytes > 0 && s.rekey.sent.Load() >= uint64(p.Bytes)) ||
+		(p.IntervalMinutes > 0 && time.Since(s.rekey.keyTime) >= time.Duration(p.IntervalMinutes)*time.Minute)
+}
+
+// startRekeyLocked sends a fresh ephemeral key unless a rekey is already
+// under way; the caller holds writeMu
+func (s *secureConn) startRekeyLocked() error {
+	s.rekey.mu.Lock()
+	if s.rekey.busy {
+		s.rekey.mu.Unlock()
+		return nil
+	}
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		s.rekey.mu.Unlock()
+		return err
+	}
+	s.rekey.busy, s.rekey.ephemeral = true, ephemeral
+	s.rekey.mu.Unlock()
+	return s.writeFrame(append([]byte{rekeyStart}, ephemeral.PublicKey().Bytes()...), true)
+}
+
+// Rekey starts a rekey now; false means one is already under way
+func (s *secureConn) Rekey() (bool, error) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.rekey.mu.Lock()
+	busy := s.rekey.busy
+	s.rekey.mu.Unlock()
+	if busy {
+		return false, nil
+	}
+	return true, s.startRekeyLocked()
+}
+
+// handleControl acts on a rekey message; it runs on the reading side
+func (s *secureConn) handleControl(msg []byte) error {
+	if len(msg) == 0 {
+		return errRekeyProtocol
+	}
+	r := &s.rekey
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch msg[0] {
+	case rekeyStart:
+		if len(msg) != 33 || r.nextOpen != nil {
+			return errRekeyProtocol
+		}
+		if r.ephemeral != nil {
+			if s.initiator {
+				// Both started; the peer drops its rekey and answers ours
+				return nil
+			}
+			r.ephemeral = nil
+		}
+		peer, err := ecdh.X25519().NewPublicKey(msg[1:])
+		if err != nil {
+			return err
+		}
+		ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return err
+		}
+		dh, err := ephemeral.ECDH(peer)
+		if err != nil {
+			return err
+		}
+		toAnswerer, toStarter, err := r.nextKeysLocked(dh)
+		if err != nil {
+			return err
+		}
+		r.busy, r.nextOpen = true, toAnswerer
+		s.queueSwitchLocked(append([]byte{rekeyAnswer}, ephemeral.PublicKey().Bytes()...), toStarter, false)
+
+	case rekeyAnswer:
+		if len(msg) != 33 || r.ephemeral == nil {
+			return errRekeyProtocol
+		}
+		peer, err := ecdh.X25519().NewPublicKey(msg[1:])
+		if err != nil {
+			return err
+		}
+		dh, err := r.ephemeral.ECDH(peer)
+		if err != nil {
+			return err
+		}
+		r.ephemeral = nil
+		toAnswerer, toStarter, err := r.nextKeysLocked(dh)
+		if err != nil {
+			return err
+		}
+		s.open, s.readSeq = toStarter, 0
+		s.queueSwitchLocked([]byte{rekeySwitch}, toAnswerer, true)
+
+	case rekeySwitch:
+		if r.nextOpen == nil {
+			return errRekeyProtocol
+		}
+		s.open, s.readSeq = r.nextOpen, 0
+		r.nextOpen = nil
+		r.finishLocked()
+
+	default:
+		return errRekeyProtocol
+	}
+	return nil
+}
+
+// pendingSwitch is a rekey message to write under the current sending
+// key, after which seal takes over
+type pendingSwitch struct {
+	msg    []byte
+	seal   cipher.AEAD
+	finish bool // the rekey is complete once it is written
+}
+
+// queueSwitchLocked queues msg and the key change after it; the caller
+// holds rekey.mu. Whichever gets writeMu first applies it: the goroutine
+// started here or a Write between two records.
+func (s *secureConn) queueSwitchLocked(msg []byte, seal cipher.AEAD, finish bool) {
+	s.rekey.pending = &pendingSwitch{msg: msg, seal: seal, finish: finish}
+	// Written from its own goroutine so a reader never waits on the
+	// writer, which may be stuck behind a slow peer
+	go func() {
+		s.writeMu.Lock()
+		defer s.writeMu.Unlock()
+		s.applySwitchLocked()
+	}()
+}
+
+// applySwitchLocked writes a queued rekey message and changes the sending
+// key; the caller holds writeMu
+func (s *secureConn) applySwitchLocked() error {
+	s.rekey.mu.Lock()
+	p := s.rekey.pending
+	s.rekey.pending = nil
+	s.rekey.mu.Unlock()
+	if p == nil {
+		return nil
+	}
+	err := s.writeFrame(p.msg, true)
+	s.seal, s.writeSeq = p.seal, 0
+	s.rekey.sent.Store(0)
+	s.rekey.keyTime = time.Now()
+	if p.finish {
+		s.rekey.mu.Lock()
+		s.rekey.finishLocked()
+		s.rekey.mu.Unlock()
+	}
+	return err
+}
+
+// SessionInfo describes the keys of an encrypted session
+type SessionInfo struct {
+	Cipher          string     `json:"cipher"`
+	Rekeys          uint64     `json:"rekeys"`
+	LastRekey       *time.Time `json:"last_rekey,omitempty"`
+	Rekeying        bool       `json:"rekeying"`
+	BytesSinceRekey uint64     `json:"bytes_since_rekey"` // sealed under the current sending key
+	RekeyBytes      int64      `json:"rekey_bytes"`       // -1 when only time triggers a rekey
+	RekeyIntervalMs int64      `json:"rekey_interval_ms"` // -1 when only bytes do
+
+	// The peer's clock minus ours and the round trip it was measured
+	// over, from the handshake; see clock.go. Both are 0 and clock_measured
+	// false when the peer's hello did not offer the exchange.
+	ClockMeasured    bool  `json:"clock_measured"`
+	ClockOffsetMs    int64 `json:"clock_offset_ms"`
+	ClockRoundTripMs int64 `json:"clock_round_trip_ms"`
+}
+
+func (s *secureConn) Session() *SessionInfo {
+	info := &SessionInfo{
+		Cipher:           "x25519-chacha20poly1305",
+		BytesSinceRekey:  s.rekey.sent.Load(),
+		RekeyBytes:       s.rekey.policy.Bytes,
+		RekeyIntervalMs:  -1,
+		ClockMeasured:    !s.clock.At.IsZero(),
+		ClockOffsetMs:    s.clock.Offset.Milliseconds(),
+		ClockRoundTripMs: s.clock.RoundTrip.Milliseconds(),
+	}
+	if m := s.rekey.policy.IntervalMinutes; m > 0 {
+		info.RekeyIntervalMs = (time.Duration(m) * time.Minute).Milliseconds()
+	}
+	s.rekey.mu.Lock()
+	info.Rekeys, info.Rekeying = s.rekey.rekeys, s.rekey.busy
+	if !s.rekey.last.IsZero() {
+		last := s.rekey.last
+		info.LastRekey = &last
+	}
+	s.rekey.mu.Unlock()
+	return info
+}
+
+// secureOf finds the encryption layer of a connection, if it has one
+func secureOf(conn net.Conn) *secureConn {
+	for {
+		switch w := conn.(type) {
+		case *secureConn:
+			return w
+		case *compressedConn:
+			conn = w.Conn
+		default:
+			return nil
+		}
+	}
+}
+
+type RekeyConnectionPayload struct {
+	ID string `json:"id"`
+}
+
+// handleRekeyConnection rekeys an encrypted connection now rather than
+// waiting for its byte or time trigger
+func handleRekeyConnection(payload json.RawMessage, writer *Output) {
+	var p RekeyConnectionPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		sendInvalidPayload(writer, "rekey_connection")
+		return
+	}
+	c, ok := lookupConn(p.ID, writer)
+	if !ok {
+		sendErrorCode(writer, ErrNotFound, message("common.connection_not_found"), nil)
+		return
+	}
+	s := secureOf(c.Conn())
+	if s == nil {
+		sendErrorCode(writer, ErrInvalidState, message("rekey.connection_not_encrypted"), map[string]interface{}{"id": p.ID})
+		return
+	}
+	// The write can wait behind a slow peer; the session info tells when
+	// the rekey is done
+	go func() {
+		if _, err := s.Rekey(); err != nil {
+			logger.Warn("rekey failed", "id", c.ID, "error", err)
+		}
+	}()
+	writer.Encode(okResponse(message("rekey.started"), map[string]interface{}{"id": c.ID, "session": s.Session()}))
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var relaySeq atomic.Uint64
+
+// Relay pipes every connection accepted on its listener to a fixed target
+type Relay struct {
+	ID       string
+	Target   string
+	Listener *Listener
+	Created  time.Time
+
+	Up       atomic.Uint64 // bytes from clients to the target
+	Down     atomic.Uint64 // bytes from the target back to clients
+	Sessions atomic.Uint64
+
+	dialTimeout time.Duration
+
+	mu     sync.Mutex
+	active map[*Connection]*Connection // client -> target for live sessions
+}
+
+// RelayInfo is the JSON view of a Relay
+type RelayInfo struct {
+	ID         string    `json:"id"`
+	Listen     string    `json:"listen"`
+	ListenerID string    `json:"listener_id"`
+	Target     string    `json:"target"`
+	Created    time.Time `json:"created"`
+	Sessions   uint64    `json:"sessions"`
+	Active     int       `json:"active"`
+	BytesUp    uint64    `json:"bytes_up"`
+	BytesDown  uint64    `json:"bytes_down"`
+}
+
+func (r *Relay) Info() RelayInfo {
+	r.mu.Lock()
+	active := len(r.active)
+	r.mu.Unlock()
+
+	return RelayInfo{
+		ID:         r.ID,
+		Listen:     r.Listener.Addr,
+		ListenerID: r.Listener.ID,
+		Target:     r.Target,
+		Created:    r.Created,
+		Sessions:   r.Sessions.Load(),
+		Active:     active,
+		BytesUp:    r.Up.Load(),
+		BytesDown:  r.Down.Load(),
+	}
+}
+
+type StartRelayPayload struct {
+	Host           string         `json:"host"` // bind address, empty for all interfaces
+	Port           int            `json:"port"` // 0 picks a free port
+	TargetHost     string         `json:"target_host"`
+	TargetPort     int            `json:"target_port"`
+	TimeoutMs      int            `json:"timeout_ms"` // dial timeout for the target
+	MaxConnections int            `json:"max_connections"`
+	Timeouts       TimeoutOptions `json:"timeouts"`
+}
+
+func handleStartRelay(payload json.RawMessage, writer *Output) {
+	var p StartRelayPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		sendInvalidPayload(writer, "start_relay")
+		return
+	}
+	if p.TargetHost == "" || p.TargetPort <= 0 {
+		sendErrorCode(writer, ErrInvalidArgument, message("relay.start_relay_requires_target"), nil)
+		return
+	}
+	if p.MaxConnections < 0 {
+		sendErrorCode(writer, ErrInvalidArgument, message("common.max_connections_must_not"), nil)
+		return
+	}
+	dialTimeout := defaultDialTimeout
+	if p.TimeoutMs > 0 {
+		dialTimeout = time.Duration(p.TimeoutMs) * time.Millisecond
+	}
+
+	var failed bindFailure
+	defer failed.send(writer)
+	state.Mutex.Lock()
+	defer state.Mutex.Unlock()
+
+	addr := listenAddr(p.Host, p.Port)
+	if other := conflictLocked(addr, "tcp", familyDual); other != nil {
+		sendErrorCode(writer, ErrAlreadyRunning, message("common.server_already_running", "addr", addr),
+			map[string]interface{}{"addr": addr, "listener_id": other.ID})
+		return
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		failed = bindFailure{addr, err}
+		return
+	}
+	addr = listenAddr(p.Host, ln.Addr().(*net.TCPAddr).Port)
+
+	l := &Listener{
+		Addr:         addr,
+		Type:         "relay",
+		Limiter:      newRateLimiter(config.Get().RateLimits.Listener),
+		Timeouts:     p.Timeouts.Apply(defaultTimeouts),
+		Gate:         &Gate{max: p.MaxConnections},
+		OverLimit:    overLimitRefuse,
+		QueueTimeout: defaultQueueTimeout,
+		ln:           ln,
+	}
+	r := &Relay{
+		ID:          fmt.Sprintf("relay-%d", relaySeq.Add(1)),
+		Target:      net.JoinHostPort(p.TargetHost, strconv.Itoa(p.TargetPort)),
+		Listener:    l,
+		Created:     time.Now(),
+		dialTimeout: dialTimeout,
+		active:      make(map[*Connection]*Connection),
+	}
+	l.relay = r
+	l.assignID()
+	state.Listeners[l.ID] = l
+	state.Relays[r.ID] = r
+
+	go func() {
+		defer recoverPanic("relay " + r.ID)
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return // Listener closed
+			}
+			c, running := acceptConn(conn, l)
+			if !running {
+				return
+			}
+			if c != nil {
+				go r.serve(c)
+			}
+		}
+	}()
+	logger.Info("relay started", "id", r.ID, "addr", addr, "target", r.Target)
+
+	writer.Encode(okResponse(message("relay.relaying_addr_target", "addr", addr, "target", r.Target), r.Info()))
+}
+
+// serve dials the target for one client and copies both ways until either
+// side closes
+func (r *Relay) serve(client *Connection) {
+	defer recoverConn(client)
+	defer untrackConn(client)
+
+	conn, err := net.DialTimeout("tcp", r.Target, r.dialTimeout)
+	if err != nil {
+		logger.Warn("relay target unreachable", "id", r.ID, "target", r.Target, "error", err)
+		emitEvent("relay_session_failed", map[string]interface{}{
+			"relay": r.ID, "client": client.ID, "error": err.Error(),
+		})
+		return
+	}
+	target := trackConn(conn, "outbound", "tcp", nil)
+	if target == nil {
+		conn.Close()
+		return
+	}
+	defer untrackConn(target)
+
+	r.Sessions.Add(1)
+	r.mu.Lock()
+	r.active[client] = target
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		delete(r.active, client)
+		r.mu.Unlock()
+	}()
+
+	emitEvent("relay_session_opened", map[string]interface{}{
+		"relay":  r.ID,
+		"client": client.ID,
+		"target": target.ID,
+		"remote": client.RemoteAddr().String(),
+	})
+
+	done := make(chan struct{}, 2)
+	pipe := func(dst, src *Connection, total *atomic.Uint64) {
+		io.CopyBuffer(countingWriter{w: dst, n: total}, src, make([]byte, streamBufferSize))
+		done <- struct{}{}
+	}
+	go pipe(target, client, &r.Up)
+	go pipe(client, target, &r.Down)
+
+	// Once either direction ends the session is over
+	<-done
+	client.Close()
+	target.Close()
+	<-done
+
+	emitEvent("relay_session_closed", map[string]interface{}{
+		"relay":      r.ID,
+		"client":     client.ID,
+		"bytes_up":   target.BytesOut.Load(),
+		"bytes_down": target.BytesIn.Load(),
+	})
+}
+
+// countingWriter adds every byte written through it to n
+type countingWriter struct {
+	w io.Writer
+	n *atomic.Uint64
+}
+
+func (cw countingWriter) Write(b []byte) (int, error) {
+	n, err := cw.w.Write(b)
+	cw.n.Add(uint64(n))
+	return n, err
+}
+
+// stopLocked closes the relay's listener and every live session.
+// Callers hold state.Mutex.
+func (r *Relay) stopLocked() {
+	r.Listener.ln.Close()
+	delete(state.Listeners, r.Listener.ID)
+	delete(state.Relays, r.ID)
+
+	r.mu.Lock()
+	for client, target := range r.active {
+		client.Abort()
+		target.Abort()
+	}
+	r.mu.Unlock()
+	logger.Info("relay stopped", "id", r.ID, "addr", r.Listener.Addr)
+}
+
+type StopRelayPayload struct {
+	ID string `json:"id"`
+}
+
+func handleStopRelay(payload json.RawMessage, writer *Output) {
+	var p StopRelayPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		sendInvalidPayload(writer, "stop_relay")
+		return
+	}
+
+	state.Mutex.Lock()
+	defer state.Mutex.Unlock()
+
+	r, exists := state.Relays[p.ID]
+	if !exists {
+		sendErrorCode(writer, ErrNotFound, message("relay.not_found"), nil)
+		return
+	}
+	r.stopLocked()
+
+	writer.Encode(okResponse(message("relay.stopped"), r.Info()))
+}
+
+func handleListRelays(writer *Output) {
+	state.Mutex.Lock()
+	list := make([]RelayInfo, 0, len(state.Relays))
+	for _, r := range state.Relays {
+		list = append(list, r.Info())
+	}
+	state.Mutex.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+
+	writer.Encode(ProtocolResponse{
+		Status: "ok",
+		Data:   map[string]interface{}{"relays": list},
+	})
+}
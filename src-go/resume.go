@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// resumeChunkSize is how much data is received between checkpoints; an
+// interrupted transfer loses at most this much
+const resumeChunkSize = 4 << 20
+
+// partialSuffix marks the sidecar that makes a .part file resumable
+const partialSuffix = ".part.json"
+
+// errResumeMismatch means the receiver's partial copy is not a prefix of
+// the file being sent, so it has to start over
+var errResumeMismatch = errors.New("partial copy on receiver does not match")
+
+// partialState is persisted next to a partial download after every chunk
+type partialState struct {
+	Key       string    `json:"key"`
+	Name      string    `json:"name"`
+	Path      string    `json:"path"` // final destination
+	Size      int64     `json:"size"`
+	Offset    int64     `json:"offset"` // bytes known to be on disk in the .part file
+	Hash      []byte    `json:"hash"`   // SHA-256 state after Offset bytes
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// transferKey identifies a source file across attempts, including after a
+// restart of either side, and changes when the file is modified
+func transferKey(path string, info os.FileInfo) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s|%d|%d", path, info.Size(), info.ModTime().UnixNano())))
+	return hex.EncodeToString(sum[:16])
+}
+
+// findPartial looks in dir for a resumable download with the given key
+func findPartial(dir, key string) (*partialState, bool) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, false
+	}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), partialSuffix) {
+			continue
+		}
+		st, err := loadPartial(filepath.Join(dir, entry.Name()))
+		if err == nil && st.Key == key {
+			return st, true
+		}
+	}
+	return nil, false
+}
+
+func loadPartial(path string) (*partialState, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var st partialState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+// save writes the sidecar atomically so a crash never leaves it half written
+func (st *partialState) save() error {
+	st.UpdatedAt = time.Now()
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	sidecar := st.Path + partialSuffix
+	if err := os.WriteFile(sidecar+".tmp", data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(sidecar+".tmp", sidecar)
+}
+
+// isPartialName reports whether a file in a download directory is an
+// unfinished download or its bookkeeping
+func isPartialName(name string) bool {
+	return strings.HasSuffix(name, ".part") || strings.HasSuffix(name, partialSuffix) ||
+		strings.HasSuffix(name, partialSuffix+".tmp")
+}
+
+func (st *partialState) remove() {
+	os.Remove(st.Path + ".part")
+	os.Remove(st.Path + partialSuffix)
+}
+
+// receiveResumable receives a keyed file, checkpointing into a sidecar so a
+// later attempt with the same key can continue where this one stopped
+func receiveResumable(c *Connection, t *Transfer, r *bufio.Reader, dir string, header TransferHeader) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	h := sha256.New()
+	st, f, err := reopenPartial(dir, header, h)
+	if err != nil {
+		return err
+	}
+	if f == nil {
+		// Fresh attempt: anything kept for this key is stale now
+		if old, ok := findPartial(dir, header.Key); ok {
+			old.remove()
+		}
+		path, err := safeJoin(dir, t.Name)
+		if err == nil {
+			path, err = uniquePath(path)
+		}
+		if err != nil {
+			return err
+		}
+		st = &partialState{Key: header.Key, Name: t.Name, Path: path, Size: header.Size}
+		if f, err = os.Create(path + ".part"); err != nil {
+			return err
+		}
+	}
+	defer f.Close()
+
+	t.mu.Lock()
+	t.Path = st.Path
+	t.Key = st.Key
+	t.ResumedFrom = st.Offset
+	t.mu.Unlock()
+	t.bytes.Store(st.Offset)
+
+	body, finish, pr, err := openBody(c, t, r, header, st.Offset, hex.EncodeToString(h.Sum(nil)))
+	if header.Pausable {
+		defer t.disablePause(nil)
+	}
+	if err != nil {
+		return err
+	}
+	if err := st.save(); err != nil {
+		return err
+	}
+	emitEvent("transfer_started", t.Info())
+
+	done := make(chan struct{})
+	go t.reportProgress(done)
+	cw := &checkpointWriter{f: f, h: h, st: st}
+	_, err = io.CopyBuffer(progressWriter{w: cw, t: t}, io.LimitReader(body, header.Size-st.Offset), make([]byte, transferBufferSize))
+	close(done)
+	if err == nil && st.Offset+cw.pending == header.Size {
+		err = finish()
+	}
+	if err == nil && pr != nil && st.Offset+cw.pending == header.Size {
+		err = pr.finish()
+	}
+	t.disablePause(nil)
+	if err == nil && header.Verify && st.Offset+cw.pending == header.Size {
+		if err = verifyTrailer(t, r, st.Path, hex.EncodeToString(h.Sum(nil))); errors.Is(err, errChecksumMismatch) {
+			// The data on disk is wrong, so resuming from it would not help
+			f.Close()
+			st.remove()
+			return err
+		}
+	}
+
+	if err == nil && st.Offset+cw.pending != header.Size {
+		err = fmt.Errorf("connection closed after %d of %d bytes", st.Offset+cw.pending, header.Size)
+	}
+	if err != nil {
+		// Keep what arrived so resume_transfer can pick it up
+		if cerr := cw.checkpoint(); cerr != nil {
+			logger.Warn("failed to save transfer checkpoint", "id", t.ID, "error", cerr)
+		}
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := finalizeReceived(t, st.Path+".part", st.Path); err != nil {
+		var pe *PolicyError
+		if errors.As(err, &pe) {
+			st.remove() // nothing left to resume
+		}
+		return err
+	}
+	os.Remove(st.Path + partialSuffix)
+	if header.Verify {
+		t.mu.Lock()
+		t.SHA256 = hex.EncodeToString(h.Sum(nil))
+		t.mu.Unlock()
+	}
+	return nil
+}
+
+// openBody answers a keyed header and returns the body that follows it,
+// with finish checking the end of a compressed body and pr the framing of a
+// pausable one. offset and sum are what the receiver already holds of the
+// file, for a resume. The caller disables pausing when done.
+func openBody(c *Connection, t *Transfer, r *bufio.Reader, header TransferHeader, offset int64, sum string) (io.Reader, func() error, *pausableReader, error) {
+	compression := supportedCompression(header.Compression)
+	if header.Resume || header.Compression != "" || header.Pausable {
+		ack := TransferAck{Status: "ok", Compression: compression, Pausable: header.Pausable,
+			ChunkChecksums: header.Pausable && header.ChunkChecksums}
+		if header.Resume {
+			ack.Offset, ack.SHA256 = offset, sum
+		}
+		line, _ := json.Marshal(ack)
+		if _, err := c.Write(append(line, '\n')); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	t.setCompression(compression)
+	var framed io.Reader = r
+	var pr *pausableReader
+	if header.Pausable {
+		back := &backChannel{c: c}
+		pr = &pausableReader{r: r, t: t}
+		if header.ChunkChecksums {
+			pr.back, pr.expect = back.send, 1
+		}
+		framed = pr
+		t.enablePause(c, back.pause)
+	}
+	body, finish, err := bodyReader(framed, compression, &t.wire)
+	return body, finish, pr, err
+}
+
+// verifyTrailer reads the sender's digest after the body and compares it
+// with what was stored
+func verifyTrailer(t *Transfer, r *bufio.Reader, path, actual string) error {
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return err
+	}
+	var trailer transferTrailer
+	if err := json.Unmarshal(line, &trailer); err != nil || trailer.SHA256 == "" {
+		return errors.New("invalid transfer trailer")
+	}
+	if !strings.EqualFold(trailer.SHA256, actual) {
+		emitVerifyFailed(t, path, hashSHA256, strings.ToLower(trailer.SHA256), actual)
+		return &checksumError{name: t.Name, expected: trailer.SHA256, actual: actual}
+	}
+	return nil
+}
+
+// reopenPartial restores the partial file and hash state for a resume
+// request. It returns a nil file when there is nothing to resume.
+func reopenPartial(dir string, header TransferHeader, h hash.Hash) (*partialState, *os.File, error) {
+	if !header.Resume {
+		return nil, nil, nil
+	}
+	st, ok := findPartial(dir, header.Key)
+	if !ok || st.Size != header.Size {
+		return nil, nil, nil
+	}
+	if err := h.(encoding.BinaryUnmarshaler).UnmarshalBinary(st.Hash); err != nil {
+		h.Reset()
+		return nil, nil, nil
+	}
+
+	f, err := os.OpenFile(st.Path+".part", os.O_RDWR, 0o644)
+	if err != nil {
+		h.Reset()
+		return nil, nil, nil
+	}
+	// A partial file shorter than its checkpoint lost data the hash state
+	// vouches for; extending it would fill the gap with zeros
+	if info, err := f.Stat(); err != nil || info.Size() < st.Offset {
+		f.Close()
+		h.Reset()
+		return nil, nil, nil
+	}
+	// Anything past the last checkpoint may be torn, so drop it
+	if err := f.Truncate(st.Offset); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if _, err := f.Seek(st.Offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return st, f, nil
+}
+
+// checkpointWriter appends to the partial file and saves its state every
+// resumeChunkSize bytes
+type checkpointWriter struct {
+	f       *os.File
+	h       hash.Hash
+	st      *partialState
+	pending int64 // bytes written since the last checkpoint
+}
+
+func (w *checkpointWriter) Write(b []byte) (int, error) {
+	n, err := w.f.Write(b)
+	w.h.Write(b[:n])
+	w.pending += int64(n)
+	if err != nil {
+		return n, err
+	}
+	if w.pending >= resumeChunkSize {
+		if err := w.checkpoint(); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// checkpoint makes the data durable before recording it in the sidecar
+func (w *checkpointWriter) checkpoint() error {
+	if w.pending == 0 {
+		return nil
+	}
+	if err := w.f.Sync(); err != nil {
+		return err
+	}
+	state, err := w.h.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return err
+	}
+	w.st.Offset += w.pending
+	w.st.Hash = state
+	w.pending = 0
+	return w.st.save()
+}
+
+// skipVerifiedPrefix checks that the receiver's partial copy matches the
+// start of f and positions f right after it, leaving the prefix in h
+func skipVerifiedPrefix(t *Transfer, f *os.File, ack TransferAck, h hash.Hash) error {
+	if ack.Offset <= 0 {
+		return nil
+	}
+	if ack.Offset > t.Size {
+		return errResumeMismatch
+	}
+	if _, err := io.CopyN(h, f, ack.Offset); err != nil {
+		return err
+	}
+	if hex.EncodeToString(h.Sum(nil)) != ack.SHA256 {
+		return errResumeMismatch
+	}
+
+	t.mu.Lock()
+	t.ResumedFrom = ack.Offset
+	t.mu.Unlock()
+	t.bytes.Store(ack.Offset)
+	logger.Info("resuming transfer", "id", t.ID, "name", t.Name, "offset", ack.Offset)
+	return nil
+}
+
+type ResumeTransferPayload struct {
+	ID string `json:"id"`
+
+	// Host and port redirect a failed send to a receiver whose address
+	// changed; the transfer session lets it continue there
+	Host string `json:"host"`
+	Port int    `json:"port"`
+}
+
+// handleResumeTransfer continues a transfer paused with pause_transfer, or
+// retries a failed send from whatever the receiver already holds
+func handleResumeTransfer(payload json.RawMessage, writer *Output) {
+	var p ResumeTransferPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		sendInvalidPayload(writer, "resume_transfer")
+		return
+	}
+
+	t, exists := lookupTransfer(p.ID, writer)
+	if !exists {
+		sendErrorCode(writer, ErrNotFound, message("common.transfer_not_found"), nil)
+		return
+	}
+	info := t.Info()
+	if info.State == "active" && info.Files == 0 {
+		// Still connected, so only a pause can be holding it up
+		resumePaused(t, writer)
+		return
+	}
+	if t.download != nil {
+		resumeDownload(t, writer)
+		return
+	}
+	if info.Direction != "send" || info.Key == "" || info.Files > 0 {
+		sendErrorCode(writer, ErrInvalidArgument, message("resume.only_single_file_sends"), nil)
+		return
+	}
+	if info.State != "failed" && info.State != "canceled" {
+		sendErrorCode(writer, ErrInvalidState, message("resume.transfer_not_failed_canceled", "state", info.State), nil)
+		return
+	}
+
+	f, err := os.Open(info.Path)
+	if err != nil {
+		sendError(writer, message("common.failed_open", "path", info.Path, "error", err))
+		return
+	}
+	stat, err := f.Stat()
+	if err != nil || transferKey(info.Path, stat) != info.Key {
+		f.Close()
+		sendError(writer, message("resume.file_changed_since_transfer", "path", info.Path))
+		return
+	}
+
+	spec, err := redirectSpec(t.spec, p.Host, p.Port)
+	if err != nil {
+		f.Close()
+		sendFailure(writer, err)
+		return
+	}
+	startSendFile(writer, f, stat, info.Name, info.Path, spec, t.compression, true, t.ID, t.priority())
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// resumeTestSize spans more than one checkpoint
+const resumeTestSize = resumeChunkSize + resumeChunkSize/2 + 1234
+
+// startReceiver runs a transfer listener on loopback that stores into dir
+func startReceiver(t *testing.T, dir string) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			if c := trackConn(conn, "inbound", "tcp", nil); c != nil {
+				go handleTransferConnection(c, dir)
+			}
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// cuttingProxy forwards connections to target. The first one is dropped
+// after limit bytes have gone from the sender to the receiver; later
+// ones, like a retry, pass untouched.
+func cuttingProxy(t *testing.T, target string, limit int64) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for first := true; ; first = false {
+			client, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			server, err := net.Dial("tcp", target)
+			if err != nil {
+				client.Close()
+				continue
+			}
+			go func(first bool) {
+				defer client.Close()
+				defer server.Close()
+				go io.Copy(client, server)
+				if first {
+					io.CopyN(server, client, limit)
+				} else {
+					io.Copy(server, client)
+				}
+			}(first)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func writeSource(t *testing.T, path string, size int) string {
+	t.Helper()
+	data := make([]byte, size)
+	rand.Read(data)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return sha256File(t, path)
+}
+
+func sha256File(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// sendTo runs one send of path to addr the way send_file does, registering
+// the transfer so resume_transfer can find it
+func sendTo(t *testing.T, path, addr string, resume bool) (*Transfer, error) {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := newTransfer("send", filepath.Base(path), path, addr, info.Size())
+	tr.spec = dialSpec{Network: "tcp", Addr: addr, Timeout: 5 * time.Second}
+	tr.Key = transferKey(path, info)
+	err = sendFile(context.Background(), tr, f, tr.spec, resume)
+	tr.finish(err)
+	waitReceivers(t)
+	return tr, err
+}
+
+// waitReceivers waits until no receive is still active, so checkpoints
+// written after a dropped connection are on disk
+func waitReceivers(t *testing.T) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		active := false
+		transfersMu.Lock()
+		for _, tr := range transfers {
+			if info := tr.Info(); info.Direction == "receive" && info.State == "active" {
+				active = true
+			}
+		}
+		transfersMu.Unlock()
+		if !active {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("receiver did not finish")
+}
+
+// interrupt sends src through a proxy that drops the connection part way
+// and returns the failed transfer and the checkpoint the receiver kept
+func interrupt(t *testing.T, src, dir, addr string) (*Transfer, *partialState) {
+	t.Helper()
+	tr, err := sendTo(t, src, cuttingProxy(t, addr, resumeChunkSize+resumeChunkSize/4), false)
+	if err == nil {
+		t.Fatal("transfer through the cutting proxy succeeded")
+	}
+	st, ok := findPartial(dir, tr.Info().Key)
+	if !ok {
+		t.Fatal("receiver kept no checkpoint")
+	}
+	if st.Offset <= 0 || st.Offset >= resumeTestSize {
+		t.Fatalf("checkpoint offset %d outside (0, %d)", st.Offset, resumeTestSize)
+	}
+	return tr, st
+}
+
+func checkReceived(t *testing.T, dir, name, want string) {
+	t.Helper()
+	got := filepath.Join(dir, name)
+	if sum := sha256File(t, got); sum != want {
+		t.Fatalf("received file hashes to %s, want %s", sum, want)
+	}
+	for _, leftover := range []string{got + ".part", got + partialSuffix} {
+		if _, err := os.Stat(leftover); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s left behind after completion", filepath.Base(leftover))
+		}
+	}
+}
+
+func TestResumeAfterInterruption(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "source.bin")
+	want := writeSource(t, src, resumeTestSize)
+	dir := t.TempDir()
+	addr := startReceiver(t, dir)
+
+	_, st := interrupt(t, src, dir, addr)
+	tr, err := sendTo(t, src, addr, true)
+	if err != nil {
+		t.Fatalf("resumed send failed: %v", err)
+	}
+	if info := tr.Info(); info.ResumedFrom != st.Offset || info.Bytes != resumeTestSize {
+		t.Fatalf("resumed from %d with %d bytes counted, want %d and %d",
+			info.ResumedFrom, info.Bytes, st.Offset, resumeTestSize)
+	}
+	if tr.Info().SHA256 != want {
+		t.Fatalf("sender reports %s, want %s", tr.Info().SHA256, want)
+	}
+	checkReceived(t, dir, "source.bin", want)
+}
+
+func TestResumeWithPartialShorterThanCheckpoint(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "source.bin")
+	want := writeSource(t, src, resumeTestSize)
+	dir := t.TempDir()
+	addr := startReceiver(t, dir)
+
+	_, st := interrupt(t, src, dir, addr)
+	// The checkpoint promises more than the disk holds, so the prefix it
+	// vouches for is gone and the receiver has to start over
+	if err := os.Truncate(st.Path+".part", st.Offset/2); err != nil {
+		t.Fatal(err)
+	}
+	tr, err := sendTo(t, src, addr, true)
+	if err != nil {
+		t.Fatalf("resumed send failed: %v", err)
+	}
+	if from := tr.Info().ResumedFrom; from != 0 {
+		t.Fatalf("resumed from %d over a truncated partial, want a fresh start", from)
+	}
+	checkReceived(t, dir, "source.bin", want)
+}
+
+func TestResumeWithPartialLongerThanCheckpoint(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "source.bin")
+	want := writeSource(t, src, resumeTestSize)
+	dir := t.TempDir()
+	addr := startReceiver(t, dir)
+
+	_, st := interrupt(t, src, dir, addr)
+	// Bytes past the checkpoint may be torn; they must be dropped, not kept
+	f, err := os.OpenFile(st.Path+".part", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(bytes.Repeat([]byte{0xff}, 64<<10))
+	f.Close()
+
+	tr, err := sendTo(t, src, addr, true)
+	if err != nil {
+		t.Fatalf("resumed send failed: %v", err)
+	}
+	if from := tr.Info().ResumedFrom; from != st.Offset {
+		t.Fatalf("resumed from %d, want the checkpoint at %d", from, st.Offset)
+	}
+	checkReceived(t, dir, "source.bin", want)
+}
+
+// resumeByCommand runs resume_transfer for failed and waits for the retry
+func resumeByCommand(t *testing.T, failed *Transfer) (TransferInfo, ProtocolResponse) {
+	t.Helper()
+	var buf bytes.Buffer
+	payload, _ := json.Marshal(ResumeTransferPayload{ID: failed.ID})
+	handleResumeTransfer(payload, NewOutput(&buf))
+
+	var resp struct {
+		ProtocolResponse
+		Data TransferInfo `json:"data"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &resp); err != nil {
+		t.Fatalf("bad response %q: %v", buf.String(), err)
+	}
+	if resp.Status != "ok" {
+		return TransferInfo{}, resp.ProtocolResponse
+	}
+	transfersMu.Lock()
+	retry := transfers[resp.Data.ID]
+	transfersMu.Unlock()
+	deadline := time.Now().Add(10 * time.Second)
+	for retry.Info().State == "active" {
+		if time.Now().After(deadline) {
+			t.Fatal("resumed transfer did not finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	waitReceivers(t)
+	return retry.Info(), resp.ProtocolResponse
+}
+
+func TestResumeRestartsWhenSourceContentChanged(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "source.bin")
+	writeSource(t, src, resumeTestSize)
+	dir := t.TempDir()
+	addr := startReceiver(t, dir)
+
+	failed, _ := interrupt(t, src, dir, addr)
+	// Rewrite the start of the file but keep its size and mtime, so the
+	// key still matches and only the prefix hash can catch the change
+	stat, _ := os.Stat(src)
+	f, err := os.OpenFile(src, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt(bytes.Repeat([]byte("changed"), 1000), 0)
+	f.Close()
+	os.Chtimes(src, stat.ModTime(), stat.ModTime())
+	want := sha256File(t, src)
+
+	info, resp := resumeByCommand(t, failed)
+	if resp.Status != "ok" || info.State != "completed" {
+		t.Fatalf("retry ended %s (%s): %s", info.State, resp.Message, info.Error)
+	}
+	if info.ResumedFrom != 0 {
+		t.Fatalf("resumed from %d over a prefix that no longer matches", info.ResumedFrom)
+	}
+	if info.Resumes != failed.ID {
+		t.Fatalf("retry resumes %q, want %q", info.Resumes, failed.ID)
+	}
+	checkReceived(t, dir, "source.bin", want)
+}
+
+func TestResumeRefusesModifiedSource(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "source.bin")
+	writeSource(t, src, resumeTestSize)
+	dir := t.TempDir()
+	addr := startReceiver(t, dir)
+
+	failed, _ := interrupt(t, src, dir, addr)
+	f, err := os.OpenFile(src, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("more"))
+	f.Close()
+
+	_, resp := resumeByCommand(t, failed)
+	if resp.Status != "error" || !strings.Contains(resp.Message, "File changed") {
+		t.Fatalf("resume of a modified file answered %s: %s", resp.Status, resp.Message)
+	}
+}
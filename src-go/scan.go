@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// scan_ports probes every port of every host in a target, a few hundred at
+// a time, and streams what it finds. It runs as a diagnostic, so
+// cancel_diagnostic stops it between probes.
+const (
+	defaultScanConcurrency = 100
+	maxScanConcurrency     = 1000
+	defaultScanTimeout     = 500 * time.Millisecond
+	maxScanProbes          = 1 << 20
+	scanProgressInterval   = time.Second
+)
+
+// defaultScanPorts are the services worth checking when no list is given
+var defaultScanPorts = []int{
+	21, 22, 23, 25, 53, 80, 110, 139, 143, 443, 445, 993, 995,
+	1883, 3306, 3389, 5000, 5353, 5432, 5900, 6379, 8000, 8080, 8443, 9000,
+}
+
+// parsePortList reads "22,80,8000-8100" into sorted, unique ports
+func parsePortList(spec string) ([]int, error) {
+	seen := make(map[int]bool)
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		first, last, isRange := strings.Cut(part, "-")
+		lo, err := strconv.Atoi(strings.TrimSpace(first))
+		hi := lo
+		if err == nil && isRange {
+			hi, err = strconv.Atoi(strings.TrimSpace(last))
+		}
+		if err != nil || lo < 1 || hi > 65535 || lo > hi {
+			return nil, catalogError(ErrInvalidArgument, "scan.invalid_port_range", "part", part)
+		}
+		for port := lo; port <= hi; port++ {
+			seen[port] = true
+		}
+	}
+	if len(seen) == 0 {
+		return nil, catalogError(ErrFailed, "scan.no_ports_scan")
+	}
+	ports := make([]int, 0, len(seen))
+	for port := range seen {
+		ports = append(ports, port)
+	}
+	sort.Ints(ports)
+	return ports, nil
+}
+
+// scanHosts expands a host name, an address or a CIDR block into the
+// addresses to scan. Network and broadcast addresses of IPv4 blocks are
+// left out.
+func scanHosts(target string, limit int) ([]string, error) {
+	prefix, err := netip.ParsePrefix(target)
+	if err != nil {
+		return []string{normalizeHost(target)}, nil
+	}
+	prefix = prefix.Masked()
+	bits := prefix.Addr().BitLen() - prefix.Bits()
+	if bits >= 31 || 1<<bits > limit {
+		return nil, fmt.Errorf("%s has too many addresses to scan", target)
+	}
+	var hosts []string
+	for addr := prefix.Addr(); prefix.Contains(addr); addr = addr.Next() {
+		hosts = append(hosts, addr.String())
+	}
+	if prefix.Addr().Is4() && bits >= 2 {
+		hosts = hosts[1 : len(hosts)-1]
+	}
+	return hosts, nil
+}
+
+// ScanResult is one probed port
+type ScanResult struct {
+	Host    string  `json:"host"`
+	Port    int     `json:"port"`
+	Network string  `json:"network"`
+	State   string  `json:"state"` // "open", "closed", "filtered", "open|filtered"
+	RTTMs   float64 `json:"rtt_ms,omitempty"`
+}
+
+// scanPort probes one port. Over UDP a missing answer can mean open or
+// filtered; only a reply proves the port open and port unreachable closed.
+func scanPort(ctx context.Context, network, host string, port int, timeout time.Duration) ScanResult {
+	res := ScanResult{Host: host, Port: port, Network: network}
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	dialer := net.Dialer{Timeout: timeout}
+	start := time.Now()
+	conn, err := dialer.DialContext(ctx, network, addr)
+	if network == "tcp" {
+		switch {
+		case err == nil:
+			conn.Close()
+			res.State, res.RTTMs = "open", millis(time.Since(start))
+		case isRefused(err):
+			res.State, res.RTTMs = "closed", millis(time.Since(start))
+		default:
+			res.State = "filtered"
+		}
+		return res
+	}
+	if err != nil {
+		res.State = "filtered"
+		return res
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	start = time.Now()
+	if _, err := conn.Write(nil); err != nil {
+		res.State = "filtered"
+		return res
+	}
+	_, err = conn.Read(make([]byte, 512))
+	switch {
+	case err == nil:
+		res.State, res.RTTMs = "open", millis(time.Since(start))
+	case isRefused(err):
+		res.State, res.RTTMs = "closed", millis(time.Since(start))
+	default:
+		res.State = "open|filtered"
+	}
+	return res
+}
+
+type ScanPortsPayload struct {
+	Target      string `json:"target" required:"true"` // host name, address or CIDR block
+	Ports       string `json:"ports"`                  // e.g. "22,80,8000-8100"; common service ports by default
+	Network     string `json:"network"`                // "tcp" (default), "udp"
+	Concurrency int    `json:"concurrency"`            // probes in flight, default 100
+	TimeoutMs   int    `json:"timeout_ms"`             // per probe, default 500
+	ReportAll   bool   `json:"report_all"`             // also stream closed and filtered ports
+}
+
+// handleScanPorts starts a scan. Open ports arrive as scan_result events,
+// with scan_progress about once a second and scan_completed at the end.
+func handleScanPorts(payload json.RawMessage, writer *Output) {
+	var p ScanPortsPayload
+	if err := json.Unmarshal(payload, &p); err != nil || p.Target == "" {
+		sendErrorCode(writer, ErrInvalidArgument, message("scan.ports_requires_target"), nil)
+		return
+	}
+	switch p.Network {
+	case "":
+		p.Network = "tcp"
+	case "tcp", "udp":
+	default:
+		sendErrorCode(writer, ErrUnsupported, message("common.unsupported_network", "network", p.Network), nil)
+		return
+	}
+	ports := defaultScanPorts
+	if p.Ports != "" {
+		var err error
+		if ports, err = parsePortList(p.Ports); err != nil {
+			sendFailure(writer, err)
+			return
+		}
+	}
+	hosts, err := scanHosts(p.Target, maxScanProbes/len(ports))
+	if err != nil {
+		sendFailure(writer, err)
+		return
+	}
+	total := len(hosts) * len(ports)
+	if total > maxScanProbes {
+		sendError(writer, message("scan.would_send_probes_limit", "total", total, "max_scan_probes", maxScanProbes))
+		return
+	}
+	if p.Concurrency <= 0 {
+		p.Concurrency = defaultScanConcurrency
+	}
+	if p.Concurrency > maxScanConcurrency {
+		sendErrorCode(writer, ErrInvalidArgument, message("common.concurrency_must_most", "max_lan_concurrency", maxScanConcurrency), nil)
+		return
+	}
+	timeout := defaultScanTimeout
+	if p.TimeoutMs > 0 {
+		timeout = time.Duration(p.TimeoutMs) * time.Millisecond
+	}
+
+	id := startDiagnostic("scan", p.Target, func(ctx context.Context, id string) {
+		runScan(ctx, id, p, hosts, ports, timeout)
+	})
+	writer.Encode(okResponse(message("scan.scanning_ports_hosts", "ports", len(ports), "hosts", len(hosts)),
+		map[string]interface{}{"id": id, "hosts": len(hosts), "ports": len(ports), "total": total}))
+}
+
+func runScan(ctx context.Context, id string, p ScanPortsPayload, hosts []string, ports []int, timeout time.Duration) {
+	type probe struct {
+		host string
+		port int
+	}
+	probes := make(chan probe)
+	goSafe("scan "+id, func() {
+		defer close(probes)
+		for _, host := range hosts {
+			for _, port := range ports {
+				select {
+				case probes <- probe{host, port}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	})
+
+	start := time.Now()
+	var done atomic.Int64
+	var mu sync.Mutex
+	open := []ScanResult{}
+	var wg sync.WaitGroup
+	for i := 0; i < p.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer recoverPanic("scan " + id)
+			defer wg.Done()
+			for pr := range probes {
+				res := scanPort(ctx, p.Network, pr.host, pr.port, timeout)
+				if ctx.Err() != nil {
+					return // canceled mid-probe; the result means nothing
+				}
+				done.Add(1)
+				if res.State == "open" {
+					mu.Lock()
+					open = append(open, res)
+					mu.Unlock()
+				}
+				if res.State == "open" || p.ReportAll {
+					emitEvent("scan_result", map[string]interface{}{"id": id, "result": res})
+				}
+			}
+		}()
+	}
+
+	finished := make(chan struct{})
+	goSafe("scan "+id, func() {
+		wg.Wait()
+		close(finished)
+	})
+	total := len(hosts) * len(ports)
+	ticker := time.NewTicker(scanProgressInterval)
+	defer ticker.Stop()
+	for running := true; running; {
+		select {
+		case <-finished:
+			running = false
+		case <-ticker.C:
+			mu.Lock()
+			found := len(open)
+			mu.Unlock()
+			emitEvent("scan_progress", map[string]interface{}{
+				"id": id, "scanned": done.Load(), "total": total, "open": found,
+			})
+		}
+	}
+
+	sort.Slice(open, func(i, j int) bool {
+		if open[i].Host != open[j].Host {
+			return open[i].Host < open[j].Host
+		}
+		return open[i].Port < open[j].Port
+	})
+	logger.Info("port scan finished", "id", id, "target", p.Target, "scanned", done.Load(), "open", len(open))
+	emitEvent("scan_completed", map[string]interface{}{
+		"id":               id,
+		"target":           p.Target,
+		"network":          p.Network,
+		"scanned":          done.Load(),
+		"total":            total,
+		"open":             open,
+		"duration_seconds": time.Since(start).Seconds(),
+		"canceled":         ctx.Err() != nil,
+	})
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// send_file, send_directory, start_sync and download_url accept a
+// schedule instead of running right away: a single start time, or a cron
+// expression for recurring runs such as nightly backups. Schedules are saved beside the
+// config and survive restarts; a one-off run missed while the sidecar was
+// not running fires at the next launch, while a recurring one just waits
+// for its next slot. A scheduled start_sync pushes once and stops rather
+// than watching the folder.
+const (
+	scheduleAt   = "at"
+	scheduleCron = "cron"
+)
+
+// ScheduleSpec is the schedule field of a schedulable command
+type ScheduleSpec struct {
+	At   string `json:"at"`   // RFC 3339 time of a single run
+	Cron string `json:"cron"` // "minute hour day-of-month month day-of-week", local time
+	Name string `json:"name"` // label for the UI
+}
+
+// Scheduled is a command waiting for its time
+type Scheduled struct {
+	ID      string          `json:"id"`
+	Name    string          `json:"name,omitempty"`
+	Command string          `json:"command"`
+	Payload json.RawMessage `json:"payload"`
+	Kind    string          `json:"kind"` // "at", "cron"
+	At      *time.Time      `json:"at,omitempty"`
+	Cron    string          `json:"cron,omitempty"`
+	Next    time.Time       `json:"next"`
+	Created time.Time       `json:"created"`
+
+	Runs       int        `json:"runs"`
+	LastRun    *time.Time `json:"last_run,omitempty"`
+	LastStatus string     `json:"last_status,omitempty"` // "ok", "error"
+	LastError  string     `json:"last_error,omitempty"`
+
+	cron  *cronSchedule
+	timer *time.Timer
+}
+
+// Scheduler holds the schedules and the file they are saved to
+type Scheduler struct {
+	mu    sync.Mutex
+	path  string
+	items map[string]*Scheduled
+	seq   uint64
+}
+
+var scheduler = Scheduler{items: make(map[string]*Scheduled)}
+
+// schedulesPath puts the schedules beside the config file
+func schedulesPath(configPath string) string {
+	return filepath.Join(filepath.Dir(configPath), "lumina-schedules.json")
+}
+
+// Load reads path and arms every schedule in it
+func (s *Scheduler) Load(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.path = path
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var items []*Scheduled
+	if err := json.Unmarshal(data, &items); err != nil {
+		return fmt.Errorf("parse %s: %w", path, err)
+	}
+	now := time.Now()
+	for _, item := range items {
+		if item.Kind == scheduleCron {
+			c, err := parseCron(item.Cron)
+			if err == nil && c.next(now).IsZero() {
+				err = catalogError(ErrFailed, "schedule.cron_never_matches_date")
+			}
+			if err != nil {
+				logger.Warn("dropping schedule", "id", item.ID, "error", err)
+				continue
+			}
+			item.cron = c
+			item.Next = c.next(now)
+		}
+		if n, err := strconv.ParseUint(strings.TrimPrefix(item.ID, "sched-"), 10, 64); err == nil {
+			s.seq = max(s.seq, n)
+		}
+		s.items[item.ID] = item
+		s.armLocked(item)
+	}
+	return nil
+}
+
+// armLocked starts the timer for item's next run
+func (s *Scheduler) armLocked(item *Scheduled) {
+	item.timer = time.AfterFunc(max(time.Until(item.Next), 0), func() { s.fire(item.ID) })
+}
+
+// saveLocked writes the schedules atomically
+func (s *Scheduler) saveLocked() {
+	if s.path == "" {
+		return
+	}
+	items := s.listLocked()
+	var buf bytes.Buffer
+	err := json.NewEncoder(&buf).Encode(items)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(s.path), 0o755)
+	}
+	if err == nil {
+		err = os.WriteFile(s.path+".tmp", buf.Bytes(), 0o600)
+	}
+	if err == nil {
+		err = os.Rename(s.path+".tmp", s.path)
+	}
+	if err != nil {
+		logger.Warn("failed to save schedules", "path", s.path, "error", err)
+	}
+}
+
+func (s *Scheduler) listLocked() []*Scheduled {
+	items := make([]*Scheduled, 0, len(s.items))
+	for _, item := range s.items {
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Next.Before(items[j].Next) })
+	return items
+}
+
+// fire runs a schedule that came due and arms its next run
+func (s *Scheduler) fire(id string) {
+	s.mu.Lock()
+	item, ok := s.items[id]
+	if !ok {
+		s.mu.Unlock()
+		return
+	}
+	command, payload, due := item.Command, item.Payload, item.Next
+	s.mu.Unlock()
+
+	var buf bytes.Buffer
+	runScheduled(command, payload, NewOutput(&buf))
+	var resp ProtocolResponse
+	json.Unmarshal(buf.Bytes(), &resp)
+
+	now := time.Now()
+	s.mu.Lock()
+	if _, ok := s.items[id]; !ok {
+		s.mu.Unlock()
+		return // canceled while running
+	}
+	item.Runs++
+	item.LastRun, item.LastStatus, item.LastError = &now, resp.Status, ""
+	if resp.Status != "ok" {
+		item.LastError = resp.Message
+	}
+	fired := map[string]interface{}{
+		"id":      item.ID,
+		"command": item.Command,
+		"run":     item.Runs,
+		"status":  resp.Status,
+		"late":    now.Sub(due) > time.Minute,
+	}
+	if item.Name != "" {
+		fired["name"] = item.Name
+	}
+	if resp.Status == "ok" {
+		fired["data"] = resp.Data
+	} else {
+		fired["error"] = resp.Message
+	}
+	if item.cron != nil {
+		item.Next = item.cron.next(now)
+		s.armLocked(item)
+		fired["next"] = item.Next
+	}
+	if item.cron == nil || item.Next.IsZero() {
+		delete(s.items, id)
+	}
+	s.saveLocked()
+	s.mu.Unlock()
+
+	logger.Info("schedule fired", "id", id, "command", command, "status", resp.Status)
+	emitEvent("schedule_fired", fired)
+}
+
+// runScheduled runs a schedulable command as if the app had sent it
+func runScheduled(command string, payload json.RawMessage, writer *Output) {
+	switch command {
+	case "send_file":
+		handleSendFile(payload, writer)
+	case "send_directory":
+		handleSendDirectory(payload, writer)
+	case "start_sync":
+		handleStartSync(payload, writer)
+	case "download_url":
+		handleDownloadURL(payload, writer)
+	default:
+		sendErrorCode(writer, ErrUnsupported, message("schedule.unsupported_command", "command", command), nil)
+	}
+}
+
+// scheduleCommand stores command for later instead of running it. The
+// saved payload loses its schedule so that the run does not schedule again.
+func scheduleCommand(writer *Output, command string, payload json.RawMessage, spec ScheduleSpec) {
+	item := &Scheduled{Name: spec.Name, Command: command, Created: time.Now()}
+	switch {
+	case spec.At != "" && spec.Cron != "":
+		sendErrorCode(writer, ErrInvalidArgument, message("schedule.takes_cron_not_both"), nil)
+		return
+	case spec.At != "":
+		at, err := time.Parse(time.RFC3339, spec.At)
+		if err != nil {
+			sendErrorCode(writer, ErrInvalidArgument, message("schedule.must_rfc_3339_time"), nil)
+			return
+		}
+		if at.Before(item.Created) {
+			sendErrorCode(writer, ErrInvalidArgument, message("schedule.must_future"), nil)
+			return
+		}
+		item.Kind, item.At, item.Next = scheduleAt, &at, at
+	case spec.Cron != "":
+		c, err := parseCron(spec.Cron)
+		if err != nil {
+			sendErrorCode(writer, ErrInvalidArgument, messageOf(err), nil)
+			return
+		}
+		item.Kind, item.Cron, item.cron, item.Next = scheduleCron, spec.Cron, c, c.next(item.Created)
+		if item.Next.IsZero() {
+			sendErrorCode(writer, ErrInvalidArgument, message("schedule.cron_never_matches_date"), nil)
+			return
+		}
+	default:
+		sendErrorCode(writer, ErrInvalidArgument, message("schedule.requires_cron"), nil)
+		return
+	}
+
+	var fields map[string]json.RawMessage
+	json.Unmarshal(payload, &fields)
+	delete(fields, "schedule")
+	if command == "start_sync" {
+		fields["once"] = json.RawMessage("true")
+	}
+	if _, ok := fields["priority"]; !ok && (command == "send_file" || command == "send_directory" || command == "download_url") {
+		fields["priority"] = json.RawMessage(`"low"`) // unattended runs yield to the user
+	}
+	item.Payload, _ = json.Marshal(fields)
+
+	scheduler.mu.Lock()
+	scheduler.seq++
+	item.ID = fmt.Sprintf("sched-%d", scheduler.seq)
+	scheduler.items[item.ID] = item
+	scheduler.armLocked(item)
+	scheduler.saveLocked()
+	data, _ := json.Marshal(item)
+	scheduler.mu.Unlock()
+
+	logger.Info("command scheduled", "id", item.ID, "command", command, "next", item.Next)
+	writer.Encode(okResponse(message("schedule.scheduled_command", "command", command), json.RawMessage(data)))
+}
+
+// handleListScheduled returns the schedules, soonest first
+func handleListScheduled(writer *Output) {
+	scheduler.mu.Lock()
+	items := scheduler.listLocked()
+	data, _ := json.Marshal(items) // copy while the lock keeps fire from writing
+	scheduler.mu.Unlock()
+	writer.Encode(ProtocolResponse{Status: "ok", Data: map[string]interface{}{"scheduled": json.RawMessage(data)}})
+}
+
+type CancelScheduledPayload struct {
+	ID string `json:"id"`
+}
+
+func handleCancelScheduled(payload json.RawMessage, writer *Output) {
+	var p CancelScheduledPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		sendInvalidPayload(writer, "cancel_scheduled")
+		return
+	}
+	scheduler.mu.Lock()
+	item, ok := scheduler.items[p.ID]
+	if ok {
+		item.timer.Stop()
+		delete(scheduler.items, p.ID)
+		scheduler.saveLocked()
+	}
+	scheduler.mu.Unlock()
+	if !ok {
+		sendErrorCode(writer, ErrNotFound, message("schedule.not_found"), nil)
+		return
+	}
+	logger.Info("schedule canceled", "id", p.ID)
+	writer.Encode(okResponse(message("schedule.canceled"), nil))
+}
+
+// cronSchedule is a parsed cron expression; each field is a bit set of
+// the values it matches
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	domAny, dowAny                bool
+}
+
+var cronFields = []struct {
+	name     string
+	min, max int
+}{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7}, // 0 and 7 are both Sunday
+}
+
+// parseCron reads a standard five-field expression: each field is *, a
+// value, a range a-b, or a comma list of those, each optionally with /step
+func parseCron(expr string) (*cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("cron needs 5 fields, got %d", len(fields))
+	}
+	sets := make([]uint64, len(fields))
+	for i, field := range fields {
+		set, err := parseCronField(field, cronFields[i].min, cronFields[i].max)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron %s %q: %v", cronFields[i].name, field, err)
+		}
+		sets[i] = set
+	}
+	if sets[4]&(1<<7) != 0 {
+		sets[4] |= 1
+	}
+	return &cronSchedule{
+		minute: sets[0], hour: sets[1], dom: sets[2], month: sets[3], dow: sets[4],
+		domAny: fields[2] == "*", dowAny: fields[4] == "*",
+	}, nil
+}
+
+func parseCronField(field string, lo, hi int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, stepText, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepText)
+			if err != nil || n <= 0 {
+				return 0, errors.New("bad step")
+			}
+			step = n
+		}
+		first, last := lo, hi
+		if rng != "*" {
+			a, b, isRange := strings.Cut(rng, "-")
+			var err error
+			if first, err = strconv.Atoi(a); err != nil {
+				return 0, errors.New("bad value")
+			}
+			last = first
+			if isRange {
+				if last, err = strconv.Atoi(b); err != nil {
+					return 0, errors.New("bad range")
+				}
+			} else if hasStep {
+				last = hi
+			}
+		}
+		if first < lo || last > hi || first > last {
+			return 0, fmt.Errorf("out of range %d-%d", lo, hi)
+		}
+		for v := first; v <= last; v += step {
+			set |= 1 << v
+		}
+	}
+	return set, nil
+}
+
+// dayMatches applies cron's rule that a day matches either restricted
+// day field when both are restricted
+func (c *cronSchedule) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<t.Day()) != 0
+	dow := c.dow&(1<<int(t.Weekday())) != 0
+	switch {
+	case c.domAny && c.dowAny:
+		return true
+	case c.domAny:
+		return dow
+	case c.dowAny:
+		return dom
+	}
+	return dom || dow
+}
+
+// next returns the first matching minute after t, or the zero time when
+// nothing matches within five years
+func (c *cronSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case c.month&(1<<int(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case c.hour&(1<<t.Hour()) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case c.minute&(1<<t.Minute()) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,459 @@
+package main
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Payloads are decoded strictly before a command runs: a field the
+// command does not know, a value of the wrong JSON type or a missing field
+// tagged required:"true" is refused with every problem listed in
+// details.fields, instead of being dropped or read as a zero value. A
+// request with "validate_only" stops there and says whether the command
+// would have accepted its payload, so frontends can check what they build
+// in tests. payloadSchemas names the payload type of every command;
+// commands missing from it are not checked.
+const (
+	problemSyntax   = "syntax"        // the payload is not JSON, or not one object
+	problemUnknown  = "unknown_field" // the command has no such field
+	problemType     = "type"          // the value has the wrong JSON type
+	problemRequired = "required"      // the field is missing, empty or zero
+	problemInvalid  = "invalid"       // the value failed its own parsing, such as a malformed time
+)
+
+// noPayload is the schema of commands that take no arguments
+type noPayload struct{}
+
+// PayloadError is one problem with a payload
+type PayloadError struct {
+	Field    string `json:"field,omitempty"`    // dotted path, "" for the payload as a whole
+	Problem  string `json:"problem"`            // one of the problem constants
+	Expected string `json:"expected,omitempty"` // JSON type the field takes
+	Got      string `json:"got,omitempty"`      // JSON type it was given
+	Offset   int64  `json:"offset,omitempty"`   // byte a syntax error was found at
+	Message  string `json:"message,omitempty"`  // what an invalid value's parser said
+}
+
+func (e PayloadError) Error() string {
+	field := e.Field
+	if field == "" {
+		field = "payload"
+	}
+	switch e.Problem {
+	case problemSyntax:
+		return fmt.Sprintf("malformed JSON at byte %d", e.Offset)
+	case problemUnknown:
+		return "unknown field " + field
+	case problemType:
+		return fmt.Sprintf("%s must be %s, not %s", field, article(e.Expected), e.Got)
+	case problemRequired:
+		return field + " is required"
+	default:
+		return fmt.Sprintf("%s is invalid: %s", field, e.Message)
+	}
+}
+
+// PayloadErrors is every problem decodePayload found
+type PayloadErrors []PayloadError
+
+func (e PayloadErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, pe := range e {
+		msgs[i] = pe.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// decodePayload decodes payload into v, which points to a struct, refusing
+// unknown fields, trailing data and missing required fields. Its errors
+// are PayloadErrors.
+func decodePayload(payload json.RawMessage, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return PayloadErrors{payloadError(err, reflect.TypeOf(v).Elem())}
+	}
+	end := dec.InputOffset()
+	if _, err := dec.Token(); err != io.EOF {
+		return PayloadErrors{{Problem: problemSyntax, Offset: end}} // trailing data
+	}
+	var errs PayloadErrors
+	checkRequired(reflect.ValueOf(v).Elem(), "", &errs)
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// payloadError describes what encoding/json refused when decoding into t
+func payloadError(err error, t reflect.Type) PayloadError {
+	var syntax *json.SyntaxError
+	var typ *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntax):
+		return PayloadError{Problem: problemSyntax, Offset: syntax.Offset}
+	case errors.As(err, &typ):
+		if typ.Field == "" {
+			return PayloadError{Problem: problemType, Expected: jsonKind(t), Got: typ.Value}
+		}
+		return PayloadError{Field: typ.Field, Problem: problemType, Expected: jsonKind(typ.Type), Got: typ.Value}
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return PayloadError{Problem: problemSyntax}
+	}
+	if name, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		if unquoted, err := strconv.Unquote(name); err == nil {
+			name = unquoted
+		}
+		return PayloadError{Field: name, Problem: problemUnknown}
+	}
+	return PayloadError{Problem: problemInvalid, Message: err.Error()}
+}
+
+var textUnmarshaler = reflect.TypeFor[encoding.TextUnmarshaler]()
+
+// jsonKind is the JSON type values of t are written as
+func jsonKind(t reflect.Type) string {
+	if t == nil {
+		return "value"
+	}
+	if reflect.PointerTo(t).Implements(textUnmarshaler) {
+		return "string"
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return jsonKind(t.Elem())
+	case reflect.Bool:
+		return "boolean"
+	case reflect.String:
+		return "string"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return "string" // base64
+		}
+		return "array"
+	case reflect.Array:
+		return "array"
+	case reflect.Map, reflect.Struct:
+		return "object"
+	default:
+		return "value"
+	}
+}
+
+func article(kind string) string {
+	switch kind {
+	case "array", "object":
+		return "an " + kind
+	case "value":
+		return "a value"
+	default:
+		return "a " + kind
+	}
+}
+
+// checkRequired appends a problem for every field tagged required:"true"
+// that is still zero, looking into nested objects and lists of them
+func checkRequired(v reflect.Value, path string, errs *PayloadErrors) {
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if !v.IsNil() {
+			checkRequired(v.Elem(), path, errs)
+		}
+	case reflect.Slice, reflect.Array:
+		if k := v.Type().Elem().Kind(); k != reflect.Struct && k != reflect.Pointer {
+			return
+		}
+		for i := range v.Len() {
+			checkRequired(v.Index(i), fmt.Sprintf("%s[%d]", path, i), errs)
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := range t.NumField() {
+			f := t.Field(i)
+			if !f.IsExported() {
+				continue
+			}
+			name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+			if name == "-" {
+				continue
+			}
+			if f.Anonymous && name == "" {
+				checkRequired(v.Field(i), path, errs) // promoted fields
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			if path != "" {
+				name = path + "." + name
+			}
+			if f.Tag.Get("required") == "true" && v.Field(i).IsZero() {
+				*errs = append(*errs, PayloadError{Field: name, Problem: problemRequired})
+				continue
+			}
+			checkRequired(v.Field(i), name, errs)
+		}
+	}
+}
+
+// checkPayload strictly decodes a request's payload against its command's
+// schema, answering with the problems when there are any
+func checkPayload(req ProtocolRequest, writer *Output) bool {
+	schema, ok := payloadSchemas[req.Command]
+	if !ok {
+		return true
+	}
+	var err error
+	if check, custom := payloadCheckers[req.Command]; custom {
+		err = check(req.Payload)
+	} else {
+		err = decodePayload(req.Payload, reflect.New(schema).Interface())
+	}
+	if err == nil {
+		return true
+	}
+	var errs PayloadErrors
+	errors.As(err, &errs)
+	sendErrorCode(writer, ErrInvalidPayload, message("schema.invalid_payload_for", "command", req.Command, "problems", err),
+		map[string]interface{}{"command": req.Command, "fields": errs})
+	return false
+}
+
+// payloadCheckers replace the plain schema of commands that pass part of
+// their payload on to another command
+var payloadCheckers = map[string]func(json.RawMessage) error{
+	"enqueue_transfer": checkEnqueuePayload,
+}
+
+// checkEnqueuePayload checks enqueue_transfer's own fields, then the rest
+// as the send_file or send_directory payload it becomes
+func checkEnqueuePayload(payload json.RawMessage) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		return PayloadErrors{payloadError(err, reflect.TypeFor[EnqueueTransferPayload]())}
+	}
+	own := map[string]json.RawMessage{}
+	for _, name := range []string{"kind", "priority", "paths"} {
+		if v, ok := fields[name]; ok {
+			own[name] = v
+			delete(fields, name)
+		}
+	}
+	ownJSON, _ := json.Marshal(own)
+	var p EnqueueTransferPayload
+	if err := decodePayload(ownJSON, &p); err != nil {
+		return err
+	}
+	sendJSON, _ := json.Marshal(fields)
+	if p.Kind == "directory" {
+		return decodePayload(sendJSON, new(SendDirectoryPayload))
+	}
+	return decodePayload(sendJSON, new(SendFilePayload))
+}
+
+// validatePayload answers a validate_only request without running it
+func validatePayload(req ProtocolRequest, writer *Output) {
+	if _, ok := payloadSchemas[req.Command]; !ok {
+		sendErrorCode(writer, ErrUnknownCommand, message("main.unknown_command", "command", req.Command), map[string]interface{}{"command": req.Command})
+		return
+	}
+	if checkPayload(req, writer) {
+		writer.Encode(ProtocolResponse{Status: "ok", Data: map[string]interface{}{"command": req.Command, "valid": true}})
+	}
+}
+
+// payloadSchemas is the payload type of each command
+var payloadSchemas = map[string]reflect.Type{
+	"accept_offer":            reflect.TypeFor[DecideOfferPayload](),
+	"add_firewall_rule":       reflect.TypeFor[FirewallPayload](),
+	"add_peer_to_group":       reflect.TypeFor[GroupPeerPayload](),
+	"add_port_mapping":        reflect.TypeFor[AddPortMappingPayload](),
+	"apply_update":            reflect.TypeFor[ApplyUpdatePayload](),
+	"attach":                  reflect.TypeFor[AttachPayload](),
+	"begin_payload":           reflect.TypeFor[BeginPayloadPayload](),
+	"block_peer":              reflect.TypeFor[PeerTrustPayload](),
+	"broadcast_file":          reflect.TypeFor[BroadcastFilePayload](),
+	"broadcast_message":       reflect.TypeFor[BroadcastMessagePayload](),
+	"cancel":                  reflect.TypeFor[CancelPayload](),
+	"cancel_diagnostic":       reflect.TypeFor[CancelDiagnosticPayload](),
+	"cancel_queued":           reflect.TypeFor[CancelQueuedPayload](),
+	"cancel_scheduled":        reflect.TypeFor[CancelScheduledPayload](),
+	"check_firewall":          reflect.TypeFor[FirewallPayload](),
+	"check_port":              reflect.TypeFor[CheckPortPayload](),
+	"check_update":            reflect.TypeFor[CheckUpdatePayload](),
+	"clear_chat_history":      reflect.TypeFor[ChatHistoryPayload](),
+	"clear_dedup_cache":       reflect.TypeFor[noPayload](),
+	"clear_history":           reflect.TypeFor[HistoryFilter](),
+	"clear_queue_history":     reflect.TypeFor[noPayload](),
+	"close_mux":               reflect.TypeFor[CloseMuxPayload](),
+	"confirm_firewall_change": reflect.TypeFor[ConfirmFirewallChangePayload](),
+	"connect":                 reflect.TypeFor[ConnectPayload](),
+	"control_status":          reflect.TypeFor[noPayload](),
+	"create_group":            reflect.TypeFor[CreateGroupPayload](),
+	"crypto_benchmark":        reflect.TypeFor[CryptoBenchmarkPayload](),
+	"dedup_cache_status":      reflect.TypeFor[noPayload](),
+	"delete_group":            reflect.TypeFor[GroupPayload](),
+	"delete_profile":          reflect.TypeFor[ProfilePayload](),
+	"detach":                  reflect.TypeFor[noPayload](),
+	"disable_drop_mode":       reflect.TypeFor[noPayload](),
+	"disconnect":              reflect.TypeFor[DisconnectPayload](),
+	"dns_benchmark":           reflect.TypeFor[DNSBenchmarkPayload](),
+	"doctor":                  reflect.TypeFor[DoctorPayload](),
+	"download_url":            reflect.TypeFor[DownloadURLPayload](),
+	"enable_drop_mode":        reflect.TypeFor[EnableDropModePayload](),
+	"end_payload":             reflect.TypeFor[EndPayloadPayload](),
+	"enqueue_transfer":        reflect.TypeFor[EnqueueTransferPayload](),
+	"export_keypair":          reflect.TypeFor[ExportKeypairPayload](),
+	"export_state":            reflect.TypeFor[ExportStatePayload](),
+	"extract_archive":         reflect.TypeFor[ExtractArchivePayload](),
+	"flush_output":            reflect.TypeFor[noPayload](),
+	"forget_peer":             reflect.TypeFor[PeerTrustPayload](),
+	"generate_keypair":        reflect.TypeFor[GenerateKeypairPayload](),
+	"get_audit_log":           reflect.TypeFor[GetAuditLogPayload](),
+	"get_chat_history":        reflect.TypeFor[ChatHistoryPayload](),
+	"get_config":              reflect.TypeFor[noPayload](),
+	"get_message_catalog":     reflect.TypeFor[GetMessageCatalogPayload](),
+	"get_peer_latency":        reflect.TypeFor[PeerLatencyPayload](),
+	"get_usage":               reflect.TypeFor[GetUsagePayload](),
+	"grpc_status":             reflect.TypeFor[noPayload](),
+	"hash_file":               reflect.TypeFor[HashFilePayload](),
+	"hello":                   reflect.TypeFor[HelloPayload](),
+	"icmp_ping":               reflect.TypeFor[ICMPPingPayload](),
+	"import_keypair":          reflect.TypeFor[ImportKeypairPayload](),
+	"import_state":            reflect.TypeFor[ImportStatePayload](),
+	"issue_auth_token":        reflect.TypeFor[IssueAuthTokenPayload](),
+	"join_multicast":          reflect.TypeFor[JoinMulticastPayload](),
+	"kick_media_subscriber":   reflect.TypeFor[KickMediaSubscriberPayload](),
+	"leave_multicast":         reflect.TypeFor[LeaveMulticastPayload](),
+	"list_connections":        reflect.TypeFor[noPayload](),
+	"list_diagnostics":        reflect.TypeFor[noPayload](),
+	"list_firewall_changes":   reflect.TypeFor[noPayload](),
+	"list_groups":             reflect.TypeFor[noPayload](),
+	"list_history":            reflect.TypeFor[ListHistoryPayload](),
+	"list_interfaces":         reflect.TypeFor[noPayload](),
+	"list_jobs":               reflect.TypeFor[ListJobsPayload](),
+	"list_known_peers":        reflect.TypeFor[ListKnownPeersPayload](),
+	"list_media_subscribers":  reflect.TypeFor[ListMediaSubscribersPayload](),
+	"list_multicast":          reflect.TypeFor[noPayload](),
+	"list_muxes":              reflect.TypeFor[noPayload](),
+	"list_offers":             reflect.TypeFor[noPayload](),
+	"list_p2p":                reflect.TypeFor[noPayload](),
+	"list_peers":              reflect.TypeFor[noPayload](),
+	"list_pinned_keys":        reflect.TypeFor[noPayload](),
+	"list_port_mappings":      reflect.TypeFor[noPayload](),
+	"list_profiles":           reflect.TypeFor[noPayload](),
+	"list_queue":              reflect.TypeFor[noPayload](),
+	"list_relays":             reflect.TypeFor[noPayload](),
+	"list_scheduled":          reflect.TypeFor[noPayload](),
+	"list_shares":             reflect.TypeFor[noPayload](),
+	"list_syncs":              reflect.TypeFor[noPayload](),
+	"list_transfers":          reflect.TypeFor[noPayload](),
+	"lookup_ip":               reflect.TypeFor[LookupIPPayload](),
+	"open_mux":                reflect.TypeFor[OpenMuxPayload](),
+	"p2p_accept":              reflect.TypeFor[P2PAcceptPayload](),
+	"p2p_add_candidate":       reflect.TypeFor[P2PCandidatePayload](),
+	"p2p_answer":              reflect.TypeFor[P2PAnswerPayload](),
+	"p2p_close":               reflect.TypeFor[P2PClosePayload](),
+	"p2p_offer":               reflect.TypeFor[P2POfferPayload](),
+	"pause_background":        reflect.TypeFor[BackgroundPayload](),
+	"pause_transfer":          reflect.TypeFor[PauseTransferPayload](),
+	"payload_chunk":           reflect.TypeFor[PayloadChunkPayload](),
+	"pin_peer_key":            reflect.TypeFor[PinPeerKeyPayload](),
+	"ping":                    reflect.TypeFor[noPayload](),
+	"publish_media_frame":     reflect.TypeFor[PublishMediaFramePayload](),
+	"punch_hole":              reflect.TypeFor[PunchHolePayload](),
+	"push_clipboard":          reflect.TypeFor[PushClipboardPayload](),
+	"push_text":               reflect.TypeFor[PushTextPayload](),
+	"reject_offer":            reflect.TypeFor[DecideOfferPayload](),
+	"rekey_connection":        reflect.TypeFor[RekeyConnectionPayload](),
+	"reload_certs":            reflect.TypeFor[ReloadCertsPayload](),
+	"remove_firewall_rule":    reflect.TypeFor[FirewallPayload](),
+	"remove_peer_from_group":  reflect.TypeFor[GroupPeerPayload](),
+	"remove_port_mapping":     reflect.TypeFor[RemovePortMappingPayload](),
+	"rename_peer":             reflect.TypeFor[PeerTrustPayload](),
+	"reorder_queue":           reflect.TypeFor[ReorderQueuePayload](),
+	"reset_metrics":           reflect.TypeFor[noPayload](),
+	"resolve":                 reflect.TypeFor[ResolvePayload](),
+	"resume_background":       reflect.TypeFor[BackgroundPayload](),
+	"resume_transfer":         reflect.TypeFor[ResumeTransferPayload](),
+	"reverse_lookup":          reflect.TypeFor[ReverseLookupPayload](),
+	"revoke_auth_token":       reflect.TypeFor[RevokeAuthTokenPayload](),
+	"run_speedtest":           reflect.TypeFor[RunSpeedtestPayload](),
+	"save_profile":            reflect.TypeFor[SaveProfilePayload](),
+	"scan_lan":                reflect.TypeFor[ScanLANPayload](),
+	"scan_ports":              reflect.TypeFor[ScanPortsPayload](),
+	"send":                    reflect.TypeFor[SendPayload](),
+	"send_archive":            reflect.TypeFor[SendArchivePayload](),
+	"send_directory":          reflect.TypeFor[SendDirectoryPayload](),
+	"send_file":               reflect.TypeFor[SendFilePayload](),
+	"send_message":            reflect.TypeFor[SendMessagePayload](),
+	"send_multicast":          reflect.TypeFor[SendMulticastPayload](),
+	"send_raw":                reflect.TypeFor[SendRawPayload](),
+	"set_chat_history":        reflect.TypeFor[ChatHistoryPayload](),
+	"set_config":              reflect.TypeFor[Config](),
+	"set_connection_timeouts": reflect.TypeFor[SetConnectionTimeoutsPayload](),
+	"set_download_dir":        reflect.TypeFor[SetDownloadDirPayload](),
+	"set_framing":             reflect.TypeFor[SetFramingPayload](),
+	"set_linger":              reflect.TypeFor[SetLingerPayload](),
+	"set_locale":              reflect.TypeFor[SetLocalePayload](),
+	"set_log_file":            reflect.TypeFor[SetLogFilePayload](),
+	"set_log_level":           reflect.TypeFor[SetLogLevelPayload](),
+	"set_max_connections":     reflect.TypeFor[SetMaxConnectionsPayload](),
+	"set_namespace":           reflect.TypeFor[SetNamespacePayload](),
+	"set_netem":               reflect.TypeFor[SetNetemPayload](),
+	"set_output_batching":     reflect.TypeFor[OutputBatching](),
+	"set_queue_concurrency":   reflect.TypeFor[SetQueueConcurrencyPayload](),
+	"set_rate_limit":          reflect.TypeFor[SetRateLimitPayload](),
+	"set_raw_channel":         reflect.TypeFor[SetRawChannelPayload](),
+	"set_transfer_priority":   reflect.TypeFor[SetTransferPriorityPayload](),
+	"share_file":              reflect.TypeFor[ShareFilePayload](),
+	"shutdown":                reflect.TypeFor[ShutdownPayload](),
+	"shutdown_read":           reflect.TypeFor[HalfClosePayload](),
+	"shutdown_write":          reflect.TypeFor[HalfClosePayload](),
+	"start_control_socket":    reflect.TypeFor[ControlSocketPayload](),
+	"start_discovery":         reflect.TypeFor[StartDiscoveryPayload](),
+	"start_grpc":              reflect.TypeFor[GRPCPayload](),
+	"start_log_tail":          reflect.TypeFor[StartLogTailPayload](),
+	"start_metrics":           reflect.TypeFor[StartMetricsPayload](),
+	"start_profile":           reflect.TypeFor[StartProfilePayload](),
+	"start_relay":             reflect.TypeFor[StartRelayPayload](),
+	"start_server":            reflect.TypeFor[StartServerPayload](),
+	"start_sync":              reflect.TypeFor[StartSyncPayload](),
+	"status":                  reflect.TypeFor[noPayload](),
+	"status_since":            reflect.TypeFor[StatusSincePayload](),
+	"stop_control_socket":     reflect.TypeFor[noPayload](),
+	"stop_discovery":          reflect.TypeFor[noPayload](),
+	"stop_grpc":               reflect.TypeFor[noPayload](),
+	"stop_metrics":            reflect.TypeFor[noPayload](),
+	"stop_profile":            reflect.TypeFor[ProfilePayload](),
+	"stop_relay":              reflect.TypeFor[StopRelayPayload](),
+	"stop_server":             reflect.TypeFor[StopServerPayload](),
+	"stop_share":              reflect.TypeFor[StopSharePayload](),
+	"stop_sync":               reflect.TypeFor[StopSyncPayload](),
+	"storage_status":          reflect.TypeFor[noPayload](),
+	"stun_discover":           reflect.TypeFor[STUNPayload](),
+	"subscribe_stats":         reflect.TypeFor[SubscribeStatsPayload](),
+	"system_sleep":            reflect.TypeFor[SystemSleepPayload](),
+	"system_wake":             reflect.TypeFor[SystemSleepPayload](),
+	"tap_connection":          reflect.TypeFor[TapConnectionPayload](),
+	"test_proxy":              reflect.TypeFor[TestProxyPayload](),
+	"traceroute":              reflect.TypeFor[TraceroutePayload](),
+	"trust_peer":              reflect.TypeFor[PeerTrustPayload](),
+	"unblock_peer":            reflect.TypeFor[PeerTrustPayload](),
+	"unpin_peer_key":          reflect.TypeFor[PinPeerKeyPayload](),
+	"unsubscribe_stats":       reflect.TypeFor[UnsubscribeStatsPayload](),
+	"untap_connection":        reflect.TypeFor[DisconnectPayload](),
+	"verify_transfer":         reflect.TypeFor[VerifyTransferPayload](),
+	"wake_host":               reflect.TypeFor[WakeHostPayload](),
+	"who_uses_port":           reflect.TypeFor[WhoUsesPortPayload](),
+}
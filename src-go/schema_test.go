@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+type schemaProbe struct {
+	Name   string `json:"name" required:"true"`
+	Port   int    `json:"port"`
+	Nested *struct {
+		Host string `json:"host" required:"true"`
+	} `json:"nested"`
+	Items []struct {
+		ID string `json:"id" required:"true"`
+	} `json:"items"`
+}
+
+func TestDecodePayloadReportsFields(t *testing.T) {
+	cases := []struct {
+		payload string
+		want    []PayloadError
+	}{
+		{`{"name":"a","port":1}`, nil},
+		{`{"name":"a","colour":1}`, []PayloadError{{Field: "colour", Problem: problemUnknown}}},
+		{`{"name":"a","port":"80"}`, []PayloadError{{Field: "port", Problem: problemType, Expected: "number", Got: "string"}}},
+		{`{"port":1}`, []PayloadError{{Field: "name", Problem: problemRequired}}},
+		{`{"name":"a","nested":{},"items":[{"id":"x"},{}]}`, []PayloadError{
+			{Field: "nested.host", Problem: problemRequired},
+			{Field: "items[1].id", Problem: problemRequired},
+		}},
+		{`[1]`, []PayloadError{{Problem: problemType, Expected: "object", Got: "array"}}},
+		{`{"name":"a"} {}`, []PayloadError{{Problem: problemSyntax, Offset: 12}}},
+		{`{"name":`, []PayloadError{{Problem: problemSyntax}}},
+	}
+	for _, c := range cases {
+		var p schemaProbe
+		err := decodePayload(json.RawMessage(c.payload), &p)
+		var got PayloadErrors
+		if err != nil && !errors.As(err, &got) {
+			t.Errorf("%s: error %v is not PayloadErrors", c.payload, err)
+			continue
+		}
+		if len(got) != len(c.want) {
+			t.Errorf("%s: got %+v, want %+v", c.payload, got, c.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != c.want[i] {
+				t.Errorf("%s: problem %d is %+v, want %+v", c.payload, i, got[i], c.want[i])
+			}
+		}
+	}
+}
+
+func TestValidateOnlyDoesNotRun(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewOutput(&buf)
+	handleRequest(ProtocolRequest{Command: "set_namespace", ValidateOnly: true,
+		Payload: json.RawMessage(`{"namespace":"window-1"}`)}, w)
+	if w.Namespace() != "" || !strings.Contains(buf.String(), `"valid":true`) {
+		t.Errorf("validate_only ran the command or refused it: %s", buf.String())
+	}
+
+	buf.Reset()
+	handleRequest(ProtocolRequest{Command: "cancel", Payload: json.RawMessage(`{"id":7,"force":true}`)}, w)
+	var resp ProtocolResponse
+	if err := json.Unmarshal(buf.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	fields, _ := resp.Details["fields"].([]interface{})
+	if resp.Code != ErrInvalidPayload || len(fields) != 1 {
+		t.Errorf("bad cancel payload answered %s", buf.String())
+	}
+
+	buf.Reset()
+	handleRequest(ProtocolRequest{Command: "frobnicate", ValidateOnly: true}, w)
+	if !strings.Contains(buf.String(), ErrUnknownCommand) {
+		t.Errorf("validating an unknown command answered %s", buf.String())
+	}
+}
+
+func TestEveryCommandHasSchema(t *testing.T) {
+	src, err := os.ReadFile("main.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := string(src)
+	body = body[strings.Index(body, "func handleRequest("):]
+	body = body[:strings.Index(body, "\n}\n")]
+	for _, m := range regexp.MustCompile(`(?m)^\tcase (.+):$`).FindAllStringSubmatch(body, -1) {
+		for _, name := range regexp.MustCompile(`"([a-z0-9_]+)"`).FindAllStringSubmatch(m[1], -1) {
+			if _, ok := payloadSchemas[name[1]]; !ok {
+				t.Errorf("command %s has no entry in payloadSchemas", name[1])
+			}
+		}
+	}
+}
+
+func FuzzDecodePayload(f *testing.F) {
+	for _, seed := range []string{
+		`{}`, `{"host":"0.0.0.0","port":8080,"type":"tcp"}`, `{"port":"x"}`, `{"auth":{"secret":1}}`,
+		`{"media":{"streams":[1,2]}}`, `null`, `[]`, `{"a":` + strings.Repeat("[", 100), "\xff",
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var p StartServerPayload
+		err := decodePayload(data, &p)
+		var errs PayloadErrors
+		if err != nil && (!errors.As(err, &errs) || len(errs) == 0 || errs.Error() == "") {
+			t.Fatalf("decodePayload(%q) returned %#v", data, err)
+		}
+	})
+}
+
+func TestEnqueuePayloadChecksTheSend(t *testing.T) {
+	if err := checkEnqueuePayload(json.RawMessage(`{"kind":"directory","priority":2,"paths":["a"],"host":"h","port":1,"conflict":"skip"}`)); err != nil {
+		t.Errorf("directory job refused: %v", err)
+	}
+	if err := checkEnqueuePayload(json.RawMessage(`{"path":"a","host":"h","port":1,"encrypted":true}`)); err != nil {
+		t.Errorf("file job refused: %v", err)
+	}
+	err := checkEnqueuePayload(json.RawMessage(`{"path":"a","conflict":"skip"}`))
+	var errs PayloadErrors
+	if !errors.As(err, &errs) || errs[0].Field != "conflict" || errs[0].Problem != problemUnknown {
+		t.Errorf("conflict on a file job gave %v", err)
+	}
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Self-update: check_update fetches the release manifest at
+// update.manifest_url together with its detached Ed25519 signature, the
+// same URL plus ".sig", and says whether it names a newer version with a
+// binary for this platform. The signature is checked against the release
+// key built into the binary before anything in the manifest is believed,
+// and the manifest in turn pins each binary's size and SHA-256. Only the
+// URL is configuration: a key anyone with set_config could replace would
+// let them install whatever they signed. apply_update
+// downloads the binary next to the running executable, checks it against
+// the manifest and renames it into place, then emits restart_requested;
+// with restart set it also shuts down, and the frontend, which starts the
+// sidecar again whenever it exits, brings up the new binary.
+const (
+	defaultUpdateTimeout = 5 * time.Minute
+	maxManifestSize      = 1 << 20
+	maxSignatureSize     = 4 << 10
+)
+
+var updating atomic.Bool
+
+// updatePublicKey is the base64 Ed25519 key releases are signed with, set
+// with -ldflags "-X main.updatePublicKey=..."; builds without one cannot
+// update themselves
+var updatePublicKey = ""
+
+// UpdateConfig is the config section on where releases come from
+type UpdateConfig struct {
+	ManifestURL string `json:"manifest_url,omitempty"`
+}
+
+func (u UpdateConfig) Validate() error {
+	if u.ManifestURL == "" {
+		return nil
+	}
+	if parsed, err := url.Parse(u.ManifestURL); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return catalogError(ErrInvalidArgument, "selfupdate.manifest_url_invalid")
+	}
+	return nil
+}
+
+// releaseKey is the key built in to check release manifests with
+func releaseKey() (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(updatePublicKey)
+	if updatePublicKey == "" || err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, catalogError(ErrUnsupported, "selfupdate.no_release_key")
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// UpdateManifest is what a release publishes
+type UpdateManifest struct {
+	Version  string                  `json:"version"`
+	Notes    string                  `json:"notes,omitempty"`
+	Binaries map[string]UpdateBinary `json:"binaries"` // keyed by platform, such as "linux-amd64"
+}
+
+// UpdateBinary is one platform's build of a release
+type UpdateBinary struct {
+	URL    string `json:"url"` // relative URLs are resolved against the manifest's
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+func updatePlatform() string {
+	return runtime.GOOS + "-" + runtime.GOARCH
+}
+
+// fetchManifest downloads the manifest and its signature and returns the
+// manifest once the signature checks out
+func fetchManifest(ctx context.Context, client *http.Client, cfg UpdateConfig) (*UpdateManifest, error) {
+	key, err := releaseKey()
+	if err != nil {
+		return nil, err
+	}
+	if cfg.ManifestURL == "" {
+		return nil, catalogError(ErrFailed, "selfupdate.manifest_url_unset")
+	}
+	body, err := fetchSmall(ctx, client, cfg.ManifestURL, maxManifestSize)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := fetchSmall(ctx, client, cfg.ManifestURL+".sig", maxSignatureSize)
+	if err != nil {
+		return nil, err
+	}
+	sig, err = base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig)))
+	if err != nil || !ed25519.Verify(key, body, sig) {
+		return nil, errors.New("release manifest signature does not verify")
+	}
+	var m UpdateManifest
+	if err := json.Unmarshal(body, &m); err != nil {
+		return nil, fmt.Errorf("release manifest: %w", err)
+	}
+	if m.Version == "" {
+		return nil, errors.New("release manifest has no version")
+	}
+	return &m, nil
+}
+
+// fetchSmall GETs a document of at most limit bytes
+func fetchSmall(ctx context.Context, client *http.Client, u string, limit int64) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "lumina-net/"+version)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", u, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("%s is larger than %d bytes", u, limit)
+	}
+	return data, nil
+}
+
+// binary returns this platform's build with its URL made absolute
+func (m *UpdateManifest) binary(manifestURL string) (UpdateBinary, error) {
+	b, ok := m.Binaries[updatePlatform()]
+	if !ok {
+		return b, fmt.Errorf("release %s has no build for %s", m.Version, updatePlatform())
+	}
+	if b.Size <= 0 || len(b.SHA256) != sha256.Size*2 {
+		return b, fmt.Errorf("release %s lists no size and sha256 for %s", m.Version, updatePlatform())
+	}
+	base, _ := url.Parse(manifestURL)
+	ref, err := url.Parse(b.URL)
+	if err != nil {
+		return b, fmt.Errorf("release %s: %w", m.Version, err)
+	}
+	b.URL = base.ResolveReference(ref).String()
+	return b, nil
+}
+
+// newerVersion reports whether release a comes after b. Versions are dot
+// separated numbers with an optional leading v; a suffix after - or + is
+// ignored. A build that is not a release, such as "dev", is older than
+// every release.
+func newerVersion(a, b string) bool {
+	parse := func(v string) ([]int, bool) {
+		v = strings.TrimPrefix(v, "v")
+		if i := strings.IndexAny(v, "-+"); i >= 0 {
+			v = v[:i]
+		}
+		var parts []int
+		for _, s := range strings.Split(v, ".") {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 0 {
+				return nil, false
+			}
+			parts = append(parts, n)
+		}
+		return parts, true
+	}
+	av, aok := parse(a)
+	bv, bok := parse(b)
+	if !aok || !bok {
+		return aok && !bok
+	}
+	for i := 0; i < max(len(av), len(bv)); i++ {
+		var x, y int
+		if i < len(av) {
+			x = av[i]
+		}
+		if i < len(bv) {
+			y = bv[i]
+		}
+		if x != y {
+			return x > y
+		}
+	}
+	return false
+}
+
+type CheckUpdatePayload struct {
+	Proxy     string `json:"proxy"` // proxy URL, or "direct" to skip the configured proxy
+	TimeoutMs int    `json:"timeout_ms"`
+}
+
+// handleCheckUpdate reports whether a newer release is out
+func handleCheckUpdate(payload json.RawMessage, writer *Output) {
+	var p CheckUpdatePayload
+	if len(payload) > 0 && string(payload) != "null" {
+		if err := json.Unmarshal(payload, &p); err != nil {
+			sendInvalidPayload(writer, "check_update")
+			return
+		}
+	}
+	if err := validProxy(p.Proxy, "tcp"); err != nil {
+		sendFailure(writer, err)
+		return
+	}
+	timeout := defaultUpdateTimeout
+	if p.TimeoutMs > 0 {
+		timeout = time.Duration(p.TimeoutMs) * time.Millisecond
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cfg := config.Get().Update
+	m, err := fetchManifest(ctx, downloadClient(p.Proxy, timeout), cfg)
+	if err != nil {
+		sendFailure(writer, err)
+		return
+	}
+	data := map[string]interface{}{
+		"current":   version,
+		"latest":    m.Version,
+		"platform":  updatePlatform(),
+		"available": false,
+	}
+	if m.Notes != "" {
+		data["notes"] = m.Notes
+	}
+	if b, err := m.binary(cfg.ManifestURL); err != nil {
+		data["reason"] = err.Error()
+	} else if newerVersion(m.Version, version) {
+		data["available"], data["size"] = true, b.Size
+	}
+	writer.Encode(ProtocolResponse{Status: "ok", Data: data})
+}
+
+type ApplyUpdatePayload struct {
+	Force     bool   `json:"force"`      // install the manifest's release even if it is not newer
+	Restart   bool   `json:"restart"`    // shut down once it is in place, so the frontend starts the new binary
+	Proxy     string `json:"proxy"`      // as for check_update
+	TimeoutMs int    `json:"timeout_ms"` // for the whole download, default 5 minutes
+}
+
+// handleApplyUpdate checks the manifest, answers, and replaces the binary
+// in the background, reporting update_applied or update_failed
+func handleApplyUpdate(payload json.RawMessage, writer *Output) {
+	var p ApplyUpdatePayload
+	if len(payload) > 0 && string(payload) != "null" {
+		if err := json.Unmarshal(payload, &p); err != nil {
+			sendInvalidPayload(writer, "apply_update")
+			return
+		}
+	}
+	if err := validProxy(p.Proxy, "tcp"); err != nil {
+		sendFailure(writer, err)
+		return
+	}
+	timeout := defaultUpdateTimeout
+	if p.TimeoutMs > 0 {
+		timeout = time.Duration(p.TimeoutMs) * time.Millisecond
+	}
+	client := downloadClient(p.Proxy, timeout)
+	cfg := config.Get().Update
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	m, err := fetchManifest(ctx, client, cfg)
+	cancel()
+	if err != nil {
+		sendFailure(writer, err)
+		return
+	}
+	b, err := m.binary(cfg.ManifestURL)
+	if err != nil {
+		sendFailure(writer, err)
+		return
+	}
+	if !p.Force && !newerVersion(m.Version, version) {
+		sendError(writer, message("selfupdate.up_to_date", "version", m.Version, "current", version))
+		return
+	}
+	exe, err := os.Executable()
+	if err == nil {
+		exe, err = filepath.EvalSymlinks(exe)
+	}
+	if err != nil {
+		sendError(writer, message("selfupdate.cannot_locate", "error", err))
+		return
+	}
+	if !updating.CompareAndSwap(false, true) {
+		sendError(writer, message("selfupdate.in_progress"))
+		return
+	}
+
+	writer.Encode(okResponse(message("selfupdate.update_started"),
+		map[string]interface{}{"id": "update", "current": version, "version": m.Version, "size": b.Size, "path": exe}))
+	jobCtx, done := trackJob("update", "update", b.URL)
+	go func() {
+		defer recoverPanic("update")
+		defer done()
+		defer updating.Store(false)
+		ctx, cancel := context.WithTimeout(jobCtx, timeout)
+		defer cancel()
+		if err := installBinary(ctx, client, b, exe); err != nil {
+			logger.Warn("self-update failed", "version", m.Version, "error", err)
+			emitEvent("update_failed", map[string]interface{}{"version": m.Version, "error": err.Error()})
+			return
+		}
+		logger.Info("self-update installed", "from", version, "to", m.Version, "path", exe)
+		emitEvent("update_applied", map[string]interface{}{"from": version, "version": m.Version, "path": exe})
+		emitEvent("restart_requested", map[string]interface{}{"reason": "update", "version": m.Version})
+		if p.Restart {
+			shutdown(defaultDrainTimeout)
+		}
+	}()
+}
+
+// installBinary downloads b beside exe, checks it against the manifest and
+// renames it over exe. A failure at any step leaves exe as it was.
+func installBinary(ctx context.Context, client *http.Client, b UpdateBinary, exe string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, b.URL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "lumina-net/"+version)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", b.URL, resp.Status)
+	}
+
+	// Same directory, so the rename cannot cross file systems
+	f, err := os.CreateTemp(filepath.Dir(exe), "."+filepath.Base(exe)+".update-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), io.LimitReader(resp.Body, b.Size+1))
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if n != b.Size {
+		return fmt.Errorf("downloaded %d bytes, the manifest says %d", n, b.Size)
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(sum, b.SHA256) {
+		return fmt.Errorf("downloaded binary has sha256 %s, the manifest says %s", sum, b.SHA256)
+	}
+	if err := os.Chmod(f.Name(), 0o755); err != nil {
+		return err
+	}
+	return replaceExecutable(f.Name(), exe)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewerVersion(t *testing.T) {
+	cases := []struct {
+		a, b string
+		want bool
+	}{
+		{"1.2.0", "1.1.9", true},
+		{"v1.10.0", "1.9.3", true},
+		{"1.2", "1.2.0", false},
+		{"1.2.1-rc1", "1.2.0", true},
+		{"1.2.0", "1.2.0", false},
+		{"1.0.0", "dev", true},
+		{"dev", "1.0.0", false},
+	}
+	for _, c := range cases {
+		if got := newerVersion(c.a, c.b); got != c.want {
+			t.Errorf("newerVersion(%q, %q) = %v", c.a, c.b, got)
+		}
+	}
+}
+
+func TestSelfUpdateVerifiesManifestAndBinary(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	binary := []byte("#!/bin/sh\necho new\n")
+	sum := sha256.Sum256(binary)
+	manifest, _ := json.Marshal(UpdateManifest{
+		Version: "9.0.0",
+		Binaries: map[string]UpdateBinary{
+			updatePlatform(): {URL: "bin/lumina-net", Size: int64(len(binary)), SHA256: hex.EncodeToString(sum[:])},
+		},
+	})
+	served := manifest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/release.json":
+			w.Write(served)
+		case "/release.json.sig":
+			w.Write([]byte(base64.StdEncoding.EncodeToString(ed25519.Sign(priv, manifest)) + "\n"))
+		case "/bin/lumina-net":
+			w.Write(binary)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	cfg := UpdateConfig{ManifestURL: srv.URL + "/release.json"}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	saved := updatePublicKey
+	t.Cleanup(func() { updatePublicKey = saved })
+	updatePublicKey = ""
+	if _, err := fetchManifest(ctx, srv.Client(), cfg); err == nil {
+		t.Error("manifest accepted by a build without a release key")
+	}
+	updatePublicKey = base64.StdEncoding.EncodeToString(pub)
+	m, err := fetchManifest(ctx, srv.Client(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := m.binary(cfg.ManifestURL)
+	if err != nil || b.URL != srv.URL+"/bin/lumina-net" {
+		t.Fatalf("binary %+v, %v", b, err)
+	}
+
+	exe := filepath.Join(t.TempDir(), "lumina-net")
+	os.WriteFile(exe, []byte("old"), 0o755)
+	bad := b
+	bad.SHA256 = hex.EncodeToString(make([]byte, sha256.Size))
+	if err := installBinary(ctx, srv.Client(), bad, exe); err == nil {
+		t.Error("binary with the wrong digest installed")
+	}
+	if data, _ := os.ReadFile(exe); string(data) != "old" {
+		t.Errorf("failed install changed the executable to %q", data)
+	}
+	if err := installBinary(ctx, srv.Client(), b, exe); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(exe); string(data) != string(binary) {
+		t.Errorf("executable is %q after the update", data)
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(exe)); len(entries) != 1 {
+		t.Errorf("left %d files beside the executable", len(entries))
+	}
+
+	// A manifest altered after signing is refused
+	served = append([]byte(nil), manifest...)
+	served[len(served)-2] = ' '
+	if _, err := fetchManifest(ctx, srv.Client(), cfg); err == nil {
+		t.Error("tampered manifest accepted")
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !windows
+
+package main
+
+import "os"
+
+// replaceExecutable moves next over exe in one rename; the running process
+// keeps the old file open until it exits
+func replaceExecutable(next, exe string) error {
+	return os.Rename(next, exe)
+}
@@ -0,0 +1,19 @@
+package main
+
+import "os"
+
+// replaceExecutable moves next over exe. A running executable cannot be
+// replaced on Windows, only renamed, so the old one steps aside to exe.old
+// first and is removed on the next update.
+func replaceExecutable(next, exe string) error {
+	old := exe + ".old"
+	os.Remove(old)
+	if err := os.Rename(exe, old); err != nil {
+		return err
+	}
+	if err := os.Rename(next, exe); err != nil {
+		os.Rename(old, exe)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// File bodies that cross plain TCP as they are, without compression,
+// encryption or a tap, go from the page cache to the socket without a
+// trip through user space: (*net.TCPConn).ReadFrom hands an *os.File to
+// sendfile, or splice on Linux. The SHA-256 trailer still needs the
+// bytes, so a second reader hashes each slice just behind the one on the
+// wire. Everything else takes the buffered copy.
+const zeroCopySlice = 1 << 20 // bytes per sendfile call, which is how often progress, pause and rate limits are looked at
+
+// fileSender is a body writer that can move file bytes itself
+type fileSender interface {
+	io.Writer
+	canSendFile() bool
+	// sendFile writes n bytes from f's current offset
+	sendFile(f *os.File, n int64) (int64, error)
+}
+
+// copyFileBody writes the rest of f, size bytes counted from the start,
+// into w. It counts progress on t and hashes what it sends into h unless
+// h is nil.
+func copyFileBody(w io.Writer, f *os.File, size int64, t *Transfer, h hash.Hash) error {
+	if s, ok := w.(fileSender); ok && s.canSendFile() {
+		return sendFileBody(s, f, size, t, h)
+	}
+	var src io.Reader = f
+	if h != nil {
+		src = io.TeeReader(f, h)
+	}
+	_, err := io.CopyBuffer(progressWriter{w: w, t: t}, src, make([]byte, transferBufferSize))
+	return err
+}
+
+func sendFileBody(s fileSender, f *os.File, size int64, t *Transfer, h hash.Hash) error {
+	off, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+
+	// Hash slice by slice behind the sender, reading at offsets so the
+	// file position sendfile works from is left alone
+	sent := make(chan [2]int64, 4)
+	var hashErr error
+	var wg sync.WaitGroup
+	if h != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for r := range sent {
+				if hashErr == nil {
+					hashErr = callSafe("checksum for "+t.ID, func() error {
+						_, err := io.Copy(h, io.NewSectionReader(f, r[0], r[1]))
+						return err
+					})
+				}
+			}
+		}()
+	}
+	var sendErr error
+	for off < size {
+		want := min(size-off, zeroCopySlice)
+		n, err := s.sendFile(f, want)
+		if n > 0 {
+			t.Add(int(n))
+			t.share.WaitN(int(n))
+			if h != nil {
+				sent <- [2]int64{off, n}
+			}
+			off += n
+		}
+		if err == nil && n < want {
+			err = errors.New("file changed during transfer")
+		}
+		if err != nil {
+			sendErr = err
+			break
+		}
+	}
+	close(sent)
+	wg.Wait()
+	if sendErr != nil {
+		return sendErr
+	}
+	return hashErr
+}
+
+func (c *Connection) canSendFile() bool {
+	_, ok := c.Conn().(*net.TCPConn)
+	return ok
+}
+
+// sendFile moves file bytes with sendfile, falling back to Write when a
+// tap attached since the transfer started and needs to see them
+func (c *Connection) sendFile(f *os.File, n int64) (int64, error) {
+	tcp, ok := c.Conn().(*net.TCPConn)
+	if !ok || c.tap.Load() != nil {
+		return io.CopyBuffer(writerOnly{c}, io.LimitReader(f, n), make([]byte, transferBufferSize))
+	}
+	c.throttle(int(n))
+	if write := c.Timeouts().Write; write > 0 {
+		tcp.SetWriteDeadline(time.Now().Add(write))
+	}
+	written, err := tcp.ReadFrom(io.LimitReader(f, n))
+	c.countOut(int(written))
+	if written > 0 && c.Timeouts().Idle > 0 {
+		c.armReadDeadline()
+	}
+	return written, err
+}
+
+// writerOnly hides ReadFrom so a copy goes through Write
+type writerOnly struct{ io.Writer }
+
+func (pw *pausableWriter) canSendFile() bool {
+	// Checked frames need the bytes in hand
+	s, ok := pw.w.(fileSender)
+	return ok && pw.chunks == nil && s.canSendFile()
+}
+
+// sendFile sends n file bytes as one data frame, once any pause is over
+func (pw *pausableWriter) sendFile(f *os.File, n int64) (int64, error) {
+	if err := pw.t.waitWhilePaused(); err != nil {
+		return 0, err
+	}
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	var header [frameHeaderSize]byte
+	header[0] = frameData
+	binary.BigEndian.PutUint32(header[1:], uint32(n))
+	if _, err := pw.w.Write(header[:]); err != nil {
+		return 0, err
+	}
+	written, err := pw.w.(fileSender).sendFile(f, n)
+	if err == nil && written < n {
+		// The frame promised n bytes; nothing sensible can follow
+		err = io.ErrUnexpectedEOF
+	}
+	return written, err
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// A "serial" listener bridges its port to a local serial device, so the
+// console of an Arduino or another board plugged into this machine can be
+// reached from the rest of the LAN with netcat, telnet or a second Lumina.
+// The device is opened when a peer connects and closed when it leaves, and
+// only one peer holds it at a time; others are told it is busy. Bytes pass
+// through untouched, so the listener takes compression, encryption and
+// auth like any other stream listener.
+const (
+	defaultSerialBaud     = 9600
+	defaultSerialDataBits = 8
+)
+
+// SerialOptions are the device and line settings of a "serial" listener
+type SerialOptions struct {
+	Device      string `json:"device"`       // "/dev/ttyUSB0", "/dev/cu.usbmodem1101" or "COM3"
+	Baud        int    `json:"baud"`         // default 9600
+	DataBits    int    `json:"data_bits"`    // 5 to 8, default 8
+	Parity      string `json:"parity"`       // "none" (default), "even" or "odd"
+	StopBits    int    `json:"stop_bits"`    // 1 (default) or 2
+	FlowControl string `json:"flow_control"` // "none" (default) or "rtscts"
+}
+
+func (o *SerialOptions) Validate() error {
+	if o == nil || o.Device == "" {
+		return catalogError(ErrInvalidArgument, "serial.serial_listeners_require_device")
+	}
+	if o.Baud < 0 {
+		return catalogError(ErrInvalidArgument, "serial.baud_must_not")
+	}
+	if o.DataBits != 0 && (o.DataBits < 5 || o.DataBits > 8) {
+		return catalogError(ErrInvalidArgument, "serial.data_bits_must_between")
+	}
+	switch o.Parity {
+	case "", "none", "even", "odd":
+	default:
+		return catalogError(ErrInvalidArgument, "serial.parity_must_none_even", "parity", fmt.Sprintf("%q", o.Parity))
+	}
+	if o.StopBits != 0 && o.StopBits != 1 && o.StopBits != 2 {
+		return catalogError(ErrInvalidArgument, "serial.stop_bits_must")
+	}
+	switch o.FlowControl {
+	case "", "none", "rtscts":
+	default:
+		return catalogError(ErrInvalidArgument, "serial.flow_control_must_none", "flow_control", fmt.Sprintf("%q", o.FlowControl))
+	}
+	return nil
+}
+
+// withDefaults fills in the settings left at zero
+func (o SerialOptions) withDefaults() SerialOptions {
+	if o.Baud == 0 {
+		o.Baud = defaultSerialBaud
+	}
+	if o.DataBits == 0 {
+		o.DataBits = defaultSerialDataBits
+	}
+	if o.Parity == "" {
+		o.Parity = "none"
+	}
+	if o.StopBits == 0 {
+		o.StopBits = 1
+	}
+	if o.FlowControl == "" {
+		o.FlowControl = "none"
+	}
+	return o
+}
+
+// serialBridge is the device of a "serial" listener and who holds it
+type serialBridge struct {
+	SerialOptions
+
+	mu    sync.Mutex
+	owner string // ID of the connection holding the device, "" while free
+}
+
+func newSerialBridge(o SerialOptions) *serialBridge {
+	return &serialBridge{SerialOptions: o.withDefaults()}
+}
+
+// claim hands the device to connection id unless another peer holds it
+func (b *serialBridge) claim(id string) (string, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.owner != "" {
+		return b.owner, false
+	}
+	b.owner = id
+	return id, true
+}
+
+func (b *serialBridge) release() {
+	b.mu.Lock()
+	b.owner = ""
+	b.mu.Unlock()
+}
+
+func (b *serialBridge) Info() map[string]interface{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return map[string]interface{}{
+		"device":       b.Device,
+		"baud":         b.Baud,
+		"data_bits":    b.DataBits,
+		"parity":       b.Parity,
+		"stop_bits":    b.StopBits,
+		"flow_control": b.FlowControl,
+		"connection":   b.owner,
+	}
+}
+
+// handleSerialConnection passes bytes between a peer and the serial device
+// until either side closes
+func handleSerialConnection(c *Connection, l *Listener, _ string) {
+	defer untrackConn(c)
+	emitEvent("connection_opened", c.Info())
+
+	b := l.Serial
+	if owner, ok := b.claim(c.ID); !ok {
+		fmt.Fprintf(c, "%s is in use by another connection\r\n", b.Device)
+		emitEvent("connection_closed", map[string]interface{}{"id": c.ID, "reason": "busy", "holder": owner})
+		return
+	}
+	defer b.release()
+
+	port, err := openSerial(b.SerialOptions)
+	if err != nil {
+		logger.Warn("serial device failed", "device", b.Device, "err", err)
+		fmt.Fprintf(c, "cannot open %s: %v\r\n", b.Device, err)
+		emitEvent("connection_closed", map[string]interface{}{"id": c.ID, "reason": "serial_error", "error": err.Error()})
+		return
+	}
+	logger.Info("serial device opened", "device", b.Device, "connection", c.ID)
+	emitEvent("serial_opened", map[string]interface{}{"id": c.ID, "listener_id": l.ID, "device": b.Device})
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(c, port)
+		c.Close() // the device went away; end the peer's side too
+		done <- err
+	}()
+	_, err = io.Copy(port, c)
+	if err == nil {
+		err = io.EOF
+	}
+	port.Close()
+	if derr := <-done; derr != nil && !errors.Is(derr, os.ErrClosed) {
+		logger.Warn("serial device failed", "device", b.Device, "err", derr)
+	}
+	logger.Info("serial device closed", "device", b.Device, "connection", c.ID)
+	emitClosed(c, err)
+}
@@ -0,0 +1,14 @@
+package main
+
+import "golang.org/x/sys/unix"
+
+const (
+	termiosGet = unix.TIOCGETA
+	termiosSet = unix.TIOCSETA
+)
+
+// setSerialSpeed sets the rate directly, the BSD termios keeps it as a
+// number
+func setSerialSpeed(t *unix.Termios, baud int) {
+	t.Ispeed, t.Ospeed = uint64(baud), uint64(baud)
+}
@@ -0,0 +1,15 @@
+package main
+
+import "golang.org/x/sys/unix"
+
+// termios2 takes any baud rate, not just the standard ones
+const (
+	termiosGet = unix.TCGETS2
+	termiosSet = unix.TCSETS2
+)
+
+func setSerialSpeed(t *unix.Termios, baud int) {
+	t.Cflag &^= unix.CBAUD | unix.CBAUD<<unix.IBSHIFT
+	t.Cflag |= unix.BOTHER | unix.BOTHER<<unix.IBSHIFT
+	t.Ispeed, t.Ospeed = uint32(baud), uint32(baud)
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !windows
+
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+// Elsewhere there is no serial support
+func openSerial(SerialOptions) (io.ReadWriteCloser, error) {
+	return nil, errors.ErrUnsupported
+}
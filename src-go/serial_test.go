@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestSerialOptionsValidate(t *testing.T) {
+	for _, o := range []*SerialOptions{
+		nil,
+		{},
+		{Device: "COM3", Baud: -1},
+		{Device: "COM3", DataBits: 9},
+		{Device: "COM3", Parity: "mark"},
+		{Device: "COM3", StopBits: 3},
+		{Device: "COM3", FlowControl: "xonxoff"},
+	} {
+		if o.Validate() == nil {
+			t.Errorf("%+v accepted", o)
+		}
+	}
+	o := &SerialOptions{Device: "/dev/ttyUSB0", Baud: 115200, Parity: "even"}
+	if err := o.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	d := o.withDefaults()
+	if d.Baud != 115200 || d.DataBits != 8 || d.StopBits != 1 || d.Parity != "even" || d.FlowControl != "none" {
+		t.Errorf("defaults filled in as %+v", d)
+	}
+}
+
+func TestSerialBridgeHasOneOwner(t *testing.T) {
+	b := newSerialBridge(SerialOptions{Device: "COM3"})
+	if _, ok := b.claim("conn-1"); !ok {
+		t.Fatal("free device refused")
+	}
+	if owner, ok := b.claim("conn-2"); ok || owner != "conn-1" {
+		t.Errorf("second claim got %v, holder %s", ok, owner)
+	}
+	b.release()
+	if _, ok := b.claim("conn-2"); !ok {
+		t.Error("released device refused")
+	}
+}
+
+func TestStartServerChecksSerialOptions(t *testing.T) {
+	for _, payload := range []string{
+		`{"port":0,"type":"serial"}`,
+		`{"port":0,"type":"serial","serial":{"device":"COM3","parity":"mark"}}`,
+		`{"port":0,"type":"echo","serial":{"device":"COM3"}}`,
+	} {
+		var buf bytes.Buffer
+		handleStartServer(json.RawMessage(payload), NewOutput(&buf))
+		if !strings.Contains(buf.String(), `"error"`) {
+			t.Errorf("%s started: %s", payload, buf.String())
+		}
+	}
+}
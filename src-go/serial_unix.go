@@ -0,0 +1,73 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// openSerial opens a tty in raw mode with the line settings of o. The
+// descriptor stays non-blocking so the runtime poller can interrupt reads
+// when the bridge closes it.
+func openSerial(o SerialOptions) (io.ReadWriteCloser, error) {
+	f, err := os.OpenFile(o.Device, os.O_RDWR|unix.O_NOCTTY|unix.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := f.SyscallConn()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	var terr error
+	err = raw.Control(func(fd uintptr) {
+		var t *unix.Termios
+		if t, terr = unix.IoctlGetTermios(int(fd), termiosGet); terr != nil {
+			return
+		}
+		t.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR |
+			unix.ICRNL | unix.IXON | unix.IXOFF | unix.IXANY | unix.INPCK
+		t.Oflag &^= unix.OPOST
+		t.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+		t.Cflag &^= unix.CSIZE | unix.PARENB | unix.PARODD | unix.CSTOPB | unix.CRTSCTS
+		t.Cflag |= unix.CREAD | unix.CLOCAL
+		switch o.DataBits {
+		case 5:
+			t.Cflag |= unix.CS5
+		case 6:
+			t.Cflag |= unix.CS6
+		case 7:
+			t.Cflag |= unix.CS7
+		default:
+			t.Cflag |= unix.CS8
+		}
+		switch o.Parity {
+		case "even":
+			t.Cflag |= unix.PARENB
+			t.Iflag |= unix.INPCK
+		case "odd":
+			t.Cflag |= unix.PARENB | unix.PARODD
+			t.Iflag |= unix.INPCK
+		}
+		if o.StopBits == 2 {
+			t.Cflag |= unix.CSTOPB
+		}
+		if o.FlowControl == "rtscts" {
+			t.Cflag |= unix.CRTSCTS
+		}
+		t.Cc[unix.VMIN], t.Cc[unix.VTIME] = 1, 0
+		setSerialSpeed(t, o.Baud)
+		terr = unix.IoctlSetTermios(int(fd), termiosSet, t)
+	})
+	if err == nil {
+		err = terr
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// serialPollMs bounds how long a read waits for the device before checking
+// whether the bridge closed the port; a blocked ReadFile cannot be
+// interrupted from another goroutine
+const serialPollMs = 200
+
+// DCB flag bits, see the DCB structure in winbase.h
+const (
+	dcbBinary      = 1 << 0
+	dcbParity      = 1 << 1
+	dcbOutxCtsFlow = 1 << 2
+)
+
+type comPort struct {
+	h      windows.Handle
+	closed atomic.Bool
+	reads  sync.Mutex // held by Read, so Close never pulls the handle from under ReadFile
+}
+
+// openSerial opens a COM port with the line settings of o
+func openSerial(o SerialOptions) (io.ReadWriteCloser, error) {
+	name := o.Device
+	if !strings.HasPrefix(name, `\\.\`) {
+		name = `\\.\` + name // COM10 and above are only reachable this way
+	}
+	path, err := windows.UTF16PtrFromString(name)
+	if err != nil {
+		return nil, err
+	}
+	h, err := windows.CreateFile(path, windows.GENERIC_READ|windows.GENERIC_WRITE, 0, nil, windows.OPEN_EXISTING, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	var dcb windows.DCB
+	dcb.DCBlength = uint32(unsafe.Sizeof(dcb))
+	if err := windows.GetCommState(h, &dcb); err != nil {
+		windows.CloseHandle(h)
+		return nil, err
+	}
+	dcb.BaudRate = uint32(o.Baud)
+	dcb.ByteSize = uint8(o.DataBits)
+	dcb.Flags = dcbBinary | windows.DTR_CONTROL_ENABLE | windows.RTS_CONTROL_ENABLE
+	dcb.Parity = windows.NOPARITY
+	switch o.Parity {
+	case "even":
+		dcb.Parity = windows.EVENPARITY
+		dcb.Flags |= dcbParity
+	case "odd":
+		dcb.Parity = windows.ODDPARITY
+		dcb.Flags |= dcbParity
+	}
+	dcb.StopBits = windows.ONESTOPBIT
+	if o.StopBits == 2 {
+		dcb.StopBits = windows.TWOSTOPBITS
+	}
+	if o.FlowControl == "rtscts" {
+		dcb.Flags = dcb.Flags&^windows.RTS_CONTROL_ENABLE | dcbOutxCtsFlow | windows.RTS_CONTROL_HANDSHAKE
+	}
+	if err := windows.SetCommState(h, &dcb); err != nil {
+		windows.CloseHandle(h)
+		return nil, err
+	}
+	// Return as soon as a byte arrives, or empty-handed after serialPollMs
+	timeouts := windows.CommTimeouts{
+		ReadIntervalTimeout:        ^uint32(0),
+		ReadTotalTimeoutMultiplier: ^uint32(0),
+		ReadTotalTimeoutConstant:   serialPollMs,
+	}
+	if err := windows.SetCommTimeouts(h, &timeouts); err != nil {
+		windows.CloseHandle(h)
+		return nil, err
+	}
+	return &comPort{h: h}, nil
+}
+
+func (p *comPort) Read(b []byte) (int, error) {
+	p.reads.Lock()
+	defer p.reads.Unlock()
+	for {
+		if p.closed.Load() {
+			return 0, os.ErrClosed
+		}
+		var n uint32
+		if err := windows.ReadFile(p.h, b, &n, nil); err != nil {
+			return 0, err
+		}
+		if n > 0 {
+			return int(n), nil
+		}
+	}
+}
+
+func (p *comPort) Write(b []byte) (int, error) {
+	if p.closed.Load() {
+		return 0, os.ErrClosed
+	}
+	var n uint32
+	err := windows.WriteFile(p.h, b, &n, nil)
+	return int(n), err
+}
+
+func (p *comPort) Close() error {
+	if p.closed.Swap(true) {
+		return nil
+	}
+	p.reads.Lock()
+	defer p.reads.Unlock()
+	return windows.CloseHandle(p.h)
+}
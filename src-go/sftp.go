@@ -0,0 +1,550 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// "sftp" listeners are an SSH server any standard client can drop files on
+// without running Lumina: sftp, scp (which speaks SFTP by default and the
+// old protocol with -O), WinSCP or a file manager. Clients log in with the
+// configured username and a password or one of the authorized keys, get
+// no shell, and see only the download directory. The host key is generated
+// on first use and kept beside the config so clients can pin it.
+const (
+	sshHandshakeTimeout = 15 * time.Second
+	maxSSHAuthTries     = 6
+	maxSCPLine          = 4096
+)
+
+// SFTPOptions configures an "sftp" listener
+type SFTPOptions struct {
+	Username           string   `json:"username"`
+	Password           string   `json:"password"`             // empty allows keys only
+	AuthorizedKeys     []string `json:"authorized_keys"`      // public keys in authorized_keys format
+	AuthorizedKeysFile string   `json:"authorized_keys_file"` // or a file of them
+	HostKey            string   `json:"host_key"`             // private key file, default lumina-sftp-host.key beside the config
+	AllowDelete        bool     `json:"allow_delete"`         // let clients remove, truncate and overwrite files and remove directories
+}
+
+// Validate checks the credentials form a usable login
+func (o *SFTPOptions) Validate() error {
+	if o == nil || o.Username == "" {
+		return catalogError(ErrInvalidArgument, "sftp.listeners_require_username")
+	}
+	if o.Password == "" && len(o.AuthorizedKeys) == 0 && o.AuthorizedKeysFile == "" {
+		return catalogError(ErrInvalidArgument, "sftp.listeners_require_password")
+	}
+	return nil
+}
+
+func sftpHostKeyPath(configPath string) string {
+	return filepath.Join(filepath.Dir(configPath), "lumina-sftp-host.key")
+}
+
+// sshServer is the SSH side of an "sftp" listener
+type sshServer struct {
+	config      *ssh.ServerConfig
+	fingerprint string
+	allowDelete bool
+}
+
+// newSSHServer loads the host key and authorized keys for a listener
+func newSSHServer(o SFTPOptions, l *Listener) (*sshServer, error) {
+	keyPath := o.HostKey
+	if keyPath == "" {
+		keyPath = sftpHostKeyPath(config.Path())
+	}
+	signer, err := loadHostKey(keyPath, o.HostKey == "")
+	if err != nil {
+		return nil, err
+	}
+
+	lines := strings.Join(o.AuthorizedKeys, "\n")
+	if o.AuthorizedKeysFile != "" {
+		data, err := os.ReadFile(o.AuthorizedKeysFile)
+		if err != nil {
+			return nil, err
+		}
+		lines += "\n" + string(data)
+	}
+	var keys [][]byte
+	for rest := []byte(lines); len(bytes.TrimSpace(rest)) > 0; {
+		key, _, _, next, err := ssh.ParseAuthorizedKey(rest)
+		if err != nil {
+			return nil, catalogError(ErrInvalidArgument, "sftp.invalid_authorized_key", "error", err)
+		}
+		keys = append(keys, key.Marshal())
+		rest = next
+	}
+
+	user := []byte(o.Username)
+	cfg := &ssh.ServerConfig{
+		MaxAuthTries:  maxSSHAuthTries,
+		ServerVersion: "SSH-2.0-Lumina_" + version,
+		AuthLogCallback: func(conn ssh.ConnMetadata, method string, err error) {
+			if err != nil && method != "none" {
+				reason := method + ": " + err.Error()
+				logger.Warn("authentication failed", "listener", l.Addr, "remote", conn.RemoteAddr().String(), "reason", reason)
+				emitEvent("auth_failed", map[string]interface{}{
+					"listener":    l.Addr,
+					"listener_id": l.ID,
+					"remote":      conn.RemoteAddr().String(),
+					"reason":      reason,
+				})
+			}
+		},
+	}
+	if o.Password != "" {
+		password := []byte(o.Password)
+		cfg.PasswordCallback = func(conn ssh.ConnMetadata, given []byte) (*ssh.Permissions, error) {
+			okUser := subtle.ConstantTimeCompare([]byte(conn.User()), user)
+			okPassword := subtle.ConstantTimeCompare(given, password)
+			if okUser&okPassword == 1 {
+				return nil, nil
+			}
+			return nil, errors.New("wrong username or password")
+		}
+	}
+	if len(keys) > 0 {
+		cfg.PublicKeyCallback = func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if subtle.ConstantTimeCompare([]byte(conn.User()), user) != 1 {
+				return nil, errors.New("unknown user")
+			}
+			given := key.Marshal()
+			for _, k := range keys {
+				if bytes.Equal(k, given) {
+					return &ssh.Permissions{Extensions: map[string]string{"key": ssh.FingerprintSHA256(key)}}, nil
+				}
+			}
+			return nil, errors.New("key not authorized")
+		}
+	}
+	cfg.AddHostKey(signer)
+
+	return &sshServer{
+		config:      cfg,
+		fingerprint: ssh.FingerprintSHA256(signer.PublicKey()),
+		allowDelete: o.AllowDelete,
+	}, nil
+}
+
+// loadHostKey reads a private key, generating an Ed25519 one first when
+// generate is set and the file does not exist yet
+func loadHostKey(path string, generate bool) (ssh.Signer, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) && generate {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		block, err := ssh.MarshalPrivateKey(key, "lumina sftp host key")
+		if err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path+".tmp", pem.EncodeToMemory(block), 0o600); err != nil {
+			return nil, err
+		}
+		if err := os.Rename(path+".tmp", path); err != nil {
+			return nil, err
+		}
+		logger.Info("generated sftp host key", "path", path)
+		return ssh.NewSignerFromKey(key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return signer, nil
+}
+
+// handleSFTPConnection runs the SSH handshake and serves each session
+// channel the client opens
+func handleSFTPConnection(c *Connection, l *Listener, dir string) {
+	defer untrackConn(c)
+
+	c.SetDeadline(time.Now().Add(sshHandshakeTimeout))
+	conn, chans, requests, err := ssh.NewServerConn(c, l.SFTP.config)
+	if err != nil {
+		logger.Warn("ssh handshake failed", "id", c.ID, "listener", l.Addr, "remote", c.RemoteAddr().String(), "error", err)
+		return
+	}
+	c.SetDeadline(time.Time{})
+	defer conn.Close()
+	go ssh.DiscardRequests(requests)
+
+	c.setAuth("ssh")
+	c.setProtocol("sftp")
+	logger.Info("sftp session started", "id", c.ID, "user", conn.User(), "remote", c.RemoteAddr().String())
+	emitEvent("connection_opened", c.Info())
+
+	root := sftpRoot{dir: downloadDirFor(dir), allowDelete: l.SFTP.allowDelete}
+	for nc := range chans {
+		if nc.ChannelType() != "session" {
+			nc.Reject(ssh.UnknownChannelType, "only session channels are offered")
+			continue
+		}
+		ch, reqs, err := nc.Accept()
+		if err != nil {
+			continue
+		}
+		go serveSSHSession(c, root, ch, reqs)
+	}
+	emitClosed(c, conn.Wait())
+}
+
+// serveSSHSession waits for the client to ask for the sftp subsystem or an
+// scp upload; shells, terminals and other commands are refused
+func serveSSHSession(c *Connection, root sftpRoot, ch ssh.Channel, requests <-chan *ssh.Request) {
+	defer recoverPanic("sftp session on " + c.ID)
+	defer ch.Close()
+	remote := c.RemoteAddr().String()
+	for req := range requests {
+		var arg struct{ Value string }
+		switch req.Type {
+		case "subsystem":
+			if ssh.Unmarshal(req.Payload, &arg) != nil || arg.Value != "sftp" {
+				break
+			}
+			req.Reply(true, nil)
+			go ssh.DiscardRequests(requests)
+			err := newSFTPSession(root, ch, remote).serve()
+			if err != nil {
+				logger.Warn("sftp session failed", "id", c.ID, "error", err)
+			}
+			sendExitStatus(ch, err)
+			return
+		case "exec":
+			if ssh.Unmarshal(req.Payload, &arg) != nil {
+				break
+			}
+			target, err := parseSCPCommand(arg.Value)
+			if err != nil {
+				req.Reply(true, nil)
+				fmt.Fprintf(ch.Stderr(), "%v\n", err)
+				sendExitStatus(ch, err)
+				return
+			}
+			req.Reply(true, nil)
+			go ssh.DiscardRequests(requests)
+			if err := serveSCP(root, ch, target, remote); err != nil {
+				logger.Warn("scp upload failed", "id", c.ID, "error", err)
+				fmt.Fprintf(ch.Stderr(), "scp: %v\n", err)
+				sendExitStatus(ch, err)
+				return
+			}
+			sendExitStatus(ch, nil)
+			return
+		}
+		if req.WantReply {
+			req.Reply(false, nil)
+		}
+	}
+}
+
+func sendExitStatus(ch ssh.Channel, err error) {
+	status := struct{ Code uint32 }{0}
+	if err != nil {
+		status.Code = 1
+	}
+	ch.SendRequest("exit-status", false, ssh.Marshal(&status))
+}
+
+type scpTarget struct {
+	path      string
+	recursive bool
+	wantDir   bool
+}
+
+// parseSCPCommand accepts the "scp -t" command line scp sends to upload
+func parseSCPCommand(cmd string) (scpTarget, error) {
+	fields := strings.Fields(cmd)
+	if len(fields) == 0 || fields[0] != "scp" {
+		return scpTarget{}, errors.New("only sftp and scp uploads are offered")
+	}
+	var t scpTarget
+	sink := false
+	args := fields[1:]
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		arg := args[0]
+		args = args[1:]
+		if arg == "--" {
+			break
+		}
+		for _, flag := range arg[1:] {
+			switch flag {
+			case 't':
+				sink = true
+			case 'f':
+				return scpTarget{}, errors.New("downloads are not offered over scp; use sftp")
+			case 'r':
+				t.recursive = true
+			case 'd':
+				t.wantDir = true
+			case 'p', 'v', 'q':
+			default:
+				return scpTarget{}, fmt.Errorf("unsupported scp option -%c", flag)
+			}
+		}
+	}
+	if !sink {
+		return scpTarget{}, errors.New("only scp uploads are offered")
+	}
+	t.path = strings.Join(args, " ")
+	if t.path == "" {
+		t.path = "."
+	}
+	return t, nil
+}
+
+// serveSCP receives files the way "scp -t" does: the client announces each
+// file, directory and timestamp on a line, and every step is answered with
+// a zero byte, or 1 and a message for a file that is refused
+func serveSCP(root sftpRoot, ch ssh.Channel, target scpTarget, remote string) error {
+	_, base, err := root.resolve(target.path)
+	if err != nil {
+		return err
+	}
+	baseIsDir := false
+	if info, err := os.Stat(base); err == nil && info.IsDir() {
+		baseIsDir = true
+	} else if target.wantDir {
+		return fmt.Errorf("%s is not a directory", target.path)
+	}
+
+	r := bufio.NewReaderSize(ch, 32<<10)
+	ack := func() error {
+		_, err := ch.Write([]byte{0})
+		return err
+	}
+	refuse := func(err error) error {
+		_, werr := fmt.Fprintf(ch, "\x01scp: %v\n", err)
+		return werr
+	}
+	if err := ack(); err != nil {
+		return err
+	}
+
+	dirs := []string{}
+	var times *[2]time.Time
+	for {
+		line, err := readSCPLine(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		cur := base
+		if len(dirs) > 0 {
+			cur = dirs[len(dirs)-1]
+		}
+		switch line[0] {
+		case 'T':
+			var mtime, matime, atime, aatime int64
+			if _, err := fmt.Sscanf(line, "T%d %d %d %d", &mtime, &matime, &atime, &aatime); err != nil {
+				return errors.New("malformed scp time line")
+			}
+			times = &[2]time.Time{time.Unix(atime, 0), time.Unix(mtime, 0)}
+			if err := ack(); err != nil {
+				return err
+			}
+		case 'C', 'D':
+			mode, size, name, err := parseSCPEntry(line)
+			if err != nil {
+				return err
+			}
+			local := cur
+			// A file or directory copied to a path that is not a directory
+			// takes that path as its name
+			if len(dirs) > 0 || baseIsDir {
+				if _, err := incomingName(name); err != nil || strings.ContainsAny(name, `/\`) {
+					if err := refuse(fmt.Errorf("refused name %q", name)); err != nil {
+						return err
+					}
+					continue
+				}
+				local = filepath.Join(cur, name)
+			}
+			if root.confine(local) != nil {
+				if err := refuse(fmt.Errorf("refused name %q", name)); err != nil {
+					return err
+				}
+				continue
+			}
+
+			if line[0] == 'D' {
+				if !target.recursive {
+					return errors.New("directories need scp -r")
+				}
+				if err := os.Mkdir(local, mode|0o700); err != nil && !errors.Is(err, os.ErrExist) {
+					if err := refuse(err); err != nil {
+						return err
+					}
+					continue
+				}
+				dirs = append(dirs, local)
+				times = nil
+				if err := ack(); err != nil {
+					return err
+				}
+				continue
+			}
+
+			if err := checkHeader(TransferHeader{Name: filepath.Base(local), Size: size}); err != nil {
+				reportRefusedHeader(err, remote)
+				if err := refuse(err); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := checkStorage(root.dir, size, remote); err != nil {
+				if err := refuse(err); err != nil {
+					return err
+				}
+				continue
+			}
+			flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+			if !root.allowDelete {
+				flags = os.O_WRONLY | os.O_CREATE | os.O_EXCL
+			}
+			f, err := os.OpenFile(local, flags, mode)
+			if err != nil {
+				if errors.Is(err, fs.ErrExist) {
+					err = fmt.Errorf("%s: %w", name, errSFTPOverwrite)
+				}
+				if err := refuse(unwrapPathError(err)); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := ack(); err != nil {
+				f.Close()
+				return err
+			}
+			rel, _ := filepath.Rel(root.dir, local)
+			t := newTransfer("receive", filepath.ToSlash(rel), local, remote, size)
+			emitEvent("transfer_started", t.Info())
+			done := make(chan struct{})
+			go t.reportProgress(done)
+			_, err = io.CopyN(progressWriter{w: f, t: t}, r, size)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err == nil {
+				// The client follows every file with a status byte
+				var status byte
+				if status, err = r.ReadByte(); err == nil && status != 0 {
+					err = errors.New("client reported an error sending the file")
+				}
+			}
+			if err == nil {
+				err = finalizeReceived(t, local, local)
+			}
+			if err == nil && times != nil {
+				os.Chtimes(local, times[0], times[1])
+			}
+			times = nil
+			close(done)
+			t.finish(err)
+			var pe *PolicyError
+			if errors.As(err, &pe) {
+				if err := refuse(err); err != nil {
+					return err
+				}
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if err := ack(); err != nil {
+				return err
+			}
+		case 'E':
+			if len(dirs) == 0 {
+				return errors.New("unbalanced scp directory end")
+			}
+			dirs = dirs[:len(dirs)-1]
+			if err := ack(); err != nil {
+				return err
+			}
+		case '\x01', '\x02':
+			logger.Warn("scp client reported an error", "message", strings.TrimSpace(line[1:]))
+			if line[0] == '\x02' {
+				return errors.New(strings.TrimSpace(line[1:]))
+			}
+		default:
+			return fmt.Errorf("unexpected scp line %q", line)
+		}
+	}
+}
+
+func readSCPLine(r *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			if err == io.EOF && len(line) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return "", err
+		}
+		if b == '\n' {
+			if len(line) == 0 {
+				return "", errors.New("empty scp line")
+			}
+			return string(line), nil
+		}
+		if len(line) >= maxSCPLine {
+			return "", errors.New("scp line too long")
+		}
+		line = append(line, b)
+	}
+}
+
+// parseSCPEntry reads "C0644 1234 name" or "D0755 0 name"
+func parseSCPEntry(line string) (os.FileMode, int64, string, error) {
+	parts := strings.SplitN(line[1:], " ", 3)
+	if len(parts) != 3 {
+		return 0, 0, "", errors.New("malformed scp entry")
+	}
+	mode, err := strconv.ParseUint(parts[0], 8, 32)
+	if err != nil {
+		return 0, 0, "", errors.New("malformed scp mode")
+	}
+	size, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || size < 0 {
+		return 0, 0, "", errors.New("malformed scp size")
+	}
+	return os.FileMode(mode) & 0o777, size, parts[2], nil
+}
+
+// unwrapPathError keeps the local path out of what the client is told
+func unwrapPathError(err error) error {
+	var pe *os.PathError
+	if errors.As(err, &pe) {
+		return pe.Err
+	}
+	return err
+}
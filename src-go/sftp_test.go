@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestSFTPRootConfinesPaths(t *testing.T) {
+	dir := t.TempDir()
+	outside := t.TempDir()
+	root := sftpRoot{dir: dir}
+
+	for in, want := range map[string]string{
+		"":                 "/",
+		".":                "/",
+		"/":                "/",
+		"a.txt":            "/a.txt",
+		"/sub/../a.txt":    "/a.txt",
+		"../../etc/passwd": "/etc/passwd",
+		"/../../x":         "/x",
+	} {
+		v, local, err := root.resolve(in)
+		if err != nil {
+			t.Errorf("resolve(%q): %v", in, err)
+			continue
+		}
+		if v != want {
+			t.Errorf("resolve(%q) = %q, want %q", in, v, want)
+		}
+		if rel, err := filepath.Rel(dir, local); err != nil || (rel != "." && !filepath.IsLocal(rel)) {
+			t.Errorf("resolve(%q) left the root: %s", in, local)
+		}
+	}
+
+	if runtime.GOOS == "windows" {
+		return // symlinks need privileges there
+	}
+	if err := os.Symlink(outside, filepath.Join(dir, "out")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "missing"), filepath.Join(dir, "dangling")); err != nil {
+		t.Fatal(err)
+	}
+	for _, in := range []string{"out", "out/file", "dangling"} {
+		if _, _, err := root.resolve(in); err != errSFTPDenied {
+			t.Errorf("resolve(%q) = %v, want permission denied", in, err)
+		}
+	}
+}
+
+func TestParseSCPCommand(t *testing.T) {
+	target, err := parseSCPCommand("scp -r -t -- dir/with space")
+	if err != nil || !target.recursive || target.path != "dir/with space" {
+		t.Errorf("got %+v, %v", target, err)
+	}
+	for _, cmd := range []string{"scp -f a.txt", "ls", "scp -x -t .", "scp a.txt"} {
+		if _, err := parseSCPCommand(cmd); err == nil {
+			t.Errorf("%q was accepted", cmd)
+		}
+	}
+}
+
+func TestSFTPKeepsFilesWithoutAllowDelete(t *testing.T) {
+	savedOutput := output
+	output = NewOutput(io.Discard)
+	t.Cleanup(func() { output = savedOutput })
+
+	dir := t.TempDir()
+	keep := filepath.Join(dir, "keep.txt")
+	if err := os.WriteFile(keep, []byte("original"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	s := newSFTPSession(sftpRoot{dir: dir}, &out, "127.0.0.1:1")
+	defer s.closeAll()
+	// reply is the kind and, for a status, the code of the last answer
+	reply := func() (byte, uint32) {
+		b := out.Bytes()
+		defer out.Reset()
+		if len(b) < 13 {
+			t.Fatalf("short reply %x", b)
+		}
+		return b[4], binary.BigEndian.Uint32(b[9:])
+	}
+
+	for _, flags := range []uint32{sftpFlagWrite | sftpFlagCreat | sftpFlagTrunc, sftpFlagWrite, sftpFlagWrite | sftpFlagCreat} {
+		s.open(1, "keep.txt", flags, sftpAttr{})
+		if kind, code := reply(); kind != sftpStatus || code != sftpPermissionDenied {
+			t.Errorf("open with flags %#x: reply %d, code %d", flags, kind, code)
+		}
+	}
+	req := binary.BigEndian.AppendUint32(nil, 2)
+	req = appendSFTPString(req, "keep.txt")
+	req = binary.BigEndian.AppendUint32(req, sftpAttrSize)
+	req = binary.BigEndian.AppendUint64(req, 0)
+	s.handle(sftpSetstat, &sftpReader{b: req})
+	if _, code := reply(); code != sftpPermissionDenied {
+		t.Errorf("setstat size: code %d", code)
+	}
+	if data, _ := os.ReadFile(keep); string(data) != "original" {
+		t.Errorf("file now holds %q", data)
+	}
+
+	s.open(3, "new.txt", sftpFlagWrite|sftpFlagCreat|sftpFlagTrunc, sftpAttr{})
+	if kind, _ := reply(); kind != sftpHandle {
+		t.Errorf("new file: reply %d", kind)
+	}
+}
+
+func TestSFTPRenameChecksPolicy(t *testing.T) {
+	savedOutput := output
+	output = NewOutput(io.Discard)
+	t.Cleanup(func() { output = savedOutput })
+	config.mu.Lock()
+	saved := config.cfg
+	config.cfg.ReceivePolicy.DenyExtensions = []string{"exe"}
+	config.mu.Unlock()
+	t.Cleanup(func() {
+		config.mu.Lock()
+		config.cfg = saved
+		config.mu.Unlock()
+	})
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "setup.txt"), []byte("MZ"), 0o644)
+	var out bytes.Buffer
+	s := newSFTPSession(sftpRoot{dir: dir}, &out, "127.0.0.1:1")
+	req := binary.BigEndian.AppendUint32(nil, 1)
+	req = appendSFTPString(req, "setup.txt")
+	req = appendSFTPString(req, "setup.exe")
+	s.handle(sftpRename, &sftpReader{b: req})
+	if b := out.Bytes(); len(b) < 13 || binary.BigEndian.Uint32(b[9:]) != sftpPermissionDenied {
+		t.Errorf("rename to a denied extension answered %x", b)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "setup.exe")); err == nil {
+		t.Error("file renamed to setup.exe")
+	}
+}
@@ -0,0 +1,730 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// The SFTP subsystem of "sftp" listeners speaks version 3 of the protocol
+// (draft-ietf-secsh-filexfer-02), which every common client falls back to.
+// Client paths are rooted at the listener's download directory: "/" is
+// that directory and nothing outside it can be named, followed through a
+// symlink or created. Every file opened for writing is a "receive" transfer
+// with the usual events, finished when the client closes it.
+const (
+	sftpVersion = 3
+
+	sftpInit     = 1
+	sftpVersionP = 2
+	sftpOpen     = 3
+	sftpClose    = 4
+	sftpRead     = 5
+	sftpWrite    = 6
+	sftpLstat    = 7
+	sftpFstat    = 8
+	sftpSetstat  = 9
+	sftpFsetstat = 10
+	sftpOpendir  = 11
+	sftpReaddir  = 12
+	sftpRemove   = 13
+	sftpMkdir    = 14
+	sftpRmdir    = 15
+	sftpRealpath = 16
+	sftpStat     = 17
+	sftpRename   = 18
+
+	sftpStatus = 101
+	sftpHandle = 102
+	sftpData   = 103
+	sftpName   = 104
+	sftpAttrs  = 105
+
+	maxSFTPPacket  = 256<<10 + 1024 // a 256 KiB write and its header
+	maxSFTPRead    = 256 << 10
+	sftpDirBatch   = 100
+	maxSFTPHandles = 256
+)
+
+// Status codes
+const (
+	sftpOK               = 0
+	sftpEOF              = 1
+	sftpNoSuchFile       = 2
+	sftpPermissionDenied = 3
+	sftpFailure          = 4
+	sftpBadMessage       = 5
+	sftpOpUnsupported    = 8
+)
+
+// Open flags and attribute flags
+const (
+	sftpFlagRead   = 0x01
+	sftpFlagWrite  = 0x02
+	sftpFlagAppend = 0x04
+	sftpFlagCreat  = 0x08
+	sftpFlagTrunc  = 0x10
+	sftpFlagExcl   = 0x20
+
+	sftpAttrSize     = 0x01
+	sftpAttrUIDGID   = 0x02
+	sftpAttrPerms    = 0x04
+	sftpAttrTimes    = 0x08
+	sftpAttrExtended = 0x80000000
+)
+
+// Unix file type bits in the permissions attribute
+const (
+	sftpTypeDir     = 0o040000
+	sftpTypeRegular = 0o100000
+	sftpTypeSymlink = 0o120000
+)
+
+var errSFTPDenied = errors.New("permission denied")
+
+// sftpRoot confines client paths to a directory
+type sftpRoot struct {
+	dir         string
+	allowDelete bool
+}
+
+// resolve turns a client path into its clean absolute form and the local
+// path it names. Relative paths start at the root, ".." stops there.
+func (r sftpRoot) resolve(p string) (string, string, error) {
+	v := path.Clean("/" + p)
+	if v == "/" {
+		return v, r.dir, nil
+	}
+	rel := filepath.FromSlash(v[1:])
+	if !filepath.IsLocal(rel) {
+		return "", "", errSFTPDenied
+	}
+	local := filepath.Join(r.dir, rel)
+	if err := r.confine(local); err != nil {
+		return "", "", err
+	}
+	return v, local, nil
+}
+
+// confine refuses a local path that leads outside the root, including
+// through a dangling link a create would follow wherever it points
+func (r sftpRoot) confine(local string) error {
+	if checkWithin(r.dir, local) != nil {
+		return errSFTPDenied
+	}
+	if info, err := os.Lstat(local); err == nil && info.Mode()&fs.ModeSymlink != 0 {
+		if _, err := filepath.EvalSymlinks(local); err != nil {
+			return errSFTPDenied
+		}
+	}
+	return nil
+}
+
+type sftpAttr struct {
+	flags uint32
+	size  uint64
+	perm  uint32
+	atime uint32
+	mtime uint32
+}
+
+// sftpOpenFile is a handle to an open file or directory
+type sftpOpenFile struct {
+	f       *os.File
+	dir     bool
+	name    string // client path
+	t       *Transfer
+	done    chan struct{} // stops progress reports of t
+	written int64
+	allow   storageAllowance // what writes may still put on disk
+	refused error            // a write the receive policy turned down
+}
+
+// sftpSession serves one SFTP subsystem channel
+type sftpSession struct {
+	root    sftpRoot
+	rw      io.ReadWriter
+	remote  string
+	handles map[string]*sftpOpenFile
+	next    uint64
+	out     []byte
+}
+
+func newSFTPSession(root sftpRoot, rw io.ReadWriter, remote string) *sftpSession {
+	return &sftpSession{root: root, rw: rw, remote: remote, handles: make(map[string]*sftpOpenFile)}
+}
+
+// serve answers requests until the client goes away, then closes whatever
+// it left open
+func (s *sftpSession) serve() error {
+	defer s.closeAll()
+	var header [4]byte
+	buf := make([]byte, 0, 64<<10)
+	for {
+		if _, err := io.ReadFull(s.rw, header[:]); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		n := binary.BigEndian.Uint32(header[:])
+		if n == 0 || n > maxSFTPPacket {
+			return fmt.Errorf("invalid sftp packet of %d bytes", n)
+		}
+		if cap(buf) < int(n) {
+			buf = make([]byte, n)
+		}
+		packet := buf[:n]
+		if _, err := io.ReadFull(s.rw, packet); err != nil {
+			return err
+		}
+		if err := s.handle(packet[0], &sftpReader{b: packet[1:]}); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *sftpSession) handle(kind byte, r *sftpReader) error {
+	if kind == sftpInit {
+		r.u32() // client version; we answer 3 whatever it is
+		return s.send(sftpVersionP, func(b []byte) []byte { return binary.BigEndian.AppendUint32(b, sftpVersion) })
+	}
+	id := r.u32()
+	if r.bad {
+		return errors.New("truncated sftp packet")
+	}
+
+	switch kind {
+	case sftpRealpath:
+		v, _, err := s.root.resolve(r.str())
+		if err != nil {
+			return s.status(id, err)
+		}
+		return s.send(sftpName, func(b []byte) []byte {
+			b = binary.BigEndian.AppendUint32(b, id)
+			b = binary.BigEndian.AppendUint32(b, 1)
+			b = appendSFTPString(b, v)
+			b = appendSFTPString(b, v)
+			return binary.BigEndian.AppendUint32(b, 0)
+		})
+	case sftpStat, sftpLstat:
+		_, local, err := s.root.resolve(r.str())
+		if err != nil {
+			return s.status(id, err)
+		}
+		stat := os.Stat
+		if kind == sftpLstat {
+			stat = os.Lstat
+		}
+		info, err := stat(local)
+		if err != nil {
+			return s.status(id, err)
+		}
+		return s.attrs(id, info)
+	case sftpFstat:
+		h, err := s.lookup(r.str())
+		if err != nil {
+			return s.status(id, err)
+		}
+		info, err := h.f.Stat()
+		if err != nil {
+			return s.status(id, err)
+		}
+		return s.attrs(id, info)
+	case sftpOpen:
+		name, flags, attr := r.str(), r.u32(), r.attr()
+		if r.bad {
+			return s.status(id, errSFTPBadMessage)
+		}
+		return s.open(id, name, flags, attr)
+	case sftpOpendir:
+		_, local, err := s.root.resolve(r.str())
+		if err != nil {
+			return s.status(id, err)
+		}
+		f, err := os.Open(local)
+		if err != nil {
+			return s.status(id, err)
+		}
+		if info, err := f.Stat(); err != nil || !info.IsDir() {
+			f.Close()
+			return s.status(id, errSFTPNotDir)
+		}
+		return s.addHandle(id, &sftpOpenFile{f: f, dir: true})
+	case sftpReaddir:
+		h, err := s.lookup(r.str())
+		if err != nil {
+			return s.status(id, err)
+		}
+		if !h.dir {
+			return s.status(id, errSFTPNotDir)
+		}
+		entries, err := h.f.ReadDir(sftpDirBatch)
+		if len(entries) == 0 {
+			if err == nil {
+				err = io.EOF
+			}
+			return s.status(id, err)
+		}
+		return s.names(id, entries)
+	case sftpRead:
+		handle, offset, length := r.str(), r.u64(), r.u32()
+		h, err := s.lookup(handle)
+		if err != nil {
+			return s.status(id, err)
+		}
+		data := make([]byte, min(length, maxSFTPRead))
+		n, err := h.f.ReadAt(data, int64(offset))
+		if n == 0 {
+			if err == nil {
+				err = io.EOF
+			}
+			return s.status(id, err)
+		}
+		return s.send(sftpData, func(b []byte) []byte {
+			b = binary.BigEndian.AppendUint32(b, id)
+			return appendSFTPString(b, string(data[:n]))
+		})
+	case sftpWrite:
+		handle, offset, data := r.str(), r.u64(), r.str()
+		if r.bad {
+			return s.status(id, errSFTPBadMessage)
+		}
+		h, err := s.lookup(handle)
+		if err != nil {
+			return s.status(id, err)
+		}
+		if h.t == nil {
+			return s.status(id, errSFTPDenied)
+		}
+		end := max(h.written, int64(offset)+int64(len(data)))
+		if err := h.allow.check(end); err != nil {
+			return s.statusCode(id, sftpFailure, err.Error())
+		}
+		if err := config.Get().ReceivePolicy.checkSize(path.Base(h.name), end); err != nil {
+			// The file is kept short of the limit and its transfer fails on close
+			if h.refused == nil {
+				reportRefusedHeader(err, s.remote)
+			}
+			h.refused = err
+			return s.statusCode(id, sftpPermissionDenied, err.Error())
+		}
+		n, err := h.f.WriteAt([]byte(data), int64(offset))
+		h.t.Add(n)
+		h.written = max(h.written, int64(offset)+int64(n))
+		return s.status(id, err)
+	case sftpClose:
+		handle := r.str()
+		h, err := s.lookup(handle)
+		if err != nil {
+			return s.status(id, err)
+		}
+		delete(s.handles, handle)
+		return s.status(id, h.close(nil))
+	case sftpSetstat:
+		_, local, err := s.root.resolve(r.str())
+		if err != nil {
+			return s.status(id, err)
+		}
+		a := r.attr()
+		if a.flags&sftpAttrSize != 0 && !s.root.allowDelete {
+			return s.statusCode(id, sftpPermissionDenied, errSFTPOverwrite.Error())
+		}
+		return s.status(id, setSFTPAttr(local, nil, a))
+	case sftpFsetstat:
+		h, err := s.lookup(r.str())
+		if err != nil {
+			return s.status(id, err)
+		}
+		// Without allow_delete only files this session created are
+		// written, so sizing those loses nothing
+		a := r.attr()
+		if a.flags&sftpAttrSize != 0 && !s.root.allowDelete && h.t == nil {
+			return s.statusCode(id, sftpPermissionDenied, errSFTPOverwrite.Error())
+		}
+		return s.status(id, setSFTPAttr(h.f.Name(), h.f, a))
+	case sftpMkdir:
+		_, local, err := s.root.resolve(r.str())
+		if err != nil {
+			return s.status(id, err)
+		}
+		perm := os.FileMode(0o755)
+		if a := r.attr(); a.flags&sftpAttrPerms != 0 {
+			perm = os.FileMode(a.perm & 0o777)
+		}
+		return s.status(id, os.Mkdir(local, perm))
+	case sftpRemove, sftpRmdir:
+		v, local, err := s.root.resolve(r.str())
+		if err == nil && (!s.root.allowDelete || v == "/") {
+			err = errSFTPDenied
+		}
+		if err == nil {
+			var info os.FileInfo
+			if info, err = os.Lstat(local); err == nil {
+				if info.IsDir() != (kind == sftpRmdir) {
+					err = errSFTPWrongKind
+				} else {
+					err = os.Remove(local)
+				}
+			}
+		}
+		return s.status(id, err)
+	case sftpRename:
+		from, to := r.str(), r.str()
+		vFrom, localFrom, err := s.root.resolve(from)
+		if err != nil {
+			return s.status(id, err)
+		}
+		vTo, localTo, err := s.root.resolve(to)
+		if err != nil {
+			return s.status(id, err)
+		}
+		if vFrom == "/" || vTo == "/" {
+			return s.status(id, errSFTPDenied)
+		}
+		// A file's new name faces the receive policy a new file's does
+		if info, err := os.Lstat(localFrom); err == nil && !info.IsDir() {
+			if err := config.Get().ReceivePolicy.checkName(path.Base(vTo)); err != nil {
+				reportRefusedHeader(err, s.remote)
+				return s.statusCode(id, sftpPermissionDenied, err.Error())
+			}
+		}
+		// Version 3 renames never replace what is there
+		if _, err := os.Lstat(localTo); err == nil {
+			return s.status(id, fs.ErrExist)
+		}
+		return s.status(id, os.Rename(localFrom, localTo))
+	}
+	return s.statusCode(id, sftpOpUnsupported, "operation not supported")
+}
+
+var (
+	errSFTPBadMessage = errors.New("malformed request")
+	errSFTPNotDir     = errors.New("not a directory")
+	errSFTPWrongKind  = errors.New("use remove for files and rmdir for directories")
+	errSFTPBadHandle  = errors.New("invalid handle")
+	// errSFTPOverwrite refuses truncating or writing over a file, which
+	// loses what it held as surely as removing it
+	errSFTPOverwrite = errors.New("replacing an existing file needs allow_delete")
+)
+
+func (s *sftpSession) open(id uint32, name string, flags uint32, attr sftpAttr) error {
+	v, local, err := s.root.resolve(name)
+	if err != nil {
+		return s.status(id, err)
+	}
+	if flags&(sftpFlagRead|sftpFlagWrite) == 0 {
+		return s.status(id, errSFTPBadMessage)
+	}
+	write := flags&sftpFlagWrite != 0
+	mode := os.O_RDONLY
+	if write {
+		mode = os.O_WRONLY
+		if flags&sftpFlagRead != 0 {
+			mode = os.O_RDWR
+		}
+		// WriteAt refuses O_APPEND files; clients send the offset anyway
+		if flags&sftpFlagCreat != 0 {
+			mode |= os.O_CREATE
+		}
+		if flags&sftpFlagTrunc != 0 {
+			mode |= os.O_TRUNC
+		}
+		if flags&sftpFlagExcl != 0 {
+			mode |= os.O_EXCL
+		}
+		if !s.root.allowDelete {
+			// Only new files: without create the file must already exist
+			if flags&sftpFlagCreat == 0 {
+				return s.statusCode(id, sftpPermissionDenied, errSFTPOverwrite.Error())
+			}
+			mode = mode&^os.O_TRUNC | os.O_EXCL
+		}
+		if err := config.Get().ReceivePolicy.checkName(path.Base(v)); err != nil {
+			reportRefusedHeader(err, s.remote)
+			return s.statusCode(id, sftpPermissionDenied, err.Error())
+		}
+		if err := checkStorage(s.root.dir, 0, s.remote); err != nil {
+			return s.statusCode(id, sftpFailure, err.Error())
+		}
+	}
+	perm := os.FileMode(0o644)
+	if attr.flags&sftpAttrPerms != 0 {
+		perm = os.FileMode(attr.perm & 0o777)
+	}
+	f, err := os.OpenFile(local, mode, perm)
+	if err != nil {
+		if write && !s.root.allowDelete && flags&sftpFlagExcl == 0 && errors.Is(err, fs.ErrExist) {
+			return s.statusCode(id, sftpPermissionDenied, errSFTPOverwrite.Error())
+		}
+		return s.status(id, err)
+	}
+	if info, err := f.Stat(); err != nil || !info.Mode().IsRegular() {
+		f.Close()
+		return s.status(id, errSFTPDenied)
+	}
+
+	h := &sftpOpenFile{f: f, name: v}
+	if write {
+		size := int64(-1)
+		if attr.flags&sftpAttrSize != 0 {
+			size = int64(attr.size)
+		}
+		h.t = newTransfer("receive", v[1:], local, s.remote, size)
+		h.allow = allowStorage(s.root.dir, s.remote)
+		h.done = make(chan struct{})
+		emitEvent("transfer_started", h.t.Info())
+		go h.t.reportProgress(h.done)
+	}
+	return s.addHandle(id, h)
+}
+
+func (s *sftpSession) addHandle(id uint32, h *sftpOpenFile) error {
+	if len(s.handles) >= maxSFTPHandles {
+		h.close(errors.New("too many open handles"))
+		return s.statusCode(id, sftpFailure, "too many open handles")
+	}
+	s.next++
+	handle := strconv.FormatUint(s.next, 10)
+	s.handles[handle] = h
+	return s.send(sftpHandle, func(b []byte) []byte {
+		b = binary.BigEndian.AppendUint32(b, id)
+		return appendSFTPString(b, handle)
+	})
+}
+
+func (s *sftpSession) lookup(handle string) (*sftpOpenFile, error) {
+	if h, ok := s.handles[handle]; ok {
+		return h, nil
+	}
+	return nil, errSFTPBadHandle
+}
+
+func (s *sftpSession) closeAll() {
+	for handle, h := range s.handles {
+		h.close(errors.New("session ended before the file was closed"))
+		delete(s.handles, handle)
+	}
+}
+
+// close closes the file and finishes its transfer, failed when cause is set
+func (h *sftpOpenFile) close(cause error) error {
+	err := h.f.Close()
+	if h.t == nil {
+		return err
+	}
+	close(h.done)
+	h.t.mu.Lock()
+	h.t.Size = h.written
+	h.t.mu.Unlock()
+	if cause == nil {
+		cause = err
+	}
+	if cause == nil && h.refused != nil {
+		cause, err = h.refused, h.refused
+	}
+	if cause == nil {
+		// Written in place, so a rejected file is moved away from its name
+		cause = finalizeReceived(h.t, h.t.Path, h.t.Path)
+		err = cause
+	}
+	h.t.finish(cause)
+	return err
+}
+
+func setSFTPAttr(local string, f *os.File, a sftpAttr) error {
+	if a.flags&sftpAttrSize != 0 {
+		var err error
+		if f != nil {
+			err = f.Truncate(int64(a.size))
+		} else {
+			err = os.Truncate(local, int64(a.size))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if a.flags&sftpAttrPerms != 0 {
+		if err := os.Chmod(local, os.FileMode(a.perm&0o777)); err != nil {
+			return err
+		}
+	}
+	if a.flags&sftpAttrTimes != 0 {
+		if err := os.Chtimes(local, time.Unix(int64(a.atime), 0), time.Unix(int64(a.mtime), 0)); err != nil {
+			return err
+		}
+	}
+	return nil // owners are left alone
+}
+
+func (s *sftpSession) send(kind byte, body func([]byte) []byte) error {
+	b := append(s.out[:0], 0, 0, 0, 0, kind)
+	b = body(b)
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+	s.out = b
+	_, err := s.rw.Write(b)
+	return err
+}
+
+// status answers with the status err maps to
+func (s *sftpSession) status(id uint32, err error) error {
+	switch {
+	case err == nil:
+		return s.statusCode(id, sftpOK, "")
+	case errors.Is(err, io.EOF):
+		return s.statusCode(id, sftpEOF, "end of file")
+	case errors.Is(err, fs.ErrNotExist):
+		return s.statusCode(id, sftpNoSuchFile, "no such file")
+	case errors.Is(err, errSFTPDenied), errors.Is(err, fs.ErrPermission):
+		return s.statusCode(id, sftpPermissionDenied, "permission denied")
+	case errors.Is(err, errSFTPBadMessage):
+		return s.statusCode(id, sftpBadMessage, err.Error())
+	}
+	return s.statusCode(id, sftpFailure, unwrapPathError(err).Error())
+}
+
+func (s *sftpSession) statusCode(id, code uint32, msg string) error {
+	return s.send(sftpStatus, func(b []byte) []byte {
+		b = binary.BigEndian.AppendUint32(b, id)
+		b = binary.BigEndian.AppendUint32(b, code)
+		b = appendSFTPString(b, msg)
+		return appendSFTPString(b, "en")
+	})
+}
+
+func (s *sftpSession) attrs(id uint32, info os.FileInfo) error {
+	return s.send(sftpAttrs, func(b []byte) []byte {
+		b = binary.BigEndian.AppendUint32(b, id)
+		return appendSFTPAttr(b, info)
+	})
+}
+
+func (s *sftpSession) names(id uint32, entries []os.DirEntry) error {
+	return s.send(sftpName, func(b []byte) []byte {
+		b = binary.BigEndian.AppendUint32(b, id)
+		count := len(b)
+		b = binary.BigEndian.AppendUint32(b, 0)
+		n := uint32(0)
+		for _, e := range entries {
+			info, err := e.Info()
+			if err != nil {
+				continue // removed while listing
+			}
+			b = appendSFTPString(b, e.Name())
+			b = appendSFTPString(b, sftpLongName(info))
+			b = appendSFTPAttr(b, info)
+			n++
+		}
+		binary.BigEndian.PutUint32(b[count:], n)
+		return b
+	})
+}
+
+// sftpLongName is the "ls -l" line clients print for a directory entry
+func sftpLongName(info os.FileInfo) string {
+	mod := info.ModTime()
+	stamp := mod.Format("Jan _2 15:04")
+	if time.Since(mod) > 180*24*time.Hour {
+		stamp = mod.Format("Jan _2  2006")
+	}
+	mode := info.Mode().String()
+	if info.Mode()&fs.ModeSymlink != 0 {
+		mode = "l" + mode[1:]
+	}
+	return fmt.Sprintf("%s 1 lumina lumina %8d %s %s", mode, info.Size(), stamp, info.Name())
+}
+
+func appendSFTPString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(len(s)))
+	return append(b, s...)
+}
+
+func appendSFTPAttr(b []byte, info os.FileInfo) []byte {
+	perm := uint32(info.Mode().Perm())
+	switch {
+	case info.IsDir():
+		perm |= sftpTypeDir
+	case info.Mode()&fs.ModeSymlink != 0:
+		perm |= sftpTypeSymlink
+	case info.Mode().IsRegular():
+		perm |= sftpTypeRegular
+	}
+	b = binary.BigEndian.AppendUint32(b, sftpAttrSize|sftpAttrUIDGID|sftpAttrPerms|sftpAttrTimes)
+	b = binary.BigEndian.AppendUint64(b, uint64(info.Size()))
+	b = binary.BigEndian.AppendUint32(b, 0)
+	b = binary.BigEndian.AppendUint32(b, 0)
+	b = binary.BigEndian.AppendUint32(b, perm)
+	mtime := uint32(info.ModTime().Unix())
+	b = binary.BigEndian.AppendUint32(b, mtime)
+	return binary.BigEndian.AppendUint32(b, mtime)
+}
+
+// sftpReader takes fields off a request, noting when one runs past the end
+type sftpReader struct {
+	b   []byte
+	bad bool
+}
+
+func (r *sftpReader) take(n int) []byte {
+	if r.bad || len(r.b) < n {
+		r.bad = true
+		return nil
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *sftpReader) u32() uint32 {
+	if v := r.take(4); v != nil {
+		return binary.BigEndian.Uint32(v)
+	}
+	return 0
+}
+
+func (r *sftpReader) u64() uint64 {
+	if v := r.take(8); v != nil {
+		return binary.BigEndian.Uint64(v)
+	}
+	return 0
+}
+
+func (r *sftpReader) str() string {
+	n := r.u32()
+	if n > uint32(len(r.b)) {
+		r.bad = true
+		return ""
+	}
+	return string(r.take(int(n)))
+}
+
+func (r *sftpReader) attr() sftpAttr {
+	a := sftpAttr{flags: r.u32()}
+	if a.flags&sftpAttrSize != 0 {
+		a.size = r.u64()
+	}
+	if a.flags&sftpAttrUIDGID != 0 {
+		r.u32()
+		r.u32()
+	}
+	if a.flags&sftpAttrPerms != 0 {
+		a.perm = r.u32()
+	}
+	if a.flags&sftpAttrTimes != 0 {
+		a.atime, a.mtime = r.u32(), r.u32()
+	}
+	if a.flags&sftpAttrExtended != 0 {
+		for n := r.u32(); n > 0 && !r.bad; n-- {
+			r.str()
+			r.str()
+		}
+	}
+	return a
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Share links let any browser fetch one file without Lumina. share_file
+// starts a small HTTP server of its own for the file, reachable only under
+// a random token, and returns its URL for the frontend to copy. A share
+// closes when it expires, when max_downloads downloads have started, or on
+// stop_share. A range request from an address whose counted download got
+// at least as far as the range starts continues that download and does not
+// count as a new one; any other request does.
+const maxShareDuration = 30 * 24 * time.Hour
+
+type ShareFilePayload struct {
+	Path         string `json:"path" required:"true"`
+	Name         string `json:"name"` // offered file name, defaults to the base name
+	Host         string `json:"host"` // interface to serve on, default all
+	Port         int    `json:"port"` // 0 picks a free port
+	TTLMs        int64  `json:"ttl_ms"`
+	MaxDownloads int    `json:"max_downloads"` // 0 for unlimited
+}
+
+type StopSharePayload struct {
+	ID string `json:"id" required:"true"`
+}
+
+// Share is one file served behind a token
+type Share struct {
+	ID           string
+	Path         string
+	Name         string
+	Size         int64
+	URLs         []string
+	Created      time.Time
+	Expires      time.Time // zero for never
+	MaxDownloads int
+
+	token     string
+	mu        sync.Mutex
+	downloads int
+	reached   map[string]int64 // by client IP, how far its downloads got
+	closed    bool
+	srv       *http.Server
+	timer     *time.Timer
+}
+
+// ShareInfo is the JSON view of a share
+type ShareInfo struct {
+	ID           string     `json:"id"`
+	Path         string     `json:"path"`
+	Name         string     `json:"name"`
+	Size         int64      `json:"size"`
+	URL          string     `json:"url"`
+	URLs         []string   `json:"urls"`
+	Created      time.Time  `json:"created"`
+	Expires      *time.Time `json:"expires,omitempty"`
+	MaxDownloads int        `json:"max_downloads"`
+	Downloads    int        `json:"downloads"`
+}
+
+var (
+	sharesMu sync.Mutex
+	shares   = make(map[string]*Share)
+	shareSeq atomic.Uint64
+)
+
+func (s *Share) Info() ShareInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	info := ShareInfo{
+		ID:           s.ID,
+		Path:         s.Path,
+		Name:         s.Name,
+		Size:         s.Size,
+		URL:          s.URLs[0],
+		URLs:         s.URLs,
+		Created:      s.Created,
+		MaxDownloads: s.MaxDownloads,
+		Downloads:    s.downloads,
+	}
+	if !s.Expires.IsZero() {
+		expires := s.Expires
+		info.Expires = &expires
+	}
+	return info
+}
+
+func handleShareFile(payload json.RawMessage, writer *Output) {
+	var p ShareFilePayload
+	if err := json.Unmarshal(payload, &p); err != nil || p.Path == "" {
+		sendErrorCode(writer, ErrInvalidArgument, message("share.file_requires_path"), nil)
+		return
+	}
+	if p.TTLMs < 0 || time.Duration(p.TTLMs)*time.Millisecond > maxShareDuration {
+		sendErrorCode(writer, ErrInvalidArgument, message("share.ttl_ms_must_between", "milliseconds", maxShareDuration.Milliseconds()), nil)
+		return
+	}
+	if p.MaxDownloads < 0 {
+		sendErrorCode(writer, ErrInvalidArgument, message("share.max_downloads_must_not"), nil)
+		return
+	}
+	path, err := filepath.Abs(p.Path)
+	if err != nil {
+		sendFailure(writer, err)
+		return
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		sendErrorCode(writer, ErrNotFound, message("share.file_not_found", "path", p.Path), map[string]interface{}{"path": p.Path})
+		return
+	}
+	if !info.Mode().IsRegular() {
+		sendErrorCode(writer, ErrInvalidArgument, message("share.file_must_given_regular"), nil)
+		return
+	}
+	name := p.Name
+	if name == "" {
+		name = filepath.Base(path)
+	}
+	if name, err = incomingName(name); err != nil {
+		sendErrorCode(writer, ErrInvalidArgument, message("share.invalid_name", "error", err), nil)
+		return
+	}
+
+	raw := make([]byte, 24)
+	if _, err := rand.Read(raw); err != nil {
+		sendError(writer, message("share.failed_create_token", "error", err))
+		return
+	}
+	addr := listenAddr(p.Host, p.Port)
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		sendBindError(writer, addr, err)
+		return
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	s := &Share{
+		ID:           fmt.Sprintf("share-%d", shareSeq.Add(1)),
+		Path:         path,
+		Name:         name,
+		Size:         info.Size(),
+		Created:      time.Now(),
+		MaxDownloads: p.MaxDownloads,
+		token:        base64.RawURLEncoding.EncodeToString(raw),
+	}
+	for _, host := range shareHosts(p.Host) {
+		u := url.URL{Scheme: "http", Host: net.JoinHostPort(host, strconv.Itoa(port)), Path: "/" + s.token + "/" + name}
+		s.URLs = append(s.URLs, u.String())
+	}
+	s.srv = &http.Server{Handler: s, ReadHeaderTimeout: 10 * time.Second}
+	if p.TTLMs > 0 {
+		ttl := time.Duration(p.TTLMs) * time.Millisecond
+		s.Expires = s.Created.Add(ttl)
+		s.timer = time.AfterFunc(ttl, func() { s.close("expired") })
+	}
+
+	sharesMu.Lock()
+	shares[s.ID] = s
+	sharesMu.Unlock()
+	goSafe("share "+s.ID, func() { s.srv.Serve(ln) })
+
+	logger.Info("share started", "id", s.ID, "path", path, "addr", ln.Addr().String())
+	writer.Encode(okResponse(message("share.sharing_name", "name", name), s.Info()))
+}
+
+// shareHosts lists the addresses a share URL can name: the host it was
+// bound to, or else every LAN IPv4 address, falling back to loopback
+func shareHosts(host string) []string {
+	host = normalizeHost(host)
+	if ip := net.ParseIP(host); host != "" && (ip == nil || !ip.IsUnspecified()) {
+		return []string{host}
+	}
+	var hosts []string
+	if _, own, err := localSubnets(""); err == nil {
+		for ip := range own {
+			hosts = append(hosts, ip)
+		}
+	}
+	sort.Strings(hosts)
+	if len(hosts) == 0 {
+		hosts = []string{"127.0.0.1"}
+	}
+	return hosts
+}
+
+// ServeHTTP answers only GET and HEAD for the token path; everything else
+// looks like nothing is there
+func (s *Share) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rest, _ := strings.CutPrefix(r.URL.Path, "/")
+	token, _, _ := strings.Cut(rest, "/")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 ||
+		(r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		http.NotFound(w, r)
+		return
+	}
+
+	// A download that starts over counts; one continuing with a range does not
+	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+	start := rangeStart(r.Header.Get("Range"))
+	s.mu.Lock()
+	reached, resumed := s.reached[ip]
+	counted := r.Method == http.MethodGet && !(resumed && start > 0 && start <= reached)
+	if s.closed || (counted && s.MaxDownloads > 0 && s.downloads >= s.MaxDownloads) {
+		s.mu.Unlock()
+		http.Error(w, "This link is no longer available", http.StatusGone)
+		return
+	}
+	if counted {
+		s.downloads++
+	}
+	downloads, last := s.downloads, counted && s.MaxDownloads > 0 && s.downloads == s.MaxDownloads
+	s.mu.Unlock()
+
+	f, err := os.Open(s.Path)
+	if err != nil {
+		http.Error(w, "This file is no longer available", http.StatusGone)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		http.Error(w, "This file is no longer available", http.StatusGone)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": s.Name}))
+	w.Header().Set("Cache-Control", "no-store")
+	if counted {
+		logger.Info("share downloaded", "id", s.ID, "remote", r.RemoteAddr, "downloads", downloads)
+		emitEvent("share_downloaded", map[string]interface{}{
+			"id":        s.ID,
+			"name":      s.Name,
+			"remote":    r.RemoteAddr,
+			"downloads": downloads,
+		})
+	}
+	if r.Method != http.MethodGet {
+		http.ServeContent(w, r, s.Name, info.ModTime(), f)
+		return
+	}
+	cw := &countingResponseWriter{ResponseWriter: w}
+	http.ServeContent(cw, r, s.Name, info.ModTime(), f)
+	s.mu.Lock()
+	if s.reached == nil {
+		s.reached = make(map[string]int64)
+	}
+	s.reached[ip] = max(s.reached[ip], start+cw.n)
+	s.mu.Unlock()
+	if last {
+		goSafe("share "+s.ID, func() { s.close("download limit reached") })
+	}
+}
+
+// rangeStart is the offset a Range header starts at, 0 for none or a
+// suffix range
+func rangeStart(header string) int64 {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok {
+		return 0
+	}
+	first, _, _ := strings.Cut(spec, ",")
+	start, _, _ := strings.Cut(strings.TrimSpace(first), "-")
+	n, err := strconv.ParseInt(start, 10, 64)
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+// countingResponseWriter counts the body bytes written through it
+type countingResponseWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (c *countingResponseWriter) Write(b []byte) (int, error) {
+	n, err := c.ResponseWriter.Write(b)
+	c.n += int64(n)
+	return n, err
+}
+
+// close stops the share, letting downloads in progress finish
+func (s *Share) close(reason string) bool {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return false
+	}
+	s.closed = true
+	downloads := s.downloads
+	s.mu.Unlock()
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+
+	sharesMu.Lock()
+	delete(shares, s.ID)
+	sharesMu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	go func() {
+		defer cancel()
+		s.srv.Shutdown(ctx)
+	}()
+	logger.Info("share closed", "id", s.ID, "reason", reason)
+	emitEvent("share_closed", map[string]interface{}{"id": s.ID, "name": s.Name, "reason": reason, "downloads": downloads})
+	return true
+}
+
+func handleStopShare(payload json.RawMessage, writer *Output) {
+	var p StopSharePayload
+	if err := json.Unmarshal(payload, &p); err != nil || p.ID == "" {
+		sendErrorCode(writer, ErrInvalidArgument, message("share.stop_share_requires_id"), nil)
+		return
+	}
+	sharesMu.Lock()
+	s, exists := shares[p.ID]
+	sharesMu.Unlock()
+	if !exists || !s.close("stopped") {
+		sendErrorCode(writer, ErrNotFound, message("share.not_found"), nil)
+		return
+	}
+	writer.Encode(okResponse(message("share.stopped"), nil))
+}
+
+func handleListShares(writer *Output) {
+	sharesMu.Lock()
+	list := make([]ShareInfo, 0, len(shares))
+	for _, s := range shares {
+		list = append(list, s.Info())
+	}
+	sharesMu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+	writer.Encode(ProtocolResponse{Status: "ok", Data: map[string]interface{}{"shares": list}})
+}
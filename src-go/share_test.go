@@ -0,0 +1,47 @@
+package main
+
+import (
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestShareCountsUnrelatedRanges(t *testing.T) {
+	savedOutput := output
+	output = NewOutput(io.Discard)
+	t.Cleanup(func() { output = savedOutput })
+
+	path := filepath.Join(t.TempDir(), "f.bin")
+	if err := os.WriteFile(path, make([]byte, 1000), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s := &Share{ID: "share-test", Path: path, Name: "f.bin", URLs: []string{"http://127.0.0.1/tok/f.bin"}, token: "tok"}
+	get := func(remote, rng string) {
+		r := httptest.NewRequest("GET", "/tok/f.bin", nil)
+		r.RemoteAddr = remote
+		if rng != "" {
+			r.Header.Set("Range", rng)
+		}
+		s.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	for _, step := range []struct {
+		remote, rng string
+		downloads   int
+	}{
+		{"10.0.0.1:1000", "bytes=0-399", 1},
+		{"10.0.0.1:1001", "bytes=400-", 1}, // continues its own download
+		{"10.0.0.2:1000", "bytes=400-", 2}, // never downloaded before
+		{"10.0.0.3:1000", "bytes=0-99", 3}, // reaches byte 100
+		{"10.0.0.3:1001", "bytes=500-", 4}, // skips past what it got
+		{"10.0.0.3:1002", "bytes=100-", 4}, // picks up where it stopped
+		{"10.0.0.1:1002", "bytes=-100", 5}, // a suffix range starts over
+	} {
+		get(step.remote, step.rng)
+		if n := s.Info().Downloads; n != step.downloads {
+			t.Fatalf("%s %s: %d downloads, want %d", step.remote, step.rng, n, step.downloads)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// defaultDrainTimeout is how long active connections get to finish on their own
+const defaultDrainTimeout = 5 * time.Second
+
+var shutdownOnce sync.Once
+
+type ShutdownPayload struct {
+	TimeoutMs int `json:"timeout_ms"`
+}
+
+func handleShutdown(payload json.RawMessage, writer *Output) {
+	var p ShutdownPayload
+	if len(payload) > 0 && string(payload) != "null" {
+		if err := json.Unmarshal(payload, &p); err != nil {
+			sendInvalidPayload(writer, "shutdown")
+			return
+		}
+	}
+
+	timeout := defaultDrainTimeout
+	if p.TimeoutMs > 0 {
+		timeout = time.Duration(p.TimeoutMs) * time.Millisecond
+	}
+
+	writer.Encode(okResponse(message("shutdown.shutting_down_drain_timeout", "timeout", timeout), nil))
+	shutdown(timeout)
+}
+
+// shutdown closes every listener, waits up to timeout for active connections
+// to finish, force-closes the rest, flushes stdout and exits with code 0.
+// It is safe to call from several goroutines; only the first call runs.
+func shutdown(timeout time.Duration) {
+	shutdownOnce.Do(func() {
+		state.Mutex.Lock()
+		state.stopping = true
+		for id, l := range state.Listeners {
+			l.ln.Close()
+			l.TLS.stop()
+			delete(state.Listeners, id)
+		}
+		state.Mutex.Unlock()
+
+		control.mu.Lock()
+		stopControlLocked()
+		control.mu.Unlock()
+
+		grpcState.mu.Lock()
+		stopGRPCLocked()
+		grpcState.mu.Unlock()
+
+		metricsServer.mu.Lock()
+		stopMetricsLocked()
+		metricsServer.mu.Unlock()
+		leaveAllMulticast()
+		cancelAllJobs()
+
+		discovery.Mutex.Lock()
+		if discovery.Running {
+			stopDiscoveryLocked()
+		}
+		discovery.Mutex.Unlock()
+
+		drained := make(chan struct{})
+		go func() {
+			state.active.Wait()
+			close(drained)
+		}()
+
+		select {
+		case <-drained:
+		case <-time.After(timeout):
+			state.Mutex.Lock()
+			forced := len(state.Conns)
+			for _, c := range state.Conns {
+				c.Abort()
+			}
+			state.Mutex.Unlock()
+			logger.Warn("drain timeout reached", "force_closed", forced)
+			<-drained
+		}
+
+		releasePortMappings()
+		usage.save()
+		removeDaemonInfo()
+		output.Close()
+		logger.Info("Lumina Net (Go) service stopped")
+		audit.Close()
+		logSink.SetFile(nil)
+		os.Exit(0)
+	})
+
+	// Concurrent callers wait for the first one to exit the process
+	select {}
+}
+
+func isStopping() bool {
+	state.Mutex.Lock()
+	defer state.Mutex.Unlock()
+	return state.stopping
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Sleep and wake: a laptop closed overnight used to come back to a pile of
+// connections that broke without a word. Before the system suspends, the
+// node pauses every transfer it can (telling the peer, so neither side
+// times out) and holds background activity as pause_background does. On
+// wake it resumes those transfers, pings every mux link and closes the
+// ones that no longer answer, and reports both as system_suspend and
+// system_resume events.
+//
+// Linux announces a suspend through logind, see sleep_linux.go. Elsewhere
+// the frontend, which hears about it from the OS, says so with
+// system_sleep and system_wake. Wakes are also caught everywhere by the
+// clock: the wall clock moves on while the machine sleeps, the monotonic
+// clock does not, and a tick that arrives long after it was due tells the
+// same story where the monotonic clock keeps running.
+const (
+	sleepReason        = "sleep" // the power reason held while asleep
+	sleepCheckInterval = 5 * time.Second
+	// sleepMinGap is how long the clock must have stalled to count as a
+	// suspend rather than a busy machine
+	sleepMinGap = 30 * time.Second
+	// wakeDedup merges the wake the frontend reports with the one the
+	// clock notices
+	wakeDedup = time.Minute
+)
+
+type sleepState struct {
+	mu       sync.Mutex
+	asleep   bool
+	since    time.Time
+	lastWake time.Time
+	slept    time.Duration      // length of the last sleep
+	held     map[*Transfer]bool // paused for the sleep, resumed on wake
+}
+
+var sleeper = sleepState{held: make(map[*Transfer]bool)}
+
+// SleepInfo is the JSON view of the sleep state
+type SleepInfo struct {
+	Asleep   bool       `json:"asleep"`
+	Since    *time.Time `json:"since,omitempty"`
+	LastWake *time.Time `json:"last_wake,omitempty"`
+	SleptMs  int64      `json:"slept_ms,omitempty"` // length of the last sleep
+}
+
+func (s *sleepState) Info() SleepInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	info := SleepInfo{Asleep: s.asleep, SleptMs: s.slept.Milliseconds()}
+	if s.asleep {
+		since := s.since
+		info.Since = &since
+	}
+	if !s.lastWake.IsZero() {
+		last := s.lastWake
+		info.LastWake = &last
+	}
+	return info
+}
+
+// suspend gets the node ready for a suspend announced by source and
+// returns the transfers it paused; nil when it already was
+func (s *sleepState) suspend(source string) []string {
+	s.mu.Lock()
+	if s.asleep {
+		s.mu.Unlock()
+		return nil
+	}
+	s.asleep, s.since = true, time.Now()
+	s.mu.Unlock()
+
+	if power.pause(sleepReason) {
+		applyPowerKeepalives()
+	}
+	held := []string{}
+	for _, t := range activeTransfers() {
+		// Leave what the user or the scheduler paused to them
+		if local, _ := t.pausedBy(); local || t.setPaused("local", true) != nil {
+			continue
+		}
+		s.mu.Lock()
+		s.held[t] = true
+		s.mu.Unlock()
+		held = append(held, t.ID)
+	}
+	sort.Strings(held)
+	logger.Info("system suspending", "source", source, "paused_transfers", len(held))
+	emitEvent("system_suspend", map[string]interface{}{"source": source, "paused_transfers": held})
+	return held
+}
+
+// wake undoes suspend and checks the mux links. slept is how long the
+// machine was down, 0 to take it from the suspend. It reports false for a
+// wake already handled.
+func (s *sleepState) wake(source string, slept time.Duration) bool {
+	s.mu.Lock()
+	if !s.asleep && time.Since(s.lastWake) < wakeDedup {
+		s.mu.Unlock()
+		return false
+	}
+	if s.asleep && slept == 0 {
+		slept = time.Since(s.since)
+	}
+	held := s.held
+	s.held = make(map[*Transfer]bool)
+	s.asleep, s.lastWake, s.slept = false, time.Now(), slept
+	s.mu.Unlock()
+
+	if power.resume(sleepReason) {
+		applyPowerKeepalives()
+	}
+	resumed := []string{}
+	for t := range held {
+		if t.setPaused("local", false) == nil {
+			resumed = append(resumed, t.ID)
+		}
+	}
+	sort.Strings(resumed)
+	alive, lost := checkMuxLinks()
+	logger.Info("system woke", "source", source, "slept", slept, "links_lost", len(lost))
+	emitEvent("system_resume", map[string]interface{}{
+		"source":            source,
+		"slept_ms":          slept.Milliseconds(),
+		"resumed_transfers": resumed,
+		"links_ok":          alive,
+		"links_lost":        lost,
+	})
+	return true
+}
+
+// activeTransfers lists the transfers still running
+func activeTransfers() []*Transfer {
+	transfersMu.Lock()
+	defer transfersMu.Unlock()
+	var active []*Transfer
+	for _, t := range transfers {
+		if t.Info().State == "active" {
+			active = append(active, t)
+		}
+	}
+	return active
+}
+
+// checkMuxLinks pings every mux link once and closes those that do not
+// answer within a heartbeat interval, rather than waiting for them to
+// miss several
+func checkMuxLinks() (alive, lost []string) {
+	muxMu.Lock()
+	links := make([]*Mux, 0, len(muxes))
+	for _, m := range muxes {
+		links = append(links, m)
+	}
+	muxMu.Unlock()
+
+	timeout := config.Get().Heartbeat.effective().interval()
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	alive, lost = []string{}, []string{}
+	for _, m := range links {
+		wg.Add(1)
+		go func() {
+			defer recoverPanic("wake check of " + m.ID)
+			defer wg.Done()
+			_, err := m.session.Ping(timeout)
+			if err != nil {
+				m.session.close(fmt.Errorf("%w: no answer after wake", errPeerUnreachable))
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				lost = append(lost, m.ID)
+			} else {
+				alive = append(alive, m.ID)
+			}
+		}()
+	}
+	wg.Wait()
+	sort.Strings(alive)
+	sort.Strings(lost)
+	return alive, lost
+}
+
+// watchClock catches wakes nobody announced
+func (s *sleepState) watchClock() {
+	last := time.Now()
+	for now := range time.Tick(sleepCheckInterval) {
+		if slept := sleptBetween(last, now, sleepCheckInterval); slept > 0 {
+			s.wake("clock", slept)
+		}
+		last = now
+	}
+}
+
+// sleptBetween is how long the machine slept between two ticks interval
+// apart, 0 if it did not
+func sleptBetween(last, now time.Time, interval time.Duration) time.Duration {
+	mono := now.Sub(last)
+	wall := now.Round(0).Sub(last.Round(0))
+	if gap := max(wall-mono, mono-interval); gap >= sleepMinGap {
+		return gap
+	}
+	return 0
+}
+
+type SystemSleepPayload struct {
+	Source string `json:"source"` // who noticed, default "frontend"
+}
+
+// handleSystemSleep is the frontend passing on the OS's suspend notice
+func handleSystemSleep(payload json.RawMessage, writer *Output) {
+	var p SystemSleepPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		sendInvalidPayload(writer, "system_sleep")
+		return
+	}
+	if p.Source == "" {
+		p.Source = "frontend"
+	}
+	held := sleeper.suspend(p.Source)
+	writer.Encode(okResponse(message("sleep.ready_for_sleep"),
+		map[string]interface{}{"sleep": sleeper.Info(), "paused_transfers": held}))
+}
+
+// handleSystemWake is the frontend passing on the OS's resume notice
+func handleSystemWake(payload json.RawMessage, writer *Output) {
+	var p SystemSleepPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		sendInvalidPayload(writer, "system_wake")
+		return
+	}
+	if p.Source == "" {
+		p.Source = "frontend"
+	}
+	woke := sleeper.wake(p.Source, 0)
+	writer.Encode(okResponse(message("sleep.awake"), map[string]interface{}{"sleep": sleeper.Info(), "handled": woke}))
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"os/exec"
+	"strings"
+)
+
+// watchOSSleep follows logind's PrepareForSleep signal through gdbus. A
+// delay inhibitor holds the suspend back until the transfers are paused;
+// logind waits at most InhibitDelayMaxSec for it. Without gdbus or
+// systemd the clock watcher still catches the wake.
+func watchOSSleep() {
+	if _, err := exec.LookPath("gdbus"); err != nil {
+		return
+	}
+	cmd := exec.Command("gdbus", "monitor", "--system",
+		"--dest", "org.freedesktop.login1", "--object-path", "/org/freedesktop/login1")
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return
+	}
+	if err := cmd.Start(); err != nil {
+		logger.Debug("cannot follow logind", "err", err)
+		return
+	}
+	lock := takeSleepDelay()
+	scanner := bufio.NewScanner(out)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.Contains(line, "PrepareForSleep") {
+			continue
+		}
+		if strings.Contains(line, "true") {
+			sleeper.suspend("logind")
+			lock.release() // let the suspend go ahead
+			lock = nil
+		} else {
+			lock = takeSleepDelay()
+			sleeper.wake("logind", 0)
+		}
+	}
+	lock.release()
+	cmd.Wait()
+}
+
+// sleepDelay is a logind delay inhibitor, held while its child runs
+type sleepDelay struct {
+	cmd   *exec.Cmd
+	stdin io.Closer
+}
+
+// takeSleepDelay takes an inhibitor whose child, cat, exits when its
+// stdin closes: on release, or when the sidecar itself goes away
+func takeSleepDelay() *sleepDelay {
+	cmd := exec.Command("systemd-inhibit", "--what=sleep", "--mode=delay",
+		"--who=Lumina", "--why=Pausing transfers before sleep", "cat")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil
+	}
+	if err := cmd.Start(); err != nil {
+		return nil
+	}
+	return &sleepDelay{cmd: cmd, stdin: stdin}
+}
+
+func (d *sleepDelay) release() {
+	if d == nil {
+		return
+	}
+	d.stdin.Close()
+	d.cmd.Wait()
+}
@@ -0,0 +1,7 @@
+//go:build !linux
+
+package main
+
+// Elsewhere the frontend reports suspends, and the clock watcher catches
+// wakes
+func watchOSSleep() {}
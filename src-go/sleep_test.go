@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestSleptBetween(t *testing.T) {
+	last := time.Now()
+	if slept := sleptBetween(last, last.Add(sleepCheckInterval+time.Second), sleepCheckInterval); slept != 0 {
+		t.Errorf("a late tick counted as %v of sleep", slept)
+	}
+	if slept := sleptBetween(last, last.Add(sleepCheckInterval+2*time.Minute), sleepCheckInterval); slept != 2*time.Minute {
+		t.Errorf("a tick two minutes late counted as %v of sleep", slept)
+	}
+}
+
+func TestSleepPausesAndResumesTransfers(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	c := &Connection{ID: "test", Direction: "outbound", Network: "tcp", Created: time.Now(), Limiter: newRateLimiter(0)}
+	c.setConn(a)
+
+	tr := newTransfer("send", "movie.mkv", "", "peer:1", 1)
+	defer tr.finish(nil)
+	tr.enablePause(c, func(bool) error { return nil })
+	held := newTransfer("send", "held.bin", "", "peer:1", 1)
+	defer held.finish(nil)
+	held.enablePause(c, func(bool) error { return nil })
+	held.setPaused("local", true)
+
+	s := sleepState{held: make(map[*Transfer]bool)}
+	paused := s.suspend("test")
+	if !slices.Contains(paused, tr.ID) || slices.Contains(paused, held.ID) {
+		t.Errorf("suspend paused %v", paused)
+	}
+	if local, _ := tr.pausedBy(); !local || !power.paused() || s.suspend("test") != nil {
+		t.Error("suspend left the transfer running or the background going, or ran twice")
+	}
+
+	if !s.wake("test", 0) {
+		t.Fatal("wake after suspend ignored")
+	}
+	if local, _ := tr.pausedBy(); local || power.paused() {
+		t.Error("wake left the transfer or the background paused")
+	}
+	if local, _ := held.pausedBy(); !local {
+		t.Error("wake resumed a transfer the user paused")
+	}
+	if s.wake("clock", time.Hour) {
+		t.Error("the clock's wake was handled again right after the frontend's")
+	}
+}
@@ -0,0 +1,539 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"time"
+)
+
+// State snapshots: export_state writes the durable state (config, trust
+// store, schedules and transfer history, and on request the node's private
+// identity) into one file, and import_state reads it back on this or a new
+// machine. Imports merge rather than overwrite. Peers match by fingerprint,
+// schedules by command and timing, history entries by transfer ID and
+// start time, so importing the same file twice changes nothing. Where both
+// sides hold a different value (a config setting, a profile or group, a
+// peer's trust or name) on_conflict decides: "keep" this machine's,
+// "replace" it with the file's, or "abort" the whole import and list them.
+const (
+	snapshotFormat  = "lumina-state"
+	snapshotVersion = 1
+)
+
+var snapshotSections = []string{"config", "peers", "schedules", "history"}
+
+// StateSnapshot is the file export_state writes
+type StateSnapshot struct {
+	Format   string    `json:"format"`
+	Version  int       `json:"version"`
+	Exported time.Time `json:"exported"`
+	Node     string    `json:"node,omitempty"` // fingerprint of the node that exported it
+
+	Config    json.RawMessage `json:"config,omitempty"`
+	Peers     []KnownPeer     `json:"peers,omitempty"`
+	Schedules []*Scheduled    `json:"schedules,omitempty"`
+	History   []HistoryEntry  `json:"history,omitempty"`
+	Identity  string          `json:"identity,omitempty"` // base64 private key, only with include_identity
+}
+
+type ExportStatePayload struct {
+	Path            string   `json:"path"`
+	Sections        []string `json:"sections"`         // default all of them
+	IncludeIdentity bool     `json:"include_identity"` // the node's private key, to keep its ID on a new machine
+}
+
+// checkSections fills in and validates a sections list
+func checkSections(sections []string) ([]string, error) {
+	if len(sections) == 0 {
+		return snapshotSections, nil
+	}
+	for _, s := range sections {
+		if !slices.Contains(snapshotSections, s) {
+			return nil, catalogError(ErrUnsupported, "snapshot.unsupported_section", "section", s)
+		}
+	}
+	return sections, nil
+}
+
+func handleExportState(payload json.RawMessage, writer *Output) {
+	var p ExportStatePayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		sendInvalidPayload(writer, "export_state")
+		return
+	}
+	if p.Path == "" {
+		sendErrorCode(writer, ErrInvalidArgument, message("snapshot.export_state_requires_path"), nil)
+		return
+	}
+	sections, err := checkSections(p.Sections)
+	if err != nil {
+		sendFailure(writer, err)
+		return
+	}
+
+	snap := StateSnapshot{Format: snapshotFormat, Version: snapshotVersion, Exported: time.Now().UTC()}
+	key, err := keys.Identity()
+	if err != nil {
+		sendError(writer, message("snapshot.failed_export_state", "error", err))
+		return
+	}
+	snap.Node = Fingerprint(key.PublicKey().Bytes())
+	if p.IncludeIdentity {
+		snap.Identity = base64.StdEncoding.EncodeToString(key.Bytes())
+	}
+	counts := map[string]int{}
+	for _, s := range sections {
+		switch s {
+		case "config":
+			snap.Config, _ = json.Marshal(config.Get())
+			counts["config"] = 1
+		case "peers":
+			trust.mu.Lock()
+			snap.Peers = trust.listLocked()
+			trust.mu.Unlock()
+			counts["peers"] = len(snap.Peers)
+		case "schedules":
+			scheduler.mu.Lock()
+			data, _ := json.Marshal(scheduler.listLocked())
+			scheduler.mu.Unlock()
+			json.Unmarshal(data, &snap.Schedules)
+			counts["schedules"] = len(snap.Schedules)
+		case "history":
+			history.mu.Lock()
+			snap.History = append([]HistoryEntry(nil), history.entries...)
+			history.mu.Unlock()
+			counts["history"] = len(snap.History)
+		}
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(snap); err == nil {
+		err = os.MkdirAll(filepath.Dir(p.Path), 0o755)
+	}
+	// The trust store and identity are private, so the file is too
+	if err == nil {
+		err = os.WriteFile(p.Path+".tmp", buf.Bytes(), 0o600)
+	}
+	if err == nil {
+		err = os.Rename(p.Path+".tmp", p.Path)
+	}
+	if err != nil {
+		sendError(writer, message("snapshot.failed_export_state", "error", err))
+		return
+	}
+	logger.Info("state exported", "path", p.Path, "sections", sections, "identity", p.IncludeIdentity)
+	writer.Encode(okResponse(message("snapshot.state_exported", "path", p.Path), map[string]interface{}{
+		"path":     p.Path,
+		"version":  snapshotVersion,
+		"counts":   counts,
+		"identity": p.IncludeIdentity,
+		"bytes":    buf.Len(),
+	}))
+}
+
+type ImportStatePayload struct {
+	Path       string   `json:"path"`
+	Sections   []string `json:"sections"`    // default all in the file
+	OnConflict string   `json:"on_conflict"` // "keep" (default), "replace" or "abort"
+	Identity   bool     `json:"identity"`    // take the file's identity; peers that pinned ours will not know us
+}
+
+// SnapshotConflict is one value both sides hold differently
+type SnapshotConflict struct {
+	Section string `json:"section"`
+	Key     string `json:"key"` // config field, "profiles.<name>", "groups.<name>" or peer fingerprint
+}
+
+// ImportResult counts what an import did per section
+type ImportResult struct {
+	Added     int `json:"added"`
+	Replaced  int `json:"replaced"`
+	Kept      int `json:"kept"`      // conflicts resolved in this machine's favour
+	Unchanged int `json:"unchanged"` // already here
+	Skipped   int `json:"skipped,omitempty"`
+}
+
+func handleImportState(payload json.RawMessage, writer *Output) {
+	var p ImportStatePayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		sendInvalidPayload(writer, "import_state")
+		return
+	}
+	if p.Path == "" {
+		sendErrorCode(writer, ErrInvalidArgument, message("snapshot.import_state_requires_path"), nil)
+		return
+	}
+	switch p.OnConflict {
+	case "":
+		p.OnConflict = "keep"
+	case "keep", "replace", "abort":
+	default:
+		sendErrorCode(writer, ErrUnsupported, message("snapshot.unsupported_on_conflict", "on_conflict", p.OnConflict), nil)
+		return
+	}
+	sections, err := checkSections(p.Sections)
+	if err != nil {
+		sendFailure(writer, err)
+		return
+	}
+	data, err := os.ReadFile(p.Path)
+	if err != nil {
+		sendError(writer, message("common.failed_read", "path", p.Path, "error", err))
+		return
+	}
+	var snap StateSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil || snap.Format != snapshotFormat {
+		sendErrorCode(writer, ErrInvalidArgument, message("snapshot.not_lumina_state_file", "path", p.Path), map[string]interface{}{"path": p.Path})
+		return
+	}
+	if snap.Version > snapshotVersion {
+		sendErrorCode(writer, ErrUnsupported, message("snapshot.state_file_version_newer", "version", snap.Version),
+			map[string]interface{}{"version": snap.Version, "supported": snapshotVersion})
+		return
+	}
+	if p.Identity && snap.Identity == "" {
+		sendError(writer, message("snapshot.state_file_holds_no"))
+		return
+	}
+
+	var cfgPatch map[string]json.RawMessage
+	var cfgResult *ImportResult
+	var conflicts []SnapshotConflict
+	if slices.Contains(sections, "config") && len(snap.Config) > 0 {
+		if cfgPatch, cfgResult, conflicts, err = configImportPatch(snap.Config, p.OnConflict == "replace"); err != nil {
+			sendErrorCode(writer, ErrInvalidArgument, message("config.invalid_config", "error", err), nil)
+			return
+		}
+	}
+	if slices.Contains(sections, "peers") {
+		conflicts = append(conflicts, peerConflicts(snap.Peers)...)
+	}
+	if p.OnConflict == "abort" && len(conflicts) > 0 {
+		sendErrorCode(writer, ErrInvalidState, message("snapshot.import_would_change_existing", "count", len(conflicts)),
+			map[string]interface{}{"conflicts": conflicts})
+		return
+	}
+
+	results := map[string]*ImportResult{}
+	if cfgResult != nil {
+		if len(cfgPatch) > 0 {
+			patch, _ := json.Marshal(cfgPatch)
+			cfg, err := config.Update(patch)
+			if err != nil {
+				sendFailure(writer, err)
+				return
+			}
+			if err := applyConfig(cfg, cfgPatch); err != nil {
+				logger.Warn("imported config not applied", "error", err)
+			}
+		}
+		results["config"] = cfgResult
+	}
+	for _, s := range sections {
+		switch s {
+		case "peers":
+			results[s] = importPeers(snap.Peers, p.OnConflict == "replace")
+		case "schedules":
+			results[s] = importSchedules(snap.Schedules)
+		case "history":
+			results[s] = importHistory(snap.History)
+		}
+	}
+	if p.Identity {
+		key, err := parsePrivateKey(snap.Identity)
+		if err == nil {
+			err = keys.SetIdentity(key)
+		}
+		if err != nil {
+			sendError(writer, message("crypto.failed_save_identity", "error", err))
+			return
+		}
+	}
+
+	logger.Info("state imported", "path", p.Path, "from", snap.Node, "on_conflict", p.OnConflict, "conflicts", len(conflicts))
+	writer.Encode(okResponse(message("snapshot.state_imported", "path", p.Path), map[string]interface{}{
+		"path":        p.Path,
+		"node":        snap.Node,
+		"exported":    snap.Exported,
+		"on_conflict": p.OnConflict,
+		"results":     results,
+		"conflicts":   conflicts,
+		"identity":    p.Identity,
+	}))
+}
+
+// configImportPatch is the set_config patch importing raw amounts to,
+// and the settings that differ from ones set here. Without replace, a
+// setting or named profile or group this machine has is left out. The
+// result counts settings, profiles and groups alike.
+func configImportPatch(raw json.RawMessage, replace bool) (map[string]json.RawMessage, *ImportResult, []SnapshotConflict, error) {
+	var imported Config
+	if err := json.Unmarshal(raw, &imported); err != nil {
+		return nil, nil, nil, err
+	}
+	if err := imported.Validate(); err != nil {
+		return nil, nil, nil, err
+	}
+	r := &ImportResult{}
+	// tally counts one setting, profile or group given whether this
+	// machine has it, whether it differs and whether it is taken
+	tally := func(have, differs, take bool) {
+		switch {
+		case !have && take:
+			r.Added++
+		case have && !differs:
+			r.Unchanged++
+		case take:
+			r.Replaced++
+		case have:
+			r.Kept++
+		}
+	}
+	fields := jsonFields(imported)
+	local := jsonFields(config.Get())
+	zero := jsonFields(Config{})
+
+	patch := map[string]json.RawMessage{}
+	var conflicts []SnapshotConflict
+	for name, value := range fields {
+		if name == "profiles" || name == "groups" {
+			continue
+		}
+		if bytes.Equal(value, zero[name]) {
+			continue
+		}
+		have, set := local[name]
+		set = set && !bytes.Equal(have, zero[name])
+		differs := !bytes.Equal(value, have)
+		take := differs && (!set || replace)
+		tally(set, differs, take)
+		if set && differs {
+			conflicts = append(conflicts, SnapshotConflict{Section: "config", Key: name})
+		}
+		if take {
+			patch[name] = value
+		}
+	}
+
+	cfg := config.Get()
+	profiles := map[string]json.RawMessage{}
+	for name, value := range imported.Profiles {
+		have, ok := cfg.Profiles[name]
+		differs := !ok || !jsonEqual(have, value)
+		take := differs && (!ok || replace)
+		tally(ok, differs, take)
+		if ok && differs {
+			conflicts = append(conflicts, SnapshotConflict{Section: "config", Key: "profiles." + name})
+		}
+		if take {
+			profiles[name] = value
+		}
+	}
+	if len(profiles) > 0 {
+		patch["profiles"], _ = json.Marshal(profiles)
+	}
+	groups := map[string][]string{}
+	for name, members := range imported.Groups {
+		have, ok := cfg.Groups[name]
+		differs := !ok || !reflect.DeepEqual(have, members)
+		take := differs && (!ok || replace)
+		tally(ok, differs, take)
+		if ok && differs {
+			conflicts = append(conflicts, SnapshotConflict{Section: "config", Key: "groups." + name})
+		}
+		if take {
+			groups[name] = members
+		}
+	}
+	if len(groups) > 0 {
+		patch["groups"], _ = json.Marshal(groups)
+	}
+	sort.Slice(conflicts, func(i, j int) bool { return conflicts[i].Key < conflicts[j].Key })
+	return patch, r, conflicts, nil
+}
+
+// jsonFields splits v's JSON object into its fields
+func jsonFields(v interface{}) map[string]json.RawMessage {
+	data, _ := json.Marshal(v)
+	var fields map[string]json.RawMessage
+	json.Unmarshal(data, &fields)
+	return fields
+}
+
+// jsonEqual compares two JSON values regardless of spacing and key order
+func jsonEqual(a, b json.RawMessage) bool {
+	var va, vb interface{}
+	if json.Unmarshal(a, &va) != nil || json.Unmarshal(b, &vb) != nil {
+		return bytes.Equal(a, b)
+	}
+	return reflect.DeepEqual(va, vb)
+}
+
+// peerConflicts lists imported peers the trust store knows under another
+// trust level or name
+func peerConflicts(peers []KnownPeer) []SnapshotConflict {
+	trust.mu.Lock()
+	defer trust.mu.Unlock()
+	var conflicts []SnapshotConflict
+	for _, p := range peers {
+		if have, ok := trust.peers[p.Fingerprint]; ok && (have.Trust != p.Trust || have.Name != p.Name) {
+			conflicts = append(conflicts, SnapshotConflict{Section: "peers", Key: p.Fingerprint})
+		}
+	}
+	return conflicts
+}
+
+// importPeers adds unknown peers to the trust store. A known one keeps its
+// trust and name unless replace; either way it learns the other's
+// addresses and the earlier first sighting.
+func importPeers(peers []KnownPeer, replace bool) *ImportResult {
+	r := &ImportResult{}
+	trust.mu.Lock()
+	defer trust.mu.Unlock()
+	for _, p := range peers {
+		pub, err := decodePublicKey(p.PublicKey)
+		if err != nil || Fingerprint(pub) != p.Fingerprint {
+			r.Skipped++
+			continue
+		}
+		have, ok := trust.peers[p.Fingerprint]
+		if !ok {
+			peer := p
+			trust.peers[p.Fingerprint] = &peer
+			r.Added++
+			continue
+		}
+		switch {
+		case have.Trust == p.Trust && have.Name == p.Name:
+			r.Unchanged++
+		case replace:
+			have.Trust, have.Name = p.Trust, p.Name
+			r.Replaced++
+		default:
+			r.Kept++
+		}
+		for _, a := range p.Addrs {
+			if len(have.Addrs) < maxKnownPeerAddr && !slices.Contains(have.Addrs, a) {
+				have.Addrs = append(have.Addrs, a)
+			}
+		}
+		if p.FirstSeen.Before(have.FirstSeen) {
+			have.FirstSeen = p.FirstSeen
+		}
+		if p.LastSeen.After(have.LastSeen) {
+			have.LastSeen = p.LastSeen
+		}
+	}
+	if err := trust.saveLocked(); err != nil {
+		logger.Warn("failed to save trust store", "path", trust.path, "error", err)
+	}
+	return r
+}
+
+// importSchedules arms the imported schedules under new IDs. One that
+// matches a schedule here is already here; a one-off whose time has
+// passed is skipped rather than run on a machine that never planned it.
+func importSchedules(items []*Scheduled) *ImportResult {
+	r := &ImportResult{}
+	now := time.Now()
+	scheduler.mu.Lock()
+	defer scheduler.mu.Unlock()
+	for _, item := range items {
+		if scheduleExistsLocked(item) {
+			r.Unchanged++
+			continue
+		}
+		s := &Scheduled{
+			Name: item.Name, Command: item.Command, Payload: item.Payload,
+			Kind: item.Kind, At: item.At, Cron: item.Cron, Created: item.Created,
+		}
+		switch item.Kind {
+		case scheduleAt:
+			if item.At == nil || item.At.Before(now) {
+				r.Skipped++
+				continue
+			}
+			s.Next = *item.At
+		case scheduleCron:
+			c, err := parseCron(item.Cron)
+			if err != nil || c.next(now).IsZero() {
+				r.Skipped++
+				continue
+			}
+			s.cron, s.Next = c, c.next(now)
+		default:
+			r.Skipped++
+			continue
+		}
+		scheduler.seq++
+		s.ID = fmt.Sprintf("sched-%d", scheduler.seq)
+		scheduler.items[s.ID] = s
+		scheduler.armLocked(s)
+		r.Added++
+	}
+	if r.Added > 0 {
+		scheduler.saveLocked()
+	}
+	return r
+}
+
+// scheduleExistsLocked reports a schedule here running the same command
+// at the same times; the caller holds scheduler.mu
+func scheduleExistsLocked(item *Scheduled) bool {
+	for _, have := range scheduler.items {
+		sameAt := (have.At == nil) == (item.At == nil) && (have.At == nil || have.At.Equal(*item.At))
+		if have.Command == item.Command && have.Kind == item.Kind && have.Cron == item.Cron && sameAt &&
+			jsonEqual(have.Payload, item.Payload) {
+			return true
+		}
+	}
+	return false
+}
+
+// importHistory merges the imported records into the history in the
+// order they finished, keeping the newest maxHistoryEntries
+func importHistory(entries []HistoryEntry) *ImportResult {
+	r := &ImportResult{}
+	history.mu.Lock()
+	defer history.mu.Unlock()
+	type key struct {
+		id      string
+		started int64
+	}
+	seen := make(map[key]bool, len(history.entries))
+	for _, e := range history.entries {
+		seen[key{e.ID, e.StartedAt.UnixNano()}] = true
+	}
+	for _, e := range entries {
+		k := key{e.ID, e.StartedAt.UnixNano()}
+		if seen[k] {
+			r.Unchanged++
+			continue
+		}
+		seen[k] = true
+		history.entries = append(history.entries, e)
+		r.Added++
+	}
+	if r.Added == 0 {
+		return r
+	}
+	sort.SliceStable(history.entries, func(i, j int) bool {
+		return history.entries[i].FinishedAt.Before(history.entries[j].FinishedAt)
+	})
+	if len(history.entries) > maxHistoryEntries {
+		history.entries = append([]HistoryEntry(nil), history.entries[len(history.entries)-maxHistoryEntries:]...)
+	}
+	if err := history.saveLocked(); err != nil {
+		logger.Warn("failed to save transfer history", "path", history.path, "error", err)
+	}
+	return r
+}
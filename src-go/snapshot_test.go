@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestConfigImportPatchConflicts(t *testing.T) {
+	config.mu.Lock()
+	saved := config.cfg
+	config.cfg = Config{
+		LogLevel:    "debug",
+		DownloadDir: "/data",
+		Groups:      map[string][]string{"team": {"a"}},
+	}
+	config.mu.Unlock()
+	defer func() {
+		config.mu.Lock()
+		config.cfg = saved
+		config.mu.Unlock()
+	}()
+
+	raw, _ := json.Marshal(Config{
+		LogLevel:       "info",
+		DownloadDir:    "/data",
+		MaxConnections: 8,
+		Groups:         map[string][]string{"team": {"b"}, "ops": {"c"}},
+	})
+
+	patch, r, conflicts, err := configImportPatch(raw, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := patch["log_level"]; ok {
+		t.Error("keep replaced log_level")
+	}
+	if string(patch["max_connections"]) != "8" || string(patch["groups"]) != `{"ops":["c"]}` {
+		t.Errorf("keep patch %s %s", patch["max_connections"], patch["groups"])
+	}
+	if r.Added != 2 || r.Kept != 2 || r.Unchanged != 1 || r.Replaced != 0 {
+		t.Errorf("keep result %+v", *r)
+	}
+	if len(conflicts) != 2 || conflicts[0].Key != "groups.team" || conflicts[1].Key != "log_level" {
+		t.Errorf("conflicts %+v", conflicts)
+	}
+
+	patch, r, _, err = configImportPatch(raw, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(patch["log_level"]) != `"info"` {
+		t.Errorf("replace patch log_level %s", patch["log_level"])
+	}
+	if r.Added != 2 || r.Replaced != 2 || r.Kept != 0 {
+		t.Errorf("replace result %+v", *r)
+	}
+}
+
+func TestImportHistoryDedupes(t *testing.T) {
+	history.mu.Lock()
+	saved, savedPath := history.entries, history.path
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	history.entries = []HistoryEntry{{ID: "t1", StartedAt: start, FinishedAt: start.Add(time.Minute)}}
+	history.path = filepath.Join(t.TempDir(), "lumina-history.json")
+	history.mu.Unlock()
+	defer func() {
+		history.mu.Lock()
+		history.entries, history.path = saved, savedPath
+		history.mu.Unlock()
+	}()
+
+	r := importHistory([]HistoryEntry{
+		{ID: "t1", StartedAt: start, FinishedAt: start.Add(time.Minute)},
+		{ID: "t0", StartedAt: start.Add(-time.Hour), FinishedAt: start.Add(-time.Hour)},
+	})
+	if r.Added != 1 || r.Unchanged != 1 {
+		t.Errorf("result %+v", *r)
+	}
+	if len(history.entries) != 2 || history.entries[0].ID != "t0" {
+		t.Errorf("entries %+v", history.entries)
+	}
+	if r := importHistory([]HistoryEntry{{ID: "t0", StartedAt: start.Add(-time.Hour)}}); r.Added != 0 {
+		t.Errorf("second import added %d", r.Added)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"runtime"
+	"strings"
+	"syscall"
+)
+
+// maxSocketBuffer caps requested buffer sizes; the kernel may clamp further
+const maxSocketBuffer = 64 << 20
+
+// SocketOptions tunes a listener's socket and the connections it accepts.
+// Omitted fields keep the operating system's defaults.
+type SocketOptions struct {
+	ReuseAddr  *bool `json:"reuse_addr,omitempty"`  // SO_REUSEADDR; Go already sets it on Unix
+	ReusePort  bool  `json:"reuse_port,omitempty"`  // SO_REUSEPORT, several sockets share the port (not on Windows)
+	NoDelay    *bool `json:"no_delay,omitempty"`    // TCP_NODELAY on accepted connections, on by default
+	SendBuffer int   `json:"send_buffer,omitempty"` // SO_SNDBUF in bytes
+	RecvBuffer int   `json:"recv_buffer,omitempty"` // SO_RCVBUF in bytes, set before listen so window scaling follows
+	DualStack  *bool `json:"dual_stack,omitempty"`  // an IPv6 wildcard socket also accepts IPv4, on by default
+	IPv4Only   bool  `json:"ipv4_only,omitempty"`   // bind IPv4 only
+}
+
+// tcpOnly reports whether any option set only applies to TCP sockets
+func (o SocketOptions) tcpOnly() bool {
+	return o.ReuseAddr != nil || o.ReusePort || o.NoDelay != nil || o.SendBuffer != 0 || o.RecvBuffer != 0
+}
+
+func (o SocketOptions) Validate(host string) error {
+	if o.SendBuffer < 0 || o.SendBuffer > maxSocketBuffer || o.RecvBuffer < 0 || o.RecvBuffer > maxSocketBuffer {
+		return catalogError(ErrInvalidArgument, "sockopts.socket_buffers_must_between", "max_socket_buffer", maxSocketBuffer)
+	}
+	if o.ReusePort && runtime.GOOS == "windows" {
+		return errors.New("reuse_port is not supported on Windows")
+	}
+	ip := net.ParseIP(host)
+	if o.IPv4Only && ((o.DualStack != nil && *o.DualStack) || (ip != nil && ip.To4() == nil)) {
+		return catalogError(ErrInvalidArgument, "sockopts.ipv4_only_cannot_combined")
+	}
+	if o.DualStack != nil && ip != nil && ip.To4() != nil {
+		return errors.New("dual_stack needs an IPv6 or empty host")
+	}
+	return nil
+}
+
+// network picks the address family for the listening socket
+func (o SocketOptions) network() string {
+	switch {
+	case o.IPv4Only:
+		return "tcp4"
+	case o.DualStack != nil && !*o.DualStack:
+		return "tcp6"
+	}
+	return "tcp"
+}
+
+// udpNetwork is network for the UDP socket a QUIC listener binds
+func (o SocketOptions) udpNetwork() string {
+	return "udp" + strings.TrimPrefix(o.network(), "tcp")
+}
+
+// listenTCP binds addr with the options applied to the socket before bind
+func listenTCP(addr string, o SocketOptions) (net.Listener, error) {
+	lc := net.ListenConfig{
+		Control: func(network, _ string, rc syscall.RawConn) error {
+			var serr error
+			if err := rc.Control(func(fd uintptr) { serr = setSocketOptions(fd, network, o) }); err != nil {
+				return err
+			}
+			return serr
+		},
+	}
+	ln, err := lc.Listen(context.Background(), o.network(), addr)
+	if err != nil {
+		return nil, err
+	}
+	if o.NoDelay == nil && o.SendBuffer == 0 {
+		return ln, nil
+	}
+	return &tunedListener{Listener: ln, opts: o}, nil
+}
+
+// tunedListener applies the per-connection options to accepted sockets
+type tunedListener struct {
+	net.Listener
+	opts SocketOptions
+}
+
+func (l *tunedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		if l.opts.NoDelay != nil {
+			tcp.SetNoDelay(*l.opts.NoDelay)
+		}
+		if l.opts.SendBuffer > 0 {
+			tcp.SetWriteBuffer(l.opts.SendBuffer)
+		}
+	}
+	return conn, nil
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,54 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+
+	"golang.org/x/sys/unix"
+)
+
+// setSocketOptions runs on the raw socket before bind
+func setSocketOptions(fd uintptr, network string, o SocketOptions) error {
+	s := int(fd)
+	if o.ReuseAddr != nil {
+		if err := unix.SetsockoptInt(s, unix.SOL_SOCKET, unix.SO_REUSEADDR, boolInt(*o.ReuseAddr)); err != nil {
+			return err
+		}
+	}
+	if o.ReusePort {
+		if err := unix.SetsockoptInt(s, unix.SOL_SOCKET, unix.SO_REUSEPORT, 1); err != nil {
+			return err
+		}
+	}
+	if o.SendBuffer > 0 {
+		if err := unix.SetsockoptInt(s, unix.SOL_SOCKET, unix.SO_SNDBUF, o.SendBuffer); err != nil {
+			return err
+		}
+	}
+	if o.RecvBuffer > 0 {
+		if err := unix.SetsockoptInt(s, unix.SOL_SOCKET, unix.SO_RCVBUF, o.RecvBuffer); err != nil {
+			return err
+		}
+	}
+	if o.DualStack != nil && network == "tcp6" {
+		return unix.SetsockoptInt(s, unix.IPPROTO_IPV6, unix.IPV6_V6ONLY, boolInt(!*o.DualStack))
+	}
+	return nil
+}
+
+// isRefused reports a TCP reset or, on a connected UDP socket, an ICMP
+// port unreachable
+func isRefused(err error) bool {
+	return errors.Is(err, unix.ECONNREFUSED)
+}
+
+// isAddrInUse reports a bind to a port another socket holds
+func isAddrInUse(err error) bool {
+	return errors.Is(err, unix.EADDRINUSE)
+}
+
+// isMessageTooBig reports a datagram refused for exceeding the path MTU
+func isMessageTooBig(err error) bool {
+	return errors.Is(err, unix.EMSGSIZE)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+
+	"golang.org/x/sys/windows"
+)
+
+// setSocketOptions runs on the raw socket before bind. SO_REUSEADDR on
+// Windows lets another socket steal the port, so it is only set on request.
+func setSocketOptions(fd uintptr, network string, o SocketOptions) error {
+	s := windows.Handle(fd)
+	if o.ReuseAddr != nil {
+		if err := windows.SetsockoptInt(s, windows.SOL_SOCKET, windows.SO_REUSEADDR, boolInt(*o.ReuseAddr)); err != nil {
+			return err
+		}
+	}
+	if o.SendBuffer > 0 {
+		if err := windows.SetsockoptInt(s, windows.SOL_SOCKET, windows.SO_SNDBUF, o.SendBuffer); err != nil {
+			return err
+		}
+	}
+	if o.RecvBuffer > 0 {
+		if err := windows.SetsockoptInt(s, windows.SOL_SOCKET, windows.SO_RCVBUF, o.RecvBuffer); err != nil {
+			return err
+		}
+	}
+	if o.DualStack != nil && network == "tcp6" {
+		return windows.SetsockoptInt(s, windows.IPPROTO_IPV6, windows.IPV6_V6ONLY, boolInt(!*o.DualStack))
+	}
+	return nil
+}
+
+// isRefused reports a TCP reset or, on a connected UDP socket, an ICMP
+// port unreachable, which Windows surfaces as a reset
+func isRefused(err error) bool {
+	return errors.Is(err, windows.WSAECONNREFUSED) || errors.Is(err, windows.WSAECONNRESET)
+}
+
+// isAddrInUse reports a bind to a port another socket holds
+func isAddrInUse(err error) bool {
+	return errors.Is(err, windows.WSAEADDRINUSE)
+}
+
+// isMessageTooBig reports a datagram refused for exceeding the path MTU
+func isMessageTooBig(err error) bool {
+	return errors.Is(err, windows.WSAEMSGSIZE)
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// "socks5" listeners are a SOCKS5 proxy (RFC 1928) other devices on the
+// LAN can route TCP through. Only CONNECT is offered; BIND and UDP
+// ASSOCIATE are refused. With a username set, clients must log in with
+// RFC 1929 username/password auth, otherwise anyone who can reach the
+// port may use it. Targets on this host itself (loopback, unspecified) or
+// only on the local link are refused unless allow_local is set: without
+// that, a device on the LAN could reach services bound to loopback, such
+// as the gRPC server, through the proxy.
+const (
+	socksVersion     = 5
+	socksAuthVersion = 1
+
+	socksNoAuth       = 0x00
+	socksUserPass     = 0x02
+	socksNoAcceptable = 0xFF
+
+	socksConnect = 0x01
+
+	socksIPv4   = 0x01
+	socksDomain = 0x03
+	socksIPv6   = 0x04
+
+	socksHandshakeTimeout = 10 * time.Second
+)
+
+// SOCKS5 reply codes
+const (
+	socksSucceeded        = 0x00
+	socksGeneralFailure   = 0x01
+	socksNotAllowed       = 0x02
+	socksHostUnreachable  = 0x04
+	socksConnRefused      = 0x05
+	socksCmdNotSupported  = 0x07
+	socksAddrNotSupported = 0x08
+)
+
+// SOCKSOptions configures a "socks5" listener
+type SOCKSOptions struct {
+	Username string `json:"username"` // empty accepts clients without auth
+	Password string `json:"password"`
+
+	DialTimeoutMs int  `json:"dial_timeout_ms"` // per target, default 10000
+	AllowLocal    bool `json:"allow_local"`     // also proxy to loopback, unspecified and link-local targets
+}
+
+// errSOCKSNotAllowed is a target the listener does not proxy to
+var errSOCKSNotAllowed = errors.New("target is on this host or its link")
+
+// Validate checks the credentials fit RFC 1929; nil options are valid
+func (o *SOCKSOptions) Validate() error {
+	if o == nil {
+		return nil
+	}
+	if (o.Username == "") != (o.Password == "") {
+		return catalogError(ErrInvalidArgument, "socks.username_socks_password_must_set")
+	}
+	if len(o.Username) > 255 || len(o.Password) > 255 {
+		return catalogError(ErrInvalidArgument, "socks.username_socks_password_must")
+	}
+	return nil
+}
+
+// handleSOCKSConnection runs one proxied session
+func handleSOCKSConnection(c *Connection, l *Listener, _ string) {
+	defer untrackConn(c)
+
+	c.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	reader := bufio.NewReader(c)
+	user, err := socksNegotiate(c, reader, l.SOCKS)
+	if err != nil {
+		logger.Warn("socks handshake failed", "id", c.ID, "listener", l.Addr, "remote", c.RemoteAddr().String(), "error", err)
+		return
+	}
+	target, err := socksRequest(c, reader)
+	if err != nil {
+		logger.Debug("socks request refused", "id", c.ID, "error", err)
+		return
+	}
+
+	conn, err := socksDialer(l.SOCKS).Dial("tcp", target)
+	if err != nil {
+		socksReply(c, socksDialError(err), nil)
+		logger.Info("socks target unreachable", "id", c.ID, "target", target, "error", err)
+		emitEvent("socks_session_failed", map[string]interface{}{"listener": l.Addr, "listener_id": l.ID, "client": c.ID, "target": target, "error": err.Error()})
+		return
+	}
+	upstream := trackConn(conn, "outbound", "tcp", nil)
+	if upstream == nil {
+		conn.Close()
+		socksReply(c, socksGeneralFailure, nil)
+		return
+	}
+	defer untrackConn(upstream)
+	if err := socksReply(c, socksSucceeded, conn.LocalAddr()); err != nil {
+		return
+	}
+	c.SetDeadline(time.Time{})
+
+	opened := map[string]interface{}{
+		"listener":    l.Addr,
+		"listener_id": l.ID,
+		"client":      c.ID,
+		"upstream":    upstream.ID,
+		"remote":      c.RemoteAddr().String(),
+		"target":      target,
+	}
+	if user != "" {
+		opened["username"] = user
+	}
+	emitEvent("socks_session_opened", opened)
+
+	done := make(chan struct{}, 2)
+	pipe := func(dst io.Writer, src io.Reader) {
+		defer recoverPanic("socks session on " + c.ID)
+		defer func() { done <- struct{}{} }()
+		io.CopyBuffer(dst, src, make([]byte, streamBufferSize))
+	}
+	go pipe(upstream, reader) // the reader may already hold client bytes
+	go pipe(c, upstream)
+	<-done
+	c.Close()
+	upstream.Close()
+	<-done
+
+	emitEvent("socks_session_closed", map[string]interface{}{
+		"listener":    l.Addr,
+		"listener_id": l.ID,
+		"client":      c.ID,
+		"target":      target,
+		"bytes_up":    upstream.BytesOut.Load(),
+		"bytes_down":  upstream.BytesIn.Load(),
+	})
+}
+
+// socksNegotiate picks the auth method and, for username/password, checks
+// the credentials; it returns the user that logged in
+func socksNegotiate(c *Connection, r *bufio.Reader, o *SOCKSOptions) (string, error) {
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return "", err
+	}
+	if head[0] != socksVersion {
+		return "", fmt.Errorf("unsupported SOCKS version %d", head[0])
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return "", err
+	}
+	want := byte(socksNoAuth)
+	if o != nil && o.Username != "" {
+		want = socksUserPass
+	}
+	offered := false
+	for _, m := range methods {
+		offered = offered || m == want
+	}
+	if !offered {
+		c.Write([]byte{socksVersion, socksNoAcceptable})
+		return "", errors.New("client offers no acceptable auth method")
+	}
+	if _, err := c.Write([]byte{socksVersion, want}); err != nil {
+		return "", err
+	}
+	if want == socksNoAuth {
+		return "", nil
+	}
+
+	// RFC 1929: VER ULEN UNAME PLEN PASSWD
+	ver, err := r.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	if ver != socksAuthVersion {
+		return "", fmt.Errorf("unsupported auth version %d", ver)
+	}
+	user, err := readSOCKSString(r)
+	if err != nil {
+		return "", err
+	}
+	pass, err := readSOCKSString(r)
+	if err != nil {
+		return "", err
+	}
+	userOK := subtle.ConstantTimeCompare([]byte(user), []byte(o.Username))
+	passOK := subtle.ConstantTimeCompare([]byte(pass), []byte(o.Password))
+	if userOK&passOK != 1 {
+		c.Write([]byte{socksAuthVersion, 1})
+		return "", errors.New("invalid username or password")
+	}
+	_, err = c.Write([]byte{socksAuthVersion, 0})
+	return user, err
+}
+
+func readSOCKSString(r *bufio.Reader) (string, error) {
+	n, err := r.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, n)
+	_, err = io.ReadFull(r, b)
+	return string(b), err
+}
+
+// socksRequest reads the client's request and returns the target as
+// host:port, answering requests it cannot serve
+func socksRequest(c *Connection, r *bufio.Reader) (string, error) {
+	head := make([]byte, 4) // VER CMD RSV ATYP
+	if _, err := io.ReadFull(r, head); err != nil {
+		return "", err
+	}
+	if head[0] != socksVersion {
+		return "", fmt.Errorf("unsupported SOCKS version %d", head[0])
+	}
+
+	var host string
+	switch head[3] {
+	case socksIPv4, socksIPv6:
+		ip := make([]byte, net.IPv4len)
+		if head[3] == socksIPv6 {
+			ip = make([]byte, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case socksDomain:
+		name, err := readSOCKSString(r)
+		if err != nil {
+			return "", err
+		}
+		host = name
+	default:
+		socksReply(c, socksAddrNotSupported, nil)
+		return "", fmt.Errorf("unsupported address type %d", head[3])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", err
+	}
+	if head[1] != socksConnect {
+		socksReply(c, socksCmdNotSupported, nil)
+		return "", fmt.Errorf("unsupported command %d", head[1])
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// socksDialer dials targets for a listener with options o. The check runs
+// on each address actually dialed, so a name resolving to loopback is
+// refused as well.
+func socksDialer(o *SOCKSOptions) *net.Dialer {
+	d := &net.Dialer{Timeout: defaultDialTimeout}
+	if o != nil && o.DialTimeoutMs > 0 {
+		d.Timeout = time.Duration(o.DialTimeoutMs) * time.Millisecond
+	}
+	if o != nil && o.AllowLocal {
+		return d
+	}
+	d.Control = func(_, address string, _ syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		// A zoned address is link-local; ParseIP refuses those too
+		if ip := net.ParseIP(host); ip == nil || localTarget(ip) {
+			return errSOCKSNotAllowed
+		}
+		return nil
+	}
+	return d
+}
+
+// localTarget reports whether ip reaches only this host or its link
+func localTarget(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast()
+}
+
+// socksReply answers a request; bound is the address used for the
+// target, or nil on failure
+func socksReply(c *Connection, code byte, bound net.Addr) error {
+	reply := []byte{socksVersion, code, 0}
+	ip, port := net.IPv4zero.To4(), 0
+	if tcp, ok := bound.(*net.TCPAddr); ok {
+		ip, port = tcp.IP, tcp.Port
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		reply = append(append(reply, socksIPv4), ip4...)
+	} else {
+		reply = append(append(reply, socksIPv6), ip.To16()...)
+	}
+	reply = binary.BigEndian.AppendUint16(reply, uint16(port))
+	_, err := c.Write(reply)
+	return err
+}
+
+// socksDialError maps a failed dial to the closest reply code
+func socksDialError(err error) byte {
+	var dnsErr *net.DNSError
+	switch {
+	case errors.Is(err, errSOCKSNotAllowed):
+		return socksNotAllowed
+	case isRefused(err):
+		return socksConnRefused
+	case errors.As(err, &dnsErr), isTimeout(err):
+		return socksHostUnreachable
+	}
+	return socksGeneralFailure
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// socksRequestTo asks the proxy at proxy for target and returns the reply code
+func socksRequestTo(t *testing.T, proxy string, target *net.TCPAddr) byte {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", proxy, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte{socksVersion, 1, socksNoAuth})
+	method := make([]byte, 2)
+	if _, err := io.ReadFull(conn, method); err != nil || method[1] != socksNoAuth {
+		t.Fatalf("method %v, %v", method, err)
+	}
+	req := []byte{socksVersion, socksConnect, 0, socksIPv4}
+	req = append(req, target.IP.To4()...)
+	req = append(req, byte(target.Port>>8), byte(target.Port))
+	conn.Write(req)
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	return reply[1]
+}
+
+func TestSOCKSRefusesLocalTargets(t *testing.T) {
+	savedOutput := output
+	output = NewOutput(io.Discard)
+	t.Cleanup(func() { output = savedOutput })
+
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			c, err := target.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	addr := target.Addr().(*net.TCPAddr)
+
+	for _, allow := range []bool{false, true} {
+		resp := harnessCall(t, handleStartServer, `{"host":"127.0.0.1","port":0,"type":"socks5","socks":{"allow_local":`+strconv.FormatBool(allow)+`}}`)
+		data := resp.Data.(map[string]interface{})
+		t.Cleanup(func() { harnessCall(t, handleStopServer, `{"listener_id":"`+data["listener_id"].(string)+`"}`) })
+
+		want := byte(socksNotAllowed)
+		if allow {
+			want = socksSucceeded
+		}
+		if code := socksRequestTo(t, data["addr"].(string), addr); code != want {
+			t.Errorf("allow_local %v: reply %d, want %d", allow, code, want)
+		}
+	}
+}
+
+func TestLocalTarget(t *testing.T) {
+	for addr, local := range map[string]bool{
+		"127.0.0.1":        true,
+		"::1":              true,
+		"0.0.0.0":          true,
+		"::ffff:127.0.0.2": true,
+		"169.254.10.1":     true,
+		"fe80::1":          true,
+		"192.168.1.20":     false,
+		"2001:db8::1":      false,
+	} {
+		if got := localTarget(net.ParseIP(addr)); got != local {
+			t.Errorf("%s: local %v", addr, got)
+		}
+	}
+}
@@ -0,0 +1,463 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A speed test runs over a "speedtest" listener. Every connection opens
+// with a JSON line naming its phase: "ping" echoes 8-byte probes back,
+// "download" streams data to the client for the requested duration and
+// "upload" counts what the client sends for that long, then answers with
+// a result line.
+const (
+	defaultSpeedtestDuration = 5 * time.Second
+	maxSpeedtestDuration     = 60 * time.Second
+	defaultSpeedtestStreams  = 4
+	maxSpeedtestStreams      = 16
+	defaultSpeedtestPings    = 10
+	maxSpeedtestPings        = 100
+	speedtestInterval        = time.Second
+)
+
+var errSpeedtestProtocol = errors.New("unexpected speed test reply")
+
+// speedtestBlock is sent repeatedly; random so compressing links cannot
+// inflate the result
+var speedtestBlock = func() []byte {
+	b := make([]byte, transferBufferSize)
+	rand.Read(b)
+	return b
+}()
+
+type speedtestHello struct {
+	Phase      string `json:"phase"` // "ping", "upload", "download"
+	DurationMs int    `json:"duration_ms"`
+}
+
+type speedtestReply struct {
+	Bytes     int64 `json:"bytes"`
+	ElapsedMs int64 `json:"elapsed_ms"`
+}
+
+func (h speedtestHello) duration() time.Duration {
+	d := time.Duration(h.DurationMs) * time.Millisecond
+	if d <= 0 {
+		return defaultSpeedtestDuration
+	}
+	return min(d, maxSpeedtestDuration)
+}
+
+// handleSpeedtestConnection serves one phase of a speed test
+func handleSpeedtestConnection(c *Connection) {
+	defer untrackConn(c)
+
+	reader := bufio.NewReader(c)
+	c.SetReadDeadline(time.Now().Add(secureHandshakeTTL))
+	line, err := reader.ReadBytes('\n')
+	c.SetReadDeadline(time.Time{})
+	var hello speedtestHello
+	if err != nil || json.Unmarshal(line, &hello) != nil {
+		return
+	}
+
+	switch hello.Phase {
+	case "ping":
+		probe := make([]byte, 8)
+		for {
+			if _, err := io.ReadFull(reader, probe); err != nil {
+				return
+			}
+			if _, err := c.Write(probe); err != nil {
+				return
+			}
+		}
+	case "download":
+		deadline := time.Now().Add(hello.duration())
+		for time.Now().Before(deadline) {
+			if _, err := c.Write(speedtestBlock); err != nil {
+				return
+			}
+		}
+	case "upload":
+		window := hello.duration()
+		buf := make([]byte, transferBufferSize)
+		var total int64
+		var start time.Time
+		c.SetReadDeadline(time.Now().Add(window + secureHandshakeTTL))
+		for {
+			n, err := reader.Read(buf)
+			if total == 0 && n > 0 {
+				// Time from the first byte so dial latency is not counted
+				start = time.Now()
+				c.SetReadDeadline(start.Add(window))
+			}
+			total += int64(n)
+			if err != nil {
+				break
+			}
+		}
+		c.SetReadDeadline(time.Time{})
+		reply, _ := json.Marshal(speedtestReply{Bytes: total, ElapsedMs: time.Since(start).Milliseconds()})
+		if start.IsZero() {
+			reply, _ = json.Marshal(speedtestReply{})
+		}
+		c.Write(append(reply, '\n'))
+		// Let the client finish writing what is still in flight
+		c.SetReadDeadline(time.Now().Add(secureHandshakeTTL))
+		io.Copy(io.Discard, reader)
+	}
+}
+
+type RunSpeedtestPayload struct {
+	Host       string     `json:"host"`
+	Port       int        `json:"port"`
+	Streams    int        `json:"streams"`     // parallel connections per direction, default 4
+	DurationMs int        `json:"duration_ms"` // per direction, default 5000
+	Direction  string     `json:"direction"`   // "both" (default), "upload", "download"
+	Pings      int        `json:"pings"`       // latency probes, default 10
+	TimeoutMs  int        `json:"timeout_ms"`
+	Encrypted  bool       `json:"encrypted"`
+	PeerKey    string     `json:"peer_key"`
+	Auth       ClientAuth `json:"auth"`
+
+	AddressFamily string `json:"address_family"` // "ipv4", "ipv6" or "dual" (default)
+	Transport     string `json:"transport"`      // "tcp" (default) or "quic"
+}
+
+// RTTStats summarizes the latency probes of a speed test
+type RTTStats struct {
+	Samples  int     `json:"samples"`
+	MinMs    float64 `json:"min_ms"`
+	AvgMs    float64 `json:"avg_ms"`
+	MaxMs    float64 `json:"max_ms"`
+	JitterMs float64 `json:"jitter_ms"` // mean difference between consecutive samples
+}
+
+// SpeedtestResult is reported in the speedtest_completed event
+type SpeedtestResult struct {
+	ID            string   `json:"id"`
+	Target        string   `json:"target"`
+	Streams       int      `json:"streams"`
+	DurationMs    int64    `json:"duration_ms"`
+	UploadMbps    float64  `json:"upload_mbps"`
+	DownloadMbps  float64  `json:"download_mbps"`
+	UploadBytes   int64    `json:"upload_bytes"`
+	DownloadBytes int64    `json:"download_bytes"`
+	RTT           RTTStats `json:"rtt"`
+}
+
+var speedtestSeq atomic.Uint64
+
+func handleRunSpeedtest(payload json.RawMessage, writer *Output) {
+	var p RunSpeedtestPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		sendInvalidPayload(writer, "run_speedtest")
+		return
+	}
+	if p.Host == "" || p.Port <= 0 {
+		sendErrorCode(writer, ErrInvalidArgument, message("speedtest.run_speedtest_requires_host"), nil)
+		return
+	}
+	switch p.Direction {
+	case "":
+		p.Direction = "both"
+	case "both", "upload", "download":
+	default:
+		sendErrorCode(writer, ErrUnsupported, message("speedtest.unsupported_speed_test_direction", "direction", p.Direction), nil)
+		return
+	}
+	if err := p.Auth.Validate(); err != nil {
+		sendFailure(writer, err)
+		return
+	}
+	if p.Streams <= 0 {
+		p.Streams = defaultSpeedtestStreams
+	}
+	p.Streams = min(p.Streams, maxSpeedtestStreams)
+	if p.Pings <= 0 {
+		p.Pings = defaultSpeedtestPings
+	}
+	p.Pings = min(p.Pings, maxSpeedtestPings)
+	duration := speedtestHello{DurationMs: p.DurationMs}.duration()
+
+	timeout := defaultDialTimeout
+	if p.TimeoutMs > 0 {
+		timeout = time.Duration(p.TimeoutMs) * time.Millisecond
+	}
+	network, isQUIC, err := transportNetwork(p.Transport, p.AddressFamily)
+	if err != nil {
+		sendFailure(writer, err)
+		return
+	}
+	spec := dialSpec{
+		Network:   network,
+		Addr:      net.JoinHostPort(normalizeHost(p.Host), strconv.Itoa(p.Port)),
+		QUIC:      isQUIC,
+		Timeout:   timeout,
+		Encrypted: p.Encrypted,
+		PeerKey:   p.PeerKey,
+		Auth:      p.Auth,
+	}
+	res := &SpeedtestResult{
+		ID:         fmt.Sprintf("speedtest-%d", speedtestSeq.Add(1)),
+		Target:     spec.Addr,
+		Streams:    p.Streams,
+		DurationMs: duration.Milliseconds(),
+	}
+
+	// A run takes several seconds, so answer now and report through events
+	ctx, done := trackJob(res.ID, "speedtest", res.Target)
+	writer.Encode(okResponse(message("speedtest.speed_test_started"), map[string]interface{}{"id": res.ID, "target": res.Target}))
+
+	go func() {
+		defer recoverPanic("speedtest " + res.ID)
+		defer done()
+		err := canceled(ctx, runSpeedtest(ctx, res, spec, p.Direction, p.Pings, duration))
+		if errors.Is(err, context.Canceled) {
+			logger.Info("speed test canceled", "id", res.ID, "target", res.Target)
+			emitEvent("speedtest_canceled", map[string]interface{}{"id": res.ID})
+			return
+		}
+		if err != nil {
+			logger.Warn("speed test failed", "id", res.ID, "target", res.Target, "error", err)
+			emitEvent("speedtest_failed", map[string]interface{}{"id": res.ID, "error": err.Error()})
+			return
+		}
+		emitEvent("speedtest_completed", res)
+	}()
+}
+
+func runSpeedtest(ctx context.Context, res *SpeedtestResult, spec dialSpec, direction string, pings int, duration time.Duration) error {
+	rtt, err := speedtestPing(ctx, spec, pings)
+	if err != nil {
+		return fmt.Errorf("ping: %w", err)
+	}
+	res.RTT = rtt
+
+	if direction != "download" {
+		bytes, elapsed, err := speedtestPhase(ctx, res, spec, "upload", duration)
+		if err != nil {
+			return fmt.Errorf("upload: %w", err)
+		}
+		res.UploadBytes, res.UploadMbps = bytes, mbps(bytes, elapsed)
+	}
+	if direction != "upload" {
+		bytes, elapsed, err := speedtestPhase(ctx, res, spec, "download", duration)
+		if err != nil {
+			return fmt.Errorf("download: %w", err)
+		}
+		res.DownloadBytes, res.DownloadMbps = bytes, mbps(bytes, elapsed)
+	}
+	return nil
+}
+
+// speedtestDial opens a tracked connection and announces its phase. The
+// connection is aborted when ctx ends, which stops a canceled run.
+func speedtestDial(ctx context.Context, spec dialSpec, hello speedtestHello) (*Connection, error) {
+	conn, secure, err := spec.dial()
+	if err != nil {
+		return nil, err
+	}
+	c := trackConn(conn, "outbound", spec.transport(), nil)
+	if c == nil {
+		conn.Close()
+		return nil, errors.New("service is shutting down")
+	}
+	c.setSecure(secure)
+	context.AfterFunc(ctx, func() { c.Abort() })
+	line, _ := json.Marshal(hello)
+	if _, err := c.Write(append(line, '\n')); err != nil {
+		untrackConn(c)
+		return nil, err
+	}
+	return c, nil
+}
+
+// speedtestPing measures round trips with sequential 8-byte probes
+func speedtestPing(ctx context.Context, spec dialSpec, count int) (RTTStats, error) {
+	var stats RTTStats
+	c, err := speedtestDial(ctx, spec, speedtestHello{Phase: "ping"})
+	if err != nil {
+		return stats, err
+	}
+	defer untrackConn(c)
+
+	probe, echo := make([]byte, 8), make([]byte, 8)
+	samples := make([]float64, 0, count)
+	for i := 0; i < count; i++ {
+		binary.BigEndian.PutUint64(probe, uint64(i))
+		c.SetReadDeadline(time.Now().Add(spec.Timeout))
+		start := time.Now()
+		if _, err := c.Write(probe); err != nil {
+			return stats, err
+		}
+		if _, err := io.ReadFull(c, echo); err != nil {
+			return stats, err
+		}
+		if binary.BigEndian.Uint64(echo) != uint64(i) {
+			return stats, errSpeedtestProtocol
+		}
+		samples = append(samples, float64(time.Since(start).Microseconds())/1000)
+	}
+	c.SetReadDeadline(time.Time{})
+
+	stats.Samples = len(samples)
+	stats.MinMs = math.Inf(1)
+	var sum, jitter float64
+	for i, s := range samples {
+		sum += s
+		stats.MinMs = math.Min(stats.MinMs, s)
+		stats.MaxMs = math.Max(stats.MaxMs, s)
+		if i > 0 {
+			jitter += math.Abs(s - samples[i-1])
+		}
+	}
+	stats.AvgMs = sum / float64(len(samples))
+	if len(samples) > 1 {
+		stats.JitterMs = jitter / float64(len(samples)-1)
+	}
+	return stats, nil
+}
+
+// speedtestPhase runs one direction over res.Streams parallel connections
+// and returns the bytes moved and the time it took
+func speedtestPhase(ctx context.Context, res *SpeedtestResult, spec dialSpec, phase string, duration time.Duration) (int64, time.Duration, error) {
+	hello := speedtestHello{Phase: phase, DurationMs: int(duration.Milliseconds())}
+	var total atomic.Int64
+	var sent atomic.Int64    // upload: bytes written so far, for progress only
+	var longest atomic.Int64 // upload: slowest stream as measured by the listener
+	var wg sync.WaitGroup
+	errs := make(chan error, res.Streams)
+
+	start := time.Now()
+	done := make(chan struct{})
+	progress := &total
+	if phase == "upload" {
+		progress = &sent
+	}
+	go speedtestProgress(res.ID, phase, progress, start, done)
+
+	for i := 0; i < res.Streams; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := callSafe("speedtest "+res.ID, func() error {
+				c, err := speedtestDial(ctx, spec, hello)
+				if err != nil {
+					return err
+				}
+				defer untrackConn(c)
+
+				if phase == "download" {
+					n, err := io.CopyBuffer(io.Discard, countingReader{r: c, n: &total}, make([]byte, transferBufferSize))
+					if err == nil && n == 0 {
+						err = errSpeedtestProtocol
+					}
+					return err
+				}
+
+				reply, err := speedtestUpload(c, duration, &sent)
+				if err != nil {
+					return err
+				}
+				total.Add(reply.Bytes)
+				for {
+					cur := longest.Load()
+					if reply.ElapsedMs <= cur || longest.CompareAndSwap(cur, reply.ElapsedMs) {
+						return nil
+					}
+				}
+			}); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(done)
+
+	select {
+	case err := <-errs:
+		return 0, 0, err
+	default:
+	}
+	elapsed := time.Since(start)
+	if phase == "upload" {
+		elapsed = time.Duration(longest.Load()) * time.Millisecond
+	}
+	return total.Load(), elapsed, nil
+}
+
+// speedtestUpload sends for duration and returns what the listener counted
+func speedtestUpload(c *Connection, duration time.Duration, sent *atomic.Int64) (speedtestReply, error) {
+	var reply speedtestReply
+	deadline := time.Now().Add(duration)
+	for time.Now().Before(deadline) {
+		n, err := c.Write(speedtestBlock)
+		sent.Add(int64(n))
+		if err != nil {
+			return reply, err
+		}
+	}
+
+	c.SetReadDeadline(time.Now().Add(duration + secureHandshakeTTL))
+	line, err := bufio.NewReader(c).ReadBytes('\n')
+	if err != nil {
+		return reply, err
+	}
+	if err := json.Unmarshal(line, &reply); err != nil {
+		return reply, errSpeedtestProtocol
+	}
+	return reply, nil
+}
+
+// speedtestProgress reports the running throughput of a phase
+func speedtestProgress(id, phase string, total *atomic.Int64, start time.Time, done <-chan struct{}) {
+	ticker := time.NewTicker(speedtestInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			bytes := total.Load()
+			emitEvent("speedtest_progress", map[string]interface{}{
+				"id":    id,
+				"phase": phase,
+				"bytes": bytes,
+				"mbps":  mbps(bytes, time.Since(start)),
+			})
+		}
+	}
+}
+
+// countingReader adds every byte read through it to n
+type countingReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (cr countingReader) Read(b []byte) (int, error) {
+	n, err := cr.r.Read(b)
+	cr.n.Add(int64(n))
+	return n, err
+}
+
+func mbps(bytes int64, elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(bytes) * 8 / elapsed.Seconds() / 1e6
+}
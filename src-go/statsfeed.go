@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stats subscriptions push listener_stats every interval so the dashboard
+// can draw live graphs without polling status. Each event carries one
+// sample per listener, or only the listener the subscription names.
+// Subscriptions live until unsubscribe_stats or the process exits.
+const (
+	defaultStatsInterval = time.Second
+	minStatsInterval     = 100 * time.Millisecond
+	maxStatsInterval     = time.Hour
+	maxStatsSubs         = 16
+)
+
+type SubscribeStatsPayload struct {
+	IntervalMs int    `json:"interval_ms"` // default 1000, at least 100
+	ListenerID string `json:"listener_id"` // only this listener, default all
+}
+
+type UnsubscribeStatsPayload struct {
+	ID string `json:"id"` // subscription to end, default all of them
+}
+
+// ListenerStats is one listener's sample in a listener_stats event
+type ListenerStats struct {
+	ListenerID     string  `json:"listener_id"`
+	Addr           string  `json:"addr"`
+	Type           string  `json:"type"`
+	Transport      string  `json:"transport"`
+	Connections    int     `json:"connections"`
+	AcceptedPerSec float64 `json:"accepted_per_sec"`
+	InBps          float64 `json:"in_bps"`
+	OutBps         float64 `json:"out_bps"`
+	Accepted       uint64  `json:"accepted"`
+	BytesIn        uint64  `json:"bytes_in"`
+	BytesOut       uint64  `json:"bytes_out"`
+}
+
+type statsSub struct {
+	id         string
+	interval   time.Duration
+	listenerID string
+	stop       chan struct{}
+
+	// accepted counts at the previous sample, for the per-second rate
+	accepted map[string]uint64
+	sampled  time.Time
+}
+
+var (
+	statsSubsMu sync.Mutex
+	statsSubs   = make(map[string]*statsSub)
+	statsSubSeq atomic.Uint64
+)
+
+func handleSubscribeStats(payload json.RawMessage, writer *Output) {
+	var p SubscribeStatsPayload
+	if len(payload) > 0 && string(payload) != "null" {
+		if err := json.Unmarshal(payload, &p); err != nil {
+			sendInvalidPayload(writer, "subscribe_stats")
+			return
+		}
+	}
+	interval := defaultStatsInterval
+	if p.IntervalMs != 0 {
+		interval = time.Duration(p.IntervalMs) * time.Millisecond
+		if interval < minStatsInterval || interval > maxStatsInterval {
+			sendErrorCode(writer, ErrInvalidArgument, message("statsfeed.interval_ms_must_between", "milliseconds", minStatsInterval.Milliseconds(), "milliseconds2", maxStatsInterval.Milliseconds()), nil)
+			return
+		}
+	}
+	if p.ListenerID != "" {
+		state.Mutex.Lock()
+		_, exists := state.Listeners[p.ListenerID]
+		state.Mutex.Unlock()
+		if !exists {
+			sendErrorCode(writer, ErrNotFound, message("common.server_id_not_found", "listener_id", p.ListenerID), map[string]interface{}{"listener_id": p.ListenerID})
+			return
+		}
+	}
+
+	statsSubsMu.Lock()
+	if len(statsSubs) >= maxStatsSubs {
+		statsSubsMu.Unlock()
+		sendErrorCode(writer, ErrInvalidArgument, message("statsfeed.most_stats_subscriptions_can", "max_stats_subs", maxStatsSubs), nil)
+		return
+	}
+	s := &statsSub{
+		id:         fmt.Sprintf("stats-%d", statsSubSeq.Add(1)),
+		interval:   interval,
+		listenerID: p.ListenerID,
+		stop:       make(chan struct{}),
+		accepted:   make(map[string]uint64),
+	}
+	statsSubs[s.id] = s
+	statsSubsMu.Unlock()
+
+	s.sample() // seeds the accept counts
+	go s.run()
+	logger.Info("stats subscription started", "id", s.id, "interval", interval, "listener_id", p.ListenerID)
+
+	writer.Encode(ProtocolResponse{
+		Status: "ok",
+		Data: map[string]interface{}{
+			"id":          s.id,
+			"interval_ms": interval.Milliseconds(),
+			"listener_id": p.ListenerID,
+		},
+	})
+}
+
+func handleUnsubscribeStats(payload json.RawMessage, writer *Output) {
+	var p UnsubscribeStatsPayload
+	if len(payload) > 0 && string(payload) != "null" {
+		if err := json.Unmarshal(payload, &p); err != nil {
+			sendInvalidPayload(writer, "unsubscribe_stats")
+			return
+		}
+	}
+
+	statsSubsMu.Lock()
+	var ended []string
+	for id, s := range statsSubs {
+		if p.ID == "" || p.ID == id {
+			close(s.stop)
+			delete(statsSubs, id)
+			ended = append(ended, id)
+		}
+	}
+	statsSubsMu.Unlock()
+
+	if p.ID != "" && len(ended) == 0 {
+		sendErrorCode(writer, ErrNotFound, message("statsfeed.subscription_not_found"), nil)
+		return
+	}
+	sort.Strings(ended)
+	logger.Info("stats subscriptions ended", "ids", ended)
+	writer.Encode(okResponse(message("statsfeed.stats_subscriptions_ended", "ended", len(ended)),
+		map[string]interface{}{"ids": ended}))
+}
+
+func (s *statsSub) run() {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			emitEvent("listener_stats", map[string]interface{}{
+				"id":        s.id,
+				"time":      time.Now(),
+				"listeners": s.sample(),
+			})
+		}
+	}
+}
+
+// sample reads the counters of the subscribed listeners, oldest first
+func (s *statsSub) sample() []ListenerStats {
+	now := time.Now()
+	elapsed := now.Sub(s.sampled).Seconds()
+	first := s.sampled.IsZero()
+	s.sampled = now
+
+	state.Mutex.Lock()
+	open := make(map[string]int)
+	for _, c := range state.Conns {
+		if c.ListenerID != "" {
+			open[c.ListenerID]++
+		}
+	}
+	listeners := make([]*Listener, 0, len(state.Listeners))
+	for id, l := range state.Listeners {
+		if s.listenerID == "" || s.listenerID == id {
+			listeners = append(listeners, l)
+		}
+	}
+	state.Mutex.Unlock()
+	sort.Slice(listeners, func(i, j int) bool { return listeners[i].seq < listeners[j].seq })
+
+	seen := make(map[string]uint64, len(listeners))
+	stats := make([]ListenerStats, 0, len(listeners))
+	for _, l := range listeners {
+		accepted := l.Accepted.Load()
+		seen[l.ID] = accepted
+		var rate float64
+		// reset_metrics zeroes the count, and a new listener has no previous one
+		if prev, ok := s.accepted[l.ID]; ok && !first && elapsed > 0 && accepted >= prev {
+			rate = float64(accepted-prev) / elapsed
+		}
+		stats = append(stats, ListenerStats{
+			ListenerID:     l.ID,
+			Addr:           l.Addr,
+			Type:           l.Type,
+			Transport:      l.Transport,
+			Connections:    open[l.ID],
+			AcceptedPerSec: rate,
+			InBps:          l.In.Rate(),
+			OutBps:         l.Out.Rate(),
+			Accepted:       accepted,
+			BytesIn:        l.BytesIn.Load(),
+			BytesOut:       l.BytesOut.Load(),
+		})
+	}
+	s.accepted = seen
+	return stats
+}
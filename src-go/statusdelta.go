@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Delta status: a frontend polling status every second used to get the
+// whole snapshot each time and diff it itself. Every part of the status,
+// each top-level field and each listener, now carries the state sequence
+// number at which it last changed, and status_since returns only what
+// changed after the sequence the frontend already has, plus the fields and
+// listeners that went away. status reports the current sequence too.
+//
+// Changes are noticed when a status is taken: each status or status_since
+// compares the snapshot with the previous one, and what differs gets the
+// next number. The numbers only grow, across namespaces too, so a
+// frontend never has to tell them apart.
+const (
+	// maxStatusTombstones bounds how many removed fields and listeners a
+	// tracker remembers; a since older than the oldest forgotten one gets a
+	// reset
+	maxStatusTombstones = 1024
+)
+
+var statusSeq atomic.Uint64
+
+// statusTracker remembers the last status of one namespace
+type statusTracker struct {
+	mu        sync.Mutex
+	seq       uint64 // highest sequence handed out here
+	floor     uint64 // removals at or below it are forgotten
+	fields    map[string]statusPart
+	listeners map[string]statusPart
+	removed   map[string]uint64 // listener ID -> when it went away
+	gone      map[string]uint64 // field -> when it went away
+}
+
+// statusPart is one field or listener as last seen
+type statusPart struct {
+	value json.RawMessage
+	seq   uint64
+}
+
+var (
+	statusTrackersMu sync.Mutex
+	statusTrackers   = make(map[string]*statusTracker)
+)
+
+func statusTrackerFor(ns string) *statusTracker {
+	statusTrackersMu.Lock()
+	defer statusTrackersMu.Unlock()
+	t, ok := statusTrackers[ns]
+	if !ok {
+		t = &statusTracker{
+			fields:    make(map[string]statusPart),
+			listeners: make(map[string]statusPart),
+			removed:   make(map[string]uint64),
+			gone:      make(map[string]uint64),
+		}
+		statusTrackers[ns] = t
+	}
+	return t
+}
+
+// statusDelta is the answer to status_since
+type statusDelta struct {
+	seq       uint64
+	reset     bool // since was too old or zero: everything is included
+	fields    map[string]json.RawMessage
+	listeners map[string]json.RawMessage
+	removed   []string
+	gone      []string // fields
+}
+
+// observe records a status snapshot, numbering what changed since the
+// last one, and returns the whole state as of now
+func (t *statusTracker) observe(data map[string]interface{}) statusDelta {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	fields := make(map[string]json.RawMessage, len(data))
+	listeners := make(map[string]json.RawMessage)
+	for k, v := range data {
+		if k == "listeners" {
+			for _, entry := range v.([]map[string]interface{}) {
+				listeners[entry["listener_id"].(string)], _ = json.Marshal(entry)
+			}
+			continue
+		}
+		fields[k], _ = json.Marshal(v)
+	}
+
+	next := func() uint64 {
+		t.seq = statusSeq.Add(1)
+		return t.seq
+	}
+	for k, v := range fields {
+		if old, ok := t.fields[k]; !ok || !bytes.Equal(old.value, v) {
+			t.fields[k] = statusPart{value: v, seq: next()}
+			delete(t.gone, k)
+		}
+	}
+	for k := range t.fields {
+		if _, ok := fields[k]; !ok {
+			delete(t.fields, k)
+			t.gone[k] = next()
+		}
+	}
+	for id, v := range listeners {
+		if old, ok := t.listeners[id]; !ok || !bytes.Equal(old.value, v) {
+			t.listeners[id] = statusPart{value: v, seq: next()}
+			delete(t.removed, id)
+		}
+	}
+	for id := range t.listeners {
+		if _, ok := listeners[id]; !ok {
+			delete(t.listeners, id)
+			t.removed[id] = next()
+		}
+	}
+	t.pruneLocked()
+	return statusDelta{seq: t.seq, reset: true, fields: fields, listeners: listeners, removed: []string{}, gone: []string{}}
+}
+
+// pruneLocked forgets the oldest removals beyond maxStatusTombstones
+func (t *statusTracker) pruneLocked() {
+	if len(t.removed)+len(t.gone) <= maxStatusTombstones {
+		return
+	}
+	seqs := make([]uint64, 0, len(t.removed)+len(t.gone))
+	for _, seq := range t.removed {
+		seqs = append(seqs, seq)
+	}
+	for _, seq := range t.gone {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	t.floor = seqs[len(seqs)-maxStatusTombstones-1]
+	for _, tombstones := range []map[string]uint64{t.removed, t.gone} {
+		for key, seq := range tombstones {
+			if seq <= t.floor {
+				delete(tombstones, key)
+			}
+		}
+	}
+}
+
+// since records a snapshot and returns what changed after seq
+func (t *statusTracker) since(data map[string]interface{}, seq uint64) statusDelta {
+	full := t.observe(data)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if seq == 0 || seq < t.floor || seq > full.seq {
+		// Too old to tell, or from before a restart: start over
+		return full
+	}
+	delta := statusDelta{seq: full.seq, fields: map[string]json.RawMessage{}, listeners: map[string]json.RawMessage{}, removed: []string{}, gone: []string{}}
+	for k, part := range t.fields {
+		if part.seq > seq {
+			delta.fields[k] = part.value
+		}
+	}
+	for id, part := range t.listeners {
+		if part.seq > seq {
+			delta.listeners[id] = part.value
+		}
+	}
+	for id, removed := range t.removed {
+		if removed > seq {
+			delta.removed = append(delta.removed, id)
+		}
+	}
+	for k, removed := range t.gone {
+		if removed > seq {
+			delta.gone = append(delta.gone, k)
+		}
+	}
+	sort.Strings(delta.removed)
+	sort.Strings(delta.gone)
+	return delta
+}
+
+type StatusSincePayload struct {
+	Since uint64 `json:"since"` // the seq of the last status or status_since seen, 0 for everything
+}
+
+// handleStatusSince answers with the parts of status that changed after
+// the given sequence
+func handleStatusSince(payload json.RawMessage, writer *Output) {
+	var p StatusSincePayload
+	if len(payload) > 0 && string(payload) != "null" {
+		if err := json.Unmarshal(payload, &p); err != nil {
+			sendInvalidPayload(writer, "status_since")
+			return
+		}
+	}
+	ns := writer.Namespace()
+	delta := statusTrackerFor(ns).since(statusData(ns), p.Since)
+	writer.Encode(ProtocolResponse{Status: "ok", Data: map[string]interface{}{
+		"seq":               delta.seq,
+		"since":             p.Since,
+		"reset":             delta.reset,
+		"changed":           delta.fields,
+		"listeners":         delta.listeners,
+		"removed_listeners": delta.removed,
+		"removed_fields":    delta.gone,
+	}})
+}
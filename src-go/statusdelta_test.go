@@ -0,0 +1,56 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestStatusSinceReturnsOnlyChanges(t *testing.T) {
+	tr := statusTrackerFor("delta-test")
+	listener := func(id string, conns int) map[string]interface{} {
+		return map[string]interface{}{"listener_id": id, "connections": conns}
+	}
+	snapshot := func(conns int, listeners ...map[string]interface{}) map[string]interface{} {
+		return map[string]interface{}{"connections": conns, "in_bps": 0.0, "listeners": listeners}
+	}
+
+	first := tr.since(snapshot(1, listener("a", 1), listener("b", 0)), 0)
+	if !first.reset || len(first.fields) != 2 || len(first.listeners) != 2 {
+		t.Fatalf("first call was not a full snapshot: %+v", first)
+	}
+
+	same := tr.since(snapshot(1, listener("a", 1), listener("b", 0)), first.seq)
+	if same.reset || same.seq != first.seq || len(same.fields)+len(same.listeners)+len(same.removed) != 0 {
+		t.Errorf("nothing changed but got %+v", same)
+	}
+
+	next := tr.since(snapshot(2, listener("a", 2)), first.seq)
+	if next.seq <= first.seq || len(next.fields) != 1 || next.fields["connections"] == nil {
+		t.Errorf("changed fields %v", next.fields)
+	}
+	if len(next.listeners) != 1 || next.listeners["a"] == nil || !slices.Equal(next.removed, []string{"b"}) {
+		t.Errorf("changed listeners %v, removed %v", next.listeners, next.removed)
+	}
+
+	if future := tr.since(snapshot(2, listener("a", 2)), next.seq+1000); !future.reset {
+		t.Error("a sequence from the future did not reset")
+	}
+}
+
+func TestStatusSinceReportsRemovedFields(t *testing.T) {
+	tr := statusTrackerFor("delta-removed-test")
+	first := tr.since(map[string]interface{}{"connections": 1, "proxy": "socks5://p"}, 0)
+
+	next := tr.since(map[string]interface{}{"connections": 1}, first.seq)
+	if next.seq <= first.seq || len(next.fields) != 0 || !slices.Equal(next.gone, []string{"proxy"}) {
+		t.Fatalf("removed field not reported: %+v", next)
+	}
+	if again := tr.since(map[string]interface{}{"connections": 1}, next.seq); len(again.gone) != 0 {
+		t.Errorf("removal reported twice: %v", again.gone)
+	}
+
+	back := tr.since(map[string]interface{}{"connections": 1, "proxy": "socks5://q"}, next.seq)
+	if back.fields["proxy"] == nil || len(back.gone) != 0 {
+		t.Errorf("returning field: fields %v, removed %v", back.fields, back.gone)
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Before a transfer listener takes a file, directory or archive it checks
+// that the body fits in the free space of the download directory with
+// min_free_bytes to spare, and that the received files still on disk stay
+// within the quotas: quota_bytes for every peer together and
+// peer_quota_bytes for each one. A received file counts while the path the
+// history recorded for it exists, so deleting it gives the space back.
+// low_disk goes out whenever free space falls below low_disk_bytes, at
+// most once per lowDiskReportGap for each directory.
+const (
+	defaultLowDiskBytes = 1 << 30 // 1 GiB
+	lowDiskReportGap    = 10 * time.Minute
+)
+
+// StorageConfig guards the disk of receiving listeners
+type StorageConfig struct {
+	MinFreeBytes   int64 `json:"min_free_bytes,omitempty"`   // free space every transfer must leave behind
+	LowDiskBytes   int64 `json:"low_disk_bytes,omitempty"`   // threshold for low_disk, default 1 GiB, -1 for never
+	QuotaBytes     int64 `json:"quota_bytes,omitempty"`      // received files kept on disk, all peers together
+	PeerQuotaBytes int64 `json:"peer_quota_bytes,omitempty"` // received files kept on disk from any one peer
+}
+
+func (s StorageConfig) Validate() error {
+	if s.MinFreeBytes < 0 || s.QuotaBytes < 0 || s.PeerQuotaBytes < 0 || s.LowDiskBytes < -1 {
+		return catalogError(ErrInvalidArgument, "storage.limits_must_not_negative")
+	}
+	return nil
+}
+
+func (s StorageConfig) lowDisk() int64 {
+	if s.LowDiskBytes == 0 {
+		return defaultLowDiskBytes
+	}
+	return s.LowDiskBytes
+}
+
+// Reasons in StorageError and TransferAck.Storage
+const (
+	storageNoSpace   = "insufficient_space"
+	storageQuota     = "quota_exceeded"
+	storagePeerQuota = "peer_quota_exceeded"
+)
+
+// StorageError refuses a transfer the disk or a quota has no room for
+type StorageError struct {
+	Reason    string
+	Needed    int64 // bytes the transfer needs
+	Available int64 // bytes left under the limit that refused it
+	msg       string
+}
+
+func (e *StorageError) Error() string { return e.msg }
+
+// storageAck puts the details of a storage refusal into an ack
+func storageAck(ack *TransferAck, err error) {
+	var se *StorageError
+	if errors.As(err, &se) {
+		ack.Storage, ack.Needed, ack.Available = se.Reason, se.Needed, se.Available
+	}
+}
+
+// incomingSize is how many bytes a header will put on disk, as far as it
+// says; the files of an archive unpacked on arrival count twice
+func incomingSize(h TransferHeader) int64 {
+	switch {
+	case h.Manifest != nil:
+		_, size := h.Manifest.Totals()
+		return size
+	case h.Archive != "":
+		if h.Extract {
+			return 2 * h.Unpacked
+		}
+		return h.Unpacked
+	}
+	return h.Size
+}
+
+// existingDir is dir or the nearest parent that exists, since the
+// download directory is only created for the first file
+func existingDir(dir string) string {
+	for {
+		if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return dir
+		}
+		dir = parent
+	}
+}
+
+var (
+	lowDiskMu       sync.Mutex
+	lowDiskReported = make(map[string]time.Time)
+)
+
+// reportLowDisk emits low_disk for dir unless it went out recently
+func reportLowDisk(dir string, free uint64, threshold, needed int64) {
+	lowDiskMu.Lock()
+	if last, ok := lowDiskReported[dir]; ok && time.Since(last) < lowDiskReportGap {
+		lowDiskMu.Unlock()
+		return
+	}
+	lowDiskReported[dir] = time.Now()
+	lowDiskMu.Unlock()
+	logger.Warn("low disk space", "dir", dir, "free", free, "threshold", threshold)
+	emitEvent("low_disk", map[string]interface{}{
+		"dir":             dir,
+		"free_bytes":      free,
+		"threshold_bytes": threshold,
+		"needed_bytes":    needed,
+	})
+}
+
+// storedBytes adds up the received files still on disk, in all and from
+// peer, going by the transfer history
+func (s *HistoryStore) storedBytes(peer string) (total, fromPeer int64) {
+	s.mu.Lock()
+	entries := make([]HistoryEntry, 0, len(s.entries))
+	for _, e := range s.entries {
+		if e.Direction == "receive" && e.Result == "completed" && e.Path != "" {
+			entries = append(entries, e)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, e := range entries {
+		if _, err := os.Lstat(e.Path); err != nil {
+			continue
+		}
+		total += e.Bytes
+		if remoteHost(e.Peer) == peer {
+			fromPeer += e.Bytes
+		}
+	}
+	return total, fromPeer
+}
+
+// remoteHost strips the port from a remote address
+func remoteHost(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// checkStorage decides whether size more bytes from remote fit in dir
+func checkStorage(dir string, size int64, remote string) error {
+	cfg := config.Get().Storage
+	if size < 0 {
+		size = 0
+	}
+	free, err := diskFree(existingDir(dir))
+	if err != nil {
+		// Some file systems cannot say; the write will fail if it must
+		logger.Debug("free space unknown", "dir", dir, "error", err)
+	} else {
+		left := int64(free) - size
+		if left < cfg.MinFreeBytes {
+			reportLowDisk(dir, free, max(cfg.lowDisk(), cfg.MinFreeBytes), size)
+			return &StorageError{
+				Reason:    storageNoSpace,
+				Needed:    size + cfg.MinFreeBytes,
+				Available: int64(free),
+				msg:       fmt.Sprintf("not enough disk space: %d bytes needed, %d available", size+cfg.MinFreeBytes, free),
+			}
+		}
+		if threshold := cfg.lowDisk(); threshold >= 0 && left < threshold {
+			reportLowDisk(dir, free, threshold, size)
+		}
+	}
+
+	if cfg.QuotaBytes == 0 && cfg.PeerQuotaBytes == 0 {
+		return nil
+	}
+	total, fromPeer := history.storedBytes(remoteHost(remote))
+	if cfg.QuotaBytes > 0 && total+size > cfg.QuotaBytes {
+		return &StorageError{
+			Reason:    storageQuota,
+			Needed:    size,
+			Available: max(0, cfg.QuotaBytes-total),
+			msg:       fmt.Sprintf("storage quota exceeded: %d of %d bytes used", total, cfg.QuotaBytes),
+		}
+	}
+	if cfg.PeerQuotaBytes > 0 && fromPeer+size > cfg.PeerQuotaBytes {
+		return &StorageError{
+			Reason:    storagePeerQuota,
+			Needed:    size,
+			Available: max(0, cfg.PeerQuotaBytes-fromPeer),
+			msg:       fmt.Sprintf("storage quota for this peer exceeded: %d of %d bytes used", fromPeer, cfg.PeerQuotaBytes),
+		}
+	}
+	return nil
+}
+
+// storageAllowance is how much more a write of unknown size from one peer
+// may put on disk, fixed when the write starts
+type storageAllowance struct {
+	left   int64 // -1 when nothing limits the write
+	reason string
+}
+
+// allowStorage is the smallest of what the quotas have left for remote and
+// what dir can take while keeping min_free_bytes free
+func allowStorage(dir, remote string) storageAllowance {
+	cfg := config.Get().Storage
+	a := storageAllowance{left: -1}
+	limit := func(left int64, reason string) {
+		if left = max(0, left); a.left < 0 || left < a.left {
+			a.left, a.reason = left, reason
+		}
+	}
+	if free, err := diskFree(existingDir(dir)); err == nil {
+		limit(int64(free)-cfg.MinFreeBytes, storageNoSpace)
+	}
+	if cfg.QuotaBytes == 0 && cfg.PeerQuotaBytes == 0 {
+		return a
+	}
+	total, fromPeer := history.storedBytes(remoteHost(remote))
+	if cfg.QuotaBytes > 0 {
+		limit(cfg.QuotaBytes-total, storageQuota)
+	}
+	if cfg.PeerQuotaBytes > 0 {
+		limit(cfg.PeerQuotaBytes-fromPeer, storagePeerQuota)
+	}
+	return a
+}
+
+// check refuses a write once it has put more than the allowance on disk
+func (a storageAllowance) check(written int64) error {
+	if a.left < 0 || written <= a.left {
+		return nil
+	}
+	var msg string
+	switch a.reason {
+	case storageQuota:
+		msg = fmt.Sprintf("storage quota exceeded: only %d more bytes allowed", a.left)
+	case storagePeerQuota:
+		msg = fmt.Sprintf("storage quota for this peer exceeded: only %d more bytes allowed", a.left)
+	default:
+		msg = fmt.Sprintf("not enough disk space: only %d more bytes fit", a.left)
+	}
+	return &StorageError{Reason: a.reason, Needed: written, Available: a.left, msg: msg}
+}
+
+// storageReader passes a body of unknown size through until it crosses
+// its allowance, then fails with a StorageError
+type storageReader struct {
+	r     io.Reader
+	allow storageAllowance
+	read  int64
+}
+
+func (s *storageReader) Read(b []byte) (int, error) {
+	if s.allow.left >= 0 {
+		// One byte past the allowance is enough to know it was crossed
+		b = b[:min(int64(len(b)), s.allow.left-s.read+1)]
+	}
+	n, err := s.r.Read(b)
+	s.read += int64(n)
+	if serr := s.allow.check(s.read); serr != nil {
+		return n, serr
+	}
+	return n, err
+}
+
+// handleStorageStatus reports free space in the download directory and
+// how much of each quota received files take
+func handleStorageStatus(writer *Output) {
+	cfg := config.Get().Storage
+	dir := downloadDirFor("")
+	data := map[string]interface{}{
+		"dir":     dir,
+		"storage": cfg,
+	}
+	if free, err := diskFree(existingDir(dir)); err == nil {
+		data["free_bytes"] = free
+		data["low_disk"] = cfg.lowDisk() >= 0 && int64(free) < cfg.lowDisk()
+	} else {
+		data["free_error"] = err.Error()
+	}
+	total, _ := history.storedBytes("")
+	data["stored_bytes"] = total
+	writer.Encode(ProtocolResponse{Status: "ok", Data: data})
+}
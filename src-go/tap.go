@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+)
+
+// tap_connection mirrors what a connection reads and writes, for users
+// debugging custom protocols. Chunks are reported in tap_data events and
+// can also be written to a pcap file. The capture sits above encryption
+// and compression, so it shows the application's bytes; the pcap frames
+// them in synthesized IP and TCP (or UDP) headers with the connection's
+// real addresses, which Wireshark follows like a live capture.
+const (
+	defaultTapChunk = 4 << 10
+	maxTapChunk     = 64 << 10
+	defaultTapLimit = 16 << 20
+
+	linkTypeRaw   = 101 // pcap LINKTYPE_RAW: packets start at the IP header
+	pcapSnapLen   = 1 << 18
+	maxTapSegment = 65000
+)
+
+// Tap captures one connection's traffic
+type Tap struct {
+	conn     string
+	encoding string // "hex", "base64"
+	events   bool
+	chunk    int
+	limit    uint64 // bytes captured before the tap stops, 0 for no limit
+	started  time.Time
+
+	mu       sync.Mutex
+	captured uint64
+	pcapPath string
+	pcap     *bufio.Writer
+	file     *os.File
+	local    netip.AddrPort
+	remote   netip.AddrPort
+	udp      bool
+	seq      [2]uint32 // next sequence number sent by local, remote
+	stopped  bool
+}
+
+// capture records b, which the connection just moved in direction dir
+func (t *Tap) capture(c *Connection, dir string, b []byte) {
+	t.mu.Lock()
+	if t.stopped {
+		t.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	t.captured += uint64(len(b))
+	if t.pcap != nil {
+		t.writePacket(now, dir == "out", b)
+	}
+	limited := t.limit > 0 && t.captured >= t.limit
+	t.mu.Unlock()
+
+	if t.events {
+		data := b
+		if len(data) > t.chunk {
+			data = data[:t.chunk]
+		}
+		ev := map[string]interface{}{
+			"connection": t.conn,
+			"direction":  dir,
+			"time":       now.UTC().Format(time.RFC3339Nano),
+			"size":       len(b),
+			"encoding":   t.encoding,
+			"truncated":  len(data) < len(b),
+		}
+		if t.encoding == "hex" {
+			ev["data"] = hex.EncodeToString(data)
+		} else {
+			ev["data"] = base64.StdEncoding.EncodeToString(data)
+		}
+		emitEvent("tap_data", ev)
+	}
+	if limited && c.tap.CompareAndSwap(t, nil) {
+		t.stop("limit")
+	}
+}
+
+// stop ends the capture and flushes the pcap file
+func (t *Tap) stop(reason string) {
+	t.mu.Lock()
+	if t.stopped {
+		t.mu.Unlock()
+		return
+	}
+	t.stopped = true
+	var err error
+	if t.pcap != nil {
+		err = t.pcap.Flush()
+		if cerr := t.file.Close(); err == nil {
+			err = cerr
+		}
+	}
+	captured := t.captured
+	t.mu.Unlock()
+
+	stopped := map[string]interface{}{
+		"connection":  t.conn,
+		"reason":      reason,
+		"bytes":       captured,
+		"duration_ms": time.Since(t.started).Milliseconds(),
+	}
+	if t.pcapPath != "" {
+		stopped["pcap"] = t.pcapPath
+	}
+	if err != nil {
+		logger.Warn("failed to write pcap", "path", t.pcapPath, "error", err)
+		stopped["error"] = err.Error()
+	}
+	logger.Info("tap stopped", "connection", t.conn, "reason", reason, "bytes", captured)
+	emitEvent("tap_stopped", stopped)
+}
+
+// addrPort reads a socket address, unmapping IPv4-in-IPv6
+func addrPort(a net.Addr) netip.AddrPort {
+	ap, _ := netip.ParseAddrPort(a.String())
+	return netip.AddrPortFrom(ap.Addr().WithZone("").Unmap(), ap.Port())
+}
+
+// openPcap starts the pcap file; the caller holds t.mu or has not shared t
+func (t *Tap) openPcap(path string, c *Connection) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	t.pcapPath, t.file, t.pcap = path, f, bufio.NewWriter(f)
+	t.local, t.remote = addrPort(c.LocalAddr()), addrPort(c.RemoteAddr())
+	t.udp = c.Network == "udp"
+	t.seq = [2]uint32{1, 1}
+
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], pcapSnapLen)
+	binary.LittleEndian.PutUint32(header[20:], linkTypeRaw)
+	_, err = t.pcap.Write(header)
+	return err
+}
+
+// writePacket frames b as one or more IP packets; the caller holds t.mu
+func (t *Tap) writePacket(ts time.Time, out bool, b []byte) {
+	src, dst, side := t.remote, t.local, 1
+	if out {
+		src, dst, side = t.local, t.remote, 0
+	}
+	for len(b) > 0 {
+		seg := b[:min(len(b), maxTapSegment)]
+		b = b[len(seg):]
+
+		var l4 []byte
+		if t.udp {
+			l4 = make([]byte, 8, 8+len(seg))
+			binary.BigEndian.PutUint16(l4[0:], src.Port())
+			binary.BigEndian.PutUint16(l4[2:], dst.Port())
+			binary.BigEndian.PutUint16(l4[4:], uint16(8+len(seg)))
+		} else {
+			l4 = make([]byte, 20, 20+len(seg))
+			binary.BigEndian.PutUint16(l4[0:], src.Port())
+			binary.BigEndian.PutUint16(l4[2:], dst.Port())
+			binary.BigEndian.PutUint32(l4[4:], t.seq[side])
+			binary.BigEndian.PutUint32(l4[8:], t.seq[1-side])
+			l4[12] = 5 << 4 // data offset, no options
+			l4[13] = 0x18   // PSH, ACK
+			binary.BigEndian.PutUint16(l4[14:], 65535)
+			t.seq[side] += uint32(len(seg))
+		}
+		packet := ipHeader(src.Addr(), dst.Addr(), t.udp, len(l4)+len(seg))
+		packet = append(append(packet, l4...), seg...)
+
+		record := make([]byte, 16)
+		binary.LittleEndian.PutUint32(record[0:], uint32(ts.Unix()))
+		binary.LittleEndian.PutUint32(record[4:], uint32(ts.Nanosecond()/1000))
+		binary.LittleEndian.PutUint32(record[8:], uint32(len(packet)))
+		binary.LittleEndian.PutUint32(record[12:], uint32(len(packet)))
+		t.pcap.Write(record)
+		t.pcap.Write(packet)
+	}
+}
+
+// ipHeader builds an IPv4 header, or IPv6 unless both ends are IPv4
+func ipHeader(src, dst netip.Addr, udp bool, payload int) []byte {
+	proto := byte(6)
+	if udp {
+		proto = 17
+	}
+	if src.Is4() && dst.Is4() {
+		h := make([]byte, 20)
+		h[0] = 0x45
+		binary.BigEndian.PutUint16(h[2:], uint16(20+payload))
+		h[6] = 0x40 // don't fragment
+		h[8], h[9] = 64, proto
+		s, d := src.As4(), dst.As4()
+		copy(h[12:], s[:])
+		copy(h[16:], d[:])
+		var sum uint32
+		for i := 0; i < 20; i += 2 {
+			sum += uint32(binary.BigEndian.Uint16(h[i:]))
+		}
+		for sum > 0xffff {
+			sum = sum>>16 + sum&0xffff
+		}
+		binary.BigEndian.PutUint16(h[10:], ^uint16(sum))
+		return h
+	}
+	h := make([]byte, 40)
+	h[0] = 0x60
+	binary.BigEndian.PutUint16(h[4:], uint16(payload))
+	h[6], h[7] = proto, 64
+	s, d := src.As16(), dst.As16()
+	copy(h[8:], s[:])
+	copy(h[24:], d[:])
+	return h
+}
+
+type TapConnectionPayload struct {
+	ID       string `json:"id"`
+	Encoding string `json:"encoding"`  // "base64" (default) or "hex"
+	Events   *bool  `json:"events"`    // emit tap_data events, default true
+	MaxChunk int    `json:"max_chunk"` // bytes of data per event, default 4096; longer chunks are truncated
+	MaxBytes int64  `json:"max_bytes"` // stop after capturing this much, default 16 MiB, -1 for no limit
+	Pcap     string `json:"pcap"`      // also write a pcap file at this path
+}
+
+// handleTapConnection starts capturing a connection's traffic
+func handleTapConnection(payload json.RawMessage, writer *Output) {
+	var p TapConnectionPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		sendInvalidPayload(writer, "tap_connection")
+		return
+	}
+	switch p.Encoding {
+	case "":
+		p.Encoding = "base64"
+	case "base64", "hex":
+	default:
+		sendErrorCode(writer, ErrUnsupported, message("common.unsupported_encoding", "encoding", p.Encoding), nil)
+		return
+	}
+	if p.MaxChunk == 0 {
+		p.MaxChunk = defaultTapChunk
+	}
+	if p.MaxChunk < 0 || p.MaxChunk > maxTapChunk {
+		sendErrorCode(writer, ErrInvalidArgument, message("tap.max_chunk_must_between", "max_tap_chunk", maxTapChunk), nil)
+		return
+	}
+	t := &Tap{conn: p.ID, encoding: p.Encoding, events: p.Events == nil || *p.Events, chunk: p.MaxChunk, started: time.Now()}
+	switch {
+	case p.MaxBytes == 0:
+		t.limit = defaultTapLimit
+	case p.MaxBytes > 0:
+		t.limit = uint64(p.MaxBytes)
+	}
+	if !t.events && p.Pcap == "" {
+		sendErrorCode(writer, ErrInvalidArgument, message("tap.connection_requires_events_pcap"), nil)
+		return
+	}
+	c, ok := lookupConn(p.ID, writer)
+	if !ok {
+		sendErrorCode(writer, ErrNotFound, message("common.connection_not_found"), nil)
+		return
+	}
+	if p.Pcap != "" {
+		if err := t.openPcap(p.Pcap, c); err != nil {
+			sendError(writer, message("common.failed_create", "dir", p.Pcap, "error", err))
+			return
+		}
+	}
+	if !c.tap.CompareAndSwap(nil, t) {
+		if t.file != nil {
+			t.file.Close()
+			os.Remove(p.Pcap)
+		}
+		sendErrorCode(writer, ErrInvalidState, message("tap.connection_already_tapped"), nil)
+		return
+	}
+	logger.Info("tap started", "connection", p.ID, "pcap", p.Pcap)
+	writer.Encode(okResponse(message("tap.started"),
+		map[string]interface{}{"connection": p.ID, "encoding": t.encoding, "events": t.events, "pcap": p.Pcap, "max_bytes": t.limit}))
+}
+
+// handleUntapConnection stops a capture; tap_stopped reports what it got
+func handleUntapConnection(payload json.RawMessage, writer *Output) {
+	var p DisconnectPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		sendInvalidPayload(writer, "untap_connection")
+		return
+	}
+	c, ok := lookupConn(p.ID, writer)
+	if !ok {
+		sendErrorCode(writer, ErrNotFound, message("common.connection_not_found"), nil)
+		return
+	}
+	t := c.tap.Swap(nil)
+	if t == nil {
+		sendErrorCode(writer, ErrInvalidState, message("tap.connection_not_tapped"), nil)
+		return
+	}
+	t.stop("stopped")
+	writer.Encode(okResponse(message("tap.stopped"), nil))
+}
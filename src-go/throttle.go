@@ -0,0 +1,288 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Listeners can screen connections by source IP the moment they are
+// accepted, before the connection limit, handshakes or auth see them.
+// Allow and deny lists take CIDR blocks or single addresses; deny wins,
+// and a non-empty allow list refuses everyone it does not name. A token
+// bucket per source IP caps how fast one host may open connections.
+// Denied peers are dropped without a word, throttled ones are told to
+// slow down. Events go out once per episode rather than per connection,
+// so a flood does not become a flood of events.
+const (
+	filterSweepEvery = time.Minute
+	deniedReportGap  = time.Minute // between connection_denied events for one host
+)
+
+const errThrottled = "Too many connections from this address"
+
+// AcceptFilterOptions are the start_server fields screening peers
+type AcceptFilterOptions struct {
+	PerIPRate  float64  `json:"per_ip_rate"`  // new connections per second from one IP, 0 for no cap
+	PerIPBurst int      `json:"per_ip_burst"` // connections one IP may open at once, default the rate rounded up
+	Allow      []string `json:"allow"`        // only these CIDR blocks or addresses may connect
+	Deny       []string `json:"deny"`         // these may not, whatever allow says
+}
+
+// AcceptFilter screens inbound connections of one listener
+type AcceptFilter struct {
+	allow, deny []netip.Prefix
+	rate, burst float64
+
+	mu       sync.Mutex
+	buckets  map[netip.Addr]*ipBucket
+	reported map[netip.Addr]time.Time // last connection_denied per host
+	swept    time.Time
+
+	Denied    atomic.Uint64
+	Throttled atomic.Uint64
+}
+
+// ipBucket is one source IP's connection allowance
+type ipBucket struct {
+	tokens   float64
+	last     time.Time
+	reported bool // throttled since it last got in, and the event is out
+}
+
+// Verdicts of AcceptFilter.check
+const (
+	filterAllow    = ""
+	filterDenied   = "denied"
+	filterNotAllow = "not_allowed"
+	filterThrottle = "throttled"
+)
+
+// newAcceptFilter builds a filter, or returns nil when o screens nobody
+func newAcceptFilter(o AcceptFilterOptions) (*AcceptFilter, error) {
+	if o.PerIPRate < 0 || o.PerIPBurst < 0 {
+		return nil, catalogError(ErrInvalidArgument, "throttle.per_ip_rate_per")
+	}
+	if o.PerIPBurst > 0 && o.PerIPRate == 0 {
+		return nil, catalogError(ErrInvalidArgument, "throttle.per_ip_burst_requires")
+	}
+	f := &AcceptFilter{rate: o.PerIPRate, burst: float64(o.PerIPBurst)}
+	if f.rate > 0 && f.burst == 0 {
+		f.burst = math.Ceil(f.rate)
+	}
+	var err error
+	if f.allow, err = parsePrefixes("allow", o.Allow); err != nil {
+		return nil, err
+	}
+	if f.deny, err = parsePrefixes("deny", o.Deny); err != nil {
+		return nil, err
+	}
+	if f.rate == 0 && len(f.allow) == 0 && len(f.deny) == 0 {
+		return nil, nil
+	}
+	f.buckets = make(map[netip.Addr]*ipBucket)
+	f.reported = make(map[netip.Addr]time.Time)
+	return f, nil
+}
+
+// parsePrefixes reads CIDR blocks, taking a bare address as a block of one
+func parsePrefixes(field string, list []string) ([]netip.Prefix, error) {
+	var out []netip.Prefix
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if !strings.Contains(s, "/") {
+			ip, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s entry %q", field, s)
+			}
+			ip = ip.Unmap()
+			out = append(out, netip.PrefixFrom(ip, ip.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s entry %q", field, s)
+		}
+		if prefix.Addr().Is4In6() {
+			if prefix.Bits() < 96 {
+				return nil, fmt.Errorf("invalid %s entry %q", field, s)
+			}
+			prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+		}
+		out = append(out, prefix.Masked())
+	}
+	return out, nil
+}
+
+func matchPrefixes(list []netip.Prefix, ip netip.Addr) bool {
+	for _, p := range list {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// check judges a connection from ip at now; report is true when the
+// verdict starts an episode worth an event
+func (f *AcceptFilter) check(ip netip.Addr, now time.Time) (verdict string, report bool) {
+	ip = ip.Unmap().WithZone("")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if now.Sub(f.swept) >= filterSweepEvery {
+		f.sweepLocked(now)
+	}
+
+	switch {
+	case matchPrefixes(f.deny, ip):
+		verdict = filterDenied
+	case len(f.allow) > 0 && !matchPrefixes(f.allow, ip):
+		verdict = filterNotAllow
+	}
+	if verdict != filterAllow {
+		f.Denied.Add(1)
+		if last, ok := f.reported[ip]; !ok || now.Sub(last) >= deniedReportGap {
+			f.reported[ip] = now
+			report = true
+		}
+		return verdict, report
+	}
+
+	if f.rate == 0 {
+		return filterAllow, false
+	}
+	b := f.buckets[ip]
+	if b == nil {
+		b = &ipBucket{tokens: f.burst, last: now}
+		f.buckets[ip] = b
+	}
+	b.tokens = min(f.burst, b.tokens+now.Sub(b.last).Seconds()*f.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		b.reported = false
+		return filterAllow, false
+	}
+	f.Throttled.Add(1)
+	report = !b.reported
+	b.reported = true
+	return filterThrottle, report
+}
+
+// sweepLocked forgets hosts whose bucket has refilled and whose denial
+// was reported long enough ago, so a scan of many addresses does not
+// leave them all behind
+func (f *AcceptFilter) sweepLocked(now time.Time) {
+	f.swept = now
+	if f.rate > 0 {
+		refill := time.Duration(f.burst / f.rate * float64(time.Second))
+		for ip, b := range f.buckets {
+			if now.Sub(b.last) >= refill {
+				delete(f.buckets, ip)
+			}
+		}
+	}
+	for ip, last := range f.reported {
+		if now.Sub(last) >= deniedReportGap {
+			delete(f.reported, ip)
+		}
+	}
+}
+
+// Info describes the filter for status; nil filters are fine
+func (f *AcceptFilter) Info() map[string]interface{} {
+	if f == nil {
+		return nil
+	}
+	prefixes := func(list []netip.Prefix) []string {
+		out := make([]string, len(list))
+		for i, p := range list {
+			out[i] = p.String()
+		}
+		return out
+	}
+	f.mu.Lock()
+	tracked := len(f.buckets)
+	f.mu.Unlock()
+	return map[string]interface{}{
+		"per_ip_rate":  f.rate,
+		"per_ip_burst": f.burst,
+		"allow":        prefixes(f.allow),
+		"deny":         prefixes(f.deny),
+		"denied":       f.Denied.Load(),
+		"throttled":    f.Throttled.Load(),
+		"tracked_ips":  tracked,
+	}
+}
+
+// screenPeer runs l's filter on a connection from remote. It emits the
+// block event when one is due and returns the verdict; listeners without
+// a filter, and remotes that are not IPs, always pass.
+func screenPeer(l *Listener, remote net.Addr) string {
+	if l.Filter == nil {
+		return filterAllow
+	}
+	ap, err := netip.ParseAddrPort(remote.String())
+	if err != nil {
+		return filterAllow
+	}
+	verdict, report := l.Filter.check(ap.Addr(), time.Now())
+	if verdict == filterAllow {
+		return verdict
+	}
+	l.Refused.Add(1)
+	if !report {
+		return verdict
+	}
+	ip := ap.Addr().Unmap().String()
+	if verdict == filterThrottle {
+		logger.Warn("peer throttled", "listener", l.Addr, "remote", ip, "per_ip_rate", l.Filter.rate)
+		emitEvent("connection_throttled", map[string]interface{}{
+			"listener":     l.Addr,
+			"listener_id":  l.ID,
+			"remote":       ip,
+			"per_ip_rate":  l.Filter.rate,
+			"per_ip_burst": l.Filter.burst,
+		})
+		return verdict
+	}
+	logger.Warn("peer denied", "listener", l.Addr, "remote", ip, "reason", verdict)
+	emitEvent("connection_denied", map[string]interface{}{
+		"listener":    l.Addr,
+		"listener_id": l.ID,
+		"remote":      ip,
+		"reason":      verdict, // "denied", "not_allowed"
+	})
+	return verdict
+}
+
+// screenRequest is screenPeer for listeners served by net/http, which
+// answers the request itself; it reports whether the request may go on
+func screenRequest(l *Listener, w http.ResponseWriter, r *http.Request) bool {
+	addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if err != nil {
+		return true
+	}
+	switch screenPeer(l, addr) {
+	case filterAllow:
+		return true
+	case filterThrottle:
+		writeJSON(w, http.StatusTooManyRequests, ProtocolResponse{Status: "error", Message: errThrottled})
+	default:
+		// Hijacking drops the connection without an answer, as at accept
+		if hj, ok := w.(http.Hijacker); ok {
+			if conn, _, err := hj.Hijack(); err == nil {
+				conn.Close()
+				return false
+			}
+		}
+		w.WriteHeader(http.StatusForbidden)
+	}
+	return false
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestAcceptFilterLists(t *testing.T) {
+	f, err := newAcceptFilter(AcceptFilterOptions{
+		Allow: []string{"10.0.0.0/8", "2001:db8::/32", "::ffff:192.168.1.0/120"},
+		Deny:  []string{"10.1.0.0/16", "10.2.3.4"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{"10.0.0.1", filterAllow},
+		{"::ffff:10.0.0.1", filterAllow},
+		{"10.1.2.3", filterDenied},
+		{"10.2.3.4", filterDenied},
+		{"10.2.3.5", filterAllow},
+		{"192.168.1.7", filterAllow},
+		{"192.168.2.7", filterNotAllow},
+		{"2001:db8::1", filterAllow},
+		{"fe80::1%eth0", filterNotAllow},
+		{"8.8.8.8", filterNotAllow},
+	}
+	for _, tt := range tests {
+		if got, _ := f.check(netip.MustParseAddr(tt.ip), now); got != tt.want {
+			t.Errorf("%s: verdict %q, want %q", tt.ip, got, tt.want)
+		}
+	}
+	if _, report := f.check(netip.MustParseAddr("8.8.8.8"), now.Add(time.Second)); report {
+		t.Error("second denial within a minute was reported")
+	}
+	if _, report := f.check(netip.MustParseAddr("8.8.8.8"), now.Add(deniedReportGap)); !report {
+		t.Error("denial after the gap was not reported")
+	}
+}
+
+func TestAcceptFilterRate(t *testing.T) {
+	f, err := newAcceptFilter(AcceptFilterOptions{PerIPRate: 2, PerIPBurst: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip, other := netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.2")
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if v, _ := f.check(ip, now); v != filterAllow {
+			t.Fatalf("connection %d within the burst: %q", i+1, v)
+		}
+	}
+	if v, report := f.check(ip, now); v != filterThrottle || !report {
+		t.Fatalf("over the burst: %q, report %v", v, report)
+	}
+	if _, report := f.check(ip, now); report {
+		t.Error("throttle reported twice in one episode")
+	}
+	if v, _ := f.check(other, now); v != filterAllow {
+		t.Errorf("other host: %q", v)
+	}
+	// Half a second refills one token at two per second
+	if v, _ := f.check(ip, now.Add(500*time.Millisecond)); v != filterAllow {
+		t.Errorf("after refill: %q", v)
+	}
+	if v, report := f.check(ip, now.Add(500*time.Millisecond)); v != filterThrottle || !report {
+		t.Errorf("new episode: %q, report %v", v, report)
+	}
+}
+
+func TestAcceptFilterRejects(t *testing.T) {
+	for _, o := range []AcceptFilterOptions{
+		{PerIPRate: -1},
+		{PerIPBurst: 5},
+		{Allow: []string{"10.0.0.0/33"}},
+		{Deny: []string{"example.com"}},
+		{Deny: []string{"::ffff:0:0/64"}},
+	} {
+		if _, err := newAcceptFilter(o); err == nil {
+			t.Errorf("%+v accepted", o)
+		}
+	}
+	if f, err := newAcceptFilter(AcceptFilterOptions{}); f != nil || err != nil {
+		t.Errorf("empty options: %v, %v", f, err)
+	}
+}
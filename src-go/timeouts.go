@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"time"
+)
+
+// Defaults applied when start_server or connect leave a timeout unset
+const (
+	defaultWriteTimeout = 30 * time.Second
+	defaultIdleTimeout  = 5 * time.Minute
+	defaultKeepalive    = 30 * time.Second
+)
+
+// TimeoutOptions is the JSON form of Timeouts. Omitted fields keep their
+// default, 0 disables a timeout and -1 disables TCP keepalive.
+type TimeoutOptions struct {
+	ReadTimeoutMs  *int `json:"read_timeout_ms"`
+	WriteTimeoutMs *int `json:"write_timeout_ms"`
+	IdleTimeoutMs  *int `json:"idle_timeout_ms"`
+	KeepaliveMs    *int `json:"keepalive_ms"`
+}
+
+// Timeouts bounds how long a connection may block or stay quiet
+type Timeouts struct {
+	Read      time.Duration `json:"read"`      // longest wait for the next read
+	Write     time.Duration `json:"write"`     // longest a single write may block
+	Idle      time.Duration `json:"idle"`      // close after this long without traffic
+	Keepalive time.Duration `json:"keepalive"` // TCP keepalive period, negative disables
+}
+
+// Inbound connections are reaped once idle; outbound ones belong to the
+// app, which decides when to disconnect, so they rely on keepalive alone
+var (
+	defaultTimeouts = Timeouts{
+		Write:     defaultWriteTimeout,
+		Idle:      defaultIdleTimeout,
+		Keepalive: defaultKeepalive,
+	}
+	defaultOutboundTimeouts = Timeouts{
+		Write:     defaultWriteTimeout,
+		Keepalive: defaultKeepalive,
+	}
+)
+
+// Apply overlays the fields set in opts on top of t
+func (opts TimeoutOptions) Apply(t Timeouts) Timeouts {
+	if opts.ReadTimeoutMs != nil {
+		t.Read = time.Duration(*opts.ReadTimeoutMs) * time.Millisecond
+	}
+	if opts.WriteTimeoutMs != nil {
+		t.Write = time.Duration(*opts.WriteTimeoutMs) * time.Millisecond
+	}
+	if opts.IdleTimeoutMs != nil {
+		t.Idle = time.Duration(*opts.IdleTimeoutMs) * time.Millisecond
+	}
+	if opts.KeepaliveMs != nil {
+		t.Keepalive = time.Duration(*opts.KeepaliveMs) * time.Millisecond
+	}
+	return t
+}
+
+// readWindow is how long the next read may wait; the shorter of the read
+// and idle timeouts, or zero when neither is set
+func (t Timeouts) readWindow() time.Duration {
+	switch {
+	case t.Read > 0 && t.Idle > 0:
+		return min(t.Read, t.Idle)
+	case t.Read > 0:
+		return t.Read
+	default:
+		return t.Idle
+	}
+}
+
+// MarshalJSON reports durations in milliseconds like the options that set them
+func (t Timeouts) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]int64{
+		"read_timeout_ms":  t.Read.Milliseconds(),
+		"write_timeout_ms": t.Write.Milliseconds(),
+		"idle_timeout_ms":  t.Idle.Milliseconds(),
+		"keepalive_ms":     t.Keepalive.Milliseconds(),
+	})
+}
+
+// socketOf unwraps the encryption and compression layers around a socket
+func socketOf(conn net.Conn) net.Conn {
+	for {
+		switch w := conn.(type) {
+		case *secureConn:
+			conn = w.Conn
+		case *compressedConn:
+			conn = w.Conn
+		case *tls.Conn:
+			conn = w.NetConn()
+		default:
+			return conn
+		}
+	}
+}
+
+// applyKeepalive configures TCP keepalive on the socket below any
+// wrappers; non-TCP connections are left alone
+func applyKeepalive(conn net.Conn, period time.Duration) {
+	tcp, ok := socketOf(conn).(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if period < 0 || power.paused() {
+		tcp.SetKeepAlive(false)
+		return
+	}
+	tcp.SetKeepAliveConfig(net.KeepAliveConfig{Enable: true, Idle: period, Interval: period})
+}
+
+// isTimeout reports whether err came from a read or write deadline
+func isTimeout(err error) bool {
+	return errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+type SetConnectionTimeoutsPayload struct {
+	ID string `json:"id"`
+	TimeoutOptions
+}
+
+func handleSetConnectionTimeouts(payload json.RawMessage, writer *Output) {
+	var p SetConnectionTimeoutsPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		sendInvalidPayload(writer, "set_connection_timeouts")
+		return
+	}
+
+	c, exists := lookupConn(p.ID, writer)
+	if !exists {
+		sendErrorCode(writer, ErrNotFound, message("common.connection_not_found"), nil)
+		return
+	}
+
+	t := p.TimeoutOptions.Apply(c.Timeouts())
+	c.SetTimeouts(t)
+
+	writer.Encode(okResponse(message("timeouts.updated", "id", p.ID), map[string]interface{}{"id": p.ID, "timeouts": t}))
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// TCP listeners can serve TLS with a certificate and key from disk, such
+// as the ones certbot keeps renewed. Handshakes pick the certificate up
+// through GetCertificate, so reload_certs, or a change to the files when
+// watch is set, swaps it for new connections while open ones carry on
+// and the socket is never rebound. A reload that fails keeps the
+// certificate in use.
+const (
+	certReloadDelay     = time.Second // renewals write the chain and key one after the other
+	tlsHandshakeTimeout = 10 * time.Second
+)
+
+// TLSOptions serves a listener over TLS
+type TLSOptions struct {
+	CertFile string `json:"cert_file"` // PEM chain, leaf first
+	KeyFile  string `json:"key_file"`  // PEM private key
+	Watch    bool   `json:"watch"`     // reload when either file changes
+}
+
+func (o *TLSOptions) Validate() error {
+	if o == nil {
+		return nil
+	}
+	if o.CertFile == "" || o.KeyFile == "" {
+		return catalogError(ErrInvalidArgument, "tlscerts.tls_requires_cert_file")
+	}
+	return nil
+}
+
+// certStore holds the certificate a listener presents
+type certStore struct {
+	addr string
+	opts TLSOptions
+
+	cert    atomic.Pointer[tls.Certificate]
+	mu      sync.Mutex
+	loaded  time.Time
+	reloads int
+	watcher *fsnotify.Watcher
+}
+
+// newCertStore loads the certificate; start watches it once the
+// listener's address is known
+func newCertStore(opts TLSOptions) (*certStore, error) {
+	s := &certStore{opts: opts}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// start names the listener in logs and events and watches the files if
+// asked to
+func (s *certStore) start(addr string) error {
+	s.addr = addr
+	if !s.opts.Watch {
+		return nil
+	}
+	return s.watch()
+}
+
+// load reads the files and makes them the certificate in use
+func (s *certStore) load() error {
+	cert, err := tls.LoadX509KeyPair(s.opts.CertFile, s.opts.KeyFile)
+	if err != nil {
+		return err
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return err
+		}
+	}
+	s.cert.Store(&cert)
+	s.mu.Lock()
+	s.loaded = time.Now()
+	s.mu.Unlock()
+	return nil
+}
+
+// config is the TLS config handshakes on the listener use
+func (s *certStore) config() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return s.cert.Load(), nil
+		},
+	}
+}
+
+// Info describes the certificate in use
+func (s *certStore) Info() map[string]interface{} {
+	leaf := s.cert.Load().Leaf
+	sum := sha256.Sum256(leaf.Raw)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return map[string]interface{}{
+		"cert_file":   s.opts.CertFile,
+		"key_file":    s.opts.KeyFile,
+		"watch":       s.opts.Watch,
+		"subject":     leaf.Subject.CommonName,
+		"dns_names":   leaf.DNSNames,
+		"not_before":  leaf.NotBefore,
+		"not_after":   leaf.NotAfter,
+		"fingerprint": hex.EncodeToString(sum[:]),
+		"loaded_at":   s.loaded,
+		"reloads":     s.reloads,
+	}
+}
+
+// reload loads the files again and reports the outcome in an event;
+// trigger says what asked for it
+func (s *certStore) reload(trigger string) error {
+	old := s.cert.Load()
+	if err := s.load(); err != nil {
+		logger.Warn("failed to reload certificate", "addr", s.addr, "error", err)
+		emitEvent("certs_reload_failed", map[string]interface{}{"addr": s.addr, "trigger": trigger, "error": err.Error()})
+		return err
+	}
+	changed := !old.Leaf.Equal(s.cert.Load().Leaf)
+	s.mu.Lock()
+	if changed {
+		s.reloads++
+	}
+	s.mu.Unlock()
+
+	info := s.Info()
+	info["addr"], info["trigger"], info["changed"] = s.addr, trigger, changed
+	logger.Info("certificate reloaded", "addr", s.addr, "trigger", trigger, "changed", changed, "not_after", info["not_after"])
+	emitEvent("certs_reloaded", info)
+	return nil
+}
+
+// watch reloads shortly after the certificate or key changes. It watches
+// their directories, since renewals usually replace the files or the
+// symlinks pointing at them rather than rewriting them in place.
+func (s *certStore) watch() error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	names := map[string]bool{filepath.Clean(s.opts.CertFile): true, filepath.Clean(s.opts.KeyFile): true}
+	for _, dir := range []string{filepath.Dir(s.opts.CertFile), filepath.Dir(s.opts.KeyFile)} {
+		if err := w.Add(dir); err != nil {
+			w.Close()
+			return fmt.Errorf("watch %s: %w", dir, err)
+		}
+	}
+	s.watcher = w
+
+	go func() {
+		var timer *time.Timer
+		for {
+			select {
+			case ev, ok := <-w.Events:
+				if !ok {
+					if timer != nil {
+						timer.Stop()
+					}
+					return
+				}
+				if !names[filepath.Clean(ev.Name)] {
+					continue
+				}
+				if timer == nil {
+					timer = time.AfterFunc(certReloadDelay, func() { s.reload("watch") })
+				} else {
+					timer.Reset(certReloadDelay)
+				}
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				logger.Warn("certificate watch error", "addr", s.addr, "error", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// stop ends watching; nil stores are fine
+func (s *certStore) stop() {
+	if s != nil && s.watcher != nil {
+		s.watcher.Close()
+	}
+}
+
+// tlsListener serves TLS on ln with the store's certificate. Accept does
+// not handshake; handshakeTLS does, on the connection's own goroutine.
+func tlsListener(ln net.Listener, s *certStore) net.Listener {
+	return tls.NewListener(ln, s.config())
+}
+
+// handshakeTLS completes the TLS handshake on c, if it is TLS, within
+// tlsHandshakeTimeout, so a client that connects and says nothing cannot
+// hold its goroutine either
+func handshakeTLS(c *Connection) error {
+	tc, ok := c.Conn().(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	tc.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	if err := tc.Handshake(); err != nil {
+		return err
+	}
+	return tc.SetDeadline(time.Time{})
+}
+
+type ReloadCertsPayload struct {
+	ListenerID string `json:"listener_id"` // listener to reload
+	Addr       string `json:"addr"`        // or every listener on an address; default every TLS listener
+}
+
+// handleReloadCerts reloads listener certificates from disk
+func handleReloadCerts(payload json.RawMessage, writer *Output) {
+	var p ReloadCertsPayload
+	if len(payload) > 0 && string(payload) != "null" {
+		if err := json.Unmarshal(payload, &p); err != nil {
+			sendInvalidPayload(writer, "reload_certs")
+			return
+		}
+	}
+
+	state.Mutex.Lock()
+	var stores []*certStore
+	exists := false
+	for id, l := range state.Listeners {
+		if (p.Addr != "" && p.Addr != l.Addr) || (p.ListenerID != "" && p.ListenerID != id) {
+			continue
+		}
+		exists = true
+		if l.TLS != nil {
+			stores = append(stores, l.TLS)
+		}
+	}
+	state.Mutex.Unlock()
+
+	if (p.Addr != "" || p.ListenerID != "") && len(stores) == 0 {
+		if exists {
+			sendErrorCode(writer, ErrInvalidState, message("tlscerts.listener_does_not_serve"),
+				map[string]interface{}{"addr": p.Addr, "listener_id": p.ListenerID})
+		} else {
+			sendErrorCode(writer, ErrNotFound, message("common.server_not_found"), nil)
+		}
+		return
+	}
+	sort.Slice(stores, func(i, j int) bool { return stores[i].addr < stores[j].addr })
+
+	results := make([]map[string]interface{}, 0, len(stores))
+	failed := 0
+	for _, s := range stores {
+		if err := s.reload("command"); err != nil {
+			failed++
+			results = append(results, map[string]interface{}{"addr": s.addr, "error": err.Error()})
+			continue
+		}
+		info := s.Info()
+		info["addr"] = s.addr
+		results = append(results, info)
+	}
+	data := map[string]interface{}{"listeners": results}
+	if failed > 0 && failed == len(stores) {
+		sendErrorCode(writer, ErrFailed, message("tlscerts.failed_reload_certificates"), data)
+		return
+	}
+	writer.Encode(okResponse(message("tlscerts.reloaded_certificates", "value", len(stores)-failed, "stores", len(stores)), data))
+}
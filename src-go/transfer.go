@@ -0,0 +1,1019 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// progressInterval is how often transfer_progress events are emitted
+const progressInterval = 500 * time.Millisecond
+
+// transferBufferSize is the copy buffer used for file bodies that cannot
+// go with sendfile
+const transferBufferSize = 256 << 10
+
+// TransferHeader is the line a sender writes before each file on a transfer
+// connection, followed by exactly Size bytes of file content. A header
+// carrying a Manifest opens a directory transfer instead and has no body.
+type TransferHeader struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+
+	Manifest *Manifest `json:"manifest,omitempty"`
+	Conflict string    `json:"conflict,omitempty"` // policy for the whole directory transfer
+
+	Batch  string `json:"batch,omitempty"` // directory transfer this file belongs to
+	Path   string `json:"path,omitempty"`  // slash-separated path inside the directory
+	SHA256 string `json:"sha256,omitempty"`
+
+	Key    string `json:"key,omitempty"`    // identifies the file across resume attempts
+	Resume bool   `json:"resume,omitempty"` // ask the receiver where to continue from
+
+	// Session is the send's token on every attempt, so a resume from a new
+	// address continues the transfer the receiver already accepted, see
+	// transfersession.go
+	Session string `json:"session,omitempty"`
+
+	// Compression proposes an algorithm for the body. The receiver answers
+	// before the body is sent, except for directory files, which use what
+	// the manifest already agreed on.
+	Compression string `json:"compression,omitempty"`
+
+	// Offer asks the receiver to answer before anything else happens, so
+	// drop receivers can let the user decide
+	Offer bool   `json:"offer,omitempty"`
+	From  string `json:"from,omitempty"` // sender's name, shown with the offer
+
+	Verify bool `json:"verify,omitempty"` // a SHA-256 trailer line follows the body
+
+	// Pausable offers a framed body either side can pause; the receiver
+	// answers before the body when it agrees
+	Pausable bool `json:"pausable,omitempty"`
+
+	// ChunkChecksums asks for a pausable body of checked frames, each
+	// acknowledged or asked for again, see chunkcheck.go
+	ChunkChecksums bool `json:"chunk_checksums,omitempty"`
+
+	// Streams announces a parallel transfer whose body arrives in chunks
+	// of ChunkSize on other connections. Each chunk has its own header
+	// naming the transfer in Parallel, with Size bytes at Offset.
+	Streams   int    `json:"streams,omitempty"`
+	ChunkSize int64  `json:"chunk_size,omitempty"`
+	Parallel  string `json:"parallel,omitempty"`
+	Offset    int64  `json:"offset,omitempty"`
+
+	// Archive announces a body packed on the fly in this format. Size is
+	// then -1 and the body comes in length-prefixed chunks, see send_archive.
+	Archive  string `json:"archive,omitempty"`
+	Extract  bool   `json:"extract,omitempty"`  // unpack the archive on arrival
+	Unpacked int64  `json:"unpacked,omitempty"` // bytes of the files inside
+	Entries  int    `json:"entries,omitempty"`  // files and folders inside
+
+	// Dedup offers to send a list of the body's chunks first and then only
+	// the chunks the receiver has no copy of, see dedup.go
+	Dedup bool `json:"dedup,omitempty"`
+}
+
+// TransferAck is the line the receiver answers with once the body is stored
+type TransferAck struct {
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+
+	Batch  string   `json:"batch,omitempty"`  // directory transfer ID assigned by the receiver
+	Skip   []string `json:"skip,omitempty"`   // manifest paths the receiver does not want
+	Result string   `json:"result,omitempty"` // what happened to a directory file, see conflict policies
+
+	Offset int64  `json:"offset,omitempty"` // bytes the receiver already holds on resume
+	SHA256 string `json:"sha256,omitempty"` // hash of those bytes, for the sender to check
+
+	Compression string `json:"compression,omitempty"` // algorithm the receiver accepted
+	Pausable    bool   `json:"pausable,omitempty"`    // the body will be framed for pausing
+
+	ChunkChecksums bool `json:"chunk_checksums,omitempty"` // the receiver checks each frame
+
+	Conflicts []string `json:"conflicts,omitempty"` // sync paths changed on both sides, left alone
+
+	Rejected string `json:"rejected,omitempty"` // incoming path the receiver refused
+	Reason   string `json:"reason,omitempty"`   // why, see PathError
+
+	// A transfer refused for lack of space says which limit it hit, see
+	// StorageError
+	Storage   string `json:"storage,omitempty"`
+	Needed    int64  `json:"needed,omitempty"`
+	Available int64  `json:"available,omitempty"`
+
+	Dedup bool   `json:"dedup,omitempty"` // the receiver wants the chunk list
+	Need  string `json:"need,omitempty"`  // base64 bitmap of the chunks it asks for
+}
+
+// TransferInfo is the JSON view of a Transfer
+type TransferInfo struct {
+	ID        string    `json:"id"`
+	Direction string    `json:"direction"` // "send", "receive"
+	Name      string    `json:"name"`
+	Path      string    `json:"path"`
+	Peer      string    `json:"peer"`
+	Size      int64     `json:"size"`
+	Files     int       `json:"files,omitempty"` // number of files in a directory transfer
+	Bytes     int64     `json:"bytes"`
+	State     string    `json:"state"` // "active", "completed", "failed", "canceled"
+	Error     string    `json:"error,omitempty"`
+	StartedAt time.Time `json:"started_at"`
+
+	Key         string `json:"key,omitempty"`          // set on resumable transfers
+	ResumedFrom int64  `json:"resumed_from,omitempty"` // offset this attempt started at
+	Resumes     string `json:"resumes,omitempty"`      // failed transfer this one continues
+
+	Compression string `json:"compression,omitempty"` // negotiated algorithm, empty when uncompressed
+	WireBytes   int64  `json:"wire_bytes,omitempty"`  // compressed bytes actually sent or received
+
+	SHA256 string `json:"sha256,omitempty"` // digest of the whole file once both ends agreed on it
+
+	Paused bool `json:"paused,omitempty"` // held by either side through pause_transfer
+
+	Retransmits int `json:"retransmits,omitempty"` // checked frames that failed and were sent again
+
+	Conflicts []string `json:"conflicts,omitempty"` // files a sync receiver kept because both sides changed them
+
+	Deduplicated int64 `json:"deduplicated,omitempty"` // bytes the receiver already had, so they were not sent
+
+	Broadcast string `json:"broadcast,omitempty"` // broadcast_file run this send belongs to
+
+	Namespace string `json:"namespace,omitempty"`
+
+	Priority string `json:"priority,omitempty"` // "low", "normal" or "high", see priority.go
+
+	URL string `json:"url,omitempty"` // source of a download_url receive
+
+	Storage string `json:"storage,omitempty"` // remote storage backend a receive went to; path is then its location
+
+	Plaintext bool `json:"plaintext,omitempty"` // sent unencrypted on a trusted subnet, see plaintext.go
+}
+
+// Transfer is a file moving over the network in either direction
+type Transfer struct {
+	TransferInfo // guarded by mu, except the immutable identity fields
+
+	bytes atomic.Int64
+	wire  atomic.Int64 // compressed bytes on the wire
+	mu    sync.Mutex
+
+	spec        dialSpec            // how a send was dialed, kept for resume_transfer
+	compression CompressionOptions  // what a send asked for
+	download    *DownloadURLPayload // what download_url asked for, kept for resume_transfer
+	pause       pauseGate
+	share       *RateLimiter // its part of transfer_priority's bandwidth
+}
+
+// TransferProgress is the payload of transfer_progress events
+type TransferProgress struct {
+	ID             string  `json:"id"`
+	Direction      string  `json:"direction"`
+	Name           string  `json:"name"`
+	Bytes          int64   `json:"bytes"`
+	Total          int64   `json:"total"`
+	Percent        float64 `json:"percent"`
+	InstantBps     float64 `json:"instant_bps"`
+	AverageBps     float64 `json:"average_bps"`
+	ETASeconds     float64 `json:"eta_seconds"`
+	ElapsedSeconds float64 `json:"elapsed_seconds"`
+
+	Compression string  `json:"compression,omitempty"`
+	WireBytes   int64   `json:"wire_bytes,omitempty"` // compressed bytes so far
+	Ratio       float64 `json:"ratio,omitempty"`      // wire bytes per uncompressed byte
+
+	Paused bool `json:"paused,omitempty"`
+
+	Broadcast string `json:"broadcast,omitempty"`
+}
+
+var (
+	transfersMu sync.Mutex
+	transfers   = make(map[string]*Transfer)
+	transferSeq atomic.Uint64
+)
+
+func newTransfer(direction, name, path, peer string, size int64) *Transfer {
+	return newTransferAt(priorityNormal, direction, name, path, peer, size)
+}
+
+// newTransferAt registers a transfer at priority, "" for normal
+func newTransferAt(priority, direction, name, path, peer string, size int64) *Transfer {
+	if priority == "" {
+		priority = priorityNormal
+	}
+	t := &Transfer{TransferInfo: TransferInfo{
+		ID:        fmt.Sprintf("transfer-%d", transferSeq.Add(1)),
+		Direction: direction,
+		Name:      name,
+		Path:      path,
+		Peer:      peer,
+		Size:      size,
+		State:     "active",
+		StartedAt: clock.Now(),
+		Priority:  priority,
+	}, share: newRateLimiter(0)}
+
+	transfersMu.Lock()
+	transfers[t.ID] = t
+	transfersMu.Unlock()
+	priorities.join(t)
+	return t
+}
+
+func (t *Transfer) Add(n int) {
+	t.bytes.Add(int64(n))
+}
+
+func (t *Transfer) Info() TransferInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	info := t.TransferInfo
+	info.Bytes = t.bytes.Load()
+	if info.Namespace == "" {
+		info.Namespace = scopeOf(t.ID)
+	}
+	if info.Compression != "" {
+		info.WireBytes = t.wire.Load()
+	}
+	return info
+}
+
+// setCompression records the algorithm a transfer ended up using
+func (t *Transfer) setCompression(algorithm string) {
+	if algorithm == compressNone {
+		algorithm = ""
+	}
+	t.mu.Lock()
+	t.Compression = algorithm
+	t.mu.Unlock()
+}
+
+// finish records the outcome and emits transfer_completed or transfer_failed
+func (t *Transfer) finish(err error) {
+	t.mu.Lock()
+	switch {
+	case errors.Is(err, context.Canceled):
+		t.State = "canceled"
+		t.Error = "canceled"
+	case err != nil:
+		t.State = "failed"
+		t.Error = err.Error()
+	default:
+		t.State = "completed"
+	}
+	// A finished transfer keeps its namespace itself, so scopes only
+	// holds what is running
+	t.Namespace = scopeOf(t.ID)
+	t.mu.Unlock()
+	priorities.leave(t)
+	defer dropScope(t.ID)
+
+	metrics.ObserveTransfer(t.Direction, err, clock.Now().Sub(t.StartedAt))
+	history.Record(t)
+	defer transferQueue.transferFinished(t.ID, err)
+	elapsed := clock.Now().Sub(t.StartedAt).Seconds()
+	data := map[string]interface{}{
+		"id":              t.ID,
+		"direction":       t.Direction,
+		"name":            t.Name,
+		"path":            t.Path,
+		"bytes":           t.bytes.Load(),
+		"elapsed_seconds": elapsed,
+	}
+	if elapsed > 0 {
+		data["average_bps"] = float64(t.bytes.Load()) / elapsed
+	}
+	info := t.Info()
+	if info.Compression != "" {
+		data["compression"] = info.Compression
+		data["wire_bytes"] = info.WireBytes
+	}
+	if info.Deduplicated > 0 {
+		data["deduplicated"] = info.Deduplicated
+	}
+	if t.Broadcast != "" {
+		data["broadcast"] = t.Broadcast
+	}
+
+	if errors.Is(err, context.Canceled) {
+		data["resumable"] = t.Key != ""
+		logger.Info("transfer canceled", "id", t.ID, "name", t.Name, "bytes", t.bytes.Load())
+		emitEvent("transfer_canceled", data)
+		return
+	}
+	if err != nil {
+		data["error"] = err.Error()
+		data["resumable"] = t.Key != "" && !errors.Is(err, errChecksumMismatch)
+		var se *StorageError
+		if errors.As(err, &se) {
+			data["storage"] = map[string]interface{}{"reason": se.Reason, "needed": se.Needed, "available": se.Available}
+		}
+		logger.Warn("transfer failed", "id", t.ID, "name", t.Name, "error", err)
+		emitEvent("transfer_failed", data)
+		return
+	}
+	logger.Info("transfer completed", "id", t.ID, "name", t.Name, "bytes", t.bytes.Load())
+	emitEvent("transfer_completed", data)
+	if t.Direction == "receive" {
+		goSafe("hooks for "+t.ID, func() { runHooks(t) })
+	}
+}
+
+// reportProgress emits transfer_progress until done is closed
+func (t *Transfer) reportProgress(done <-chan struct{}) {
+	ticker := clock.NewTicker(progressInterval)
+	defer ticker.Stop()
+
+	last := t.bytes.Load()
+	lastTick := t.StartedAt
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			bytes := t.bytes.Load()
+			emitEvent("transfer_progress", t.progress(bytes, last, now.Sub(lastTick)))
+			last, lastTick = bytes, now
+		}
+	}
+}
+
+func (t *Transfer) progress(bytes, lastBytes int64, interval time.Duration) TransferProgress {
+	elapsed := clock.Now().Sub(t.StartedAt).Seconds()
+	p := TransferProgress{
+		ID:             t.ID,
+		Direction:      t.Direction,
+		Name:           t.Name,
+		Broadcast:      t.Broadcast,
+		Bytes:          bytes,
+		Total:          t.Size,
+		ElapsedSeconds: elapsed,
+	}
+	if t.Size > 0 {
+		p.Percent = float64(bytes) / float64(t.Size) * 100
+	}
+	if interval > 0 {
+		p.InstantBps = float64(bytes-lastBytes) / interval.Seconds()
+	}
+	if elapsed > 0 {
+		p.AverageBps = float64(bytes) / elapsed
+	}
+	if p.AverageBps > 0 && t.Size > bytes {
+		p.ETASeconds = float64(t.Size-bytes) / p.AverageBps
+	}
+
+	t.mu.Lock()
+	p.Compression = t.Compression
+	p.Paused = t.Paused
+	t.mu.Unlock()
+	if p.Compression != "" {
+		p.WireBytes = t.wire.Load()
+		if bytes > 0 {
+			p.Ratio = float64(p.WireBytes) / float64(bytes)
+		}
+	}
+	return p
+}
+
+// progressWriter counts bytes flowing through a copy into a transfer
+type progressWriter struct {
+	w io.Writer
+	t *Transfer
+}
+
+func (pw progressWriter) Write(b []byte) (int, error) {
+	n, err := pw.w.Write(b)
+	pw.t.Add(n)
+	pw.t.share.WaitN(n)
+	return n, err
+}
+
+type SendFilePayload struct {
+	Host      string `json:"host"`
+	Port      int    `json:"port"`
+	Path      string `json:"path"`
+	Name      string `json:"name"` // name announced to the receiver, defaults to the file's base name
+	TimeoutMs int    `json:"timeout_ms"`
+	Encrypted bool   `json:"encrypted"`
+	PeerKey   string `json:"peer_key"`
+	Resume    bool   `json:"resume"` // continue a partial copy the receiver kept from an earlier attempt
+
+	Compression CompressionOptions `json:"compression"`
+	Auth        ClientAuth         `json:"auth"`
+
+	Offer          bool `json:"offer"`            // wait for a drop receiver to accept first
+	OfferTimeoutMs int  `json:"offer_timeout_ms"` // how long to wait for that answer
+
+	AddressFamily string `json:"address_family"` // "ipv4", "ipv6" or "dual" (default)
+	Transport     string `json:"transport"`      // "tcp" (default) or "quic"
+	Proxy         string `json:"proxy"`          // proxy URL, or "direct" to skip the configured proxy
+	Mux           string `json:"mux"`            // send over this open_mux link instead of dialing host and port
+
+	// Streams splits the body across this many connections, default 1.
+	// Files under two chunks go over one.
+	Streams int `json:"streams"`
+
+	Schedule *ScheduleSpec `json:"schedule"` // run later or repeatedly instead of now
+
+	// ChunkChecksums checks each piece of the body as it arrives and sends
+	// a damaged one again, up to ChunkRetries times (default 3), instead
+	// of failing at the final hash. Plain TCP bodies then skip sendfile.
+	ChunkChecksums bool `json:"chunk_checksums"`
+	ChunkRetries   int  `json:"chunk_retries"`
+
+	// Dedup sends only the chunks of the file the receiver has no copy
+	// of, such as the unchanged parts of an earlier version. The body is
+	// then neither pausable nor resumable. Receivers take it only from
+	// peers they pinned and have the file sent whole otherwise.
+	Dedup bool `json:"dedup"`
+
+	Priority string `json:"priority"` // "low", "normal" (default) or "high", see priority.go
+
+	// Plaintext skips the encryption an encrypted listener requires. Both
+	// peers' encryption.plaintext_subnets must hold both addresses.
+	Plaintext bool `json:"plaintext"`
+}
+
+func handleSendFile(payload json.RawMessage, writer *Output) {
+	var p SendFilePayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		sendInvalidPayload(writer, "send_file")
+		return
+	}
+	if (p.Mux == "" && (p.Host == "" || p.Port <= 0)) || p.Path == "" {
+		sendErrorCode(writer, ErrInvalidArgument, message("transfer.send_file_requires_path"), nil)
+		return
+	}
+	if !validPriority(p.Priority) {
+		sendErrorCode(writer, ErrInvalidArgument, message("priority.priority_must_low"), nil)
+		return
+	}
+	if p.Mux != "" {
+		if err := checkMuxOptions(p.Transport, p.Encrypted, p.Auth, p.Compression, p.Proxy); err != nil {
+			sendFailure(writer, err)
+			return
+		}
+	}
+	if p.Schedule != nil {
+		scheduleCommand(writer, "send_file", payload, *p.Schedule)
+		return
+	}
+	if err := p.Auth.Validate(); err != nil {
+		sendFailure(writer, err)
+		return
+	}
+	if err := p.Compression.Validate(); err != nil {
+		sendFailure(writer, err)
+		return
+	}
+	if p.Streams > 1 && (p.Resume || p.Compression.Enabled()) {
+		sendErrorCode(writer, ErrInvalidArgument, message("transfer.streams_cannot_combined_resume"), nil)
+		return
+	}
+	if p.ChunkRetries < 0 || p.ChunkRetries > maxChunkRetries {
+		sendErrorCode(writer, ErrInvalidArgument, message("transfer.chunk_retries_must_between", "max_chunk_retries", maxChunkRetries), nil)
+		return
+	}
+	if p.ChunkRetries > 0 && !p.ChunkChecksums {
+		sendErrorCode(writer, ErrInvalidArgument, message("transfer.chunk_retries_requires_chunk"), nil)
+		return
+	}
+	if p.ChunkChecksums && p.Streams > 1 {
+		sendErrorCode(writer, ErrInvalidArgument, message("transfer.chunk_checksums_cannot_combined"), nil)
+		return
+	}
+	if p.Dedup && (p.Streams > 1 || p.Resume || p.ChunkChecksums) {
+		sendErrorCode(writer, ErrInvalidArgument, message("transfer.dedup_cannot_combined_streams"), nil)
+		return
+	}
+	if p.Plaintext && (p.Encrypted || p.Mux != "" || p.Transport == "quic") {
+		sendErrorCode(writer, ErrInvalidArgument, message("transfer.plaintext_cannot_combined"), nil)
+		return
+	}
+	if p.ChunkChecksums && p.ChunkRetries == 0 {
+		p.ChunkRetries = defaultChunkRetries
+	}
+
+	f, err := os.Open(p.Path)
+	if err != nil {
+		sendError(writer, message("common.failed_open", "path", p.Path, "error", err))
+		return
+	}
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		f.Close()
+		sendErrorCode(writer, ErrInvalidArgument, message("common.not_regular_file", "path", p.Path), nil)
+		return
+	}
+
+	name := p.Name
+	if name == "" {
+		name = filepath.Base(p.Path)
+	}
+	timeout := defaultDialTimeout
+	if p.TimeoutMs > 0 {
+		timeout = time.Duration(p.TimeoutMs) * time.Millisecond
+	}
+	network, isQUIC, err := transportNetwork(p.Transport, p.AddressFamily)
+	if err == nil && isQUIC {
+		err = validProxy(p.Proxy, "quic")
+	} else if err == nil {
+		err = validProxy(p.Proxy, "tcp")
+	}
+	if err != nil {
+		f.Close()
+		sendFailure(writer, err)
+		return
+	}
+
+	spec := dialSpec{
+		Network:   network,
+		Addr:      net.JoinHostPort(normalizeHost(p.Host), strconv.Itoa(p.Port)),
+		QUIC:      isQUIC,
+		Timeout:   timeout,
+		Encrypted: p.Encrypted,
+		Plaintext: p.Plaintext,
+		PeerKey:   p.PeerKey,
+		Auth:      p.Auth,
+		Proxy:     p.Proxy,
+		Streams:   min(p.Streams, maxTransferStreams),
+
+		ChunkRetries: p.ChunkRetries,
+		Dedup:        p.Dedup,
+		Session:      newSessionToken(),
+	}
+	if p.Offer {
+		spec.OfferWait = defaultOfferSenderWait
+		if p.OfferTimeoutMs > 0 {
+			spec.OfferWait = time.Duration(p.OfferTimeoutMs) * time.Millisecond
+		}
+	}
+	if p.Mux != "" {
+		if err := spec.useMux(p.Mux, "transfer"); err != nil {
+			f.Close()
+			sendFailure(writer, err)
+			return
+		}
+	}
+	startSendFile(writer, f, info, name, p.Path, spec, p.Compression, p.Resume, "", p.Priority)
+}
+
+// startSendFile registers a send transfer for f and runs it in the background
+func startSendFile(writer *Output, f *os.File, info os.FileInfo, name, path string, spec dialSpec,
+	compression CompressionOptions, resume bool, resumes, priority string) {
+	t := newSendTransfer(info, name, path, spec, compression, resumes, priority)
+	setScope(t.ID, writer.Namespace())
+
+	// Transfers can run for a long time, so reply with the ID right away
+	// and report the rest through events
+	writer.Encode(okResponse(message("common.transfer_started"), t.Info()))
+	launchSendFile(t, f, resume, nil)
+}
+
+// newSendTransfer registers a send transfer of the file described by info
+func newSendTransfer(info os.FileInfo, name, path string, spec dialSpec, compression CompressionOptions, resumes, priority string) *Transfer {
+	t := newTransferAt(priority, "send", name, path, spec.Addr, info.Size())
+	t.spec = spec
+	t.compression = compression
+	t.mu.Lock()
+	t.Key = transferKey(path, info)
+	t.Resumes = resumes
+	t.Plaintext = spec.Plaintext
+	t.mu.Unlock()
+	return t
+}
+
+// launchSendFile sends f for t in the background and calls finished, if
+// set, once the outcome is recorded
+func launchSendFile(t *Transfer, f *os.File, resume bool, finished func()) {
+	ctx, done := trackJob(t.ID, "transfer", t.spec.Addr)
+	go func() {
+		defer recoverTransfer(t)
+		defer done()
+		defer f.Close()
+		err := sendFile(ctx, t, f, t.spec, resume)
+		if errors.Is(err, errResumeMismatch) {
+			// Our copy no longer matches what the receiver kept; start over
+			logger.Info("resume rejected, resending", "id", t.ID, "name", t.Name)
+			t.bytes.Store(0)
+			if _, err = f.Seek(0, io.SeekStart); err == nil {
+				err = sendFile(ctx, t, f, t.spec, false)
+			}
+		}
+		t.finish(canceled(ctx, err))
+		if finished != nil {
+			finished()
+		}
+	}()
+}
+
+func sendFile(ctx context.Context, t *Transfer, f *os.File, spec dialSpec, resume bool) error {
+	// A retry goes over one stream and picks up what the receiver kept
+	if spec.Streams > 1 && !resume && t.Size >= 2*parallelChunkSize {
+		return sendParallel(ctx, t, f, spec)
+	}
+	conn, secure, err := spec.dial()
+	if err != nil {
+		return err
+	}
+	c := trackConn(conn, "outbound", spec.transport(), nil)
+	if c == nil {
+		conn.Close()
+		return errors.New("service is shutting down")
+	}
+	defer untrackConn(c)
+	defer t.cancelOn(ctx, c)()
+	c.setSecure(secure)
+
+	header := TransferHeader{Name: t.Name, Size: t.Size, Key: t.Key, Resume: resume, Session: spec.Session}
+	if t.compression.Enabled() {
+		header.Compression = t.compression.Algorithm
+	}
+	if spec.OfferWait > 0 {
+		header.Offer, header.From = true, senderName()
+	}
+	header.Verify, header.Pausable = true, true
+	header.ChunkChecksums = spec.ChunkRetries > 0
+	header.Dedup = spec.Dedup && !resume
+	line, _ := json.Marshal(header)
+	if _, err := c.Write(append(line, '\n')); err != nil {
+		return err
+	}
+
+	h := sha256.New()
+	reader := bufio.NewReader(c)
+	if header.Offer {
+		if _, err := readAck(reader, c, spec.OfferWait); err != nil {
+			return err
+		}
+	}
+	// Resuming, compression and pausing need the receiver's answer before the body
+	opts := CompressionOptions{}
+	var pw *pausableWriter
+	if resume || header.Compression != "" || header.Pausable {
+		ack, err := readAck(reader, c, spec.Timeout)
+		if err != nil {
+			return err
+		}
+		if resume {
+			if err := skipVerifiedPrefix(t, f, ack, h); err != nil {
+				return err
+			}
+		}
+		opts = CompressionOptions{Algorithm: supportedCompression(ack.Compression), Level: t.compression.Level}
+		t.setCompression(opts.Algorithm)
+		if header.Dedup && ack.Dedup {
+			return sendDeduped(t, f, c, reader, opts, spec.Timeout)
+		}
+		if ack.Pausable {
+			pw = &pausableWriter{w: c, t: t}
+			if header.ChunkChecksums && ack.ChunkChecksums {
+				pw.chunks = newChunkLog(t, spec.ChunkRetries)
+			}
+		}
+	}
+
+	var w io.Writer = c
+	var acks <-chan ackResult
+	if pw != nil {
+		w = pw
+		t.enablePause(c, pw.control)
+		defer t.disablePause(nil)
+		acks = watchControl(t, reader, pw.chunks)
+	}
+	body, finish, err := bodyWriter(w, opts, &t.wire)
+	if err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	go t.reportProgress(done)
+	err = copyFileBody(body, f, t.Size, t, h)
+	if err == nil {
+		err = finish()
+	}
+	if err == nil && pw != nil {
+		err = pw.finish()
+	}
+	close(done)
+	if err != nil {
+		return err
+	}
+
+	sum := hex.EncodeToString(h.Sum(nil))
+	line, _ = json.Marshal(transferTrailer{SHA256: sum})
+	if _, err := c.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	var ack TransferAck
+	if acks != nil {
+		// The control reader owns the connection's input until the ack,
+		// and the receiver may still hold the transfer while it drains
+		t.setAckWindow(spec.Timeout)
+		result := <-acks
+		ack, err = result.ack, result.err
+	} else {
+		ack, err = readAck(reader, c, spec.Timeout)
+	}
+	if ack.Result == resultChecksumMismatch {
+		emitVerifyFailed(t, t.Path, hashSHA256, sum, ack.SHA256)
+		return &checksumError{name: t.Name, expected: sum, actual: ack.SHA256}
+	}
+	if err == nil {
+		t.mu.Lock()
+		t.SHA256 = sum
+		t.mu.Unlock()
+	}
+	return err
+}
+
+// cancelOn aborts c, and wakes a sender held by a pause, once ctx is
+// canceled; the returned function stops watching
+func (t *Transfer) cancelOn(ctx context.Context, c *Connection) func() bool {
+	return context.AfterFunc(ctx, func() {
+		t.disablePause(context.Canceled)
+		c.Abort()
+	})
+}
+
+// readAck waits for the receiver's answer on r, which must read from c
+func readAck(r *bufio.Reader, c *Connection, timeout time.Duration) (TransferAck, error) {
+	var ack TransferAck
+	c.SetReadDeadline(time.Now().Add(timeout))
+	defer c.SetReadDeadline(time.Time{})
+
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return ack, fmt.Errorf("no acknowledgement from receiver: %w", err)
+	}
+	return parseAck(line)
+}
+
+// parseAck decodes an ack line and turns a rejection into an error
+func parseAck(line string) (TransferAck, error) {
+	var ack TransferAck
+	if err := json.Unmarshal([]byte(line), &ack); err != nil {
+		return ack, errors.New("invalid acknowledgement from receiver")
+	}
+	if ack.Status != "ok" {
+		msg := "receiver rejected transfer: " + ack.Message
+		if ack.Storage != "" {
+			return ack, &StorageError{Reason: ack.Storage, Needed: ack.Needed, Available: ack.Available, msg: msg}
+		}
+		return ack, errors.New(msg)
+	}
+	return ack, nil
+}
+
+// handleTransferConnection receives files on a "transfer" listener until the
+// sender closes the connection
+func handleTransferConnection(c *Connection, dir string) {
+	defer untrackConn(c)
+
+	reader := bufio.NewReaderSize(c, transferBufferSize)
+	for {
+		c.SetReadDeadline(time.Now().Add(30 * time.Second))
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		var header TransferHeader
+		if err := json.Unmarshal([]byte(line), &header); err != nil || header.Name == "" || (header.Size < 0 && header.Archive == "") {
+			writeAck(c, errors.New("invalid transfer header"))
+			return
+		}
+		c.SetReadDeadline(time.Time{})
+
+		target := receiveDest{dir: dir}
+		if c.server != nil {
+			target.storage = c.server.Storage
+		}
+		if header.Batch == "" && header.Parallel == "" {
+			if target.storage != "" {
+				err = localOnly(header, target.storage)
+			} else {
+				err = checkStorage(dir, incomingSize(header), c.Info().RemoteAddr)
+			}
+			if err != nil {
+				logger.Warn("transfer refused for storage", "remote", c.Info().RemoteAddr, "name", header.Name, "error", err)
+				writeAck(c, err)
+				return
+			}
+			if err := checkHeader(header); err != nil {
+				reportRefusedHeader(err, c.Info().RemoteAddr)
+				writeAck(c, err)
+				return
+			}
+			if s := resumedSession(c, header); s != nil {
+				// Accepted on an earlier attempt, perhaps from another address
+				target = s.dest
+				if header.Offer {
+					writeAck(c, nil)
+				}
+			} else if target, err = answerOffer(c, header, target); err != nil {
+				writeAck(c, err)
+				return
+			}
+			if target.storage != "" {
+				// The offer may have picked a backend the listener does not use
+				if err := localOnly(header, target.storage); err != nil {
+					writeAck(c, err)
+					return
+				}
+			}
+			rememberSession(c, header, target)
+		}
+
+		switch {
+		case header.Manifest != nil:
+			// The manifest connection stays open as the control channel
+			// until the whole directory has arrived
+			receiveDirectory(c, reader, target.dir, header)
+			return
+		case header.Streams > 1:
+			receiveParallel(c, reader, target.dir, header)
+			return
+		case header.Parallel != "":
+			receiveChunks(c, reader, header)
+			return
+		case header.Batch != "":
+			if err := receiveDirectoryFile(c, reader, header); err != nil {
+				return
+			}
+		case header.Archive != "":
+			if err := receiveArchive(c, reader, target.dir, header); err != nil {
+				return
+			}
+		default:
+			name, err := incomingName(header.Name)
+			if err != nil {
+				writeAck(c, err)
+				return
+			}
+			t := newTransfer("receive", name, "", c.Info().RemoteAddr, header.Size)
+			setScope(t.ID, scopeOf(c.ID))
+			t.notePlaintext(c)
+			ctx, done := trackJob(t.ID, "transfer", t.Peer)
+			stop := t.cancelOn(ctx, c)
+			switch {
+			case target.storage != "":
+				err = receiveToBackend(ctx, c, t, reader, target.storage, header)
+			case header.Dedup && !header.Resume && header.Size > 0 && dedupAllowed(c):
+				err = receiveDeduped(c, t, reader, target.dir, header)
+			case header.Key != "":
+				err = receiveResumable(c, t, reader, target.dir, header)
+			default:
+				emitEvent("transfer_started", t.Info())
+				err = receiveFile(t, reader, target.dir)
+			}
+			stop()
+			err = canceled(ctx, err)
+			writeAck(c, err)
+			t.finish(err)
+			done()
+			if err != nil {
+				return
+			}
+			forgetSession(header.Session)
+		}
+	}
+}
+
+func receiveFile(t *Transfer, r io.Reader, dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	path, err := safeJoin(dir, t.Name)
+	if err == nil {
+		path, err = uniquePath(path)
+	}
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	t.Path = path
+	t.mu.Unlock()
+
+	done := make(chan struct{})
+	go t.reportProgress(done)
+	err = writeFile(t, r, path, t.Size, "")
+	close(done)
+	return err
+}
+
+// writeFile stores exactly size bytes from r at path, counting them into t.
+// The body goes to a temporary name first so a half-received file is never
+// mistaken for a complete one. A non-empty sum is checked before the rename.
+func writeFile(t *Transfer, r io.Reader, path string, size int64, sum string) error {
+	partial := path + ".part"
+	f, err := os.Create(partial)
+	if err != nil {
+		return err
+	}
+
+	h := sha256.New()
+	n, err := io.CopyBuffer(progressWriter{w: io.MultiWriter(f, h), t: t}, io.LimitReader(r, size), make([]byte, transferBufferSize))
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && n != size {
+		err = fmt.Errorf("connection closed after %d of %d bytes", n, size)
+	}
+	if actual := hex.EncodeToString(h.Sum(nil)); err == nil && sum != "" && !strings.EqualFold(actual, sum) {
+		emitVerifyFailed(t, path, hashSHA256, strings.ToLower(sum), actual)
+		err = &checksumError{name: filepath.Base(path), expected: sum, actual: actual}
+	}
+	if err != nil {
+		os.Remove(partial)
+		return err
+	}
+	return finalizeReceived(t, partial, path)
+}
+
+func writeAck(c *Connection, err error) {
+	ack := TransferAck{Status: "ok"}
+	if err != nil {
+		ack = TransferAck{Status: "error", Message: err.Error()}
+		mismatchAck(&ack, err)
+		pathAck(c, &ack, err)
+		storageAck(&ack, err)
+	}
+	line, _ := json.Marshal(ack)
+	c.Write(append(line, '\n'))
+}
+
+// uniquePath returns path, or "name (n).ext" if something already exists there
+func uniquePath(path string) (string, error) {
+	if _, err := os.Lstat(path); os.IsNotExist(err) {
+		return path, nil
+	}
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	for i := 1; i < 10000; i++ {
+		candidate := fmt.Sprintf("%s (%d)%s", base, i, ext)
+		if _, err := os.Lstat(candidate); os.IsNotExist(err) {
+			return candidate, nil
+		}
+	}
+	return "", errors.New("too many files named " + filepath.Base(path))
+}
+
+// defaultDownloadDir is where transfer listeners store files unless told otherwise
+func defaultDownloadDir() string {
+	if dir := config.Get().DownloadDir; dir != "" {
+		return dir
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join(os.TempDir(), "Lumina")
+	}
+	return filepath.Join(home, "Downloads", "Lumina")
+}
+
+// lookupTransfer finds transfer id if requests answered through writer can
+// see it
+func lookupTransfer(id string, writer *Output) (*Transfer, bool) {
+	transfersMu.Lock()
+	t, exists := transfers[id]
+	transfersMu.Unlock()
+	if !exists || !visible(t.Info().Namespace, writer.Namespace()) {
+		return nil, false
+	}
+	return t, true
+}
+
+func handleListTransfers(writer *Output) {
+	transfersMu.Lock()
+	list := make([]TransferInfo, 0, len(transfers))
+	for _, t := range transfers {
+		if info := t.Info(); visible(info.Namespace, writer.Namespace()) {
+			list = append(list, info)
+		}
+	}
+	transfersMu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].StartedAt.Before(list[j].StartedAt) })
+
+	writer.Encode(ProtocolResponse{
+		Status: "ok",
+		Data:   map[string]interface{}{"transfers": list},
+	})
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"crypto/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Transfer sessions let a sender that reconnects from another address, after
+// a DHCP renewal or a Wi-Fi roam, carry on where it left off. Every
+// single-file send picks a random token and puts it in its header. The
+// receiver remembers the token once it has accepted the transfer, along with
+// the file's name and size, the listener it arrived on, the directory or
+// storage backend it went to and, on encrypted connections, the sender's
+// fingerprint. A resume presenting a remembered token for the same file on
+// the same listener is then the same logical transfer: it is not offered to
+// the user again, lands in the same place and must come from the same key,
+// whatever address it arrives from. Anything else that differs makes it a
+// new transfer, offered like any other.
+
+const (
+	// transferSessionTTL is how long a receiver remembers an unfinished
+	// session
+	transferSessionTTL = 24 * time.Hour
+	// maxTransferSessions bounds what a sender can make a receiver remember
+	maxTransferSessions = 1024
+	// maxSessionTokenLen is the longest token a header may carry
+	maxSessionTokenLen = 64
+)
+
+// errRedirectMux refuses to redirect a send that went over a mux link
+var errRedirectMux = catalogError(ErrInvalidArgument, "transfersession.send_over_mux_link_cannot")
+
+// transferSession is a receiver's record of an accepted transfer
+type transferSession struct {
+	key         string // TransferHeader.Key of the file
+	name        string // TransferHeader.Name and Size as accepted
+	size        int64
+	listener    string      // ID of the listener it arrived on
+	dest        receiveDest // where the offer, if any, sent it
+	remote      string      // address the sender last connected from
+	fingerprint string      // sender's key on encrypted connections
+	expires     time.Time
+}
+
+var (
+	transferSessionsMu sync.Mutex
+	transferSessions   = make(map[string]*transferSession)
+)
+
+// newSessionToken is the token a send presents on every attempt
+func newSessionToken() string {
+	return rand.Text()
+}
+
+// sessionHeader reports whether header belongs to a transfer that can have
+// a session: a single keyed file
+func sessionHeader(header TransferHeader) bool {
+	return header.Session != "" && len(header.Session) <= maxSessionTokenLen && header.Key != "" &&
+		header.Manifest == nil && header.Batch == "" && header.Parallel == "" && header.Streams <= 1 && header.Archive == ""
+}
+
+// connFingerprint is the sender's key on an encrypted connection, "" otherwise
+func connFingerprint(c *Connection) string {
+	if s := c.Info().Secure; s != nil {
+		return s.Fingerprint
+	}
+	return ""
+}
+
+// resumedSession finds the session a resuming header continues, or nil
+// when it starts a new one. A match moves the session to the connection's
+// address and emits transfer_session_resumed.
+func resumedSession(c *Connection, header TransferHeader) *transferSession {
+	if !header.Resume || !sessionHeader(header) {
+		return nil
+	}
+	remote := c.Info().RemoteAddr
+	transferSessionsMu.Lock()
+	s, ok := transferSessions[header.Session]
+	if ok && time.Now().After(s.expires) {
+		delete(transferSessions, header.Session)
+		ok = false
+	}
+	if !ok {
+		transferSessionsMu.Unlock()
+		return nil
+	}
+	if s.key != header.Key || s.name != header.Name || s.size != header.Size || s.listener != c.ListenerID {
+		transferSessionsMu.Unlock()
+		logger.Info("transfer session presented for another file or listener", "remote", remote, "name", header.Name)
+		return nil
+	}
+	if s.fingerprint != "" && s.fingerprint != connFingerprint(c) {
+		transferSessionsMu.Unlock()
+		logger.Warn("transfer session presented by another key", "remote", remote, "name", header.Name)
+		return nil
+	}
+	previous := s.remote
+	s.remote = remote
+	s.expires = time.Now().Add(transferSessionTTL)
+	found := *s
+	transferSessionsMu.Unlock()
+
+	moved := !sameRemoteHost(previous, remote)
+	if moved {
+		logger.Info("transfer session moved", "name", header.Name, "from", previous, "to", remote)
+	}
+	emitEvent("transfer_session_resumed", map[string]interface{}{
+		"name":            header.Name,
+		"key":             header.Key,
+		"remote":          remote,
+		"previous_remote": previous,
+		"moved":           moved,
+	})
+	return &found
+}
+
+// rememberSession records an accepted transfer so a sender reconnecting
+// from elsewhere can continue it
+func rememberSession(c *Connection, header TransferHeader, dest receiveDest) {
+	if !sessionHeader(header) {
+		return
+	}
+	now := time.Now()
+	transferSessionsMu.Lock()
+	defer transferSessionsMu.Unlock()
+	for token, s := range transferSessions {
+		if now.After(s.expires) {
+			delete(transferSessions, token)
+		}
+	}
+	if _, ok := transferSessions[header.Session]; !ok && len(transferSessions) >= maxTransferSessions {
+		logger.Warn("too many transfer sessions, not remembering another", "remote", c.Info().RemoteAddr)
+		return
+	}
+	transferSessions[header.Session] = &transferSession{
+		key:         header.Key,
+		name:        header.Name,
+		size:        header.Size,
+		listener:    c.ListenerID,
+		dest:        dest,
+		remote:      c.Info().RemoteAddr,
+		fingerprint: connFingerprint(c),
+		expires:     now.Add(transferSessionTTL),
+	}
+}
+
+// forgetSession drops the session of a finished transfer
+func forgetSession(token string) {
+	transferSessionsMu.Lock()
+	delete(transferSessions, token)
+	transferSessionsMu.Unlock()
+}
+
+// sameRemoteHost reports whether two remote addresses are the same host
+func sameRemoteHost(a, b string) bool {
+	ha, _, err := net.SplitHostPort(a)
+	if err != nil {
+		return a == b
+	}
+	hb, _, err := net.SplitHostPort(b)
+	if err != nil {
+		return a == b
+	}
+	return sameHost(ha, hb)
+}
+
+// redirectSpec points a send's dial spec at host and port, keeping
+// whichever the caller left empty
+func redirectSpec(spec dialSpec, host string, port int) (dialSpec, error) {
+	if host == "" && port <= 0 {
+		return spec, nil
+	}
+	if spec.Mux != nil {
+		return spec, errRedirectMux
+	}
+	oldHost, oldPort, err := net.SplitHostPort(spec.Addr)
+	if err != nil {
+		return spec, err
+	}
+	if host == "" {
+		host = oldHost
+	} else {
+		host = normalizeHost(host)
+	}
+	if port > 0 {
+		oldPort = strconv.Itoa(port)
+	}
+	spec.Addr = net.JoinHostPort(host, oldPort)
+	return spec, nil
+}
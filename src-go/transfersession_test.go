@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// addrConn is a connection that only knows its addresses
+type addrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c addrConn) LocalAddr() net.Addr  { return &net.TCPAddr{IP: net.IPv4(192, 168, 1, 2), Port: 9000} }
+func (c addrConn) RemoteAddr() net.Addr { return c.remote }
+
+func connFrom(ip string, secure *SecureInfo) *Connection {
+	c := &Connection{ID: "test", Direction: "inbound", Network: "tcp", Created: time.Now(), Limiter: newRateLimiter(0)}
+	c.setConn(addrConn{remote: &net.TCPAddr{IP: net.ParseIP(ip), Port: 50000}})
+	c.setSecure(secure)
+	return c
+}
+
+func TestTransferSessionFollowsSender(t *testing.T) {
+	header := TransferHeader{Name: "a.bin", Size: 10, Key: "k1", Session: newSessionToken()}
+	rememberSession(connFrom("192.168.1.10", nil), header, receiveDest{dir: "/drop/accepted"})
+	defer forgetSession(header.Session)
+
+	if resumedSession(connFrom("192.168.1.20", nil), header) != nil {
+		t.Error("a fresh attempt continued the session")
+	}
+	header.Resume = true
+	s := resumedSession(connFrom("192.168.1.20", nil), header)
+	if s == nil || s.dest.dir != "/drop/accepted" || s.remote != "192.168.1.20:50000" {
+		t.Fatalf("roamed sender got session %+v", s)
+	}
+	for _, change := range []func(*TransferHeader){
+		func(h *TransferHeader) { h.Key = "k2" },
+		func(h *TransferHeader) { h.Name = "other.bin" },
+		func(h *TransferHeader) { h.Size = 1 << 30 },
+	} {
+		other := header
+		change(&other)
+		if resumedSession(connFrom("192.168.1.20", nil), other) != nil {
+			t.Errorf("token continued another file: %+v", other)
+		}
+	}
+	elsewhere := connFrom("192.168.1.20", nil)
+	elsewhere.ListenerID = "other-listener"
+	if resumedSession(elsewhere, header) != nil {
+		t.Error("token continued on another listener")
+	}
+
+	secure := TransferHeader{Name: "b.bin", Size: 10, Key: "k3", Session: newSessionToken(), Resume: true}
+	rememberSession(connFrom("10.0.0.5", &SecureInfo{Fingerprint: "aa"}), secure, receiveDest{dir: "/drop"})
+	defer forgetSession(secure.Session)
+	if resumedSession(connFrom("10.0.0.6", &SecureInfo{Fingerprint: "bb"}), secure) != nil {
+		t.Error("token accepted from another key")
+	}
+	if resumedSession(connFrom("10.0.0.6", &SecureInfo{Fingerprint: "aa"}), secure) == nil {
+		t.Error("same key at a new address refused")
+	}
+}
+
+func TestRedirectSpec(t *testing.T) {
+	spec := dialSpec{Addr: "192.168.1.10:7000"}
+	if got, _ := redirectSpec(spec, "[fe80::1]", 0); got.Addr != "[fe80::1]:7000" {
+		t.Errorf("host redirect gave %s", got.Addr)
+	}
+	if got, _ := redirectSpec(spec, "", 7001); got.Addr != "192.168.1.10:7001" {
+		t.Errorf("port redirect gave %s", got.Addr)
+	}
+	if _, err := redirectSpec(dialSpec{Mux: &Mux{}}, "10.0.0.1", 0); err != errRedirectMux {
+		t.Errorf("mux redirect gave %v", err)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+// builtinTranslations cover the messages a frontend sees most; the rest
+// stay in English unless set_locale supplies them. Placeholders keep the
+// catalog's names.
+var builtinTranslations = map[string]map[string]string{
+	"uk": {
+		"catalog.locale_set":                      "Мову встановлено: {locale}",
+		"catalog.message_key_not_found":           "Ключ повідомлення не знайдено: {key}",
+		"client.connected_addr":                   "Підключено до {addr}",
+		"client.connection_closed":                "З'єднання закрито",
+		"common.connection_not_found":             "З'єднання не знайдено",
+		"common.failed_connect":                   "Не вдалося підключитися до {addr}: {error}",
+		"common.failed_open":                      "Не вдалося відкрити {path}: {error}",
+		"common.invalid_payload":                  "Некоректні дані для {command}",
+		"common.job_canceled":                     "Завдання скасовано",
+		"common.not_regular_file":                 "Не звичайний файл: {path}",
+		"common.server_already_running":           "Сервер уже працює на {addr}",
+		"common.server_not_found":                 "Сервер не знайдено",
+		"common.service_shutting_down":            "Служба завершує роботу",
+		"common.transfer_not_found":               "Передачу не знайдено",
+		"common.transfer_started":                 "Передачу розпочато",
+		"config.failed_save_config":               "Не вдалося зберегти налаштування: {error}",
+		"config.saved":                            "Налаштування збережено в {path}",
+		"discovery.already_running":               "Пошук уже запущено",
+		"discovery.not_running":                   "Пошук не запущено",
+		"discovery.started":                       "Пошук {service} запущено",
+		"discovery.stopped":                       "Пошук зупинено",
+		"drop.offer_accepted":                     "Пропозицію прийнято",
+		"drop.offer_rejected":                     "Пропозицію відхилено",
+		"errors.failed_bind":                      "Не вдалося зайняти {addr}: {error}",
+		"groups.group_already_exists":             "Група вже існує: {name}",
+		"groups.group_created":                    "Групу створено: {name}",
+		"groups.group_deleted":                    "Групу видалено: {name}",
+		"groups.group_not_found":                  "Групу не знайдено: {group}",
+		"guardrails.message_exceeds_maximum_size": "Повідомлення перевищує максимальний розмір",
+		"main.server_started":                     "Сервер запущено на {addr}",
+		"main.server_stopped":                     "Сервер зупинено",
+		"main.unknown_command":                    "Невідома команда: {command}",
+		"mux.link_closed":                         "Канал закрито",
+		"mux.link_not_found":                      "Канал не знайдено",
+		"pause.transfer_paused":                   "Передачу призупинено",
+		"pause.transfer_resumed":                  "Передачу відновлено",
+		"profiles.profile_deleted":                "Профіль видалено: {name}",
+		"profiles.profile_not_found":              "Профіль не знайдено: {name}",
+		"profiles.profile_saved":                  "Профіль збережено: {name}",
+		"version.hello":                           "Вітаю",
+	},
+	"ja": {
+		"catalog.locale_set":                      "言語を {locale} に設定しました",
+		"catalog.message_key_not_found":           "メッセージキーが見つかりません: {key}",
+		"client.connected_addr":                   "{addr} に接続しました",
+		"client.connection_closed":                "接続を閉じました",
+		"common.connection_not_found":             "接続が見つかりません",
+		"common.failed_connect":                   "{addr} に接続できませんでした: {error}",
+		"common.failed_open":                      "{path} を開けませんでした: {error}",
+		"common.invalid_payload":                  "{command} のペイロードが不正です",
+		"common.job_canceled":                     "ジョブをキャンセルしました",
+		"common.not_regular_file":                 "通常のファイルではありません: {path}",
+		"common.server_already_running":           "サーバーは既に {addr} で実行中です",
+		"common.server_not_found":                 "サーバーが見つかりません",
+		"common.service_shutting_down":            "サービスを終了しています",
+		"common.transfer_not_found":               "転送が見つかりません",
+		"common.transfer_started":                 "転送を開始しました",
+		"config.failed_save_config":               "設定を保存できませんでした: {error}",
+		"config.saved":                            "設定を {path} に保存しました",
+		"discovery.already_running":               "検出は既に実行中です",
+		"discovery.not_running":                   "検出は実行されていません",
+		"discovery.started":                       "{service} の検出を開始しました",
+		"discovery.stopped":                       "検出を停止しました",
+		"drop.offer_accepted":                     "受信を承諾しました",
+		"drop.offer_rejected":                     "受信を拒否しました",
+		"errors.failed_bind":                      "{addr} にバインドできませんでした: {error}",
+		"groups.group_already_exists":             "グループは既に存在します: {name}",
+		"groups.group_created":                    "グループを作成しました: {name}",
+		"groups.group_deleted":                    "グループを削除しました: {name}",
+		"groups.group_not_found":                  "グループが見つかりません: {group}",
+		"guardrails.message_exceeds_maximum_size": "メッセージが最大サイズを超えています",
+		"main.server_started":                     "サーバーを {addr} で開始しました",
+		"main.server_stopped":                     "サーバーを停止しました",
+		"main.unknown_command":                    "不明なコマンド: {command}",
+		"mux.link_closed":                         "リンクを閉じました",
+		"mux.link_not_found":                      "リンクが見つかりません",
+		"pause.transfer_paused":                   "転送を一時停止しました",
+		"pause.transfer_resumed":                  "転送を再開しました",
+		"profiles.profile_deleted":                "プロファイルを削除しました: {name}",
+		"profiles.profile_not_found":              "プロファイルが見つかりません: {name}",
+		"profiles.profile_saved":                  "プロファイルを保存しました: {name}",
+		"version.hello":                           "こんにちは",
+	},
+}
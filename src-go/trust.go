@@ -0,0 +1,473 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Every node has a stable X25519 identity, saved next to the config, and
+// advertises its public key in the discovery TXT record. Peers seen through
+// discovery or an encrypted handshake are remembered by key fingerprint in
+// the trust store. Trusted peers count as pinned on encrypted listeners;
+// blocked peers are dropped as soon as they are recognised, before their
+// connection is admitted or, on encrypted listeners, right after the
+// handshake.
+const (
+	trustUnknown = "unknown"
+	trustTrusted = "trusted"
+	trustBlocked = "blocked"
+
+	identityTXTKey   = "lumina_key="
+	maxKnownPeerAddr = 8
+)
+
+// KnownPeer is a peer identity the trust store remembers
+type KnownPeer struct {
+	Fingerprint string    `json:"fingerprint"`
+	PublicKey   string    `json:"public_key"`
+	Name        string    `json:"name,omitempty"`     // set by trust_peer or rename_peer
+	Instance    string    `json:"instance,omitempty"` // last discovery instance name
+	Trust       string    `json:"trust"`              // "unknown", "trusted", "blocked"
+	Addrs       []string  `json:"addrs,omitempty"`    // recent IP addresses, newest first
+	FirstSeen   time.Time `json:"first_seen"`
+	LastSeen    time.Time `json:"last_seen"`
+}
+
+// PeerStore is the trust store and the file it is saved to
+type PeerStore struct {
+	mu    sync.Mutex
+	path  string
+	peers map[string]*KnownPeer // fingerprint -> peer
+}
+
+var trust = PeerStore{peers: make(map[string]*KnownPeer)}
+
+func identityPath(configPath string) string {
+	return filepath.Join(filepath.Dir(configPath), "lumina-identity.key")
+}
+
+func trustPath(configPath string) string {
+	return filepath.Join(filepath.Dir(configPath), "lumina-peers.json")
+}
+
+// Load reads path into the store; a missing file is an empty store
+func (s *PeerStore) Load(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.path = path
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var list []*KnownPeer
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("parse %s: %w", path, err)
+	}
+	for _, p := range list {
+		s.peers[p.Fingerprint] = p
+	}
+	return nil
+}
+
+func (s *PeerStore) listLocked() []KnownPeer {
+	list := make([]KnownPeer, 0, len(s.peers))
+	for _, p := range s.peers {
+		list = append(list, *p)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].FirstSeen.Before(list[j].FirstSeen) })
+	return list
+}
+
+// saveLocked writes the store atomically, like the config
+func (s *PeerStore) saveLocked() error {
+	if s.path == "" {
+		return nil
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(s.listLocked()); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(s.path+".tmp", buf.Bytes(), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(s.path+".tmp", s.path)
+}
+
+// observe records that the peer holding pub was seen at addrs, under
+// instance if it came through discovery, and returns its current entry
+func (s *PeerStore) observe(pub []byte, instance string, addrs ...string) KnownPeer {
+	fp := Fingerprint(pub)
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, known := s.peers[fp]
+	if !known {
+		p = &KnownPeer{
+			Fingerprint: fp,
+			PublicKey:   base64.StdEncoding.EncodeToString(pub),
+			Trust:       trustUnknown,
+			FirstSeen:   now,
+		}
+		s.peers[fp] = p
+	}
+	p.LastSeen = now
+	changed := !known
+	if instance != "" && instance != p.Instance {
+		p.Instance, changed = instance, true
+	}
+	for i := len(addrs) - 1; i >= 0; i-- {
+		if len(p.Addrs) == 0 || !sameHost(p.Addrs[0], addrs[i]) {
+			p.Addrs = append([]string{addrs[i]}, removeAddr(p.Addrs, addrs[i])...)
+			changed = true
+		}
+	}
+	if len(p.Addrs) > maxKnownPeerAddr {
+		p.Addrs = p.Addrs[:maxKnownPeerAddr]
+	}
+	// A sighting alone only moves last_seen; that is saved with the next change
+	if changed {
+		if err := s.saveLocked(); err != nil {
+			logger.Warn("failed to save trust store", "path", s.path, "error", err)
+		}
+	}
+	return *p
+}
+
+func removeAddr(addrs []string, addr string) []string {
+	kept := make([]string, 0, len(addrs))
+	for _, a := range addrs {
+		if !sameHost(a, addr) {
+			kept = append(kept, a)
+		}
+	}
+	return kept
+}
+
+// byKey returns the entry for pub, if the store has one
+func (s *PeerStore) byKey(pub []byte) (KnownPeer, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.peers[Fingerprint(pub)]
+	if !ok {
+		return KnownPeer{}, false
+	}
+	return *p, true
+}
+
+// trustedName is the name a trusted key is known by; encrypted listeners
+// accept it like a pinned key
+func (s *PeerStore) trustedName(pub []byte) (string, bool) {
+	p, ok := s.byKey(pub)
+	if !ok || p.Trust != trustTrusted {
+		return "", false
+	}
+	return p.displayName(), true
+}
+
+// blockedAddr reports the blocked peer last seen at the host of addr
+func (s *PeerStore) blockedAddr(addr net.Addr) (KnownPeer, bool) {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return KnownPeer{}, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range s.peers {
+		if p.Trust != trustBlocked {
+			continue
+		}
+		for _, a := range p.Addrs {
+			if sameHost(a, host) {
+				return *p, true
+			}
+		}
+	}
+	return KnownPeer{}, false
+}
+
+// atHost returns the peer most recently seen at host
+func (s *PeerStore) atHost(host string) (KnownPeer, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var found *KnownPeer
+	for _, p := range s.peers {
+		if found != nil && !p.LastSeen.After(found.LastSeen) {
+			continue
+		}
+		for _, a := range p.Addrs {
+			if sameHost(a, host) {
+				found = p
+				break
+			}
+		}
+	}
+	if found == nil {
+		return KnownPeer{}, false
+	}
+	return *found, true
+}
+
+// lookupLocked resolves a name, instance, fingerprint or base64 key to a peer
+func (s *PeerStore) lookupLocked(ref string) *KnownPeer {
+	if p, ok := s.peers[ref]; ok {
+		return p
+	}
+	if pub, err := decodePublicKey(ref); err == nil {
+		if p, ok := s.peers[Fingerprint(pub)]; ok {
+			return p
+		}
+	}
+	for _, p := range s.peers {
+		if p.Name == ref {
+			return p
+		}
+	}
+	for _, p := range s.peers {
+		if p.Instance == ref {
+			return p
+		}
+	}
+	return nil
+}
+
+func (p *KnownPeer) displayName() string {
+	switch {
+	case p.Name != "":
+		return p.Name
+	case p.Instance != "":
+		return p.Instance
+	}
+	return p.Fingerprint
+}
+
+// identityText is the TXT entry discovery advertises our key with
+func identityText() (string, error) {
+	key, err := keys.Identity()
+	if err != nil {
+		return "", err
+	}
+	return identityTXTKey + base64.StdEncoding.EncodeToString(key.PublicKey().Bytes()), nil
+}
+
+// textIdentity finds the advertised key in a discovery TXT record
+func textIdentity(text []string) ([]byte, bool) {
+	for _, t := range text {
+		if len(t) > len(identityTXTKey) && t[:len(identityTXTKey)] == identityTXTKey {
+			pub, err := decodePublicKey(t[len(identityTXTKey):])
+			return pub, err == nil
+		}
+	}
+	return nil, false
+}
+
+// rejectBlocked reports a connection refused because its peer is blocked
+func rejectBlocked(l *Listener, remote string, p KnownPeer, stage string) {
+	logger.Warn("blocked peer rejected", "listener", l.Addr, "remote", remote, "fingerprint", p.Fingerprint, "stage", stage)
+	emitEvent("peer_blocked", map[string]interface{}{
+		"listener":    l.Addr,
+		"listener_id": l.ID,
+		"remote":      remote,
+		"fingerprint": p.Fingerprint,
+		"name":        p.displayName(),
+		"stage":       stage, // "accept", "handshake"
+	})
+}
+
+// dropBlockedConns closes the open connections of a peer that was just blocked
+func dropBlockedConns(p KnownPeer) int {
+	state.Mutex.Lock()
+	conns := make([]*Connection, 0, len(state.Conns))
+	for _, c := range state.Conns {
+		conns = append(conns, c)
+	}
+	state.Mutex.Unlock()
+
+	dropped := 0
+	for _, c := range conns {
+		info := c.Info()
+		match := info.Secure != nil && info.Secure.Fingerprint == p.Fingerprint
+		if host, _, err := net.SplitHostPort(info.RemoteAddr); err == nil && c.Direction == "inbound" {
+			for _, a := range p.Addrs {
+				match = match || sameHost(a, host)
+			}
+		}
+		if match {
+			c.Abort()
+			dropped++
+		}
+	}
+	return dropped
+}
+
+type PeerTrustPayload struct {
+	Peer      string `json:"peer"`       // name, instance, fingerprint or public key
+	PublicKey string `json:"public_key"` // adds a peer the store has not seen yet
+	Name      string `json:"name"`
+}
+
+// resolveTrustPeer finds the peer a trust command is about, adding it when
+// the payload carries a key the store does not know yet
+func resolveTrustPeer(p PeerTrustPayload) (*KnownPeer, error) {
+	if p.PublicKey != "" {
+		pub, err := decodePublicKey(p.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		fp := Fingerprint(pub)
+		if known, ok := trust.peers[fp]; ok {
+			return known, nil
+		}
+		known := &KnownPeer{
+			Fingerprint: fp,
+			PublicKey:   p.PublicKey,
+			Trust:       trustUnknown,
+			FirstSeen:   time.Now(),
+		}
+		trust.peers[fp] = known
+		return known, nil
+	}
+	if p.Peer == "" {
+		return nil, errors.New("peer or public_key is required")
+	}
+	if known := trust.lookupLocked(p.Peer); known != nil {
+		return known, nil
+	}
+	return nil, catalogError(ErrUnsupported, "trust.unknown_peer", "peer", p.Peer)
+}
+
+func updatePeerTrust(payload json.RawMessage, writer *Output, command string, apply func(*KnownPeer, PeerTrustPayload) error) {
+	var p PeerTrustPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		sendInvalidPayload(writer, command)
+		return
+	}
+	trust.mu.Lock()
+	known, err := resolveTrustPeer(p)
+	if err == nil {
+		err = apply(known, p)
+	}
+	if err != nil {
+		trust.mu.Unlock()
+		sendFailure(writer, err)
+		return
+	}
+	err = trust.saveLocked()
+	peer := *known
+	trust.mu.Unlock()
+	if err != nil {
+		sendError(writer, message("trust.failed_save_trust_store", "error", err))
+		return
+	}
+
+	data := map[string]interface{}{"peer": peer}
+	if peer.Trust == trustBlocked {
+		data["dropped"] = dropBlockedConns(peer)
+	}
+	logger.Info("peer trust changed", "fingerprint", peer.Fingerprint, "trust", peer.Trust, "name", peer.Name)
+	emitEvent("peer_trust_changed", peer)
+	writer.Encode(okResponse(message("trust.display_name_trust", "display_name", peer.displayName(), "trust", peer.Trust), data))
+}
+
+func handleTrustPeer(payload json.RawMessage, writer *Output) {
+	updatePeerTrust(payload, writer, "trust_peer", func(k *KnownPeer, p PeerTrustPayload) error {
+		k.Trust = trustTrusted
+		if p.Name != "" {
+			k.Name = p.Name
+		}
+		return nil
+	})
+}
+
+func handleBlockPeer(payload json.RawMessage, writer *Output) {
+	updatePeerTrust(payload, writer, "block_peer", func(k *KnownPeer, p PeerTrustPayload) error {
+		k.Trust = trustBlocked
+		return nil
+	})
+}
+
+// handleUnblockPeer returns a peer to unknown, whether it was trusted or blocked
+func handleUnblockPeer(payload json.RawMessage, writer *Output) {
+	updatePeerTrust(payload, writer, "unblock_peer", func(k *KnownPeer, p PeerTrustPayload) error {
+		k.Trust = trustUnknown
+		return nil
+	})
+}
+
+func handleRenamePeer(payload json.RawMessage, writer *Output) {
+	updatePeerTrust(payload, writer, "rename_peer", func(k *KnownPeer, p PeerTrustPayload) error {
+		for _, other := range trust.peers {
+			if p.Name != "" && other != k && other.Name == p.Name {
+				return catalogError(ErrFailed, "trust.name_already_use", "name", p.Name)
+			}
+		}
+		k.Name = p.Name // empty clears it
+		return nil
+	})
+}
+
+func handleForgetPeer(payload json.RawMessage, writer *Output) {
+	var p PeerTrustPayload
+	if err := json.Unmarshal(payload, &p); err != nil || p.Peer == "" {
+		sendErrorCode(writer, ErrInvalidArgument, message("trust.forget_peer_requires_peer"), nil)
+		return
+	}
+	trust.mu.Lock()
+	known := trust.lookupLocked(p.Peer)
+	if known == nil {
+		trust.mu.Unlock()
+		sendErrorCode(writer, ErrUnsupported, message("trust.unknown_peer", "peer", p.Peer), nil)
+		return
+	}
+	delete(trust.peers, known.Fingerprint)
+	err := trust.saveLocked()
+	trust.mu.Unlock()
+	if err != nil {
+		sendError(writer, message("trust.failed_save_trust_store", "error", err))
+		return
+	}
+	writer.Encode(okResponse(message("trust.forgot_display_name", "display_name", known.displayName()), *known))
+}
+
+type ListKnownPeersPayload struct {
+	Trust string `json:"trust"` // only peers with this trust level
+}
+
+func handleListKnownPeers(payload json.RawMessage, writer *Output) {
+	var p ListKnownPeersPayload
+	if len(payload) > 0 && string(payload) != "null" {
+		if err := json.Unmarshal(payload, &p); err != nil {
+			sendInvalidPayload(writer, "list_known_peers")
+			return
+		}
+	}
+	trust.mu.Lock()
+	all := trust.listLocked()
+	trust.mu.Unlock()
+
+	peers := []KnownPeer{}
+	for _, k := range all {
+		if p.Trust == "" || k.Trust == p.Trust {
+			peers = append(peers, k)
+		}
+	}
+	writer.Encode(ProtocolResponse{Status: "ok", Data: map[string]interface{}{"peers": peers}})
+}
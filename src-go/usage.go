@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Usage accounting adds up the bytes every connection moved per peer host
+// and local calendar day, for users on metered links. Open connections are
+// sampled every usageInterval and closed ones once more as they go, and
+// the totals are saved beside the config whenever they changed. Days older
+// than maxUsageDays are dropped.
+const (
+	usageInterval = time.Minute
+	maxUsageDays  = 400
+	usageDay      = "2006-01-02"
+)
+
+// UsageRecord is what one peer moved on one day
+type UsageRecord struct {
+	Day      string `json:"day,omitempty"` // YYYY-MM-DD, local time; YYYY-MM when grouped by month
+	Peer     string `json:"peer,omitempty"`
+	BytesIn  uint64 `json:"bytes_in"`
+	BytesOut uint64 `json:"bytes_out"`
+}
+
+type usageKey struct{ day, peer string }
+
+// UsageStore holds the totals and the file they are saved to
+type UsageStore struct {
+	mu     sync.Mutex
+	path   string
+	totals map[usageKey]*UsageRecord
+	dirty  bool
+
+	// counted is how much of each open connection is already in totals
+	counted map[*Connection][2]uint64
+}
+
+var usage = UsageStore{totals: make(map[usageKey]*UsageRecord), counted: make(map[*Connection][2]uint64)}
+
+// usagePath puts the usage totals beside the config file
+func usagePath(configPath string) string {
+	return filepath.Join(filepath.Dir(configPath), "lumina-usage.json")
+}
+
+// Load reads path into the store; a missing file means nothing was used yet
+func (s *UsageStore) Load(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.path = path
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var records []UsageRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return fmt.Errorf("parse %s: %w", path, err)
+	}
+	for i := range records {
+		r := records[i]
+		if _, err := time.Parse(usageDay, r.Day); err != nil {
+			continue
+		}
+		s.totals[usageKey{r.Day, r.Peer}] = &r
+	}
+	return nil
+}
+
+// run samples open connections and saves the totals until the process exits
+func (s *UsageStore) run() {
+	ticker := time.NewTicker(usageInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.sample()
+	}
+}
+
+// sample counts what open connections moved since the last sample
+func (s *UsageStore) sample() {
+	state.Mutex.Lock()
+	open := make([]*Connection, 0, len(state.Conns))
+	for _, c := range state.Conns {
+		open = append(open, c)
+	}
+	state.Mutex.Unlock()
+
+	for _, c := range open {
+		s.account(c, false)
+	}
+	s.save()
+}
+
+// account adds what c moved since it was last counted to today's total for
+// its peer; closed connections are forgotten afterwards
+func (s *UsageStore) account(c *Connection, closed bool) {
+	in, out := c.BytesIn.Load(), c.BytesOut.Load()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prev := s.counted[c]
+	if closed {
+		delete(s.counted, c)
+	} else {
+		s.counted[c] = [2]uint64{in, out}
+	}
+	if in == prev[0] && out == prev[1] {
+		return
+	}
+	peer := c.RemoteAddr().String()
+	if ap, err := netip.ParseAddrPort(peer); err == nil {
+		peer = ap.Addr().WithZone("").Unmap().String()
+	} else if host, _, err := net.SplitHostPort(peer); err == nil {
+		peer = host
+	}
+	key := usageKey{time.Now().Format(usageDay), peer}
+	r := s.totals[key]
+	if r == nil {
+		r = &UsageRecord{Day: key.day, Peer: key.peer}
+		s.totals[key] = r
+	}
+	r.BytesIn += in - prev[0]
+	r.BytesOut += out - prev[1]
+	s.dirty = true
+}
+
+// save writes the totals if they changed, dropping expired days first
+func (s *UsageStore) save() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.dirty || s.path == "" {
+		return
+	}
+	oldest := time.Now().AddDate(0, 0, -maxUsageDays).Format(usageDay)
+	records := make([]UsageRecord, 0, len(s.totals))
+	for key, r := range s.totals {
+		if key.day < oldest {
+			delete(s.totals, key)
+			continue
+		}
+		records = append(records, *r)
+	}
+	sortUsage(records)
+
+	var buf bytes.Buffer
+	err := json.NewEncoder(&buf).Encode(records)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(s.path), 0o755)
+	}
+	if err == nil {
+		err = os.WriteFile(s.path+".tmp", buf.Bytes(), 0o644)
+	}
+	if err == nil {
+		err = os.Rename(s.path+".tmp", s.path)
+	}
+	if err != nil {
+		logger.Warn("failed to save usage", "path", s.path, "error", err)
+		return
+	}
+	s.dirty = false
+}
+
+func sortUsage(records []UsageRecord) {
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Day != records[j].Day {
+			return records[i].Day < records[j].Day
+		}
+		return records[i].Peer < records[j].Peer
+	})
+}
+
+type GetUsagePayload struct {
+	Peer    string `json:"peer"`     // host, or instance name of a discovered peer
+	Since   string `json:"since"`    // first day included, YYYY-MM-DD
+	Until   string `json:"until"`    // last day included, YYYY-MM-DD
+	Month   string `json:"month"`    // YYYY-MM, shorthand for that month's days
+	GroupBy string `json:"group_by"` // "day" and peer (default), "day", "peer", "month"
+}
+
+// handleGetUsage returns matching totals, grouped as asked, and their sum
+func handleGetUsage(payload json.RawMessage, writer *Output) {
+	var p GetUsagePayload
+	if len(payload) > 0 && string(payload) != "null" {
+		if err := json.Unmarshal(payload, &p); err != nil {
+			sendInvalidPayload(writer, "get_usage")
+			return
+		}
+	}
+	for _, day := range []string{p.Since, p.Until} {
+		if _, err := time.Parse(usageDay, day); day != "" && err != nil {
+			sendErrorCode(writer, ErrInvalidArgument, message("usage.since_until_must_yyyy"), nil)
+			return
+		}
+	}
+	if _, err := time.Parse("2006-01", p.Month); p.Month != "" && err != nil {
+		sendErrorCode(writer, ErrInvalidArgument, message("usage.month_must_yyyy_mm"), nil)
+		return
+	}
+	group := func(r UsageRecord) usageKey { return usageKey{r.Day, r.Peer} }
+	switch p.GroupBy {
+	case "":
+	case "day":
+		group = func(r UsageRecord) usageKey { return usageKey{day: r.Day} }
+	case "peer":
+		group = func(r UsageRecord) usageKey { return usageKey{peer: r.Peer} }
+	case "month":
+		group = func(r UsageRecord) usageKey { return usageKey{day: r.Day[:7]} }
+	default:
+		sendErrorCode(writer, ErrUnsupported, message("usage.unsupported_group", "group_by", p.GroupBy), nil)
+		return
+	}
+	// A discovered peer's name stands for all of its addresses
+	var hosts []string
+	if p.Peer != "" {
+		hosts = append(hosts, normalizeHost(p.Peer))
+		discovery.Mutex.Lock()
+		if peer, ok := discovery.Peers[p.Peer]; ok {
+			hosts = append(append(hosts, peer.IPv4...), peer.IPv6...)
+		}
+		discovery.Mutex.Unlock()
+	}
+
+	// Count what open connections moved up to now
+	usage.sample()
+
+	groups := make(map[usageKey]*UsageRecord)
+	var total UsageRecord
+	usage.mu.Lock()
+	for _, r := range usage.totals {
+		switch {
+		case hosts != nil && !slices.ContainsFunc(hosts, func(h string) bool { return h == r.Peer || sameHost(h, r.Peer) }):
+			continue
+		case p.Since != "" && r.Day < p.Since, p.Until != "" && r.Day > p.Until:
+			continue
+		case p.Month != "" && r.Day[:7] != p.Month:
+			continue
+		}
+		key := group(*r)
+		g := groups[key]
+		if g == nil {
+			g = &UsageRecord{Day: key.day, Peer: key.peer}
+			groups[key] = g
+		}
+		g.BytesIn += r.BytesIn
+		g.BytesOut += r.BytesOut
+		total.BytesIn += r.BytesIn
+		total.BytesOut += r.BytesOut
+	}
+	usage.mu.Unlock()
+
+	records := make([]UsageRecord, 0, len(groups))
+	for _, g := range groups {
+		records = append(records, *g)
+	}
+	sortUsage(records)
+	writer.Encode(ProtocolResponse{
+		Status: "ok",
+		Data: map[string]interface{}{
+			"usage":     records,
+			"bytes_in":  total.BytesIn,
+			"bytes_out": total.BytesOut,
+		},
+	})
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"runtime"
+	"sort"
+)
+
+// version is the build's release, set with -ldflags "-X main.version=..."
+var version = "dev"
+
+// protocolVersion counts breaking changes to the request/response protocol.
+// Additions such as new commands, fields and events do not bump it; the
+// frontend finds those through features instead.
+const (
+	protocolVersion    = 1
+	minProtocolVersion = 1 // oldest frontend protocol this build still serves
+)
+
+// transferProtocolVersion counts breaking changes to what peers say to each
+// other over a transfer connection; discovery advertises it
+const transferProtocolVersion = 1
+
+// features are capability flags the frontend can check before relying on
+// a subsystem. Keep them sorted and stable: a flag is only ever added,
+// never renamed.
+var features = []string{
+	"accept_filter",
+	"address_family",
+	"archive",
+	"audit_log",
+	"auth",
+	"background_pause",
+	"broadcast",
+	"chat",
+	"chunk_checksums",
+	"chunked_payloads",
+	"clipboard",
+	"clock_offset",
+	"compression",
+	"config",
+	"control_limits",
+	"control_socket",
+	"daemon",
+	"dedup",
+	"directory_transfer",
+	"discovery",
+	"dns",
+	"doctor",
+	"drain_stop",
+	"drop_mode",
+	"encryption",
+	"error_codes",
+	"event_webhooks",
+	"firewall",
+	"folder_sync",
+	"geoip",
+	"grpc",
+	"half_close",
+	"happy_eyeballs",
+	"hash",
+	"heartbeat",
+	"history",
+	"http",
+	"http_download",
+	"jobs",
+	"lan_scan",
+	"length_framing",
+	"listener_ids",
+	"listener_recovery",
+	"localization",
+	"log_tail",
+	"media_relay",
+	"multicast",
+	"mux",
+	"namespaces",
+	"netem",
+	"network_watch",
+	"output_batching",
+	"p2p",
+	"panic_recovery",
+	"parallel_transfer",
+	"path_mtu",
+	"pause",
+	"peer_capabilities",
+	"peer_latency",
+	"ping",
+	"plaintext_transfers",
+	"port_mapping",
+	"port_owner",
+	"port_scan",
+	"profiles",
+	"prometheus",
+	"proxy",
+	"queue",
+	"quic",
+	"rate_limit",
+	"raw_channel",
+	"receive_policy",
+	"reconnect_backoff",
+	"rekey",
+	"relay",
+	"request_ids",
+	"resume",
+	"schedule",
+	"self_update",
+	"serial_bridge",
+	"sftp",
+	"share_links",
+	"sleep_hooks",
+	"socket_options",
+	"socks5",
+	"speedtest",
+	"state_snapshot",
+	"stats_subscriptions",
+	"status_delta",
+	"storage_backends",
+	"storage_quota",
+	"strict_payloads",
+	"stun",
+	"tap",
+	"text_push",
+	"tls",
+	"traceroute",
+	"transfer",
+	"transfer_hooks",
+	"transfer_priority",
+	"transfer_sessions",
+	"trust",
+	"udp",
+	"udp_hole_punch",
+	"usage",
+	"wake_on_lan",
+	"websocket",
+}
+
+func hasFeature(name string) bool {
+	i := sort.SearchStrings(features, name)
+	return i < len(features) && features[i] == name
+}
+
+type HelloPayload struct {
+	ProtocolVersion int      `json:"protocol_version"` // the frontend's, 0 when it does not say
+	Features        []string `json:"features"`         // features the frontend wants to use
+}
+
+// handleHello lets the frontend adapt to whichever sidecar build it runs
+// with. The answer is the protocol version both sides speak, what this build
+// supports and which of the requested features it lacks.
+func handleHello(payload json.RawMessage, writer *Output) {
+	var p HelloPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		sendInvalidPayload(writer, "hello")
+		return
+	}
+
+	negotiated := protocolVersion
+	if p.ProtocolVersion > 0 && p.ProtocolVersion < negotiated {
+		negotiated = p.ProtocolVersion
+	}
+	missing := []string{}
+	for _, f := range p.Features {
+		if !hasFeature(f) {
+			missing = append(missing, f)
+		}
+	}
+	listenerTypes := []string{"http", "ws"}
+	for typ := range connHandlers {
+		listenerTypes = append(listenerTypes, typ)
+	}
+	sort.Strings(listenerTypes)
+
+	compatible := p.ProtocolVersion == 0 || p.ProtocolVersion >= minProtocolVersion
+	m := message("version.hello")
+	if !compatible {
+		m = message("version.frontend_protocol_older")
+	}
+	host, _ := os.Hostname()
+	writer.Encode(okResponse(m, map[string]interface{}{
+		"version":              version,
+		"protocol_version":     negotiated,
+		"max_protocol_version": protocolVersion,
+		"min_protocol_version": minProtocolVersion,
+		"compatible":           compatible,
+		"features":             features,
+		"missing":              missing,
+		"listener_types":       listenerTypes,
+		"go_version":           runtime.Version(),
+		"os":                   runtime.GOOS,
+		"arch":                 runtime.GOARCH,
+		"hostname":             host,
+		"pid":                  os.Getpid(),
+	}))
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"sort"
+	"testing"
+)
+
+// hasFeature searches features, so it must stay sorted
+func TestFeaturesSorted(t *testing.T) {
+	if !sort.StringsAreSorted(features) {
+		for i := 1; i < len(features); i++ {
+			if features[i-1] >= features[i] {
+				t.Errorf("%q sorts before %q", features[i], features[i-1])
+			}
+		}
+		t.FailNow()
+	}
+	for _, name := range features {
+		if !hasFeature(name) {
+			t.Errorf("hasFeature(%q) is false", name)
+		}
+	}
+}
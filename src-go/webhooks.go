@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event webhooks forward chosen events, such as transfer_completed,
+// peer_found or listener_down, to URLs outside the app: each one is POSTed
+// as {"event", "time", "namespace", "data"} JSON. With a secret set, the
+// body is signed with HMAC-SHA256 in X-Lumina-Signature the way GitHub
+// signs its webhooks. A delivery that fails or gets a 5xx or 429 answer is
+// retried with growing delays; X-Lumina-Delivery stays the same across
+// retries, so a receiver can drop duplicates. Each webhook has its own
+// queue and sender, so a slow endpoint holds up neither emitEvent nor the
+// other webhooks; a full queue drops the newest events. A delivery that
+// gives up emits webhook_failed, and webhook_* events are never forwarded.
+const (
+	defaultWebhookRetries = 3
+	maxWebhookRetries     = 10
+	defaultWebhookTimeout = 10 * time.Second
+	webhookRetryDelay     = time.Second // doubled after each failed attempt
+	webhookQueueSize      = 256
+)
+
+// EventWebhook is one entry of the config's webhooks
+type EventWebhook struct {
+	Name      string            `json:"name,omitempty"` // shown in webhook_failed; default the URL
+	URL       string            `json:"url"`
+	Events    []string          `json:"events"`           // event types to forward, "*" for all
+	Secret    string            `json:"secret,omitempty"` // HMAC key for X-Lumina-Signature
+	Headers   map[string]string `json:"headers,omitempty"`
+	Retries   int               `json:"retries,omitempty"`    // after the first attempt, default 3; -1 for none
+	TimeoutMs int               `json:"timeout_ms,omitempty"` // per attempt, default 10 seconds
+}
+
+func (w EventWebhook) Validate() error {
+	u, err := url.Parse(w.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return catalogError(ErrFailed, "webhooks.webhooks_need_http")
+	}
+	if len(w.Events) == 0 {
+		return catalogError(ErrFailed, "webhooks.webhooks_need_least")
+	}
+	if w.Retries < -1 || w.Retries > maxWebhookRetries {
+		return catalogError(ErrInvalidArgument, "webhooks.webhook_retries_must_between", "max", maxWebhookRetries)
+	}
+	if w.TimeoutMs < 0 {
+		return catalogError(ErrInvalidArgument, "webhooks.webhook_timeout_ms_must")
+	}
+	return nil
+}
+
+func (w EventWebhook) name() string {
+	if w.Name != "" {
+		return w.Name
+	}
+	return w.URL
+}
+
+func (w EventWebhook) matches(event string) bool {
+	return !strings.HasPrefix(event, "webhook_") && (slices.Contains(w.Events, "*") || slices.Contains(w.Events, event))
+}
+
+func (w EventWebhook) retries() int {
+	switch {
+	case w.Retries < 0:
+		return 0
+	case w.Retries == 0:
+		return defaultWebhookRetries
+	}
+	return w.Retries
+}
+
+func (w EventWebhook) timeout() time.Duration {
+	if w.TimeoutMs > 0 {
+		return time.Duration(w.TimeoutMs) * time.Millisecond
+	}
+	return defaultWebhookTimeout
+}
+
+// validateWebhooks checks the config's webhooks
+func validateWebhooks(hooks []EventWebhook) error {
+	var names []string
+	for i, w := range hooks {
+		if err := w.Validate(); err != nil {
+			return fmt.Errorf("webhook %d: %v", i+1, err)
+		}
+		if slices.Contains(names, w.name()) {
+			return catalogError(ErrFailed, "webhooks.duplicate_webhook_name", "name", w.name())
+		}
+		names = append(names, w.name())
+	}
+	return nil
+}
+
+// webhookDelivery is one event on its way to one webhook
+type webhookDelivery struct {
+	hook  EventWebhook
+	event string
+	id    string
+	body  []byte
+}
+
+// webhookQueues holds a queue per webhook name; each has a sender
+// goroutine from the first event on
+var webhookQueues = struct {
+	mu     sync.Mutex
+	queues map[string]chan webhookDelivery
+}{queues: make(map[string]chan webhookDelivery)}
+
+// forwardWebhooks queues ev for every webhook that wants it. It never
+// blocks.
+func forwardWebhooks(ev ProtocolEvent) {
+	hooks := config.Get().Webhooks
+	var body []byte
+	for _, w := range hooks {
+		if !w.matches(ev.Event) {
+			continue
+		}
+		if body == nil {
+			var err error
+			body, err = json.Marshal(map[string]interface{}{
+				"event":     ev.Event,
+				"time":      time.Now().UTC().Format(time.RFC3339Nano),
+				"namespace": ev.Namespace,
+				"data":      ev.Data,
+			})
+			if err != nil {
+				return
+			}
+		}
+		id := make([]byte, 8)
+		rand.Read(id)
+		d := webhookDelivery{hook: w, event: ev.Event, id: hex.EncodeToString(id), body: body}
+		select {
+		case webhookQueue(w.name()) <- d:
+		default:
+			logger.Warn("webhook queue full, event dropped", "webhook", w.name(), "event", ev.Event)
+		}
+	}
+}
+
+func webhookQueue(name string) chan webhookDelivery {
+	webhookQueues.mu.Lock()
+	defer webhookQueues.mu.Unlock()
+	q, ok := webhookQueues.queues[name]
+	if !ok {
+		q = make(chan webhookDelivery, webhookQueueSize)
+		webhookQueues.queues[name] = q
+		go func() {
+			for d := range q {
+				// One bad delivery must not stop the queue behind it
+				func() {
+					defer recoverPanic("webhook " + name)
+					d.send()
+				}()
+			}
+		}()
+	}
+	return q
+}
+
+// send delivers d, retrying as the webhook allows
+func (d webhookDelivery) send() {
+	client := downloadClient("", d.hook.timeout())
+	client.Timeout = d.hook.timeout()
+	delay := webhookRetryDelay
+	var err error
+	attempts := 0
+	for attempts <= d.hook.retries() {
+		if attempts > 0 {
+			<-clock.After(delay)
+			delay *= 2
+		}
+		attempts++
+		var retry bool
+		if retry, err = d.post(client); err == nil || !retry {
+			break
+		}
+	}
+	if err != nil {
+		logger.Warn("webhook delivery failed", "webhook", d.hook.name(), "event", d.event, "attempts", attempts, "error", err)
+		emitEvent("webhook_failed", map[string]interface{}{
+			"webhook":  d.hook.name(),
+			"event":    d.event,
+			"delivery": d.id,
+			"attempts": attempts,
+			"error":    err.Error(),
+		})
+	}
+}
+
+// post makes one attempt and says whether a failure is worth retrying
+func (d webhookDelivery) post(client *http.Client) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, d.hook.URL, bytes.NewReader(d.body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "lumina-net/"+version)
+	for k, v := range d.hook.Headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("X-Lumina-Event", d.event)
+	req.Header.Set("X-Lumina-Delivery", d.id)
+	if d.hook.Secret != "" {
+		req.Header.Set("X-Lumina-Signature", webhookSignature(d.hook.Secret, d.body))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		return retry, fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return false, nil
+}
+
+// webhookSignature is the X-Lumina-Signature of body: "sha256=" and the
+// hex HMAC-SHA256 of the body under the webhook's secret
+func webhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
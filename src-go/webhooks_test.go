@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWebhookRetriesAndSigns(t *testing.T) {
+	type received struct {
+		body               []byte
+		signature, deliver string
+	}
+	got := make(chan received, 4)
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		got <- received{body, r.Header.Get("X-Lumina-Signature"), r.Header.Get("X-Lumina-Delivery")}
+	}))
+	defer srv.Close()
+
+	config.mu.Lock()
+	saved := config.cfg
+	config.cfg.Webhooks = []EventWebhook{{Name: "home", URL: srv.URL, Events: []string{"transfer_completed"}, Secret: "s3cret"}}
+	config.mu.Unlock()
+	t.Cleanup(func() {
+		config.mu.Lock()
+		config.cfg = saved
+		config.mu.Unlock()
+	})
+
+	forwardWebhooks(ProtocolEvent{Event: "transfer_progress", Data: map[string]interface{}{"id": "t1"}})
+	forwardWebhooks(ProtocolEvent{Event: "transfer_completed", Data: map[string]interface{}{"id": "t1", "name": "a.txt"}})
+
+	select {
+	case r := <-got:
+		if r.signature != webhookSignature("s3cret", r.body) {
+			t.Errorf("signature %q does not match the body", r.signature)
+		}
+		var ev struct {
+			Event string            `json:"event"`
+			Data  map[string]string `json:"data"`
+		}
+		if err := json.Unmarshal(r.body, &ev); err != nil || ev.Event != "transfer_completed" || ev.Data["name"] != "a.txt" {
+			t.Errorf("forwarded %s (%v)", r.body, err)
+		}
+		if r.deliver == "" {
+			t.Error("no delivery id")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("event not delivered after a failed attempt")
+	}
+	if n := calls.Load(); n != 2 {
+		t.Errorf("%d attempts, want the failure and one retry", n)
+	}
+}
+
+func TestWebhookValidation(t *testing.T) {
+	cases := []EventWebhook{
+		{URL: "ftp://example.com", Events: []string{"*"}},
+		{URL: "https://example.com"},
+		{URL: "https://example.com", Events: []string{"*"}, Retries: -2},
+	}
+	for _, w := range cases {
+		if err := w.Validate(); err == nil {
+			t.Errorf("%+v accepted", w)
+		}
+	}
+	dup := []EventWebhook{{URL: "https://example.com", Events: []string{"*"}}, {URL: "https://example.com", Events: []string{"peer_found"}}}
+	if err := validateWebhooks(dup); err == nil {
+		t.Error("two webhooks with the same name accepted")
+	}
+	if (EventWebhook{Events: []string{"*"}}).matches("webhook_failed") {
+		t.Error("webhook events would be forwarded")
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+	// The Tauri webview and LAN browsers connect from arbitrary origins
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// wsConn adapts a WebSocket to net.Conn so it can live in the connection
+// registry. Writes become one message each: text when the bytes are valid
+// UTF-8, binary otherwise.
+type wsConn struct {
+	*websocket.Conn
+	writeMu sync.Mutex // gorilla allows only one concurrent writer
+}
+
+func (w *wsConn) Read(b []byte) (int, error) {
+	_, r, err := w.NextReader()
+	if err != nil {
+		return 0, err
+	}
+	return r.Read(b)
+}
+
+func (w *wsConn) Write(b []byte) (int, error) {
+	messageType := websocket.BinaryMessage
+	if utf8.Valid(b) {
+		messageType = websocket.TextMessage
+	}
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+	if err := w.WriteMessage(messageType, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (w *wsConn) SetDeadline(t time.Time) error {
+	if err := w.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return w.SetWriteDeadline(t)
+}
+
+// serveWebSocket runs an HTTP server on ln that upgrades every request on
+// path to a WebSocket connection
+func serveWebSocket(l *Listener, ln net.Listener, path string) {
+	mux := http.NewServeMux()
+	mux.Handle(path, requireAuth(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !screenRequest(l, w, r) {
+			return
+		}
+		if !admit(l) {
+			writeJSON(w, http.StatusServiceUnavailable, ProtocolResponse{Status: "error", Message: errConnectionLimit})
+			return
+		}
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			releaseServerSlots(l)
+			return // Upgrade already replied with an HTTP error
+		}
+
+		c := trackConn(&wsConn{Conn: ws}, "inbound", "ws", l)
+		if c == nil {
+			releaseServerSlots(l)
+			ws.Close()
+			return
+		}
+		handleWebSocket(c, ws)
+	})))
+
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	srv.Serve(ln) // returns once the listener is closed
+}
+
+// handleWebSocket pushes every received frame as a connection_message event
+func handleWebSocket(c *Connection, ws *websocket.Conn) {
+	defer recoverConn(c)
+	defer untrackConn(c)
+	emitEvent("connection_opened", c.Info())
+
+	for {
+		messageType, data, err := ws.ReadMessage()
+		if err != nil {
+			emitEvent("connection_closed", map[string]interface{}{"id": c.ID, "reason": closeReason(err)})
+			return
+		}
+		c.countIn(len(data))
+
+		event := map[string]interface{}{"id": c.ID}
+		if messageType == websocket.TextMessage {
+			event["message_type"] = "text"
+			event["encoding"] = "utf8"
+			event["data"] = string(data)
+		} else {
+			event["message_type"] = "binary"
+			event["encoding"] = "base64"
+			event["data"] = base64.StdEncoding.EncodeToString(data)
+		}
+		emitEvent("connection_message", event)
+	}
+}
+
+func closeReason(err error) string {
+	if ce, ok := err.(*websocket.CloseError); ok {
+		return fmt.Sprintf("closed (%d)", ce.Code)
+	}
+	return err.Error()
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// wake_host sends Wake-on-LAN magic packets: six 0xff bytes, then the
+// target's MAC sixteen times, optionally followed by a SecureOn password.
+// They go to a broadcast address, since a sleeping host answers no ARP;
+// naming an interface picks that subnet's broadcast address and leaves
+// through it. Given a host and wait_port, it then dials until the machine
+// is up and reports the outcome in an event, so a transfer can follow.
+const (
+	defaultWoLPort       = 9
+	defaultWoLCount      = 3
+	wolPacketGap         = 100 * time.Millisecond
+	defaultWakeWait      = 2 * time.Minute
+	wakeProbeInterval    = 2 * time.Second
+	wakeProbeDialTimeout = time.Second
+)
+
+type WakeHostPayload struct {
+	MAC       string `json:"mac"`       // e.g. "aa:bb:cc:dd:ee:ff"
+	Broadcast string `json:"broadcast"` // default 255.255.255.255, or the interface's subnet broadcast
+	Port      int    `json:"port"`      // default 9; 7 is the other usual one
+	Interface string `json:"interface"` // send from this interface
+	Count     int    `json:"count"`     // packets to send, default 3
+	Password  string `json:"password"`  // SecureOn password: 4 bytes dotted or 6 like a MAC
+
+	Host          string `json:"host"`            // the machine's address, to wait for
+	WaitPort      int    `json:"wait_port"`       // a port that answers once it is up
+	WaitTimeoutMs int    `json:"wait_timeout_ms"` // how long to wait, default 2 minutes
+}
+
+// magicPacket builds the Wake-on-LAN payload for mac
+func magicPacket(mac net.HardwareAddr, password []byte) []byte {
+	packet := bytes.Repeat([]byte{0xff}, 6)
+	for i := 0; i < 16; i++ {
+		packet = append(packet, mac...)
+	}
+	return append(packet, password...)
+}
+
+// parseSecureOn reads a SecureOn password, written as four dotted
+// decimals or six hex pairs
+func parseSecureOn(s string) ([]byte, error) {
+	if s == "" {
+		return nil, nil
+	}
+	if ip := net.ParseIP(s).To4(); ip != nil && strings.Count(s, ".") == 3 {
+		return []byte(ip), nil
+	}
+	raw, err := hex.DecodeString(strings.NewReplacer(":", "", "-", "").Replace(s))
+	if err != nil || len(raw) != 6 {
+		return nil, fmt.Errorf("invalid password %q: use 4 dotted bytes or 6 hex pairs", s)
+	}
+	return raw, nil
+}
+
+// wakeSource finds the local address and broadcast address of an
+// interface's first IPv4 subnet
+func wakeSource(name string) (local *net.UDPAddr, broadcast net.IP, err error) {
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unknown interface %s", name)
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok || ipnet.IP.To4() == nil {
+			continue
+		}
+		ip, mask := ipnet.IP.To4(), net.IP(ipnet.Mask).To4()
+		if mask == nil {
+			mask = net.IP(ipnet.Mask[len(ipnet.Mask)-4:])
+		}
+		bcast := make(net.IP, 4)
+		for i := range bcast {
+			bcast[i] = ip[i] | ^mask[i]
+		}
+		return &net.UDPAddr{IP: ip}, bcast, nil
+	}
+	return nil, nil, fmt.Errorf("interface %s has no IPv4 address", name)
+}
+
+func handleWakeHost(payload json.RawMessage, writer *Output) {
+	var p WakeHostPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		sendInvalidPayload(writer, "wake_host")
+		return
+	}
+	mac, err := net.ParseMAC(p.MAC)
+	if err != nil || len(mac) != 6 {
+		sendErrorCode(writer, ErrInvalidArgument, message("wol.wake_host_requires_6"), nil)
+		return
+	}
+	password, err := parseSecureOn(p.Password)
+	if err != nil {
+		sendFailure(writer, err)
+		return
+	}
+	if p.Port == 0 {
+		p.Port = defaultWoLPort
+	}
+	if p.Port < 0 || p.Port > 65535 {
+		sendErrorCode(writer, ErrInvalidArgument, message("wol.port_must_between_1"), nil)
+		return
+	}
+	if p.Count <= 0 {
+		p.Count = defaultWoLCount
+	}
+	if p.Count > 20 {
+		sendErrorCode(writer, ErrInvalidArgument, message("wol.count_must_most_20"), nil)
+		return
+	}
+	if (p.Host == "") != (p.WaitPort == 0) {
+		sendErrorCode(writer, ErrInvalidArgument, message("wol.waiting_requires_both_host"), nil)
+		return
+	}
+
+	var local *net.UDPAddr
+	target := net.IPv4bcast
+	if p.Interface != "" {
+		if local, target, err = wakeSource(p.Interface); err != nil {
+			sendFailure(writer, err)
+			return
+		}
+	}
+	if p.Broadcast != "" {
+		if target = net.ParseIP(p.Broadcast).To4(); target == nil {
+			sendErrorCode(writer, ErrInvalidArgument, message("wol.invalid_broadcast_address", "broadcast", p.Broadcast), nil)
+			return
+		}
+	}
+
+	conn, err := net.ListenUDP("udp4", local)
+	if err != nil {
+		sendError(writer, message("common.failed_open_udp_socket", "error", err))
+		return
+	}
+	defer conn.Close()
+	dst := &net.UDPAddr{IP: target, Port: p.Port}
+	packet := magicPacket(mac, password)
+	for i := 0; i < p.Count; i++ {
+		if i > 0 {
+			time.Sleep(wolPacketGap)
+		}
+		if _, err := conn.WriteToUDP(packet, dst); err != nil {
+			sendError(writer, message("wol.failed_send_magic_packet", "dst", dst, "error", err))
+			return
+		}
+	}
+	logger.Info("magic packet sent", "mac", mac.String(), "to", dst.String(), "count", p.Count)
+
+	data := map[string]interface{}{"mac": mac.String(), "broadcast": dst.String(), "packets": p.Count}
+	if p.Host != "" {
+		wait := defaultWakeWait
+		if p.WaitTimeoutMs > 0 {
+			wait = time.Duration(p.WaitTimeoutMs) * time.Millisecond
+		}
+		addr := net.JoinHostPort(normalizeHost(p.Host), strconv.Itoa(p.WaitPort))
+		go waitForWake(mac.String(), addr, wait)
+		data["waiting_for"] = addr
+	}
+	writer.Encode(okResponse(message("wol.magic_packet_sent", "mac", mac.String()), data))
+}
+
+// waitForWake dials addr until it answers or wait runs out, then emits
+// host_awake or host_wake_timeout
+func waitForWake(mac, addr string, wait time.Duration) {
+	start := time.Now()
+	deadline := start.Add(wait)
+	for attempt := 1; ; attempt++ {
+		conn, err := net.DialTimeout("tcp", addr, wakeProbeDialTimeout)
+		if err == nil {
+			conn.Close()
+			logger.Info("woken host is up", "mac", mac, "addr", addr, "after", time.Since(start).String())
+			emitEvent("host_awake", map[string]interface{}{
+				"mac":        mac,
+				"addr":       addr,
+				"attempts":   attempt,
+				"elapsed_ms": time.Since(start).Milliseconds(),
+			})
+			return
+		}
+		if isStopping() || time.Now().Add(wakeProbeInterval).After(deadline) {
+			emitEvent("host_wake_timeout", map[string]interface{}{
+				"mac":      mac,
+				"addr":     addr,
+				"attempts": attempt,
+				"error":    err.Error(),
+			})
+			return
+		}
+		time.Sleep(wakeProbeInterval)
+	}
+}
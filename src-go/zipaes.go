@@ -0,0 +1,290 @@
+package main
+
+import (
+	"archive/zip"
+	"compress/flate"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+)
+
+// Password-protected zip entries use WinZip's AES format (AE-1), which
+// 7-Zip, WinZip and most other archive tools can open. Each entry has its
+// own salt; keys come from PBKDF2-HMAC-SHA1, the body is AES in counter
+// mode, and a truncated HMAC-SHA1 of the ciphertext follows it.
+const (
+	zipMethodAES  = 99
+	zipExtraAES   = 0x9901
+	zipAESRounds  = 1000
+	zipAESMacSize = 10
+	zipAESVerify  = 2 // password check bytes after the salt
+)
+
+var (
+	errArchivePassword = errors.New("archive is encrypted; a password is required")
+	errWrongPassword   = errors.New("wrong archive password")
+)
+
+// zipAESExtra is the extra field announcing AES-256 over method
+func zipAESExtra(method uint16) []byte {
+	b := make([]byte, 11)
+	binary.LittleEndian.PutUint16(b[0:], zipExtraAES)
+	binary.LittleEndian.PutUint16(b[2:], 7)
+	binary.LittleEndian.PutUint16(b[4:], 1) // AE-1: the CRC is kept
+	b[6], b[7] = 'A', 'E'
+	b[8] = 3 // AES-256
+	binary.LittleEndian.PutUint16(b[9:], method)
+	return b
+}
+
+// zipAESParams reads the AES extra field of an entry
+func zipAESParams(extra []byte) (version, method uint16, keySize int, ok bool) {
+	for len(extra) >= 4 {
+		id, size := binary.LittleEndian.Uint16(extra), int(binary.LittleEndian.Uint16(extra[2:]))
+		if len(extra) < 4+size {
+			return
+		}
+		if id == zipExtraAES && size >= 7 {
+			field := extra[4 : 4+size]
+			version, method = binary.LittleEndian.Uint16(field), binary.LittleEndian.Uint16(field[5:])
+			if strength := field[4]; strength >= 1 && strength <= 3 {
+				return version, method, 8 + 8*int(strength), true
+			}
+			return
+		}
+		extra = extra[4+size:]
+	}
+	return
+}
+
+// zipAESKeys derives the cipher key, MAC key and password check value;
+// the salt is half the key size
+func zipAESKeys(password string, salt []byte) (enc, mac, verify []byte, err error) {
+	keySize := 2 * len(salt)
+	key, err := pbkdf2.Key(sha1.New, password, salt, zipAESRounds, 2*keySize+zipAESVerify)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return key[:keySize], key[keySize : 2*keySize], key[2*keySize:], nil
+}
+
+// zipCTR is AES in counter mode with WinZip's little-endian counter,
+// which starts at 1
+type zipCTR struct {
+	block   cipher.Block
+	counter [aes.BlockSize]byte
+	stream  [aes.BlockSize]byte
+	used    int
+}
+
+func newZipCTR(key []byte) (*zipCTR, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &zipCTR{block: block, used: aes.BlockSize}, nil
+}
+
+func (z *zipCTR) XORKeyStream(dst, src []byte) {
+	for i := range src {
+		if z.used == aes.BlockSize {
+			for j := range z.counter {
+				z.counter[j]++
+				if z.counter[j] != 0 {
+					break
+				}
+			}
+			z.block.Encrypt(z.stream[:], z.counter[:])
+			z.used = 0
+		}
+		dst[i] = src[i] ^ z.stream[z.used]
+		z.used++
+	}
+}
+
+// zipAESSink encrypts and authenticates the deflated body on its way out
+type zipAESSink struct {
+	w    io.Writer
+	ctr  *zipCTR
+	mac  hash.Hash
+	buf  []byte
+	head []byte // salt and password check, held back until the entry header is out
+}
+
+func (s *zipAESSink) Write(b []byte) (int, error) {
+	if err := s.writeHead(); err != nil {
+		return 0, err
+	}
+	if cap(s.buf) < len(b) {
+		s.buf = make([]byte, len(b))
+	}
+	out := s.buf[:len(b)]
+	s.ctr.XORKeyStream(out, b)
+	s.mac.Write(out)
+	if _, err := s.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// writeHead sends the salt and password check before the first ciphertext;
+// zip.Writer builds the compressor before it writes the entry header
+func (s *zipAESSink) writeHead() error {
+	if s.head == nil {
+		return nil
+	}
+	_, err := s.w.Write(s.head)
+	s.head = nil
+	return err
+}
+
+// zipAESWriter compresses an entry and encrypts it; Close writes the MAC
+type zipAESWriter struct {
+	*flate.Writer
+	sink *zipAESSink
+}
+
+// newZipAESWriter is a zip compressor for method 99 that deflates at level
+func newZipAESWriter(w io.Writer, password string, level int) (io.WriteCloser, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	enc, macKey, verify, err := zipAESKeys(password, salt)
+	if err != nil {
+		return nil, err
+	}
+	ctr, err := newZipCTR(enc)
+	if err != nil {
+		return nil, err
+	}
+	sink := &zipAESSink{w: w, ctr: ctr, mac: hmac.New(sha1.New, macKey), head: append(salt, verify...)}
+	if level == 0 {
+		level = flate.DefaultCompression
+	}
+	fw, err := flate.NewWriter(sink, level)
+	if err != nil {
+		return nil, err
+	}
+	return &zipAESWriter{Writer: fw, sink: sink}, nil
+}
+
+func (z *zipAESWriter) Close() error {
+	if err := z.Writer.Close(); err != nil {
+		return err
+	}
+	if err := z.sink.writeHead(); err != nil {
+		return err
+	}
+	_, err := z.sink.w.Write(z.sink.mac.Sum(nil)[:zipAESMacSize])
+	return err
+}
+
+// zipAESReader decrypts an entry body and checks its MAC at the end
+type zipAESReader struct {
+	raw   io.Reader
+	body  io.Reader // the ciphertext, limited to its length
+	ctr   *zipCTR
+	mac   hash.Hash
+	crc   hash.Hash32 // nil when the entry carries no CRC (AE-2)
+	want  uint32
+	plain io.Reader
+
+	verified bool // the MAC has been checked
+}
+
+func (r *zipAESReader) Read(b []byte) (int, error) {
+	n, err := r.plain.Read(b)
+	if r.crc != nil {
+		r.crc.Write(b[:n])
+	}
+	if err != io.EOF {
+		return n, err
+	}
+	// The decompressor may stop short of the end of the ciphertext
+	if _, derr := io.Copy(io.Discard, cipherReader{r}); derr != nil {
+		return n, derr
+	}
+	if r.crc != nil && r.crc.Sum32() != r.want {
+		return n, zip.ErrChecksum
+	}
+	return n, io.EOF
+}
+
+// cipherReader decrypts what the plaintext reader asks for
+type cipherReader struct{ r *zipAESReader }
+
+func (c cipherReader) Read(b []byte) (int, error) {
+	n, err := c.r.body.Read(b)
+	c.r.mac.Write(b[:n])
+	c.r.ctr.XORKeyStream(b[:n], b[:n])
+	if err == io.EOF && !c.r.verified {
+		c.r.verified = true
+		code := make([]byte, zipAESMacSize)
+		if _, rerr := io.ReadFull(c.r.raw, code); rerr != nil {
+			return n, rerr
+		}
+		if !hmac.Equal(code, c.r.mac.Sum(nil)[:zipAESMacSize]) {
+			return n, errors.New("archive entry failed authentication")
+		}
+	}
+	return n, err
+}
+
+func (r *zipAESReader) Close() error { return nil }
+
+// openZipAES opens an AES-encrypted entry with password
+func openZipAES(f *zip.File, password string) (io.ReadCloser, error) {
+	version, method, keySize, ok := zipAESParams(f.Extra)
+	if !ok {
+		return nil, errors.New("unsupported zip encryption in " + f.Name)
+	}
+	if password == "" {
+		return nil, errArchivePassword
+	}
+	raw, err := f.OpenRaw()
+	if err != nil {
+		return nil, err
+	}
+	saltSize := keySize / 2
+	head := make([]byte, saltSize+zipAESVerify)
+	if _, err := io.ReadFull(raw, head); err != nil {
+		return nil, err
+	}
+	enc, macKey, verify, err := zipAESKeys(password, head[:saltSize])
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(verify, head[saltSize:]) {
+		return nil, errWrongPassword
+	}
+	size := int64(f.CompressedSize64) - int64(len(head)) - zipAESMacSize
+	if size < 0 {
+		return nil, errors.New("truncated archive entry " + f.Name)
+	}
+	ctr, err := newZipCTR(enc)
+	if err != nil {
+		return nil, err
+	}
+	r := &zipAESReader{raw: raw, body: io.LimitReader(raw, size), ctr: ctr, mac: hmac.New(sha1.New, macKey), want: f.CRC32}
+	if version == 1 {
+		r.crc = crc32.NewIEEE()
+	}
+	switch method {
+	case zip.Store:
+		r.plain = cipherReader{r}
+	case zip.Deflate:
+		r.plain = flate.NewReader(cipherReader{r})
+	default:
+		return nil, errors.New("unsupported compression in " + f.Name)
+	}
+	return r, nil
+}